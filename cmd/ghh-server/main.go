@@ -3,12 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github-hub/internal/metrics"
 	srv "github-hub/internal/server"
 	"github-hub/internal/version"
 )
@@ -31,6 +35,7 @@ func main() {
 	defaultUser := cfg.DefaultUser
 	downloadTO := cfg.DownloadTimeout
 	showVersion := false
+	skipWarmup := false
 
 	flag.StringVar(&configPath, "config", configPath, "path to server config (yaml or json)")
 	flag.StringVar(&addr, "addr", addr, "listen address (e.g., :8080)")
@@ -38,6 +43,7 @@ func main() {
 	flag.StringVar(&token, "github-token", token, "GitHub token for higher rate limits (env: GITHUB_TOKEN)")
 	flag.StringVar(&defaultUser, "default-user", defaultUser, "default user grouping when client user is empty")
 	flag.BoolVar(&showVersion, "version", showVersion, "print version and exit")
+	flag.BoolVar(&skipWarmup, "skip-warmup", skipWarmup, "skip the startup warm-up (warmup_entries)")
 	flag.StringVar(&downloadTO, "download-timeout", downloadTO, "timeout for download/package handlers (e.g., 10m, 5m)")
 	flag.Parse()
 
@@ -56,12 +62,215 @@ func main() {
 		log.Fatalf("init server: %v", err)
 	}
 
+	keys, err := cfg.Keys()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetAuth(keys)
+	s.SetMetrics(metrics.NewRegistry())
+	s.SetCompressionThreshold(cfg.CompressMinBytes)
+	s.SetUploadLimit(cfg.UploadMaxBytes)
+	s.SetManifestLimits(cfg.ManifestMaxEntries, cfg.ManifestMaxBytes)
+	s.SetPatchLimit(cfg.PatchMaxBytes)
+	if mt := strings.TrimSpace(cfg.MetadataTimeout); mt != "" {
+		d, err := time.ParseDuration(mt)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid metadata_timeout: %q", mt)
+		}
+		s.SetMetadataTimeout(d)
+	}
+	complete, err := cfg.CompleteOnDisconnect()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetCompleteOnDisconnect(complete)
+	s.SetMaxInflight(cfg.MaxInflight)
+	budgets, err := cfg.ByteBudgets()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetDailyByteBudget(cfg.DailyByteBudgetBytes, budgets)
+	transport, err := cfg.Transport()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetUpstreamTransport(transport)
+	s.SetSlowDownloadAlert(cfg.SlowDownloadBytesPerSec, cfg.SlowDownloadRecovery)
+	threshold, cooldown, err := cfg.Circuit()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetUpstreamCircuit(threshold, cooldown)
+	apiTimeout, err := cfg.ParsedAPICallTimeout()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetAPICallTimeout(apiTimeout)
+	branchLookup, err := cfg.ParsedBranchLookup()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetBranchLookup(branchLookup)
+	redirects, err := cfg.PackageRedirects()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetPackageRedirects(redirects)
+	s.SetPackageHostCheck(cfg.PackageHostCheck())
+	if cfg.PackageAllowPrivateHosts {
+		fmt.Println("package downloads may reach private and loopback addresses (package_allow_private_hosts)")
+	}
+	mirrors, err := cfg.ParsedPackageMirrors()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetPackageMirrors(mirrors)
+	retention, err := cfg.Retention()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetRetention(retention, cfg.RetentionOnEnsure)
+	s.SetKeepPrevious(cfg.KeepPreviousArchives)
+	s.SetShortSHALength(cfg.ShortSHALength)
+	touchInterval, err := cfg.TouchInterval()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetTouchInterval(touchInterval)
+	serveStale, purgeAfter, err := cfg.BranchGonePolicy()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetBranchGonePolicy(serveStale, purgeAfter)
+	trash, trashRetention, err := cfg.TrashPolicy()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetTrash(trash, trashRetention)
+	compress, err := cfg.CompressArchives()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetArchiveCompression(compress)
+	encKeys, err := cfg.Encryption()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetEncryption(encKeys)
+	signKeys, err := cfg.Signing()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetSigning(signKeys)
+	urlKeys, urlGrace, err := cfg.URLSigning()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetURLSigning(urlKeys, urlGrace)
+	if err := s.SetPublicURL(cfg.PublicURL); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	proxies, err := srv.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetTrustedProxies(proxies)
+	s.SetNormalizeArchives(cfg.NormalizeArchives)
+	s.SetWebUI(cfg.WebUI)
+	s.SetUserAgent(cfg.UserAgent)
+	stalePolicy, err := cfg.ParsedStalePolicy()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetStalePolicy(stalePolicy)
+	s.SetStrictVerification(cfg.StrictVerification)
+	layout, err := cfg.ParsedCacheLayout()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetCacheLayout(layout)
+	s.SetDownloadTempDir(cfg.DownloadTempDir)
+	s.SetSpaceReserve(cfg.SpaceReserveBytes, cfg.SpaceEmergencyCleanup)
+	policy, err := cfg.RepoPolicy()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetRepoPolicy(policy)
+	pkgPolicy, err := cfg.PackagePolicy()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetPackagePolicy(pkgPolicy)
+	routes, err := cfg.ParsedTokenRoutes(token)
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetTokenRoutes(routes)
+	deprecations, err := cfg.ParsedDeprecations()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	s.SetDeprecations(deprecations)
+	if cfg.MirrorManifest != "" {
+		var gcAfter time.Duration
+		if v := strings.TrimSpace(cfg.MirrorGCAfter); v != "" {
+			if gcAfter, err = time.ParseDuration(v); err != nil || gcAfter < 0 {
+				log.Fatalf("invalid mirror_gc_after: %q", v)
+			}
+		}
+		if err := s.SetMirror(cfg.MirrorManifest, gcAfter); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		if err := s.SetWebhook(cfg.WebhookURL, cfg.ParsedWebhookSecret(), cfg.WebhookEvents, cfg.WebhookDeadLetter); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
+	clusterOpts, err := cfg.Cluster()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	if clusterOpts != nil {
+		if err := s.SetCluster(*clusterOpts); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
+	if v := strings.TrimSpace(cfg.RevalidateInterval); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < 0 {
+			log.Fatalf("invalid revalidate_interval: %q", v)
+		}
+		var window time.Duration
+		if w := strings.TrimSpace(cfg.RevalidateWindow); w != "" {
+			if window, err = time.ParseDuration(w); err != nil || window < 0 {
+				log.Fatalf("invalid revalidate_window: %q", w)
+			}
+		}
+		if err := s.SetRevalidation(interval, window, cfg.RevalidateConcurrency); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
+	hotCapacity, tiers, tierInterval, err := cfg.Tiers()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	if err := s.SetTiers(hotCapacity, tiers, tierInterval); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+	if !skipWarmup {
+		if err := s.StartWarmup(cfg.WarmupEntries, cfg.WarmupConcurrency, !cfg.WarmupBackground); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+	}
+	go watchConfig(configPath, s, token)
+
 	mux := http.NewServeMux()
 	s.RegisterRoutes(mux)
 
 	httpSrv := &http.Server{
 		Addr:              addr,
-		Handler:           logging(mux),
+		Handler:           logging(srv.Identify(mux)),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 	fmt.Printf("ghh-server listening on %s, root=%s, default_user=%s\n", addr, root, defaultUser)
@@ -93,6 +302,23 @@ func (r *statusRecorder) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// ReadFrom passes file bodies through to the connection so sendfile still
+// applies behind the logger.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	var n int64
+	var err error
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{r.ResponseWriter}, src)
+	}
+	r.size += int(n)
+	return n, err
+}
+
 func logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -107,6 +333,71 @@ func logging(next http.Handler) http.Handler {
 	})
 }
 
+// watchConfig reloads the hot-reloadable settings (the repo allow/deny
+// policy, the token routes and the package mirrors) on SIGHUP or when the config file's mtime
+// changes. A config that fails to parse leaves the previous settings in
+// place. token is the server token from startup.
+func watchConfig(path string, s *srv.Server, token string) {
+	if path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = fi.ModTime()
+		}
+		cfg, err := srv.LoadConfig(path)
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		policy, err := cfg.RepoPolicy()
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		routes, err := cfg.ParsedTokenRoutes(token)
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		mirrors, err := cfg.ParsedPackageMirrors()
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		pkgPolicy, err := cfg.PackagePolicy()
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		deprecations, err := cfg.ParsedDeprecations()
+		if err != nil {
+			fmt.Printf("config reload failed: %v\n", err)
+			continue
+		}
+		s.SetRepoPolicy(policy)
+		s.SetTokenRoutes(routes)
+		s.SetPackageMirrors(mirrors)
+		s.SetPackagePolicy(pkgPolicy)
+		s.SetDeprecations(deprecations)
+		fmt.Printf("config reloaded from %s (repo_allow=%d repo_deny=%d token_routes=%d package_mirrors=%d package_allow=%d package_deny=%d deprecations=%d)\n", path, len(cfg.RepoAllow), len(cfg.RepoDeny), len(cfg.TokenRoutes), len(cfg.PackageMirrors), len(cfg.PackageAllow), len(cfg.PackageDeny), len(deprecations))
+	}
+}
+
 // findConfigPath scans args for --config or -config to allow loading defaults before flag parsing.
 func findConfigPath(args []string) string {
 	for i := 0; i < len(args); i++ {
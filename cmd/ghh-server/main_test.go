@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggingDoesNotLeakGitHubToken(t *testing.T) {
+	const secret = "ghp_accesslogsecret"
+	h := logging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	for _, hdr := range [][2]string{{"X-GHH-Token", secret}, {"Authorization", "github " + secret}} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo", nil)
+		req.Header.Set(hdr[0], hdr[1])
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	_ = w.Close()
+	os.Stdout = orig
+	out, _ := io.ReadAll(r)
+	if !strings.Contains(string(out), "/api/v1/download") {
+		t.Fatalf("expected access log line, got %q", out)
+	}
+	if strings.Contains(string(out), secret) {
+		t.Fatalf("token leaked into access log: %q", out)
+	}
+}
@@ -34,6 +34,7 @@ func main() {
 	// Global flags
 	server := getenvDefault("GHH_BASE_URL", "")
 	token := os.Getenv("GHH_TOKEN")
+	githubToken := os.Getenv("GHH_GITHUB_TOKEN")
 	timeout := defaultTimeout
 	retryMax := defaultRetryMax
 	retryBackoff := defaultRetryBackoff
@@ -57,6 +58,7 @@ func main() {
 	global.Usage = func() { printUsage() }
 	global.StringVar(&server, "server", server, "server base URL (env: GHH_BASE_URL or config.base_url)")
 	global.StringVar(&token, "token", token, "auth token (env: GHH_TOKEN)")
+	global.StringVar(&githubToken, "github-token", githubToken, "GitHub PAT forwarded to the server for this request (env: GHH_GITHUB_TOKEN)")
 	global.StringVar(&user, "user", user, "user name (env: GHH_USER or config.user)")
 	global.DurationVar(&timeout, "timeout", timeout, "HTTP timeout")
 	global.IntVar(&retryMax, "retry", retryMax, "retry times for failed downloads (env: GHH_RETRY)")
@@ -131,6 +133,7 @@ func main() {
 	client := ic.NewClient(server, token, httpClient)
 	client.Endpoint = eps
 	client.User = strings.TrimSpace(user)
+	client.GitHubToken = strings.TrimSpace(githubToken)
 	client.RetryMax = retryMax
 	client.RetryBackoff = retryBackoff
 	client.ProgressInterval = time.Second
@@ -147,6 +150,7 @@ func main() {
 		dest := cmd.String("dest", "", "destination path (default: current directory)")
 		extract := cmd.Bool("extract", false, "extract zip archive into dest directory")
 		legacy := cmd.Bool("legacy", false, "use legacy GitHub zipball API instead of git archive")
+		root := cmd.String("root", "", "top-level folder of the archive: repo, none or keep (default: server default)")
 		debugDelay := cmd.String("debug-delay", "", "DEBUG: request server to add artificial delay (e.g., 90s, 2m)")
 		debugStreamDelay := cmd.String("debug-stream-delay", "", "DEBUG: slow down server streaming to client (e.g., 90s, 2m)")
 		if err := cmd.Parse(args[1:]); err != nil {
@@ -161,6 +165,7 @@ func main() {
 		if *legacy {
 			client.Legacy = true
 		}
+		client.Root = strings.TrimSpace(*root)
 		pkgURL := strings.TrimSpace(*pkgURLFlag)
 		if pkgURL != "" {
 			destPath := resolvePackageDest(pkgURL, *dest)
@@ -347,6 +352,7 @@ Global Flags:
   --server     Server base URL (env: GHH_BASE_URL) (default: http://localhost:8080)
   --token      Auth token (env: GHH_TOKEN)
   --user       User name for grouping cache (env: GHH_USER)
+  --github-token  GitHub PAT used by the server for this request (env: GHH_GITHUB_TOKEN)
   --config     Path to YAML config (env: GHH_CONFIG); JSON compatible
   --timeout    HTTP timeout (default: 30s)
   --retry      Retry times for failed downloads (env: GHH_RETRY)
@@ -360,6 +366,7 @@ Download Flags:
   --dest         Destination path (default: current directory)
   --extract      Extract zip archive into dest directory
   --legacy       Use legacy GitHub zipball API instead of git archive
+  --root         Top-level folder: repo (<repo>/), none (flat) or keep (as fetched)
   --package      Package download URL (alternative to --repo)
   --debug-delay  DEBUG: request server to add artificial delay (e.g., 90s, 2m)
   --debug-stream-delay  DEBUG: slow down server streaming to client (e.g., 90s, 2m)
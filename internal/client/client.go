@@ -4,6 +4,8 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,20 +16,25 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github-hub/internal/storage"
+	"github-hub/internal/version"
 )
 
 // Client is a minimal HTTP API client for the ghh server.
 type Client struct {
 	BaseURL          string
 	Token            string
+	GitHubToken      string // Per-request GitHub PAT sent as X-GHH-Token (overrides the server's token)
 	User             string
+	ClientName       string // Sent as X-GHH-Client so the server can tell client versions apart (default "ghh/<version>")
 	Legacy           bool   // Use legacy GitHub zipball API instead of git archive
+	Root             string // Top-level folder of the archive: "repo", "none" or "keep" (empty: server default)
 	DebugDelay       string // DEBUG: request server to add artificial delay (e.g., "90s", "2m")
 	DebugStreamDelay string // DEBUG: request server to slow streaming (e.g., "90s", "2m")
 	RetryMax         int
@@ -45,6 +52,7 @@ func NewClient(baseURL, token string, httpClient *http.Client) *Client {
 	return &Client{
 		BaseURL:          strings.TrimRight(baseURL, "/"),
 		Token:            token,
+		ClientName:       "ghh/" + version.Version,
 		http:             httpClient,
 		Endpoint:         DefaultEndpoints(),
 		RetryMax:         5,
@@ -56,8 +64,10 @@ func NewClient(baseURL, token string, httpClient *http.Client) *Client {
 // HTTPError wraps non-2xx responses.
 type HTTPError struct {
 	StatusCode int
-	Message    string
-	Body       string
+	// Code is the server's X-GHH-Error-Code, when it sent one.
+	Code    string
+	Message string
+	Body    string
 }
 
 func (e *HTTPError) Error() string { return fmt.Sprintf("http %d: %s", e.StatusCode, e.Message) }
@@ -108,6 +118,9 @@ func (c *Client) Download(ctx context.Context, repo, branch, zipPath, extractDir
 	if c.Legacy {
 		q.Set("legacy", "true")
 	}
+	if strings.TrimSpace(c.Root) != "" {
+		q.Set("root", c.Root)
+	}
 	if strings.TrimSpace(c.DebugDelay) != "" {
 		q.Set("debug_delay", c.DebugDelay)
 	}
@@ -288,6 +301,222 @@ func (c *Client) DownloadSparse(ctx context.Context, repo, branch string, paths
 	return nil
 }
 
+// DownloadSegmented downloads repository code as an archive in verified
+// chunks instead of one stream, for large archives over unreliable links.
+// It fetches the segment manifest, then each chunk at the manifest's
+// commit, retrying a chunk on its own, and writes them into zipPath.part.
+// A later call resumes: chunks already in zipPath.part that match their
+// checksum are not fetched again. The reassembled file is checked against
+// the manifest's digest before it replaces zipPath. Archives the server
+// stores compressed or encrypted cannot be segmented (409 not_segmentable);
+// those are downloaded whole with Download instead.
+// Expected server endpoints: GET /api/v1/download/segments?repo=<>&branch=<>
+// and GET /api/v1/download/segment?repo=<>&branch=<>&commit=<>&index=<>
+func (c *Client) DownloadSegmented(ctx context.Context, repo, branch, zipPath string) error {
+	startTime := time.Now()
+	q := url.Values{}
+	q.Set("repo", repo)
+	if strings.TrimSpace(branch) != "" {
+		q.Set("branch", branch)
+	}
+	if c.Legacy {
+		q.Set("legacy", "true")
+	}
+	m, err := c.fetchSegments(ctx, q)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Code == "not_segmentable" {
+		fmt.Printf("%s cannot be segmented by the server, downloading it whole ...\n", repo)
+		return c.Download(ctx, repo, branch, zipPath, "")
+	}
+	if err != nil {
+		return err
+	}
+	if m.Commit != "" {
+		q.Set("commit", m.Commit)
+	}
+
+	partPath := zipPath + ".part"
+	if err := os.MkdirAll(filepath.Dir(partPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := f.Truncate(m.TotalSize); err != nil {
+		return err
+	}
+	fmt.Printf("downloading %s in %d segments ...\n", repo, len(m.Chunks))
+	resumed := 0
+	for _, seg := range m.Chunks {
+		if segmentPresent(f, seg) {
+			resumed++
+			continue
+		}
+		if err := c.downloadSegmentWithRetry(ctx, f, q, seg); err != nil {
+			return fmt.Errorf("segment %d of %d: %w", seg.Index, len(m.Chunks), err)
+		}
+		printInline(fmt.Sprintf("segment %d/%d", seg.Index+1, len(m.Chunks)), false)
+	}
+	clearInline()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, m.TotalSize)); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != m.SHA256 {
+		// Every chunk matched, so the manifest itself is inconsistent; start
+		// over next time.
+		_ = f.Close()
+		_ = os.Remove(partPath)
+		return fmt.Errorf("reassembled archive sha256 %s, manifest says %s", got, m.SHA256)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, zipPath); err != nil {
+		return err
+	}
+	fmt.Printf("saved archive to %s (%.2f MB, %d of %d segments resumed, %s)\n", zipPath, float64(m.TotalSize)/(1024*1024), resumed, len(m.Chunks), time.Since(startTime).Round(time.Millisecond))
+	if m.Commit != "" {
+		commitPath := zipPath + ".commit.txt"
+		if err := os.WriteFile(commitPath, []byte(m.Commit+"\n"), 0o644); err != nil {
+			fmt.Printf("warning: failed to save commit info to %s: %v\n", commitPath, err)
+		} else {
+			fmt.Printf("saved commit to %s\n", commitPath)
+		}
+	}
+	return nil
+}
+
+// fetchSegments gets the segment manifest, retrying like downloads do.
+func (c *Client) fetchSegments(ctx context.Context, q url.Values) (*storage.SegmentManifest, error) {
+	endpoint := c.fullURL(c.Endpoint.DownloadSegments, q)
+	attempts := c.retryAttempts()
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithBackoff(ctx, c.retryBackoff(), attempt); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.addAuth(req)
+		req.Header.Set("Accept", "application/json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			lastErr = err
+			if attempt == attempts-1 || !isRetryableError(err) {
+				return nil, err
+			}
+			printRetry(attempt, attempts, err)
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+		_ = resp.Body.Close()
+		if err == nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+			err = &HTTPError{StatusCode: resp.StatusCode, Code: resp.Header.Get("X-GHH-Error-Code"), Message: "segments failed", Body: string(b)}
+			if !isRetryableStatus(resp.StatusCode) {
+				return nil, err
+			}
+		}
+		if err != nil {
+			lastErr = err
+			if attempt == attempts-1 {
+				return nil, err
+			}
+			printRetry(attempt, attempts, err)
+			continue
+		}
+		var m storage.SegmentManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("decode segments: %w", err)
+		}
+		return &m, nil
+	}
+	return nil, lastErr
+}
+
+// segmentPresent reports whether f already holds seg, from an earlier
+// interrupted call.
+func segmentPresent(f *os.File, seg storage.Segment) bool {
+	h := sha256.New()
+	if n, err := io.Copy(h, io.NewSectionReader(f, seg.Offset, seg.Length)); err != nil || n != seg.Length {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == seg.SHA256
+}
+
+// downloadSegmentWithRetry writes chunk seg into f at its offset, fetching
+// it again while it fails or does not match its checksum.
+func (c *Client) downloadSegmentWithRetry(ctx context.Context, f *os.File, q url.Values, seg storage.Segment) error {
+	sq := url.Values{}
+	for k, v := range q {
+		sq[k] = v
+	}
+	sq.Set("index", strconv.Itoa(seg.Index))
+	endpoint := c.fullURL(c.Endpoint.DownloadSegment, sq)
+	attempts := c.retryAttempts()
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithBackoff(ctx, c.retryBackoff(), attempt); err != nil {
+				return err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		c.addAuth(req)
+		req.Header.Set("Accept", "application/octet-stream")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			lastErr = err
+			if attempt == attempts-1 || !isRetryableError(err) {
+				return err
+			}
+			printRetry(attempt, attempts, err)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			_ = resp.Body.Close()
+			err := &HTTPError{StatusCode: resp.StatusCode, Message: "segment failed", Body: string(body)}
+			lastErr = err
+			if attempt == attempts-1 || !isRetryableStatus(resp.StatusCode) {
+				return err
+			}
+			printRetry(attempt, attempts, err)
+			continue
+		}
+		if sum := resp.Header.Get("X-GHH-Segment-SHA256"); sum != "" && sum != seg.SHA256 {
+			_ = resp.Body.Close()
+			return fmt.Errorf("server sent sha256 %s, manifest says %s: archive changed", sum, seg.SHA256)
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(f, seg.Offset), h), &countingReader{r: io.LimitReader(resp.Body, seg.Length), ctx: ctx, written: new(int64)})
+		_ = resp.Body.Close()
+		if err == nil && (n != seg.Length || hex.EncodeToString(h.Sum(nil)) != seg.SHA256) {
+			err = fmt.Errorf("got %d bytes with sha256 %x, want %d bytes with %s", n, h.Sum(nil), seg.Length, seg.SHA256)
+		}
+		if err != nil {
+			lastErr = err
+			if attempt == attempts-1 || !isRetryableError(err) {
+				return err
+			}
+			printRetry(attempt, attempts, err)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
 func (c *Client) fetchCommit(ctx context.Context, repo, branch string) string {
 	q := url.Values{}
 	if !strings.Contains(c.Endpoint.DownloadCommit, "{repo}") {
@@ -497,35 +726,45 @@ func (c *Client) addAuth(req *http.Request) {
 	if strings.TrimSpace(c.Token) != "" {
 		req.Header.Set("Authorization", "Bearer "+c.Token)
 	}
+	if strings.TrimSpace(c.GitHubToken) != "" {
+		req.Header.Set("X-GHH-Token", c.GitHubToken)
+	}
 	if strings.TrimSpace(c.User) != "" {
 		req.Header.Set("X-GHH-User", c.User)
 	}
+	if strings.TrimSpace(c.ClientName) != "" {
+		req.Header.Set("X-GHH-Client", c.ClientName)
+	}
 }
 
 // Endpoints provides API path templates.
 type Endpoints struct {
-	Download        string
-	DownloadCommit  string
-	DownloadInfo    string
-	DownloadSparse  string
-	BranchSwitch    string
-	DirList         string
-	DirDelete       string
-	ServerVersion   string
-	DownloadPackage string
+	Download         string
+	DownloadCommit   string
+	DownloadInfo     string
+	DownloadSparse   string
+	DownloadSegments string
+	DownloadSegment  string
+	BranchSwitch     string
+	DirList          string
+	DirDelete        string
+	ServerVersion    string
+	DownloadPackage  string
 }
 
 func DefaultEndpoints() Endpoints {
 	return Endpoints{
-		Download:        "/api/v1/download",
-		DownloadCommit:  "/api/v1/download/commit",
-		DownloadInfo:    "/api/v1/download/info",
-		DownloadSparse:  "/api/v1/download/sparse",
-		BranchSwitch:    "/api/v1/branch/switch",
-		DirList:         "/api/v1/dir/list",
-		DirDelete:       "/api/v1/dir",
-		ServerVersion:   "/api/v1/version",
-		DownloadPackage: "/api/v1/download/package",
+		Download:         "/api/v1/download",
+		DownloadCommit:   "/api/v1/download/commit",
+		DownloadInfo:     "/api/v1/download/info",
+		DownloadSparse:   "/api/v1/download/sparse",
+		DownloadSegments: "/api/v1/download/segments",
+		DownloadSegment:  "/api/v1/download/segment",
+		BranchSwitch:     "/api/v1/branch/switch",
+		DirList:          "/api/v1/dir/list",
+		DirDelete:        "/api/v1/dir",
+		ServerVersion:    "/api/v1/version",
+		DownloadPackage:  "/api/v1/download/package",
 	}
 }
 
@@ -853,6 +1092,9 @@ func extractZip(r io.ReaderAt, size int64, dest string) error {
 	if err != nil {
 		return err
 	}
+	// Files extracted so far; a second entry at the same path (possible once
+	// root=none flattens an archive) is an error rather than an overwrite.
+	written := map[string]bool{}
 	for _, f := range zr.File {
 		fp := filepath.Join(dest, f.Name)
 		// Prevent ZipSlip using absolute paths
@@ -869,8 +1111,12 @@ func extractZip(r io.ReaderAt, size int64, dest string) error {
 			}
 			continue
 		}
+		if written[fp] {
+			return fmt.Errorf("path collision: %s appears more than once in the archive", f.Name)
+		}
+		written[fp] = true
 		if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
-			return err
+			return fmt.Errorf("extract %s: %w", f.Name, err)
 		}
 		rc, err := f.Open()
 		if err != nil {
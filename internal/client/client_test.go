@@ -4,6 +4,8 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -16,6 +18,7 @@ import (
 	"time"
 
 	"github-hub/internal/storage"
+	"github-hub/internal/version"
 )
 
 func minimalZipBytes(t *testing.T) []byte {
@@ -74,6 +77,10 @@ func TestDownloadRepo_Retry(t *testing.T) {
 	var attempts int32
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/download", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-GHH-Client"); got != "ghh/"+version.Version {
+			http.Error(w, "X-GHH-Client "+got, http.StatusBadRequest)
+			return
+		}
 		if atomic.AddInt32(&attempts, 1) == 1 {
 			http.Error(w, "temporary", http.StatusBadGateway)
 			return
@@ -260,3 +267,144 @@ func TestDownloadSparse_Retry(t *testing.T) {
 		t.Fatalf("expected 2 attempts, got %d", attempts)
 	}
 }
+
+func TestDownload_RootAndCollision(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "a.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gotRoot string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/download", func(w http.ResponseWriter, r *http.Request) {
+		gotRoot = r.URL.Query().Get("root")
+		_, _ = w.Write(buf.Bytes())
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := NewClient(server.URL, "", server.Client())
+	c.Root = "none"
+	tmpDir := t.TempDir()
+	err := c.Download(context.Background(), "owner/repo", "main", filepath.Join(tmpDir, "repo.zip"), filepath.Join(tmpDir, "out"))
+	if err == nil || !strings.Contains(err.Error(), "path collision") {
+		t.Fatalf("Download err = %v, want path collision", err)
+	}
+	if gotRoot != "none" {
+		t.Fatalf("root=%q, want none", gotRoot)
+	}
+}
+
+func TestDownloadSegmented_RetryAndResume(t *testing.T) {
+	archive := bytes.Repeat([]byte("0123456789"), 25) // 250 bytes, 3 chunks of 100
+	m := storage.SegmentManifest{Repo: "owner/repo", Branch: "main", Commit: "abc123", TotalSize: int64(len(archive)), ChunkSize: 100}
+	for off := 0; off < len(archive); off += 100 {
+		end := min(off+100, len(archive))
+		sum := sha256.Sum256(archive[off:end])
+		m.Chunks = append(m.Chunks, storage.Segment{Index: len(m.Chunks), Offset: int64(off), Length: int64(end - off), SHA256: hex.EncodeToString(sum[:])})
+	}
+	whole := sha256.Sum256(archive)
+	m.SHA256 = hex.EncodeToString(whole[:])
+
+	var fetched [3]int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/download/segments", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(m)
+	})
+	mux.HandleFunc("/api/v1/download/segment", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("commit") != "abc123" {
+			t.Errorf("segment request without the manifest's commit: %s", r.URL.RawQuery)
+		}
+		i, _ := strconv.Atoi(r.URL.Query().Get("index"))
+		seg := m.Chunks[i]
+		switch atomic.AddInt32(&fetched[i], 1) {
+		case 1:
+			if i == 1 {
+				http.Error(w, "temporary", http.StatusBadGateway)
+				return
+			}
+			if i == 2 {
+				// Corrupted in transit: right length, wrong bytes.
+				_, _ = w.Write(bytes.Repeat([]byte("x"), int(seg.Length)))
+				return
+			}
+		}
+		w.Header().Set("X-GHH-Segment-SHA256", seg.SHA256)
+		_, _ = w.Write(archive[seg.Offset : seg.Offset+seg.Length])
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := NewClient(server.URL, "", server.Client())
+	c.RetryMax = 1
+	c.RetryBackoff = 0
+	dest := filepath.Join(t.TempDir(), "main.zip")
+	if err := c.DownloadSegmented(context.Background(), "owner/repo", "main", dest); err != nil {
+		t.Fatalf("DownloadSegmented: %v", err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(data, archive) {
+		t.Fatalf("reassembled archive differs (err=%v)", err)
+	}
+	if fetched != [3]int32{1, 2, 2} {
+		t.Fatalf("chunk fetches = %v, want [1 2 2]", fetched)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("part file left behind: %v", err)
+	}
+
+	// An interrupted download resumes from the chunks already there.
+	fetched = [3]int32{}
+	part := make([]byte, len(archive))
+	copy(part, archive[:200])
+	if err := os.WriteFile(dest+".part", part, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DownloadSegmented(context.Background(), "owner/repo", "main", dest); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if fetched[0] != 0 || fetched[1] != 0 || fetched[2] == 0 {
+		t.Fatalf("resume fetched %v, want only the last chunk", fetched)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, archive) {
+		t.Fatal("resumed archive differs")
+	}
+}
+
+func TestDownloadSegmented_NotSegmentable(t *testing.T) {
+	var downloads int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/download/segments", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			t.Errorf("segments request without Accept: application/json")
+		}
+		w.Header().Set("X-GHH-Error-Code", "not_segmentable")
+		http.Error(w, "archive is stored compressed or encrypted", http.StatusConflict)
+	})
+	mux.HandleFunc("/api/v1/download/segment", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("segment fetched: %s", r.URL.RawQuery)
+	})
+	mux.HandleFunc("/api/v1/download", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("Content-Length", "7")
+		_, _ = w.Write([]byte("zipdata"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := NewClient(server.URL, "", server.Client())
+	dest := filepath.Join(t.TempDir(), "main.zip")
+	if err := c.DownloadSegmented(context.Background(), "owner/repo", "main", dest); err != nil {
+		t.Fatalf("DownloadSegmented: %v", err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || string(data) != "zipdata" || downloads != 1 {
+		t.Fatalf("archive %q (err=%v) after %d downloads, want the whole download once", data, err, downloads)
+	}
+}
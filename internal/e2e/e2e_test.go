@@ -0,0 +1,225 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const repo = "acme/app"
+
+// download fetches a zipball download of repo@branch as user u.
+func download(h *Harness, branch, extra string) *Response {
+	h.t.Helper()
+	return h.Get("/api/v1/download?user=u&legacy=true&repo=" + repo + "&branch=" + url.QueryEscape(branch) + extra)
+}
+
+// zipFile returns the body of name inside the archive served in resp.
+func zipFile(t *testing.T, resp *Response, name string) string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(resp.Body), int64(len(resp.Body)))
+	if err != nil {
+		t.Fatalf("response is not a zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/"+name) {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			_, _ = buf.ReadFrom(rc)
+			_ = rc.Close()
+			return buf.String()
+		}
+	}
+	t.Fatalf("%s not in archive", name)
+	return ""
+}
+
+func TestColdDownloadThenWarmHit(t *testing.T) {
+	h := New(t)
+	sha := h.GitHub.Push(repo, "main", map[string]string{"README.md": "v1"})
+
+	resp := download(h, "main", "")
+	if resp.Status != http.StatusOK || resp.Header.Get("X-GHH-Cache") != "miss" {
+		t.Fatalf("cold: status=%d cache=%q body=%s", resp.Status, resp.Header.Get("X-GHH-Cache"), resp.Body)
+	}
+	if resp.Header.Get("X-GHH-Commit") != sha || resp.Header.Get("X-GHH-Commit-Short") != sha[:12] || resp.Header.Get("X-GHH-SHA256") == "" {
+		t.Fatalf("cold: headers %v", resp.Header)
+	}
+	if got := zipFile(t, resp, "README.md"); got != "v1" {
+		t.Fatalf("README.md = %q", got)
+	}
+	h.AssertCached("u", repo, "main", sha)
+
+	resp = download(h, "main", "")
+	if resp.Status != http.StatusOK || resp.Header.Get("X-GHH-Cache") != "revalidated" || resp.Header.Get("X-GHH-Commit") != sha {
+		t.Fatalf("warm: status=%d headers=%v", resp.Status, resp.Header)
+	}
+	if n := h.GitHub.Requests("/codeload/"); n != 1 {
+		t.Fatalf("codeload requests = %d, want 1", n)
+	}
+}
+
+func TestSHAChangeRefreshes(t *testing.T) {
+	h := New(t)
+	h.GitHub.Push(repo, "main", map[string]string{"README.md": "v1"})
+	download(h, "main", "")
+
+	sha2 := h.GitHub.Push(repo, "main", map[string]string{"README.md": "v2"})
+	resp := download(h, "main", "")
+	if resp.Status != http.StatusOK || resp.Header.Get("X-GHH-Cache") != "miss" || resp.Header.Get("X-GHH-Commit") != sha2 {
+		t.Fatalf("status=%d headers=%v", resp.Status, resp.Header)
+	}
+	if got := zipFile(t, resp, "README.md"); got != "v2" {
+		t.Fatalf("README.md = %q", got)
+	}
+	h.AssertCached("u", repo, "main", sha2)
+}
+
+func TestForceRefresh(t *testing.T) {
+	h := New(t)
+	sha := h.GitHub.Push(repo, "main", map[string]string{"README.md": "v1"})
+	download(h, "main", "")
+
+	resp := download(h, "main", "&force=true")
+	if resp.Status != http.StatusOK || resp.Header.Get("X-GHH-Cache") != "miss" {
+		t.Fatalf("status=%d headers=%v", resp.Status, resp.Header)
+	}
+	if n := h.GitHub.Requests("/codeload/"); n != 2 {
+		t.Fatalf("codeload requests = %d, want 2", n)
+	}
+	h.AssertCached("u", repo, "main", sha)
+}
+
+func TestBranchWithSlash(t *testing.T) {
+	h := New(t)
+	h.GitHub.Push(repo, "main", map[string]string{"README.md": "main"})
+	sha := h.GitHub.Push(repo, "feature/login", map[string]string{"README.md": "login"})
+
+	resp := download(h, "feature/login", "")
+	if resp.Status != http.StatusOK || resp.Header.Get("X-GHH-Commit") != sha {
+		t.Fatalf("status=%d headers=%v body=%s", resp.Status, resp.Header, resp.Body)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename="acme-app-feature-login.legacy.zip"` {
+		t.Fatalf("Content-Disposition = %q", cd)
+	}
+	if got := zipFile(t, resp, "README.md"); got != "login" {
+		t.Fatalf("README.md = %q", got)
+	}
+	h.AssertCached("u", repo, "feature/login", sha)
+	h.AssertNotCached("u", repo, "main")
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	cases := []struct {
+		name       string
+		fail       string // path prefix answering 500
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"codeload 500 v1", "/codeload/", "/api/v1/download?user=u&legacy=true&repo=" + repo + "&branch=main", http.StatusBadGateway, ""},
+		{"codeload 500 v2", "/codeload/", "/api/v2/repos/" + repo + "/archive/main?user=u&legacy=true", http.StatusBadGateway, "upstream_unavailable"},
+		{"unknown branch", "", "/api/v2/repos/" + repo + "/archive/nope?user=u&legacy=true", http.StatusNotFound, "branch_not_found"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(t)
+			h.GitHub.Push(repo, "main", map[string]string{"README.md": "v1"})
+			if tc.fail != "" {
+				h.GitHub.Fail(tc.fail, http.StatusInternalServerError)
+			}
+			resp := h.Get(tc.path)
+			if resp.Status != tc.wantStatus {
+				t.Fatalf("status=%d, want %d; body=%s", resp.Status, tc.wantStatus, resp.Body)
+			}
+			if tc.wantCode != "" {
+				var env struct {
+					Error struct {
+						Code string `json:"code"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(resp.Body, &env); err != nil || env.Error.Code != tc.wantCode {
+					t.Fatalf("body=%s, want code %q", resp.Body, tc.wantCode)
+				}
+			}
+			h.AssertNotCached("u", repo, "main")
+		})
+	}
+}
+
+func TestBranchSwitchItems(t *testing.T) {
+	type item struct {
+		Status int    `json:"status"`
+		Commit string `json:"commit"`
+		Error  *struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	cases := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantItems  []int    // per-item status
+		wantCodes  []string // per-item error code, "" for none
+		cached     []string // branches cached afterwards
+	}{
+		{"non-atomic mixed", `{"legacy":true,"items":[{"repo":"acme/app","branch":"main"},{"repo":"acme/app","branch":"nope"}]}`,
+			http.StatusMultiStatus, []int{200, 404}, []string{"", "branch_not_found"}, []string{"main"}},
+		{"atomic all ok", `{"atomic":true,"legacy":true,"items":[{"repo":"acme/app","branch":"main"},{"repo":"acme/app","branch":"release"}]}`,
+			http.StatusOK, []int{200, 200}, []string{"", ""}, []string{"main", "release"}},
+		{"atomic with failure", `{"atomic":true,"legacy":true,"items":[{"repo":"acme/app","branch":"main"},{"repo":"acme/app","branch":"nope"}]}`,
+			http.StatusConflict, []int{200, 404}, []string{"", "branch_not_found"}, []string{"main"}},
+		{"atomic with invalid item", `{"atomic":true,"legacy":true,"items":[{"repo":"acme/app","branch":"main"},{"repo":"acme/app","branch":"a..b"}]}`,
+			http.StatusConflict, []int{424, 400}, []string{"skipped", "bad_request"}, nil},
+		{"items and repo", `{"repo":"acme/app","branch":"main","items":[{"repo":"acme/app","branch":"main"}]}`,
+			http.StatusBadRequest, nil, nil, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(t)
+			shas := map[string]string{
+				"main":    h.GitHub.Push(repo, "main", map[string]string{"README.md": "main"}),
+				"release": h.GitHub.Push(repo, "release", map[string]string{"README.md": "release"}),
+			}
+			resp := h.Post("/api/v1/branch/switch?user=u", tc.body)
+			if resp.Status != tc.wantStatus {
+				t.Fatalf("status=%d, want %d; body=%s", resp.Status, tc.wantStatus, resp.Body)
+			}
+			if tc.wantItems != nil {
+				var out struct {
+					OK    bool   `json:"ok"`
+					Items []item `json:"items"`
+				}
+				if err := json.Unmarshal(resp.Body, &out); err != nil || len(out.Items) != len(tc.wantItems) {
+					t.Fatalf("body=%s", resp.Body)
+				}
+				for i, it := range out.Items {
+					code := ""
+					if it.Error != nil {
+						code = it.Error.Code
+					}
+					if it.Status != tc.wantItems[i] || code != tc.wantCodes[i] {
+						t.Fatalf("item %d = %d %q, want %d %q; body=%s", i, it.Status, code, tc.wantItems[i], tc.wantCodes[i], resp.Body)
+					}
+				}
+				if out.OK != (resp.Status == http.StatusOK) {
+					t.Fatalf("ok=%t with status %d", out.OK, resp.Status)
+				}
+			}
+			for _, b := range tc.cached {
+				h.AssertCached("u", repo, b, shas[b])
+				delete(shas, b)
+			}
+			for b := range shas {
+				h.AssertNotCached("u", repo, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package e2e runs the real server on a real Storage against a fake GitHub
+// (testutil.FakeGitHub), for tests of how the two work together: sidecars
+// on disk, cache outcomes and the headers and statuses clients see.
+package e2e
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/server"
+	"github-hub/internal/storage"
+	"github-hub/internal/testutil"
+)
+
+// Harness is a server with a Storage at a temp root, reachable at URL, whose
+// upstream is GitHub.
+type Harness struct {
+	t       testing.TB
+	GitHub  *testutil.FakeGitHub
+	Storage *storage.Storage
+	Server  *server.Server
+	URL     string
+}
+
+// New starts a harness that is torn down when t ends. opts are passed to
+// server.New. Failed downloads are retried once, without waiting.
+func New(t testing.TB, opts ...server.Option) *Harness {
+	t.Helper()
+	gh := testutil.NewFakeGitHub(t)
+	st := storage.New(t.TempDir())
+	st.HTTPClient = gh.Client()
+	st.RetryMax = 2
+	st.RetryBackoff = time.Millisecond
+	srv := server.New(st, opts...)
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Shutdown()
+	})
+	return &Harness{t: t, GitHub: gh, Storage: st, Server: srv, URL: ts.URL}
+}
+
+// Response is a finished request.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Get requests path (with its query) from the server.
+func (h *Harness) Get(path string) *Response {
+	h.t.Helper()
+	resp, err := http.Get(h.URL + path)
+	if err != nil {
+		h.t.Fatalf("GET %s: %v", path, err)
+	}
+	return h.read(path, resp)
+}
+
+// Post sends body as JSON to path.
+func (h *Harness) Post(path, body string) *Response {
+	h.t.Helper()
+	resp, err := http.Post(h.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		h.t.Fatalf("POST %s: %v", path, err)
+	}
+	return h.read(path, resp)
+}
+
+func (h *Harness) read(path string, resp *http.Response) *Response {
+	h.t.Helper()
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("%s: read body: %v", path, err)
+	}
+	return &Response{Status: resp.StatusCode, Header: resp.Header, Body: body}
+}
+
+// ArchivePath is where a zipball download of repo@branch for user is cached.
+func (h *Harness) ArchivePath(user, repo, branch string) string {
+	safe := strings.NewReplacer("/", "-", "\\", "-").Replace(branch)
+	return filepath.Join(h.Storage.Root, "users", user, "repos", repo, safe+".legacy.zip")
+}
+
+// AssertCached checks the cache layout of repo@branch for user: the
+// archive, its .meta SHA, .commit.txt short SHA and metadata sidecar all
+// describe commit sha.
+func (h *Harness) AssertCached(user, repo, branch, sha string) {
+	h.t.Helper()
+	zipPath := h.ArchivePath(user, repo, branch)
+	if _, err := os.Stat(zipPath); err != nil {
+		h.t.Fatalf("%s@%s not cached: %v", repo, branch, err)
+	}
+	if got := readTrimmed(h.t, zipPath+".meta"); got != sha {
+		h.t.Fatalf("%s.meta = %q, want %q", filepath.Base(zipPath), got, sha)
+	}
+	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
+	if got, want := readTrimmed(h.t, commitPath), sha[:storage.DefaultShortSHALen]; got != want {
+		h.t.Fatalf("%s = %q, want %q", filepath.Base(commitPath), got, want)
+	}
+	meta, err := h.Storage.ReadArchiveMeta(zipPath)
+	if err != nil {
+		h.t.Fatalf("metadata of %s: %v", filepath.Base(zipPath), err)
+	}
+	if meta.CommitSHA != sha || meta.Repo != repo || meta.Branch != branch || meta.SHA256 == "" {
+		h.t.Fatalf("metadata of %s = %+v, want commit %s of %s@%s", filepath.Base(zipPath), meta, sha, repo, branch)
+	}
+}
+
+// AssertNotCached checks that nothing is cached for repo@branch for user.
+func (h *Harness) AssertNotCached(user, repo, branch string) {
+	h.t.Helper()
+	if _, err := os.Stat(h.ArchivePath(user, repo, branch)); !os.IsNotExist(err) {
+		h.t.Fatalf("%s@%s is cached (err=%v)", repo, branch, err)
+	}
+}
+
+func readTrimmed(t testing.TB, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", filepath.Base(path), err)
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,267 @@
+// Package metrics is a small, dependency-free metrics registry that renders
+// the Prometheus text exposition format. It covers what the hub needs
+// (labelled counters, gauges and histograms, plus func-backed values) without
+// pulling the Prometheus client into the module.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds, stretched for multi-minute
+// archive downloads.
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// Registry holds metric families in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{byName: make(map[string]*family)}
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // histogram bucket counts (non-cumulative)
+	sum         float64
+	count       uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.byName[f.name]; ok {
+		return existing
+	}
+	f.series = make(map[string]*series)
+	r.byName[f.name] = f
+	r.families = append(r.families, f)
+	return f
+}
+
+// CounterVec is a monotonically increasing value partitioned by labels.
+type CounterVec struct{ f *family }
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct{ f *family }
+
+// HistogramVec counts observations into buckets, partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// Counter registers (or returns the existing) counter family.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Gauge registers (or returns the existing) gauge family.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// Histogram registers (or returns the existing) histogram family. Nil
+// buckets select DefBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: b})}
+}
+
+// CounterFunc registers a counter whose value is read from fn at scrape time.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindCounter, fn: fn})
+}
+
+// GaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add increases the counter by v (negative values are ignored).
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.get(labelValues).value += v
+	c.f.mu.Unlock()
+}
+
+// Inc increases the counter by one.
+func (c *CounterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Set replaces the gauge value.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.get(labelValues).value = v
+	g.f.mu.Unlock()
+}
+
+// Add adjusts the gauge by v.
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.get(labelValues).value += v
+	g.f.mu.Unlock()
+}
+
+// Observe records one observation.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	i := sort.SearchFloat64s(h.f.buckets, v) // first bucket with upper bound >= v
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// WritePrometheus renders all families in the text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry for scraping.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WritePrometheus(w)
+	})
+}
+
+func (f *family) write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+	if f.fn != nil {
+		fmt.Fprintf(&b, "%s %s\n", f.name, formatFloat(f.fn()))
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		switch f.kind {
+		case kindHistogram:
+			var cum uint64
+			for i, ub := range f.buckets {
+				cum += s.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labelValues, "le", formatFloat(ub)), cum)
+			}
+			cum += s.counts[len(f.buckets)]
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labelValues, "le", "+Inf"), cum)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labelString(f.labels, s.labelValues, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labelString(f.labels, s.labelValues, "", ""), s.count)
+		default:
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labelString(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+		}
+	}
+	f.mu.Unlock()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+"=\""+escapeLabel(values[i])+"\"")
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+"=\""+extraValue+"\"")
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func escapeHelp(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
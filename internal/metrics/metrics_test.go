@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("ghh_requests_total", "Requests.", "route", "code")
+	c.Inc("/a", "2xx")
+	c.Add(2, "/a", "2xx")
+	c.Inc("/b", "5xx")
+	h := r.Histogram("ghh_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(5, "/a")
+	r.GaugeFunc("ghh_up", "Up.", func() float64 { return 1 })
+
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE ghh_requests_total counter",
+		`ghh_requests_total{route="/a",code="2xx"} 3`,
+		`ghh_requests_total{route="/b",code="5xx"} 1`,
+		`ghh_latency_seconds_bucket{route="/a",le="0.1"} 1`,
+		`ghh_latency_seconds_bucket{route="/a",le="1"} 2`,
+		`ghh_latency_seconds_bucket{route="/a",le="+Inf"} 3`,
+		`ghh_latency_seconds_count{route="/a"} 3`,
+		"ghh_up 1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestNilVecsAreNoops(t *testing.T) {
+	var c *CounterVec
+	var g *GaugeVec
+	var h *HistogramVec
+	c.Inc("x")
+	g.Set(1, "x")
+	h.Observe(1, "x")
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x_total", "X.", "v").Inc("a\"b\\c\nd")
+	var b strings.Builder
+	_ = r.WritePrometheus(&b)
+	if !strings.Contains(b.String(), `x_total{v="a\"b\\c\nd"} 1`) {
+		t.Fatalf("bad escaping:\n%s", b.String())
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// budgetsFile persists today's per-user byte consumption beside the stats.
+const budgetsFile = "budgets.json"
+
+// UserBytes is one user's consumption on Day (UTC, YYYY-MM-DD): bytes the
+// download endpoints served them and bytes fetched from upstream for them.
+type UserBytes struct {
+	User    string `json:"user"`
+	Day     string `json:"day"`
+	Served  int64  `json:"bytes_served"`
+	Fetched int64  `json:"bytes_fetched"`
+}
+
+func (u UserBytes) total() int64 { return u.Served + u.Fetched }
+
+// budgets counts bytes per user and day and enforces the daily budgets.
+// Counts are kept for the current UTC day only and written to path by the
+// stats flusher; path is empty for in-memory-only accounting.
+type budgets struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	limit   int64            // per user and day; 0 is unlimited
+	perUser map[string]int64 // overrides of limit; 0 is unlimited
+	used    map[string]*UserBytes
+	dirty   bool
+}
+
+func newBudgets(path string, now func() time.Time, logf func(string, ...any)) *budgets {
+	b := &budgets{path: path, now: now, used: map[string]*UserBytes{}}
+	if path == "" {
+		return b
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logf("budgets: read %s: %v\n", path, err)
+		}
+		return b
+	}
+	var saved []UserBytes
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logf("budgets: ignoring corrupt %s: %v\n", path, err)
+		return b
+	}
+	for _, u := range saved {
+		u := u
+		b.used[u.User] = &u
+	}
+	return b
+}
+
+func budgetDay(t time.Time) string { return t.UTC().Format(time.DateOnly) }
+
+// resetAt is when the current day's counts end.
+func (b *budgets) resetAt() time.Time {
+	y, m, d := b.now().UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// entry returns user's counts for today, starting them over on a new day;
+// b.mu must be held.
+func (b *budgets) entry(user string) *UserBytes {
+	day := budgetDay(b.now())
+	u, ok := b.used[user]
+	if !ok || u.Day != day {
+		u = &UserBytes{User: user, Day: day}
+		b.used[user] = u
+	}
+	return u
+}
+
+// limitFor is user's daily budget; 0 is unlimited. b.mu must be held.
+func (b *budgets) limitFor(user string) int64 {
+	if n, ok := b.perUser[user]; ok {
+		return n
+	}
+	return b.limit
+}
+
+// exceeded reports whether user has used up today's budget.
+func (b *budgets) exceeded(user string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limit := b.limitFor(user)
+	return limit > 0 && b.entry(user).total() >= limit
+}
+
+// add charges served and fetched bytes to user.
+func (b *budgets) add(user string, served, fetched int64) {
+	if served == 0 && fetched == 0 {
+		return
+	}
+	b.mu.Lock()
+	u := b.entry(user)
+	u.Served += served
+	u.Fetched += fetched
+	b.dirty = true
+	b.mu.Unlock()
+}
+
+// reset clears user's counts for today.
+func (b *budgets) reset(user string) {
+	b.mu.Lock()
+	delete(b.used, user)
+	b.dirty = true
+	b.mu.Unlock()
+}
+
+// flush writes today's counts if they changed since the last flush.
+func (b *budgets) flush() error {
+	b.mu.Lock()
+	if b.path == "" || !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	day := budgetDay(b.now())
+	saved := make([]UserBytes, 0, len(b.used))
+	for _, u := range b.used {
+		if u.Day == day {
+			saved = append(saved, *u)
+		}
+	}
+	b.dirty = false
+	b.mu.Unlock()
+	data, err := json.Marshal(saved)
+	if err == nil {
+		tmp := b.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, b.path)
+		}
+	}
+	if err != nil {
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+	return err
+}
+
+// SetDailyByteBudget caps the bytes each user may pull through the hub per
+// UTC day: what download endpoints serve them plus what is fetched from
+// upstream for them. perUser overrides the cap for some users; 0 is
+// unlimited. Past it, archive and package downloads answer 429
+// quota_exceeded until midnight UTC, while metadata endpoints keep
+// working. Consumption is counted either way.
+func (s *Server) SetDailyByteBudget(limit int64, perUser map[string]int64) {
+	b := s.budgets
+	b.mu.Lock()
+	b.limit = max(limit, 0)
+	b.perUser = make(map[string]int64, len(perUser))
+	for user, n := range perUser {
+		b.perUser[sanitizeUser(user)] = max(n, 0)
+	}
+	b.mu.Unlock()
+}
+
+// budgetCharge is what the budget middleware charges a request to: the
+// user scope resolved and the bytes fetched upstream for it.
+type budgetCharge struct {
+	user    atomic.Pointer[string]
+	enforce bool
+	fetched atomic.Int64
+}
+
+type budgetKey struct{}
+
+// budget charges the bytes h serves, and those fetched upstream on its
+// behalf, to the user scope resolves; with enforce, scope turns users past
+// their budget away.
+func (s *Server) budget(enforce bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &budgetCharge{enforce: enforce}
+		ctx := context.WithValue(r.Context(), budgetKey{}, c)
+		ctx = storage.WithDownloadedBytes(ctx, &c.fetched)
+		cw := &countingWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, r.WithContext(ctx))
+		if user := c.user.Load(); user != nil {
+			served := int64(0)
+			if enforce {
+				served = cw.n
+			}
+			s.budgets.add(*user, served, c.fetched.Load())
+		}
+	})
+}
+
+// checkBudget records the user a request acts as for the budget middleware
+// and, on enforcing routes, answers 429 quota_exceeded when the user has
+// used up today's budget.
+func (s *Server) checkBudget(w http.ResponseWriter, r *http.Request, user string) bool {
+	c, ok := r.Context().Value(budgetKey{}).(*budgetCharge)
+	if !ok {
+		return true
+	}
+	c.user.Store(&user)
+	if !c.enforce || !s.budgets.exceeded(user) {
+		return true
+	}
+	reset := s.budgets.resetAt()
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(max(reset.Sub(s.now()).Seconds(), 1))), 10))
+	w.Header().Set("X-GHH-Quota-Reset", reset.Format(time.RFC3339))
+	s.logf("quota exceeded user=%s path=%s\n", user, r.URL.Path)
+	writeError(w, http.StatusTooManyRequests, CodeQuotaExceeded, fmt.Sprintf("daily download budget of user %s used up; resets at %s", user, reset.Format(time.RFC3339)))
+	return false
+}
+
+// budgetStatus is one user in GET /api/v1/admin/budgets.
+type budgetStatus struct {
+	UserBytes
+	// Limit is the user's daily budget, 0 if unlimited; Remaining is
+	// what is left of it, absent when unlimited.
+	Limit     int64     `json:"limit"`
+	Remaining *int64    `json:"remaining,omitempty"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// handleBudgets shows today's consumption of every user (or the one named
+// by user=) against their budget; DELETE with user= resets that user's
+// counter. Admin only.
+func (s *Server) handleBudgets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "byte budgets require an admin key")
+		return
+	}
+	user := strings.TrimSpace(r.URL.Query().Get("user"))
+	if user != "" {
+		user = sanitizeUser(user)
+	}
+	b := s.budgets
+	if r.Method == http.MethodDelete {
+		if user == "" {
+			fail(w, r, http.StatusBadRequest, "missing user")
+			return
+		}
+		b.reset(user)
+		s.logf("budget reset user=%s\n", user)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	reset := b.resetAt()
+	out := []budgetStatus{}
+	b.mu.Lock()
+	users := []string{user}
+	if user == "" {
+		users = users[:0]
+		for u := range b.used {
+			users = append(users, u)
+		}
+	}
+	for _, u := range users {
+		st := budgetStatus{UserBytes: *b.entry(u), Limit: b.limitFor(u), ResetAt: reset}
+		if st.Limit > 0 {
+			left := max(st.Limit-st.total(), 0)
+			st.Remaining = &left
+		}
+		out = append(out, st)
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
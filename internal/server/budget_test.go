@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestBudgets(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		perUser map[string]int64
+		charges []int64 // served bytes charged to alice, in order
+		advance time.Duration
+		reset   bool
+		want    bool // exceeded after the steps
+	}{
+		{name: "under the budget", charges: []int64{40, 50}},
+		{name: "at the budget", charges: []int64{60, 40}, want: true},
+		{name: "next day starts over", charges: []int64{150}, advance: 12 * time.Hour},
+		{name: "admin reset", charges: []int64{150}, reset: true},
+		{name: "per-user override", perUser: map[string]int64{"alice": 500}, charges: []int64{150}},
+		{name: "per-user unlimited", perUser: map[string]int64{"alice": 0}, charges: []int64{1 << 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := day
+			path := filepath.Join(t.TempDir(), budgetsFile)
+			b := newBudgets(path, func() time.Time { return now }, t.Logf)
+			b.limit, b.perUser = 100, tt.perUser
+			for _, n := range tt.charges {
+				b.add("alice", n, 0)
+			}
+			now = now.Add(tt.advance)
+			if tt.reset {
+				b.reset("alice")
+			}
+			if got := b.exceeded("alice"); got != tt.want {
+				t.Fatalf("exceeded = %v, want %v", got, tt.want)
+			}
+			if b.exceeded("bob") {
+				t.Fatal("bob exceeded without downloading")
+			}
+		})
+	}
+}
+
+func TestBudgetsPersist(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	path := filepath.Join(t.TempDir(), budgetsFile)
+	b := newBudgets(path, clock, t.Logf)
+	b.add("alice", 30, 70)
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	b = newBudgets(path, clock, t.Logf)
+	b.limit = 100
+	if !b.exceeded("alice") {
+		t.Fatal("restored counts not enforced")
+	}
+	if got := b.resetAt(); !got.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("resetAt = %v", got)
+	}
+	now = now.Add(2 * time.Hour)
+	if b.exceeded("alice") {
+		t.Fatal("yesterday's counts enforced")
+	}
+}
+
+func TestDailyByteBudget(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{SHA256: "cafe", Size: 3, CommitSHA: "abc123"}}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetAuth([]APIKey{{Key: "k-alice", User: "alice"}, {Key: "k-bob", User: "bob"}, {Key: "k-admin", User: "root", Admin: true}})
+	s.SetDailyByteBudget(1, map[string]int64{"bob": 0})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	do := func(method, path, apiKey string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("X-GHH-Api-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+	const download = "/api/v1/download?repo=own/repo&branch=main"
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"first download", http.MethodGet, download, "k-alice", http.StatusOK},
+		{"over the budget", http.MethodGet, download, "k-alice", http.StatusTooManyRequests},
+		{"metadata still served", http.MethodGet, "/api/v1/stats/repos", "k-alice", http.StatusOK},
+		{"unlimited user", http.MethodGet, download, "k-bob", http.StatusOK},
+		{"unlimited user again", http.MethodGet, download, "k-bob", http.StatusOK},
+		{"reset needs admin", http.MethodDelete, "/api/v1/admin/budgets?user=alice", "k-alice", http.StatusForbidden},
+		{"admin reset", http.MethodDelete, "/api/v1/admin/budgets?user=alice", "k-admin", http.StatusNoContent},
+		{"download after reset", http.MethodGet, download, "k-alice", http.StatusOK},
+	}
+	for _, st := range steps {
+		resp := do(st.method, st.path, st.key)
+		if resp.StatusCode != st.want {
+			t.Fatalf("%s: status=%d, want %d", st.name, resp.StatusCode, st.want)
+		}
+		if st.want == http.StatusTooManyRequests {
+			reset, err := time.Parse(time.RFC3339, resp.Header.Get("X-GHH-Quota-Reset"))
+			if resp.Header.Get("X-GHH-Error-Code") != CodeQuotaExceeded || err != nil || !reset.After(time.Now()) || resp.Header.Get("Retry-After") == "" {
+				t.Fatalf("%s: headers=%v", st.name, resp.Header)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/admin/budgets", nil)
+	req.Header.Set("X-GHH-Api-Key", "k-admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []budgetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].User != "alice" || got[1].User != "bob" {
+		t.Fatalf("budgets = %+v", got)
+	}
+	if got[0].Served == 0 || got[0].Limit != 1 || got[0].Remaining == nil || *got[0].Remaining != 0 {
+		t.Fatalf("alice = %+v", got[0])
+	}
+	if got[1].Served == 0 || got[1].Limit != 0 || got[1].Remaining != nil {
+		t.Fatalf("bob = %+v", got[1])
+	}
+}
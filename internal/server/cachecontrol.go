@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// immutableCacheControl is sent with archives served by exact commit SHA,
+// whose bytes can never change. private: they are served per user.
+const immutableCacheControl = "private, max-age=31536000, immutable"
+
+// maxCacheControlAge caps max-age as RFC 9111 section 1.2.2 suggests.
+const maxCacheControlAge = 1 << 31
+
+// cacheDirectives are the Cache-Control request directives archive
+// downloads honour (RFC 9111 section 5.2.1).
+type cacheDirectives struct {
+	maxAge       time.Duration
+	hasMaxAge    bool
+	noCache      bool
+	noStore      bool
+	onlyIfCached bool
+}
+
+// requestCacheControl parses the request's Cache-Control headers. Other
+// directives, and max-age values that are not a number of seconds, are
+// ignored.
+func requestCacheControl(r *http.Request) cacheDirectives {
+	var d cacheDirectives
+	for _, line := range r.Header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "no-cache":
+				d.noCache = true
+			case "no-store":
+				d.noStore = true
+			case "only-if-cached":
+				d.onlyIfCached = true
+			case "max-age":
+				n, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(val), `"`), 10, 64)
+				if err != nil || n < 0 {
+					continue
+				}
+				d.maxAge, d.hasMaxAge = time.Duration(min(n, maxCacheControlAge))*time.Second, true
+			}
+		}
+	}
+	return d
+}
+
+// applyCacheControl folds the request's Cache-Control directives into req:
+// max-age is the freshness window unless max_age= is given, no-cache
+// revalidates whatever the max age, no-store keeps archives that have to
+// be downloaded out of the cache and only-if-cached never goes upstream.
+func applyCacheControl(r *http.Request, req *archiveRequest) {
+	d := requestCacheControl(r)
+	if d.hasMaxAge && !r.URL.Query().Has("max_age") {
+		req.maxAge = d.maxAge
+	}
+	if d.noCache {
+		req.maxAge = 0
+		req.revalidate = true
+	}
+	req.noStore = d.noStore
+	req.onlyIfCached = d.onlyIfCached
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientHeader is where the ghh client names itself and its version.
+const clientHeader = "X-GHH-Client"
+
+const (
+	// maxClientEntries bounds the route/version/client combinations
+	// counted; past it new clients are counted as otherClient.
+	maxClientEntries = 1000
+	// maxClientField bounds a User-Agent or X-GHH-Client kept.
+	maxClientField = 200
+	// deprecationLogEvery is how often the continued use of one
+	// deprecation by one client is logged.
+	deprecationLogEvery = time.Hour
+)
+
+// otherClient stands in for clients that did not fit maxClientEntries.
+const otherClient = "(other)"
+
+// clientKey is what API usage is counted by.
+type clientKey struct {
+	route, api, userAgent, client string
+}
+
+// clientEntry is one line of GET /api/v1/admin/clients.
+type clientEntry struct {
+	Route     string `json:"route"`
+	API       string `json:"api"`
+	UserAgent string `json:"user_agent"`
+	Client    string `json:"client,omitempty"`
+	Requests  int64  `json:"requests"`
+	// Deprecated counts the requests that used a deprecated route or
+	// parameter (see Server.SetDeprecations).
+	Deprecated int64     `json:"deprecated"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// clientUsage counts requests per route, API version and client since the
+// server started; it is not persisted.
+type clientUsage struct {
+	mu      sync.Mutex
+	since   time.Time
+	entries map[clientKey]*clientEntry
+	logged  map[string]time.Time // deprecation|user agent|client -> last logged
+}
+
+func newClientUsage(now time.Time) *clientUsage {
+	return &clientUsage{since: now, entries: map[clientKey]*clientEntry{}, logged: map[string]time.Time{}}
+}
+
+func (u *clientUsage) record(k clientKey, deprecated bool, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e := u.entries[k]
+	if e == nil && len(u.entries) >= maxClientEntries {
+		k.userAgent, k.client = otherClient, otherClient
+		e = u.entries[k]
+	}
+	if e == nil {
+		e = &clientEntry{Route: k.route, API: k.api, UserAgent: k.userAgent, Client: k.client, FirstSeen: now}
+		u.entries[k] = e
+	}
+	e.Requests++
+	if deprecated {
+		e.Deprecated++
+	}
+	e.LastSeen = now
+}
+
+// shouldLog reports whether the use of a deprecation by a client is due
+// to be logged again.
+func (u *clientUsage) shouldLog(key string, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if last, ok := u.logged[key]; ok && now.Sub(last) < deprecationLogEvery {
+		return false
+	}
+	if len(u.logged) >= maxClientEntries {
+		clear(u.logged)
+	}
+	u.logged[key] = now
+	return true
+}
+
+// Deprecation marks a route, or a query parameter or request header on
+// it, as deprecated (see Server.SetDeprecations). Requests that use it are
+// served as before, with Deprecation, Sunset and Link headers added.
+type Deprecation struct {
+	// Route is a route pattern as registered, without the method (e.g.
+	// "/api/v1/download"), or a prefix ending in "*".
+	Route string
+	// Param is a query parameter, or "header:<Name>" for a request header;
+	// empty deprecates the whole route.
+	Param string
+	// Since fills the Deprecation header ("@<unix seconds>", RFC 9745);
+	// when zero it is "true".
+	Since time.Time
+	// Sunset, when set, is sent as the Sunset header (RFC 8594).
+	Sunset time.Time
+	// Link points to migration notes (Link rel="deprecation").
+	Link string
+}
+
+func (d Deprecation) String() string {
+	if d.Param == "" {
+		return d.Route
+	}
+	return d.Route + "?" + d.Param
+}
+
+// ParseDeprecation parses "<route>[?<param>][; since=<date>][; sunset=<date>][; link=<url>]",
+// dates as 2006-01-02 or RFC 3339, e.g.
+// "/api/v1/download?legacy; sunset=2027-01-01".
+func ParseDeprecation(entry string) (Deprecation, error) {
+	parts := strings.Split(entry, ";")
+	var d Deprecation
+	d.Route, d.Param, _ = strings.Cut(strings.TrimSpace(parts[0]), "?")
+	d.Route, d.Param = strings.TrimSpace(d.Route), strings.TrimSpace(d.Param)
+	if !strings.HasPrefix(d.Route, "/") {
+		return Deprecation{}, fmt.Errorf("deprecation %q: route must start with /", entry)
+	}
+	if name, ok := strings.CutPrefix(d.Param, "header:"); ok {
+		if name = strings.TrimSpace(name); name == "" {
+			return Deprecation{}, fmt.Errorf("deprecation %q: empty header name", entry)
+		}
+		d.Param = "header:" + http.CanonicalHeaderKey(name)
+	}
+	for _, p := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !ok || v == "" {
+			return Deprecation{}, fmt.Errorf("deprecation %q: %q is not key=value", entry, p)
+		}
+		var err error
+		switch k {
+		case "since":
+			d.Since, err = parseDeprecationDate(v)
+		case "sunset":
+			d.Sunset, err = parseDeprecationDate(v)
+		case "link":
+			d.Link = v
+		default:
+			err = fmt.Errorf("unknown key %q (since, sunset, link)", k)
+		}
+		if err != nil {
+			return Deprecation{}, fmt.Errorf("deprecation %q: %w", entry, err)
+		}
+	}
+	return d, nil
+}
+
+func parseDeprecationDate(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// matches reports whether r, served by the route pattern, uses d.
+func (d Deprecation) matches(pattern string, r *http.Request) bool {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	if prefix, ok := strings.CutSuffix(d.Route, "*"); ok {
+		if !strings.HasPrefix(pattern, prefix) {
+			return false
+		}
+	} else if pattern != d.Route {
+		return false
+	}
+	if d.Param == "" {
+		return true
+	}
+	if name, ok := strings.CutPrefix(d.Param, "header:"); ok {
+		return r.Header.Get(name) != ""
+	}
+	return r.URL.Query().Has(d.Param)
+}
+
+// annotate adds d's headers to the response.
+func (d Deprecation) annotate(h http.Header) {
+	if d.Since.IsZero() {
+		h.Set("Deprecation", "true")
+	} else {
+		h.Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+	}
+	if !d.Sunset.IsZero() {
+		h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+	}
+}
+
+// SetDeprecations replaces the deprecated routes and parameters. It may be
+// called again while serving; nil deprecates nothing.
+func (s *Server) SetDeprecations(rules []Deprecation) {
+	s.deprecations.Store(&rules)
+}
+
+// apiVersion names the API a route pattern belongs to.
+func apiVersion(pattern string) string {
+	switch {
+	case strings.Contains(pattern, "/api/v2/"):
+		return "v2"
+	case strings.Contains(pattern, "/api/v1/"):
+		return "v1"
+	}
+	return "other"
+}
+
+func clipClientField(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) > maxClientField {
+		v = v[:maxClientField]
+	}
+	return v
+}
+
+// countClients counts each request by route, API version, User-Agent and
+// X-GHH-Client, and marks and logs the use of deprecated routes and
+// parameters. It never changes how a request is served.
+func (s *Server) countClients(pattern string, h http.Handler) http.Handler {
+	api := apiVersion(pattern)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var used []Deprecation
+		if rules := s.deprecations.Load(); rules != nil {
+			for _, d := range *rules {
+				if d.matches(pattern, r) {
+					d.annotate(w.Header())
+					used = append(used, d)
+				}
+			}
+		}
+		now := s.now()
+		k := clientKey{route: pattern, api: api, userAgent: clipClientField(r.UserAgent()), client: clipClientField(r.Header.Get(clientHeader))}
+		s.clients.record(k, len(used) > 0, now)
+		for _, d := range used {
+			if s.clients.shouldLog(d.String()+"|"+k.userAgent+"|"+k.client, now) {
+				s.logf("deprecated: %s used path=%s user_agent=%q client=%q\n", d, r.URL.Path, k.userAgent, k.client)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientsReport is the answer of GET /api/v1/admin/clients.
+type clientsReport struct {
+	// Since is when counting started (the server start).
+	Since        time.Time     `json:"since"`
+	Clients      []clientEntry `json:"clients"`
+	Deprecations []string      `json:"deprecations"`
+}
+
+// handleClients lists API usage by route, API version and client, busiest
+// first; api= keeps one API version and deprecated=true the entries that
+// used a deprecation. Admin only.
+func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "client usage requires an admin key")
+		return
+	}
+	api := strings.TrimSpace(r.URL.Query().Get("api"))
+	var onlyDeprecated bool
+	if v := strings.TrimSpace(r.URL.Query().Get("deprecated")); v != "" {
+		var err error
+		if onlyDeprecated, err = strconv.ParseBool(v); err != nil {
+			fail(w, r, http.StatusBadRequest, "deprecated must be true or false, got "+strconv.Quote(v))
+			return
+		}
+	}
+	u := s.clients
+	u.mu.Lock()
+	report := clientsReport{Since: u.since, Clients: make([]clientEntry, 0, len(u.entries)), Deprecations: []string{}}
+	for _, e := range u.entries {
+		if (api == "" || e.API == api) && (!onlyDeprecated || e.Deprecated > 0) {
+			report.Clients = append(report.Clients, *e)
+		}
+	}
+	u.mu.Unlock()
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.UserAgent != b.UserAgent {
+			return a.UserAgent < b.UserAgent
+		}
+		return a.Client < b.Client
+	})
+	if rules := s.deprecations.Load(); rules != nil {
+		for _, d := range *rules {
+			report.Deprecations = append(report.Deprecations, d.String())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestClientsAndDeprecations(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	var logs bytes.Buffer
+	s := New(&fakeStore{ensurePath: zipPath, outcome: storage.CacheHit}, WithDefaultUser("default"), withStatsFile(""), WithLogger(log.New(&logs, "", 0)))
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	var rules []Deprecation
+	for _, e := range []string{
+		"/api/v1/download?legacy; since=2026-01-01; sunset=2027-01-01; link=https://example.com/migrate",
+		"/api/v1/download?header:X-GHH-Debug-Delay",
+	} {
+		d, err := ParseDeprecation(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, d)
+	}
+	s.SetDeprecations(rules)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	do := func(method, url, key string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("X-GHH-Api-Key", key)
+		req.Header.Set("User-Agent", "test-agent/1")
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		hdr         map[string]string
+		deprecation string
+		sunset      string
+	}{
+		{"plain", "/api/v1/download?repo=own/repo", nil, "", ""},
+		{"client header", "/api/v1/download?repo=own/repo", map[string]string{clientHeader: "ghh/1.2.3"}, "", ""},
+		{"legacy param", "/api/v1/download?repo=own/repo&legacy=true", nil, "@1767225600", "Fri, 01 Jan 2027 00:00:00 GMT"},
+		{"legacy again", "/api/v1/download?repo=own/repo&legacy=1", nil, "@1767225600", "Fri, 01 Jan 2027 00:00:00 GMT"},
+		{"deprecated header", "/api/v1/download?repo=own/repo", map[string]string{"X-GHH-Debug-Delay": "0s"}, "true", ""},
+		{"other route", "/api/v2/repos/own/repo/archive/main?legacy=true", nil, "", ""},
+	}
+	for _, tt := range tests {
+		rec := do(http.MethodGet, tt.url, "alice-key", tt.hdr)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.name, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Deprecation"); got != tt.deprecation {
+			t.Fatalf("%s: Deprecation %q, want %q", tt.name, got, tt.deprecation)
+		}
+		if got := rec.Header().Get("Sunset"); got != tt.sunset {
+			t.Fatalf("%s: Sunset %q, want %q", tt.name, got, tt.sunset)
+		}
+	}
+	if got := do(http.MethodGet, "/api/v1/download?repo=own/repo&legacy=true", "alice-key", nil).Header().Get("Link"); got != `<https://example.com/migrate>; rel="deprecation"` {
+		t.Fatalf("Link %q", got)
+	}
+	// Continued use by the same client is logged once.
+	if got := strings.Count(logs.String(), "deprecated: "); got != 2 {
+		t.Fatalf("logged %d deprecation lines, want one per rule:\n%s", got, logs.String())
+	}
+
+	if rec := do(http.MethodGet, "/api/v1/admin/clients", "alice-key", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("not admin: status %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/v1/admin/clients", "root-key", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("post: status %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/v1/admin/clients?deprecated=maybe", "root-key", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("deprecated=maybe: status %d", rec.Code)
+	}
+	report := func(query string) clientsReport {
+		t.Helper()
+		rec := do(http.MethodGet, "/api/v1/admin/clients"+query, "root-key", nil)
+		var r clientsReport
+		if err := json.NewDecoder(rec.Body).Decode(&r); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d err %v", query, rec.Code, err)
+		}
+		return r
+	}
+	all := report("?api=v1")
+	var download, withClient *clientEntry
+	for i, e := range all.Clients {
+		if e.API != "v1" {
+			t.Fatalf("api=v1 listed %+v", e)
+		}
+		switch {
+		case e.Route == "/api/v1/download" && e.Client == "":
+			download = &all.Clients[i]
+		case e.Route == "/api/v1/download" && e.Client == "ghh/1.2.3":
+			withClient = &all.Clients[i]
+		}
+	}
+	if download == nil || download.Requests != 5 || download.Deprecated != 4 || download.UserAgent != "test-agent/1" {
+		t.Fatalf("download entry %+v in %+v", download, all.Clients)
+	}
+	if withClient == nil || withClient.Requests != 1 || withClient.Deprecated != 0 {
+		t.Fatalf("client entry %+v", withClient)
+	}
+	if len(all.Deprecations) != 2 || all.Deprecations[0] != "/api/v1/download?legacy" {
+		t.Fatalf("deprecations %q", all.Deprecations)
+	}
+	if got := report("?deprecated=true").Clients; len(got) != 1 || got[0].Deprecated != 4 {
+		t.Fatalf("deprecated=true: %+v", got)
+	}
+	if got := report("?api=v2").Clients; len(got) != 1 || !strings.Contains(got[0].Route, "/api/v2/") {
+		t.Fatalf("api=v2: %+v", got)
+	}
+}
+
+func TestParseDeprecation(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Deprecation
+		wantErr string
+	}{
+		{in: "/api/v1/download", want: Deprecation{Route: "/api/v1/download"}},
+		{in: " /api/v1/* ? header:x-ghh-debug-delay ; link=https://x", want: Deprecation{Route: "/api/v1/*", Param: "header:X-Ghh-Debug-Delay", Link: "https://x"}},
+		{in: "/api/v1/download?legacy; since=2026-01-01; sunset=2027-01-01T12:00:00Z", want: Deprecation{
+			Route: "/api/v1/download", Param: "legacy",
+			Since:  time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			Sunset: time.Date(2027, 1, 1, 12, 0, 0, 0, time.UTC),
+		}},
+		{in: "api/v1/download", wantErr: "must start with /"},
+		{in: "/api/v1/download?header:", wantErr: "empty header name"},
+		{in: "/api/v1/download; sunset", wantErr: "not key=value"},
+		{in: "/api/v1/download; sunset=soon", wantErr: "cannot parse"},
+		{in: "/api/v1/download; until=2027-01-01", wantErr: "unknown key"},
+	}
+	for _, tt := range tests {
+		got, err := ParseDeprecation(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("%q: err %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !got.Since.Equal(tt.want.Since) || !got.Sunset.Equal(tt.want.Sunset) || got.Route != tt.want.Route || got.Param != tt.want.Param || got.Link != tt.want.Link {
+			t.Fatalf("%q: got %+v err %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
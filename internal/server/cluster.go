@@ -0,0 +1,546 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clusterSignatureHeader carries the signature of a request one
+	// instance sends another: "t=<unix seconds>,p=<purpose>,n=<nonce>,
+	// from=<base URL>,b=<hex SHA-256 of the body>,v1=<hex HMAC>". The HMAC
+	// also covers the method, request URI, Content-Length and identity
+	// headers; each nonce is accepted once.
+	clusterSignatureHeader = "X-GHH-Cluster-Signature"
+	// clusterSignatureSkew is how far the signing time may be from ours.
+	clusterSignatureSkew = 5 * time.Minute
+	// clusterPeerTimeout bounds each stats call to a peer.
+	clusterPeerTimeout = 10 * time.Second
+)
+
+// Purposes of signed requests between instances: a request forwarded to
+// the instance that owns its user, and a peer's share of cluster stats.
+const (
+	clusterForward = "forward"
+	clusterStats   = "stats"
+)
+
+// ClusterOptions configures cluster mode (see Server.SetCluster). Base URLs
+// are how clients and the other instances reach an instance, e.g.
+// "http://hub-b:8080".
+type ClusterOptions struct {
+	// Self is this instance's base URL; Peers are the others'.
+	Self  string
+	Peers []string
+	// Routes pins users to instances; other users are spread over all of
+	// them by rendezvous hashing, so every instance agrees without a
+	// shared table.
+	Routes map[string]string
+	// Proxy streams a request for a user owned by another instance from
+	// that instance instead of redirecting the client there with 307.
+	Proxy bool
+	// Secret signs the requests instances send each other.
+	Secret string
+}
+
+// cluster is the routing state of cluster mode.
+type cluster struct {
+	self    string
+	members []string // self and peers
+	routes  map[string]string
+	proxy   bool
+	secret  []byte
+	client  *http.Client
+	proxies map[string]*httputil.ReverseProxy
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // signature nonces seen -> when they expire
+}
+
+// SetCluster turns on cluster mode: requests for users another instance
+// owns are redirected (or proxied) there, GET /api/v1/locate names the
+// owner, and the stats endpoints add the peers' numbers with cluster=true.
+// It fails for base URLs that are not http(s), routes to unknown instances
+// and a missing secret.
+func (s *Server) SetCluster(o ClusterOptions) error {
+	self, err := clusterURL(o.Self)
+	if err != nil {
+		return fmt.Errorf("cluster self: %w", err)
+	}
+	if strings.TrimSpace(o.Secret) == "" {
+		return errors.New("cluster mode needs a cluster secret")
+	}
+	c := &cluster{
+		self:    self,
+		members: []string{self},
+		routes:  map[string]string{},
+		proxy:   o.Proxy,
+		secret:  []byte(strings.TrimSpace(o.Secret)),
+		client:  &http.Client{Timeout: clusterPeerTimeout},
+		proxies: map[string]*httputil.ReverseProxy{},
+		nonces:  map[string]time.Time{},
+	}
+	for _, p := range o.Peers {
+		peer, err := clusterURL(p)
+		if err != nil {
+			return fmt.Errorf("cluster peer: %w", err)
+		}
+		if !c.member(peer) {
+			c.members = append(c.members, peer)
+		}
+	}
+	for user, base := range o.Routes {
+		u, err := clusterURL(base)
+		if err != nil {
+			return fmt.Errorf("cluster route for %q: %w", user, err)
+		}
+		if !c.member(u) {
+			return fmt.Errorf("cluster route for %q: %s is neither cluster_self nor a peer", user, u)
+		}
+		c.routes[sanitizeUser(user)] = u
+	}
+	for _, m := range c.members[1:] {
+		c.proxies[m] = s.clusterProxy(c, m)
+	}
+	s.cluster = c
+	return nil
+}
+
+// clusterURL normalizes a base URL: http(s), a host, no query, no trailing
+// slash.
+func clusterURL(v string) (string, error) {
+	v = strings.TrimRight(strings.TrimSpace(v), "/")
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("base url must be an http(s) URL without query, got %q", v)
+	}
+	return v, nil
+}
+
+func (c *cluster) member(base string) bool {
+	for _, m := range c.members {
+		if m == base {
+			return true
+		}
+	}
+	return false
+}
+
+// owner returns the base URL of the instance that holds user's cache and
+// whether a route (rather than the hash) chose it.
+func (c *cluster) owner(user string) (string, bool) {
+	if base, ok := c.routes[user]; ok {
+		return base, true
+	}
+	best, bestScore := "", uint64(0)
+	for _, m := range c.members {
+		sum := sha256.Sum256([]byte(m + "\n" + user))
+		score := binary.BigEndian.Uint64(sum[:8])
+		if best == "" || score > bestScore || (score == bestScore && m < best) {
+			best, bestScore = m, score
+		}
+	}
+	return best, false
+}
+
+// clusterIdentityHeaders are the request headers that say who a request
+// is for; the signature covers them so they cannot be swapped.
+var clusterIdentityHeaders = []string{"Authorization", "X-GHH-Api-Key", "X-GHH-User", "X-GHH-Token"}
+
+// emptyBodySHA256 is the hex SHA-256 of an empty body.
+const emptyBodySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var (
+	// errClusterBody reports a signed request whose body is not the one
+	// signed.
+	errClusterBody = errors.New("cluster request body does not match its signature")
+	// errClusterBodyTooLarge reports a body too large to forward.
+	errClusterBodyTooLarge = errors.New("request body over the upload cap")
+)
+
+// clusterSigned is what a cluster signature covers besides the method,
+// request URI and identity headers of the request it is on.
+type clusterSigned struct {
+	ts      int64
+	purpose string
+	nonce   string
+	from    string // base URL of the signing instance
+	body    string // hex SHA-256 of the body
+}
+
+func (c *cluster) mac(sg clusterSigned, r *http.Request) string {
+	m := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(m, "%d\n%s\n%s\n%s\n%s\n%s\n%d\n%s", sg.ts, sg.purpose, sg.nonce, sg.from, r.Method, r.URL.RequestURI(), max(r.ContentLength, 0), sg.body)
+	for _, h := range clusterIdentityHeaders {
+		fmt.Fprintf(m, "\n%s", r.Header.Get(h))
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// sign marks req, about to be sent to a peer, as coming from this instance
+// for purpose. body is the hex SHA-256 of req's body, whose length must be
+// in req.ContentLength.
+func (c *cluster) sign(req *http.Request, purpose, body string, now time.Time) {
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	sg := clusterSigned{ts: now.Unix(), purpose: purpose, nonce: hex.EncodeToString(nonce[:]), from: c.self, body: body}
+	req.Header.Set(clusterSignatureHeader, fmt.Sprintf("t=%d,p=%s,n=%s,from=%s,b=%s,v1=%s", sg.ts, sg.purpose, sg.nonce, sg.from, sg.body, c.mac(sg, req)))
+}
+
+// verify returns the purpose of a request signed by a peer, "" for one
+// that is not signed, and an error for a signature that is not valid now
+// or was seen before. r.Body is replaced by one that fails at its end
+// when the body read is not the one signed.
+func (c *cluster) verify(r *http.Request, now time.Time) (string, error) {
+	h := strings.TrimSpace(r.Header.Get(clusterSignatureHeader))
+	if h == "" {
+		return "", nil
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(h, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+	ts, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil || fields["p"] == "" || len(fields["n"]) < 16 || len(fields["b"]) != sha256.Size*2 {
+		return "", errors.New("malformed cluster signature")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > clusterSignatureSkew || d < -clusterSignatureSkew {
+		return "", errors.New("cluster signature expired")
+	}
+	sg := clusterSigned{ts: ts, purpose: fields["p"], nonce: fields["n"], from: fields["from"], body: fields["b"]}
+	if !c.member(sg.from) {
+		return "", errors.New("cluster signature from an unknown instance")
+	}
+	if !hmac.Equal([]byte(fields["v1"]), []byte(c.mac(sg, r))) {
+		return "", errors.New("invalid cluster signature")
+	}
+	if !c.fresh(sg.nonce, time.Unix(ts, 0).Add(clusterSignatureSkew), now) {
+		return "", errors.New("replayed cluster signature")
+	}
+	if sg.body != emptyBodySHA256 || r.ContentLength > 0 {
+		r.Body = &signedBody{ReadCloser: r.Body, sum: sha256.New(), want: sg.body}
+	}
+	return sg.purpose, nil
+}
+
+// fresh records nonce until it expires and reports whether it was new.
+func (c *cluster) fresh(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.nonces) >= 1024 {
+		for n, exp := range c.nonces {
+			if now.After(exp) {
+				delete(c.nonces, n)
+			}
+		}
+	}
+	if _, seen := c.nonces[nonce]; seen {
+		return false
+	}
+	c.nonces[nonce] = expires
+	return true
+}
+
+// signedBody hashes a signed request's body as it is read and fails at the
+// end instead of io.EOF when it is not the body signed.
+type signedBody struct {
+	io.ReadCloser
+	sum  hash.Hash
+	want string
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sum.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.sum.Sum(nil)) != b.want {
+		return n, errClusterBody
+	}
+	return n, err
+}
+
+// clusterBodyKey carries the hex SHA-256 of a spooled request body to the
+// proxy that signs it.
+type clusterBodyKey struct{}
+
+// spoolClusterBody reads the body of r, about to be proxied to a peer, into
+// a temporary file while hashing it, so the signature can cover it. It
+// returns the request to proxy and a cleanup for the file; bodies over the
+// upload cap fail with errClusterBodyTooLarge.
+func (s *Server) spoolClusterBody(r *http.Request) (*http.Request, func(), error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		r = r.WithContext(context.WithValue(r.Context(), clusterBodyKey{}, emptyBodySHA256))
+		r.ContentLength, r.Body = 0, http.NoBody
+		return r, func() {}, nil
+	}
+	f, err := os.CreateTemp("", "ghh-cluster-*.body")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	body := io.Reader(r.Body)
+	if s.uploadMax > 0 {
+		body = io.LimitReader(r.Body, s.uploadMax+multipartSlack+1)
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, sum), body)
+	if err == nil && s.uploadMax > 0 && n > s.uploadMax+multipartSlack {
+		err = errClusterBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), clusterBodyKey{}, hex.EncodeToString(sum.Sum(nil))))
+	r.ContentLength, r.Body = n, io.NopCloser(f)
+	r.Header.Del("Transfer-Encoding")
+	return r, cleanup, nil
+}
+
+// clusterProxy streams requests forwarded to the peer at base.
+func (s *Server) clusterProxy(c *cluster, base string) *httputil.ReverseProxy {
+	target, _ := url.Parse(base)
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			body, _ := pr.In.Context().Value(clusterBodyKey{}).(string)
+			c.sign(pr.Out, clusterForward, body, s.now())
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.logf("cluster: forward %s to %s: %v\n", r.URL.Path, base, err)
+			fail(w, r, http.StatusBadGateway, "cluster peer "+base+" unavailable")
+		},
+	}
+}
+
+// clusterLocal reports whether a route is always answered by the instance
+// it reached: instance-wide and admin routes, the locate and stats
+// endpoints, signed URLs (whose user is in the token) and GitHub hooks.
+func clusterLocal(pattern string, c routeClass) bool {
+	if c == monitorRoute {
+		return true
+	}
+	switch pattern {
+	case "/api/v1/version", "/api/v1/locate", "/api/v1/public-key", signedDownloadPath,
+		"/api/v1/mirror/hook", "/api/v1/revalidate/status", "/api/v1/user/token/validate":
+		return true
+	}
+	return strings.HasPrefix(pattern, "/api/v1/stats/") || strings.HasPrefix(pattern, "/api/v1/admin/")
+}
+
+// clusterRoute sends requests for users another instance owns there: a 307
+// to the same path on the owner, or the owner's answer streamed back in
+// proxy mode. The user is the one the request names (X-GHH-User, user=) or
+// its API key's; requests that fail authentication are left to the
+// handler. Requests a peer forwarded are served where they land, so
+// instances that disagree about an owner cannot loop.
+func (s *Server) clusterRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.cluster
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		purpose, err := c.verify(r, s.now())
+		if err != nil {
+			fail(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if purpose == clusterForward {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p, err := s.authenticate(r)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, err := s.effectiveUser(r, p, "")
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		owner, _ := c.owner(user)
+		if owner == c.self {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-GHH-Cluster-Owner", owner)
+		if c.proxy {
+			spooled, cleanup, err := s.spoolClusterBody(r)
+			if errors.Is(err, errClusterBodyTooLarge) {
+				fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", s.uploadMax))
+				return
+			}
+			if err != nil {
+				s.logf("cluster: spool request body for %s: %v\n", owner, err)
+				fail(w, r, http.StatusBadRequest, "read request body")
+				return
+			}
+			defer cleanup()
+			c.proxies[owner].ServeHTTP(w, spooled)
+			return
+		}
+		http.Redirect(w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// location is the answer of GET /api/v1/locate.
+type location struct {
+	User string `json:"user"`
+	Repo string `json:"repo,omitempty"`
+	// BaseURL is the instance that holds the user's cache; empty when
+	// cluster mode is off, as any instance will do.
+	BaseURL string `json:"base_url"`
+	// Self is set when BaseURL is the instance that answered.
+	Self bool `json:"self"`
+	// Source is "route" for a configured route, "hash" otherwise.
+	Source string `json:"source,omitempty"`
+}
+
+// handleLocate names the instance that owns the caller's user (or the one
+// named by X-GHH-User or user=). repo= is accepted for clients that locate
+// per repo; caches are sharded by user, so it does not change the answer.
+func (s *Server) handleLocate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	loc := location{User: user, Repo: repoArg(r.URL.Query().Get("repo")), Self: true}
+	if c := s.cluster; c != nil {
+		owner, routed := c.owner(user)
+		loc.BaseURL, loc.Self, loc.Source = owner, owner == c.self, "hash"
+		if routed {
+			loc.Source = "route"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(loc)
+}
+
+// peerAnswer is one peer's answer to a cluster stats request.
+type peerAnswer struct {
+	peer string
+	body []byte
+	err  error
+}
+
+// clusterStats reports whether r asks for stats across the cluster
+// (cluster=true), answering 400 for an invalid value and 501 when cluster
+// mode is off.
+func (s *Server) clusterStats(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("cluster"))
+	if v == "" {
+		return false, true
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, "cluster must be true or false, got "+strconv.Quote(v))
+		return false, false
+	}
+	if on && s.cluster == nil {
+		fail(w, r, http.StatusNotImplemented, "cluster mode is off")
+		return false, false
+	}
+	return on, true
+}
+
+// statsPeer reports whether r is a peer's signed request for this
+// instance's share of cluster stats, answering 401 for a bad signature.
+// Such requests are trusted with every user's stats: the instance that
+// fans out has already checked what its caller may see.
+func (s *Server) statsPeer(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	c := s.cluster
+	if c == nil || r.Header.Get(clusterSignatureHeader) == "" {
+		return false, true
+	}
+	purpose, err := c.verify(r, s.now())
+	if err != nil || purpose != clusterStats {
+		if err == nil {
+			err = errors.New("cluster signature is not for stats")
+		}
+		fail(w, r, http.StatusUnauthorized, err.Error())
+		return false, false
+	}
+	return true, true
+}
+
+// fanOut asks every peer for path with query, signed for stats, and hands
+// each answer to add in peer order. X-GHH-Cluster-Failed lists the peers
+// that did not answer, or whose answer add refused.
+func (s *Server) fanOut(ctx context.Context, w http.ResponseWriter, path string, query url.Values, add func([]byte) error) {
+	c := s.cluster
+	peers := c.members[1:]
+	out := make([]peerAnswer, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			out[i] = peerAnswer{peer: peer}
+			out[i].body, out[i].err = c.get(ctx, peer+path+"?"+query.Encode(), s.now())
+		}(i, peer)
+	}
+	wg.Wait()
+	var failed []string
+	for _, a := range out {
+		err := a.err
+		if err == nil {
+			err = add(a.body)
+		}
+		if err != nil {
+			s.logf("cluster: stats from %s: %v\n", a.peer, err)
+			failed = append(failed, a.peer)
+		}
+	}
+	if len(failed) > 0 {
+		w.Header().Set("X-GHH-Cluster-Failed", strings.Join(failed, ", "))
+	}
+}
+
+// get fetches rawURL from a peer, signed for stats.
+func (c *cluster) get(ctx context.Context, rawURL string, now time.Time) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, clusterStats, emptyBodySHA256, now)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestCluster(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	newInstance := func() (*Server, *httptest.Server) {
+		s := NewServerWithStore(&fakeStore{ensurePath: zipPath, outcome: storage.CacheHit}, "", "default")
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		return s, ts
+	}
+	sa, a := newInstance()
+	sb, b := newInstance()
+	const secret = "shared"
+	if err := sa.SetCluster(ClusterOptions{Self: a.URL, Peers: []string{b.URL}, Routes: map[string]string{"pinned": b.URL}, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetCluster(ClusterOptions{Self: b.URL, Peers: []string{a.URL + "/"}, Routes: map[string]string{"pinned": b.URL}, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both instances agree on every owner; find a user each one holds.
+	owned := map[string]string{}
+	for i := 0; i < 100 && len(owned) < 2; i++ {
+		user := fmt.Sprintf("u%d", i)
+		oa, _ := sa.cluster.owner(user)
+		ob, _ := sb.cluster.owner(user)
+		if oa != ob {
+			t.Fatalf("owner of %s: %s on a, %s on b", user, oa, ob)
+		}
+		if owned[oa] == "" {
+			owned[oa] = user
+		}
+	}
+	userA, userB := owned[a.URL], owned[b.URL]
+	if userA == "" || userB == "" {
+		t.Fatalf("hashing left an instance without users: %v", owned)
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(base, path, user string, hdr map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		if user != "" {
+			req.Header.Set("X-GHH-User", user)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := noFollow.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		resp := get(a.URL, "/api/v1/download?repo=own/repo", userB, nil)
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Fatalf("status=%d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Location"); got != b.URL+"/api/v1/download?repo=own/repo" {
+			t.Fatalf("Location %q", got)
+		}
+		if got := resp.Header.Get("X-GHH-Cluster-Owner"); got != b.URL {
+			t.Fatalf("X-GHH-Cluster-Owner %q", got)
+		}
+		if resp := get(a.URL, "/api/v1/download?repo=own/repo", userA, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("own user: status=%d", resp.StatusCode)
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		sa.cluster.proxy = true
+		defer func() { sa.cluster.proxy = false }()
+		resp := get(a.URL, "/api/v1/download?repo=own/proxied", userB, nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-GHH-Cluster-Owner") != b.URL {
+			t.Fatalf("status=%d owner=%q", resp.StatusCode, resp.Header.Get("X-GHH-Cluster-Owner"))
+		}
+		if got := sb.stats.top(userB, 0); len(got) != 1 || got[0].Repo != "own/proxied" {
+			t.Fatalf("b stats %+v", got)
+		}
+		if got := sa.stats.top(userB, 0); len(got) != 0 {
+			t.Fatalf("a served the proxied request itself: %+v", got)
+		}
+	})
+
+	t.Run("signatures", func(t *testing.T) {
+		resp := get(a.URL, "/api/v1/download?repo=own/repo", userB, map[string]string{clusterSignatureHeader: "t=1,p=forward,v1=00"})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("bad signature: status=%d", resp.StatusCode)
+		}
+		// A forwarded request is served where it lands.
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo", nil)
+		req.Header.Set("X-GHH-User", userB)
+		sb.cluster.sign(req, clusterForward, emptyBodySHA256, sb.now())
+		resp = get(a.URL, "/api/v1/download?repo=own/repo", userB, map[string]string{clusterSignatureHeader: req.Header.Get(clusterSignatureHeader)})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("forwarded: status=%d", resp.StatusCode)
+		}
+		// The same signature is not accepted twice.
+		resp = get(a.URL, "/api/v1/download?repo=own/repo", userB, map[string]string{clusterSignatureHeader: req.Header.Get(clusterSignatureHeader)})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("replayed: status=%d", resp.StatusCode)
+		}
+		// Stats signatures do not unlock forwarding.
+		sb.cluster.sign(req, clusterStats, emptyBodySHA256, sb.now())
+		resp = get(a.URL, "/api/v1/download?repo=own/repo", userB, map[string]string{clusterSignatureHeader: req.Header.Get(clusterSignatureHeader)})
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Fatalf("stats-signed: status=%d", resp.StatusCode)
+		}
+	})
+
+	t.Run("locate", func(t *testing.T) {
+		tests := []struct {
+			user, base, source string
+			self               bool
+		}{
+			{userA, a.URL, "hash", true},
+			{userB, b.URL, "hash", false},
+			{"pinned", b.URL, "route", false},
+		}
+		for _, tc := range tests {
+			resp := get(a.URL, "/api/v1/locate?repo=own/repo&user="+tc.user, "", nil)
+			var loc location
+			if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
+				t.Fatal(err)
+			}
+			if loc.User != tc.user || loc.Repo != "own/repo" || loc.BaseURL != tc.base || loc.Self != tc.self || loc.Source != tc.source {
+				t.Fatalf("locate %s: %+v", tc.user, loc)
+			}
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		var stats []RepoStat
+		resp := get(a.URL, "/api/v1/stats/repos?cluster=true", "", nil)
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		repos := map[string]string{}
+		for _, st := range stats {
+			repos[st.User+" "+st.Repo] = st.Repo
+		}
+		if repos[userB+" own/proxied"] == "" || repos[userA+" own/repo"] == "" || resp.Header.Get("X-GHH-Cluster-Failed") != "" {
+			t.Fatalf("cluster stats %+v (failed %q)", stats, resp.Header.Get("X-GHH-Cluster-Failed"))
+		}
+		var local, all usageSummary
+		resp = get(a.URL, "/api/v1/stats/summary", "", nil)
+		_ = json.NewDecoder(resp.Body).Decode(&local)
+		resp = get(a.URL, "/api/v1/stats/summary?cluster=true", "", nil)
+		_ = json.NewDecoder(resp.Body).Decode(&all)
+		if want := local.LastHour.Requests + sb.usage.summary().LastHour.Requests; all.LastHour.Requests != want || want == local.LastHour.Requests {
+			t.Fatalf("cluster summary %d requests, want %d", all.LastHour.Requests, want)
+		}
+
+		// A peer that does not answer is named, not fatal.
+		gone := httptest.NewServer(http.NotFoundHandler())
+		gone.Close()
+		if err := sa.SetCluster(ClusterOptions{Self: a.URL, Peers: []string{b.URL, gone.URL}, Secret: secret}); err != nil {
+			t.Fatal(err)
+		}
+		resp = get(a.URL, "/api/v1/stats/repos?cluster=true", "", nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-GHH-Cluster-Failed") != gone.URL {
+			t.Fatalf("status=%d failed=%q", resp.StatusCode, resp.Header.Get("X-GHH-Cluster-Failed"))
+		}
+
+		// Without the secret a stats request is refused.
+		resp = get(b.URL, "/api/v1/stats/repos", "", map[string]string{clusterSignatureHeader: "t=1,p=stats,v1=00"})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("forged stats: status=%d", resp.StatusCode)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		_, solo := newInstance()
+		if resp := get(solo.URL, "/api/v1/stats/repos?cluster=true", "", nil); resp.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("cluster=true without cluster mode: status=%d", resp.StatusCode)
+		}
+		if resp := get(solo.URL, "/api/v1/stats/summary?cluster=maybe", "", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("cluster=maybe: status=%d", resp.StatusCode)
+		}
+	})
+}
+
+func TestClusterSignature(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	if err := s.SetCluster(ClusterOptions{Self: "http://a:1", Peers: []string{"http://b:1"}, Secret: "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	peer := NewServerWithStore(&fakeStore{}, "", "default")
+	if err := peer.SetCluster(ClusterOptions{Self: "http://b:1", Peers: []string{"http://a:1"}, Secret: "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	outsider := NewServerWithStore(&fakeStore{}, "", "default")
+	if err := outsider.SetCluster(ClusterOptions{Self: "http://c:1", Secret: "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	const body = `{"repo":"own/repo"}`
+	sum := sha256.Sum256([]byte(body))
+	signed := func(signer *Server) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/import?user=alice", strings.NewReader(body))
+		req.Header.Set("X-GHH-User", "alice")
+		signer.cluster.sign(req, clusterForward, hex.EncodeToString(sum[:]), signer.now())
+		return req
+	}
+	// resend copies a signed request, as a peer would receive it, with
+	// the given body and headers changed.
+	resend := func(req *http.Request, newBody string, hdr map[string]string) *http.Request {
+		out := httptest.NewRequest(req.Method, req.URL.RequestURI(), strings.NewReader(newBody))
+		out.Header = req.Header.Clone()
+		for k, v := range hdr {
+			out.Header.Set(k, v)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		wantErr string // from verify
+		badBody bool   // verify passes, reading the body fails
+	}{
+		{name: "valid", req: func() *http.Request { return resend(signed(peer), body, nil) }},
+		{name: "modified body", req: func() *http.Request { return resend(signed(peer), `{"repo":"own/evil"}`, nil) }, badBody: true},
+		{name: "same length body", req: func() *http.Request { return resend(signed(peer), strings.Replace(body, "own", "OWN", 1), nil) }, badBody: true},
+		{name: "other user", req: func() *http.Request { return resend(signed(peer), body, map[string]string{"X-GHH-User": "bob"}) }, wantErr: "invalid"},
+		{name: "added api key", req: func() *http.Request { return resend(signed(peer), body, map[string]string{"X-GHH-Api-Key": "k"}) }, wantErr: "invalid"},
+		{name: "unknown instance", req: func() *http.Request { return resend(signed(outsider), body, nil) }, wantErr: "unknown instance"},
+		{name: "replayed", req: func() func() *http.Request {
+			req := signed(peer)
+			if _, err := s.cluster.verify(resend(req, body, nil), s.now()); err != nil {
+				t.Fatal(err)
+			}
+			return func() *http.Request { return resend(req, body, nil) }
+		}(), wantErr: "replayed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req()
+			purpose, err := s.cluster.verify(req, s.now())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || purpose != clusterForward {
+				t.Fatalf("purpose=%q err=%v", purpose, err)
+			}
+			_, err = io.ReadAll(req.Body)
+			if tt.badBody != errors.Is(err, errClusterBody) {
+				t.Fatalf("read body: err = %v, want mismatch=%v", err, tt.badBody)
+			}
+		})
+	}
+}
+
+func TestSetClusterValidation(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	tests := []struct {
+		name string
+		o    ClusterOptions
+		want string
+	}{
+		{"no secret", ClusterOptions{Self: "http://a:1"}, "secret"},
+		{"bad self", ClusterOptions{Self: "a:1", Secret: "s"}, "cluster self"},
+		{"bad peer", ClusterOptions{Self: "http://a:1", Peers: []string{"ftp://b"}, Secret: "s"}, "cluster peer"},
+		{"unknown route", ClusterOptions{Self: "http://a:1", Routes: map[string]string{"x": "http://c:1"}, Secret: "s"}, "neither"},
+	}
+	for _, tc := range tests {
+		err := s.SetCluster(tc.o)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: err %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressMin is the response size below which compression is skipped.
+const defaultCompressMin = 1024
+
+// SetCompressionThreshold sets the minimum body size that is compressed for
+// JSON/text endpoints. A negative value disables compression. It must be
+// called before RegisterRoutes.
+func (s *Server) SetCompressionThreshold(n int) {
+	s.compressMin = n
+}
+
+// compress negotiates gzip/deflate for h's JSON and text responses. Archive
+// streaming routes are registered without it: their payloads are already
+// compressed.
+func (s *Server) compress(h http.Handler) http.Handler {
+	if s.compressMin < 0 {
+		return h
+	}
+	min := s.compressMin
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: enc, min: min}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// honoring q-values. gzip wins ties.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			name = "gzip"
+		}
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	if bestQ <= 0 {
+		return ""
+	}
+	return best
+}
+
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "application/json") || strings.HasPrefix(ct, "text/")
+}
+
+// compressWriter buffers the first min bytes so small responses and
+// non-compressible content types go out untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	min      int
+	status   int
+	buf      bytes.Buffer
+	zw       io.WriteCloser
+	decided  bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		if c.zw != nil {
+			return c.zw.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() >= c.min {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide commits the response headers. large reports whether the threshold
+// was reached.
+func (c *compressWriter) decide(large bool) error {
+	c.decided = true
+	h := c.Header()
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if large && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if c.encoding == "gzip" {
+			c.zw = gzip.NewWriter(c.ResponseWriter)
+		} else {
+			c.zw, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if c.zw != nil {
+		_, err = c.zw.Write(c.buf.Bytes())
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf.Bytes())
+	}
+	c.buf.Reset()
+	return err
+}
+
+// Flush implements http.Flusher, committing buffered output first.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		_ = c.decide(c.buf.Len() >= c.min)
+	}
+	if gz, ok := c.zw.(interface{ Flush() error }); ok {
+		_ = gz.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close flushes any buffered body and terminates the compressed stream.
+func (c *compressWriter) Close() {
+	if !c.decided {
+		if c.status == 0 && c.buf.Len() == 0 {
+			// Handler wrote nothing; let net/http send its implicit 200.
+			return
+		}
+		_ = c.decide(false)
+	}
+	if c.zw != nil {
+		_ = c.zw.Close()
+	}
+}
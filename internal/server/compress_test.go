@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0", ""},
+		{"br, *", "gzip"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q)=%q want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	files := make([]string, 500)
+	for i := range files {
+		files[i] = fmt.Sprintf("path/to/file-%d.go", i)
+	}
+	fs := &fakeStore{ensurePath: zipPath, ensureInfo: &storage.RepoInfo{Repo: "own/repo", ChangedFiles: files}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("large json is gzipped", func(t *testing.T) {
+		rr := get("/api/v1/download/info?repo=own/repo&branch=main")
+		if rr.Header().Get("Content-Encoding") != "gzip" || !strings.Contains(rr.Header().Get("Vary"), "Accept-Encoding") {
+			t.Fatalf("headers=%v", rr.Header())
+		}
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(zr)
+		if !bytes.Contains(body, []byte("file-499.go")) {
+			t.Fatalf("unexpected body %q", body[:64])
+		}
+	})
+
+	t.Run("small response is not compressed", func(t *testing.T) {
+		rr := get("/api/v1/version")
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("small body compressed: %v", rr.Header())
+		}
+		if !strings.Contains(rr.Body.String(), "version") {
+			t.Fatalf("body=%q", rr.Body.String())
+		}
+	})
+
+	t.Run("zip download is never compressed", func(t *testing.T) {
+		rr := get("/api/v1/download?repo=own/repo&branch=main")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d", rr.Code)
+		}
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("archive was compressed: %v", rr.Header())
+		}
+		if !bytes.HasPrefix(rr.Body.Bytes(), []byte("PK")) {
+			t.Fatalf("body is not a zip")
+		}
+	})
+}
@@ -1,11 +1,18 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github-hub/internal/storage"
 )
 
 // Config holds server defaults for root path, auth token, and default user grouping.
@@ -15,14 +22,273 @@ type Config struct {
 	Token           string `json:"token"`
 	DefaultUser     string `json:"default_user"`
 	DownloadTimeout string `json:"download_timeout"` // e.g. "10m", "5m"
+	// APIKeys enables hub authentication when non-empty; entries are "user:key".
+	APIKeys []string `json:"api_keys"`
+	// Admins lists users allowed to act on any namespace.
+	Admins []string `json:"admins"`
+	// CompressMinBytes is the smallest JSON/text response that is gzip/deflate
+	// compressed; negative disables compression.
+	CompressMinBytes int `json:"compress_min_bytes"`
+	// MetadataTimeout bounds routes that never download archives, e.g. "30s".
+	MetadataTimeout string `json:"metadata_timeout"`
+	// OnClientDisconnect is "cancel" (default) to abort a cache population
+	// when its client goes away, or "complete" to let it finish.
+	OnClientDisconnect string `json:"on_client_disconnect"`
+	// RetentionMaxArchives keeps at most this many branch archives per user
+	// and repo (0 = unlimited); RetentionPerRepo entries ("owner/repo=N")
+	// override it.
+	RetentionMaxArchives int      `json:"retention_max_archives"`
+	RetentionPerRepo     []string `json:"retention_per_repo"`
+	// RetentionOnEnsure also applies the policy right after each download.
+	RetentionOnEnsure bool `json:"retention_on_ensure"`
+	// KeepPreviousArchives keeps this many replaced archives per branch for
+	// commit= downloads and rollback (0 = none); they count against retention.
+	KeepPreviousArchives int `json:"keep_previous_archives"`
+	// AccessTimeInterval (default "60s") is how often the last-access time
+	// of one cache entry is written to disk; accesses in between are kept
+	// in memory, so cleanup may see an entry up to that much older.
+	// ExactAccessTimes writes every access instead.
+	AccessTimeInterval string `json:"access_time_interval"`
+	ExactAccessTimes   bool   `json:"exact_access_times"`
+	// ShortSHALength is the length of short commit SHAs (X-GHH-Commit-Short,
+	// download/commit?short=true, .commit.txt), 4 to 40; 0 means 12.
+	ShortSHALength int `json:"short_sha_length"`
+	// OnBranchDeleted is "gone" (default, answer 410) or "stale" (serve the
+	// cached archive with X-GHH-Stale) when a cached branch was deleted
+	// upstream; BranchGonePurgeAfter (e.g. "168h") lets cleanup remove such
+	// archives after a grace period.
+	OnBranchDeleted      string `json:"on_branch_deleted"`
+	BranchGonePurgeAfter string `json:"branch_gone_purge_after"`
+	// OnDelete is "remove" (default) or "trash": trash moves deleted cache
+	// items to <root>/trash for restore until TrashRetention (default
+	// "168h", "0" keeps them) has passed.
+	OnDelete       string `json:"on_delete"`
+	TrashRetention string `json:"trash_retention"`
+	// ArchiveCompression is "none" (default) or "zstd": zstd stores newly
+	// cached repo archives as <branch>.zip.zst and decompresses on serve.
+	ArchiveCompression string `json:"archive_compression"`
+	// EncryptionKeyFile enables encryption at rest of newly cached archives
+	// and packages with the 32-byte key in that file (raw, hex or base64);
+	// EncryptionPreviousKeyFiles keep files written under rotated-out keys
+	// readable.
+	EncryptionKeyFile          string   `json:"encryption_key_file"`
+	EncryptionPreviousKeyFiles []string `json:"encryption_previous_key_files"`
+	// SigningKeyFile enables Ed25519 signatures of cached archives with the
+	// private key in that file (PKCS#8 PEM or a 32-byte seed);
+	// SigningPreviousKeyFiles keep publishing the public keys of rotated-out
+	// ones.
+	SigningKeyFile          string   `json:"signing_key_file"`
+	SigningPreviousKeyFiles []string `json:"signing_previous_key_files"`
+	// SignedURLKeyFile enables POST /api/v1/download/sign with the HMAC key
+	// in that file (32 bytes, raw, hex or base64). URLs signed with
+	// SignedURLPreviousKeyFiles keep working for SignedURLGrace (default
+	// "24h") after startup.
+	SignedURLKeyFile          string   `json:"signed_url_key_file"`
+	SignedURLPreviousKeyFiles []string `json:"signed_url_previous_key_files"`
+	SignedURLGrace            string   `json:"signed_url_grace"`
+	// PublicURL is the base URL clients reach the server at, used for the
+	// signed URLs it hands out; without it they take the request's scheme
+	// and Host, or the X-Forwarded-Proto and X-Forwarded-Host of the
+	// TrustedProxies (addresses or CIDR prefixes).
+	PublicURL      string   `json:"public_url"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	// NormalizeArchives serves the deterministic repack of archives (root
+	// folder <repo>/, sorted entries, fixed timestamps and modes) unless a
+	// download passes normalize=false.
+	NormalizeArchives bool `json:"normalize_archives"`
+	// UserAgent replaces the default User-Agent ("github-hub/<version>")
+	// of requests to GitHub and package hosts.
+	UserAgent string `json:"user_agent"`
+	// StalePolicy is "prefer-fresh" (default), "prefer-cache" or "fail":
+	// what downloads do when a branch's upstream commit cannot be fetched.
+	// Downloads may override it with stale=.
+	StalePolicy string `json:"stale_policy"`
+	// StrictVerification makes downloads fail (502 or 409) rather than
+	// serve an archive that cannot be verified against the branch head,
+	// whatever StalePolicy and OnBranchDeleted say. Downloads may turn it
+	// on with strict=true.
+	StrictVerification bool `json:"strict_verification"`
+	// CacheLayout is "per-user" (default) or "shared": whether every user
+	// gets their own copy of each repo archive or all share one under
+	// shared/repos. Restrict access in shared mode with RepoAllow/RepoDeny.
+	CacheLayout string `json:"cache_layout"`
+	// DownloadTempDir is where downloads are written until complete; empty
+	// writes them beside their cache entry. Another filesystem (e.g. local
+	// disk under a network root) works; archives are then copied in.
+	DownloadTempDir string `json:"download_temp_dir"`
+	// SpaceReserveBytes is the free space downloads leave on the cache and
+	// temp filesystems (0 = 64 MiB, negative = no checks); downloads that
+	// would not fit answer 507. SpaceEmergencyCleanup first evicts least
+	// recently used archives to make room.
+	SpaceReserveBytes     int64 `json:"space_reserve_bytes"`
+	SpaceEmergencyCleanup bool  `json:"space_emergency_cleanup"`
+	// RepoAllow and RepoDeny restrict which owner/repo names may be fetched:
+	// globs ("myorg/*") or regexes prefixed with "re:". Deny wins; an empty
+	// allow list allows every repo not denied. Reloaded on SIGHUP or when
+	// the config file changes.
+	RepoAllow []string `json:"repo_allow"`
+	RepoDeny  []string `json:"repo_deny"`
+	// UploadMaxBytes caps PUT /api/v1/packages/upload bodies; 0 or less
+	// means unlimited.
+	UploadMaxBytes int64 `json:"upload_max_bytes"`
+	// ManifestMaxEntries and ManifestMaxBytes cap the archives
+	// GET /api/v1/repos/manifest hashes, by file count and uncompressed
+	// bytes; 0 or less means unlimited.
+	ManifestMaxEntries int   `json:"manifest_max_entries"`
+	ManifestMaxBytes   int64 `json:"manifest_max_bytes"`
+	// PatchMaxBytes caps the diffs GET /api/v1/repos/patch serves; 0 means
+	// 10 MiB. Larger diffs answer 413.
+	PatchMaxBytes int64 `json:"patch_max_bytes"`
+	// MirrorManifest is a JSON file listing repos to keep fresh (see
+	// MirrorManifest); MirrorGCAfter (e.g. "72h") deletes archives of
+	// entries removed from it after that grace period.
+	MirrorManifest string `json:"mirror_manifest"`
+	MirrorGCAfter  string `json:"mirror_gc_after"`
+	// RevalidateInterval (e.g. "15m") rechecks branches served within
+	// RevalidateWindow (default "24h") in the background, at most
+	// RevalidateConcurrency (default 2) at once. Empty disables it.
+	RevalidateInterval    string `json:"revalidate_interval"`
+	RevalidateWindow      string `json:"revalidate_window"`
+	RevalidateConcurrency int    `json:"revalidate_concurrency"`
+	// WarmupEntries revalidates that many of the most recently used
+	// branches at startup, at most WarmupConcurrency (default 2) at once;
+	// /readyz waits for it unless WarmupBackground is set. 0 disables it.
+	WarmupEntries     int  `json:"warmup_entries"`
+	WarmupConcurrency int  `json:"warmup_concurrency"`
+	WarmupBackground  bool `json:"warmup_background"`
+	// MaxInflight answers 503 with Retry-After to new API requests while
+	// that many are in flight; 0 (default) is unlimited.
+	MaxInflight int `json:"max_inflight"`
+	// DailyByteBudgetBytes caps what each user may download per UTC day,
+	// counting bytes served by the download endpoints and bytes fetched
+	// upstream for them; 0 (default) is unlimited. DailyByteBudgetPerUser
+	// entries ("user=bytes") override it for single users.
+	DailyByteBudgetBytes   int64    `json:"daily_byte_budget_bytes"`
+	DailyByteBudgetPerUser []string `json:"daily_byte_budget_per_user"`
+	// CacheTiers are slower cache roots, fastest first, as "path" or
+	// "path=capacity_bytes" entries. Archives beyond HotTierCapacityBytes
+	// in Root, least recently used first, move down the tiers every
+	// TierRebalanceInterval (default "1m") and move back once served.
+	CacheTiers            []string `json:"cache_tiers"`
+	HotTierCapacityBytes  int64    `json:"hot_tier_capacity_bytes"`
+	TierRebalanceInterval string   `json:"tier_rebalance_interval"`
+	// Upstream* tune the connection pool shared by GitHub API calls, archive
+	// downloads and package fetches; 0 or empty keeps the storage defaults
+	// (32 idle connections per host, no per-host cap, 90s idle timeout).
+	// UpstreamHTTP2 "false" stops the transport attempting HTTP/2.
+	UpstreamMaxIdleConnsPerHost int    `json:"upstream_max_idle_conns_per_host"`
+	UpstreamMaxConnsPerHost     int    `json:"upstream_max_conns_per_host"`
+	UpstreamIdleConnTimeout     string `json:"upstream_idle_conn_timeout"`
+	UpstreamHTTP2               string `json:"upstream_http2"`
+	// SlowDownloadBytesPerSec marks upstream degraded on /api/v1/status
+	// when a download of at least 1 MiB is slower; SlowDownloadRecovery
+	// healthy downloads (default 3) clear it. 0 disables the alert.
+	SlowDownloadBytesPerSec int64 `json:"slow_download_bytes_per_sec"`
+	SlowDownloadRecovery    int   `json:"slow_download_recovery"`
+	// CircuitFailureThreshold opens the upstream circuit after that many
+	// GitHub calls in a row failed (0 = 5, negative disables it); it stays
+	// open for CircuitCooldown (default "30s") before a probe.
+	CircuitFailureThreshold int    `json:"circuit_failure_threshold"`
+	CircuitCooldown         string `json:"circuit_cooldown"`
+	// APICallTimeout bounds each GitHub API call, reading the answer
+	// included (default "30s", negative disables it).
+	APICallTimeout string `json:"api_call_timeout"`
+	// BranchLookup is the GitHub API call that checks a branch head:
+	// "ref" (default, the Git Data API) or "branches".
+	BranchLookup string `json:"branch_lookup"`
+	// PackageRedirectMaxHops caps the redirects a package download follows
+	// (0 = 10, negative = none). PackageRedirectSameScheme "false" lets a
+	// hop change scheme, e.g. https to http; PackageRedirectSameHost keeps
+	// every hop on the package URL's host. Refused hops answer 502
+	// redirect_refused.
+	PackageRedirectMaxHops    int    `json:"package_redirect_max_hops"`
+	PackageRedirectSameScheme string `json:"package_redirect_same_scheme"`
+	PackageRedirectSameHost   bool   `json:"package_redirect_same_host"`
+	// PackageAllowPrivateHosts lets package URLs and their redirect hops
+	// reach loopback, private, link-local, unspecified and multicast
+	// addresses, which storage.PublicHostCheck otherwise refuses.
+	PackageAllowPrivateHosts bool `json:"package_allow_private_hosts"`
+	// PackageMirrors rewrite package URLs to internal mirrors,
+	// "match=base[ fallback]" (see storage.NewPackageMirrors). Packages stay
+	// cached under the original URL. Reloaded like RepoAllow.
+	PackageMirrors []string `json:"package_mirrors"`
+	// PackageAllow and PackageDeny decide which package URLs may be
+	// downloaded, matched against "host/path" (see storage.PackagePolicy).
+	// Deny wins; URLs matching neither get PackageDefault, "allow"
+	// (default) or "deny". Reloaded like RepoAllow.
+	PackageAllow   []string `json:"package_allow"`
+	PackageDeny    []string `json:"package_deny"`
+	PackageDefault string   `json:"package_default"`
+	// Credentials are named GitHub tokens, "name:token"; a token of "$VAR"
+	// is read from that environment variable. TokenRoutes ("pattern=name",
+	// patterns as in RepoAllow, or a bare owner) pick the credential for
+	// requests without a token; TokenDefault (default "server", the server
+	// token) covers unmatched repos. DebugTokenRoutes logs each choice by
+	// credential name. Reloaded like RepoAllow.
+	Credentials      []string `json:"credentials"`
+	TokenRoutes      []string `json:"token_routes"`
+	TokenDefault     string   `json:"token_default"`
+	DebugTokenRoutes bool     `json:"debug_token_routes"`
+	// WebhookURL receives storage events as signed JSON POSTs (see
+	// Server.SetWebhook). WebhookSecret keys the HMAC signature ("$VAR"
+	// reads it from the environment), WebhookEvents picks the event types
+	// (default all) and WebhookDeadLetter is the file undeliverable events
+	// are appended to (default: the log).
+	WebhookURL        string   `json:"webhook_url"`
+	WebhookSecret     string   `json:"webhook_secret"`
+	WebhookEvents     []string `json:"webhook_events"`
+	WebhookDeadLetter string   `json:"webhook_dead_letter"`
+	// WebUI serves the embedded cache browser at /. It only calls the JSON
+	// API, so it needs the same API key (sent as the Basic password).
+	WebUI bool `json:"web_ui"`
+	// ClusterSelf, this instance's base URL, turns on cluster mode (see
+	// Server.SetCluster); ClusterPeers are the other instances. ClusterRoutes
+	// ("user=base_url") pin users to instances, the rest are hashed over
+	// all of them. ClusterForward is "redirect" (default, 307) or "proxy".
+	// ClusterSecret, shared by all instances, signs their requests to each
+	// other ("$VAR" reads it from the environment).
+	ClusterSelf    string   `json:"cluster_self"`
+	ClusterPeers   []string `json:"cluster_peers"`
+	ClusterRoutes  []string `json:"cluster_routes"`
+	ClusterForward string   `json:"cluster_forward"`
+	ClusterSecret  string   `json:"cluster_secret"`
+	// Deprecations mark routes or their parameters as deprecated:
+	// "<route>[?<param>][; since=<date>][; sunset=<date>][; link=<url>]"
+	// (see ParseDeprecation). Requests using them still work but carry
+	// Deprecation and Sunset headers, and their use is logged.
+	Deprecations []string `json:"deprecations"`
+}
+
+// Keys converts APIKeys/Admins into the form expected by Server.SetAuth.
+func (c Config) Keys() ([]APIKey, error) {
+	admins := make(map[string]bool, len(c.Admins))
+	for _, a := range c.Admins {
+		admins[strings.TrimSpace(a)] = true
+	}
+	keys := make([]APIKey, 0, len(c.APIKeys))
+	for _, entry := range c.APIKeys {
+		user, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		user, key = strings.TrimSpace(user), strings.TrimSpace(key)
+		if !ok || user == "" || key == "" {
+			return nil, fmt.Errorf("api_keys entry must be \"user:key\"")
+		}
+		keys = append(keys, APIKey{Key: key, User: user, Admin: admins[user]})
+	}
+	return keys, nil
 }
 
 func DefaultConfig() Config {
 	return Config{
-		Addr:            ":8080",
-		Root:            "data",
-		DefaultUser:     "default",
-		DownloadTimeout: "30m",
+		Addr:               ":8080",
+		Root:               "data",
+		DefaultUser:        "default",
+		DownloadTimeout:    "30m",
+		CompressMinBytes:   defaultCompressMin,
+		MetadataTimeout:    "30s",
+		OnClientDisconnect: "cancel",
+		UploadMaxBytes:     defaultUploadMax,
+		ManifestMaxEntries: defaultManifestLimits.MaxEntries,
+		ManifestMaxBytes:   defaultManifestLimits.MaxBytes,
 	}
 }
 
@@ -65,20 +331,72 @@ func looksLikeYAML(s string) bool {
 }
 
 // Minimal YAML parser for the limited schema of Config.
+// Scalars are "key: value"; lists are a bare "key:" followed by "- item" lines.
 func parseYAMLConfig(s string) (Config, error) {
 	cfg := DefaultConfig()
+	listKey := ""
 	for _, raw := range strings.Split(s, "\n") {
 		line := strings.TrimRight(raw, "\r")
 		t := strings.TrimSpace(line)
 		if t == "" || strings.HasPrefix(t, "#") {
 			continue
 		}
+		if strings.HasPrefix(t, "- ") {
+			item := strings.Trim(strings.TrimSpace(t[2:]), "\"'")
+			switch listKey {
+			case "api_keys":
+				cfg.APIKeys = append(cfg.APIKeys, item)
+			case "admins":
+				cfg.Admins = append(cfg.Admins, item)
+			case "retention_per_repo":
+				cfg.RetentionPerRepo = append(cfg.RetentionPerRepo, item)
+			case "repo_allow":
+				cfg.RepoAllow = append(cfg.RepoAllow, item)
+			case "repo_deny":
+				cfg.RepoDeny = append(cfg.RepoDeny, item)
+			case "credentials":
+				cfg.Credentials = append(cfg.Credentials, item)
+			case "token_routes":
+				cfg.TokenRoutes = append(cfg.TokenRoutes, item)
+			case "package_allow":
+				cfg.PackageAllow = append(cfg.PackageAllow, item)
+			case "package_deny":
+				cfg.PackageDeny = append(cfg.PackageDeny, item)
+			case "package_mirrors":
+				cfg.PackageMirrors = append(cfg.PackageMirrors, item)
+			case "encryption_previous_key_files":
+				cfg.EncryptionPreviousKeyFiles = append(cfg.EncryptionPreviousKeyFiles, item)
+			case "signing_previous_key_files":
+				cfg.SigningPreviousKeyFiles = append(cfg.SigningPreviousKeyFiles, item)
+			case "signed_url_previous_key_files":
+				cfg.SignedURLPreviousKeyFiles = append(cfg.SignedURLPreviousKeyFiles, item)
+			case "trusted_proxies":
+				cfg.TrustedProxies = append(cfg.TrustedProxies, item)
+			case "daily_byte_budget_per_user":
+				cfg.DailyByteBudgetPerUser = append(cfg.DailyByteBudgetPerUser, item)
+			case "webhook_events":
+				cfg.WebhookEvents = append(cfg.WebhookEvents, item)
+			case "cache_tiers":
+				cfg.CacheTiers = append(cfg.CacheTiers, item)
+			case "cluster_peers":
+				cfg.ClusterPeers = append(cfg.ClusterPeers, item)
+			case "cluster_routes":
+				cfg.ClusterRoutes = append(cfg.ClusterRoutes, item)
+			case "deprecations":
+				cfg.Deprecations = append(cfg.Deprecations, item)
+			}
+			continue
+		}
 		kv := strings.SplitN(t, ":", 2)
 		if len(kv) != 2 {
 			continue
 		}
 		k := strings.TrimSpace(kv[0])
 		v := strings.Trim(strings.TrimSpace(kv[1]), "\"'")
+		listKey = ""
+		if v == "" {
+			listKey = k
+		}
 		switch k {
 		case "addr":
 			if v != "" {
@@ -100,7 +418,808 @@ func parseYAMLConfig(s string) (Config, error) {
 			if v != "" {
 				cfg.DownloadTimeout = v
 			}
+		case "on_branch_deleted":
+			if v != "" {
+				cfg.OnBranchDeleted = v
+			}
+		case "branch_gone_purge_after":
+			if v != "" {
+				cfg.BranchGonePurgeAfter = v
+			}
+		case "on_delete":
+			if v != "" {
+				cfg.OnDelete = v
+			}
+		case "trash_retention":
+			if v != "" {
+				cfg.TrashRetention = v
+			}
+		case "archive_compression":
+			if v != "" {
+				cfg.ArchiveCompression = v
+			}
+		case "encryption_key_file":
+			if v != "" {
+				cfg.EncryptionKeyFile = v
+			}
+		case "signing_key_file":
+			if v != "" {
+				cfg.SigningKeyFile = v
+			}
+		case "signed_url_key_file":
+			if v != "" {
+				cfg.SignedURLKeyFile = v
+			}
+		case "signed_url_grace":
+			if v != "" {
+				cfg.SignedURLGrace = v
+			}
+		case "public_url":
+			if v != "" {
+				cfg.PublicURL = v
+			}
+		case "user_agent":
+			if v != "" {
+				cfg.UserAgent = v
+			}
+		case "stale_policy":
+			if v != "" {
+				cfg.StalePolicy = v
+			}
+		case "strict_verification":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("strict_verification: %w", err)
+				}
+				cfg.StrictVerification = b
+			}
+		case "cache_layout":
+			if v != "" {
+				cfg.CacheLayout = v
+			}
+		case "download_temp_dir":
+			if v != "" {
+				cfg.DownloadTempDir = v
+			}
+		case "space_reserve_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("space_reserve_bytes: %w", err)
+				}
+				cfg.SpaceReserveBytes = n
+			}
+		case "space_emergency_cleanup":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("space_emergency_cleanup: %w", err)
+				}
+				cfg.SpaceEmergencyCleanup = b
+			}
+		case "mirror_manifest":
+			if v != "" {
+				cfg.MirrorManifest = v
+			}
+		case "mirror_gc_after":
+			if v != "" {
+				cfg.MirrorGCAfter = v
+			}
+		case "webhook_url":
+			if v != "" {
+				cfg.WebhookURL = v
+			}
+		case "webhook_secret":
+			if v != "" {
+				cfg.WebhookSecret = v
+			}
+		case "webhook_dead_letter":
+			if v != "" {
+				cfg.WebhookDeadLetter = v
+			}
+		case "cluster_self":
+			cfg.ClusterSelf = v
+		case "cluster_forward":
+			cfg.ClusterForward = v
+		case "cluster_secret":
+			cfg.ClusterSecret = v
+		case "revalidate_interval":
+			if v != "" {
+				cfg.RevalidateInterval = v
+			}
+		case "revalidate_window":
+			if v != "" {
+				cfg.RevalidateWindow = v
+			}
+		case "revalidate_concurrency":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("revalidate_concurrency: %w", err)
+				}
+				cfg.RevalidateConcurrency = n
+			}
+		case "token_default":
+			if v != "" {
+				cfg.TokenDefault = v
+			}
+		case "debug_token_routes":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("debug_token_routes: %w", err)
+				}
+				cfg.DebugTokenRoutes = b
+			}
+		case "warmup_entries":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("warmup_entries: %w", err)
+				}
+				cfg.WarmupEntries = n
+			}
+		case "max_inflight":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("max_inflight: %w", err)
+				}
+				cfg.MaxInflight = n
+			}
+		case "daily_byte_budget_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("daily_byte_budget_bytes: %w", err)
+				}
+				cfg.DailyByteBudgetBytes = n
+			}
+		case "hot_tier_capacity_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("hot_tier_capacity_bytes: %w", err)
+				}
+				cfg.HotTierCapacityBytes = n
+			}
+		case "tier_rebalance_interval":
+			cfg.TierRebalanceInterval = v
+		case "upstream_max_idle_conns_per_host":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("upstream_max_idle_conns_per_host: %w", err)
+				}
+				cfg.UpstreamMaxIdleConnsPerHost = n
+			}
+		case "upstream_max_conns_per_host":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("upstream_max_conns_per_host: %w", err)
+				}
+				cfg.UpstreamMaxConnsPerHost = n
+			}
+		case "upstream_idle_conn_timeout":
+			if v != "" {
+				cfg.UpstreamIdleConnTimeout = v
+			}
+		case "upstream_http2":
+			if v != "" {
+				cfg.UpstreamHTTP2 = v
+			}
+		case "warmup_concurrency":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("warmup_concurrency: %w", err)
+				}
+				cfg.WarmupConcurrency = n
+			}
+		case "web_ui":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("web_ui: %w", err)
+				}
+				cfg.WebUI = b
+			}
+		case "warmup_background":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("warmup_background: %w", err)
+				}
+				cfg.WarmupBackground = b
+			}
+		case "metadata_timeout":
+			if v != "" {
+				cfg.MetadataTimeout = v
+			}
+		case "on_client_disconnect":
+			if v != "" {
+				cfg.OnClientDisconnect = v
+			}
+		case "retention_max_archives":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("retention_max_archives: %w", err)
+				}
+				cfg.RetentionMaxArchives = n
+			}
+		case "keep_previous_archives":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("keep_previous_archives: %w", err)
+				}
+				cfg.KeepPreviousArchives = n
+			}
+		case "normalize_archives":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("normalize_archives: %w", err)
+				}
+				cfg.NormalizeArchives = b
+			}
+		case "retention_on_ensure":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("retention_on_ensure: %w", err)
+				}
+				cfg.RetentionOnEnsure = b
+			}
+		case "upload_max_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("upload_max_bytes: %w", err)
+				}
+				cfg.UploadMaxBytes = n
+			}
+		case "slow_download_bytes_per_sec":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("slow_download_bytes_per_sec: %w", err)
+				}
+				cfg.SlowDownloadBytesPerSec = n
+			}
+		case "slow_download_recovery":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("slow_download_recovery: %w", err)
+				}
+				cfg.SlowDownloadRecovery = n
+			}
+		case "circuit_failure_threshold":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("circuit_failure_threshold: %w", err)
+				}
+				cfg.CircuitFailureThreshold = n
+			}
+		case "circuit_cooldown":
+			cfg.CircuitCooldown = v
+		case "api_call_timeout":
+			cfg.APICallTimeout = v
+		case "branch_lookup":
+			cfg.BranchLookup = v
+		case "package_redirect_max_hops":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("package_redirect_max_hops: %w", err)
+				}
+				cfg.PackageRedirectMaxHops = n
+			}
+		case "package_redirect_same_scheme":
+			if v != "" {
+				cfg.PackageRedirectSameScheme = v
+			}
+		case "package_redirect_same_host":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("package_redirect_same_host: %w", err)
+				}
+				cfg.PackageRedirectSameHost = b
+			}
+		case "package_allow_private_hosts":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("package_allow_private_hosts: %w", err)
+				}
+				cfg.PackageAllowPrivateHosts = b
+			}
+		case "package_default":
+			if v != "" {
+				cfg.PackageDefault = v
+			}
+		case "access_time_interval":
+			if v != "" {
+				cfg.AccessTimeInterval = v
+			}
+		case "exact_access_times":
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("exact_access_times: %w", err)
+				}
+				cfg.ExactAccessTimes = b
+			}
+		case "short_sha_length":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("short_sha_length: %w", err)
+				}
+				if n != 0 && (n < 4 || n > 40) {
+					return Config{}, fmt.Errorf("short_sha_length: %d is not between 4 and 40", n)
+				}
+				cfg.ShortSHALength = n
+			}
+		case "manifest_max_entries":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("manifest_max_entries: %w", err)
+				}
+				cfg.ManifestMaxEntries = n
+			}
+		case "manifest_max_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("manifest_max_bytes: %w", err)
+				}
+				cfg.ManifestMaxBytes = n
+			}
+		case "patch_max_bytes":
+			if v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return Config{}, fmt.Errorf("patch_max_bytes: %w", err)
+				}
+				cfg.PatchMaxBytes = n
+			}
+		case "compress_min_bytes":
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return Config{}, fmt.Errorf("compress_min_bytes: %w", err)
+				}
+				cfg.CompressMinBytes = n
+			}
 		}
 	}
 	return cfg, nil
 }
+
+// CompleteOnDisconnect reports whether OnClientDisconnect asks for cache
+// populations to outlive their client.
+func (c Config) CompleteOnDisconnect() (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(c.OnClientDisconnect)) {
+	case "", "cancel":
+		return false, nil
+	case "complete":
+		return true, nil
+	}
+	return false, fmt.Errorf("on_client_disconnect must be \"cancel\" or \"complete\", got %q", c.OnClientDisconnect)
+}
+
+// Retention converts the retention settings into a storage policy.
+func (c Config) Retention() (storage.RetentionPolicy, error) {
+	p := storage.RetentionPolicy{MaxArchives: c.RetentionMaxArchives}
+	for _, entry := range c.RetentionPerRepo {
+		repo, n, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		repo = strings.Trim(strings.TrimSpace(repo), "/")
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || strings.Count(repo, "/") != 1 || err != nil || limit < 0 {
+			return storage.RetentionPolicy{}, fmt.Errorf("retention_per_repo entry must be \"owner/repo=N\", got %q", entry)
+		}
+		if p.PerRepo == nil {
+			p.PerRepo = make(map[string]int)
+		}
+		p.PerRepo[repo] = limit
+	}
+	return p, nil
+}
+
+// Tiers parses CacheTiers, HotTierCapacityBytes and TierRebalanceInterval
+// for Server.SetTiers. Tier paths are made absolute.
+func (c Config) Tiers() (hotCapacity int64, tiers []storage.Tier, interval time.Duration, err error) {
+	if c.HotTierCapacityBytes < 0 {
+		return 0, nil, 0, fmt.Errorf("invalid hot_tier_capacity_bytes %d", c.HotTierCapacityBytes)
+	}
+	for _, entry := range c.CacheTiers {
+		path, capacity, hasCap := strings.Cut(strings.TrimSpace(entry), "=")
+		var n int64
+		if hasCap {
+			n, err = strconv.ParseInt(strings.TrimSpace(capacity), 10, 64)
+		}
+		path = strings.TrimSpace(path)
+		if path == "" || err != nil || n < 0 {
+			return 0, nil, 0, fmt.Errorf("cache_tiers entry must be \"path\" or \"path=capacity_bytes\", got %q", entry)
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return 0, nil, 0, fmt.Errorf("cache_tiers: %w", err)
+		}
+		tiers = append(tiers, storage.Tier{Root: path, Capacity: n})
+	}
+	if v := strings.TrimSpace(c.TierRebalanceInterval); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return 0, nil, 0, fmt.Errorf("invalid tier_rebalance_interval %q", v)
+		}
+	}
+	return c.HotTierCapacityBytes, tiers, interval, nil
+}
+
+// TouchInterval parses AccessTimeInterval and ExactAccessTimes into
+// Server.SetTouchInterval's argument.
+func (c Config) TouchInterval() (time.Duration, error) {
+	if c.ExactAccessTimes {
+		return 0, nil
+	}
+	v := strings.TrimSpace(c.AccessTimeInterval)
+	if v == "" {
+		return storage.DefaultTouchInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid access_time_interval %q", v)
+	}
+	return d, nil
+}
+
+// BranchGonePolicy parses OnBranchDeleted and BranchGonePurgeAfter.
+func (c Config) BranchGonePolicy() (serveStale bool, purgeAfter time.Duration, err error) {
+	switch strings.ToLower(strings.TrimSpace(c.OnBranchDeleted)) {
+	case "", "gone":
+	case "stale":
+		serveStale = true
+	default:
+		return false, 0, fmt.Errorf("on_branch_deleted must be \"gone\" or \"stale\", got %q", c.OnBranchDeleted)
+	}
+	if v := strings.TrimSpace(c.BranchGonePurgeAfter); v != "" {
+		purgeAfter, err = time.ParseDuration(v)
+		if err != nil || purgeAfter < 0 {
+			return false, 0, fmt.Errorf("invalid branch_gone_purge_after %q", v)
+		}
+	}
+	return serveStale, purgeAfter, nil
+}
+
+// Circuit parses CircuitFailureThreshold and CircuitCooldown into
+// Server.SetUpstreamCircuit's arguments.
+func (c Config) Circuit() (threshold int, cooldown time.Duration, err error) {
+	if v := strings.TrimSpace(c.CircuitCooldown); v != "" {
+		cooldown, err = time.ParseDuration(v)
+		if err != nil || cooldown < 0 {
+			return 0, 0, fmt.Errorf("invalid circuit_cooldown %q", v)
+		}
+	}
+	return c.CircuitFailureThreshold, cooldown, nil
+}
+
+// ParsedAPICallTimeout parses APICallTimeout; 0 means the default.
+func (c Config) ParsedAPICallTimeout() (time.Duration, error) {
+	v := strings.TrimSpace(c.APICallTimeout)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid api_call_timeout %q", v)
+	}
+	return d, nil
+}
+
+// ParsedBranchLookup parses BranchLookup.
+func (c Config) ParsedBranchLookup() (storage.BranchLookup, error) {
+	l, err := storage.ParseBranchLookup(c.BranchLookup)
+	if err != nil {
+		return "", fmt.Errorf("branch_lookup: %w", err)
+	}
+	return l, nil
+}
+
+// ParsedDeprecations parses Deprecations.
+func (c Config) ParsedDeprecations() ([]Deprecation, error) {
+	rules := make([]Deprecation, 0, len(c.Deprecations))
+	for _, entry := range c.Deprecations {
+		d, err := ParseDeprecation(entry)
+		if err != nil {
+			return nil, fmt.Errorf("deprecations: %w", err)
+		}
+		rules = append(rules, d)
+	}
+	return rules, nil
+}
+
+// TrashPolicy parses OnDelete and TrashRetention.
+func (c Config) TrashPolicy() (trash bool, retention time.Duration, err error) {
+	switch strings.ToLower(strings.TrimSpace(c.OnDelete)) {
+	case "", "remove":
+		return false, 0, nil
+	case "trash":
+	default:
+		return false, 0, fmt.Errorf("on_delete must be \"remove\" or \"trash\", got %q", c.OnDelete)
+	}
+	retention = 7 * 24 * time.Hour
+	if v := strings.TrimSpace(c.TrashRetention); v != "" {
+		retention, err = time.ParseDuration(v)
+		if err != nil || retention < 0 {
+			return false, 0, fmt.Errorf("invalid trash_retention %q", v)
+		}
+	}
+	return true, retention, nil
+}
+
+// Encryption loads the keys for encryption at rest; nil when
+// EncryptionKeyFile is empty.
+func (c Config) Encryption() (storage.KeyProvider, error) {
+	if strings.TrimSpace(c.EncryptionKeyFile) == "" {
+		if len(c.EncryptionPreviousKeyFiles) > 0 {
+			return nil, errors.New("encryption_previous_key_files needs encryption_key_file")
+		}
+		return nil, nil
+	}
+	keys, err := storage.LoadKeyRing(strings.TrimSpace(c.EncryptionKeyFile), c.EncryptionPreviousKeyFiles...)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Signing loads the archive signing keys; nil when SigningKeyFile is empty.
+func (c Config) Signing() (*storage.SigningKeys, error) {
+	if strings.TrimSpace(c.SigningKeyFile) == "" {
+		if len(c.SigningPreviousKeyFiles) > 0 {
+			return nil, errors.New("signing_previous_key_files needs signing_key_file")
+		}
+		return nil, nil
+	}
+	return storage.LoadSigningKeys(strings.TrimSpace(c.SigningKeyFile), c.SigningPreviousKeyFiles...)
+}
+
+// URLSigning loads the keys of signed download URLs and the grace period
+// of the previous ones for Server.SetURLSigning; nil keys when
+// SignedURLKeyFile is empty.
+func (c Config) URLSigning() (storage.KeyProvider, time.Duration, error) {
+	grace := maxSignedURLTTL
+	if v := strings.TrimSpace(c.SignedURLGrace); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, 0, fmt.Errorf("invalid signed_url_grace %q", v)
+		}
+		grace = d
+	}
+	if strings.TrimSpace(c.SignedURLKeyFile) == "" {
+		if len(c.SignedURLPreviousKeyFiles) > 0 {
+			return nil, 0, errors.New("signed_url_previous_key_files needs signed_url_key_file")
+		}
+		return nil, grace, nil
+	}
+	keys, err := storage.LoadKeyRing(strings.TrimSpace(c.SignedURLKeyFile), c.SignedURLPreviousKeyFiles...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys, grace, nil
+}
+
+// ByteBudgets parses DailyByteBudgetPerUser for Server.SetDailyByteBudget.
+func (c Config) ByteBudgets() (map[string]int64, error) {
+	if c.DailyByteBudgetBytes < 0 {
+		return nil, fmt.Errorf("invalid daily_byte_budget_bytes %d", c.DailyByteBudgetBytes)
+	}
+	perUser := make(map[string]int64, len(c.DailyByteBudgetPerUser))
+	for _, entry := range c.DailyByteBudgetPerUser {
+		user, v, ok := strings.Cut(entry, "=")
+		user = strings.TrimSpace(user)
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if !ok || user == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid daily_byte_budget_per_user entry %q (want user=bytes)", entry)
+		}
+		perUser[user] = n
+	}
+	return perUser, nil
+}
+
+// Transport converts the Upstream* settings into storage transport options.
+func (c Config) Transport() (storage.TransportOptions, error) {
+	o := storage.TransportOptions{
+		MaxIdleConnsPerHost: c.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.UpstreamMaxConnsPerHost,
+	}
+	if o.MaxIdleConnsPerHost < 0 || o.MaxConnsPerHost < 0 {
+		return o, errors.New("upstream_max_idle_conns_per_host and upstream_max_conns_per_host must not be negative")
+	}
+	if v := strings.TrimSpace(c.UpstreamIdleConnTimeout); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid upstream_idle_conn_timeout %q", v)
+		}
+		o.IdleConnTimeout = d
+	}
+	if v := strings.TrimSpace(c.UpstreamHTTP2); v != "" {
+		http2, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("upstream_http2: %w", err)
+		}
+		o.DisableHTTP2 = !http2
+	}
+	return o, nil
+}
+
+// PackageRedirects converts the PackageRedirect* settings into the storage
+// redirect policy.
+func (c Config) PackageRedirects() (storage.RedirectPolicy, error) {
+	p := storage.DefaultRedirectPolicy()
+	if c.PackageRedirectMaxHops != 0 {
+		p.MaxHops = c.PackageRedirectMaxHops
+	}
+	if v := strings.TrimSpace(c.PackageRedirectSameScheme); v != "" {
+		same, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("package_redirect_same_scheme: %w", err)
+		}
+		p.RequireSameScheme = same
+	}
+	p.RequireSameHost = c.PackageRedirectSameHost
+	return p, nil
+}
+
+// PackageHostCheck is the check package URLs and their redirect hops must
+// pass, as must the addresses their connections go to:
+// storage.PublicHostCheck, or nil with PackageAllowPrivateHosts.
+func (c Config) PackageHostCheck() func(context.Context, *url.URL) error {
+	if c.PackageAllowPrivateHosts {
+		return nil
+	}
+	return storage.PublicHostCheck
+}
+
+// ParsedPackageMirrors builds the package mirror rules; nil without any.
+func (c Config) ParsedPackageMirrors() (*storage.PackageMirrors, error) {
+	if len(c.PackageMirrors) == 0 {
+		return nil, nil
+	}
+	m, err := storage.NewPackageMirrors(c.PackageMirrors)
+	if err != nil {
+		return nil, fmt.Errorf("package_mirrors: %w", err)
+	}
+	return m, nil
+}
+
+// PackagePolicy compiles PackageAllow, PackageDeny and PackageDefault; it
+// returns nil when none is set.
+func (c Config) PackagePolicy() (*storage.PackagePolicy, error) {
+	def := strings.ToLower(strings.TrimSpace(c.PackageDefault))
+	if len(c.PackageAllow) == 0 && len(c.PackageDeny) == 0 && def == "" {
+		return nil, nil
+	}
+	if def != "" && def != "allow" && def != "deny" {
+		return nil, fmt.Errorf("invalid package_default %q (want allow or deny)", c.PackageDefault)
+	}
+	return storage.NewPackagePolicy(c.PackageAllow, c.PackageDeny, def != "deny")
+}
+
+// CompressArchives parses ArchiveCompression.
+func (c Config) CompressArchives() (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(c.ArchiveCompression)) {
+	case "", "none":
+		return false, nil
+	case "zstd":
+		return true, nil
+	}
+	return false, fmt.Errorf("archive_compression must be \"none\" or \"zstd\", got %q", c.ArchiveCompression)
+}
+
+// ParsedStalePolicy parses StalePolicy.
+func (c Config) ParsedStalePolicy() (storage.StalePolicy, error) {
+	return storage.ParseStalePolicy(c.StalePolicy)
+}
+
+// ParsedCacheLayout parses CacheLayout.
+func (c Config) ParsedCacheLayout() (storage.CacheLayout, error) {
+	return storage.ParseCacheLayout(c.CacheLayout)
+}
+
+// RepoPolicy compiles RepoAllow and RepoDeny; it returns nil when neither is set.
+func (c Config) RepoPolicy() (*storage.RepoPolicy, error) {
+	if len(c.RepoAllow) == 0 && len(c.RepoDeny) == 0 {
+		return nil, nil
+	}
+	return storage.NewRepoPolicy(c.RepoAllow, c.RepoDeny)
+}
+
+// ParsedWebhookSecret is WebhookSecret with a "$VAR" value read from the
+// environment.
+func (c Config) ParsedWebhookSecret() string {
+	secret := strings.TrimSpace(c.WebhookSecret)
+	if env, ok := strings.CutPrefix(secret, "$"); ok {
+		return strings.TrimSpace(os.Getenv(env))
+	}
+	return secret
+}
+
+// Cluster builds the cluster mode options; it returns nil when ClusterSelf
+// is empty.
+func (c Config) Cluster() (*ClusterOptions, error) {
+	self := strings.TrimSpace(c.ClusterSelf)
+	if self == "" {
+		return nil, nil
+	}
+	o := &ClusterOptions{Self: self, Routes: make(map[string]string, len(c.ClusterRoutes))}
+	for _, p := range c.ClusterPeers {
+		if p = strings.TrimSpace(p); p != "" {
+			o.Peers = append(o.Peers, p)
+		}
+	}
+	for _, entry := range c.ClusterRoutes {
+		user, base, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		user, base = strings.TrimSpace(user), strings.TrimSpace(base)
+		if !ok || user == "" || base == "" {
+			return nil, fmt.Errorf("cluster_routes entry must be \"user=base_url\"")
+		}
+		o.Routes[user] = base
+	}
+	switch strings.ToLower(strings.TrimSpace(c.ClusterForward)) {
+	case "", "redirect":
+	case "proxy":
+		o.Proxy = true
+	default:
+		return nil, fmt.Errorf("cluster_forward must be \"redirect\" or \"proxy\", got %q", c.ClusterForward)
+	}
+	o.Secret = strings.TrimSpace(c.ClusterSecret)
+	if env, ok := strings.CutPrefix(o.Secret, "$"); ok {
+		o.Secret = strings.TrimSpace(os.Getenv(env))
+	}
+	return o, nil
+}
+
+// serverCredential names the server token in TokenRoutes.
+const serverCredential = "server"
+
+// ParsedTokenRoutes builds the credential routing table, with serverToken
+// (the effective server token) as the "server" credential. It is nil when
+// no credentials or routes are configured.
+func (c Config) ParsedTokenRoutes(serverToken string) (*storage.TokenRoutes, error) {
+	if len(c.Credentials) == 0 && len(c.TokenRoutes) == 0 && strings.TrimSpace(c.TokenDefault) == "" {
+		return nil, nil
+	}
+	creds := map[string]string{serverCredential: serverToken}
+	for _, entry := range c.Credentials {
+		name, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		name, token = strings.TrimSpace(name), strings.TrimSpace(token)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("credentials entry must be \"name:token\"")
+		}
+		if name == serverCredential {
+			return nil, fmt.Errorf("credentials: %q is reserved for the server token", name)
+		}
+		if env, ok := strings.CutPrefix(token, "$"); ok {
+			token = strings.TrimSpace(os.Getenv(env))
+		}
+		creds[name] = token
+	}
+	def := strings.TrimSpace(c.TokenDefault)
+	if def == "" {
+		def = serverCredential
+	}
+	t, err := storage.NewTokenRoutes(creds, c.TokenRoutes, def)
+	if err != nil {
+		return nil, err
+	}
+	t.Debug = c.DebugTokenRoutes
+	return t, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github-hub/internal/storage"
+)
+
+// consistencyChecker is implemented by stores that can find and repair
+// inconsistent cache state (see storage.Storage.CheckConsistency).
+type consistencyChecker interface {
+	CheckConsistency(dryRun bool) (*storage.ConsistencyReport, error)
+}
+
+// handleConsistency runs the cache consistency pass and returns its
+// report. GET only reports what would be repaired; POST repairs it unless
+// dry_run=true. Admin only.
+func (s *Server) handleConsistency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "consistency checks require an admin key")
+		return
+	}
+	checker, ok := s.store.(consistencyChecker)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "consistency checks are not supported by this store")
+		return
+	}
+	dryRun := r.Method == http.MethodGet
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, "invalid dry_run")
+			return
+		}
+		dryRun = dryRun || b
+	}
+	report, err := checker.CheckConsistency(dryRun)
+	if err != nil {
+		failErr(w, r, "consistency check", err)
+		return
+	}
+	if !dryRun {
+		s.logConsistency(report)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// checkConsistency is the janitor's consistency pass.
+func (s *Server) checkConsistency() {
+	checker, ok := s.store.(consistencyChecker)
+	if !ok {
+		return
+	}
+	report, err := checker.CheckConsistency(false)
+	if err != nil {
+		s.logf("consistency check failed: %v\n", err)
+		return
+	}
+	s.logConsistency(report)
+}
+
+func (s *Server) logConsistency(report *storage.ConsistencyReport) {
+	if report.Repairs() == 0 && len(report.Unexpected) == 0 {
+		return
+	}
+	s.logf("consistency: orphan_sidecars=%d regenerated=%d unverified=%d broken=%d unexpected=%d\n",
+		len(report.OrphanSidecars), len(report.Regenerated), len(report.Unverified), len(report.Broken), len(report.Unexpected))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestConsistencyEndpoint(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	orphan := filepath.Join(root, "users", "ci", "repos", "own", "repo", "main.meta.json")
+	if err := os.MkdirAll(filepath.Dir(orphan), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		key    string
+		want   int
+		dryRun bool
+	}{
+		{"not admin", http.MethodGet, "/api/v1/admin/consistency", "alice-key", http.StatusForbidden, false},
+		{"bad method", http.MethodDelete, "/api/v1/admin/consistency", "root-key", http.StatusMethodNotAllowed, false},
+		{"bad dry_run", http.MethodPost, "/api/v1/admin/consistency?dry_run=maybe", "root-key", http.StatusBadRequest, false},
+		{"get is a dry run", http.MethodGet, "/api/v1/admin/consistency", "root-key", http.StatusOK, true},
+		{"post dry run", http.MethodPost, "/api/v1/admin/consistency?dry_run=true", "root-key", http.StatusOK, true},
+		{"post repairs", http.MethodPost, "/api/v1/admin/consistency", "root-key", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		req.Header.Set("X-GHH-Api-Key", tt.key)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var report storage.ConsistencyReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.DryRun != tt.dryRun || len(report.OrphanSidecars) != 1 {
+			t.Fatalf("%s: report = %+v", tt.name, report)
+		}
+		_, err := os.Stat(orphan)
+		if tt.dryRun != (err == nil) {
+			t.Fatalf("%s: orphan stat err = %v", tt.name, err)
+		}
+	}
+}
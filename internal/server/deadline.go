@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// defaultMetadataTimeout bounds routes that never download archives.
+const defaultMetadataTimeout = 30 * time.Second
+
+// SetMetadataTimeout sets the deadline of metadata routes (listing, version,
+// ref and default-branch lookups). Non-positive values keep the default.
+func (s *Server) SetMetadataTimeout(d time.Duration) {
+	if d > 0 {
+		s.metadataTO = d
+	}
+}
+
+// SetCompleteOnDisconnect chooses what happens to an in-progress cache
+// population when its client disconnects: false cancels it (the default),
+// true lets it finish within the route deadline so the next request hits the
+// cache.
+func (s *Server) SetCompleteOnDisconnect(complete bool) {
+	s.completeOnDisconnect = complete
+}
+
+// deadline bounds the request context with the download or metadata budget.
+func (s *Server) deadline(download bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget := s.metadataTO
+		if download {
+			budget = s.downloadTO
+		}
+		if budget <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// populateContext derives the context for storage calls that fill the
+// cache. It keeps the request's deadline (or applies the download budget
+// when there is none) and, with completeOnDisconnect, stops client
+// cancellation from reaching the download.
+func (s *Server) populateContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if s.completeOnDisconnect {
+		ctx = context.WithoutCancel(parent)
+		if dl, ok := parent.Deadline(); ok {
+			return context.WithDeadline(ctx, dl)
+		}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return s.downloadContext(ctx)
+}
+
+// downloadContext bounds ctx with the download budget. A budget lifted by
+// a negative Limits.DownloadTimeout sets no deadline.
+func (s *Server) downloadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.downloadTO <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.downloadTO)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// blockingStore simulates a cold download that runs until released or
+// cancelled, reporting how it ended.
+type blockingStore struct {
+	fakeStore
+	started chan struct{}
+	release chan struct{}
+	done    chan error
+}
+
+func (b *blockingStore) EnsureRepoResult(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (*storage.RepoArchive, error) {
+	close(b.started)
+	select {
+	case <-ctx.Done():
+		b.done <- ctx.Err()
+		return nil, ctx.Err()
+	case <-b.release:
+		b.done <- nil
+		return &storage.RepoArchive{Path: b.ensurePath}, nil
+	}
+}
+
+func TestClientDisconnectDuringColdDownload(t *testing.T) {
+	for _, complete := range []bool{false, true} {
+		name := "cancel"
+		if complete {
+			name = "complete"
+		}
+		t.Run(name, func(t *testing.T) {
+			bs := &blockingStore{started: make(chan struct{}), release: make(chan struct{}), done: make(chan error, 1)}
+			s := NewServerWithStore(bs, "", "default")
+			s.SetCompleteOnDisconnect(complete)
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v1/download?repo=own/repo&branch=main", nil)
+			go func() {
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					_ = resp.Body.Close()
+				}
+			}()
+			<-bs.started
+			cancel() // client gives up mid-download
+
+			if complete {
+				select {
+				case err := <-bs.done:
+					t.Fatalf("population ended early: %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				close(bs.release)
+			}
+			select {
+			case err := <-bs.done:
+				if complete && err != nil {
+					t.Fatalf("population cancelled: %v", err)
+				}
+				if !complete && err == nil {
+					t.Fatalf("population was not cancelled")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("population never finished")
+			}
+		})
+	}
+}
+
+func TestDeadlineBudgets(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	s.downloadTO = time.Hour
+	s.SetMetadataTimeout(time.Second)
+	var got time.Duration
+	probe := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dl, ok := r.Context().Deadline()
+		if !ok {
+			t.Fatal("no deadline")
+		}
+		got = time.Until(dl)
+	})
+	s.deadline(false, probe).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got > time.Second {
+		t.Fatalf("metadata budget %v", got)
+	}
+	s.deadline(true, probe).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got < time.Minute {
+		t.Fatalf("download budget %v", got)
+	}
+}
+
+// ctxStore fails downloads whose context is already done, as a real
+// download would.
+type ctxStore struct {
+	fakeStore
+}
+
+func (c *ctxStore) EnsureRepoResult(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (*storage.RepoArchive, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.fakeStore.EnsureRepoResult(ctx, user, ownerRepo, branch, token, force, legacy)
+}
+
+func TestNegativeDownloadTimeoutLiftsDeadline(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	s := New(&ctxStore{fakeStore{ensurePath: zipPath}}, withStatsFile(""), WithLimits(Limits{DownloadTimeout: -1}))
+	defer s.Shutdown()
+	ctx, cancel := s.downloadContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok || ctx.Err() != nil {
+		t.Fatalf("download context has a deadline (err=%v)", ctx.Err())
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+)
+
+// downloadSource is implemented by stores that record their upstream
+// downloads (see storage.Storage.RecentDownloads).
+type downloadSource interface {
+	RecentDownloads() []storage.DownloadRecord
+	UpstreamHealth() storage.UpstreamHealth
+}
+
+// SetSlowDownloadAlert makes the built-in storage flag upstream as degraded
+// once a download of at least 1 MiB runs below bytesPerSec, until recovery
+// (0 = 3) downloads in a row did not; 0 bytesPerSec disables the alert.
+// The flag shows on /api/v1/status.
+func (s *Server) SetSlowDownloadAlert(bytesPerSec int64, recovery int) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SlowDownloadThreshold = max(bytesPerSec, 0)
+		st.SlowDownloadRecovery = recovery
+	}
+}
+
+// observeDownload counts an upstream download of the built-in storage.
+func (s *Server) observeDownload(rec storage.DownloadRecord) {
+	if rec.Error == "" {
+		s.usage.downloaded(rec.Bytes)
+	}
+	if s.downloadMetrics != nil {
+		s.downloadMetrics(rec)
+	}
+}
+
+// observeDownloads feeds the built-in storage's downloads into the metrics.
+func (s *Server) observeDownloads(reg *metrics.Registry) {
+	st, ok := s.store.(*storage.Storage)
+	if !ok {
+		return
+	}
+	duration := reg.Histogram("ghh_upstream_download_duration_seconds", "Upstream download time, retries included, by kind and result.",
+		[]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}, "kind", "result")
+	size := reg.Histogram("ghh_upstream_download_bytes", "Bytes of successful upstream downloads by kind.",
+		[]float64{1 << 10, 1 << 15, 1 << 20, 1 << 23, 1 << 25, 1 << 27, 1 << 29, 1 << 31}, "kind")
+	throughput := reg.Histogram("ghh_upstream_download_throughput_bytes_per_second", "Effective throughput of successful upstream downloads by kind.",
+		[]float64{1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28}, "kind")
+	s.downloadMetrics = func(rec storage.DownloadRecord) {
+		result := "ok"
+		if rec.Error != "" {
+			result = "error"
+		}
+		duration.Observe(rec.DurationSeconds, rec.Kind, result)
+		if rec.Error == "" {
+			size.Observe(float64(rec.Bytes), rec.Kind)
+			throughput.Observe(rec.BytesPerSecond, rec.Kind)
+		}
+	}
+	reg.GaugeFunc("ghh_upstream_degraded", "1 while slow downloads mark upstream as degraded.", func() float64 {
+		if st.UpstreamHealth().Degraded {
+			return 1
+		}
+		return 0
+	})
+}
+
+// recentDownloads is the answer of /api/v1/admin/downloads/recent.
+type recentDownloads struct {
+	Upstream  storage.UpstreamHealth   `json:"upstream"`
+	Downloads []storage.DownloadRecord `json:"downloads"`
+}
+
+// handleRecentDownloads lists the last upstream downloads, newest first,
+// at most limit= of them, with the slow-download alert state. Admin only.
+func (s *Server) handleRecentDownloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "recent downloads require an admin key")
+		return
+	}
+	src, ok := s.store.(downloadSource)
+	if !ok {
+		fail(w, r, http.StatusNotFound, "this store does not record downloads")
+		return
+	}
+	out := recentDownloads{Upstream: src.UpstreamHealth(), Downloads: src.RecentDownloads()}
+	if v := strings.TrimSpace(r.URL.Query().Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			fail(w, r, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if n < len(out.Downloads) {
+			out.Downloads = out.Downloads[:n]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// serverStatus is the answer of /api/v1/status.
+type serverStatus struct {
+	// Status is "ok", "warming" or "degraded".
+	Status           string `json:"status"`
+	Warming          bool   `json:"warming"`
+	DegradedUpstream bool   `json:"degraded_upstream"`
+	// DegradedSince is when the current degradation began.
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+// handleStatus summarizes the server's health for dashboards: whether a
+// gating warm-up runs and whether slow downloads mark upstream degraded.
+// Unlike /readyz it always answers 200; a degraded upstream still serves
+// what is cached.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	st := serverStatus{Status: "ok", Warming: s.warmup.warming.Load()}
+	if src, ok := s.store.(downloadSource); ok {
+		h := src.UpstreamHealth()
+		st.DegradedUpstream, st.DegradedSince = h.Degraded, h.Since
+	}
+	switch {
+	case st.Warming:
+		st.Status = "warming"
+	case st.DegradedUpstream:
+		st.Status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(st)
+}
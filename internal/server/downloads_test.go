@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+	"github-hub/internal/testutil"
+)
+
+func TestSlowDownloadStatus(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	st := s.store.(*storage.Storage)
+	clock := testutil.NewFakeClock(time.Now())
+	st.Clock = clock
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		clock.Advance(8 * time.Second) // 2 MiB in 8s: 256 KiB/s
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(make([]byte, 2<<20))), Header: make(http.Header)}, nil
+	})}
+	s.SetMetrics(metrics.NewRegistry())
+	s.SetSlowDownloadAlert(1<<20, 1)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	var status serverStatus
+	if err := json.NewDecoder(get("/api/v1/status").Body).Decode(&status); err != nil || status.Status != "ok" || status.DegradedUpstream {
+		t.Fatalf("status before = %+v, %v", status, err)
+	}
+
+	if rec := get("/api/v1/download/package?url=https://example.com/big.bin"); rec.Code != http.StatusOK {
+		t.Fatalf("package download: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := json.NewDecoder(get("/api/v1/status").Body).Decode(&status); err != nil || status.Status != "degraded" || !status.DegradedUpstream || status.DegradedSince == nil {
+		t.Fatalf("status after slow download = %+v, %v", status, err)
+	}
+	var recent recentDownloads
+	if err := json.NewDecoder(get("/api/v1/admin/downloads/recent?limit=5").Body).Decode(&recent); err != nil {
+		t.Fatal(err)
+	}
+	if len(recent.Downloads) != 1 || !recent.Downloads[0].Slow || recent.Downloads[0].DurationSeconds != 8 || recent.Downloads[0].BytesPerSecond != 256<<10 || !recent.Upstream.Degraded {
+		t.Fatalf("recent = %+v", recent)
+	}
+	if rec := get("/api/v1/admin/downloads/recent?limit=0"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("limit=0: %d", rec.Code)
+	}
+	body := get("/metrics").Body.String()
+	for _, want := range []string{"ghh_upstream_degraded 1", "ghh_upstream_slow_downloads_total 1", `ghh_upstream_download_duration_seconds_count{kind="package",result="ok"} 1`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics lack %q", want)
+		}
+	}
+
+	// One healthy download clears the flag.
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		clock.Advance(time.Second)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(make([]byte, 2<<20))), Header: make(http.Header)}, nil
+	})}
+	if rec := get("/api/v1/download/package?url=https://example.com/big2.bin"); rec.Code != http.StatusOK {
+		t.Fatalf("package download: %d", rec.Code)
+	}
+	status = serverStatus{}
+	if err := json.NewDecoder(get("/api/v1/status").Body).Decode(&status); err != nil || status.Status != "ok" || status.DegradedSince != nil {
+		t.Fatalf("status after recovery = %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// Error codes carried in the structured error envelope and the
+// X-GHH-Error-Code header so clients can branch without parsing messages.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeRepoNotFound         = "repo_not_found"
+	CodeBranchNotFound       = "branch_not_found"
+	CodeEmptyRepo            = "empty_repo"
+	CodeRateLimited          = "rate_limited"
+	CodeBranchGone           = "branch_gone"
+	CodePolicyDenied         = "policy_denied"
+	CodeConflict             = "conflict"
+	CodeTooLarge             = "too_large"
+	CodeUnverified           = "upstream_unverified"
+	CodeUnverifiable         = "unverifiable"
+	CodeNoSpace              = "insufficient_storage"
+	CodeUpstreamUnauthorized = "upstream_unauthorized"
+	CodeUpstreamUnavailable  = "upstream_unavailable"
+	CodeRedirectRefused      = "redirect_refused"
+	CodeChecksumMismatch     = "checksum_mismatch"
+	CodeServerBusy           = "server_busy"
+	CodeSignatureInvalid     = "signature_invalid"
+	CodeURLExpired           = "url_expired"
+	CodeQuotaExceeded        = "quota_exceeded"
+	CodeNotCached            = "not_cached"
+	CodeNotAcceptable        = "not_acceptable"
+	CodeNotSegmentable       = "not_segmentable"
+	CodeInternal             = "internal"
+	// CodeSkipped marks batch items that were not attempted because another
+	// item of an atomic request failed.
+	CodeSkipped = "skipped"
+)
+
+// errorBody is the JSON envelope returned by endpoints that speak JSON.
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// classify maps a store error to an HTTP status and error code. Rate limits
+// come before refused credentials, as GitHub signals both with 403.
+// Strict verification failures come before the upstream error they wrap.
+func classify(err error) (int, string) {
+	var unverifiable *storage.UnverifiableError
+	switch {
+	case errors.Is(err, storage.ErrBadPath), errors.Is(err, storage.ErrBadPageToken):
+		return http.StatusBadRequest, CodeBadRequest
+	case errors.As(err, &unverifiable):
+		if unverifiable.Err != nil {
+			// Upstream could not confirm the branch head.
+			return http.StatusBadGateway, CodeUnverifiable
+		}
+		// The cached archive cannot be served as the branch head.
+		return http.StatusConflict, CodeUnverifiable
+	case errors.Is(err, storage.ErrRepoNotFound):
+		return http.StatusNotFound, CodeRepoNotFound
+	case errors.Is(err, storage.ErrBranchNotFound):
+		return http.StatusNotFound, CodeBranchNotFound
+	case errors.Is(err, storage.ErrEmptyRepo):
+		return http.StatusNotFound, CodeEmptyRepo
+	case errors.Is(err, storage.ErrRateLimited):
+		return http.StatusTooManyRequests, CodeRateLimited
+	case errors.Is(err, storage.ErrBranchGone):
+		return http.StatusGone, CodeBranchGone
+	case errors.Is(err, storage.ErrPolicyDenied):
+		return http.StatusForbidden, CodePolicyDenied
+	case errors.Is(err, storage.ErrExists):
+		return http.StatusConflict, CodeConflict
+	case errors.Is(err, storage.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, CodeTooLarge
+	case errors.Is(err, storage.ErrUnverified):
+		return http.StatusBadGateway, CodeUnverified
+	case errors.Is(err, storage.ErrInsufficientSpace):
+		return http.StatusInsufficientStorage, CodeNoSpace
+	case errors.Is(err, storage.ErrUnauthorizedUpstream):
+		// The caller's (or the server's) GitHub token was refused; retrying
+		// with the same one will not help.
+		return http.StatusForbidden, CodeUpstreamUnauthorized
+	case errors.Is(err, storage.ErrRedirectPolicy):
+		// The package host answered, with a redirect we will not follow.
+		return http.StatusBadGateway, CodeRedirectRefused
+	case errors.Is(err, storage.ErrBlockedHost):
+		// The package host resolved to an internal address on connect.
+		return http.StatusForbidden, CodeForbidden
+	case errors.Is(err, storage.ErrNotSegmentable):
+		// Stored compressed or encrypted; the plain download still works.
+		return http.StatusConflict, CodeNotSegmentable
+	case errors.Is(err, storage.ErrNotCached):
+		// RFC 9111: only-if-cached requests the cache cannot satisfy.
+		return http.StatusGatewayTimeout, CodeNotCached
+	case errors.Is(err, storage.ErrUpstreamUnavailable):
+		return http.StatusBadGateway, CodeUpstreamUnavailable
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		return http.StatusInternalServerError, CodeChecksumMismatch
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// writeError writes the structured error envelope.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = msg
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-GHH-Error-Code", code)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// jsonError classifies err and writes it as a structured error.
+func jsonError(w http.ResponseWriter, op string, err error) {
+	setRetryAfter(w, err)
+	status, code := classify(err)
+	writeError(w, status, code, op+": "+err.Error())
+}
+
+// codeForStatus picks the generic error code for a handler-level failure.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusNotAcceptable:
+		return CodeNotAcceptable
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway:
+		return CodeUpstreamUnavailable
+	case http.StatusServiceUnavailable:
+		return CodeServerBusy
+	}
+	return CodeInternal
+}
+
+// isV2 reports whether r targets the /api/v2 surface, which always answers
+// errors with the JSON envelope.
+func isV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/v2/")
+}
+
+// fail writes a handler error. v2 requests and v1 callers that negotiated
+// JSON get the envelope; other v1 callers keep the historical plain text.
+func fail(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if isV2(r) || wantsJSON(r) {
+		writeError(w, status, codeForStatus(status), msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// historicalV1 reports whether v1 answers code with its original status
+// mapping (bad path and not found are 400, everything else 500). Codes added
+// later (deleted branches, policy denials, upload conflicts, unverifiable
+// branches, upstream failures) and missing upstream repos and branches,
+// which clients must not retry, use their classify status in both versions.
+func historicalV1(code string) bool {
+	switch code {
+	case CodeBadRequest, CodeNotFound, CodeRateLimited, CodeInternal:
+		return true
+	}
+	return false
+}
+
+// failErr writes a store error: v1 keeps its historical status mapping for
+// the original error kinds (see historicalV1); v2 uses classify.
+func failErr(w http.ResponseWriter, r *http.Request, op string, err error) {
+	status, code := classify(err)
+	if !isV2(r) && historicalV1(code) {
+		status = http.StatusInternalServerError
+		if errors.Is(err, storage.ErrBadPath) || errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrBadPageToken) {
+			status = http.StatusBadRequest
+		}
+	}
+	setRetryAfter(w, err)
+	var gone *storage.BranchGoneError
+	if errors.As(err, &gone) && gone.LastCommit != "" {
+		setCommitHeaders(w, gone.LastCommit, gone.Archive().ShortSHA)
+	}
+	msg := op + ": " + err.Error()
+	if isV2(r) || wantsJSON(r) {
+		writeError(w, status, code, msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// setRetryAfter passes GitHub's rate limit advice, or the rest of the
+// upstream circuit's cool-down, on to the client, so a cooling-down server
+// tells callers when to come back.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var rle *storage.RateLimitError
+	var coe *storage.CircuitOpenError
+	switch {
+	case errors.As(err, &rle) && rle.RetryAfter > 0:
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(rle.RetryAfter.Seconds())), 10))
+	case errors.As(err, &coe) && coe.RetryAfter > 0:
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(coe.RetryAfter.Seconds())), 10))
+	}
+}
+
+// setCommitHeaders sets X-GHH-Commit to the full SHA, or the short one
+// when the full SHA is unknown, and X-GHH-Commit-Short for display.
+func setCommitHeaders(w http.ResponseWriter, full, short string) {
+	switch {
+	case full != "":
+		w.Header().Set("X-GHH-Commit", full)
+	case short != "":
+		w.Header().Set("X-GHH-Commit", short)
+	}
+	if short != "" {
+		w.Header().Set("X-GHH-Commit-Short", short)
+	}
+}
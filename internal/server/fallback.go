@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// maxFallbackBranches caps the branches of one fallback= list.
+const maxFallbackBranches = 10
+
+// fallbackParam parses fallback=, a comma-separated list of branches to try
+// in order when the requested one does not exist upstream. Duplicates are
+// dropped.
+func fallbackParam(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("fallback"))
+	if v == "" {
+		return nil, true
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, b := range strings.Split(v, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" || seen[b] {
+			continue
+		}
+		if !refParam(w, r, b) {
+			return nil, false
+		}
+		seen[b] = true
+		out = append(out, b)
+	}
+	if len(out) > maxFallbackBranches {
+		fail(w, r, http.StatusBadRequest, fmt.Sprintf("fallback lists at most %d branches", maxFallbackBranches))
+		return nil, false
+	}
+	return out, true
+}
+
+// ensureWithFallback is EnsureRepoResult for branch, or, when branch does
+// not exist upstream, for the first branch of fallback that does. Fallbacks
+// are checked with ResolveRef so none is downloaded just to find out it is
+// missing. It returns the branch served.
+func (s *Server) ensureWithFallback(ctx context.Context, user, repo, branch, token string, force, legacy bool, fallback []string) (string, *storage.RepoArchive, error) {
+	res, err := s.store.EnsureRepoResult(ctx, user, repo, branch, token, force, legacy)
+	if err == nil || len(fallback) == 0 || !errors.Is(err, storage.ErrBranchNotFound) {
+		return branch, res, err
+	}
+	for _, b := range fallback {
+		if b == branch {
+			continue
+		}
+		if _, rerr := s.store.ResolveRef(ctx, user, repo, b, token); errors.Is(rerr, storage.ErrBranchNotFound) {
+			continue
+		} else if rerr != nil {
+			return branch, nil, rerr
+		}
+		s.logf("branch fallback user=%s repo=%s branch=%s served=%s\n", user, repo, branch, b)
+		res, err := s.store.EnsureRepoResult(ctx, user, repo, b, token, force, legacy)
+		return b, res, err
+	}
+	return branch, nil, fmt.Errorf("%w; fallbacks %s not found either", err, strings.Join(fallback, ","))
+}
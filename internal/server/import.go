@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// archiveImporter is implemented by stores that can be seeded with
+// archives obtained out of band (see storage.Storage.ImportRepoArchive).
+type archiveImporter interface {
+	ImportRepoArchive(user, ownerRepo, branch, commitSHA, src string) (*storage.ArchiveMeta, error)
+}
+
+// importFormMemory is how much of an import form is held in memory; the
+// rest, normally the archive, is spooled to a temp file.
+const importFormMemory = 1 << 20
+
+// handleImportArchive seeds the cache with an uploaded archive: a
+// multipart form with the zip as its "archive" file and the fields repo,
+// branch, commit (the full SHA the archive was made from) and optionally
+// user, which defaults to the caller's namespace. The archive is then
+// served as that commit until upstream can be asked again. Admin only.
+func (s *Server) handleImportArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "archive import requires an admin key")
+		return
+	}
+	importer, ok := s.store.(archiveImporter)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "archive import is not supported by this store")
+		return
+	}
+	if s.uploadMax > 0 {
+		if r.ContentLength > s.uploadMax+multipartSlack {
+			fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", s.uploadMax))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.uploadMax+multipartSlack+1)
+	}
+	if err := r.ParseMultipartForm(importFormMemory); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", s.uploadMax))
+			return
+		}
+		fail(w, r, http.StatusBadRequest, "expected a multipart form")
+		return
+	}
+	defer func() { _ = r.MultipartForm.RemoveAll() }()
+	if u := strings.TrimSpace(r.FormValue("user")); u != "" {
+		user = sanitizeUser(u)
+	}
+	repo := repoArg(r.FormValue("repo"))
+	branch := strings.TrimSpace(r.FormValue("branch"))
+	commit := strings.TrimSpace(r.FormValue("commit"))
+	if repo == "" || commit == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo or commit")
+		return
+	}
+	if !refParam(w, r, branch) {
+		return
+	}
+	file, hdr, err := r.FormFile("archive")
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, "multipart form has no archive file")
+		return
+	}
+	defer func() { _ = file.Close() }()
+	src, cleanup, err := spoolUpload(file, hdr)
+	if err != nil {
+		s.logf("import spool error repo=%s err=%v\n", repo, err)
+		failErr(w, r, "import archive", err)
+		return
+	}
+	defer cleanup()
+
+	meta, err := importer.ImportRepoArchive(user, repo, branch, commit, src)
+	if err != nil {
+		s.logf("import error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "import archive", err)
+		return
+	}
+	s.logf("import ok user=%s repo=%s branch=%s commit=%s\n", user, meta.Repo, meta.Branch, meta.CommitSHA)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+// spoolUpload returns a path holding the uploaded file: the temp file the
+// form was spooled to, or a copy of a file small enough to stay in memory.
+func spoolUpload(file multipart.File, hdr *multipart.FileHeader) (string, func(), error) {
+	if f, ok := file.(*os.File); ok {
+		return f.Name(), func() {}, nil
+	}
+	tmp, err := os.CreateTemp("", "ghh-import-*.zip")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, io.LimitReader(file, hdr.Size))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestImportArchiveEndpoint(t *testing.T) {
+	const sha = "abcdefabcdefabcdefabcdefabcdefabcdefabcd"
+	zipPath := filepath.Join(t.TempDir(), "seed.zip")
+	createZip(t, zipPath)
+	archive, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	post := func(key string, fields map[string]string, file []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range fields {
+			_ = mw.WriteField(k, v)
+		}
+		if file != nil {
+			fw, _ := mw.CreateFormFile("archive", "seed.zip")
+			_, _ = fw.Write(file)
+		}
+		_ = mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("X-GHH-Api-Key", key)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fields := map[string]string{"repo": "https://github.com/own/repo.git", "branch": "main", "commit": sha, "user": "ci"}
+	tests := []struct {
+		name   string
+		key    string
+		fields map[string]string
+		file   []byte
+		want   int
+	}{
+		{"not admin", "alice-key", fields, archive, http.StatusForbidden},
+		{"no file", "root-key", fields, nil, http.StatusBadRequest},
+		{"not a zip", "root-key", fields, []byte("nope"), http.StatusBadRequest},
+		{"bad commit", "root-key", map[string]string{"repo": "own/repo", "commit": "abc"}, archive, http.StatusBadRequest},
+		{"bad branch", "root-key", map[string]string{"repo": "own/repo", "branch": "a..b", "commit": sha}, archive, http.StatusBadRequest},
+		{"ok", "root-key", fields, archive, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		rec := post(tt.key, tt.fields, tt.file)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+
+	var meta storage.ArchiveMeta
+	rec := post("root-key", fields, archive)
+	if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil || meta.CommitSHA != sha || meta.Repo != "own/repo" {
+		t.Fatalf("meta = %+v, %v", meta, err)
+	}
+	imported := filepath.Join(root, "users", "ci", "repos", "own", "repo", "main.zip")
+	if got, err := os.ReadFile(imported); err != nil || !bytes.Equal(got, archive) {
+		t.Fatalf("imported archive differs: %v", err)
+	}
+}
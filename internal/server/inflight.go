@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflight tracks the requests being served on router routes, globally and
+// per route, for the metrics gauges, the admin snapshot and the busy cap.
+type inflight struct {
+	mu      sync.Mutex
+	next    uint64
+	reqs    map[uint64]*inflightRequest
+	byRoute map[string]int
+	// limit caps concurrent capped requests; 0 is unlimited.
+	limit  int
+	capped int
+}
+
+// inflightRequest is one request in flight, as the snapshot shows it.
+type inflightRequest struct {
+	ID      uint64    `json:"id"`
+	Method  string    `json:"method"`
+	Route   string    `json:"route"`
+	Path    string    `json:"path"`
+	User    string    `json:"user,omitempty"`
+	Repo    string    `json:"repo,omitempty"`
+	Started time.Time `json:"started"`
+	// AgeSeconds is filled in by the snapshot.
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+type inflightKey struct{}
+
+func newInflight() *inflight {
+	return &inflight{reqs: make(map[uint64]*inflightRequest), byRoute: make(map[string]int)}
+}
+
+// SetMaxInflight rejects new requests with 503 and Retry-After while n
+// requests are already in flight on the API, as a backstop before the host
+// is overwhelmed; 0 (the default) sets no limit. The in-flight snapshot and
+// other monitoring routes are never rejected.
+func (s *Server) SetMaxInflight(n int) {
+	s.inflight.mu.Lock()
+	defer s.inflight.mu.Unlock()
+	s.inflight.limit = max(n, 0)
+}
+
+// begin registers a request. When capped and the limit is reached it
+// registers nothing and returns the limit.
+func (f *inflight) begin(route string, r *http.Request, capped bool) (*inflightRequest, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if capped && f.limit > 0 && f.capped >= f.limit {
+		return nil, f.limit
+	}
+	if capped {
+		f.capped++
+	}
+	f.next++
+	e := &inflightRequest{ID: f.next, Method: r.Method, Route: route, Path: r.URL.Path, Repo: requestRepo(r), Started: time.Now()}
+	f.reqs[e.ID] = e
+	f.byRoute[route]++
+	return e, 0
+}
+
+func (f *inflight) end(e *inflightRequest, capped bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.reqs, e.ID)
+	if f.byRoute[e.Route]--; f.byRoute[e.Route] <= 0 {
+		delete(f.byRoute, e.Route)
+	}
+	if capped {
+		f.capped--
+	}
+}
+
+func (f *inflight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.reqs)
+}
+
+// requestRepo is the repository a request names, as far as it can be told
+// before the handler runs.
+func requestRepo(r *http.Request) string {
+	if owner := r.PathValue("owner"); owner != "" {
+		return owner + "/" + r.PathValue("repo")
+	}
+	return repoArg(r.URL.Query().Get("repo"))
+}
+
+// noteInflightUser records the user a request acts as once scope has
+// resolved it.
+func (s *Server) noteInflightUser(r *http.Request, user string) {
+	if e, ok := r.Context().Value(inflightKey{}).(*inflightRequest); ok {
+		s.inflight.mu.Lock()
+		e.User = user
+		s.inflight.mu.Unlock()
+	}
+}
+
+// track counts h's requests in flight on route and, when capped, turns
+// requests away while the limit is reached.
+func (s *Server) track(route string, capped bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, limit := s.inflight.begin(route, r, capped)
+		if e == nil {
+			s.logf("server busy path=%s limit=%d\n", r.URL.Path, limit)
+			w.Header().Set("Retry-After", "1")
+			fail(w, r, http.StatusServiceUnavailable, fmt.Sprintf("server busy: %d requests in flight", limit))
+			return
+		}
+		if m := s.metrics; m != nil {
+			m.inflight.Add(1, route)
+		}
+		defer func() {
+			s.inflight.end(e, capped)
+			if m := s.metrics; m != nil {
+				m.inflight.Add(-1, route)
+			}
+		}()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inflightKey{}, e)))
+	})
+}
+
+// inflightSnapshot is the answer of /api/v1/admin/inflight.
+type inflightSnapshot struct {
+	Total    int                `json:"total"`
+	Limit    int                `json:"limit"`
+	Routes   map[string]int     `json:"routes"`
+	Requests []*inflightRequest `json:"requests"`
+}
+
+// handleInflight lists the requests in flight, oldest first. Admin only.
+func (s *Server) handleInflight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "the in-flight snapshot requires an admin key")
+		return
+	}
+	now := time.Now()
+	f := s.inflight
+	f.mu.Lock()
+	snap := inflightSnapshot{Total: len(f.reqs), Limit: f.limit, Routes: make(map[string]int, len(f.byRoute)), Requests: make([]*inflightRequest, 0, len(f.reqs))}
+	for route, n := range f.byRoute {
+		snap.Routes[route] = n
+	}
+	for _, e := range f.reqs {
+		c := *e
+		c.AgeSeconds = now.Sub(c.Started).Seconds()
+		snap.Requests = append(snap.Requests, &c)
+	}
+	f.mu.Unlock()
+	sort.Slice(snap.Requests, func(i, j int) bool { return snap.Requests[i].ID < snap.Requests[j].ID })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(snap)
+}
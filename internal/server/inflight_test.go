@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/metrics"
+)
+
+func TestInflightCapAndSnapshot(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	bs := &blockingStore{fakeStore: fakeStore{ensurePath: zipPath}, started: make(chan struct{}), release: make(chan struct{}), done: make(chan error, 1)}
+	s := NewServerWithStore(bs, "", "default")
+	defer s.Shutdown()
+	s.SetMetrics(metrics.NewRegistry())
+	s.SetMaxInflight(1)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	first := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main&user=ci")
+		if err != nil {
+			first <- 0
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	<-bs.started
+
+	resp, err := http.Get(ts.URL + "/api/v2/repos/own/repo/archive/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env errorBody
+	_ = json.NewDecoder(resp.Body).Decode(&env)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" || env.Error.Code != CodeServerBusy {
+		t.Fatalf("over the cap: status=%d retry-after=%q code=%q", resp.StatusCode, resp.Header.Get("Retry-After"), env.Error.Code)
+	}
+
+	// The snapshot is exempt from the cap.
+	resp, err = http.Get(ts.URL + "/api/v1/admin/inflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap inflightSnapshot
+	err = json.NewDecoder(resp.Body).Decode(&snap)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot: status=%d err=%v", resp.StatusCode, err)
+	}
+	// The snapshot sees itself too.
+	if snap.Total != 2 || snap.Limit != 1 || snap.Routes["/api/v1/download"] != 1 || snap.Routes["/api/v1/admin/inflight"] != 1 {
+		t.Fatalf("snapshot %+v", snap)
+	}
+	dl := snap.Requests[0]
+	if dl.Route != "/api/v1/download" || dl.User != "ci" || dl.Repo != "own/repo" || dl.AgeSeconds <= 0 {
+		t.Fatalf("download entry %+v", dl)
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.Contains(string(body), "ghh_http_inflight_requests 1\n") ||
+		!strings.Contains(string(body), `ghh_http_inflight_route_requests{route="/api/v1/download"} 1`) {
+		t.Fatalf("metrics:\n%s", body)
+	}
+
+	close(bs.release)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first download: status=%d", code)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.inflight.count() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests still in flight", s.inflight.count())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// defaultManifestLimits caps manifests unless SetManifestLimits changes it.
+var defaultManifestLimits = storage.ManifestLimits{MaxEntries: 200000, MaxBytes: 8 << 30}
+
+// SetManifestLimits caps the archives GET /api/v1/repos/manifest hashes:
+// at most entries files and bytes uncompressed bytes; 0 or less removes
+// that limit. Larger archives answer 413.
+func (s *Server) SetManifestLimits(entries int, bytes int64) {
+	s.manifestLimits = storage.ManifestLimits{MaxEntries: entries, MaxBytes: bytes}
+}
+
+// handleRepoManifest serves the file manifest (paths, sizes and SHA-256
+// digests) of the user's archive of a branch, downloading the archive when
+// it is not cached. The manifest is built on the first request for a
+// commit and served from its sidecar afterwards.
+func (s *Server) handleRepoManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	branch := strings.TrimSpace(q.Get("branch"))
+	legacy, _ := strconv.ParseBool(q.Get("legacy"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	if err := storage.ValidateRef(branch); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if err := s.repoPolicy.Load().Check(repo); err != nil {
+		jsonError(w, "repo policy", err)
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+
+	var outcome storage.CacheOutcome
+	res, err := s.store.EnsureRepoResult(storage.WithOutcome(ctx, &outcome), user, repo, branch, token, false, legacy)
+	setCacheLabel(r, outcome)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("repo manifest error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		jsonError(w, "ensure repo", err)
+		return
+	}
+	// The manifest is built before anything is written, so its errors can
+	// still change the status.
+	mw := &manifestWriter{w: w, commit: res.CommitSHA, short: res.ShortSHA}
+	if _, err := s.store.ArchiveManifest(mw, res.Path, s.manifestLimits); err != nil {
+		if mw.started {
+			s.logf("repo manifest write error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+			return
+		}
+		s.logf("repo manifest error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		jsonError(w, "manifest", err)
+		return
+	}
+	s.logf("repo manifest ok user=%s repo=%s branch=%s\n", user, repo, branch)
+}
+
+// manifestWriter sets the response headers on the first write.
+type manifestWriter struct {
+	w       http.ResponseWriter
+	commit  string
+	short   string
+	started bool
+}
+
+func (m *manifestWriter) Write(p []byte) (int, error) {
+	if !m.started {
+		m.started = true
+		m.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		setCommitHeaders(m.w, m.commit, m.short)
+	}
+	return m.w.Write(p)
+}
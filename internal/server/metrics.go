@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+)
+
+// requestMetrics holds the HTTP-level metric families. A nil *requestMetrics
+// disables instrumentation entirely, so embedders that never call SetMetrics
+// pay nothing.
+type requestMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	ttfb     *metrics.HistogramVec
+	// revalidations counts background revalidations by result.
+	revalidations *metrics.CounterVec
+	// inflight counts the requests in flight per route.
+	inflight *metrics.GaugeVec
+}
+
+// countersSource is implemented by stores that expose storage-level counters.
+type countersSource interface {
+	Counters() storage.Counters
+}
+
+// breakerSource is implemented by stores with a GitHub rate limit breaker.
+type breakerSource interface {
+	BreakerOpen() bool
+}
+
+// SetMetrics enables request instrumentation and the /metrics endpoint. It
+// must be called before RegisterRoutes.
+func (s *Server) SetMetrics(reg *metrics.Registry) {
+	if reg == nil {
+		s.metrics = nil
+		return
+	}
+	labels := []string{"method", "route", "status", "cache"}
+	s.metrics = &requestMetrics{
+		registry: reg,
+		requests: reg.Counter("ghh_http_requests_total", "HTTP requests handled.", labels...),
+		latency:  reg.Histogram("ghh_http_request_duration_seconds", "Time until the handler returned.", nil, labels...),
+		ttfb:     reg.Histogram("ghh_http_time_to_first_byte_seconds", "Time until the response header was written.", nil, labels...),
+
+		revalidations: reg.Counter("ghh_revalidations_total", "Background branch revalidations by result.", "result"),
+		inflight:      reg.Gauge("ghh_http_inflight_route_requests", "HTTP requests in flight per route.", "route"),
+	}
+	reg.GaugeFunc("ghh_http_inflight_requests", "HTTP requests in flight on the API.", func() float64 { return float64(s.inflight.count()) })
+	if src, ok := s.store.(countersSource); ok {
+		counter := func(name, help string, get func(storage.Counters) int64) {
+			reg.CounterFunc(name, help, func() float64 { return float64(get(src.Counters())) })
+		}
+		counter("ghh_storage_cache_hits_total", "Archive/package requests served from cache.", func(c storage.Counters) int64 { return c.CacheHits })
+		counter("ghh_storage_cache_misses_total", "Archive/package requests that required fetching.", func(c storage.Counters) int64 { return c.CacheMisses })
+		counter("ghh_storage_downloads_total", "Upstream downloads started.", func(c storage.Counters) int64 { return c.Downloads })
+		counter("ghh_storage_download_failures_total", "Upstream downloads that failed after retries.", func(c storage.Counters) int64 { return c.DownloadFailures })
+		counter("ghh_storage_downloaded_bytes_total", "Bytes fetched from upstream.", func(c storage.Counters) int64 { return c.DownloadedBytes })
+		counter("ghh_storage_collapsed_lookups_total", "Default-branch and branch-SHA lookups that shared another request's GitHub call.", func(c storage.Counters) int64 { return c.CollapsedLookups })
+		counter("ghh_storage_skipped_revalidations_total", "Archives served within the request's max_age without a branch-SHA lookup.", func(c storage.Counters) int64 { return c.SkippedRevalidations })
+		counter("ghh_upstream_dials_total", "Connections opened to GitHub and package hosts.", func(c storage.Counters) int64 { return c.UpstreamDials })
+		counter("ghh_upstream_reused_connections_total", "Upstream requests served on a pooled connection.", func(c storage.Counters) int64 { return c.UpstreamReusedConns })
+		counter("ghh_upstream_slow_downloads_total", "Upstream downloads slower than the slow-download threshold.", func(c storage.Counters) int64 { return c.SlowDownloads })
+	}
+	if src, ok := s.store.(breakerSource); ok {
+		reg.GaugeFunc("ghh_github_breaker_open", "1 while a GitHub secondary rate limit breaker is open or half-open.", func() float64 {
+			if src.BreakerOpen() {
+				return 1
+			}
+			return 0
+		})
+	}
+	if src, ok := s.store.(circuitSource); ok {
+		reg.GaugeFunc("ghh_upstream_circuit_open", "1 while the upstream circuit is open or half-open.", func() float64 {
+			if src.UpstreamCircuit().State != storage.BreakerClosed {
+				return 1
+			}
+			return 0
+		})
+		reg.GaugeFunc("ghh_upstream_circuit_consecutive_failures", "GitHub calls failed in a row.", func() float64 { return float64(src.UpstreamCircuit().ConsecutiveFailures) })
+		reg.CounterFunc("ghh_upstream_circuit_failures_total", "GitHub calls that got no answer or a 5xx.", func() float64 { return float64(src.UpstreamCircuit().Failures) })
+		reg.CounterFunc("ghh_upstream_circuit_rejected_total", "GitHub calls refused while the upstream circuit was open.", func() float64 { return float64(src.UpstreamCircuit().Rejected) })
+		reg.CounterFunc("ghh_upstream_circuit_trips_total", "Times the upstream circuit opened.", func() float64 { return float64(src.UpstreamCircuit().Trips) })
+	}
+	s.observeDownloads(reg)
+	s.observeUsage(reg)
+}
+
+// observation carries labels that handlers fill in while serving.
+type observation struct {
+	cache storage.CacheOutcome
+}
+
+type observationKey struct{}
+
+// setCacheLabel lets a handler report the cache outcome it got from storage
+// so the metrics middleware can split latency by hit/miss.
+func setCacheLabel(r *http.Request, o storage.CacheOutcome) {
+	if obs, ok := r.Context().Value(observationKey{}).(*observation); ok {
+		obs.cache = o
+	}
+}
+
+// cacheHeader is the X-GHH-Cache value of an outcome: hit, revalidated or
+// miss. Stale archives were served without confirmation, so they count as
+// hits; X-GHH-Stale says why.
+func cacheHeader(o storage.CacheOutcome) string {
+	switch o {
+	case storage.CacheHit, storage.CacheStale:
+		return string(storage.CacheHit)
+	case storage.CacheRevalidated, storage.CacheMiss:
+		return string(o)
+	}
+	return ""
+}
+
+// setCacheHeader sets X-GHH-Cache when the outcome is known.
+func setCacheHeader(w http.ResponseWriter, o storage.CacheOutcome) {
+	if v := cacheHeader(o); v != "" {
+		w.Header().Set("X-GHH-Cache", v)
+	}
+}
+
+// instrument wraps h with per-route counters and latency histograms.
+func (s *Server) instrument(route string, h http.Handler) http.Handler {
+	m := s.metrics
+	if m == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		obs := &observation{}
+		rec := &metricsRecorder{ResponseWriter: w, start: start}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), observationKey{}, obs)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+			rec.firstByte = time.Since(start)
+		}
+		labels := []string{r.Method, route, statusClass(rec.status), string(obs.cache)}
+		m.requests.Inc(labels...)
+		m.latency.Observe(time.Since(start).Seconds(), labels...)
+		m.ttfb.Observe(rec.firstByte.Seconds(), labels...)
+	})
+}
+
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+type metricsRecorder struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	firstByte time.Duration
+}
+
+func (r *metricsRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.firstByte = time.Since(r.start)
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *metricsRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps http.ServeContent's sendfile path intact.
+func (r *metricsRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	return readFrom(r.ResponseWriter, src)
+}
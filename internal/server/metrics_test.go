@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+)
+
+func TestMetrics_DownloadLabelledByCacheOutcome(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, outcome: storage.CacheHit}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetMetrics(metrics.NewRegistry())
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	out := string(body)
+	for _, want := range []string{
+		`ghh_http_requests_total{method="GET",route="/api/v1/download",status="2xx",cache="hit"} 1`,
+		`ghh_http_request_duration_seconds_count{method="GET",route="/api/v1/download",status="2xx",cache="hit"} 1`,
+		`ghh_http_time_to_first_byte_seconds_bucket{method="GET",route="/api/v1/download",status="2xx",cache="hit",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("metrics output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetrics_DisabledByDefault(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rr.Body.String(), "ghh_http_requests_total") {
+		t.Fatalf("metrics exposed without SetMetrics")
+	}
+}
@@ -0,0 +1,449 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMirrorInterval = time.Hour
+	mirrorTick            = 5 * time.Second
+)
+
+// MirrorEntry is one repo the hub keeps fresh. Branch may be any ref
+// EnsureRepo accepts; empty means the default branch.
+type MirrorEntry struct {
+	Repo            string `json:"repo"`
+	Branch          string `json:"branch,omitempty"`
+	User            string `json:"user,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"` // e.g. "15m"; default 1h
+	Legacy          bool   `json:"legacy,omitempty"`
+}
+
+// MirrorManifest is the declarative set of mirrored repos, loaded from the
+// mirror_manifest file or POST /api/v1/mirror.
+type MirrorManifest struct {
+	Entries []MirrorEntry `json:"entries"`
+}
+
+// MirrorStatus reports the reconciliation state of one entry.
+type MirrorStatus struct {
+	MirrorEntry
+	SHA         string    `json:"sha,omitempty"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	NextRun     time.Time `json:"next_run"`
+	// RemovedAt is set for entries dropped from the manifest whose archive
+	// is waiting for garbage collection.
+	RemovedAt time.Time `json:"removed_at"`
+}
+
+type mirrorState struct {
+	status   MirrorStatus
+	interval time.Duration
+	zipPath  string
+	force    bool
+}
+
+// mirror reconciles the manifest: each entry is ensured on its interval (or
+// at once, forced, after a webhook hint), and archives of entries removed
+// from the manifest are deleted once gcAfter has passed.
+type mirror struct {
+	s       *Server
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	gcAfter time.Duration
+	entries map[string]*mirrorState
+	removed map[string]*mirrorState
+	running bool
+}
+
+func newMirror(s *Server) *mirror {
+	return &mirror{s: s, entries: make(map[string]*mirrorState), removed: make(map[string]*mirrorState)}
+}
+
+func mirrorKey(e MirrorEntry) string {
+	return e.User + "|" + strings.ToLower(e.Repo) + "|" + e.Branch
+}
+
+// normalize validates e and fills defaults.
+func (m *mirror) normalize(e MirrorEntry) (MirrorEntry, time.Duration, error) {
+	e.Repo = strings.Trim(strings.TrimSpace(e.Repo), "/")
+	e.Branch = strings.TrimSpace(e.Branch)
+	if strings.TrimSpace(e.User) == "" {
+		e.User = m.s.defaultUser
+	}
+	e.User = sanitizeUser(e.User)
+	if strings.Count(e.Repo, "/") != 1 || strings.Contains(e.Repo, "..") {
+		return e, 0, fmt.Errorf("mirror entry repo must be owner/repo, got %q", e.Repo)
+	}
+	interval := defaultMirrorInterval
+	if v := strings.TrimSpace(e.RefreshInterval); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return e, 0, fmt.Errorf("mirror entry %s: invalid refresh_interval %q", e.Repo, v)
+		}
+		interval = d
+	}
+	return e, interval, nil
+}
+
+// apply replaces the manifest. Entries keep their status across reloads;
+// dropped entries move to the removal list.
+func (m *mirror) apply(man MirrorManifest) error {
+	next := make(map[string]*mirrorState, len(man.Entries))
+	for _, raw := range man.Entries {
+		e, interval, err := m.normalize(raw)
+		if err != nil {
+			return err
+		}
+		next[mirrorKey(e)] = &mirrorState{status: MirrorStatus{MirrorEntry: e}, interval: interval}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, st := range next {
+		if old, ok := m.entries[key]; ok {
+			st.status.SHA, st.status.LastSuccess = old.status.SHA, old.status.LastSuccess
+			st.status.LastError, st.status.LastErrorAt = old.status.LastError, old.status.LastErrorAt
+			st.status.NextRun, st.zipPath = old.status.NextRun, old.zipPath
+		} else if old, ok := m.removed[key]; ok {
+			st.status.SHA, st.status.LastSuccess, st.zipPath = old.status.SHA, old.status.LastSuccess, old.zipPath
+		}
+		delete(m.removed, key)
+	}
+	for key, old := range m.entries {
+		if _, ok := next[key]; !ok && old.zipPath != "" {
+			old.status.RemovedAt = now
+			m.removed[key] = old
+		}
+	}
+	m.entries = next
+	return nil
+}
+
+// loadMirrorManifest reads a JSON manifest file; both {"entries":[...]} and a bare array
+// are accepted.
+func loadMirrorManifest(path string) (MirrorManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return MirrorManifest{}, err
+	}
+	return parseMirrorManifest(b)
+}
+
+func parseMirrorManifest(b []byte) (MirrorManifest, error) {
+	var man MirrorManifest
+	trimmed := strings.TrimSpace(string(b))
+	if strings.HasPrefix(trimmed, "[") {
+		err := json.Unmarshal(b, &man.Entries)
+		return man, err
+	}
+	err := json.Unmarshal(b, &man)
+	return man, err
+}
+
+// SetMirror loads the manifest at path (empty: manifest only via the API)
+// and starts the reconcile loop. gcAfter > 0 deletes the archives of removed
+// entries after that grace period.
+func (s *Server) SetMirror(path string, gcAfter time.Duration) error {
+	m := s.mirror
+	m.mu.Lock()
+	m.path, m.gcAfter = path, gcAfter
+	m.mu.Unlock()
+	if path != "" {
+		man, err := loadMirrorManifest(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("mirror manifest: %w", err)
+		}
+		if err := m.apply(man); err != nil {
+			return err
+		}
+		if fi, err := os.Stat(path); err == nil {
+			m.mu.Lock()
+			m.modTime = fi.ModTime()
+			m.mu.Unlock()
+		}
+	}
+	m.start()
+	return nil
+}
+
+func (m *mirror) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return
+	}
+	m.running = true
+	go m.run()
+}
+
+func (m *mirror) run() {
+	ticker := time.NewTicker(mirrorTick)
+	defer ticker.Stop()
+	for {
+		m.reloadIfChanged()
+		m.reconcile(m.s.janitorCtx, time.Now())
+		select {
+		case <-m.s.janitorCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reloadIfChanged picks up edits to the manifest file.
+func (m *mirror) reloadIfChanged() {
+	m.mu.Lock()
+	path, last := m.path, m.modTime
+	m.mu.Unlock()
+	if path == "" {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.ModTime().Equal(last) {
+		return
+	}
+	man, err := loadMirrorManifest(path)
+	if err == nil {
+		err = m.apply(man)
+	}
+	if err != nil {
+		m.s.logf("mirror manifest reload failed: %v\n", err)
+		return
+	}
+	m.mu.Lock()
+	m.modTime = fi.ModTime()
+	m.mu.Unlock()
+	m.s.logf("mirror manifest reloaded from %s\n", path)
+}
+
+// reconcile refreshes due entries one at a time and collects removed ones.
+func (m *mirror) reconcile(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	var due []*mirrorState
+	for _, st := range m.entries {
+		if st.force || !st.status.NextRun.After(now) {
+			due = append(due, st)
+		}
+	}
+	var gc []string
+	if m.gcAfter > 0 {
+		for key, st := range m.removed {
+			if now.Sub(st.status.RemovedAt) >= m.gcAfter {
+				gc = append(gc, key)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, st := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		m.refresh(ctx, st)
+	}
+	for _, key := range gc {
+		m.mu.Lock()
+		st, ok := m.removed[key]
+		delete(m.removed, key)
+		m.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := m.s.store.RemoveArchive(st.zipPath); err != nil {
+			m.s.logf("mirror gc error repo=%s branch=%s err=%v\n", st.status.Repo, st.status.Branch, err)
+			continue
+		}
+		m.s.logf("mirror gc removed %s (dropped from manifest)\n", st.zipPath)
+	}
+}
+
+func (m *mirror) refresh(ctx context.Context, st *mirrorState) {
+	m.mu.Lock()
+	e, force := st.status.MirrorEntry, st.force
+	st.force = false
+	m.mu.Unlock()
+
+	ctx, cancel := m.s.downloadContext(ctx)
+	defer cancel()
+	res, err := m.s.store.EnsureRepoResult(ctx, e.User, e.Repo, e.Branch, m.s.fallbackToken(), force, e.Legacy)
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st.status.NextRun = now.Add(st.interval)
+	if err != nil {
+		err = redactToken(err, m.s.fallbackToken())
+		st.status.LastError, st.status.LastErrorAt = err.Error(), now
+		m.s.logf("mirror refresh error user=%s repo=%s branch=%s err=%v\n", e.User, e.Repo, e.Branch, err)
+		return
+	}
+	st.zipPath = res.Path
+	st.status.SHA, st.status.LastSuccess, st.status.LastError = res.CommitSHA, now, ""
+}
+
+// hint forces a refresh of every entry for repo (and branch, when given).
+func (m *mirror) hint(repo, branch string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, st := range m.entries {
+		if strings.EqualFold(st.status.Repo, repo) && (branch == "" || st.status.Branch == branch) {
+			st.force = true
+			n++
+		}
+	}
+	return n
+}
+
+func (m *mirror) statuses() []MirrorStatus {
+	m.mu.Lock()
+	out := make([]MirrorStatus, 0, len(m.entries)+len(m.removed))
+	for _, st := range m.entries {
+		out = append(out, st.status)
+	}
+	for _, st := range m.removed {
+		out = append(out, st.status)
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return mirrorKey(out[i].MirrorEntry) < mirrorKey(out[j].MirrorEntry) })
+	return out
+}
+
+// handleMirror returns (GET) or replaces (POST, admin) the manifest. A
+// posted manifest is written back to the manifest file when one is set.
+func (s *Server) handleMirror(w http.ResponseWriter, r *http.Request) {
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var man MirrorManifest
+		for _, st := range s.mirror.statuses() {
+			if st.RemovedAt.IsZero() {
+				man.Entries = append(man.Entries, st.MirrorEntry)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(man)
+	case http.MethodPost, http.MethodPut:
+		if !p.Admin {
+			fail(w, r, http.StatusForbidden, "mirror manifest requires an admin key")
+			return
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, "read body")
+			return
+		}
+		man, err := parseMirrorManifest(b)
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, "invalid manifest: "+err.Error())
+			return
+		}
+		if err := s.mirror.apply(man); err != nil {
+			fail(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.mirror.save(man); err != nil {
+			s.logf("mirror manifest save error: %v\n", err)
+		}
+		s.mirror.start()
+		s.logf("mirror manifest updated entries=%d\n", len(man.Entries))
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "ok")
+	default:
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// save persists a posted manifest so it survives restarts.
+func (m *mirror) save(man MirrorManifest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(m.path); err == nil {
+		m.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// handleMirrorStatus reports each entry's last success, last error and SHA.
+func (s *Server) handleMirrorStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, _, ok := s.scope(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(s.mirror.statuses())
+}
+
+// handleMirrorHook force-refreshes mirrored entries. It takes repo= and
+// optional branch=, or a GitHub push event body (repository.full_name and
+// ref refs/heads/<branch>).
+func (s *Server) handleMirrorHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "mirror hooks require an admin key")
+		return
+	}
+	repo := repoArg(r.URL.Query().Get("repo"))
+	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
+	if repo == "" {
+		var push struct {
+			Ref        string `json:"ref"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&push); err != nil || push.Repository.FullName == "" {
+			fail(w, r, http.StatusBadRequest, "missing repo")
+			return
+		}
+		repo = push.Repository.FullName
+		branch = strings.TrimPrefix(push.Ref, "refs/heads/")
+	}
+	if !refParam(w, r, branch) {
+		return
+	}
+	n := s.mirror.hint(repo, branch)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]int{"scheduled": n})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestMirrorReconcile(t *testing.T) {
+	fs := &fakeStore{ensurePath: "/cache/users/ci/repos/o/r/main.zip", ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123"}}
+	s := NewServerWithStore(fs, "", "ci")
+	defer s.Shutdown()
+	m := s.mirror
+	m.gcAfter = time.Hour
+	ctx := context.Background()
+
+	if err := m.apply(MirrorManifest{Entries: []MirrorEntry{{Repo: "o/r", Branch: "main", RefreshInterval: "10m"}}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m.reconcile(ctx, now)
+	st := m.statuses()
+	if len(st) != 1 || st[0].User != "ci" || st[0].SHA != "abc123" || st[0].LastSuccess.IsZero() || fs.lastForce {
+		t.Fatalf("after first run %+v force=%v", st, fs.lastForce)
+	}
+
+	// Not due yet: nothing runs until a hint forces it.
+	fs.lastRepo = ""
+	m.reconcile(ctx, now.Add(time.Minute))
+	if fs.lastRepo != "" {
+		t.Fatal("entry refreshed before its interval")
+	}
+	if n := m.hint("O/R", "main"); n != 1 {
+		t.Fatalf("hint matched %d entries", n)
+	}
+	m.reconcile(ctx, now.Add(time.Minute))
+	if fs.lastRepo != "o/r" || !fs.lastForce {
+		t.Fatalf("hint did not force a refresh: repo=%q force=%v", fs.lastRepo, fs.lastForce)
+	}
+
+	fs.ensureErr = errors.New("boom")
+	m.reconcile(ctx, now.Add(time.Hour))
+	if st := m.statuses(); st[0].LastError == "" || st[0].SHA != "abc123" {
+		t.Fatalf("error not recorded: %+v", st[0])
+	}
+
+	// Dropped entries are collected only after the grace period.
+	if err := m.apply(MirrorManifest{}); err != nil {
+		t.Fatal(err)
+	}
+	if st := m.statuses(); len(st) != 1 || st[0].RemovedAt.IsZero() {
+		t.Fatalf("removed entry not reported: %+v", st)
+	}
+	m.reconcile(ctx, time.Now().Add(time.Minute))
+	if len(fs.removed) != 0 {
+		t.Fatal("archive collected before grace period")
+	}
+	m.reconcile(ctx, time.Now().Add(2*time.Hour))
+	if len(fs.removed) != 1 || fs.removed[0] != fs.ensurePath || len(m.statuses()) != 0 {
+		t.Fatalf("gc removed %v, statuses %+v", fs.removed, m.statuses())
+	}
+}
+
+func TestMirrorHandlers(t *testing.T) {
+	fs := &fakeStore{ensurePath: "/cache/main.zip"}
+	s := NewServerWithStore(fs, "", "default")
+	defer s.Shutdown()
+	manifest := filepath.Join(t.TempDir(), "mirror.json")
+	if err := s.SetMirror(manifest, 0); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/mirror", "application/json", strings.NewReader(`[{"repo":"o/r","branch":"dev"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post status=%d", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(manifest); err != nil || !strings.Contains(string(b), `"o/r"`) {
+		t.Fatalf("manifest not saved: %s %v", b, err)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/v1/mirror", "application/json", strings.NewReader(`[{"repo":"bad"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid manifest status=%d", resp.StatusCode)
+	}
+
+	push := `{"ref":"refs/heads/dev","repository":{"full_name":"o/r"}}`
+	resp, err = http.Post(ts.URL+"/api/v1/mirror/hook", "application/json", strings.NewReader(push))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("hook status=%d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/mirror/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("status endpoint status=%d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// archiveFormat is what a download answers with.
+type archiveFormat string
+
+const (
+	// formatZip is the cached archive itself, the default.
+	formatZip archiveFormat = "zip"
+	// formatTarball converts it to a gzipped tar on the fly.
+	formatTarball archiveFormat = "tar.gz"
+	// formatInfo answers the repo-info document instead of the bytes.
+	formatInfo archiveFormat = "json"
+)
+
+// tarballStore is implemented by stores that can convert archives to
+// tarballs (see storage.Storage.TarballArchive).
+type tarballStore interface {
+	TarballArchive(w io.Writer, zipPath string, root storage.RootMode) (int64, error)
+}
+
+// formatOffer is a media type a download can answer with, in the order the
+// server prefers them when the client likes several equally.
+type formatOffer struct {
+	mediaType string
+	format    archiveFormat
+}
+
+var formatOffers = []formatOffer{
+	{"application/zip", formatZip},
+	// Generic byte clients get the default archive.
+	{"application/octet-stream", formatZip},
+	{"application/gzip", formatTarball},
+	{"application/x-gtar", formatTarball},
+	{"application/x-gzip", formatTarball},
+	{"application/json", formatInfo},
+}
+
+// mediaRange is one element of an Accept header.
+type mediaRange struct {
+	typ, sub string
+	q        float64
+}
+
+// parseAccept parses an Accept header into its media ranges. Elements that
+// are not type/subtype, or whose q is not a number between 0 and 1, are
+// ignored.
+func parseAccept(h string) []mediaRange {
+	var out []mediaRange
+	for _, part := range strings.Split(h, ",") {
+		params := strings.Split(part, ";")
+		typ, sub, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || typ == "" || sub == "" || (typ == "*" && sub != "*") {
+			continue
+		}
+		mr := mediaRange{typ: strings.TrimSpace(typ), sub: strings.TrimSpace(sub), q: 1}
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || q < 0 || q > 1 {
+				ok = false
+			}
+			mr.q = q
+		}
+		if ok {
+			out = append(out, mr)
+		}
+	}
+	return out
+}
+
+// quality is the q the most specific range matching mediaType gives it,
+// 0 when none does.
+func quality(ranges []mediaRange, mediaType string) float64 {
+	typ, sub, _ := strings.Cut(mediaType, "/")
+	q, best := 0.0, -1
+	for _, mr := range ranges {
+		var specificity int
+		switch {
+		case mr.typ == typ && mr.sub == sub:
+			specificity = 2
+		case mr.typ == typ && mr.sub == "*":
+			specificity = 1
+		case mr.typ == "*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity > best {
+			q, best = mr.q, specificity
+		}
+	}
+	return q
+}
+
+// negotiateFormat picks the format of a download from accept: the offer
+// with the highest q, the server's order breaking ties. No header (or an
+// empty one) means zip; ok is false when nothing offered is acceptable.
+// Tarballs are only offered when tarballs is set.
+func negotiateFormat(accept string, tarballs bool) (archiveFormat, string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return formatZip, "application/zip", true
+	}
+	ranges := parseAccept(accept)
+	var best *formatOffer
+	bestQ := 0.0
+	for i, o := range formatOffers {
+		if o.format == formatTarball && !tarballs {
+			continue
+		}
+		if q := quality(ranges, o.mediaType); q > bestQ {
+			best, bestQ = &formatOffers[i], q
+		}
+	}
+	if best == nil {
+		return "", "", false
+	}
+	contentType := best.mediaType
+	if best.format == formatZip {
+		contentType = "application/zip"
+	}
+	return best.format, contentType, true
+}
+
+// formatParam decides what a download answers with: format= (zip, tar.gz
+// or tgz, json) when given, else the Accept header. It sets Vary: Accept,
+// and answers 400 for an unknown format=, 406 when no acceptable type is
+// offered and 501 for tarballs from a store that cannot make them.
+func (s *Server) formatParam(w http.ResponseWriter, r *http.Request) (archiveFormat, string, bool) {
+	w.Header().Add("Vary", "Accept")
+	_, tarballs := s.store.(tarballStore)
+	switch v := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))); v {
+	case "":
+	case "zip":
+		return formatZip, "application/zip", true
+	case "tar.gz", "tgz":
+		if !tarballs {
+			fail(w, r, http.StatusNotImplemented, "tarballs are not supported by this store")
+			return "", "", false
+		}
+		return formatTarball, "application/gzip", true
+	case "json":
+		return formatInfo, "application/json", true
+	default:
+		fail(w, r, http.StatusBadRequest, "format must be zip, tar.gz or json, got "+strconv.Quote(v))
+		return "", "", false
+	}
+	format, contentType, ok := negotiateFormat(r.Header.Get("Accept"), tarballs)
+	if !ok {
+		types := make([]string, 0, len(formatOffers))
+		for _, o := range formatOffers {
+			if o.format != formatTarball || tarballs {
+				types = append(types, o.mediaType)
+			}
+		}
+		fail(w, r, http.StatusNotAcceptable, "no acceptable type; downloads are available as "+strings.Join(types, ", "))
+		return "", "", false
+	}
+	return format, contentType, true
+}
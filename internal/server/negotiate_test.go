@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		tarballs bool
+		want     archiveFormat
+		wantType string
+		wantOK   bool
+	}{
+		{"no header", "", true, formatZip, "application/zip", true},
+		{"zip", "application/zip", true, formatZip, "application/zip", true},
+		{"any", "*/*", true, formatZip, "application/zip", true},
+		{"octet-stream", "application/octet-stream", true, formatZip, "application/zip", true},
+		{"gzip", "application/gzip", true, formatTarball, "application/gzip", true},
+		{"x-gtar", "application/x-gtar", true, formatTarball, "application/x-gtar", true},
+		{"json", "application/json", true, formatInfo, "application/json", true},
+		{"q prefers json", "application/zip;q=0.5, application/json", true, formatInfo, "application/json", true},
+		{"q prefers tarball", "application/json;q=0.2, application/x-gtar;q=0.9, */*;q=0.1", true, formatTarball, "application/x-gtar", true},
+		{"tie goes to zip", "application/json, application/zip", true, formatZip, "application/zip", true},
+		{"specific beats wildcard", "application/*, application/zip;q=0", true, formatZip, "application/zip", true},
+		{"refused wildcard", "*/*;q=0", true, "", "", false},
+		{"unsupported", "text/html", true, "", "", false},
+		{"invalid q ignored", "application/json;q=2, application/gzip", true, formatTarball, "application/gzip", true},
+		{"no tarball store", "application/gzip", false, "", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ct, ok := negotiateFormat(tc.accept, tc.tarballs)
+			if ok != tc.wantOK || got != tc.want {
+				t.Fatalf("negotiateFormat(%q) = %q, %v; want %q, %v", tc.accept, got, ok, tc.want, tc.wantOK)
+			}
+			if ct != tc.wantType {
+				t.Fatalf("content type %q, want %q", ct, tc.wantType)
+			}
+		})
+	}
+}
+
+func TestDownloadNegotiation(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123", SHA256: "feed"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		want     int
+		wantType string
+		body     string // prefix of the body
+	}{
+		{"default zip", "", "", http.StatusOK, "application/zip", "PK"},
+		{"accept tarball", "", "application/x-gtar", http.StatusOK, "application/x-gtar", "tarball of main.zip root="},
+		{"accept json", "", "application/json", http.StatusOK, "application/json; charset=utf-8", `{"repo":"own/repo"`},
+		{"format overrides accept", "&format=zip", "application/json", http.StatusOK, "application/zip", "PK"},
+		{"format tgz over unacceptable", "&format=tgz", "text/html", http.StatusOK, "application/gzip", "tarball of main.zip root="},
+		{"tarball with root", "&format=tar.gz&root=none", "", http.StatusOK, "application/gzip", "tarball of main.zip root=none"},
+		{"not acceptable", "", "text/html, application/xml;q=0.5", http.StatusNotAcceptable, "", ""},
+		{"unknown format", "&format=rar", "", http.StatusBadRequest, "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main"+tc.query, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.want, rec.Body.String())
+			}
+			if v := rec.Header().Values("Vary"); !containsFold(v, "Accept") {
+				t.Fatalf("Vary %q lacks Accept", v)
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tc.wantType {
+				t.Fatalf("Content-Type %q, want %q", ct, tc.wantType)
+			}
+			b, _ := io.ReadAll(rec.Body)
+			if !strings.HasPrefix(string(b), tc.body) {
+				t.Fatalf("body %.60q, want prefix %q", b, tc.body)
+			}
+			if tc.wantType != "application/zip" && rec.Header().Get("X-GHH-SHA256") != "" {
+				t.Fatalf("X-GHH-SHA256 set on a %s body", tc.wantType)
+			}
+		})
+	}
+
+	// JSON clients get the 406 as a structured error.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main", nil)
+	req.Header.Set("Accept", "application/xml, application/json;q=0")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var e errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotAcceptable || e.Error.Code != CodeNotAcceptable {
+		t.Fatalf("status %d code %q", rec.Code, e.Error.Code)
+	}
+}
+
+func containsFold(values []string, want string) bool {
+	for _, v := range values {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
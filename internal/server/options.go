@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// Option configures a Server built by New.
+type Option func(*Server)
+
+// WithDefaultUser is the namespace of requests that name no user while
+// auth is disabled (default "default").
+func WithDefaultUser(user string) Option {
+	return func(s *Server) { s.defaultUser = user }
+}
+
+// WithToken is the server's GitHub token, used for requests that bring none
+// and are not routed to another credential (see SetTokenRoutes).
+func WithToken(token string) Option {
+	return func(s *Server) { s.token = token }
+}
+
+// WithLogger receives the server's log lines: request failures, mirror,
+// revalidation, warm-up and webhook activity. The default prints them to
+// stdout unadorned; the storage layer always does.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) {
+		if l != nil {
+			s.logger = l
+		}
+	}
+}
+
+// WithAuth enables API-key authentication, as SetAuth.
+func WithAuth(keys []APIKey) Option {
+	return func(s *Server) { s.SetAuth(keys) }
+}
+
+// Limits bounds what requests may cost. Zero fields keep the defaults and
+// negative ones lift the limit.
+type Limits struct {
+	// DownloadTimeout bounds routes that may populate the cache (default
+	// 30m), MetadataTimeout the others (default 30s).
+	DownloadTimeout time.Duration
+	MetadataTimeout time.Duration
+	// UploadMax caps package uploads in bytes (default 1 GiB).
+	UploadMax int64
+	// ManifestEntries and ManifestBytes cap the archives a file manifest
+	// is built for (see SetManifestLimits).
+	ManifestEntries int
+	ManifestBytes   int64
+	// PatchBytes caps the diffs of GET /api/v1/repos/patch (see
+	// SetPatchLimit).
+	PatchBytes int64
+}
+
+// WithLimits applies the non-zero fields of l.
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		if l.DownloadTimeout != 0 {
+			s.downloadTO = l.DownloadTimeout
+		}
+		if l.MetadataTimeout != 0 {
+			s.metadataTO = l.MetadataTimeout
+		}
+		if l.UploadMax != 0 {
+			s.uploadMax = l.UploadMax
+		}
+		if l.ManifestEntries != 0 {
+			s.manifestLimits.MaxEntries = l.ManifestEntries
+		}
+		if l.ManifestBytes != 0 {
+			s.manifestLimits.MaxBytes = l.ManifestBytes
+		}
+		if l.PatchBytes != 0 {
+			s.SetPatchLimit(l.PatchBytes)
+		}
+	}
+}
+
+// withStatsFile overrides where download stats persist; "" keeps them in
+// memory.
+func withStatsFile(path string) Option {
+	return func(s *Server) { s.statsPath = &path }
+}
+
+// New creates a Server that serves from store. With the built-in
+// *storage.Storage, download stats persist under its root. Options are
+// applied in order; the Set* methods cover the rest of the configuration.
+// Call Shutdown to stop its background work.
+func New(store Store, opts ...Option) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		store:           store,
+		defaultUser:     "default",
+		downloadTO:      defaultDownloadTimeout,
+		cleanupInterval: time.Minute,
+		compressMin:     defaultCompressMin,
+		metadataTO:      defaultMetadataTimeout,
+		uploadMax:       defaultUploadMax,
+		manifestLimits:  defaultManifestLimits,
+		ttl:             24 * time.Hour,
+		logger:          log.New(os.Stdout, "", 0),
+		inflight:        newInflight(),
+		clients:         newClientUsage(time.Now()),
+		janitorCtx:      ctx,
+		janitorCancel:   cancel,
+
+		statsFlushInterval: defaultStatsFlushInterval,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	statsPath := ""
+	if st, ok := store.(*storage.Storage); ok {
+		statsPath = filepath.Join(st.Root, statsFile)
+	}
+	if s.statsPath != nil {
+		statsPath = *s.statsPath
+	}
+	s.stats = newRepoStats(statsPath, s.logf)
+	budgetsPath := ""
+	if statsPath != "" {
+		budgetsPath = filepath.Join(filepath.Dir(statsPath), budgetsFile)
+	}
+	s.budgets = newBudgets(budgetsPath, s.now, s.logf)
+	s.usage = newUsage(s.now)
+	if st, ok := store.(*storage.Storage); ok {
+		s.events = &eventTap{usage: s.usage, next: st.Events}
+		st.Events = s.events
+		prev := st.DownloadObserver
+		st.DownloadObserver = func(rec storage.DownloadRecord) {
+			s.observeDownload(rec)
+			if prev != nil {
+				prev(rec)
+			}
+		}
+	}
+	s.mirror = newMirror(s)
+	s.revalidate = newRevalidator(s)
+	s.warmup = &warmup{}
+	go s.startJanitor()
+	if st, ok := store.(*storage.Storage); ok {
+		s.touchesFlushed = make(chan struct{})
+		go s.flushTouches(st)
+	}
+	if statsPath != "" {
+		s.statsFlushed = make(chan struct{})
+		go s.flushStats()
+	}
+	return s
+}
+
+// logf writes one line to the server's logger.
+func (s *Server) logf(format string, args ...any) {
+	s.logger.Printf(format, args...)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// defaultUploadMax caps uploaded packages unless SetUploadLimit changes it.
+const defaultUploadMax = 1 << 30
+
+// multipartSlack is the form framing allowed on top of the upload limit.
+const multipartSlack = 64 << 10
+
+// SetUploadLimit sets the largest accepted package upload in bytes; 0 or
+// less removes the limit.
+func (s *Server) SetUploadLimit(n int64) {
+	s.uploadMax = n
+}
+
+// handlePackages lists the caller's cached packages (GET), most recently
+// used first or, paged with limit= and page_token=, in hash order; DELETE
+// removes the one cached for url=.
+func (s *Server) handlePackages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		_, user, ok := s.scope(w, r)
+		if !ok {
+			return
+		}
+		opts, paged, ok := listOptions(w, r)
+		if !ok {
+			return
+		}
+		var (
+			pkgs []storage.PackageMeta
+			next string
+			err  error
+		)
+		if paged {
+			pkgs, next, err = s.store.ListPackagesPage(user, opts)
+		} else {
+			pkgs, err = s.store.ListPackages(user)
+		}
+		if err != nil {
+			s.logf("list packages error user=%s err=%v\n", user, err)
+			failErr(w, r, "list packages", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if next != "" {
+			w.Header().Set("X-GHH-Next-Page", next)
+		}
+		_ = json.NewEncoder(w).Encode(pkgs)
+	case http.MethodDelete:
+		_, user, ok := s.scope(w, r)
+		if !ok {
+			return
+		}
+		pkgURL := strings.TrimSpace(r.URL.Query().Get("url"))
+		if pkgURL == "" {
+			fail(w, r, http.StatusBadRequest, "missing url")
+			return
+		}
+		if err := s.store.DeletePackage(user, pkgURL); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				fail(w, r, http.StatusNotFound, "package not cached")
+				return
+			}
+			s.logf("delete package error user=%s url=%s err=%v\n", user, pkgURL, err)
+			failErr(w, r, "delete package", err)
+			return
+		}
+		s.usage.evicted(evictManual, 1)
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.WriteString(w, "deleted"); err != nil {
+			s.logf("delete package write error user=%s url=%s err=%v\n", user, pkgURL, err)
+			return
+		}
+		s.logf("delete package ok user=%s url=%s\n", user, pkgURL)
+	default:
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handlePackageLookup reports whether url= is cached, never fetching it:
+// 200 with its metadata, or 404.
+func (s *Server) handlePackageLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	pkgURL := strings.TrimSpace(r.URL.Query().Get("url"))
+	if pkgURL == "" {
+		fail(w, r, http.StatusBadRequest, "missing url")
+		return
+	}
+	meta, err := s.store.LookupPackage(user, pkgURL)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "package not cached")
+			return
+		}
+		failErr(w, r, "lookup package", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+// handlePackageUpload stores the request body (raw with X-Filename, or the
+// first file of a multipart form) as a package under a synthetic
+// upload:// URL that /api/v1/download/package then serves from cache. The
+// key defaults to the file name; key= names it explicitly, and a key ending
+// in "/" is a prefix for the file name. Only authenticated
+// callers may upload, and replacing an existing key needs overwrite=true.
+func (s *Server) handlePackageUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Authenticated {
+		fail(w, r, http.StatusUnauthorized, "uploads require an api key")
+		return
+	}
+	overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	multipartBody := mt == "multipart/form-data"
+	if s.uploadMax > 0 {
+		// Storage enforces the exact limit on the file itself; this stops
+		// reading early, leaving room for multipart framing.
+		limit := s.uploadMax
+		if multipartBody {
+			limit += multipartSlack
+		}
+		if r.ContentLength > limit {
+			fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", s.uploadMax))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit+1)
+	}
+
+	var body io.Reader = r.Body
+	filename := strings.TrimSpace(r.Header.Get("X-Filename"))
+	if multipartBody {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				fail(w, r, http.StatusBadRequest, "multipart body has no file")
+				return
+			}
+			if part.FileName() != "" {
+				body = part
+				if filename == "" {
+					filename = part.FileName()
+				}
+				break
+			}
+		}
+	}
+	key := strings.TrimSpace(r.URL.Query().Get("key"))
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += filename
+	}
+	if key == "" {
+		fail(w, r, http.StatusBadRequest, "missing X-Filename or key")
+		return
+	}
+
+	meta, err := s.store.StorePackage(user, key, body, s.uploadMax, overwrite)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			err = fmt.Errorf("limit is %d bytes: %w", s.uploadMax, storage.ErrTooLarge)
+		}
+		s.logf("package upload error user=%s key=%s err=%v\n", user, key, err)
+		failErr(w, r, "upload package", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(meta)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// SetPatchLimit caps the diffs GET /api/v1/repos/patch serves, in bytes;
+// 0 or less means storage.DefaultPatchMaxBytes. Larger diffs answer 413.
+func (s *Server) SetPatchLimit(n int64) {
+	s.patchMax = max(n, 0)
+}
+
+// handleRepoPatch serves the unified diff of a repo between two commits as
+// text/x-patch, for clients that applied the archive at from and want to
+// move to to (the cached head of branch when omitted). The diff is built
+// before anything is written, so oversized ones still answer 413.
+func (s *Server) handleRepoPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	branch := strings.TrimSpace(q.Get("branch"))
+	from, to := strings.TrimSpace(q.Get("from")), strings.TrimSpace(q.Get("to"))
+	if repo == "" || from == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo/from")
+		return
+	}
+	if !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+	p, err := s.store.Patch(ctx, user, repo, branch, from, to, token, s.patchMax)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("repo patch error user=%s repo=%s from=%s to=%s err=%v\n", user, repo, from, to, err)
+		jsonError(w, "patch", err)
+		return
+	}
+	name := fmt.Sprintf("%s-%s..%s.patch", path.Base(p.Repo), abbrev(p.From), abbrev(p.To))
+	w.Header().Set("Content-Type", "text/x-patch; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.Body)))
+	w.Header().Set("X-GHH-Patch-From", p.From)
+	w.Header().Set("X-GHH-Patch-To", p.To)
+	w.Header().Set("X-GHH-Patch-Source", p.Source)
+	s.logf("repo patch ok user=%s repo=%s from=%s to=%s source=%s bytes=%d\n", user, repo, p.From, p.To, p.Source, len(p.Body))
+	_, _ = w.Write(p.Body)
+}
+
+// abbrev shortens a commit for a file name.
+func abbrev(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestRepoPatch(t *testing.T) {
+	body := "diff --git a/README b/README\n--- a/README\n+++ b/README\n@@ -1 +1 @@\n-v1\n+v2\n"
+	tests := []struct {
+		name     string
+		query    string
+		err      error
+		wantCode int
+		wantErr  string
+		wantTo   string
+	}{
+		{name: "to defaults to the cached head", query: "repo=own/repo&branch=main&from=abc1234", wantCode: http.StatusOK, wantTo: "def5678"},
+		{name: "explicit to", query: "repo=own/repo&branch=main&from=abc1234&to=0123456", wantCode: http.StatusOK, wantTo: "0123456"},
+		{name: "missing from", query: "repo=own/repo&branch=main", wantCode: http.StatusBadRequest, wantErr: CodeBadRequest},
+		{name: "unknown from", query: "repo=own/repo&from=abc1234", err: fmt.Errorf("compare: commit %w", storage.ErrNotFound), wantCode: http.StatusNotFound, wantErr: CodeNotFound},
+		{name: "too large", query: "repo=own/repo&from=abc1234", err: fmt.Errorf("patch is over 10 bytes; download the full archive instead: %w", storage.ErrTooLarge), wantCode: http.StatusRequestEntityTooLarge, wantErr: CodeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStore{ensureErr: tt.err, patch: &storage.Patch{To: "def5678", Source: storage.PatchFromCache, Body: []byte(body)}}
+			s := NewServerWithStore(fs, "", "default")
+			s.SetPatchLimit(4096)
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/patch?"+tt.query, nil))
+			if rr.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%s)", rr.Code, tt.wantCode, rr.Body.String())
+			}
+			if tt.wantErr != "" {
+				if got := rr.Header().Get("X-GHH-Error-Code"); got != tt.wantErr {
+					t.Fatalf("error code = %q, want %q", got, tt.wantErr)
+				}
+				return
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "text/x-patch; charset=utf-8" {
+				t.Fatalf("Content-Type = %q", ct)
+			}
+			if got := rr.Header().Get("X-GHH-Patch-To"); got != tt.wantTo {
+				t.Fatalf("X-GHH-Patch-To = %q, want %q", got, tt.wantTo)
+			}
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="repo-abc1234..`+tt.wantTo+`.patch"` {
+				t.Fatalf("Content-Disposition = %q", got)
+			}
+			if rr.Body.String() != body || fs.lastPatchMax != 4096 || fs.lastRepo != "own/repo" {
+				t.Fatalf("body=%q max=%d repo=%s", rr.Body.String(), fs.lastPatchMax, fs.lastRepo)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// archivePinner is implemented by stores that can protect archives from
+// cleanup.
+type archivePinner interface {
+	Pin(rel string) (*storage.ArchiveMeta, error)
+	Unpin(rel string) (*storage.ArchiveMeta, error)
+	ProtectedUsage() storage.ProtectedUsage
+}
+
+// handlePin protects the archive at path= from expiry, retention and
+// low-space eviction. Users may pin archives in their own namespace;
+// shared archives and other users' need an admin key.
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	s.protectArchive(w, r, true)
+}
+
+// handleUnpin lifts what handlePin set, with the same permissions.
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	s.protectArchive(w, r, false)
+}
+
+func (s *Server) protectArchive(w http.ResponseWriter, r *http.Request, on bool) {
+	if r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	pinner, ok := s.store.(archivePinner)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "pinning is not supported by this store")
+		return
+	}
+	rel := r.URL.Query().Get("path")
+	if strings.TrimSpace(rel) == "" || badRel(rel) {
+		fail(w, r, http.StatusBadRequest, "bad path")
+		return
+	}
+	cleanRel := strings.TrimLeft(filepath.ToSlash(rel), "./")
+	if !strings.HasPrefix(cleanRel, "users/") && !isSharedRel(cleanRel) {
+		cleanRel = s.userPath(user, cleanRel)
+	}
+	if err := authorizePath(p, user, cleanRel, true); err != nil {
+		fail(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	op := "unpin"
+	pin := pinner.Unpin
+	if on {
+		op, pin = "pin", pinner.Pin
+	}
+	meta, err := pin(cleanRel)
+	if err != nil {
+		s.logf("%s error user=%s path=%s err=%v\n", op, user, cleanRel, err)
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, op+": "+err.Error())
+			return
+		}
+		failErr(w, r, op, err)
+		return
+	}
+	s.logf("%s ok user=%s path=%s\n", op, user, cleanRel)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(struct {
+		Path      string `json:"path"`
+		Protected bool   `json:"protected"`
+	}{cleanRel, meta.Protected})
+}
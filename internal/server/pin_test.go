@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestPinEndpoints(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	for _, user := range []string{"alice", "bob"} {
+		zipPath := filepath.Join(root, "users", user, "repos", "own", "repo", "v1.zip")
+		if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(zipPath, []byte("zip-bytes"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(filepath.Dir(zipPath), "v1.meta.json"), []byte(`{"repo":"own/repo","branch":"v1","size":9}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		key       string
+		want      int
+		protected bool
+	}{
+		{"own archive", http.MethodPost, "/api/v1/cache/pin?path=repos/own/repo/v1.zip", "alice-key", http.StatusOK, true},
+		{"other user", http.MethodPost, "/api/v1/cache/pin?path=users/bob/repos/own/repo/v1.zip", "alice-key", http.StatusForbidden, false},
+		{"admin", http.MethodPost, "/api/v1/cache/pin?path=users/bob/repos/own/repo/v1.zip", "root-key", http.StatusOK, true},
+		{"missing", http.MethodPost, "/api/v1/cache/pin?path=repos/own/repo/v2.zip", "alice-key", http.StatusNotFound, false},
+		{"not an archive", http.MethodPost, "/api/v1/cache/pin?path=repos/own/repo", "alice-key", http.StatusBadRequest, false},
+		{"bad method", http.MethodGet, "/api/v1/cache/pin?path=repos/own/repo/v1.zip", "alice-key", http.StatusMethodNotAllowed, false},
+		{"unpin", http.MethodPost, "/api/v1/cache/unpin?path=repos/own/repo/v1.zip", "alice-key", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		req.Header.Set("X-GHH-Api-Key", tt.key)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var got struct {
+			Protected bool `json:"protected"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Protected != tt.protected {
+			t.Fatalf("%s: protected = %v", tt.name, got.Protected)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stats/summary", nil)
+	req.Header.Set("X-GHH-Api-Key", "root-key")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var sum usageSummary
+	if err := json.NewDecoder(rec.Body).Decode(&sum); err != nil {
+		t.Fatal(err)
+	}
+	if want := (storage.ProtectedUsage{Archives: 1, Bytes: 9}); sum.Protected == nil || *sum.Protected != want {
+		t.Fatalf("summary protected = %+v", sum.Protected)
+	}
+}
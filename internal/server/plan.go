@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github-hub/internal/storage"
+)
+
+// planConcurrency is how many items of one plan request are checked
+// against GitHub at once.
+const planConcurrency = 4
+
+// repoPlanner is implemented by stores that can tell what EnsureRepo would
+// do without doing it.
+type repoPlanner interface {
+	PlanRepo(ctx context.Context, user, ownerRepo, branch, token string, legacy, checkRemote bool) (*storage.RepoPlan, error)
+}
+
+// planItem is one entry of a plan items array. Legacy of the request
+// applies to every item as well.
+type planItem struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	Legacy bool   `json:"legacy"`
+}
+
+// planItemResult is the plan of one item, in request order. RemoteSkipped
+// is set when check=remote was asked but GitHub was rate limiting, so the
+// plan only reflects the cache.
+type planItemResult struct {
+	Repo          string            `json:"repo"`
+	Branch        string            `json:"branch"`
+	Status        int               `json:"status"`
+	Plan          *storage.RepoPlan `json:"plan,omitempty"`
+	RemoteSkipped bool              `json:"remote_skipped,omitempty"`
+	Error         *itemError        `json:"error,omitempty"`
+}
+
+func (res *planItemResult) fail(status int, code, msg string) {
+	res.Status = status
+	res.Error = &itemError{Code: code, Message: msg}
+}
+
+// handlePlan answers what a download of repo@branch would do: serve the
+// cache as is (hit), ask GitHub first (revalidate) or fetch a new archive
+// (download). Only the cache is consulted unless check=remote, which adds
+// the commit lookup a revalidation makes; nothing is downloaded and no
+// archive's access time is touched. GET plans one branch from repo=,
+// branch= (or pr=) and legacy=; POST plans a JSON {"items": [...]} list,
+// with the remote checks run concurrently until GitHub rate limits them.
+// max_age= and prerelease= mean what they mean for downloads.
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	planner, ok := s.store.(repoPlanner)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "plans are not supported by this store")
+		return
+	}
+	q := r.URL.Query()
+	var checkRemote bool
+	switch v := strings.TrimSpace(q.Get("check")); v {
+	case "", "local":
+	case "remote":
+		checkRemote = true
+	default:
+		fail(w, r, http.StatusBadRequest, "check must be local or remote, got "+strconv.Quote(v))
+		return
+	}
+	legacy, _ := strconv.ParseBool(q.Get("legacy"))
+	maxAge, ok := maxAgeParam(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	if maxAge > 0 {
+		ctx = storage.WithMaxAge(ctx, maxAge)
+	}
+	if prereleaseParam(r) {
+		ctx = storage.WithPrereleases(ctx, true)
+	}
+	token := s.githubToken(r)
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Items []planItem `json:"items"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			fail(w, r, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		if len(req.Items) == 0 {
+			fail(w, r, http.StatusBadRequest, "missing items")
+			return
+		}
+		if len(req.Items) > maxBranchSwitchItems {
+			fail(w, r, http.StatusBadRequest, "too many items")
+			return
+		}
+		s.planItems(ctx, w, r, planner, user, token, req.Items, legacy, checkRemote)
+		return
+	}
+
+	repo := repoArg(q.Get("repo"))
+	if repo == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	branch, ok := pullParam(w, r, strings.TrimSpace(q.Get("branch")))
+	if !ok || !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	plan, err := planner.PlanRepo(ctx, user, repo, branch, token, legacy, checkRemote)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("plan error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "plan", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(plan)
+}
+
+// planItems plans each item, at most planConcurrency at once, and answers
+// 207 with every item's plan or error. Once GitHub rate limits a check, or
+// the breaker is open, the remaining items are planned from the cache only
+// rather than spending what is left of the budget.
+func (s *Server) planItems(ctx context.Context, w http.ResponseWriter, r *http.Request, planner repoPlanner, user, token string, items []planItem, legacy, checkRemote bool) {
+	results := make([]planItemResult, len(items))
+	policy := s.repoPolicy.Load()
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		rateLimited bool
+	)
+	limited := func() bool {
+		mu.Lock()
+		stop := rateLimited
+		mu.Unlock()
+		if b, ok := s.store.(breakerSource); ok && b.BreakerOpen() {
+			stop = true
+		}
+		return stop
+	}
+	sem := make(chan struct{}, planConcurrency)
+	for i := range items {
+		it := items[i]
+		it.Repo, it.Branch, it.Legacy = repoArg(it.Repo), strings.TrimSpace(it.Branch), it.Legacy || legacy
+		res := &results[i]
+		res.Repo, res.Branch = it.Repo, it.Branch
+		if it.Repo == "" {
+			res.fail(http.StatusBadRequest, CodeBadRequest, "missing repo")
+			continue
+		}
+		if err := storage.ValidateRef(it.Branch); err != nil {
+			res.fail(http.StatusBadRequest, CodeBadRequest, err.Error())
+			continue
+		}
+		if err := policy.Check(it.Repo); err != nil {
+			status, code := classify(err)
+			res.fail(status, code, "repo policy: "+err.Error())
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(it planItem, res *planItemResult) {
+			defer func() { <-sem; wg.Done() }()
+			remote := checkRemote && !limited()
+			plan, err := planner.PlanRepo(ctx, user, it.Repo, it.Branch, token, it.Legacy, remote)
+			if remote && errors.Is(err, storage.ErrRateLimited) {
+				mu.Lock()
+				rateLimited = true
+				mu.Unlock()
+				remote = false
+				plan, err = planner.PlanRepo(ctx, user, it.Repo, it.Branch, token, it.Legacy, false)
+			}
+			if err != nil {
+				err = redactToken(err, token)
+				status, code := classify(err)
+				res.fail(status, code, "plan: "+err.Error())
+				return
+			}
+			res.Status, res.Plan = http.StatusOK, plan
+			res.RemoteSkipped = checkRemote && !remote
+		}(it, res)
+	}
+	wg.Wait()
+	s.logf("plan batch user=%s items=%d remote=%t rate_limited=%t\n", user, len(items), checkRemote, rateLimited)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_ = json.NewEncoder(w).Encode(struct {
+		Items []planItemResult `json:"items"`
+	}{results})
+}
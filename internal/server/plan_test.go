@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestPlanEndpoint(t *testing.T) {
+	const sha = "1111111111111111111111111111111111111111"
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	st := s.store.(*storage.Storage)
+	var downloads atomic.Int32
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}
+		switch {
+		case r.URL.Host != "api.github.com":
+			downloads.Add(1)
+		case r.URL.Path == "/repos/own/repo":
+			resp.StatusCode, resp.Body = http.StatusOK, io.NopCloser(strings.NewReader(`{"full_name":"own/repo","default_branch":"main"}`))
+		case r.URL.Path == "/repos/own/repo/branches/main":
+			resp.StatusCode, resp.Body = http.StatusOK, io.NopCloser(strings.NewReader(`{"commit":{"sha":"`+sha+`"}}`))
+		case r.URL.Path == "/repos/own/repo/branches/limited":
+			resp.StatusCode = http.StatusForbidden
+			resp.Header.Set("X-RateLimit-Remaining", "0")
+		}
+		return resp, nil
+	})}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	zipPath := filepath.Join(root, "users", "default", "repos", "own", "repo", "main.zip")
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipPath, []byte("zip-bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipPath+".meta", []byte(sha), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(zipPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		want   int
+		would  storage.PlanAction
+		remote string
+	}{
+		{"cached", "/api/v1/repos/plan?repo=own/repo&branch=main", http.StatusOK, storage.PlanRevalidate, ""},
+		{"remote check", "/api/v1/repos/plan?repo=own/repo&branch=main&check=remote", http.StatusOK, storage.PlanRevalidate, sha},
+		{"not cached", "/api/v1/repos/plan?repo=own/repo&branch=dev", http.StatusOK, storage.PlanDownload, ""},
+		{"missing upstream", "/api/v1/repos/plan?repo=own/repo&branch=dev&check=remote", http.StatusNotFound, "", ""},
+		{"missing repo", "/api/v1/repos/plan?branch=main", http.StatusBadRequest, "", ""},
+		{"bad check", "/api/v1/repos/plan?repo=own/repo&check=maybe", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if rec.Code != tt.want {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var plan storage.RepoPlan
+		if err := json.NewDecoder(rec.Body).Decode(&plan); err != nil {
+			t.Fatal(err)
+		}
+		if plan.Would != tt.would || plan.RemoteSHA != tt.remote {
+			t.Fatalf("%s: plan = %+v", tt.name, plan)
+		}
+	}
+
+	body := `{"items":[{"repo":"own/repo","branch":"main"},{"repo":"own/repo","branch":"limited"},{"repo":"","branch":"main"}]}`
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/repos/plan?check=remote", strings.NewReader(body)))
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("batch: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Items []planItemResult `json:"items"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 3 {
+		t.Fatalf("batch items = %+v", out.Items)
+	}
+	if it := out.Items[0]; it.Status != http.StatusOK || it.Plan == nil || it.Plan.CachedSHA != sha {
+		t.Fatalf("batch main = %+v", it)
+	}
+	if it := out.Items[1]; it.Status != http.StatusOK || !it.RemoteSkipped || it.Plan == nil || it.Plan.Would != storage.PlanDownload {
+		t.Fatalf("batch rate limited = %+v", it)
+	}
+	if it := out.Items[2]; it.Status != http.StatusBadRequest || it.Error == nil {
+		t.Fatalf("batch missing repo = %+v", it)
+	}
+
+	if n := downloads.Load(); n != 0 {
+		t.Fatalf("plans downloaded %d archives", n)
+	}
+	if fi, err := os.Stat(zipPath); err != nil || !fi.ModTime().Equal(old) {
+		t.Fatalf("plans touched the archive: %v", err)
+	}
+}
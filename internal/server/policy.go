@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github-hub/internal/storage"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+	// errBadUser reports a requested namespace that fails checkUser.
+	errBadUser = errors.New("invalid user")
+)
+
+// maxUserLen caps the length of a requested namespace.
+const maxUserLen = 128
+
+// APIKey maps a hub credential to the user it authenticates.
+type APIKey struct {
+	Key   string
+	User  string
+	Admin bool
+}
+
+// Principal is the caller identity resolved from auth. When auth is disabled
+// every caller is an unauthenticated admin, which keeps the historical
+// behavior of an open hub.
+type Principal struct {
+	User          string
+	Admin         bool
+	Authenticated bool
+}
+
+// SetAuth enables API-key authentication. Passing no keys disables it.
+func (s *Server) SetAuth(keys []APIKey) {
+	m := make(map[string]Principal, len(keys))
+	for _, k := range keys {
+		key := strings.TrimSpace(k.Key)
+		if key == "" {
+			continue
+		}
+		m[key] = Principal{User: sanitizeUser(k.User), Admin: k.Admin, Authenticated: true}
+	}
+	s.apiKeys = m
+}
+
+func (s *Server) authEnabled() bool { return len(s.apiKeys) > 0 }
+
+// authenticate resolves the caller from X-GHH-Api-Key, a Bearer token or
+// the password of HTTP Basic auth (the user name is ignored), which is how
+// browsers using the web UI send it.
+func (s *Server) authenticate(r *http.Request) (Principal, error) {
+	if p, ok := r.Context().Value(signedPrincipalKey{}).(Principal); ok {
+		return p, nil
+	}
+	if !s.authEnabled() {
+		return Principal{Admin: true}, nil
+	}
+	key := strings.TrimSpace(r.Header.Get("X-GHH-Api-Key"))
+	if key == "" {
+		h := strings.TrimSpace(r.Header.Get("Authorization"))
+		if strings.HasPrefix(strings.ToLower(h), "bearer ") {
+			key = strings.TrimSpace(h[len("bearer "):])
+		} else if _, pass, ok := r.BasicAuth(); ok {
+			key = strings.TrimSpace(pass)
+		}
+	}
+	if key == "" {
+		return Principal{}, fmt.Errorf("missing api key: %w", errUnauthorized)
+	}
+	p, ok := s.apiKeys[key]
+	if !ok {
+		return Principal{}, fmt.Errorf("invalid api key: %w", errUnauthorized)
+	}
+	return p, nil
+}
+
+// requestedUsers lists the namespaces r names, by precedence: the
+// X-GHH-User header, the user query parameter, then body, the user field of
+// a JSON request body. Empty ones are left out.
+func requestedUsers(r *http.Request, body string) []string {
+	var out []string
+	for _, u := range []string{r.Header.Get("X-GHH-User"), r.URL.Query().Get("user"), body} {
+		if u = strings.TrimSpace(u); u != "" {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// checkUser applies the rules every requested namespace must pass, however
+// it was given: at most maxUserLen bytes, no control characters and, once
+// sanitized, not a dot-name such as "..".
+func checkUser(u string) error {
+	name := sanitizeUser(u)
+	if len(name) > maxUserLen || strings.HasPrefix(name, ".") || strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("%w %q", errBadUser, u)
+	}
+	return nil
+}
+
+// effectiveUser picks the namespace a request acts on, by precedence: the
+// authenticated identity, then X-GHH-User, the user query parameter, a body
+// user field (body) and finally the server default. Authenticated
+// non-admins are pinned to their own namespace; naming another one in any
+// of these places is rejected rather than silently rewritten. Admins and,
+// with auth disabled, everyone act as the first namespace named.
+func (s *Server) effectiveUser(r *http.Request, p Principal, body string) (string, error) {
+	requested := ""
+	for _, u := range requestedUsers(r, body) {
+		if err := checkUser(u); err != nil {
+			return "", err
+		}
+		user := sanitizeUser(u)
+		if p.Authenticated && !p.Admin && user != p.User {
+			return "", fmt.Errorf("user %q may not act as %q: %w", p.User, user, errForbidden)
+		}
+		if requested == "" {
+			requested = user
+		}
+	}
+	switch {
+	case requested != "":
+		return requested, nil
+	case p.Authenticated:
+		return p.User, nil
+	}
+	return sanitizeUser(s.defaultUser), nil
+}
+
+// authorizePath checks a storage-relative path (users/<user>/... or
+// git-cache/...) against the caller. Storage's safeJoin still guards against
+// escaping the root; this guards against crossing namespaces inside it.
+func authorizePath(p Principal, user, rel string, write bool) error {
+	parts := splitRel(rel)
+	if len(parts) == 0 {
+		if p.Admin {
+			return nil
+		}
+		return fmt.Errorf("root access requires admin: %w", errForbidden)
+	}
+	switch parts[0] {
+	case "users":
+		if len(parts) < 2 {
+			if p.Admin {
+				return nil
+			}
+			return fmt.Errorf("listing all users requires admin: %w", errForbidden)
+		}
+		if parts[1] != user && !p.Admin {
+			return fmt.Errorf("namespace %q not accessible: %w", parts[1], errForbidden)
+		}
+		return nil
+	case "git-cache":
+		// The bare repo cache is shared: everyone may read it, only admins may change it.
+		if write && !p.Admin {
+			return fmt.Errorf("git-cache is shared; modification requires admin: %w", errForbidden)
+		}
+		return nil
+	case storage.SharedDir:
+		// So is the shared archive cache; the repo policy decides what gets in.
+		if write && !p.Admin {
+			return fmt.Errorf("shared cache modification requires admin: %w", errForbidden)
+		}
+		return nil
+	default:
+		if p.Admin {
+			return nil
+		}
+		return fmt.Errorf("path outside user namespaces: %w", errForbidden)
+	}
+}
+
+func splitRel(rel string) []string {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	var out []string
+	for _, part := range strings.Split(rel, "/") {
+		if part != "" && part != "." {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// scope authenticates r and resolves its effective user, writing the error
+// response itself when the request must not proceed, including downloads
+// by users past their daily byte budget.
+func (s *Server) scope(w http.ResponseWriter, r *http.Request) (Principal, string, bool) {
+	return s.scopeAs(w, r, "")
+}
+
+// scopeAs is scope for requests whose JSON body may name a user, which
+// ranks below the header and the query parameter.
+func (s *Server) scopeAs(w http.ResponseWriter, r *http.Request, bodyUser string) (Principal, string, bool) {
+	p, err := s.authenticate(r)
+	if err != nil {
+		fail(w, r, http.StatusUnauthorized, err.Error())
+		return Principal{}, "", false
+	}
+	user, err := s.effectiveUser(r, p, bodyUser)
+	if errors.Is(err, errBadUser) {
+		fail(w, r, http.StatusBadRequest, err.Error())
+		return Principal{}, "", false
+	}
+	if err != nil {
+		fail(w, r, http.StatusForbidden, err.Error())
+		return Principal{}, "", false
+	}
+	s.noteInflightUser(r, user)
+	if !s.checkBudget(w, r, user) {
+		return Principal{}, "", false
+	}
+	return p, user, true
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestPermissionMatrix(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+
+	fs := &fakeStore{ensurePath: zipPath, ensurePkg: zipPath, ensureInfo: &storage.RepoInfo{Repo: "own/repo"}}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	type endpoint struct {
+		name   string
+		method string
+		path   string
+		body   any
+	}
+	// target selects the namespace: "" = caller's own, otherwise via X-GHH-User.
+	endpoints := []endpoint{
+		{"download", http.MethodGet, "/api/v1/download?repo=own/repo&branch=main", nil},
+		{"info", http.MethodGet, "/api/v1/download/info?repo=own/repo&branch=main", nil},
+		{"package", http.MethodGet, "/api/v1/download/package?url=https://example.com/p.bin", nil},
+		{"switch", http.MethodPost, "/api/v1/branch/switch", map[string]string{"repo": "own/repo", "branch": "dev"}},
+		{"list", http.MethodGet, "/api/v1/dir/list?path=repos", nil},
+		{"delete", http.MethodDelete, "/api/v1/dir?path=repos/own", nil},
+		{"v2 archive", http.MethodGet, "/api/v2/repos/own/repo/archive/main", nil},
+	}
+	callers := []struct {
+		name string
+		key  string
+	}{
+		{"anonymous", ""},
+		{"alice", "alice-key"},
+		{"admin", "root-key"},
+	}
+	targets := []string{"own", "bob"}
+
+	want := func(caller, target string) int {
+		switch {
+		case caller == "anonymous":
+			return http.StatusUnauthorized
+		case caller == "alice" && target == "bob":
+			return http.StatusForbidden
+		default:
+			return http.StatusOK
+		}
+	}
+
+	do := func(ep endpoint, key, user, pathOverride string) int {
+		t.Helper()
+		var body io.Reader
+		if ep.body != nil {
+			b, _ := json.Marshal(ep.body)
+			body = bytes.NewReader(b)
+		}
+		path := ep.path
+		if pathOverride != "" {
+			path = pathOverride
+		}
+		req, _ := http.NewRequest(ep.method, ts.URL+path, body)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		if user != "" {
+			req.Header.Set("X-GHH-User", user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, ep := range endpoints {
+		for _, c := range callers {
+			for _, target := range targets {
+				user := ""
+				if target == "bob" {
+					user = "bob"
+				}
+				if got, w := do(ep, c.key, user, ""), want(c.name, target); got != w {
+					t.Errorf("%s as %s targeting %s: got %d want %d", ep.name, c.name, target, got, w)
+				}
+			}
+		}
+	}
+
+	// Cross-namespace via explicit paths rather than headers.
+	pathCases := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"alice deletes own absolute path", http.MethodDelete, "/api/v1/dir?path=users/alice/repos", "alice-key", http.StatusOK},
+		{"alice deletes bob path", http.MethodDelete, "/api/v1/dir?path=users/bob/repos", "alice-key", http.StatusForbidden},
+		{"admin deletes bob path", http.MethodDelete, "/api/v1/dir?path=users/bob/repos", "root-key", http.StatusOK},
+		{"alice lists git-cache", http.MethodGet, "/api/v1/dir/list?path=git-cache", "alice-key", http.StatusOK},
+		{"alice deletes git-cache", http.MethodDelete, "/api/v1/dir?path=git-cache/own", "alice-key", http.StatusForbidden},
+		{"admin deletes git-cache", http.MethodDelete, "/api/v1/dir?path=git-cache/own", "root-key", http.StatusOK},
+		{"alice same user header", http.MethodGet, "/api/v1/dir/list?path=.", "alice-key", http.StatusOK},
+	}
+	for _, tc := range pathCases {
+		if got := do(endpoint{method: tc.method}, tc.key, "", tc.path); got != tc.want {
+			t.Errorf("%s: got %d want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAuthDisabledKeepsOpenBehavior(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/dir?path=users/bob/repos", nil)
+	req.Header.Set("X-GHH-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d", resp.StatusCode)
+	}
+}
+
+func TestBearerIsNotForwardedWhenAuthEnabled(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath}
+	s := NewServerWithStore(fs, "server-token", "default")
+	s.SetAuth([]APIKey{{Key: "alice-key", User: "alice"}})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download?repo=own/repo", nil)
+	req.Header.Set("Authorization", "Bearer alice-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if fs.lastToken != "server-token" || fs.lastUser != "alice" {
+		t.Fatalf("store got user=%q token=%q", fs.lastUser, fs.lastToken)
+	}
+}
+
+func TestRepoPolicyDenied(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath}
+	s := NewServerWithStore(fs, "", "default")
+	p, err := storage.NewRepoPolicy([]string{"myorg/*"}, []string{"myorg/secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRepoPolicy(p)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{"/api/v1/download?repo=myorg/tool", http.StatusOK},
+		{"/api/v1/download?repo=other/tool", http.StatusForbidden},
+		{"/api/v1/download?repo=myorg/secret", http.StatusForbidden},
+		{"/api/v1/download/commit?repo=other/tool&format=json", http.StatusForbidden},
+		{"/api/v1/repos/default-branch?repo=other/tool", http.StatusForbidden},
+		{"/api/v2/repos/other/tool/archive/main", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		fs.lastRepo = ""
+		resp, err := http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status=%d want %d", tc.path, resp.StatusCode, tc.want)
+			continue
+		}
+		if tc.want == http.StatusForbidden {
+			if code := resp.Header.Get("X-GHH-Error-Code"); strings.Contains(tc.path, "/v2/") && code != CodePolicyDenied {
+				t.Errorf("%s: error code %q", tc.path, code)
+			}
+			if fs.lastRepo != "" {
+				t.Errorf("%s: store was called for denied repo", tc.path)
+			}
+		}
+	}
+
+	// Reloading the policy takes effect immediately.
+	s.SetRepoPolicy(nil)
+	resp, err := http.Get(ts.URL + "/api/v1/download?repo=other/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("after reload status=%d", resp.StatusCode)
+	}
+}
+
+func TestSharedLayoutPaths(t *testing.T) {
+	root := t.TempDir()
+	shared := filepath.Join(root, "shared", "repos", "acme", "app")
+	if err := os.MkdirAll(shared, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, "main.zip"), []byte("zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetCacheLayout(storage.LayoutShared)
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		want     int
+		wantName string
+	}{
+		{"alice sees repos at her root", http.MethodGet, "/api/v1/dir/list?path=.", "alice-key", http.StatusOK, "repos"},
+		{"alice lists shared repos", http.MethodGet, "/api/v1/dir/list?path=repos", "alice-key", http.StatusOK, "acme"},
+		{"alice lists shared absolute", http.MethodGet, "/api/v1/dir/list?path=shared/repos", "alice-key", http.StatusOK, "acme"},
+		{"alice deletes shared repo", http.MethodDelete, "/api/v1/dir?path=repos/acme&recursive=true", "alice-key", http.StatusForbidden, ""},
+		{"alice bulk deletes shared", http.MethodDelete, "/api/v1/cache/bulk?pattern=repos/*/*/*.zip", "alice-key", http.StatusForbidden, ""},
+		{"admin deletes shared repo", http.MethodDelete, "/api/v1/dir?path=repos/acme&recursive=true", "root-key", http.StatusOK, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tc.key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status=%d want %d", resp.StatusCode, tc.want)
+			}
+			if tc.wantName == "" {
+				return
+			}
+			var list []storage.Entry
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, e := range list {
+				found = found || e.Name == tc.wantName
+			}
+			if !found {
+				t.Fatalf("%s not listed in %+v", tc.wantName, list)
+			}
+		})
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Fatalf("shared repo not deleted by admin: %v", err)
+	}
+}
+
+// TestEffectiveUserPrecedence pins the order namespaces are picked in:
+// authenticated identity, X-GHH-User, user=, the JSON body's user, the
+// server default.
+func TestEffectiveUserPrecedence(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "fallback")
+	open := Principal{Admin: true}
+	alice := Principal{User: "alice", Authenticated: true}
+	admin := Principal{User: "root", Admin: true, Authenticated: true}
+	tests := []struct {
+		name                string
+		p                   Principal
+		header, query, body string
+		want                string
+		wantErr             error
+	}{
+		{name: "open default", p: open, want: "fallback"},
+		{name: "open body", p: open, body: "dave", want: "dave"},
+		{name: "open query over body", p: open, query: "carol", body: "dave", want: "carol"},
+		{name: "open header over query", p: open, header: "bob", query: "carol", body: "dave", want: "bob"},
+		{name: "open query sanitized", p: open, query: "a/b", want: "a-b"},
+		{name: "identity", p: alice, want: "alice"},
+		{name: "identity named", p: alice, header: "alice", query: "alice", body: "alice", want: "alice"},
+		{name: "identity over header", p: alice, header: "bob", wantErr: errForbidden},
+		{name: "identity over query", p: alice, header: "alice", query: "bob", wantErr: errForbidden},
+		{name: "identity over body", p: alice, body: "bob", wantErr: errForbidden},
+		{name: "admin identity", p: admin, want: "root"},
+		{name: "admin header", p: admin, header: "bob", query: "carol", want: "bob"},
+		{name: "admin query", p: admin, query: "carol", body: "dave", want: "carol"},
+		{name: "dot dot", p: open, query: "..", wantErr: errBadUser},
+		{name: "hidden", p: admin, header: ".trash", wantErr: errBadUser},
+		{name: "control", p: open, body: "a\x00b", wantErr: errBadUser},
+		{name: "too long", p: open, query: strings.Repeat("u", maxUserLen+1), wantErr: errBadUser},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/download?user="+url.QueryEscape(tt.query), nil)
+		if tt.header != "" {
+			req.Header.Set("X-GHH-User", tt.header)
+		}
+		got, err := s.effectiveUser(req, tt.p, tt.body)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: user = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestUserQueryAndBody(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		key      string
+		want     int
+		wantUser string
+	}{
+		{"download query", http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&user=ci", "", "root-key", http.StatusOK, "ci"},
+		{"download query conflict", http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&user=ci", "", "alice-key", http.StatusForbidden, ""},
+		{"download invalid", http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&user=..", "", "root-key", http.StatusBadRequest, ""},
+		{"switch body", http.MethodPost, "/api/v1/branch/switch", `{"repo":"own/repo","branch":"dev","user":"ci"}`, "root-key", http.StatusOK, "ci"},
+		{"switch query over body", http.MethodPost, "/api/v1/branch/switch?user=qa", `{"repo":"own/repo","branch":"dev","user":"ci"}`, "root-key", http.StatusOK, "qa"},
+		{"switch body conflict", http.MethodPost, "/api/v1/branch/switch", `{"repo":"own/repo","branch":"dev","user":"ci"}`, "alice-key", http.StatusForbidden, ""},
+		{"switch bad json unauthenticated", http.MethodPost, "/api/v1/branch/switch", `{`, "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		fs.lastUser = ""
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if tt.key != "" {
+			req.Header.Set("X-GHH-Api-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want || fs.lastUser != tt.wantUser {
+			t.Errorf("%s: status %d user %q, want %d %q: %s", tt.name, rec.Code, fs.lastUser, tt.want, tt.wantUser, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// SetPublicURL sets the base URL clients reach the server at, e.g.
+// "https://hub.example.com" or "https://example.com/ghh" behind a
+// TLS-terminating proxy, for the URLs the server hands out (signed
+// download URLs). Empty derives them from each request (see
+// SetTrustedProxies).
+func (s *Server) SetPublicURL(base string) error {
+	base = strings.TrimSpace(base)
+	if base == "" {
+		s.publicURL = nil
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("public url %q: want http(s)://host[:port][/path]", base)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	s.publicURL = u
+	return nil
+}
+
+// SetTrustedProxies sets the peers whose X-Forwarded-Proto and
+// X-Forwarded-Host describe the URL the client used. Requests from other
+// peers keep their own scheme and Host header. Unused with a public URL.
+func (s *Server) SetTrustedProxies(prefixes []netip.Prefix) {
+	s.trustedProxies = prefixes
+}
+
+// ParseTrustedProxies parses addresses and CIDR prefixes such as
+// "10.0.0.0/8" or "127.0.0.1".
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: want an address or CIDR prefix", e)
+		}
+		a = a.Unmap()
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+// fromTrustedProxy reports whether r came straight from a trusted proxy.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	if len(s.trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalURL is the URL a client reaches path at: under the public URL
+// when one is set, else at the scheme and host r arrived with, as the
+// first X-Forwarded-Proto and X-Forwarded-Host of a trusted proxy report
+// them.
+func (s *Server) externalURL(r *http.Request, path string) url.URL {
+	if s.publicURL != nil {
+		u := *s.publicURL
+		u.Path += path
+		return u
+	}
+	u := url.URL{Scheme: "http", Host: r.Host, Path: path}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if s.fromTrustedProxy(r) {
+		if proto := strings.ToLower(firstForwarded(r.Header.Get("X-Forwarded-Proto"))); proto == "http" || proto == "https" {
+			u.Scheme = proto
+		}
+		if host := firstForwarded(r.Header.Get("X-Forwarded-Host")); host != "" {
+			u.Host = host
+		}
+	}
+	return u
+}
+
+// firstForwarded is the first element of a comma-separated forwarding
+// header, set by the proxy nearest the client.
+func firstForwarded(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	return strings.TrimSpace(v)
+}
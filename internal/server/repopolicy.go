@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// SetRepoPolicy installs the allow/deny rules for owner/repo names. It may be
+// called again while serving to hot-reload the rules; nil allows everything.
+// The built-in storage enforces the same policy for library callers.
+func (s *Server) SetRepoPolicy(p *storage.RepoPolicy) {
+	s.repoPolicy.Store(p)
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SetRepoPolicy(p)
+	}
+}
+
+// allowRepo rejects repo with 403 policy_denied when the policy forbids it.
+// It runs before any store call so denied repos never reach GitHub.
+func (s *Server) allowRepo(w http.ResponseWriter, r *http.Request, repo string) bool {
+	err := s.repoPolicy.Load().Check(repo)
+	if err == nil {
+		return true
+	}
+	s.logf("repo policy denied path=%s repo=%s\n", r.URL.Path, repo)
+	failErr(w, r, "repo policy", err)
+	return false
+}
+
+// repoArg normalizes a repo parameter the way the store does (see
+// storage.NormalizeRepo), so policy checks, logs and stats see one spelling
+// of it. Malformed values are passed on as given for the store to reject.
+func repoArg(v string) string {
+	if repo, err := storage.NormalizeRepo(v); err == nil {
+		return repo
+	}
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+const (
+	defaultRevalidateWindow      = 24 * time.Hour
+	defaultRevalidateConcurrency = 2
+	revalidateTick               = 30 * time.Second
+)
+
+// revalidateSource is implemented by stores that can recheck cached
+// branches in the background.
+type revalidateSource interface {
+	RecentBranches(since time.Time) []storage.RecentBranch
+	Revalidate(ctx context.Context, b storage.RecentBranch, token string) (*storage.RepoArchive, error)
+}
+
+// Revalidation results, as counted in ghh_revalidations_total.
+const (
+	revalidateUpdated     = "updated"
+	revalidateUnchanged   = "unchanged"
+	revalidateStale       = "stale"
+	revalidateBusy        = "busy"
+	revalidateRateLimited = "rate_limited"
+	revalidateError       = "error"
+)
+
+// RevalidateStatus reports the background checks of one cached branch.
+type RevalidateStatus struct {
+	storage.RecentBranch
+	SHA       string    `json:"sha,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	// LastResult is updated, unchanged, stale, busy, rate_limited or error.
+	LastResult string    `json:"last_result,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+}
+
+// RevalidateReport is the body of GET /api/v1/revalidate/status.
+type RevalidateReport struct {
+	Enabled     bool               `json:"enabled"`
+	Interval    string             `json:"interval,omitempty"`
+	Window      string             `json:"window,omitempty"`
+	Concurrency int                `json:"concurrency,omitempty"`
+	LastPass    time.Time          `json:"last_pass"`
+	Counts      map[string]int64   `json:"counts"`
+	Entries     []RevalidateStatus `json:"entries"`
+	// Warmup is the startup warm-up, when one was configured.
+	Warmup *WarmupStatus `json:"warmup,omitempty"`
+}
+
+type revalidateState struct {
+	status RevalidateStatus
+	jitter time.Duration
+}
+
+// revalidator rechecks branches served within window every interval (plus
+// jitter), so a moved branch is downloaded before the next request needs
+// it. Passes stop while the GitHub breaker is open and never wait for a
+// branch a request is working on.
+type revalidator struct {
+	s           *Server
+	mu          sync.Mutex
+	interval    time.Duration
+	window      time.Duration
+	concurrency int
+	entries     map[string]*revalidateState
+	counts      map[string]int64
+	lastPass    time.Time
+	running     bool
+	// jitter returns the random delay added to an entry's interval.
+	jitter func(time.Duration) time.Duration
+}
+
+func newRevalidator(s *Server) *revalidator {
+	return &revalidator{
+		s:       s,
+		entries: make(map[string]*revalidateState),
+		counts:  make(map[string]int64),
+		jitter: func(d time.Duration) time.Duration {
+			if d <= 0 {
+				return 0
+			}
+			return rand.N(d)
+		},
+	}
+}
+
+func revalidateKey(b storage.RecentBranch) string {
+	return fmt.Sprintf("%s|%s|%s|%t", b.User, b.Repo, b.Branch, b.Legacy)
+}
+
+// SetRevalidation enables background revalidation of branches served
+// within window (0: 24h), each rechecked every interval plus up to a tenth
+// of it as jitter, with at most concurrency (0: 2) checks at once. An
+// interval of 0 disables it. It needs a store that implements
+// RecentBranches and Revalidate, such as the built-in storage.
+func (s *Server) SetRevalidation(interval, window time.Duration, concurrency int) error {
+	if interval <= 0 {
+		return nil
+	}
+	if _, ok := s.store.(revalidateSource); !ok {
+		return errors.New("background revalidation is not supported by this store")
+	}
+	if window <= 0 {
+		window = defaultRevalidateWindow
+	}
+	if concurrency <= 0 {
+		concurrency = defaultRevalidateConcurrency
+	}
+	rv := s.revalidate
+	rv.mu.Lock()
+	rv.interval, rv.window, rv.concurrency = interval, window, concurrency
+	start := !rv.running
+	rv.running = true
+	rv.mu.Unlock()
+	if start {
+		go rv.run()
+	}
+	return nil
+}
+
+func (rv *revalidator) run() {
+	ticker := time.NewTicker(revalidateTick)
+	defer ticker.Stop()
+	for {
+		rv.pass(rv.s.janitorCtx, rv.s.now())
+		select {
+		case <-rv.s.janitorCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pass rechecks every due branch. A branch is due interval plus its jitter
+// after it was last served or checked, whichever is later.
+func (rv *revalidator) pass(ctx context.Context, now time.Time) {
+	src, ok := rv.s.store.(revalidateSource)
+	if !ok {
+		return
+	}
+	rv.mu.Lock()
+	interval, window, concurrency := rv.interval, rv.window, rv.concurrency
+	rv.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+	recent := src.RecentBranches(now.Add(-window))
+
+	rv.mu.Lock()
+	seen := make(map[string]bool, len(recent))
+	var due []*revalidateState
+	for _, b := range recent {
+		key := revalidateKey(b)
+		seen[key] = true
+		st, ok := rv.entries[key]
+		if !ok {
+			st = &revalidateState{jitter: rv.jitter(interval / 10)}
+			rv.entries[key] = st
+		}
+		st.status.RecentBranch = b
+		from := b.LastAccess
+		if st.status.LastCheck.After(from) {
+			from = st.status.LastCheck
+		}
+		st.status.NextRun = from.Add(interval + st.jitter)
+		if !st.status.NextRun.After(now) {
+			due = append(due, st)
+		}
+	}
+	for key := range rv.entries {
+		if !seen[key] {
+			delete(rv.entries, key)
+		}
+	}
+	rv.lastPass = now
+	rv.mu.Unlock()
+
+	var (
+		wg          sync.WaitGroup
+		rateLimited bool
+		limitMu     sync.Mutex
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, st := range due {
+		sem <- struct{}{}
+		if ctx.Err() != nil || rv.limited(&limitMu, &rateLimited) {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(st *revalidateState) {
+			defer func() { <-sem; wg.Done() }()
+			if rv.check(ctx, src, st, now, interval) == revalidateRateLimited {
+				limitMu.Lock()
+				rateLimited = true
+				limitMu.Unlock()
+			}
+		}(st)
+	}
+	wg.Wait()
+}
+
+// limited reports whether the pass must stop: GitHub rate limited a check
+// or the breaker is open.
+func (rv *revalidator) limited(mu *sync.Mutex, rateLimited *bool) bool {
+	mu.Lock()
+	stop := *rateLimited
+	mu.Unlock()
+	if b, ok := rv.s.store.(breakerSource); ok && b.BreakerOpen() {
+		stop = true
+	}
+	return stop
+}
+
+// check revalidates one branch and records the result.
+func (rv *revalidator) check(ctx context.Context, src revalidateSource, st *revalidateState, now time.Time, interval time.Duration) string {
+	rv.mu.Lock()
+	b := st.status.RecentBranch
+	rv.mu.Unlock()
+
+	ctx, cancel := rv.s.downloadContext(ctx)
+	defer cancel()
+	res, err := src.Revalidate(ctx, b, rv.s.fallbackToken())
+	result := revalidateResult(res, err)
+
+	rv.mu.Lock()
+	st.status.LastResult = result
+	st.status.LastError = ""
+	if result != revalidateBusy {
+		st.status.LastCheck = now
+		st.jitter = rv.jitter(interval / 10)
+		st.status.NextRun = now.Add(interval + st.jitter)
+	}
+	if err != nil {
+		err = redactToken(err, rv.s.fallbackToken())
+		st.status.LastError = err.Error()
+	} else {
+		st.status.SHA = res.CommitSHA
+	}
+	rv.counts[result]++
+	rv.mu.Unlock()
+
+	if m := rv.s.metrics; m != nil && m.revalidations != nil {
+		m.revalidations.Inc(result)
+	}
+	switch result {
+	case revalidateUpdated:
+		rv.s.logf("revalidate updated user=%s repo=%s branch=%s sha=%s\n", b.User, b.Repo, b.Branch, res.ShortSHA)
+	case revalidateError, revalidateRateLimited:
+		rv.s.logf("revalidate error user=%s repo=%s branch=%s err=%v\n", b.User, b.Repo, b.Branch, err)
+	}
+	return result
+}
+
+// revalidateResult classifies the outcome of a Revalidate call.
+func revalidateResult(res *storage.RepoArchive, err error) string {
+	switch {
+	case errors.Is(err, storage.ErrBusy):
+		return revalidateBusy
+	case errors.Is(err, storage.ErrRateLimited):
+		return revalidateRateLimited
+	case err != nil:
+		return revalidateError
+	case res.Outcome == storage.CacheStale:
+		return revalidateStale
+	case res.Outcome == storage.CacheMiss:
+		return revalidateUpdated
+	}
+	return revalidateUnchanged
+}
+
+func (rv *revalidator) report() RevalidateReport {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rep := RevalidateReport{
+		Enabled:  rv.interval > 0,
+		LastPass: rv.lastPass,
+		Counts:   make(map[string]int64, len(rv.counts)),
+		Entries:  make([]RevalidateStatus, 0, len(rv.entries)),
+	}
+	if rep.Enabled {
+		rep.Interval, rep.Window, rep.Concurrency = rv.interval.String(), rv.window.String(), rv.concurrency
+	}
+	for k, v := range rv.counts {
+		rep.Counts[k] = v
+	}
+	for _, st := range rv.entries {
+		rep.Entries = append(rep.Entries, st.status)
+	}
+	sort.Slice(rep.Entries, func(i, j int) bool {
+		return revalidateKey(rep.Entries[i].RecentBranch) < revalidateKey(rep.Entries[j].RecentBranch)
+	})
+	return rep
+}
+
+// handleRevalidateStatus reports the background revalidation schedule and
+// what its last checks found.
+func (s *Server) handleRevalidateStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, _, ok := s.scope(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rep := s.revalidate.report()
+	rep.Warmup = s.warmup.report()
+	_ = json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+type revalidateStore struct {
+	*fakeStore
+	mu          sync.Mutex
+	recent      []storage.RecentBranch
+	results     map[string]error
+	outcomes    map[string]storage.CacheOutcome
+	checked     []string
+	breakerOpen bool
+}
+
+func (f *revalidateStore) RecentBranches(since time.Time) []storage.RecentBranch {
+	var out []storage.RecentBranch
+	for _, b := range f.recent {
+		if !b.LastAccess.Before(since) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (f *revalidateStore) Revalidate(ctx context.Context, b storage.RecentBranch, token string) (*storage.RepoArchive, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checked = append(f.checked, b.Branch)
+	if err := f.results[b.Branch]; err != nil {
+		return nil, err
+	}
+	outcome := f.outcomes[b.Branch]
+	if outcome == "" {
+		outcome = storage.CacheRevalidated
+	}
+	return &storage.RepoArchive{CommitSHA: "sha-" + b.Branch, Outcome: outcome}, nil
+}
+
+func (f *revalidateStore) BreakerOpen() bool { return f.breakerOpen }
+
+func (f *revalidateStore) takeChecked() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.checked
+	f.checked = nil
+	return out
+}
+
+func TestRevalidatorPass(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fs := &revalidateStore{
+		fakeStore: &fakeStore{},
+		recent: []storage.RecentBranch{
+			{User: "ci", Repo: "o/r", Branch: "main", LastAccess: now.Add(-time.Hour)},
+			{User: "ci", Repo: "o/r", Branch: "dev", LastAccess: now.Add(-time.Hour)},
+			{User: "ci", Repo: "o/r", Branch: "busy", LastAccess: now.Add(-time.Hour)},
+			{User: "ci", Repo: "o/r", Branch: "fresh", LastAccess: now.Add(-time.Minute)},
+			{User: "ci", Repo: "o/r", Branch: "old", LastAccess: now.Add(-48 * time.Hour)},
+		},
+		results:  map[string]error{"busy": storage.ErrBusy},
+		outcomes: map[string]storage.CacheOutcome{"dev": storage.CacheMiss},
+	}
+	s := NewServerWithStore(fs, "", "ci")
+	defer s.Shutdown()
+	rv := s.revalidate
+	rv.jitter = func(time.Duration) time.Duration { return 0 }
+	rv.interval, rv.window, rv.concurrency = 15*time.Minute, defaultRevalidateWindow, 1
+	ctx := context.Background()
+
+	rv.pass(ctx, now)
+	checked := strings.Join(sorted(fs.takeChecked()), ",")
+	if checked != "busy,dev,main" {
+		t.Fatalf("checked %q, want branches served 1h ago within the 24h window", checked)
+	}
+	rep := rv.report()
+	if rep.Counts[revalidateUpdated] != 1 || rep.Counts[revalidateUnchanged] != 1 || rep.Counts[revalidateBusy] != 1 {
+		t.Fatalf("counts = %v", rep.Counts)
+	}
+	if len(rep.Entries) != 4 {
+		t.Fatalf("entries = %+v", rep.Entries)
+	}
+
+	// Checked branches wait an interval; the busy one is retried at once.
+	rv.pass(ctx, now.Add(time.Minute))
+	if checked := fs.takeChecked(); len(checked) != 1 || checked[0] != "busy" {
+		t.Fatalf("second pass checked %v", checked)
+	}
+	rv.pass(ctx, now.Add(16*time.Minute))
+	if checked := strings.Join(sorted(fs.takeChecked()), ","); checked != "busy,dev,fresh,main" {
+		t.Fatalf("third pass checked %q", checked)
+	}
+
+	// An open breaker or a rate limited check stops the pass.
+	fs.breakerOpen = true
+	rv.pass(ctx, now.Add(time.Hour))
+	if checked := fs.takeChecked(); len(checked) != 0 {
+		t.Fatalf("checked %v while the breaker is open", checked)
+	}
+	fs.breakerOpen = false
+	fs.results = map[string]error{"busy": storage.ErrRateLimited, "dev": storage.ErrRateLimited, "fresh": storage.ErrRateLimited, "main": storage.ErrRateLimited}
+	rv.pass(ctx, now.Add(time.Hour))
+	if checked := fs.takeChecked(); len(checked) != 1 {
+		t.Fatalf("checked %v after a rate limited check, want 1", checked)
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleRevalidateStatus(rr, httptest.NewRequest(http.MethodGet, "/api/v1/revalidate/status", nil))
+	var got RevalidateReport
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Enabled || got.Interval != "15m0s" || got.Counts[revalidateRateLimited] != 1 {
+		t.Fatalf("status = %+v", got)
+	}
+	for _, e := range got.Entries {
+		if e.Branch == "dev" && (e.SHA != "sha-dev" || e.LastResult != revalidateUpdated) {
+			t.Fatalf("dev entry = %+v", e)
+		}
+	}
+}
+
+func TestSetRevalidationNeedsSupport(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "ci")
+	defer s.Shutdown()
+	if err := s.SetRevalidation(0, 0, 0); err != nil {
+		t.Fatalf("disabled revalidation: %v", err)
+	}
+	if err := s.SetRevalidation(time.Minute, 0, 0); err == nil {
+		t.Fatal("expected an error for a store without Revalidate")
+	}
+}
+
+func TestStartWarmup(t *testing.T) {
+	now := time.Now()
+	fs := &revalidateStore{
+		fakeStore: &fakeStore{},
+		recent: []storage.RecentBranch{
+			{User: "ci", Repo: "o/r", Branch: "old", LastAccess: now.Add(-72 * time.Hour)},
+			{User: "ci", Repo: "o/r", Branch: "main", LastAccess: now.Add(-time.Minute)},
+			{User: "ci", Repo: "o/r", Branch: "dev", LastAccess: now.Add(-time.Hour)},
+		},
+		outcomes: map[string]storage.CacheOutcome{"dev": storage.CacheMiss},
+	}
+	s := NewServerWithStore(fs, "", "ci")
+	defer s.Shutdown()
+	readyz := func() int {
+		rr := httptest.NewRecorder()
+		s.handleReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rr.Code
+	}
+
+	// Hold the store so the warm-up cannot finish yet.
+	fs.mu.Lock()
+	if err := s.StartWarmup(2, 1, true); err != nil {
+		fs.mu.Unlock()
+		t.Fatal(err)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		fs.mu.Unlock()
+		t.Fatalf("readyz during warm-up = %d", code)
+	}
+	fs.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.warmup.report().State == warmupRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("warm-up did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("readyz after warm-up = %d", code)
+	}
+	st := s.warmup.report()
+	if st.State != warmupDone || st.Total != 2 || st.Checked != 2 || st.Updated != 1 || st.Finished == nil {
+		t.Fatalf("status = %+v", st)
+	}
+	if checked := strings.Join(sorted(fs.takeChecked()), ","); checked != "dev,main" {
+		t.Fatalf("checked %q, want the two most recently used", checked)
+	}
+	if err := s.StartWarmup(2, 1, true); err == nil {
+		t.Fatal("expected an error for a second warm-up")
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleRevalidateStatus(rr, httptest.NewRequest(http.MethodGet, "/api/v1/revalidate/status", nil))
+	var rep RevalidateReport
+	if err := json.NewDecoder(rr.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Warmup == nil || rep.Warmup.Updated != 1 {
+		t.Fatalf("status warmup = %+v", rep.Warmup)
+	}
+}
+
+func sorted(v []string) []string {
+	sort.Strings(v)
+	return v
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/version"
+)
+
+// router registers handlers with the middleware every API version shares.
+type router struct {
+	s   *Server
+	mux *http.ServeMux
+}
+
+// routeClass is what a route does, which decides its middleware.
+type routeClass int
+
+const (
+	// metadataRoute only consults metadata: compressed, short deadline.
+	metadataRoute routeClass = iota
+	// fetchRoute answers JSON/text but may populate the cache:
+	// compressed, download deadline.
+	fetchRoute
+	// streamRoute sends an archive whose payload is already compressed:
+	// uncompressed, download deadline.
+	streamRoute
+	// monitorRoute is a metadata route that must answer while the server
+	// is busy, and the class for long-poll and SSE routes: never turned
+	// away by the in-flight cap.
+	monitorRoute
+)
+
+// middleware wraps a route's handler; name identifies it in tests.
+type middleware struct {
+	name string
+	wrap func(http.Handler) http.Handler
+}
+
+// middlewares lists the middleware of a route of class c at pattern,
+// outermost first. Identify names the build on every answer. Instrument
+// sees the final status and the whole latency, rejections included.
+// Clients counts the request by route and client. Cluster forwards
+// requests for users another instance owns before anything is charged.
+// Usage tallies the cache outcome of downloads. Budget charges downloads
+// to the user's daily byte budget. Track counts the request in flight
+// for as long as its deadline allows. Deadline bounds the request
+// context. Compress sits innermost so the deadline covers writing the
+// compressed body.
+func (rt *router) middlewares(pattern string, c routeClass) []middleware {
+	download := c == fetchRoute || c == streamRoute
+	mws := []middleware{
+		{"identify", Identify},
+		{"instrument", func(h http.Handler) http.Handler { return rt.s.instrument(pattern, h) }},
+		{"clients", func(h http.Handler) http.Handler { return rt.s.countClients(pattern, h) }},
+	}
+	if !clusterLocal(pattern, c) {
+		mws = append(mws, middleware{"cluster", rt.s.clusterRoute})
+	}
+	if download {
+		mws = append(mws, middleware{"usage", rt.s.tally})
+		mws = append(mws, middleware{"budget", func(h http.Handler) http.Handler { return rt.s.budget(c == streamRoute, h) }})
+	}
+	mws = append(mws, []middleware{
+		{"track", func(h http.Handler) http.Handler { return rt.s.track(pattern, c != monitorRoute, h) }},
+		{"deadline", func(h http.Handler) http.Handler { return rt.s.deadline(download, h) }},
+	}...)
+	if c != streamRoute {
+		mws = append(mws, middleware{"compress", rt.s.compress})
+	}
+	return mws
+}
+
+// serverHeader is the X-GHH-Server value: github-hub/<version>, with the
+// commit as build metadata when it was set at build time.
+func serverHeader() string {
+	v := strings.TrimSpace(version.Version)
+	if v == "" {
+		v = "dev"
+	}
+	if c := strings.TrimSpace(version.Commit); c != "" {
+		v += "+" + c
+	}
+	return "github-hub/" + v
+}
+
+// Identify sets X-GHH-Server, so a response tells which build served it.
+// Registered routes have it already; wrap the whole mux in it to name the
+// build on answers for unknown paths too.
+func Identify(h http.Handler) http.Handler {
+	name := serverHeader()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-GHH-Server", name)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// chain wraps h in mws, the first outermost.
+func chain(h http.Handler, mws []middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i].wrap(h)
+	}
+	return h
+}
+
+func (rt *router) register(pattern string, c routeClass, h http.HandlerFunc) {
+	rt.mux.Handle(pattern, chain(h, rt.middlewares(pattern, c)))
+}
+
+// handle registers a metadata endpoint.
+func (rt *router) handle(pattern string, h http.HandlerFunc) {
+	rt.register(pattern, metadataRoute, h)
+}
+
+// fetch registers a JSON/text endpoint that may populate the cache.
+func (rt *router) fetch(pattern string, h http.HandlerFunc) {
+	rt.register(pattern, fetchRoute, h)
+}
+
+// stream registers an archive endpoint.
+func (rt *router) stream(pattern string, h http.HandlerFunc) {
+	rt.register(pattern, streamRoute, h)
+}
+
+// monitor registers an endpoint exempt from the in-flight cap.
+func (rt *router) monitor(pattern string, h http.HandlerFunc) {
+	rt.register(pattern, monitorRoute, h)
+}
+
+// registerV1 mounts the original query-string API. Its responses must stay
+// byte-for-byte compatible with existing clients.
+func (s *Server) registerV1(rt *router) {
+	rt.handle("/api/v1/version", handleVersion)
+	rt.handle("/api/v1/locate", s.handleLocate)
+	rt.stream("/api/v1/download", s.handleDownload)
+	rt.fetch("/api/v1/download/commit", s.handleDownloadCommit)
+	rt.fetch("/api/v1/download/info", s.handleDownloadInfo)
+	rt.fetch("/api/v1/download/checksum", s.handleDownloadChecksum)
+	rt.handle("/api/v1/download/rollback", s.handleDownloadRollback)
+	rt.stream("/api/v1/download/at", s.handleDownloadAt)
+	rt.fetch("/api/v1/download/signature", s.handleDownloadSignature)
+	rt.handle("/api/v1/download/sign", s.handleDownloadSign)
+	rt.stream(signedDownloadPath, s.handleSignedDownload)
+	rt.handle("/api/v1/public-key", s.handlePublicKey)
+	rt.stream("/api/v1/download/package", s.handleDownloadPackage)
+	rt.handle("/api/v1/packages", s.handlePackages)
+	rt.handle("/api/v1/packages/lookup", s.handlePackageLookup)
+	rt.fetch("/api/v1/packages/upload", s.handlePackageUpload)
+	rt.stream("/api/v1/download/sparse", s.handleDownloadSparse)
+	rt.fetch("/api/v1/download/segments", s.handleDownloadSegments)
+	rt.stream("/api/v1/download/segment", s.handleDownloadSegment)
+	rt.fetch("/api/v1/branch/switch", s.handleBranchSwitch)
+	rt.handle("/api/v1/repos/default-branch", s.handleDefaultBranch)
+	rt.handle("/api/v1/repos/commits", s.handleRepoCommits)
+	rt.fetch("/api/v1/repos/info", s.handleRepoInfo)
+	rt.fetch("/api/v1/repos/manifest", s.handleRepoManifest)
+	rt.fetch("/api/v1/repos/patch", s.handleRepoPatch)
+	rt.handle("/api/v1/repos/cached-branches", s.handleCachedBranches)
+	rt.handle("/api/v1/repos/plan", s.handlePlan)
+	rt.handle("/api/v1/user/token/validate", s.handleTokenValidate)
+	rt.handle("/api/v1/stats/repos", s.handleRepoStats)
+	rt.handle("/api/v1/stats/summary", s.handleStatsSummary)
+	rt.handle("/api/v1/mirror", s.handleMirror)
+	rt.handle("/api/v1/mirror/status", s.handleMirrorStatus)
+	rt.handle("/api/v1/mirror/hook", s.handleMirrorHook)
+	rt.handle("/api/v1/revalidate/status", s.handleRevalidateStatus)
+	rt.monitor("/api/v1/admin/inflight", s.handleInflight)
+	rt.fetch("/api/v1/admin/import", s.handleImportArchive)
+	rt.monitor("/api/v1/admin/downloads/recent", s.handleRecentDownloads)
+	rt.monitor("/api/v1/admin/upstream", s.handleUpstream)
+	rt.handle("/api/v1/admin/budgets", s.handleBudgets)
+	rt.handle("/api/v1/admin/consistency", s.handleConsistency)
+	rt.monitor("/api/v1/admin/clients", s.handleClients)
+	rt.monitor("/api/v1/status", s.handleStatus)
+	rt.handle("/api/v1/dir/list", s.handleDirList)
+	rt.handle("/api/v1/dir", s.handleDir)
+	rt.handle("/api/v1/cache/trash", s.handleTrash)
+	rt.handle("/api/v1/cache/restore", s.handleRestore)
+	rt.handle("/api/v1/cache/bulk", s.handleBulkDelete)
+	rt.handle("/api/v1/cache/pin", s.handlePin)
+	rt.handle("/api/v1/cache/unpin", s.handleUnpin)
+}
+
+// registerV2 mounts the path-parameter API. Errors always use the JSON
+// envelope.
+func (s *Server) registerV2(rt *router) {
+	const repo = "/api/v2/repos/{owner}/{repo}"
+	rt.stream("GET "+repo+"/archive/{ref...}", s.handleV2Archive)
+	rt.handle("GET "+repo+"/commit", s.handleV2Commit)
+	rt.handle("GET "+repo+"/commit/{ref...}", s.handleV2Commit)
+	rt.stream("GET "+repo+"/files/{path...}", s.handleV2Files)
+	rt.handle("GET "+repo+"/branches", s.handleV2Branches)
+}
+
+// v2Repo returns "owner/repo" from the path parameters.
+func v2Repo(r *http.Request) string {
+	return repoArg(strings.TrimSpace(r.PathValue("owner")) + "/" + strings.TrimSpace(r.PathValue("repo")))
+}
+
+// handleV2Archive streams the archive of {ref} (the default when empty).
+// force, legacy, stale, strict, max_age, prerelease, root and prefix are
+// accepted as query parameters and Cache-Control request directives are
+// honoured like in v1.
+func (s *Server) handleV2Archive(w http.ResponseWriter, r *http.Request) {
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
+	strict, _ := strconv.ParseBool(r.URL.Query().Get("strict"))
+	stale, ok := stalePolicyParam(w, r)
+	if !ok {
+		return
+	}
+	maxAge, ok := maxAgeParam(w, r)
+	if !ok {
+		return
+	}
+	root, ok := rootParam(w, r)
+	if !ok {
+		return
+	}
+	prefix, ok := s.prefixParam(w, r, root)
+	if !ok {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+	req := archiveRequest{
+		user:       user,
+		token:      s.githubToken(r),
+		repo:       v2Repo(r),
+		branch:     strings.TrimSpace(r.PathValue("ref")),
+		force:      force,
+		legacy:     legacy,
+		normalize:  s.normalizeParam(r) || prefix != "",
+		root:       root,
+		prefix:     prefix,
+		stale:      stale,
+		strict:     strict,
+		maxAge:     maxAge,
+		prerelease: prereleaseParam(r),
+	}
+	applyCacheControl(r, &req)
+	s.serveArchive(ctx, w, r, req)
+}
+
+// handleV2Commit resolves {ref} (the default branch when omitted) without
+// downloading. The body is JSON unless format=text.
+func (s *Server) handleV2Commit(w http.ResponseWriter, r *http.Request) {
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	asJSON := !strings.EqualFold(strings.TrimSpace(r.URL.Query().Get("format")), "text")
+	s.serveRef(r.Context(), w, r, user, s.githubToken(r), v2Repo(r), strings.TrimSpace(r.PathValue("ref")), asJSON)
+}
+
+// handleV2Files exports {path} at ?ref= (default main) as a sparse zip.
+func (s *Server) handleV2Files(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := s.scope(w, r); !ok {
+		return
+	}
+	p := strings.Trim(r.PathValue("path"), "/")
+	if p == "" || strings.Contains(p, "..") || path.IsAbs(p) {
+		fail(w, r, http.StatusBadRequest, fmt.Sprintf("invalid path: %s", p))
+		return
+	}
+	s.serveSparse(w, r, s.githubToken(r), v2Repo(r), strings.TrimSpace(r.URL.Query().Get("ref")), []string{p})
+}
+
+// handleV2Branches reports the default branch and the caller's cached branches.
+func (s *Server) handleV2Branches(w http.ResponseWriter, r *http.Request) {
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	s.serveDefaultBranch(w, r, user, s.githubToken(r), v2Repo(r))
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+	"github-hub/internal/version"
+)
+
+func TestV2Routes(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{
+		ensurePath: zipPath,
+		refInfo:    &storage.RefInfo{Ref: "main", SHA: "0123456789abcdef0123456789abcdef01234567", Short: "0123456", Type: storage.RefBranch},
+		branchInfo: &storage.DefaultBranchInfo{Repo: "own/repo", DefaultBranch: "main", CachedBranches: []string{"main"}},
+	}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	t.Run("archive with slashed ref", func(t *testing.T) {
+		resp, _ := get("/api/v2/repos/own/repo/archive/feature/x")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+			t.Fatalf("status=%d type=%q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if fs.lastRepo != "own/repo" || fs.lastBranch != "feature/x" {
+			t.Fatalf("repo=%q branch=%q", fs.lastRepo, fs.lastBranch)
+		}
+	})
+
+	t.Run("commit defaults to JSON", func(t *testing.T) {
+		resp, body := get("/api/v2/repos/own/repo/commit")
+		var got storage.RefInfo
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &got) != nil || got.SHA != fs.refInfo.SHA {
+			t.Fatalf("status=%d body=%s", resp.StatusCode, body)
+		}
+		if fs.lastRef != "" {
+			t.Fatalf("ref=%q, want default", fs.lastRef)
+		}
+		_, body = get("/api/v2/repos/own/repo/commit/v1.2?format=text")
+		if string(body) != "0123456\n" || fs.lastRef != "v1.2" {
+			t.Fatalf("text body=%q ref=%q", body, fs.lastRef)
+		}
+	})
+
+	t.Run("branches", func(t *testing.T) {
+		resp, body := get("/api/v2/repos/own/repo/branches")
+		var got storage.DefaultBranchInfo
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &got) != nil || got.DefaultBranch != "main" {
+			t.Fatalf("status=%d body=%s", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("v2 errors use the envelope", func(t *testing.T) {
+		resp, body := get("/api/v2/repos/own/repo/files/a/..b")
+		var env errorBody
+		if resp.StatusCode != http.StatusBadRequest || json.Unmarshal(body, &env) != nil || env.Error.Code != CodeBadRequest {
+			t.Fatalf("status=%d body=%s", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("v1 errors stay plain text", func(t *testing.T) {
+		resp, body := get("/api/v1/download")
+		if resp.StatusCode != http.StatusBadRequest || string(body) != "missing repo\n" {
+			t.Fatalf("status=%d body=%q", resp.StatusCode, body)
+		}
+		if resp.Header.Get("X-GHH-Error-Code") != "" {
+			t.Fatalf("v1 plain error carries envelope header")
+		}
+	})
+}
+
+func TestRouteMiddlewareOrder(t *testing.T) {
+	rt := &router{s: NewServerWithStore(&fakeStore{}, "", "default")}
+	defer rt.s.Shutdown()
+	tests := []struct {
+		class routeClass
+		want  []string
+	}{
+		{metadataRoute, []string{"identify", "instrument", "clients", "cluster", "track", "deadline", "compress"}},
+		{fetchRoute, []string{"identify", "instrument", "clients", "cluster", "usage", "budget", "track", "deadline", "compress"}},
+		{streamRoute, []string{"identify", "instrument", "clients", "cluster", "usage", "budget", "track", "deadline"}},
+		{monitorRoute, []string{"identify", "instrument", "clients", "track", "deadline", "compress"}},
+	}
+	for _, tt := range tests {
+		var names []string
+		for _, mw := range rt.middlewares("/x", tt.class) {
+			names = append(names, mw.name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("class %d: middlewares %v, want %v", tt.class, names, tt.want)
+		}
+	}
+
+	var order []string
+	record := func(name string) middleware {
+		return middleware{name, func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(w, r)
+			})
+		}}
+	}
+	h := chain(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { order = append(order, "handler") }),
+		[]middleware{record("outer"), record("inner")})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []string{"outer", "inner", "handler"}; !slices.Equal(order, want) {
+		t.Fatalf("ran %v, want %v", order, want)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	origV, origC := version.Version, version.Commit
+	defer func() { version.Version, version.Commit = origV, origC }()
+	version.Version, version.Commit = "v1.2.3", "abc1234"
+
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	defer s.Shutdown()
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	tests := []struct {
+		path string
+		h    http.Handler
+	}{
+		{"/api/v1/version", mux},
+		{"/api/v1/download", mux}, // error answers too
+		{"/readyz", mux},
+		{"/api/v2/nope", Identify(mux)},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := rec.Header().Get("X-GHH-Server"); got != "github-hub/v1.2.3+abc1234" {
+			t.Errorf("%s: X-GHH-Server = %q (status %d)", tt.path, got, rec.Code)
+		}
+	}
+}
+
+func TestNewServerLogsMigration(t *testing.T) {
+	root := t.TempDir()
+	// A cache without a format file is format 1.
+	zipPath := filepath.Join(root, "users", "u", "repos", "owner", "repo", "main.zip")
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	createZip(t, zipPath)
+	var logs bytes.Buffer
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout, WithLogger(log.New(&logs, "", 0)), withStatsFile(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if !strings.Contains(logs.String(), "migrated cache format 1 to ") {
+		t.Fatalf("migration not logged through the server logger:\n%s", logs.String())
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	var logs bytes.Buffer
+	s := New(&fakeStore{},
+		WithDefaultUser("ci"),
+		WithToken("tok"),
+		WithLogger(log.New(&logs, "", 0)),
+		WithLimits(Limits{MetadataTimeout: time.Second, UploadMax: -1}),
+	)
+	defer s.Shutdown()
+	if s.defaultUser != "ci" || s.token != "tok" {
+		t.Fatalf("defaultUser=%q token=%q", s.defaultUser, s.token)
+	}
+	if s.metadataTO != time.Second || s.downloadTO != defaultDownloadTimeout || s.uploadMax != -1 {
+		t.Fatalf("limits metadata=%v download=%v upload=%d", s.metadataTO, s.downloadTO, s.uploadMax)
+	}
+	s.logf("hello %d\n", 1)
+	if logs.String() != "hello 1\n" {
+		t.Fatalf("logged %q", logs.String())
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// segmentStore is implemented by stores that can serve archives in
+// verified chunks.
+type segmentStore interface {
+	ArchiveSegments(zipPath string, chunkSize int64) (*storage.SegmentManifest, error)
+	OpenSegment(zipPath string, chunkSize int64, index int) (*storage.Segment, io.ReadCloser, error)
+}
+
+// segmentArchive is the archive a segments request is about: with commit=
+// the one held at that commit (current or kept), which never downloads, so
+// every chunk of a manifest comes from the same archive even when the
+// branch moves; otherwise the branch's archive, ensured as for downloads.
+func (s *Server) segmentArchive(w http.ResponseWriter, r *http.Request, op string) (segmentStore, string, bool) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return nil, "", false
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	seg, ok := s.store.(segmentStore)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "segmented downloads are not supported by this store")
+		return nil, "", false
+	}
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	branch := strings.TrimSpace(q.Get("branch"))
+	commit := strings.TrimSpace(q.Get("commit"))
+	legacy, _ := strconv.ParseBool(q.Get("legacy"))
+	if repo == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return nil, "", false
+	}
+	if !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return nil, "", false
+	}
+	if commit != "" {
+		zipPath, meta, err := s.store.ArchiveAt(user, repo, branch, commit)
+		if err != nil {
+			s.logf("%s error user=%s repo=%s branch=%s commit=%s err=%v\n", op, user, repo, branch, commit, err)
+			if errors.Is(err, storage.ErrNotFound) {
+				fail(w, r, http.StatusNotFound, "archive at commit: "+err.Error())
+				return nil, "", false
+			}
+			failErr(w, r, "archive at commit", err)
+			return nil, "", false
+		}
+		setCommitHeaders(w, meta.CommitSHA, s.shortSHA(meta.CommitSHA))
+		setCacheLabel(r, storage.CacheHit)
+		return seg, zipPath, true
+	}
+	token := s.githubToken(r)
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+	var outcome storage.CacheOutcome
+	res, err := s.store.EnsureRepoResult(storage.WithOutcome(ctx, &outcome), user, repo, branch, token, false, legacy)
+	setCacheLabel(r, outcome)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("%s error user=%s repo=%s branch=%s err=%v\n", op, user, repo, branch, err)
+		failErr(w, r, "ensure repo", err)
+		return nil, "", false
+	}
+	setCommitHeaders(w, res.CommitSHA, res.ShortSHA)
+	return seg, res.Path, true
+}
+
+// handleDownloadSegments answers the SegmentManifest of repo@branch: the
+// archive's digest and size and, per chunk, its offset, length and
+// SHA-256, so a client can fetch the chunks with handleDownloadSegment and
+// retry each one on its own.
+func (s *Server) handleDownloadSegments(w http.ResponseWriter, r *http.Request) {
+	seg, zipPath, ok := s.segmentArchive(w, r, "segments")
+	if !ok {
+		return
+	}
+	m, err := seg.ArchiveSegments(zipPath, s.segmentSize)
+	if err != nil {
+		s.logf("segments error zip=%s err=%v\n", zipPath, err)
+		failErr(w, r, "segments", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(m)
+}
+
+// handleDownloadSegment streams chunk index= of repo@branch with its
+// SHA-256 in X-GHH-Segment-SHA256. Clients pass the manifest's commit as
+// commit= so the chunks they reassemble belong to one archive.
+func (s *Server) handleDownloadSegment(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("index")))
+	if err != nil || index < 0 {
+		fail(w, r, http.StatusBadRequest, "index must be a chunk number")
+		return
+	}
+	seg, zipPath, ok := s.segmentArchive(w, r, "segment")
+	if !ok {
+		return
+	}
+	chunk, rc, err := seg.OpenSegment(zipPath, s.segmentSize, index)
+	if err != nil {
+		s.logf("segment error zip=%s index=%d err=%v\n", zipPath, index, err)
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "segment: "+err.Error())
+			return
+		}
+		failErr(w, r, "segment", err)
+		return
+	}
+	defer func() { _ = rc.Close() }()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(chunk.Length, 10))
+	w.Header().Set("X-GHH-Segment-Index", strconv.Itoa(chunk.Index))
+	w.Header().Set("X-GHH-Segment-Offset", strconv.FormatInt(chunk.Offset, 10))
+	w.Header().Set("X-GHH-Segment-SHA256", chunk.SHA256)
+	if _, err := io.Copy(w, rc); err != nil {
+		s.logf("segment stream error zip=%s index=%d err=%v\n", zipPath, index, err)
+	}
+}
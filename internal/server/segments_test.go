@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github-hub/internal/storage"
+)
+
+func TestDownloadSegmentEndpoints(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.segmentSize = 4
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	archive := []byte("ten bytes!")
+	sum := sha256.Sum256(archive)
+	zipPath := filepath.Join(root, "users", "default", "repos", "own", "repo", "main.zip")
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipPath, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	meta := fmt.Sprintf(`{"repo":"own/repo","branch":"main","commit_sha":%q,"sha256":%q,"size":%d,"pinned":true}`, commit, hex.EncodeToString(sum[:]), len(archive))
+	if err := os.WriteFile(filepath.Join(filepath.Dir(zipPath), "main.meta.json"), []byte(meta), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	rec := get("/api/v1/download/segments?repo=own/repo&branch=main")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("segments: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var m storage.SegmentManifest
+	if err := json.NewDecoder(rec.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Commit != commit || m.TotalSize != 10 || m.ChunkSize != 4 || len(m.Chunks) != 3 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	var got []byte
+	for _, seg := range m.Chunks {
+		rec := get(fmt.Sprintf("/api/v1/download/segment?repo=own/repo&branch=main&commit=%s&index=%d", commit[:12], seg.Index))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("segment %d: status %d: %s", seg.Index, rec.Code, rec.Body.String())
+		}
+		if h := rec.Header().Get("X-GHH-Segment-SHA256"); h != seg.SHA256 {
+			t.Fatalf("segment %d: checksum header %q, manifest %q", seg.Index, h, seg.SHA256)
+		}
+		b, _ := io.ReadAll(rec.Body)
+		got = append(got, b...)
+	}
+	if string(got) != string(archive) {
+		t.Fatalf("reassembled %q", got)
+	}
+
+	// A compressed archive is refused, so clients download it whole.
+	devPath := filepath.Join(filepath.Dir(zipPath), "dev.zip")
+	if err := os.WriteFile(devPath+".zst", []byte("not read"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	meta = fmt.Sprintf(`{"repo":"own/repo","branch":"dev","commit_sha":%q,"sha256":%q,"size":%d,"pinned":true}`, commit, hex.EncodeToString(sum[:]), len(archive))
+	if err := os.WriteFile(filepath.Join(filepath.Dir(zipPath), "dev.meta.json"), []byte(meta), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/api/v1/download/segments?repo=own/repo&branch=dev", "/api/v1/download/segment?repo=own/repo&branch=dev&index=0"} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusConflict || rec.Header().Get("X-GHH-Error-Code") != CodeNotSegmentable {
+			t.Fatalf("%s: status %d code %q: %s", url, rec.Code, rec.Header().Get("X-GHH-Error-Code"), rec.Body.String())
+		}
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"index out of range", "/api/v1/download/segment?repo=own/repo&branch=main&commit=" + commit + "&index=3", http.StatusNotFound},
+		{"bad index", "/api/v1/download/segment?repo=own/repo&branch=main&index=x", http.StatusBadRequest},
+		{"unknown commit", "/api/v1/download/segment?repo=own/repo&branch=main&commit=ffffffffffff&index=0", http.StatusNotFound},
+		{"missing repo", "/api/v1/download/segments?branch=main", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.url); rec.Code != tt.want {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+		}
+	}
+}
@@ -2,17 +2,19 @@ package server
 
 import (
 	"context"
-	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
+	"log"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github-hub/internal/storage"
@@ -21,21 +23,44 @@ import (
 
 const defaultDownloadTimeout = 30 * time.Minute
 
-//go:embed static/*
-var uiFS embed.FS
-
 // Store is the abstraction for workspace/cache storage used by the server.
 type Store interface {
-	EnsureRepo(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (string, error)
+	EnsureRepoResult(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (*storage.RepoArchive, error)
 	EnsurePackage(ctx context.Context, user, pkgURL string) (string, error)
 	EnsureBareRepo(ctx context.Context, ownerRepo, token string) (string, error)
 	ExportSparseZip(ctx context.Context, ownerRepo, branch string, paths []string, destZip string) (string, error)
 	ExportSparseDir(ctx context.Context, ownerRepo, branch string, paths []string, destDir string) (string, error)
 	List(rel string) ([]storage.Entry, error)
+	ListPage(rel string, opts storage.ListOptions) ([]storage.Entry, string, error)
 	Delete(rel string, recursive bool) error
 	Touch(rel string) error
 	CleanupExpired(ttl time.Duration) error
 	ReadRepoInfo(zipPath string) (*storage.RepoInfo, error)
+	ReadArchiveMeta(zipPath string) (*storage.ArchiveMeta, error)
+	VerifyArchive(zipPath string) error
+	ResolveRef(ctx context.Context, user, ownerRepo, ref, token string) (*storage.RefInfo, error)
+	DefaultBranch(ctx context.Context, user, ownerRepo, token string) (*storage.DefaultBranchInfo, error)
+	ListCommits(ctx context.Context, ownerRepo, ref, sinceSHA string, limit int, token string) ([]storage.CommitEntry, error)
+	ListPackages(user string) ([]storage.PackageMeta, error)
+	ListPackagesPage(user string, opts storage.ListOptions) ([]storage.PackageMeta, string, error)
+	LookupPackage(user, pkgURL string) (*storage.PackageMeta, error)
+	DeletePackage(user, pkgURL string) error
+	StorePackage(user, key string, body io.Reader, maxBytes int64, overwrite bool) (*storage.PackageMeta, error)
+	RemoveArchive(zipPath string) error
+	ArchiveAt(user, ownerRepo, branch, commit string) (string, *storage.ArchiveMeta, error)
+	OpenArchive(zipPath string) (io.ReadCloser, error)
+	NormalizedArchive(zipPath string, root storage.RootMode) (*storage.RepoArchive, error)
+	RerootArchive(w io.Writer, zipPath string, root storage.RootMode) (int64, error)
+	ArchiveManifest(w io.Writer, zipPath string, limits storage.ManifestLimits) (int64, error)
+	Patch(ctx context.Context, user, ownerRepo, branch, from, to, token string, maxBytes int64) (*storage.Patch, error)
+	BranchStatus(ctx context.Context, user, ownerRepo, branch, token string, remote bool) (*storage.BranchStatus, error)
+	CachedBranches(ctx context.Context, user, ownerRepo, token string, remote bool) ([]storage.CachedBranch, error)
+	ValidateToken(ctx context.Context, token, ownerRepo string) (*storage.TokenValidation, error)
+	Rollback(user, ownerRepo, branch string) (*storage.ArchiveMeta, error)
+	ArchiveSignature(zipPath string) (*storage.ArchiveSignature, error)
+	ListTrash() ([]storage.TrashEntry, error)
+	Restore(id string) (*storage.TrashEntry, error)
+	DeleteMatching(pattern string, dryRun bool) (*storage.BulkDelete, error)
 }
 
 type Server struct {
@@ -43,15 +68,103 @@ type Server struct {
 	token       string
 	defaultUser string
 	downloadTO  time.Duration
+	apiKeys     map[string]Principal
+	metrics     *requestMetrics
+	compressMin int
+	// metadataTO bounds routes that only consult metadata; downloadTO bounds
+	// routes that may populate the cache.
+	metadataTO time.Duration
+	// completeOnDisconnect lets a cache population finish after its client
+	// has gone away instead of cancelling it.
+	completeOnDisconnect bool
+	// serveStaleOnGone serves the last cached archive of a branch deleted
+	// upstream (flagged with X-GHH-Stale) instead of answering 410.
+	serveStaleOnGone bool
+	// strictVerification refuses archives that cannot be verified against
+	// the branch head, stale and branch-deleted ones included.
+	strictVerification bool
+	// cluster routes users to the instances that own them (SetCluster);
+	// nil outside cluster mode.
+	cluster *cluster
+	// clients counts API usage per route and client; deprecations are
+	// the routes and parameters flagged as deprecated (SetDeprecations).
+	clients      *clientUsage
+	deprecations atomic.Pointer[[]Deprecation]
+	// normalizeArchives serves the deterministic repack of each archive
+	// unless a download asks for normalize=false.
+	normalizeArchives bool
+	// inflight tracks requests in flight and caps them (SetMaxInflight).
+	inflight *inflight
+	// signing holds the keys archive signatures are made and published
+	// with; nil disables signing.
+	signing *storage.SigningKeys
+	// urlSigning signs download URLs (see SetURLSigning).
+	urlSigning *urlSigning
+	// publicURL and trustedProxies decide the scheme and host of the URLs
+	// the server hands out (see SetPublicURL).
+	publicURL      *url.URL
+	trustedProxies []netip.Prefix
+	// sharedRepos maps repos/ paths to the shared archive cache
+	// (storage.LayoutShared).
+	sharedRepos bool
+	// repoPolicy limits which owner/repo names may be fetched.
+	repoPolicy atomic.Pointer[storage.RepoPolicy]
+	// tokenRoutes picks the credential for requests without a token.
+	tokenRoutes atomic.Pointer[storage.TokenRoutes]
+	// uploadMax caps package uploads in bytes (<= 0: unlimited).
+	uploadMax int64
+	// manifestLimits caps the archives a manifest is built for.
+	manifestLimits storage.ManifestLimits
+	// segmentSize is the chunk size of segment manifests; 0 is
+	// storage.DefaultSegmentSize.
+	segmentSize int64
+	// patchMax caps served diffs; 0 means the storage default.
+	patchMax int64
+	// shortSHALen is the length of X-GHH-Commit-Short where the server
+	// abbreviates itself; see SetShortSHALength.
+	shortSHALen int
+	// stats counts archive downloads per user/repo/branch.
+	stats              *repoStats
+	statsFlushInterval time.Duration
+	// mirror keeps the manifest's repos fresh.
+	mirror *mirror
+	// revalidate rechecks recently served branches in the background.
+	revalidate *revalidator
+	// warmup revalidates the most recently used branches at startup.
+	warmup *warmup
+	// webhook delivers storage events to an external URL, when set.
+	webhook *webhook
+	// usage counts cache usage over the last hour and day; events feeds
+	// it the built-in storage's evictions (nil for other stores).
+	usage  *usage
+	events *eventTap
+	// downloadMetrics observes upstream downloads, when metrics are on.
+	downloadMetrics storage.DownloadObserver
+	// webUI serves the embedded cache browser at /.
+	webUI bool
+	// logger receives the server's log lines (see WithLogger).
+	logger *log.Logger
+	// statsPath overrides where stats persist (see New).
+	statsPath *string
+	// budgets counts download bytes per user and day against the daily
+	// byte budget; it persists beside the stats.
+	budgets *budgets
 
 	cleanupInterval time.Duration
 	ttl             time.Duration
 
 	janitorCtx    context.Context
 	janitorCancel context.CancelFunc
+	// statsFlushed is closed once flushStats wrote the stats a last time,
+	// touchesFlushed once flushTouches wrote the pending access times.
+	statsFlushed   chan struct{}
+	touchesFlushed chan struct{}
 }
 
-func NewServer(root, defaultUser, githubToken string, downloadTimeout time.Duration) (*Server, error) {
+// NewServer creates a Server caching under root with the built-in storage,
+// whose HTTP client shares the download timeout. opts are applied after
+// the ones NewServer derives from its arguments.
+func NewServer(root, defaultUser, githubToken string, downloadTimeout time.Duration, opts ...Option) (*Server, error) {
 	if err := os.MkdirAll(root, 0o755); err != nil {
 		return nil, err
 	}
@@ -60,62 +173,251 @@ func NewServer(root, defaultUser, githubToken string, downloadTimeout time.Durat
 	}
 	// Pass download timeout to storage HTTP client
 	st := storage.NewWithTimeout(root, downloadTimeout)
-	ctx, cancel := context.WithCancel(context.Background())
-	s := &Server{
-		store:           st,
-		token:           githubToken,
-		defaultUser:     defaultUser,
-		downloadTO:      downloadTimeout,
-		cleanupInterval: time.Minute,
-		ttl:             24 * time.Hour,
-		janitorCtx:      ctx,
-		janitorCancel:   cancel,
-	}
-	go s.startJanitor()
+	migrated, err := st.MigrateFormat()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithDefaultUser(defaultUser), WithToken(githubToken), WithLimits(Limits{DownloadTimeout: downloadTimeout})}, opts...)
+	s := New(st, opts...)
+	for _, m := range migrated {
+		s.logf("migrated cache format %d to %d: %d archives\n", m.From, m.To, m.Archives)
+	}
+	if n, err := st.BackfillFetchedAt(); err != nil {
+		s.logf("backfill fetched-at: %v\n", err)
+	} else if n > 0 {
+		s.logf("backfilled fetched-at for %d cached archives\n", n)
+	}
 	return s, nil
 }
 
-// NewServerWithStore allows tests to inject a fake store.
+// NewServerWithStore allows tests to inject a fake store. Stats are kept in
+// memory only.
+//
+// Deprecated: use New(store, WithToken(githubToken), WithDefaultUser(defaultUser)).
 func NewServerWithStore(store Store, githubToken, defaultUser string) *Server {
-	ctx, cancel := context.WithCancel(context.Background())
-	s := &Server{
-		store:           store,
-		token:           githubToken,
-		defaultUser:     defaultUser,
-		downloadTO:      defaultDownloadTimeout,
-		cleanupInterval: time.Minute,
-		ttl:             24 * time.Hour,
-		janitorCtx:      ctx,
-		janitorCancel:   cancel,
+	return New(store, WithToken(githubToken), WithDefaultUser(defaultUser), withStatsFile(""))
+}
+
+// SetRetention configures the per-repo archive cap on the built-in storage.
+// It has no effect on injected stores.
+func (s *Server) SetRetention(p storage.RetentionPolicy, onEnsure bool) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.Retention = p
+		st.RetainOnEnsure = onEnsure
+	}
+}
+
+// SetBranchGonePolicy chooses how archive downloads react to a branch that
+// was deleted upstream: serveStale=true keeps serving the cached archive with
+// an X-GHH-Stale header, false answers 410 Gone. purgeAfter (0 = never) lets
+// cleanup remove such archives once the deletion is older than the grace
+// period; it only applies to the built-in storage.
+func (s *Server) SetBranchGonePolicy(serveStale bool, purgeAfter time.Duration) {
+	s.serveStaleOnGone = serveStale
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.GonePurgeAfter = purgeAfter
+	}
+}
+
+// SetKeepPrevious keeps n replaced archives per branch so they can be
+// downloaded with commit= and restored with rollback. It only applies to the
+// built-in storage.
+func (s *Server) SetKeepPrevious(n int) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.KeepPrevious = n
+	}
+}
+
+// SetTrash makes cache deletes soft: deleted items move to the trash,
+// can be restored with POST /api/v1/cache/restore and are purged by the
+// janitor after retention (0 = kept). It only applies to the built-in
+// storage.
+func (s *Server) SetTrash(enabled bool, retention time.Duration) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.TrashDeletes = enabled
+		st.TrashRetention = retention
+	}
+}
+
+// SetNormalizeArchives makes archive downloads serve the normalized repack
+// (see storage.NormalizedArchive) by default; normalize= overrides it per
+// request.
+func (s *Server) SetNormalizeArchives(enabled bool) {
+	s.normalizeArchives = enabled
+}
+
+// SetArchiveCompression stores newly cached repo archives zstd-compressed
+// at rest. Archives already cached are served either way. It only applies
+// to the built-in storage.
+func (s *Server) SetArchiveCompression(enabled bool) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.CompressArchives = enabled
+	}
+}
+
+// SetEncryption encrypts newly cached archives and packages at rest with
+// keys; nil stops encrypting new files. Encrypted files already cached need
+// their key in keys to be served. It only applies to the built-in storage.
+func (s *Server) SetEncryption(keys storage.KeyProvider) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.Keys = keys
+	}
+}
+
+// SetUserAgent overrides the User-Agent of outgoing requests; empty keeps
+// storage.DefaultUserAgent. It only applies to the built-in storage.
+func (s *Server) SetUserAgent(ua string) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.UserAgent = ua
+	}
+}
+
+// SetCacheLayout chooses where repo archives are cached (see
+// storage.CacheLayout). With storage.LayoutShared a user's repos/ paths
+// resolve to the shared tree, which only admins may modify. It only applies
+// to the built-in storage.
+func (s *Server) SetCacheLayout(l storage.CacheLayout) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.Layout = l
+		s.sharedRepos = l == storage.LayoutShared
+	}
+}
+
+// SetDownloadTempDir makes downloads stream into dir and move into the
+// cache once complete; empty keeps temp files beside their destination. It
+// only applies to the built-in storage.
+func (s *Server) SetDownloadTempDir(dir string) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.TempDir = dir
+	}
+}
+
+// SetSpaceReserve sets the free space downloads must leave on disk (0 =
+// storage.DefaultSpaceReserve, negative = no checks) and whether a download
+// that would not fit evicts least recently used archives first. Downloads
+// that still do not fit fail with 507. It only applies to the built-in
+// storage.
+func (s *Server) SetSpaceReserve(reserve int64, emergencyCleanup bool) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SpaceReserve = reserve
+		st.SpaceEmergencyCleanup = emergencyCleanup
+	}
+}
+
+// SetStalePolicy chooses what archive downloads do when a branch's upstream
+// commit cannot be fetched (see storage.StalePolicy). It only applies to
+// the built-in storage; requests may still override it with stale=.
+func (s *Server) SetStalePolicy(p storage.StalePolicy) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.StalePolicy = p
+	}
+}
+
+// SetStrictVerification makes archive downloads fail instead of serving an
+// archive that cannot be verified against the branch head: a stale one, one
+// whose branch was deleted (overriding SetBranchGonePolicy), one pinned by a
+// rollback or one asked for only-if-cached (see
+// storage.Storage.StrictVerification). Requests may turn it on with
+// strict=true, not off; force=true still downloads.
+func (s *Server) SetStrictVerification(on bool) {
+	s.strictVerification = on
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.StrictVerification = on
+	}
+}
+
+// SetUpstreamTransport tunes the connection pool of the built-in storage's
+// upstream client (see storage.TransportOptions).
+func (s *Server) SetUpstreamTransport(o storage.TransportOptions) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SetTransport(o)
+	}
+}
+
+// SetPackageRedirects sets the redirect policy of the built-in storage's
+// package downloads (see storage.RedirectPolicy).
+func (s *Server) SetPackageRedirects(p storage.RedirectPolicy) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.Redirects = p
+	}
+}
+
+// SetPackageHostCheck sets the check the built-in storage's package
+// downloads apply to the package URL and every redirect hop (see
+// storage.PublicHostCheck); nil checks nothing.
+func (s *Server) SetPackageHostCheck(check func(context.Context, *url.URL) error) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.PackageHostCheck = check
+	}
+}
+
+// SetShortSHALength sets the length of short commit SHAs: the
+// X-GHH-Commit-Short header, download/commit?short=true and the built-in
+// storage's .commit.txt sidecars. 0 means storage.DefaultShortSHALen.
+func (s *Server) SetShortSHALength(n int) {
+	s.shortSHALen = n
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.ShortSHALen = n
+	}
+}
+
+// shortSHA abbreviates sha as SetShortSHALength says.
+func (s *Server) shortSHA(sha string) string {
+	n := s.shortSHALen
+	if n <= 0 {
+		n = storage.DefaultShortSHALen
+	}
+	if len(sha) > n {
+		return sha[:n]
+	}
+	return sha
+}
+
+// SetPackageMirrors installs the package mirror rewrite rules of the
+// built-in storage (see storage.PackageMirrors). It may be called again
+// while serving; nil downloads packages from their own URLs.
+func (s *Server) SetPackageMirrors(m *storage.PackageMirrors) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SetPackageMirrors(m)
 	}
-	go s.startJanitor()
-	return s
 }
 
+// SetPackagePolicy installs the allow/deny rules for package URLs of the
+// built-in storage (see storage.PackagePolicy). It may be called again
+// while serving; nil allows every URL. Denied downloads answer 403
+// policy_denied.
+func (s *Server) SetPackagePolicy(p *storage.PackagePolicy) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SetPackagePolicy(p)
+	}
+}
+
+// RegisterRoutes mounts every API version, /readyz, /metrics (when
+// enabled) and the web UI (when enabled) on mux.
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/api/v1/version", handleVersion)
-	mux.HandleFunc("/api/v1/download", s.handleDownload)
-	mux.HandleFunc("/api/v1/download/commit", s.handleDownloadCommit)
-	mux.HandleFunc("/api/v1/download/info", s.handleDownloadInfo)
-	mux.HandleFunc("/api/v1/download/package", s.handleDownloadPackage)
-	mux.HandleFunc("/api/v1/download/sparse", s.handleDownloadSparse)
-	mux.HandleFunc("/api/v1/branch/switch", s.handleBranchSwitch)
-	mux.HandleFunc("/api/v1/dir/list", s.handleDirList)
-	mux.HandleFunc("/api/v1/dir", s.handleDir)
-	// Static UI for browsing cached workspace
-	sub, _ := fs.Sub(uiFS, "static")
-	mux.Handle("/", http.FileServer(http.FS(sub)))
+	rt := &router{s: s, mux: mux}
+	s.registerV1(rt)
+	s.registerV2(rt)
+	mux.Handle("/readyz", Identify(http.HandlerFunc(s.handleReadyz)))
+	if s.metrics != nil {
+		mux.Handle("/metrics", Identify(s.metrics.registry.Handler()))
+	}
+	if s.webUI {
+		mux.Handle("/", Identify(s.uiHandler()))
+	}
 }
 
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	info := map[string]string{
 		"version":    version.Version,
 		"commit":     version.Commit,
 		"build_date": version.BuildDate,
+		// cache_format is the on-disk format this build writes.
+		"cache_format": strconv.Itoa(storage.CacheFormat),
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	_ = json.NewEncoder(w).Encode(info)
@@ -123,34 +425,75 @@ func handleVersion(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	user := s.resolveUser(r)
-	token := tokenFromRequest(r, s.token)
-	repo := strings.TrimSpace(r.URL.Query().Get("repo"))
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	format, contentType, ok := s.formatParam(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
 	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
+	if branch == "" {
+		// ref= names the same thing; ref=latest-release follows releases.
+		branch = strings.TrimSpace(r.URL.Query().Get("ref"))
+	}
+	branch, ok = pullParam(w, r, branch)
+	if !ok {
+		return
+	}
+	fallback, ok := fallbackParam(w, r)
+	if !ok {
+		return
+	}
 	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
 	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
+	strict, _ := strconv.ParseBool(r.URL.Query().Get("strict"))
 	debugDelayStr := strings.TrimSpace(r.URL.Query().Get("debug_delay"))
 	debugStreamDelayStr := strings.TrimSpace(r.URL.Query().Get("debug_stream_delay"))
 	if repo == "" {
-		http.Error(w, "missing repo", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "missing repo")
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), s.downloadTO)
+	// commit= serves a kept archive of the branch; it never downloads.
+	if commit := strings.TrimSpace(r.URL.Query().Get("commit")); commit != "" {
+		s.serveRetained(w, r, user, repo, branch, commit)
+		return
+	}
+	stale, ok := stalePolicyParam(w, r)
+	if !ok {
+		return
+	}
+	maxAge, ok := maxAgeParam(w, r)
+	if !ok {
+		return
+	}
+	root, ok := rootParam(w, r)
+	if !ok {
+		return
+	}
+	prefix, ok := s.prefixParam(w, r, root)
+	if !ok {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
 	defer cancel()
 
 	// DEBUG: simulate slow network by adding delay per read chunk during download
 	if debugDelayStr != "" {
 		debugDelay, err := time.ParseDuration(debugDelayStr)
 		if err == nil && debugDelay > 0 {
-			fmt.Printf("DEBUG: client requested slow network simulation (%s per chunk) for repo=%s\n", debugDelay, repo)
+			s.logf("DEBUG: client requested slow network simulation (%s per chunk) for repo=%s\n", debugDelay, repo)
 			if st, ok := s.store.(*storage.Storage); ok {
 				st.DebugSlowReader = debugDelay
 				defer func() { st.DebugSlowReader = 0 }() // cleanup after request
 			}
-			force = true // ensure we actually download from GitHub (bypass cache)
+			force = true  // ensure we actually download from GitHub (bypass cache)
 			legacy = true // debug slow reader only works with legacy mode
 		}
 	}
@@ -158,154 +501,515 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	if debugStreamDelayStr != "" {
 		if d, err := time.ParseDuration(debugStreamDelayStr); err == nil && d > 0 {
 			streamDelay = d
-			fmt.Printf("DEBUG: client requested slow stream (%s) for repo=%s\n", d, repo)
+			s.logf("DEBUG: client requested slow stream (%s) for repo=%s\n", d, repo)
 		}
 	}
 
-	// Ensure cached copy exists (download if missing), and then stream a zip.
-	// If branch is empty, EnsureRepo will use "main" (git mode) or fetch default from GitHub (legacy mode).
-	// If force is true, bypass cache validation and always download fresh.
-	// If legacy is true, use old GitHub zipball API instead of git archive.
-	zipPath, err := s.store.EnsureRepo(ctx, user, repo, branch, token, force, legacy)
-	if err != nil {
-		fmt.Printf("download error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
-		httpError(w, "ensure repo", err)
-		return
-	}
-	// Extract actual branch name from zipPath (e.g., "main.zip" -> "main")
-	actualBranch := strings.TrimSuffix(filepath.Base(zipPath), ".zip")
-	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
-	if commit := readCommitFile(commitPath); commit != "" {
-		w.Header().Set("X-GHH-Commit", commit)
-	}
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", safeName(repo, actualBranch)))
-	// Update access time for the zip file itself
-	zipRelPath := s.userPath(user, filepath.Join("repos", repo, actualBranch+".zip"))
-	_ = s.store.Touch(zipRelPath)
-	f, err := os.Open(zipPath)
-	if err != nil {
-		fmt.Printf("zip open error user=%s repo=%s branch=%s err=%v\n", user, repo, actualBranch, err)
-		httpError(w, "open zip", err)
-		return
-	}
-	defer func() { _ = f.Close() }()
-	var reader io.Reader = f
-	if fi, err := f.Stat(); err == nil {
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-		if streamDelay > 0 {
-			reader = newSlowReader(f, r.Context(), streamDelay, fi.Size())
-		}
-	} else if streamDelay > 0 {
-		reader = newSlowReader(f, r.Context(), streamDelay, -1)
-	}
-	if _, err := io.Copy(w, reader); err != nil {
-		fmt.Printf("zip stream error user=%s repo=%s branch=%s err=%v\n", user, repo, actualBranch, err)
-		return
-	}
-	fmt.Printf("download ok user=%s repo=%s branch=%s zip=%s\n", user, repo, actualBranch, zipPath)
+	req := archiveRequest{
+		user:        user,
+		token:       token,
+		repo:        repo,
+		branch:      branch,
+		force:       force,
+		legacy:      legacy,
+		normalize:   s.normalizeParam(r) || prefix != "",
+		root:        root,
+		prefix:      prefix,
+		stale:       stale,
+		strict:      strict,
+		maxAge:      maxAge,
+		prerelease:  prereleaseParam(r),
+		fallback:    fallback,
+		format:      format,
+		contentType: contentType,
+		streamDelay: streamDelay,
+	}
+	applyCacheControl(r, &req)
+	s.serveArchive(ctx, w, r, req)
 }
 
 func (s *Server) handleDownloadCommit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	user := s.resolveUser(r)
-	token := tokenFromRequest(r, s.token)
-	repo := strings.TrimSpace(r.URL.Query().Get("repo"))
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
 	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
 	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
 	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
 	if repo == "" {
-		http.Error(w, "missing repo", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	if !refParam(w, r, branch) {
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), s.downloadTO)
+	if !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
 	defer cancel()
+	if prereleaseParam(r) {
+		ctx = storage.WithPrereleases(ctx, true)
+	}
 
-	zipPath, err := s.store.EnsureRepo(ctx, user, repo, branch, token, force, legacy)
+	// ref= and JSON callers resolve through the GitHub API without fetching
+	// the archive; plain branch= requests keep reading the cached sidecar.
+	ref, hasRef := r.URL.Query()["ref"]
+	if (hasRef || wantsJSON(r)) && !force {
+		target := branch
+		if hasRef {
+			target = strings.TrimSpace(ref[0])
+		}
+		s.serveRef(ctx, w, r, user, token, repo, target, wantsJSON(r))
+		return
+	}
+
+	res, err := s.store.EnsureRepoResult(ctx, user, repo, branch, token, force, legacy)
 	if err != nil {
-		fmt.Printf("download commit error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
-		httpError(w, "ensure repo", err)
+		err = redactToken(err, token)
+		s.logf("download commit error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "ensure repo", err)
 		return
 	}
-	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
-	commit := readCommitFile(commitPath)
+	commit := res.CommitSHA
+	if short, _ := strconv.ParseBool(r.URL.Query().Get("short")); short || commit == "" {
+		commit = res.ShortSHA
+	}
 	if commit == "" {
-		http.NotFound(w, r)
+		fail(w, r, http.StatusNotFound, "404 page not found")
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	_, _ = w.Write([]byte(commit + "\n"))
 }
 
+func (s *Server) handleDefaultBranch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	s.serveDefaultBranch(w, r, user, token, repo)
+}
+
+// handleRepoCommits lists commits on ref, newest first. With since set to
+// the SHA of a cached archive it reports what the cache is missing.
+func (s *Server) handleRepoCommits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	if _, _, ok := s.scope(w, r); !ok {
+		return
+	}
+	token := s.githubToken(r)
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	limit := 0
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	if err := s.repoPolicy.Load().Check(repo); err != nil {
+		jsonError(w, "repo policy", err)
+		return
+	}
+	ref := strings.TrimSpace(q.Get("ref"))
+	if err := storage.ValidateRef(ref); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	commits, err := s.store.ListCommits(r.Context(), repo, ref, q.Get("since"), limit, token)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("list commits error repo=%s ref=%s err=%v\n", repo, ref, err)
+		jsonError(w, "list commits", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(commits)
+}
+
+// handleRepoInfo reports everything known about the user's cached archive
+// of a branch in one document. Only the cache is read unless check=remote
+// (one GitHub API call, for stale and canonical_repo) or ensure=true
+// (download when not cached) is passed.
+func (s *Server) handleRepoInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	branch := strings.TrimSpace(q.Get("branch"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	if err := storage.ValidateRef(branch); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	var remote bool
+	switch check := strings.TrimSpace(q.Get("check")); check {
+	case "", "local":
+	case "remote":
+		remote = true
+	default:
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("check must be \"local\" or \"remote\", got %q", check))
+		return
+	}
+	ensure, _ := strconv.ParseBool(q.Get("ensure"))
+	legacy, _ := strconv.ParseBool(q.Get("legacy"))
+	if err := s.repoPolicy.Load().Check(repo); err != nil {
+		jsonError(w, "repo policy", err)
+		return
+	}
+	if ensure {
+		st, err := s.store.BranchStatus(r.Context(), user, repo, branch, token, false)
+		if err == nil && !st.Cached {
+			ctx, cancel := s.populateContext(r.Context())
+			var outcome storage.CacheOutcome
+			_, err = s.store.EnsureRepoResult(storage.WithOutcome(ctx, &outcome), user, repo, branch, token, false, legacy)
+			setCacheLabel(r, outcome)
+			cancel()
+		}
+		if err != nil {
+			err = redactToken(err, token)
+			s.logf("repo info error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+			jsonError(w, "ensure repo", err)
+			return
+		}
+	}
+	st, err := s.store.BranchStatus(r.Context(), user, repo, branch, token, remote)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("repo info error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		jsonError(w, "repo info", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// handleCachedBranches lists the branches the effective user holds archives
+// for in repo, so clients can tell which are warm before switching. It never
+// downloads; check=remote adds a stale flag per branch.
+func (s *Server) handleCachedBranches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	var remote bool
+	switch check := strings.TrimSpace(q.Get("check")); check {
+	case "", "local":
+	case "remote":
+		remote = true
+	default:
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("check must be \"local\" or \"remote\", got %q", check))
+		return
+	}
+	if err := s.repoPolicy.Load().Check(repo); err != nil {
+		jsonError(w, "repo policy", err)
+		return
+	}
+	branches, err := s.store.CachedBranches(r.Context(), user, repo, token, remote)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("cached branches error user=%s repo=%s err=%v\n", user, repo, err)
+		jsonError(w, "cached branches", err)
+		return
+	}
+	for i := range branches {
+		if branches[i].CheckError != "" {
+			branches[i].CheckError = redactToken(errors.New(branches[i].CheckError), token).Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"repo": repo, "branches": branches})
+}
+
+// handleTokenValidate checks a GitHub token before it is relied on: the
+// JSON body's token (else the one the request would use for downloads)
+// against GitHub and, with repo set, against that repository. The answer is
+// 200 with valid=false when GitHub rejects it.
+func (s *Server) handleTokenValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+		Repo  string `json:"repo"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid json")
+		return
+	}
+	repo := repoArg(req.Repo)
+	if repo == "" {
+		repo = repoArg(r.URL.Query().Get("repo"))
+	}
+	if repo != "" {
+		if err := s.repoPolicy.Load().Check(repo); err != nil {
+			jsonError(w, "repo policy", err)
+			return
+		}
+	}
+	token := strings.TrimSpace(req.Token)
+	if token == "" {
+		token = s.githubToken(r)
+	}
+	// Without a token of its own, check the credential downloads of repo
+	// would be routed to.
+	var credential string
+	if routes := s.tokenRoutes.Load(); token == "" && routes != nil && repo != "" {
+		credential, token = routes.Resolve(repo)
+		if token == "" {
+			s.logf("token validate user=%s repo=%s credential=%s anonymous\n", user, repo, credential)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_ = json.NewEncoder(w).Encode(&storage.TokenValidation{
+				Kind:       storage.TokenNone,
+				Repo:       repo,
+				Credential: credential,
+				Problem:    "credential " + credential + " has no token; requests go to GitHub anonymously",
+			})
+			return
+		}
+	}
+	if token == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing token")
+		return
+	}
+	res, err := s.store.ValidateToken(r.Context(), token, repo)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("token validate error user=%s repo=%s credential=%s err=%v\n", user, repo, credential, err)
+		jsonError(w, "validate token", err)
+		return
+	}
+	res.Credential = credential
+	s.logf("token validate user=%s repo=%s credential=%s kind=%s valid=%v\n", user, repo, credential, res.Kind, res.Valid)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// handleDownloadRollback makes the previous kept archive of a branch the
+// current one (see storage.Rollback) and returns its metadata.
+func (s *Server) handleDownloadRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	repo := repoArg(r.URL.Query().Get("repo"))
+	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
+	if repo == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo")
+		return
+	}
+	if err := storage.ValidateRef(branch); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	meta, err := s.store.Rollback(user, repo, branch)
+	if err != nil {
+		s.logf("rollback error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		jsonError(w, "rollback", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
 func (s *Server) handleDownloadInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	user := s.resolveUser(r)
-	token := tokenFromRequest(r, s.token)
-	repo := strings.TrimSpace(r.URL.Query().Get("repo"))
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
 	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
 	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
 	if repo == "" {
-		http.Error(w, "missing repo", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	if !refParam(w, r, branch) {
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), s.downloadTO)
+	if !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
 	defer cancel()
 
-	zipPath, err := s.store.EnsureRepo(ctx, user, repo, branch, token, false, legacy)
+	res, err := s.store.EnsureRepoResult(ctx, user, repo, branch, token, false, legacy)
 	if err != nil {
-		fmt.Printf("download info error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
-		httpError(w, "ensure repo", err)
+		err = redactToken(err, token)
+		s.logf("download info error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "ensure repo", err)
 		return
 	}
-	info, err := s.store.ReadRepoInfo(zipPath)
+	info, err := s.store.ReadRepoInfo(res.Path)
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
-			http.NotFound(w, r)
+			fail(w, r, http.StatusNotFound, "404 page not found")
 			return
 		}
-		fmt.Printf("read repo info error path=%s err=%v\n", zipPath, err)
-		httpError(w, "read repo info", err)
+		s.logf("read repo info error path=%s err=%v\n", res.Path, err)
+		failErr(w, r, "read repo info", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if err := json.NewEncoder(w).Encode(info); err != nil {
-		fmt.Printf("download info encode error user=%s repo=%s err=%v\n", user, repo, err)
+		s.logf("download info encode error user=%s repo=%s err=%v\n", user, repo, err)
 		return
 	}
 }
 
+// handleDownloadChecksum reports the recorded checksum of a cached archive
+// without streaming it. verify=true rehashes the file first; a mismatch
+// discards the corrupt archive and fetches a fresh one.
+func (s *Server) handleDownloadChecksum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
+	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
+	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
+	verify, _ := strconv.ParseBool(r.URL.Query().Get("verify"))
+	if repo == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	if !refParam(w, r, branch) {
+		return
+	}
+	if !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+
+	res, err := s.store.EnsureRepoResult(ctx, user, repo, branch, token, false, legacy)
+	if err == nil && verify {
+		if verr := s.store.VerifyArchive(res.Path); errors.Is(verr, storage.ErrChecksumMismatch) {
+			s.logf("checksum mismatch user=%s repo=%s branch=%s, refetching\n", user, repo, branch)
+			res, err = s.store.EnsureRepoResult(ctx, user, repo, branch, token, true, legacy)
+		} else if verr != nil && !errors.Is(verr, storage.ErrNotFound) {
+			err = verr
+		}
+	}
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("download checksum error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "ensure repo", err)
+		return
+	}
+	if res.SHA256 == "" {
+		fail(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+	commit := res.CommitSHA
+	if commit == "" {
+		commit = res.ShortSHA
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"sha256": res.SHA256,
+		"size":   res.Size,
+		"commit": commit,
+	})
+}
+
 func (s *Server) handleDownloadPackage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
 		return
 	}
-	user := s.resolveUser(r)
 	pkgURL := strings.TrimSpace(r.URL.Query().Get("url"))
 	debugStreamDelayStr := strings.TrimSpace(r.URL.Query().Get("debug_stream_delay"))
 	if pkgURL == "" {
-		http.Error(w, "missing url", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "missing url")
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), s.downloadTO)
+	ctx, cancel := s.populateContext(r.Context())
 	defer cancel()
 	var streamDelay time.Duration
 	if debugStreamDelayStr != "" {
 		if d, err := time.ParseDuration(debugStreamDelayStr); err == nil && d > 0 {
 			streamDelay = d
-			fmt.Printf("DEBUG: client requested slow stream (%s) for url=%s\n", d, pkgURL)
+			s.logf("DEBUG: client requested slow stream (%s) for url=%s\n", d, pkgURL)
 		}
 	}
 
-	filePath, err := s.store.EnsurePackage(ctx, user, pkgURL)
+	var outcome storage.CacheOutcome
+	filePath, err := s.store.EnsurePackage(storage.WithOutcome(ctx, &outcome), user, pkgURL)
+	setCacheLabel(r, outcome)
 	if err != nil {
-		fmt.Printf("download package error user=%s url=%s err=%v\n", user, pkgURL, err)
-		httpError(w, "ensure package", err)
+		s.logf("download package error user=%s url=%s err=%v\n", user, pkgURL, err)
+		failErr(w, r, "ensure package", err)
 		return
 	}
 	name := filepath.Base(filePath)
@@ -313,39 +1017,39 @@ func (s *Server) handleDownloadPackage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
 	hashStr := storage.PackageHash(pkgURL)
 	_ = s.store.Touch(s.userPath(user, filepath.Join("packages", hashStr, name)))
-	f, err := os.Open(filePath)
+	var modTime time.Time
+	if fi, err := os.Stat(filePath); err == nil {
+		modTime = fi.ModTime()
+	}
+	// Packages may be encrypted at rest; OpenArchive decodes them like
+	// archives.
+	f, err := s.store.OpenArchive(filePath)
 	if err != nil {
-		httpError(w, "open package", err)
+		failErr(w, r, "open package", err)
 		return
 	}
 	defer func() { _ = f.Close() }()
-	var reader io.Reader = f
-	if fi, err := f.Stat(); err == nil {
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-		if streamDelay > 0 {
-			reader = newSlowReader(f, r.Context(), streamDelay, fi.Size())
-		}
-	} else if streamDelay > 0 {
-		reader = newSlowReader(f, r.Context(), streamDelay, -1)
-	}
-	if _, err := io.Copy(w, reader); err != nil {
-		fmt.Printf("package stream error user=%s url=%s err=%v\n", user, pkgURL, err)
+	if _, err := serveArchiveFile(w, r, f, 0, modTime, streamDelay); err != nil {
+		s.logf("package stream error user=%s url=%s err=%v\n", user, pkgURL, err)
 		return
 	}
-	fmt.Printf("package download ok user=%s url=%s path=%s\n", user, pkgURL, filePath)
+	s.logf("package download ok user=%s url=%s path=%s\n", user, pkgURL, filePath)
 }
 
 func (s *Server) handleDownloadSparse(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	token := tokenFromRequest(r, s.token)
-	repo := strings.TrimSpace(r.URL.Query().Get("repo"))
+	if _, _, ok := s.scope(w, r); !ok {
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
 	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
 	pathsParam := strings.TrimSpace(r.URL.Query().Get("paths"))
 	if repo == "" {
-		http.Error(w, "missing repo", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "missing repo")
 		return
 	}
 	// Parse paths (comma-separated). Empty paths means download all.
@@ -358,143 +1062,206 @@ func (s *Server) handleDownloadSparse(w http.ResponseWriter, r *http.Request) {
 			}
 			// Validate path
 			if strings.Contains(p, "..") || filepath.IsAbs(p) {
-				http.Error(w, fmt.Sprintf("invalid path: %s", p), http.StatusBadRequest)
+				fail(w, r, http.StatusBadRequest, fmt.Sprintf("invalid path: %s", p))
 				return
 			}
 			paths = append(paths, p)
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), s.downloadTO)
-	defer cancel()
-
-	// Ensure bare repo is up-to-date
-	if _, err := s.store.EnsureBareRepo(ctx, repo, token); err != nil {
-		fmt.Printf("sparse download error repo=%s err=%v\n", repo, err)
-		httpError(w, "ensure bare repo", err)
-		return
-	}
-
-	// If branch not specified, use "main" as default (could also fetch default branch)
-	if branch == "" {
-		branch = "main"
-	}
-
-	// Create temp zip file
-	tmpFile, err := os.CreateTemp("", "sparse-*.zip")
-	if err != nil {
-		httpError(w, "create temp file", err)
-		return
-	}
-	tmpPath := tmpFile.Name()
-	_ = tmpFile.Close()
-	defer func() { _ = os.Remove(tmpPath) }()
-
-	// Export sparse zip
-	commit, err := s.store.ExportSparseZip(ctx, repo, branch, paths, tmpPath)
-	if err != nil {
-		fmt.Printf("sparse export error repo=%s branch=%s paths=%v err=%v\n", repo, branch, paths, err)
-		httpError(w, "export sparse", err)
-		return
-	}
-
-	// Set headers
-	w.Header().Set("X-GHH-Commit", commit)
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-sparse.zip\"", safeName(repo, branch)))
-
-	f, err := os.Open(tmpPath)
-	if err != nil {
-		httpError(w, "open zip", err)
-		return
-	}
-	defer func() { _ = f.Close() }()
-
-	if fi, err := f.Stat(); err == nil {
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-	}
+	s.serveSparse(w, r, token, repo, branch, paths)
+}
 
-	if _, err := io.Copy(w, f); err != nil {
-		fmt.Printf("sparse stream error repo=%s branch=%s err=%v\n", repo, branch, err)
-		return
-	}
-	fmt.Printf("sparse download ok repo=%s branch=%s paths=%v commit=%s\n", repo, branch, paths, commit)
+// branchSwitchResult is the JSON answer of branch/switch.
+type branchSwitchResult struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"` // the branch served, a fallback when Requested is set
+	Commit string `json:"commit,omitempty"`
+	Cache  string `json:"cache,omitempty"` // hit, revalidated or miss, as X-GHH-Cache
+	// Requested is the branch asked for when a fallback was served instead.
+	Requested string `json:"requested,omitempty"`
 }
 
 func (s *Server) handleBranchSwitch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	user := s.resolveUser(r)
-	token := tokenFromRequest(r, s.token)
 	var req struct {
 		Repo   string `json:"repo"`
 		Branch string `json:"branch"`
 		Force  bool   `json:"force"`
 		Legacy bool   `json:"legacy"`
+		// User names the namespace for clients that cannot set
+		// X-GHH-User; the header and user= take precedence.
+		User string `json:"user"`
+		// Items switches several branches at once (see
+		// handleBranchSwitchItems) instead of Repo and Branch.
+		Items  []branchSwitchItem `json:"items"`
+		Atomic bool               `json:"atomic"`
+	}
+	decodeErr := json.NewDecoder(r.Body).Decode(&req)
+	_, user, ok := s.scopeAs(w, r, req.User)
+	if !ok {
+		return
+	}
+	token := s.githubToken(r)
+	if decodeErr != nil {
+		fail(w, r, http.StatusBadRequest, "invalid json")
+		return
+	}
+	fallback, ok := fallbackParam(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Items) > 0 {
+		if strings.TrimSpace(req.Repo) != "" || strings.TrimSpace(req.Branch) != "" {
+			fail(w, r, http.StatusBadRequest, "give either repo/branch or items, not both")
+			return
+		}
+		if len(fallback) > 0 {
+			fail(w, r, http.StatusBadRequest, "fallback cannot be combined with items")
+			return
+		}
+		s.handleBranchSwitchItems(w, r, user, token, req.Items, req.Atomic, req.Force, req.Legacy)
+		return
+	}
+	req.Repo = repoArg(req.Repo)
+	req.Branch = strings.TrimSpace(req.Branch)
+	if req.Repo == "" || req.Branch == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo/branch")
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+	if !refParam(w, r, req.Branch) {
 		return
 	}
-	if strings.TrimSpace(req.Repo) == "" || strings.TrimSpace(req.Branch) == "" {
-		http.Error(w, "missing repo/branch", http.StatusBadRequest)
+	if !s.allowRepo(w, r, req.Repo) {
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	ctx, cancel := s.populateContext(r.Context())
 	defer cancel()
-	if _, err := s.store.EnsureRepo(ctx, user, req.Repo, req.Branch, token, req.Force, req.Legacy); err != nil {
-		fmt.Printf("branch switch error user=%s repo=%s branch=%s err=%v\n", user, req.Repo, req.Branch, err)
-		httpError(w, "ensure branch", err)
+	var outcome storage.CacheOutcome
+	served, res, err := s.ensureWithFallback(storage.WithOutcome(ctx, &outcome), user, req.Repo, req.Branch, token, req.Force, req.Legacy, fallback)
+	setCacheLabel(r, outcome)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("branch switch error user=%s repo=%s branch=%s err=%v\n", user, req.Repo, req.Branch, err)
+		failErr(w, r, "ensure branch", err)
+		return
+	}
+	setCacheHeader(w, res.Outcome)
+	w.Header().Set("X-GHH-Branch", served)
+	if wantsJSON(r) {
+		out := branchSwitchResult{
+			Repo:   req.Repo,
+			Branch: served,
+			Commit: res.ShortSHA,
+			Cache:  cacheHeader(res.Outcome),
+		}
+		if served != req.Branch {
+			out.Requested = req.Branch
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(out)
+		s.logf("branch switch ok user=%s repo=%s branch=%s\n", user, req.Repo, served)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	if _, err := io.WriteString(w, "ok"); err != nil {
-		fmt.Printf("branch switch write error user=%s repo=%s branch=%s err=%v\n", user, req.Repo, req.Branch, err)
+		s.logf("branch switch write error user=%s repo=%s branch=%s err=%v\n", user, req.Repo, served, err)
 		return
 	}
-	fmt.Printf("branch switch ok user=%s repo=%s branch=%s\n", user, req.Repo, req.Branch)
+	s.logf("branch switch ok user=%s repo=%s branch=%s\n", user, req.Repo, served)
+}
+
+// listOptions reads the limit= and page_token= paging parameters of a
+// listing; paged is false when neither is set, keeping the unpaged response.
+// The token of the next page goes in X-GHH-Next-Page.
+func listOptions(w http.ResponseWriter, r *http.Request) (opts storage.ListOptions, paged, ok bool) {
+	q := r.URL.Query()
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			fail(w, r, http.StatusBadRequest, "invalid limit")
+			return opts, false, false
+		}
+		opts.Limit = n
+	}
+	opts.Token = strings.TrimSpace(q.Get("page_token"))
+	return opts, opts.Limit > 0 || opts.Token != "", true
 }
 
 func (s *Server) handleDirList(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
 		return
 	}
-	user := s.resolveUser(r)
 	rel := r.URL.Query().Get("path")
 	if badRel(rel) {
-		http.Error(w, "bad path", http.StatusBadRequest)
+		fail(w, r, http.StatusBadRequest, "bad path")
 		return
 	}
 
 	// Support listing git-cache directory (shared bare repo cache)
 	cleanRel := strings.TrimLeft(filepath.ToSlash(rel), "./")
 	var listPath string
-	if strings.HasPrefix(cleanRel, "git-cache") || cleanRel == "git-cache" {
-		// List git-cache directly (no user prefix)
+	if strings.HasPrefix(cleanRel, "git-cache") || cleanRel == "git-cache" || isSharedRel(cleanRel) {
+		// List git-cache and the shared archive cache directly (no user prefix)
 		listPath = cleanRel
 	} else {
 		listPath = s.userPath(user, rel)
+	}
+	if err := authorizePath(p, user, listPath, false); err != nil {
+		fail(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	if listPath != cleanRel {
 		_ = s.store.Touch(listPath)
 	}
 
-	list, err := s.store.List(listPath)
+	opts, paged, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+	var (
+		list []storage.Entry
+		next string
+		err  error
+	)
+	if paged {
+		list, next, err = s.store.ListPage(listPath, opts)
+	} else {
+		list, err = s.store.List(listPath)
+	}
 	if err != nil {
 		// Return empty list for not found paths (e.g., new user with no cached repos)
 		if errors.Is(err, storage.ErrNotFound) {
 			list = []storage.Entry{}
 		} else {
-			fmt.Printf("dir list error user=%s path=%s err=%v\n", user, rel, err)
-			httpError(w, "list", err)
+			s.logf("dir list error user=%s path=%s err=%v\n", user, rel, err)
+			failErr(w, r, "list", err)
 			return
 		}
 	}
 
-	// Add git-cache to root listing if it exists
-	if cleanRel == "" || cleanRel == "." {
-		if gcList, err := s.store.List("git-cache"); err == nil && len(gcList) > 0 {
+	// Add git-cache to root listing if it exists; a paged listing gets
+	// these on its last page.
+	if (cleanRel == "" || cleanRel == ".") && next == "" {
+		// In the shared layout a user's repos/ is the shared one.
+		if s.sharedRepos {
+			if shared, err := s.store.List(storage.SharedDir); err == nil {
+				for _, e := range shared {
+					if e.Name == "repos" && e.IsDir {
+						list = append(list, e)
+					}
+				}
+			}
+		}
+		if gcList, _, err := s.store.ListPage("git-cache", storage.ListOptions{Limit: 1}); err == nil && len(gcList) > 0 {
 			list = append(list, storage.Entry{
 				Name:  "git-cache",
 				IsDir: true,
@@ -513,55 +1280,176 @@ func (s *Server) handleDirList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
+	if next != "" {
+		w.Header().Set("X-GHH-Next-Page", next)
+	}
 	if err := json.NewEncoder(w).Encode(list); err != nil {
-		fmt.Printf("dir list write error user=%s path=%s err=%v\n", user, rel, err)
+		s.logf("dir list write error user=%s path=%s err=%v\n", user, rel, err)
 		return
 	}
-	fmt.Printf("dir list ok user=%s path=%s entries=%d\n", user, rel, len(list))
+	s.logf("dir list ok user=%s path=%s entries=%d\n", user, rel, len(list))
 }
 
 func (s *Server) handleDir(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodDelete:
-		user := s.resolveUser(r)
+		p, user, ok := s.scope(w, r)
+		if !ok {
+			return
+		}
 		rel := r.URL.Query().Get("path")
 		if badRel(rel) {
-			http.Error(w, "bad path", http.StatusBadRequest)
+			fail(w, r, http.StatusBadRequest, "bad path")
 			return
 		}
 		// Normalize path based on prefix
 		cleanRel := strings.TrimLeft(filepath.ToSlash(rel), "./")
-		if strings.HasPrefix(cleanRel, "git-cache") {
-			// git-cache paths are used directly (no user prefix)
+		if strings.HasPrefix(cleanRel, "git-cache") || isSharedRel(cleanRel) {
+			// git-cache and shared paths are used directly (no user prefix)
 			rel = cleanRel
 		} else if strings.HasPrefix(rel, "users/") || strings.HasPrefix(rel, "users\\") {
 			// already absolute-ish, keep as-is
 		} else {
 			rel = s.userPath(user, rel)
 		}
+		if err := authorizePath(p, user, rel, true); err != nil {
+			fail(w, r, http.StatusForbidden, err.Error())
+			return
+		}
 		recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
 		if err := s.store.Delete(rel, recursive); err != nil {
-			fmt.Printf("delete error user=%s path=%s recursive=%t err=%v\n", user, rel, recursive, err)
-			httpError(w, "delete", err)
+			s.logf("delete error user=%s path=%s recursive=%t err=%v\n", user, rel, recursive, err)
+			failErr(w, r, "delete", err)
 			return
 		}
+		s.usage.evicted(evictManual, 1)
 		w.WriteHeader(http.StatusOK)
 		if _, err := io.WriteString(w, "deleted"); err != nil {
-			fmt.Printf("delete write error user=%s path=%s recursive=%t err=%v\n", user, rel, recursive, err)
+			s.logf("delete write error user=%s path=%s recursive=%t err=%v\n", user, rel, recursive, err)
 			return
 		}
-		fmt.Printf("delete ok user=%s path=%s recursive=%t\n", user, rel, recursive)
+		s.logf("delete ok user=%s path=%s recursive=%t\n", user, rel, recursive)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
-func httpError(w http.ResponseWriter, op string, err error) {
-	code := http.StatusInternalServerError
-	if errors.Is(err, storage.ErrBadPath) || errors.Is(err, storage.ErrNotFound) {
-		code = http.StatusBadRequest
+// handleTrash lists soft-deleted cache items. Admin only.
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
-	http.Error(w, op+": "+err.Error(), code)
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "trash requires an admin key")
+		return
+	}
+	entries, err := s.store.ListTrash()
+	if err != nil {
+		s.logf("list trash error err=%v\n", err)
+		failErr(w, r, "list trash", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// handleRestore moves a soft-deleted item back to where it was. Admin only.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "trash requires an admin key")
+		return
+	}
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if id == "" {
+		fail(w, r, http.StatusBadRequest, "missing id")
+		return
+	}
+	entry, err := s.store.Restore(id)
+	if err != nil {
+		s.logf("restore error user=%s id=%s err=%v\n", user, id, err)
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "restore: "+err.Error())
+			return
+		}
+		failErr(w, r, "restore", err)
+		return
+	}
+	s.logf("restore ok user=%s id=%s path=%s\n", user, id, entry.Path)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// handleBulkDelete removes the cached archives matching a glob, e.g.
+// DELETE /api/v1/cache/bulk?pattern=users/*/repos/acme/app/feature-*.zip.
+// Patterns without the users/ prefix are relative to the caller's
+// namespace. It is a dry run listing the matches unless confirm=true.
+func (s *Server) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	pattern := strings.TrimSpace(q.Get("pattern"))
+	if pattern == "" {
+		fail(w, r, http.StatusBadRequest, "missing pattern")
+		return
+	}
+	if !strings.HasPrefix(pattern, "users/") && !isSharedRel(pattern) {
+		pattern = s.userPath(user, pattern)
+	}
+	if err := authorizePath(p, user, pattern, true); err != nil {
+		fail(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	confirm := false
+	if v := q.Get("confirm"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			fail(w, r, http.StatusBadRequest, "invalid confirm value")
+			return
+		}
+		confirm = b
+	}
+	res, err := s.store.DeleteMatching(pattern, !confirm)
+	if err != nil {
+		s.logf("bulk delete error user=%s pattern=%s err=%v\n", user, pattern, err)
+		failErr(w, r, "bulk delete", err)
+		return
+	}
+	s.logf("bulk delete ok user=%s pattern=%s matched=%d deleted=%d dry_run=%t\n", user, pattern, len(res.Matched), res.Deleted, res.DryRun)
+	s.usage.evicted(evictManual, res.Deleted)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// wantsJSON reports whether the caller asked for a JSON body, either with
+// format=json or an Accept header listing application/json. format=text
+// always selects the legacy plain-text response.
+func wantsJSON(r *http.Request) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))) {
+	case "json":
+		return true
+	case "text":
+		return false
+	}
+	return strings.Contains(strings.ToLower(r.Header.Get("Accept")), "application/json")
 }
 
 func safeName(repo, branch string) string {
@@ -572,27 +1460,24 @@ func safeName(repo, branch string) string {
 	return name
 }
 
-func (s *Server) resolveUser(r *http.Request) string {
-	user := r.Header.Get("X-GHH-User")
-	if user == "" {
-		user = r.URL.Query().Get("user")
-	}
-	user = strings.TrimSpace(user)
-	if user == "" {
-		user = s.defaultUser
-	}
-	return sanitizeUser(user)
-}
-
 func (s *Server) userPath(user, rel string) string {
 	base := filepath.ToSlash(filepath.Join("users", sanitizeUser(user)))
 	rel = strings.TrimLeft(rel, "./")
+	if s.sharedRepos && (rel == "repos" || strings.HasPrefix(rel, "repos/")) {
+		// Archives are not per user in the shared layout.
+		return filepath.ToSlash(filepath.Join(storage.SharedDir, rel))
+	}
 	if rel == "" || rel == "." || rel == "/" {
 		return base
 	}
 	return filepath.ToSlash(filepath.Join(base, rel))
 }
 
+// isSharedRel reports whether rel is in the shared archive cache.
+func isSharedRel(rel string) bool {
+	return rel == storage.SharedDir || strings.HasPrefix(rel, storage.SharedDir+"/")
+}
+
 func sanitizeUser(u string) string {
 	u = strings.TrimSpace(u)
 	if u == "" {
@@ -629,26 +1514,63 @@ func badRel(rel string) bool {
 	return false
 }
 
-func readCommitFile(path string) string {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return ""
-	}
-	commit := strings.TrimSpace(string(b))
-	return commit
+// tokenFromRequest returns the GitHub token to use for upstream calls made on
+// behalf of r. Precedence: X-GHH-Token header, then an Authorization header
+// with the "github" scheme ("github <pat>" or "github:<pat>"), then a legacy
+// Bearer token, and finally the server default. An empty result means
+// anonymous access, which still works for public repos.
+func tokenFromRequest(r *http.Request, fallback string) string {
+	return tokenFromHeaders(r, fallback, true)
 }
 
-func tokenFromRequest(r *http.Request, fallback string) string {
+// githubToken is tokenFromRequest for this server: once API-key auth is on,
+// Bearer credentials identify the caller and are never forwarded to GitHub.
+func (s *Server) githubToken(r *http.Request) string {
+	return tokenFromHeaders(r, s.fallbackToken(), !s.authEnabled())
+}
+
+func tokenFromHeaders(r *http.Request, fallback string, allowBearer bool) string {
+	if t := strings.TrimSpace(r.Header.Get("X-GHH-Token")); t != "" {
+		return t
+	}
 	h := strings.TrimSpace(r.Header.Get("Authorization"))
-	if strings.HasPrefix(strings.ToLower(h), "bearer ") {
-		t := strings.TrimSpace(h[len("bearer "):])
-		if t != "" {
-			return t
+	lower := strings.ToLower(h)
+	prefixes := []string{"github ", "github:"}
+	if allowBearer {
+		prefixes = append(prefixes, "bearer ")
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			if t := strings.TrimSpace(h[len(prefix):]); t != "" {
+				return t
+			}
 		}
 	}
 	return fallback
 }
 
+// redactedError hides a secret from the wrapped error's message while keeping
+// errors.Is/As working on the original error.
+type redactedError struct {
+	err    error
+	secret string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.secret, "[REDACTED]")
+}
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactToken makes sure a per-request token never ends up in logs or error
+// responses, e.g. when git echoes a credential-bearing remote URL.
+func redactToken(err error, token string) error {
+	if err == nil || strings.TrimSpace(token) == "" || !strings.Contains(err.Error(), token) {
+		return err
+	}
+	return &redactedError{err: err, secret: token}
+}
+
 // slowReader wraps an io.Reader to simulate slow network by stretching download to target duration.
 type slowReader struct {
 	r             io.Reader
@@ -729,13 +1651,59 @@ func (s *Server) startJanitor() {
 			return
 		case <-ticker.C:
 			_ = s.store.CleanupExpired(s.ttl)
+			s.checkConsistency()
+			s.stats.prune()
+		}
+	}
+}
+
+// touchFlushIdle is how often flushTouches looks for due access times when
+// the storage writes every access itself.
+const touchFlushIdle = 30 * time.Second
+
+// flushTouches writes the built-in storage's coalesced access times as they
+// come due, and all of them once the janitor context ends.
+func (s *Server) flushTouches(st *storage.Storage) {
+	defer close(s.touchesFlushed)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for {
+		wait := st.TouchInterval / 2
+		if wait <= 0 {
+			wait = touchFlushIdle
 		}
+		timer.Reset(wait)
+		select {
+		case <-s.janitorCtx.Done():
+			st.SyncTouches()
+			return
+		case <-timer.C:
+			st.FlushTouches()
+		}
+	}
+}
+
+// SetTouchInterval sets how often the built-in storage writes the access
+// time of one cache entry (see storage.Storage.TouchInterval); 0 writes
+// every access.
+func (s *Server) SetTouchInterval(d time.Duration) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.TouchInterval = d
 	}
 }
 
 // Shutdown stops the janitor goroutine and releases associated resources.
+// It returns once the download stats and coalesced access times are
+// written.
 func (s *Server) Shutdown() {
 	if s.janitorCancel != nil {
 		s.janitorCancel()
 	}
+	if s.statsFlushed != nil {
+		<-s.statsFlushed
+	}
+	if s.touchesFlushed != nil {
+		<-s.touchesFlushed
+	}
 }
@@ -4,36 +4,100 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github-hub/internal/storage"
+	"github-hub/internal/testutil"
 )
 
 type fakeStore struct {
-	ensurePath string
-	ensurePkg  string
-	ensureErr  error
-	ensureInfo *storage.RepoInfo
-	lastUser   string
-	lastRepo   string
-	lastBranch string
-	lastForce  bool
+	ensurePath     string
+	ensurePkg      string
+	ensureErr      error
+	ensureInfo     *storage.RepoInfo
+	ensureMeta     *storage.ArchiveMeta
+	verifyErr      error
+	verifyCalls    int
+	lastUser       string
+	lastRepo       string
+	lastBranch     string
+	lastToken      string
+	lastForce      bool
+	outcome        storage.CacheOutcome
+	refInfo        *storage.RefInfo
+	lastRef        string
+	branchInfo     *storage.DefaultBranchInfo
+	removed        []string
+	commits        []storage.CommitEntry
+	lastSince      string
+	lastLimit      int
+	lastCommit     string
+	normalizeCalls int
+	lastRoot       storage.RootMode
+	lastPrefix     string
+	rerootErr      error
+	ensureCalls    int
+	lastRemote     bool
+	signature      *storage.ArchiveSignature
+	patch          *storage.Patch
+	lastPatchMax   int64
+	missing        map[string]bool // branches that do not exist upstream
+	ensured        []string
+	resolved       []string
 }
 
-func (f *fakeStore) EnsureRepo(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (string, error) {
+func (f *fakeStore) EnsureRepoResult(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (*storage.RepoArchive, error) {
 	f.lastUser = user
 	f.lastRepo = ownerRepo
 	f.lastBranch = branch
+	f.lastToken = token
 	f.lastForce = force
-	return f.ensurePath, f.ensureErr
+	f.ensureCalls++
+	f.ensured = append(f.ensured, branch)
+	if f.missing[branch] {
+		return nil, &storage.NotFoundError{Repo: ownerRepo, Branch: branch}
+	}
+	if f.outcome != "" {
+		storage.ReportOutcome(ctx, f.outcome)
+	}
+	if f.ensureErr != nil {
+		return nil, f.ensureErr
+	}
+	return f.result(f.ensurePath), nil
+}
+
+// result describes path from ensureMeta, as the real store does from the
+// archive's sidecar.
+func (f *fakeStore) result(path string) *storage.RepoArchive {
+	res := &storage.RepoArchive{Path: path, FromCache: f.outcome != storage.CacheMiss, Outcome: f.outcome}
+	if m := f.ensureMeta; m != nil {
+		res.CommitSHA, res.SHA256, res.Size, res.FetchedAt = m.CommitSHA, m.SHA256, m.Size, m.FetchedAt
+		res.ShortSHA = m.CommitSHA
+		if len(res.ShortSHA) > 7 {
+			res.ShortSHA = res.ShortSHA[:7]
+		}
+		if f.lastBranch == storage.LatestRelease {
+			res.Tag = m.Branch
+		}
+		res.Compressed = m.Compression != ""
+	}
+	return res
 }
 func (f *fakeStore) EnsurePackage(ctx context.Context, user, pkgURL string) (string, error) {
 	f.lastUser = user
@@ -50,9 +114,194 @@ func (f *fakeStore) ExportSparseDir(ctx context.Context, ownerRepo, branch strin
 	return "", nil
 }
 func (f *fakeStore) List(rel string) ([]storage.Entry, error) { return nil, nil }
-func (f *fakeStore) Delete(rel string, recursive bool) error  { return nil }
-func (f *fakeStore) Touch(rel string) error                   { return nil }
-func (f *fakeStore) CleanupExpired(ttl time.Duration) error   { return nil }
+func (f *fakeStore) ListPage(rel string, opts storage.ListOptions) ([]storage.Entry, string, error) {
+	return nil, "", nil
+}
+func (f *fakeStore) Delete(rel string, recursive bool) error { return nil }
+func (f *fakeStore) Touch(rel string) error                  { return nil }
+func (f *fakeStore) CleanupExpired(ttl time.Duration) error  { return nil }
+func (f *fakeStore) ReadArchiveMeta(zipPath string) (*storage.ArchiveMeta, error) {
+	if f.ensureMeta != nil {
+		return f.ensureMeta, nil
+	}
+	return nil, storage.ErrNotFound
+}
+func (f *fakeStore) ResolveRef(ctx context.Context, user, ownerRepo, ref, token string) (*storage.RefInfo, error) {
+	f.lastUser = user
+	f.lastRepo = ownerRepo
+	f.lastRef = ref
+	f.resolved = append(f.resolved, ref)
+	if f.missing[ref] {
+		return nil, fmt.Errorf("%w (%w)", &storage.NotFoundError{Repo: ownerRepo, Branch: ref}, storage.ErrNotFound)
+	}
+	if f.refInfo == nil {
+		return nil, storage.ErrNotFound
+	}
+	return f.refInfo, nil
+}
+func (f *fakeStore) ListCommits(ctx context.Context, ownerRepo, ref, sinceSHA string, limit int, token string) ([]storage.CommitEntry, error) {
+	f.lastRepo = ownerRepo
+	f.lastRef = ref
+	f.lastSince = sinceSHA
+	f.lastLimit = limit
+	if f.commits == nil {
+		return nil, f.ensureErr
+	}
+	return f.commits, nil
+}
+func (f *fakeStore) DefaultBranch(ctx context.Context, user, ownerRepo, token string) (*storage.DefaultBranchInfo, error) {
+	f.lastUser = user
+	f.lastRepo = ownerRepo
+	if f.ensureErr != nil {
+		return nil, f.ensureErr
+	}
+	return f.branchInfo, nil
+}
+func (f *fakeStore) ListPackages(user string) ([]storage.PackageMeta, error) { return nil, nil }
+func (f *fakeStore) ListPackagesPage(user string, opts storage.ListOptions) ([]storage.PackageMeta, string, error) {
+	return nil, "", nil
+}
+func (f *fakeStore) LookupPackage(user, pkgURL string) (*storage.PackageMeta, error) {
+	return nil, storage.ErrNotFound
+}
+func (f *fakeStore) DeletePackage(user, pkgURL string) error { return storage.ErrNotFound }
+func (f *fakeStore) StorePackage(user, key string, body io.Reader, maxBytes int64, overwrite bool) (*storage.PackageMeta, error) {
+	return nil, storage.ErrBadPath
+}
+func (f *fakeStore) RemoveArchive(zipPath string) error {
+	f.removed = append(f.removed, zipPath)
+	return nil
+}
+func (f *fakeStore) ArchiveAt(user, ownerRepo, branch, commit string) (string, *storage.ArchiveMeta, error) {
+	f.lastUser = user
+	f.lastRepo = ownerRepo
+	f.lastBranch = branch
+	f.lastCommit = commit
+	if f.ensureMeta == nil || !strings.HasPrefix(f.ensureMeta.CommitSHA, commit) {
+		return "", nil, storage.ErrNotFound
+	}
+	return f.ensurePath, f.ensureMeta, nil
+}
+func (f *fakeStore) Rollback(user, ownerRepo, branch string) (*storage.ArchiveMeta, error) {
+	f.lastUser = user
+	f.lastRepo = ownerRepo
+	f.lastBranch = branch
+	if f.ensureMeta == nil {
+		return nil, storage.ErrNotFound
+	}
+	return f.ensureMeta, nil
+}
+
+// OpenArchive stands in for decompression when ensureMeta says the archive
+// is compressed: the file holds the plain bytes, but is not handed out as an
+// *os.File.
+func (f *fakeStore) OpenArchive(zipPath string) (io.ReadCloser, error) {
+	file, err := os.Open(zipPath)
+	if err != nil || f.ensureMeta == nil || f.ensureMeta.Compression == "" {
+		return file, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{file, file}, nil
+}
+func (f *fakeStore) NormalizedArchive(zipPath string, root storage.RootMode) (*storage.RepoArchive, error) {
+	f.normalizeCalls++
+	f.lastRoot = root
+	res := f.result(zipPath)
+	res.SHA256 = "normalized"
+	return res, nil
+}
+func (f *fakeStore) PrefixedArchive(zipPath, prefix string) (*storage.RepoArchive, error) {
+	f.normalizeCalls++
+	f.lastPrefix = prefix
+	res := f.result(zipPath)
+	res.SHA256 = "prefixed"
+	return res, nil
+}
+func (f *fakeStore) ArchiveManifest(w io.Writer, zipPath string, limits storage.ManifestLimits) (int64, error) {
+	return 0, storage.ErrNotFound
+}
+func (f *fakeStore) Patch(ctx context.Context, user, ownerRepo, branch, from, to, token string, maxBytes int64) (*storage.Patch, error) {
+	f.lastUser, f.lastRepo, f.lastBranch, f.lastCommit, f.lastPatchMax = user, ownerRepo, branch, from, maxBytes
+	if f.ensureErr != nil {
+		return nil, f.ensureErr
+	}
+	p := *f.patch
+	p.Repo, p.Branch, p.From = ownerRepo, branch, from
+	if to != "" {
+		p.To = to
+	}
+	return &p, nil
+}
+func (f *fakeStore) RerootArchive(w io.Writer, zipPath string, root storage.RootMode) (int64, error) {
+	f.lastRoot = root
+	if f.rerootErr != nil {
+		return 0, f.rerootErr
+	}
+	b, err := os.ReadFile(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// TarballArchive writes a stand-in body naming the root it was asked for.
+func (f *fakeStore) TarballArchive(w io.Writer, zipPath string, root storage.RootMode) (int64, error) {
+	f.lastRoot = root
+	n, err := fmt.Fprintf(w, "tarball of %s root=%s", filepath.Base(zipPath), root)
+	return int64(n), err
+}
+
+// BranchStatus reports the branch as cached once EnsureRepoResult ran.
+func (f *fakeStore) BranchStatus(ctx context.Context, user, ownerRepo, branch, token string, remote bool) (*storage.BranchStatus, error) {
+	f.lastRemote = remote
+	st := &storage.BranchStatus{Repo: ownerRepo, Branch: branch, Provider: storage.ProviderGitHub, Cached: f.ensureCalls > 0}
+	if st.Cached {
+		st.CommitSHA = "abc123"
+	}
+	return st, nil
+}
+func (f *fakeStore) CachedBranches(ctx context.Context, user, ownerRepo, token string, remote bool) ([]storage.CachedBranch, error) {
+	f.lastUser, f.lastRepo, f.lastRemote = user, ownerRepo, remote
+	if f.ensureErr != nil {
+		return nil, f.ensureErr
+	}
+	out := []storage.CachedBranch{}
+	if f.ensureCalls > 0 {
+		out = append(out, storage.CachedBranch{Branch: "main", ShortSHA: "abc123", Size: 3})
+	}
+	return out, nil
+}
+func (f *fakeStore) ValidateToken(ctx context.Context, token, ownerRepo string) (*storage.TokenValidation, error) {
+	f.lastToken, f.lastRepo = token, ownerRepo
+	if f.ensureErr != nil {
+		return nil, f.ensureErr
+	}
+	return &storage.TokenValidation{Valid: token == "good", Kind: storage.TokenUnknown, Repo: ownerRepo}, nil
+}
+func (f *fakeStore) ArchiveSignature(zipPath string) (*storage.ArchiveSignature, error) {
+	if f.signature == nil {
+		return nil, storage.ErrSigningDisabled
+	}
+	return f.signature, nil
+}
+
+func (f *fakeStore) ListTrash() ([]storage.TrashEntry, error) { return nil, nil }
+func (f *fakeStore) Restore(id string) (*storage.TrashEntry, error) {
+	return nil, storage.ErrNotFound
+}
+func (f *fakeStore) DeleteMatching(pattern string, dryRun bool) (*storage.BulkDelete, error) {
+	return &storage.BulkDelete{Pattern: pattern, DryRun: dryRun, Matched: []storage.BulkEntry{}}, nil
+}
+func (f *fakeStore) VerifyArchive(zipPath string) error {
+	f.verifyCalls++
+	if f.verifyCalls == 1 && f.verifyErr != nil {
+		return f.verifyErr
+	}
+	return nil
+}
 func (f *fakeStore) ReadRepoInfo(zipPath string) (*storage.RepoInfo, error) {
 	if f.ensureInfo != nil {
 		return f.ensureInfo, nil
@@ -64,13 +313,8 @@ func TestDownloadHandler_UsesStore(t *testing.T) {
 	tmpDir := t.TempDir()
 	zipPath := filepath.Join(tmpDir, "repo.zip")
 	createZip(t, zipPath)
-	// commit file should be repo.commit.txt, not repo.zip.commit.txt
-	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
-	if err := os.WriteFile(commitPath, []byte("abc123\n"), 0o644); err != nil {
-		t.Fatal(err)
-	}
 
-	fs := &fakeStore{ensurePath: zipPath}
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123"}}
 	s := NewServerWithStore(fs, "", "default")
 	mux := http.NewServeMux()
 	s.RegisterRoutes(mux)
@@ -110,6 +354,447 @@ func TestDownloadHandler_UsesStore(t *testing.T) {
 	}
 }
 
+func TestDownloadHandler_LatestRelease(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "v1.2.0.zip")
+	createZip(t, zipPath)
+	for _, url := range []string{
+		"/api/v1/download?repo=own/repo&ref=latest-release",
+		"/api/v2/repos/own/repo/archive/latest-release",
+	} {
+		fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{Branch: "v1.2.0", CommitSHA: "abc1234def"}}
+		s := NewServerWithStore(fs, "", "default")
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Code != http.StatusOK || fs.lastBranch != storage.LatestRelease {
+			t.Fatalf("%s: status=%d branch=%q body=%s", url, rr.Code, fs.lastBranch, rr.Body.String())
+		}
+		if rr.Header().Get("X-GHH-Tag") != "v1.2.0" || rr.Header().Get("X-GHH-Commit") != "abc1234def" || rr.Header().Get("X-GHH-Commit-Short") != "abc1234" {
+			t.Fatalf("%s: tag=%q commit=%q short=%q", url, rr.Header().Get("X-GHH-Tag"), rr.Header().Get("X-GHH-Commit"), rr.Header().Get("X-GHH-Commit-Short"))
+		}
+	}
+}
+
+func TestDownloadHandler_PullRequest(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "7.zip")
+	createZip(t, zipPath)
+	head := strings.Repeat("c", 40)
+	gone := &storage.BranchGoneError{Repo: "own/repo", Branch: "pr/7", LastCommit: head}
+	cases := []struct {
+		name       string
+		query      string
+		err        error
+		wantStatus int
+		wantBranch string
+		wantCommit string
+	}{
+		{"open", "pr=7", nil, http.StatusOK, "pr/7", head},
+		{"head deleted", "pr=7", gone, http.StatusGone, "pr/7", head},
+		{"unknown", "pr=8", fmt.Errorf("pull request #8 of own/repo: %w", storage.ErrBranchNotFound), http.StatusNotFound, "pr/8", ""},
+		{"not a number", "pr=abc", nil, http.StatusBadRequest, "", ""},
+		{"with branch", "pr=7&branch=main", nil, http.StatusBadRequest, "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeStore{ensurePath: zipPath, ensureErr: tc.err, ensureMeta: &storage.ArchiveMeta{CommitSHA: head}}
+			s := NewServerWithStore(fs, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&"+tc.query, nil))
+			if rr.Code != tc.wantStatus || fs.lastBranch != tc.wantBranch {
+				t.Fatalf("status=%d branch=%q, want %d %q; body=%s", rr.Code, fs.lastBranch, tc.wantStatus, tc.wantBranch, rr.Body.String())
+			}
+			if got := rr.Header().Get("X-GHH-Commit"); got != tc.wantCommit {
+				t.Fatalf("X-GHH-Commit=%q, want %q", got, tc.wantCommit)
+			}
+			if tc.wantStatus == http.StatusOK && !strings.Contains(rr.Header().Get("Content-Disposition"), "own-repo-pr-7.zip") {
+				t.Fatalf("Content-Disposition=%q", rr.Header().Get("Content-Disposition"))
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_CompressedArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	body, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123", Size: int64(len(body)), Compression: storage.CompressionZstd, StoredSize: 10}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(body)) || !bytes.Equal(got, body) {
+		t.Fatalf("status=%d content-length=%d body=%d bytes, want %d", resp.StatusCode, resp.ContentLength, len(got), len(body))
+	}
+	if resp.Header.Get("Accept-Ranges") != "none" {
+		t.Fatalf("Accept-Ranges %q, want none", resp.Header.Get("Accept-Ranges"))
+	}
+
+	// Range is ignored: the archive cannot seek, and is sent whole.
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download?repo=own/repo&branch=main", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+		t.Fatalf("range: status=%d body=%d bytes, want the whole %d", resp.StatusCode, len(got), len(body))
+	}
+}
+
+func TestDownloadHandler_Normalize(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123", SHA256: "original"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		name     string
+		dflt     bool
+		query    string
+		wantSHA  string
+		wantCall int
+	}{
+		{"off by default", false, "", "original", 0},
+		{"query", false, "&normalize=true", "normalized", 1},
+		{"server default", true, "", "normalized", 1},
+		{"query opts out", true, "&normalize=false", "original", 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs.normalizeCalls = 0
+			s.SetNormalizeArchives(tc.dflt)
+			resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if got := resp.Header.Get("X-GHH-SHA256"); got != tc.wantSHA || fs.normalizeCalls != tc.wantCall {
+				t.Fatalf("X-GHH-SHA256=%q normalize calls=%d", got, fs.normalizeCalls)
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_Root(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123", SHA256: "original"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		name       string
+		query      string
+		rerootErr  error
+		wantStatus int
+		wantSHA    string
+		wantRoot   storage.RootMode
+	}{
+		{"none", "&root=none", nil, http.StatusOK, "", storage.RootNone},
+		{"keep serves as is", "&root=keep", nil, http.StatusOK, "original", ""},
+		{"normalized", "&root=none&normalize=true", nil, http.StatusOK, "normalized", storage.RootNone},
+		{"invalid", "&root=flat", nil, http.StatusBadRequest, "", ""},
+		{"collision", "&root=none", fmt.Errorf("entry collides: %w", storage.ErrExists), http.StatusConflict, "", storage.RootNone},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs.lastRoot, fs.rerootErr = "", tc.rerootErr
+			resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status=%d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if got := resp.Header.Get("X-GHH-SHA256"); resp.StatusCode == http.StatusOK && got != tc.wantSHA {
+				t.Fatalf("X-GHH-SHA256=%q, want %q", got, tc.wantSHA)
+			}
+			if fs.lastRoot != tc.wantRoot {
+				t.Fatalf("root=%q, want %q", fs.lastRoot, tc.wantRoot)
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_Prefix(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc123", SHA256: "original"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	cases := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantSHA    string
+		wantPrefix string
+	}{
+		{"v1", "/api/v1/download?repo=own/repo&branch=main&prefix=repo-1.0/", http.StatusOK, "prefixed", "repo-1.0"},
+		{"v2", "/api/v2/repos/own/repo/archive/main?prefix=third_party/repo", http.StatusOK, "prefixed", "third_party/repo"},
+		{"with normalize", "/api/v1/download?repo=own/repo&branch=main&normalize=true&prefix=x", http.StatusOK, "prefixed", "x"},
+		{"with root", "/api/v1/download?repo=own/repo&branch=main&root=repo&prefix=x", http.StatusBadRequest, "", ""},
+		{"normalize off", "/api/v1/download?repo=own/repo&branch=main&normalize=false&prefix=x", http.StatusBadRequest, "", ""},
+		{"traversal", "/api/v1/download?repo=own/repo&branch=main&prefix=../x", http.StatusBadRequest, "", ""},
+		{"empty", "/api/v2/repos/own/repo/archive/main?prefix=", http.StatusBadRequest, "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs.lastPrefix, fs.normalizeCalls = "", 0
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status=%d, want %d: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+			if fs.lastPrefix != tc.wantPrefix {
+				t.Fatalf("prefix=%q, want %q", fs.lastPrefix, tc.wantPrefix)
+			}
+			if tc.wantStatus != http.StatusOK {
+				if fs.normalizeCalls != 0 {
+					t.Fatal("rejected request was repacked")
+				}
+				return
+			}
+			if got := rec.Header().Get("X-GHH-SHA256"); got != tc.wantSHA {
+				t.Fatalf("X-GHH-SHA256=%q, want %q", got, tc.wantSHA)
+			}
+			if got := rec.Header().Get("X-GHH-Prefix"); got != tc.wantPrefix {
+				t.Fatalf("X-GHH-Prefix=%q", got)
+			}
+		})
+	}
+}
+
+func TestRepoInfoHandler(t *testing.T) {
+	cases := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantEnsure int
+		wantRemote bool
+		wantCached bool
+	}{
+		{"cache only", "", http.StatusOK, 0, false, false},
+		{"remote check", "&check=remote", http.StatusOK, 0, true, false},
+		{"ensure", "&ensure=true", http.StatusOK, 1, false, true},
+		{"bad check", "&check=github", http.StatusBadRequest, 0, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeStore{ensurePath: filepath.Join(t.TempDir(), "main.zip")}
+			s := NewServerWithStore(fs, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL + "/api/v1/repos/info?repo=own/repo&branch=main" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status=%d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if fs.ensureCalls != tc.wantEnsure || fs.lastRemote != tc.wantRemote {
+				t.Fatalf("ensure calls=%d remote=%v", fs.ensureCalls, fs.lastRemote)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var st storage.BranchStatus
+			if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Repo != "own/repo" || st.Cached != tc.wantCached {
+				t.Fatalf("status %+v", st)
+			}
+		})
+	}
+}
+
+func TestCachedBranchesHandler(t *testing.T) {
+	cases := []struct {
+		name       string
+		query      string
+		cached     bool
+		wantStatus int
+		wantBody   string
+		wantRemote bool
+	}{
+		{"nothing cached", "", false, http.StatusOK, `{"branches":[],"repo":"own/repo"}`, false},
+		{"cached", "", true, http.StatusOK, `{"branches":[{"branch":"main","short_sha":"abc123","size":3,"last_accessed":"0001-01-01T00:00:00Z"}],"repo":"own/repo"}`, false},
+		{"remote check", "&check=remote", false, http.StatusOK, `{"branches":[],"repo":"own/repo"}`, true},
+		{"bad check", "&check=github", false, http.StatusBadRequest, "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeStore{}
+			if tc.cached {
+				fs.ensureCalls = 1
+			}
+			s := NewServerWithStore(fs, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL + "/api/v1/repos/cached-branches?repo=own/repo" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status=%d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if got := strings.TrimSpace(string(body)); got != tc.wantBody {
+				t.Fatalf("body %s, want %s", got, tc.wantBody)
+			}
+			if fs.lastRemote != tc.wantRemote || fs.lastUser != "default" {
+				t.Fatalf("user=%q remote=%v", fs.lastUser, fs.lastRemote)
+			}
+		})
+	}
+}
+
+func TestTokenValidateHandler(t *testing.T) {
+	cases := []struct {
+		name       string
+		body       string
+		header     string
+		wantStatus int
+		wantToken  string
+		wantValid  bool
+	}{
+		{"body token", `{"token":"good","repo":"own/repo"}`, "", http.StatusOK, "good", true},
+		{"header token", `{"repo":"own/repo"}`, "bad", http.StatusOK, "bad", false},
+		{"empty body", ``, "good", http.StatusOK, "good", true},
+		{"no token", `{"repo":"own/repo"}`, "", http.StatusBadRequest, "", false},
+		{"bad json", `{`, "good", http.StatusBadRequest, "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &fakeStore{}
+			s := NewServerWithStore(fs, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/user/token/validate", strings.NewReader(tc.body))
+			if tc.header != "" {
+				req.Header.Set("X-GHH-Token", tc.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != tc.wantStatus || fs.lastToken != tc.wantToken {
+				t.Fatalf("status=%d token=%q", resp.StatusCode, fs.lastToken)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var v storage.TokenValidation
+			if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Valid != tc.wantValid {
+				t.Fatalf("valid=%v", v.Valid)
+			}
+		})
+	}
+}
+
+func TestTokenValidateRoutedCredential(t *testing.T) {
+	fs := &fakeStore{}
+	s := NewServerWithStore(fs, "srv", "default")
+	routes, err := storage.NewTokenRoutes(map[string]string{"server": "srv", "acme": "good", "public": ""}, []string{"acme=acme", "oss=public"}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTokenRoutes(routes)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		body, header   string
+		wantCredential string
+		wantToken      string
+		wantKind       string
+	}{
+		{`{"repo":"acme/app"}`, "", "acme", "good", storage.TokenUnknown},
+		{`{"repo":"other/app"}`, "", "server", "srv", storage.TokenUnknown},
+		{`{"repo":"oss/lib"}`, "", "public", "", storage.TokenNone},
+		{`{"repo":"acme/app"}`, "mine", "", "mine", storage.TokenUnknown},
+	}
+	for _, tc := range cases {
+		fs.lastToken = ""
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/user/token/validate", strings.NewReader(tc.body))
+		if tc.header != "" {
+			req.Header.Set("X-GHH-Token", tc.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v storage.TokenValidation
+		err = json.NewDecoder(resp.Body).Decode(&v)
+		_ = resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status=%d err=%v", tc.body, resp.StatusCode, err)
+		}
+		if v.Credential != tc.wantCredential || v.Kind != tc.wantKind || fs.lastToken != tc.wantToken {
+			t.Fatalf("%s (header %q): got %+v with token %q", tc.body, tc.header, v, fs.lastToken)
+		}
+	}
+
+	// Without a repo there is nothing to route, so the token is missing.
+	resp, err := http.Post(ts.URL+"/api/v1/user/token/validate", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status without repo = %d", resp.StatusCode)
+	}
+}
+
 func TestDownloadInfoHandler(t *testing.T) {
 	tmpDir := t.TempDir()
 	zipPath := filepath.Join(tmpDir, "repo.zip")
@@ -222,13 +907,8 @@ func TestDownloadCommitHandler(t *testing.T) {
 	tmpDir := t.TempDir()
 	zipPath := filepath.Join(tmpDir, "repo.zip")
 	createZip(t, zipPath)
-	// commit file should be repo.commit.txt, not repo.zip.commit.txt
-	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
-	if err := os.WriteFile(commitPath, []byte("deadbeef\n"), 0o644); err != nil {
-		t.Fatal(err)
-	}
 
-	fs := &fakeStore{ensurePath: zipPath}
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{CommitSHA: "deadbeef0123456789"}}
 	s := NewServerWithStore(fs, "", "default")
 	mux := http.NewServeMux()
 	s.RegisterRoutes(mux)
@@ -244,9 +924,20 @@ func TestDownloadCommitHandler(t *testing.T) {
 		t.Fatalf("status=%d", resp.StatusCode)
 	}
 	body, _ := io.ReadAll(resp.Body)
-	if strings.TrimSpace(string(body)) != "deadbeef" {
+	if strings.TrimSpace(string(body)) != "deadbeef0123456789" {
 		t.Fatalf("commit body mismatch: %q", string(body))
 	}
+
+	// short=true keeps the abbreviated form older clients expect.
+	resp, err = http.Get(ts.URL + "/api/v1/download/commit?repo=own/repo&branch=main&short=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ = io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != "deadbee" {
+		t.Fatalf("short commit body mismatch: %q", string(body))
+	}
 }
 
 func TestDownloadPackageHandler_UsesStore(t *testing.T) {
@@ -309,6 +1000,184 @@ func TestBranchSwitchHandler_UsesStore(t *testing.T) {
 	}
 }
 
+func TestDownloadHandler_ChecksumHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{SHA256: "cafe", Size: 3, CommitSHA: "abc123", FetchedAt: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/download?repo=own/repo&branch=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got := resp.Header.Get("X-GHH-SHA256"); got != "cafe" {
+		t.Fatalf("X-GHH-SHA256=%q", got)
+	}
+	if got := resp.Header.Get("X-GHH-Fetched-At"); got != "2024-05-06T07:08:09Z" {
+		t.Fatalf("X-GHH-Fetched-At=%q", got)
+	}
+}
+
+func TestDownloadChecksumHandler(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{SHA256: "cafe", Size: 3, CommitSHA: "abc123"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/download/checksum?repo=own/repo&branch=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d", resp.StatusCode)
+	}
+	var got struct {
+		SHA256 string `json:"sha256"`
+		Size   int64  `json:"size"`
+		Commit string `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA256 != "cafe" || got.Size != 3 || got.Commit != "abc123" {
+		t.Fatalf("got %+v", got)
+	}
+	if fs.verifyCalls != 0 {
+		t.Fatalf("verify should be opt-in")
+	}
+
+	// verify=true with a mismatch refetches with force.
+	fs.verifyErr = storage.ErrChecksumMismatch
+	resp2, err := http.Get(ts.URL + "/api/v1/download/checksum?repo=own/repo&branch=main&verify=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK || !fs.lastForce {
+		t.Fatalf("status=%d force=%v", resp2.StatusCode, fs.lastForce)
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"none uses server default", nil, "server"},
+		{"x-ghh-token", map[string]string{"X-GHH-Token": "pat1"}, "pat1"},
+		{"github scheme", map[string]string{"Authorization": "github pat2"}, "pat2"},
+		{"github colon scheme", map[string]string{"Authorization": "GitHub:pat3"}, "pat3"},
+		{"legacy bearer", map[string]string{"Authorization": "Bearer pat4"}, "pat4"},
+		{"header beats authorization", map[string]string{"X-GHH-Token": "pat5", "Authorization": "github other"}, "pat5"},
+		{"unknown scheme ignored", map[string]string{"Authorization": "Basic abc"}, "server"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/download", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := tokenFromRequest(r, "server"); got != tc.want {
+				t.Fatalf("got %q want %q", got, tc.want)
+			}
+		})
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/download", nil)
+	if got := tokenFromRequest(r, ""); got != "" {
+		t.Fatalf("expected anonymous access, got %q", got)
+	}
+}
+
+func TestPerRequestTokenReachesStoreAndIsNotLogged(t *testing.T) {
+	const secret = "ghp_supersecret123"
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "repo.zip")
+	createZip(t, zipPath)
+
+	fs := &fakeStore{ensurePath: zipPath}
+	s := NewServerWithStore(fs, "server-token", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	out := captureStdout(t, func() {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download?repo=own/repo&branch=main", nil)
+		req.Header.Set("X-GHH-Token", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if fs.lastToken != secret {
+			t.Fatalf("download: store got token %q", fs.lastToken)
+		}
+
+		body, _ := json.Marshal(map[string]string{"repo": "own/repo", "branch": "dev"})
+		req, _ = http.NewRequest(http.MethodPost, ts.URL+"/api/v1/branch/switch", bytes.NewReader(body))
+		req.Header.Set("Authorization", "github "+secret)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if fs.lastToken != secret {
+			t.Fatalf("branch switch: store got token %q", fs.lastToken)
+		}
+
+		// Errors that echo the token must be redacted in logs and responses.
+		fs.ensureErr = errors.New("clone https://" + secret + "@github.com/own/repo.git failed")
+		req, _ = http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download?repo=own/repo&branch=main", nil)
+		req.Header.Set("X-GHH-Token", secret)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if strings.Contains(string(respBody), secret) {
+			t.Fatalf("token echoed in error response: %s", respBody)
+		}
+	})
+	if strings.Contains(out, secret) {
+		t.Fatalf("token leaked into logs:\n%s", out)
+	}
+}
+
+// captureStdout redirects os.Stdout (where the server logs) while fn runs.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	defer func() { os.Stdout = orig }()
+	fn()
+	_ = w.Close()
+	os.Stdout = orig
+	return <-done
+}
+
 func createZip(t *testing.T, path string) {
 	t.Helper()
 	f, err := os.Create(path)
@@ -330,3 +1199,838 @@ func createZip(t *testing.T, path string) {
 		t.Fatal(err)
 	}
 }
+
+func TestDownloadCommitHandler_Ref(t *testing.T) {
+	info := &storage.RefInfo{Ref: "v1.0.0", SHA: "0123456789abcdef0123456789abcdef01234567", Short: "0123456", Type: storage.RefTag}
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		wantJSON bool
+		wantRef  string
+		wantBody string
+	}{
+		{name: "json by accept", query: "repo=own/repo&ref=v1.0.0", accept: "application/json", wantJSON: true, wantRef: "v1.0.0"},
+		{name: "json by format", query: "repo=own/repo&ref=v1.0.0&format=json", wantJSON: true, wantRef: "v1.0.0"},
+		{name: "text without accept", query: "repo=own/repo&ref=v1.0.0", wantRef: "v1.0.0", wantBody: "0123456\n"},
+		{name: "format=text wins", query: "repo=own/repo&ref=v1.0.0&format=text", accept: "application/json", wantRef: "v1.0.0", wantBody: "0123456\n"},
+		{name: "default branch json", query: "repo=own/repo", accept: "application/json", wantJSON: true, wantRef: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStore{refInfo: info}
+			s := NewServerWithStore(fs, "", "default")
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/download/commit?"+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			s.handleDownloadCommit(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+			}
+			if fs.lastRef != tt.wantRef {
+				t.Fatalf("ref=%q want %q", fs.lastRef, tt.wantRef)
+			}
+			if tt.wantJSON {
+				var got storage.RefInfo
+				if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if got != *info {
+					t.Fatalf("got %+v", got)
+				}
+				return
+			}
+			if rr.Body.String() != tt.wantBody {
+				t.Fatalf("body=%q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestDownloadCommitHandler_UnknownRef(t *testing.T) {
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/download/commit?repo=own/repo&ref=nope", nil)
+	rr := httptest.NewRecorder()
+	s.handleDownloadCommit(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("status=%d", rr.Code)
+	}
+}
+
+func TestDefaultBranchHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantErr  string // v2 error code
+	}{
+		{name: "ok", wantCode: http.StatusOK},
+		{name: "repo missing", err: fmt.Errorf("own/repo: %w", storage.ErrRepoNotFound), wantCode: http.StatusNotFound, wantErr: CodeRepoNotFound},
+		{name: "rate limited", err: fmt.Errorf("%w: 403", storage.ErrRateLimited), wantCode: http.StatusTooManyRequests, wantErr: CodeRateLimited},
+		{name: "other", err: errors.New("boom"), wantCode: http.StatusInternalServerError, wantErr: CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStore{ensureErr: tt.err, branchInfo: &storage.DefaultBranchInfo{Repo: "own/repo", DefaultBranch: "main", CachedBranches: []string{"dev", "main"}}}
+			s := NewServerWithStore(fs, "", "default")
+			rr := httptest.NewRecorder()
+			s.handleDefaultBranch(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/default-branch?repo=own/repo", nil))
+			if rr.Code != tt.wantCode {
+				t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+			}
+			if tt.wantErr == "" {
+				var got storage.DefaultBranchInfo
+				if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got.DefaultBranch != "main" || len(got.CachedBranches) != 2 {
+					t.Fatalf("body=%s err=%v", rr.Body.String(), err)
+				}
+				return
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if body.Error.Code != tt.wantErr || rr.Header().Get("X-GHH-Error-Code") != tt.wantErr {
+				t.Fatalf("code=%q header=%q", body.Error.Code, rr.Header().Get("X-GHH-Error-Code"))
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_ErrorClassification(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantV1     int
+		wantV2     int
+		wantCode   string
+		retryAfter string
+	}{
+		{name: "bad path", err: fmt.Errorf("x: %w", storage.ErrBadPath), wantV1: http.StatusBadRequest, wantV2: http.StatusBadRequest, wantCode: CodeBadRequest},
+		{name: "repo missing", err: &storage.NotFoundError{Repo: "own/repo"}, wantV1: http.StatusNotFound, wantV2: http.StatusNotFound, wantCode: CodeRepoNotFound},
+		{name: "branch missing", err: &storage.NotFoundError{Repo: "own/repo", Branch: "main"}, wantV1: http.StatusNotFound, wantV2: http.StatusNotFound, wantCode: CodeBranchNotFound},
+		{name: "rate limited", err: fmt.Errorf("%w: %w", &storage.RateLimitError{RetryAfter: 90 * time.Second}, storage.ErrUnauthorizedUpstream), wantV1: http.StatusInternalServerError, wantV2: http.StatusTooManyRequests, wantCode: CodeRateLimited, retryAfter: "90"},
+		{name: "credentials refused", err: fmt.Errorf("branch sha failed: status=401: %w", storage.ErrUnauthorizedUpstream), wantV1: http.StatusForbidden, wantV2: http.StatusForbidden, wantCode: CodeUpstreamUnauthorized},
+		{name: "upstream down", err: fmt.Errorf("%w: dial tcp: connection refused", storage.ErrUpstreamUnavailable), wantV1: http.StatusBadGateway, wantV2: http.StatusBadGateway, wantCode: CodeUpstreamUnavailable},
+		{name: "redirect refused", err: fmt.Errorf("https://host/pkg.zip redirected to http://host/pkg.zip: %w", storage.ErrRedirectPolicy), wantV1: http.StatusBadGateway, wantV2: http.StatusBadGateway, wantCode: CodeRedirectRefused},
+		{name: "too large", err: fmt.Errorf("limit: %w", storage.ErrTooLarge), wantV1: http.StatusRequestEntityTooLarge, wantV2: http.StatusRequestEntityTooLarge, wantCode: CodeTooLarge},
+		{name: "checksum", err: fmt.Errorf("main.zip: %w", storage.ErrChecksumMismatch), wantV1: http.StatusInternalServerError, wantV2: http.StatusInternalServerError, wantCode: CodeChecksumMismatch},
+		{name: "local failure", err: errors.New("disk on fire"), wantV1: http.StatusInternalServerError, wantV2: http.StatusInternalServerError, wantCode: CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{ensureErr: tt.err}, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			for _, tc := range []struct {
+				url  string
+				want int
+			}{
+				{"/api/v1/download?repo=own/repo&branch=main&format=json", tt.wantV1},
+				{"/api/v2/repos/own/repo/archive/main", tt.wantV2},
+			} {
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				if rr.Code != tc.want {
+					t.Fatalf("%s: status=%d, want %d (%s)", tc.url, rr.Code, tc.want, rr.Body.String())
+				}
+				if got := rr.Header().Get("X-GHH-Error-Code"); got != tt.wantCode {
+					t.Fatalf("%s: code=%q, want %q", tc.url, got, tt.wantCode)
+				}
+				if got := rr.Header().Get("Retry-After"); got != tt.retryAfter {
+					t.Fatalf("%s: Retry-After=%q, want %q", tc.url, got, tt.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_StalePolicy(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	tests := []struct {
+		name      string
+		url       string
+		outcome   storage.CacheOutcome
+		err       error
+		wantCode  int
+		wantStale string
+	}{
+		{name: "fresh", url: "/api/v1/download?repo=own/repo&branch=main", outcome: storage.CacheMiss, wantCode: http.StatusOK},
+		{name: "stale served", url: "/api/v1/download?repo=own/repo&branch=main&stale=prefer-cache", outcome: storage.CacheStale, wantCode: http.StatusOK, wantStale: "unverified"},
+		{name: "refused", url: "/api/v2/repos/own/repo/archive/main?stale=fail", err: &storage.StaleError{Repo: "own/repo", Branch: "main", Err: errors.New("status=502")}, wantCode: http.StatusBadGateway},
+		{name: "bad policy", url: "/api/v1/download?repo=own/repo&stale=sometimes", wantCode: http.StatusBadRequest},
+		{name: "bad max age", url: "/api/v2/repos/own/repo/archive/main?max_age=-5", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{ensurePath: zipPath, outcome: tt.outcome, ensureErr: tt.err}, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rr.Code != tt.wantCode || rr.Header().Get("X-GHH-Stale") != tt.wantStale {
+				t.Fatalf("status=%d stale=%q body=%s", rr.Code, rr.Header().Get("X-GHH-Stale"), rr.Body.String())
+			}
+			if warned := strings.HasPrefix(rr.Header().Get("Warning"), "110 "); warned != (tt.wantStale != "") {
+				t.Fatalf("Warning=%q", rr.Header().Get("Warning"))
+			}
+			if tt.err != nil && rr.Header().Get("X-GHH-Error-Code") != CodeUnverified {
+				t.Fatalf("code=%q", rr.Header().Get("X-GHH-Error-Code"))
+			}
+		})
+	}
+}
+
+func TestMaxAgeParam(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, true},
+		{"max_age=0", 0, true},
+		{"max_age=3600", time.Hour, true},
+		{"max_age=90s", 90 * time.Second, true},
+		{"max_age=-1", 0, false},
+		{"max_age=soon", 0, false},
+	} {
+		rr := httptest.NewRecorder()
+		got, ok := maxAgeParam(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&"+tt.query, nil))
+		if got != tt.want || ok != tt.ok || (!ok && rr.Code != http.StatusBadRequest) {
+			t.Fatalf("%q: got %s ok=%t status=%d", tt.query, got, ok, rr.Code)
+		}
+	}
+}
+
+func TestRepoCommitsHandler(t *testing.T) {
+	fs := &fakeStore{commits: []storage.CommitEntry{{SHA: "abcdef0123456789", Short: "abcdef0", Author: "dev", Message: "fix"}}}
+	s := NewServerWithStore(fs, "", "default")
+	rr := httptest.NewRecorder()
+	s.handleRepoCommits(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/commits?repo=own/repo&ref=main&since=1234567&limit=5", nil))
+	var got []storage.CommitEntry
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &got) != nil || len(got) != 1 || got[0].Short != "abcdef0" {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if fs.lastRepo != "own/repo" || fs.lastRef != "main" || fs.lastSince != "1234567" || fs.lastLimit != 5 {
+		t.Fatalf("unexpected args repo=%q ref=%q since=%q limit=%d", fs.lastRepo, fs.lastRef, fs.lastSince, fs.lastLimit)
+	}
+
+	for _, tt := range []struct {
+		query string
+		err   error
+		want  int
+	}{
+		{query: "repo=own/repo&limit=x", want: http.StatusBadRequest},
+		{query: "limit=3", want: http.StatusBadRequest},
+		{query: "repo=own/repo", err: fmt.Errorf("list commits: %w", storage.ErrNotFound), want: http.StatusNotFound},
+		{query: "repo=own/repo", err: storage.ErrRateLimited, want: http.StatusTooManyRequests},
+	} {
+		s := NewServerWithStore(&fakeStore{ensureErr: tt.err}, "", "default")
+		rr := httptest.NewRecorder()
+		s.handleRepoCommits(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/commits?"+tt.query, nil))
+		if rr.Code != tt.want || rr.Header().Get("X-GHH-Error-Code") == "" {
+			t.Fatalf("%s: status=%d body=%s", tt.query, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRepoArgNormalizesSpellings(t *testing.T) {
+	for _, repo := range []string{"own/repo", "own/repo.git", "https://github.com/own/repo", "https%3A%2F%2Fgithub.com%2Fown%2Frepo.git%2F", "%2Fown%2Frepo%2F"} {
+		fs := &fakeStore{}
+		s := NewServerWithStore(fs, "", "default")
+		rr := httptest.NewRecorder()
+		s.handleRepoCommits(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/commits?repo="+repo, nil))
+		if rr.Code != http.StatusOK || fs.lastRepo != "own/repo" {
+			t.Fatalf("%s: status=%d repo=%q", repo, rr.Code, fs.lastRepo)
+		}
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	err := fmt.Errorf("fetch: %w", &storage.RateLimitError{RetryAfter: 1500 * time.Millisecond, Breaker: true})
+	for _, url := range []string{"/api/v1/download?repo=own/repo", "/api/v1/repos/default-branch?repo=own/repo"} {
+		s := NewServerWithStore(&fakeStore{ensureErr: err}, "", "default")
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Header().Get("Retry-After") != "2" {
+			t.Fatalf("%s: Retry-After=%q status=%d", url, rr.Header().Get("Retry-After"), rr.Code)
+		}
+	}
+}
+
+func TestDownloadHandler_BranchGone(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "feature.zip")
+	createZip(t, zipPath)
+	goneErr := &storage.BranchGoneError{Repo: "own/repo", Branch: "feature", LastCommit: "abcdef0123456789", ZipPath: zipPath}
+
+	for _, stale := range []bool{false, true} {
+		fs := &fakeStore{ensureErr: goneErr}
+		s := NewServerWithStore(fs, "", "default")
+		s.SetBranchGonePolicy(stale, 0)
+		rr := httptest.NewRecorder()
+		s.handleDownload(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=feature", nil))
+		if !stale {
+			if rr.Code != http.StatusGone || rr.Header().Get("X-GHH-Commit") != "abcdef0123456789" || rr.Header().Get("X-GHH-Commit-Short") != "abcdef012345" || !strings.Contains(rr.Body.String(), "abcdef0123456789") {
+				t.Fatalf("status=%d commit=%q short=%q body=%q", rr.Code, rr.Header().Get("X-GHH-Commit"), rr.Header().Get("X-GHH-Commit-Short"), rr.Body.String())
+			}
+			continue
+		}
+		if rr.Code != http.StatusOK || rr.Header().Get("X-GHH-Stale") != "branch-deleted" || !strings.HasPrefix(rr.Header().Get("Warning"), "110 ") {
+			t.Fatalf("stale: status=%d headers=%v", rr.Code, rr.Header())
+		}
+	}
+}
+
+func TestDownloadHandler_Strict(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	goneErr := &storage.BranchGoneError{Repo: "own/repo", Branch: "main", LastCommit: "abcdef0123456789", ZipPath: zipPath}
+	tests := []struct {
+		name     string
+		url      string
+		server   bool // SetStrictVerification
+		err      error
+		wantCode int
+		wantErr  string // v2 error code
+	}{
+		{name: "lookup failed", url: "/api/v2/repos/own/repo/archive/main?strict=true", err: &storage.UnverifiableError{Repo: "own/repo", Branch: "main", Reason: "upstream commit lookup failed", Err: errors.New("status=502")}, wantCode: http.StatusBadGateway, wantErr: CodeUnverifiable},
+		{name: "pinned", url: "/api/v2/repos/own/repo/archive/main", err: &storage.UnverifiableError{Repo: "own/repo", Branch: "main", Reason: "archive is pinned by a rollback"}, wantCode: http.StatusConflict, wantErr: CodeUnverifiable},
+		{name: "gone served when lenient", url: "/api/v1/download?repo=own/repo&branch=main", err: goneErr, wantCode: http.StatusOK},
+		{name: "gone refused per request", url: "/api/v1/download?repo=own/repo&branch=main&strict=true", err: goneErr, wantCode: http.StatusGone},
+		{name: "gone refused by server", url: "/api/v2/repos/own/repo/archive/main?strict=false", server: true, err: goneErr, wantCode: http.StatusGone, wantErr: CodeBranchGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{ensurePath: zipPath, ensureErr: tt.err}, "", "default")
+			s.SetBranchGonePolicy(true, 0)
+			s.SetStrictVerification(tt.server)
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rr.Code != tt.wantCode || rr.Header().Get("X-GHH-Error-Code") != tt.wantErr {
+				t.Fatalf("status=%d code=%q body=%s", rr.Code, rr.Header().Get("X-GHH-Error-Code"), rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_CommitAndRollback(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.abc1234.zip")
+	createZip(t, zipPath)
+	meta := &storage.ArchiveMeta{Repo: "own/repo", Branch: "main", CommitSHA: "abc1234def", SHA256: "feed"}
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: meta}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetShortSHALength(7)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&commit=abc1234", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-GHH-Commit") != "abc1234def" || rr.Header().Get("X-GHH-Commit-Short") != "abc1234" || rr.Header().Get("X-GHH-SHA256") != "feed" {
+		t.Fatalf("status=%d headers=%v", rr.Code, rr.Header())
+	}
+	if got := rr.Header().Get("Cache-Control"); got != immutableCacheControl {
+		t.Fatalf("Cache-Control=%q", got)
+	}
+	if fs.lastCommit != "abc1234" || fs.lastForce {
+		t.Fatalf("commit=%q force=%v", fs.lastCommit, fs.lastForce)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&commit=9999999", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown commit: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/download/rollback?repo=own/repo&branch=main", nil))
+	var got storage.ArchiveMeta
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &got) != nil || got.CommitSHA != meta.CommitSHA {
+		t.Fatalf("rollback: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+
+	s = NewServerWithStore(&fakeStore{}, "", "default")
+	rr = httptest.NewRecorder()
+	s.handleDownloadRollback(rr, httptest.NewRequest(http.MethodPost, "/api/v1/download/rollback?repo=own/repo", nil))
+	if rr.Code != http.StatusNotFound || rr.Header().Get("X-GHH-Error-Code") != CodeNotFound {
+		t.Fatalf("nothing to roll back: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUpstreamNotFoundIs404(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		method   string
+		url      string
+		body     string
+		wantCode string
+	}{
+		{"download missing repo", &storage.NotFoundError{Repo: "own/typo"}, http.MethodGet, "/api/v1/download?repo=own/typo&format=json", "", CodeRepoNotFound},
+		{"download missing branch", &storage.NotFoundError{Repo: "own/repo", Branch: "nope"}, http.MethodGet, "/api/v1/download?repo=own/repo&branch=nope&format=json", "", CodeBranchNotFound},
+		{"v2 missing branch", &storage.NotFoundError{Repo: "own/repo", Branch: "nope"}, http.MethodGet, "/api/v2/repos/own/repo/archive/nope", "", CodeBranchNotFound},
+		{"switch missing repo", &storage.NotFoundError{Repo: "own/typo", Token: true}, http.MethodPost, "/api/v1/branch/switch?format=json", `{"repo":"own/typo","branch":"main"}`, CodeRepoNotFound},
+		{"download plain text", &storage.NotFoundError{Repo: "own/typo"}, http.MethodGet, "/api/v1/download?repo=own/typo", "", ""},
+		{"download empty repo", fmt.Errorf("own/new has no commits yet: %w", storage.ErrEmptyRepo), http.MethodGet, "/api/v1/download?repo=own/new&format=json", "", CodeEmptyRepo},
+		{"v2 empty repo", fmt.Errorf("own/new has no commits yet: %w", storage.ErrEmptyRepo), http.MethodGet, "/api/v2/repos/own/new/archive/main", "", CodeEmptyRepo},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{ensureErr: tc.err}, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body)))
+			if rr.Code != http.StatusNotFound {
+				t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+			}
+			if tc.wantCode == "" {
+				if !strings.Contains(rr.Body.String(), tc.err.Error()) {
+					t.Fatalf("body=%q", rr.Body.String())
+				}
+				return
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode %q: %v", rr.Body.String(), err)
+			}
+			if body.Error.Code != tc.wantCode || !strings.Contains(body.Error.Message, tc.err.Error()) {
+				t.Fatalf("error = %+v", body.Error)
+			}
+		})
+	}
+}
+
+func TestCacheHeader(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	cases := []struct {
+		outcome storage.CacheOutcome
+		want    string
+	}{
+		{storage.CacheHit, "hit"},
+		{storage.CacheRevalidated, "revalidated"},
+		{storage.CacheMiss, "miss"},
+		{storage.CacheStale, "hit"},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.outcome), func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{ensurePath: zipPath, outcome: tc.outcome}, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main", nil))
+			if rr.Code != http.StatusOK || rr.Header().Get("X-GHH-Cache") != tc.want {
+				t.Fatalf("download: status=%d X-GHH-Cache=%q", rr.Code, rr.Header().Get("X-GHH-Cache"))
+			}
+
+			rr = httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/v1/branch/switch?format=json", strings.NewReader(`{"repo":"own/repo","branch":"main"}`)))
+			var got branchSwitchResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("switch: status=%d body=%s", rr.Code, rr.Body.String())
+			}
+			if got.Cache != tc.want || rr.Header().Get("X-GHH-Cache") != tc.want || got.Repo != "own/repo" {
+				t.Fatalf("switch: %+v X-GHH-Cache=%q", got, rr.Header().Get("X-GHH-Cache"))
+			}
+		})
+	}
+}
+
+func TestInsufficientSpaceIs507(t *testing.T) {
+	err := &storage.SpaceError{Dir: "/data", Need: 2048, Free: 1024}
+	for _, url := range []string{"/api/v1/download?repo=own/repo&format=json", "/api/v1/download?repo=own/repo", "/api/v2/repos/own/repo/archive/main"} {
+		s := NewServerWithStore(&fakeStore{ensureErr: err}, "", "default")
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Code != http.StatusInsufficientStorage {
+			t.Fatalf("%s: status=%d body=%s", url, rr.Code, rr.Body.String())
+		}
+		if !strings.Contains(rr.Body.String(), err.Error()) {
+			t.Fatalf("%s: body=%q", url, rr.Body.String())
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestDownloadHandler_FreshnessHeaders(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.store.(*storage.Storage)
+	fetched := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := testutil.NewFakeClock(fetched)
+	st.Clock = clock
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := "zip-bytes"
+		if r.URL.Host == "api.github.com" {
+			body = `{"commit":{"sha":"abc123"}}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	cases := []struct {
+		name     string
+		elapsed  time.Duration
+		since    time.Time // If-Modified-Since
+		wantCode int
+		wantAge  string
+	}{
+		{"fresh download", 0, time.Time{}, http.StatusOK, "0"},
+		// Serving resets the file mtime; the headers must not move.
+		{"cached a while later", 90 * time.Second, time.Time{}, http.StatusOK, "90"},
+		{"not modified since fetch", 2 * time.Minute, fetched, http.StatusNotModified, "120"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock.Set(fetched.Add(tc.elapsed))
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main&legacy=true", nil)
+			if !tc.since.IsZero() {
+				req.Header.Set("If-Modified-Since", tc.since.Format(http.TimeFormat))
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != tc.wantCode {
+				t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+			}
+			h := rr.Header()
+			if h.Get("X-GHH-Fetched-At") != "2025-01-02T03:04:05Z" || h.Get("Age") != tc.wantAge || h.Get("Last-Modified") != fetched.Format(http.TimeFormat) {
+				t.Fatalf("fetched-at=%q age=%q last-modified=%q", h.Get("X-GHH-Fetched-At"), h.Get("Age"), h.Get("Last-Modified"))
+			}
+		})
+	}
+}
+
+func TestRepoManifestHandler(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"repo-abc1234/a.txt", "repo-abc1234/b.txt"} {
+		w, _ := zw.Create(name)
+		_, _ = w.Write([]byte("content of " + name))
+	}
+	_ = zw.Close()
+	st := s.store.(*storage.Storage)
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := archive.String()
+		if r.URL.Host == "api.github.com" {
+			body = `{"commit":{"sha":"abc1234def"}}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	get := func(branch string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/repos/manifest?repo=own/repo&legacy=true&branch="+branch, nil))
+		return rr
+	}
+
+	rr := get("main")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-GHH-Commit") != "abc1234def" {
+		t.Fatalf("status=%d commit=%q body=%s", rr.Code, rr.Header().Get("X-GHH-Commit"), rr.Body.String())
+	}
+	var m storage.Manifest
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(archive.Bytes())
+	if m.Repo != "own/repo" || m.CommitSHA != "abc1234def" || m.SHA256 != hex.EncodeToString(sum[:]) || m.FileCount != 2 || len(m.Files) != 2 {
+		t.Fatalf("manifest = %+v", m)
+	}
+
+	s.SetManifestLimits(1, 0)
+	rr = get("dev")
+	if rr.Code != http.StatusRequestEntityTooLarge || rr.Header().Get("X-GHH-Error-Code") != CodeTooLarge {
+		t.Fatalf("over the limit: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInvalidRefRejected(t *testing.T) {
+	bad := url.QueryEscape("../../etc")
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/api/v1/download?repo=own/repo&branch=" + bad, ""},
+		{http.MethodGet, "/api/v1/download?repo=own/repo&ref=-rf", ""},
+		{http.MethodGet, "/api/v1/download?repo=own/repo&branch=a%00b&commit=abc1234", ""},
+		{http.MethodGet, "/api/v1/download/commit?repo=own/repo&branch=a~1", ""},
+		{http.MethodGet, "/api/v1/download/info?repo=own/repo&branch=a:b", ""},
+		{http.MethodGet, "/api/v1/download/checksum?repo=own/repo&branch=" + strings.Repeat("x", 300), ""},
+		{http.MethodPost, "/api/v1/download/rollback?repo=own/repo&branch=" + bad, ""},
+		{http.MethodGet, "/api/v1/download/sparse?repo=own/repo&branch=a%5Eb", ""},
+		{http.MethodPost, "/api/v1/branch/switch", `{"repo":"own/repo","branch":"a..b"}`},
+		{http.MethodGet, "/api/v1/repos/commits?repo=own/repo&ref=" + bad, ""},
+		{http.MethodGet, "/api/v1/repos/info?repo=own/repo&branch=x.lock", ""},
+		{http.MethodGet, "/api/v1/repos/manifest?repo=own/repo&branch=a%5Cb", ""},
+		{http.MethodGet, "/api/v2/repos/own/repo/archive/a~1", ""},
+		{http.MethodGet, "/api/v2/repos/own/repo/commit/a@%7B1%7D", ""},
+		{http.MethodGet, "/api/v2/repos/own/repo/files/README.md?ref=-x", ""},
+	}
+	for _, tt := range tests {
+		fs := &fakeStore{}
+		s := NewServerWithStore(fs, "", "default")
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		s.Shutdown()
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid ref") {
+			t.Errorf("%s %.60s: status=%d body=%.200s", tt.method, tt.path, rr.Code, rr.Body.String())
+		}
+		if fs.ensureCalls != 0 || fs.lastRepo != "" {
+			t.Errorf("%s %.60s reached the store", tt.method, tt.path)
+		}
+	}
+}
+
+func TestArchiveSignatureEndpoints(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	_, priv, _ := ed25519.GenerateKey(nil)
+	keys, err := storage.NewSigningKeys(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &storage.ArchiveSignature{SHA256: strings.Repeat("ab", 32), Signature: "c2ln", KeyID: keys.KeyID(), Algorithm: storage.SignatureEd25519}
+	s := NewServerWithStore(&fakeStore{ensurePath: zipPath, signature: sig}, "", "default")
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{{Key: "k", User: "ci"}})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			req.Header.Set("X-GHH-Api-Key", "k")
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Disabled: no headers and no keys.
+	if rr := get("/api/v1/download?repo=own/repo", true); rr.Code != http.StatusOK || rr.Header().Get("X-GHH-Signature") != "" {
+		t.Fatalf("unsigned download: status=%d signature=%q", rr.Code, rr.Header().Get("X-GHH-Signature"))
+	}
+	if rr := get("/api/v1/public-key", false); rr.Code != http.StatusNotFound {
+		t.Fatalf("public key while disabled: status=%d", rr.Code)
+	}
+
+	s.SetSigning(keys)
+	rr := get("/api/v1/download?repo=own/repo", true)
+	if rr.Header().Get("X-GHH-Signature") != "c2ln" || rr.Header().Get("X-GHH-Signature-Key") != keys.KeyID() {
+		t.Fatalf("download headers %v", rr.Header())
+	}
+	rr = get("/api/v1/download/signature?repo=own/repo&branch=main", true)
+	var got storage.ArchiveSignature
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &got) != nil || got != *sig {
+		t.Fatalf("signature: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/api/v1/download/signature?repo=own/repo", false); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("signature without key: status=%d", rr.Code)
+	}
+
+	// The public key needs no API key.
+	rr = get("/api/v1/public-key", false)
+	var pub struct {
+		Keys []storage.SigningPublicKey `json:"keys"`
+	}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &pub) != nil || len(pub.Keys) != 1 || pub.Keys[0].KeyID != keys.KeyID() {
+		t.Fatalf("public key: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	raw, _ := base64.StdEncoding.DecodeString(pub.Keys[0].PublicKey)
+	if !bytes.Equal(raw, priv.Public().(ed25519.PublicKey)) {
+		t.Fatal("published key differs")
+	}
+	if rr := get("/api/v1/public-key?format=pem", false); !strings.HasPrefix(rr.Body.String(), "-----BEGIN PUBLIC KEY-----") {
+		t.Fatalf("pem: %q", rr.Body.String())
+	}
+}
+
+func TestApplyCacheControl(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		query   string
+		header  []string
+		want    archiveRequest
+		maxAge0 time.Duration // max_age= already parsed
+	}{
+		{name: "none", want: archiveRequest{}},
+		{name: "max-age", header: []string{"max-age=600"}, want: archiveRequest{maxAge: 10 * time.Minute}},
+		{name: "query wins", query: "max_age=60", maxAge0: time.Minute, header: []string{"max-age=600"}, want: archiveRequest{maxAge: time.Minute}},
+		{name: "no-cache revalidates", query: "max_age=60", maxAge0: time.Minute, header: []string{"No-Cache"}, want: archiveRequest{revalidate: true}},
+		{name: "list and lines", header: []string{`max-age="30", no-store`, "only-if-cached"}, want: archiveRequest{maxAge: 30 * time.Second, noStore: true, onlyIfCached: true}},
+		{name: "bad max-age ignored", header: []string{"max-age=soon, max-age=-1"}, want: archiveRequest{}},
+		{name: "huge max-age capped", header: []string{"max-age=99999999999999"}, want: archiveRequest{maxAge: maxCacheControlAge * time.Second}},
+		{name: "unknown ignored", header: []string{"no-transform, private"}, want: archiveRequest{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&"+tt.query, nil)
+			for _, h := range tt.header {
+				r.Header.Add("Cache-Control", h)
+			}
+			req := archiveRequest{maxAge: tt.maxAge0}
+			applyCacheControl(r, &req)
+			if !reflect.DeepEqual(req, tt.want) {
+				t.Fatalf("got %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_CacheControl(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	tests := []struct {
+		name      string
+		url       string
+		header    string
+		err       error
+		wantCode  int
+		wantCC    string
+		wantError string
+	}{
+		{name: "branch", url: "/api/v1/download?repo=own/repo&branch=main", wantCode: http.StatusOK},
+		{name: "exact sha", url: "/api/v2/repos/own/repo/archive/" + sha, wantCode: http.StatusOK, wantCC: immutableCacheControl},
+		{name: "exact sha upper case", url: "/api/v1/download?repo=own/repo&branch=" + strings.ToUpper(sha), wantCode: http.StatusOK, wantCC: immutableCacheControl},
+		{name: "no-store", url: "/api/v1/download?repo=own/repo&branch=" + sha, header: "no-store", wantCode: http.StatusOK, wantCC: "no-store"},
+		{name: "not cached", url: "/api/v2/repos/own/repo/archive/main", header: "only-if-cached", err: fmt.Errorf("own/repo@main: %w", storage.ErrNotCached), wantCode: http.StatusGatewayTimeout, wantError: CodeNotCached},
+		{name: "only-if-cached and no-cache", url: "/api/v1/download?repo=own/repo&branch=main", header: "only-if-cached, no-cache", wantCode: http.StatusGatewayTimeout, wantError: CodeNotCached},
+		{name: "only-if-cached and force", url: "/api/v2/repos/own/repo/archive/main?force=true", header: "only-if-cached", wantCode: http.StatusGatewayTimeout, wantError: CodeNotCached},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStore{ensurePath: zipPath, outcome: storage.CacheRevalidated, ensureErr: tt.err, ensureMeta: &storage.ArchiveMeta{CommitSHA: sha}}
+			s := NewServerWithStore(fs, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set("Cache-Control", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("status=%d, want %d (%s)", rr.Code, tt.wantCode, rr.Body.String())
+			}
+			if got := rr.Header().Get("Cache-Control"); got != tt.wantCC {
+				t.Fatalf("Cache-Control=%q, want %q", got, tt.wantCC)
+			}
+			if got := rr.Header().Get("X-GHH-Error-Code"); got != tt.wantError {
+				t.Fatalf("code=%q, want %q", got, tt.wantError)
+			}
+			if tt.wantError != "" && tt.err == nil && fs.ensureCalls != 0 {
+				t.Fatalf("store asked despite an unsatisfiable request")
+			}
+		})
+	}
+}
+
+func TestDownloadHandler_Fallback(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	missing := map[string]bool{"develop": true, "trunk": true}
+	tests := []struct {
+		name         string
+		url          string
+		refErr       error
+		wantCode     int
+		wantBranch   string
+		wantEnsured  []string
+		wantResolved []string
+	}{
+		{name: "requested exists", url: "/api/v1/download?repo=own/repo&branch=main&fallback=master", wantCode: http.StatusOK, wantBranch: "main", wantEnsured: []string{"main"}},
+		{name: "first fallback", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=main,master", wantCode: http.StatusOK, wantBranch: "main", wantEnsured: []string{"develop", "main"}, wantResolved: []string{"main"}},
+		{name: "skips missing", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=+trunk+,develop,,trunk,main", wantCode: http.StatusOK, wantBranch: "main", wantEnsured: []string{"develop", "main"}, wantResolved: []string{"trunk", "main"}},
+		{name: "none exists", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=trunk", wantCode: http.StatusNotFound, wantEnsured: []string{"develop"}, wantResolved: []string{"trunk"}},
+		{name: "no fallback", url: "/api/v1/download?repo=own/repo&branch=develop", wantCode: http.StatusNotFound, wantEnsured: []string{"develop"}},
+		{name: "lookup fails", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=main", refErr: storage.ErrRateLimited, wantCode: http.StatusInternalServerError, wantEnsured: []string{"develop"}, wantResolved: []string{"main"}},
+		{name: "bad fallback", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=main,a..b", wantCode: http.StatusBadRequest},
+		{name: "too many", url: "/api/v1/download?repo=own/repo&branch=develop&fallback=a,b,c,d,e,f,g,h,i,j,k", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStore{ensurePath: zipPath, outcome: storage.CacheRevalidated, missing: missing, refInfo: &storage.RefInfo{Type: storage.RefBranch}}
+			var store Store = fs
+			if tt.refErr != nil {
+				store = refErrStore{fs, tt.refErr}
+			}
+			s := NewServerWithStore(store, "", "default")
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rr.Code != tt.wantCode {
+				t.Fatalf("status=%d, want %d (%s)", rr.Code, tt.wantCode, rr.Body.String())
+			}
+			if got := rr.Header().Get("X-GHH-Branch"); got != tt.wantBranch {
+				t.Fatalf("X-GHH-Branch=%q, want %q", got, tt.wantBranch)
+			}
+			if !reflect.DeepEqual(fs.ensured, tt.wantEnsured) || !reflect.DeepEqual(fs.resolved, tt.wantResolved) {
+				t.Fatalf("ensured %q resolved %q, want %q and %q", fs.ensured, fs.resolved, tt.wantEnsured, tt.wantResolved)
+			}
+		})
+	}
+}
+
+// refErrStore fails every ResolveRef with err.
+type refErrStore struct {
+	*fakeStore
+	err error
+}
+
+func (s refErrStore) ResolveRef(ctx context.Context, user, ownerRepo, ref, token string) (*storage.RefInfo, error) {
+	s.resolved = append(s.resolved, ref)
+	return nil, s.err
+}
+
+func TestBranchSwitch_Fallback(t *testing.T) {
+	fs := &fakeStore{ensurePath: "/tmp/main.zip", outcome: storage.CacheMiss, missing: map[string]bool{"develop": true}, refInfo: &storage.RefInfo{Type: storage.RefBranch}, ensureMeta: &storage.ArchiveMeta{CommitSHA: "abc1234def"}}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	post := func(query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/branch/switch?"+query, strings.NewReader(body))
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("fallback=main,master", `{"repo":"own/repo","branch":"develop"}`)
+	var got branchSwitchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if got.Branch != "main" || got.Requested != "develop" || rr.Header().Get("X-GHH-Branch") != "main" {
+		t.Fatalf("result %+v, X-GHH-Branch=%q", got, rr.Header().Get("X-GHH-Branch"))
+	}
+
+	rr = post("fallback=master", `{"repo":"own/repo","branch":"main"}`)
+	got = branchSwitchResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got.Branch != "main" || got.Requested != "" {
+		t.Fatalf("requested branch: %+v err=%v", got, err)
+	}
+
+	if rr := post("fallback=main", `{"items":[{"repo":"own/repo","branch":"develop"}]}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("items with fallback: status=%d", rr.Code)
+	}
+}
@@ -1,13 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github-hub/internal/storage"
 )
 
 func TestDirListAndDeleteHandlers(t *testing.T) {
@@ -73,24 +80,178 @@ func TestDirListAndDeleteHandlers(t *testing.T) {
 	}
 }
 
-func TestStaticIndexServed(t *testing.T) {
+func TestDirListPaged(t *testing.T) {
 	root := t.TempDir()
-	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	for _, dir := range []string{"users/tester/c", "users/tester/a", "users/tester/b", "git-cache/o/r.git"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewServer(root, "tester", "", defaultDownloadTimeout)
 	if err != nil {
 		t.Fatal(err)
 	}
 	mux := http.NewServeMux()
 	s.RegisterRoutes(mux)
-	ts := httptest.NewServer(mux)
-	defer ts.Close()
+	list := func(query string) ([]string, string, int) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/dir/list?path=."+query, nil))
+		var entries []storage.Entry
+		_ = json.Unmarshal(rr.Body.Bytes(), &entries)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names, rr.Header().Get("X-GHH-Next-Page"), rr.Code
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		more  bool
+		code  int
+	}{
+		{"unpaged", "", []string{"a", "b", "c", "git-cache"}, false, http.StatusOK},
+		{"first page", "&limit=2", []string{"a", "b"}, true, http.StatusOK},
+		{"last page adds git-cache", "&limit=2&page_token=" + pageAfter(t, list, "&limit=2"), []string{"c", "git-cache"}, false, http.StatusOK},
+		{"bad limit", "&limit=-1", nil, false, http.StatusBadRequest},
+		{"bad token", "&page_token=!!", nil, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, next, code := list(tt.query)
+			if code != tt.code {
+				t.Fatalf("status = %d, want %d", code, tt.code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") || (next != "") != tt.more {
+				t.Fatalf("got %v next=%q, want %v more=%v", names, next, tt.want, tt.more)
+			}
+		})
+	}
+}
+
+// pageAfter returns the next-page token of the listing query.
+func pageAfter(t *testing.T, list func(string) ([]string, string, int), query string) string {
+	t.Helper()
+	_, next, code := list(query)
+	if code != http.StatusOK || next == "" {
+		t.Fatalf("list %s: status=%d next=%q", query, code, next)
+	}
+	return next
+}
 
-	resp, err := http.Get(ts.URL + "/")
+func TestTrashDeleteAndRestore(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "users", "tester", "alpha", "x.txt")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(root, "tester", "", defaultDownloadTimeout)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() { _ = resp.Body.Close() }()
-	if ct := resp.Header.Get("Content-Type"); ct == "" {
-		t.Fatalf("expected content type for index.html")
+	s.SetTrash(true, time.Hour)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	if rr := do(http.MethodDelete, "/api/v1/dir?path=alpha&recursive=true"); rr.Code != http.StatusOK {
+		t.Fatalf("delete status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("deleted item still in place: %v", err)
+	}
+	if rr := do(http.MethodGet, "/api/v1/dir/list?path=/"); strings.Contains(rr.Body.String(), "trash") {
+		t.Fatalf("trash listed at root: %s", rr.Body.String())
+	}
+	rr := do(http.MethodGet, "/api/v1/cache/trash")
+	var trash []storage.TrashEntry
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &trash) != nil || len(trash) != 1 || trash[0].Path != "users/tester/alpha" || !trash[0].IsDir {
+		t.Fatalf("trash status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPost, "/api/v1/cache/restore?id="+url.QueryEscape(trash[0].ID)); rr.Code != http.StatusOK {
+		t.Fatalf("restore status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "x" {
+		t.Fatalf("restored content %q err=%v", b, err)
+	}
+	if rr := do(http.MethodPost, "/api/v1/cache/restore?id="+url.QueryEscape(trash[0].ID)); rr.Code != http.StatusNotFound {
+		t.Fatalf("second restore status=%d", rr.Code)
+	}
+
+	s.SetAuth([]APIKey{{Key: "bob-key", User: "bob"}})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cache/trash", nil)
+	req.Header.Set("Authorization", "Bearer bob-key")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin trash status=%d", rr.Code)
+	}
+}
+
+func TestStaticIndexServed(t *testing.T) {
+	root := t.TempDir()
+	serve := func(webUI bool, keys ...APIKey) *httptest.Server {
+		s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetWebUI(webUI)
+		s.SetAuth(keys)
+		mux := http.NewServeMux()
+		s.RegisterRoutes(mux)
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	get := func(ts *httptest.Server, path, key string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if key != "" {
+			req.SetBasicAuth("anyone", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// Compiled in but off by default.
+	if resp := get(serve(false), "/", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("disabled ui: status %d, want 404", resp.StatusCode)
+	}
+	resp := get(serve(true), "/", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") == "" {
+		t.Fatalf("expected index.html, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Behind auth, the API key is the Basic password for the page and the API alike.
+	ts := serve(true, APIKey{Key: "k1", User: "alice"})
+	resp = get(ts, "/", "")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Fatalf("no key: status %d, challenge %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp := get(ts, "/", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad key: status %d", resp.StatusCode)
+	}
+	if resp := get(ts, "/", "k1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("good key: status %d", resp.StatusCode)
+	}
+	if resp := get(ts, "/api/v1/dir/list?path=.", "k1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("api with basic key: status %d", resp.StatusCode)
 	}
 }
 
@@ -204,3 +365,274 @@ func TestDownloadSparseHandler_Validation(t *testing.T) {
 		t.Fatalf("expected 400 for invalid path, got %d", resp.StatusCode)
 	}
 }
+
+func TestPackagesHandlers(t *testing.T) {
+	root := t.TempDir()
+	const pkgURL = "https://example.com/dist/tool-1.0.tgz"
+	dir := filepath.Join(root, "users", "tester", "packages", storage.PackageHash(pkgURL))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tool-1.0.tgz"), []byte("pkg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(root, "tester", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/api/v1/packages")
+	var list []storage.PackageMeta
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	_ = resp.Body.Close()
+	if len(list) != 1 || list[0].Filename != "tool-1.0.tgz" || list[0].Size != 3 {
+		t.Fatalf("list=%+v", list)
+	}
+
+	q := "?url=" + url.QueryEscape(pkgURL)
+	resp = do(http.MethodGet, "/api/v1/packages/lookup"+q)
+	var meta storage.PackageMeta
+	_ = json.NewDecoder(resp.Body).Decode(&meta)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || meta.URL != pkgURL {
+		t.Fatalf("lookup status=%d meta=%+v", resp.StatusCode, meta)
+	}
+
+	resp = do(http.MethodGet, "/api/v1/packages/lookup?url="+url.QueryEscape("https://example.com/other.tgz"))
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("lookup miss status=%d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodDelete, "/api/v1/packages"+q)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete status=%d", resp.StatusCode)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("hash dir still present: %v", err)
+	}
+	resp = do(http.MethodDelete, "/api/v1/packages"+q)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second delete status=%d", resp.StatusCode)
+	}
+}
+
+func TestPackageUpload(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{{Key: "ci-key", User: "ci"}})
+	s.SetUploadLimit(16)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	upload := func(query, key, ctype string, body io.Reader, headers map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/packages/upload"+query, body)
+		if key != "" {
+			req.Header.Set("X-GHH-Api-Key", key)
+		}
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	raw := map[string]string{"X-Filename": "tool.tgz"}
+
+	resp := upload("", "", "", strings.NewReader("v1"), raw)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous upload status=%d", resp.StatusCode)
+	}
+
+	resp = upload("?key=builds/42/", "ci-key", "", strings.NewReader("v1"), raw)
+	var meta storage.PackageMeta
+	_ = json.NewDecoder(resp.Body).Decode(&meta)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || meta.URL != "upload://builds/42/tool.tgz" || meta.Size != 2 || meta.SHA256 == "" {
+		t.Fatalf("upload status=%d meta=%+v", resp.StatusCode, meta)
+	}
+
+	resp = upload("?key=builds/42/", "ci-key", "", strings.NewReader("v2"), raw)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("re-upload without overwrite status=%d", resp.StatusCode)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("file", "tool.tgz")
+	_, _ = fw.Write([]byte("v2"))
+	_ = mw.Close()
+	resp = upload("?key=builds/42/&overwrite=true", "ci-key", mw.FormDataContentType(), &form, nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("multipart overwrite status=%d", resp.StatusCode)
+	}
+
+	resp = upload("", "ci-key", "", strings.NewReader(strings.Repeat("x", 17)), map[string]string{"X-Filename": "big.bin"})
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized upload status=%d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download/package?url="+url.QueryEscape(meta.URL), nil)
+	req.Header.Set("X-GHH-Api-Key", "ci-key")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(got) != "v2" {
+		t.Fatalf("download status=%d body=%q", resp.StatusCode, got)
+	}
+}
+
+func TestBulkDeleteHandler(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "users", "tester", "repos", "acme", "app")
+	if err := os.MkdirAll(repo, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"feature-a.zip", "feature-a.commit.txt", "main.zip"} {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewServer(root, "tester", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cases := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantMatch  int
+		wantGone   bool
+	}{
+		{"dry run by default", "pattern=repos/acme/app/feature-*.zip", http.StatusOK, 1, false},
+		{"escaping pattern", "pattern=users/../../etc/*", http.StatusBadRequest, 0, false},
+		{"bad confirm", "pattern=repos/*/*/feature-*&confirm=maybe", http.StatusBadRequest, 0, false},
+		{"confirmed", "pattern=users/tester/repos/*/*/feature-*.zip&confirm=true", http.StatusOK, 1, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/cache/bulk?"+tc.query, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.StatusCode != tc.wantStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("status=%d want %d: %s", resp.StatusCode, tc.wantStatus, body)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			var res storage.BulkDelete
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Matched) != tc.wantMatch || res.DryRun == tc.wantGone {
+				t.Fatalf("result = %+v", res)
+			}
+			for _, name := range []string{"feature-a.zip", "feature-a.commit.txt"} {
+				if _, err := os.Stat(filepath.Join(repo, name)); os.IsNotExist(err) != tc.wantGone {
+					t.Fatalf("%s removed=%t, want %t", name, os.IsNotExist(err), tc.wantGone)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(repo, "main.zip")); err != nil {
+				t.Fatalf("main.zip: %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptedPackageDownload(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	keys, err := storage.NewKeyRing(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetEncryption(keys)
+	s.SetAuth([]APIKey{{Key: "ci-key", User: "ci"}})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/packages/upload?key=tools/", strings.NewReader("secret package"))
+	req.Header.Set("X-Filename", "tool.bin")
+	req.Header.Set("X-GHH-Api-Key", "ci-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta storage.PackageMeta
+	_ = json.NewDecoder(resp.Body).Decode(&meta)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || meta.Encryption != storage.EncryptionAES256GCM {
+		t.Fatalf("upload status=%d meta=%+v", resp.StatusCode, meta)
+	}
+
+	for _, rng := range []string{"", "bytes=7-13"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/download/package?url="+url.QueryEscape(meta.URL), nil)
+		req.Header.Set("X-GHH-Api-Key", "ci-key")
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// Encrypted packages cannot seek, so Range is ignored.
+		want := "secret package"
+		if resp.StatusCode != http.StatusOK || string(got) != want || resp.ContentLength != int64(len(want)) || resp.Header.Get("Accept-Ranges") != "none" {
+			t.Fatalf("range %q: status=%d length=%d body=%q", rng, resp.StatusCode, resp.ContentLength, got)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// The serve* functions are the service layer shared by the v1 query-string
+// handlers and the v2 path-parameter handlers. Callers have already
+// authenticated the request and parsed its parameters; errors go through
+// fail/failErr so each API version keeps its own error format.
+
+// archiveRequest carries the parsed parameters of an archive download.
+type archiveRequest struct {
+	user         string
+	token        string
+	repo         string
+	branch       string
+	force        bool
+	legacy       bool
+	normalize    bool                // serve the deterministic repack
+	root         storage.RootMode    // empty keeps the archive's own folder
+	prefix       string              // top-level folder of the normalized repack
+	stale        storage.StalePolicy // empty keeps the storage default
+	strict       bool                // refuse archives not verified against the branch head
+	maxAge       time.Duration       // serve cached archives younger than this unchecked; 0 revalidates
+	revalidate   bool                // Cache-Control: no-cache, which only-if-cached cannot honour
+	noStore      bool                // leave the cache untouched (storage.WithNoStore)
+	onlyIfCached bool                // never go upstream (storage.WithOnlyIfCached)
+	prerelease   bool                // storage.LatestRelease may pick a prerelease
+	fallback     []string            // branches to try when branch does not exist upstream
+	format       archiveFormat       // empty is formatZip
+	contentType  string              // of a tarball: the media type negotiated
+	streamDelay  time.Duration
+}
+
+// stalePolicyParam parses the optional stale= query parameter.
+func stalePolicyParam(w http.ResponseWriter, r *http.Request) (storage.StalePolicy, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("stale"))
+	if v == "" {
+		return "", true
+	}
+	p, err := storage.ParseStalePolicy(v)
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return p, true
+}
+
+// refParam answers 400 to a branch or ref argument that is not a valid ref
+// name (see storage.ValidateRef), before it reaches the store.
+func refParam(w http.ResponseWriter, r *http.Request, ref string) bool {
+	if err := storage.ValidateRef(ref); err != nil {
+		fail(w, r, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// maxAgeParam parses the optional max_age= query parameter: seconds, as in
+// Cache-Control, or a duration such as 1h. Absent and 0 both revalidate.
+func maxAgeParam(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("max_age"))
+	if v == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.ParseInt(v, 10, 64); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || d < 0 {
+		fail(w, r, http.StatusBadRequest, fmt.Sprintf("max_age must be seconds or a duration, got %q", v))
+		return 0, false
+	}
+	return d, true
+}
+
+// pullParam reads pr=, a pull request number, into its storage ref
+// ("pr/123"). It cannot be combined with branch= or ref=.
+func pullParam(w http.ResponseWriter, r *http.Request, branch string) (string, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("pr"))
+	if v == "" {
+		return branch, true
+	}
+	if branch != "" {
+		fail(w, r, http.StatusBadRequest, "pr cannot be combined with branch or ref")
+		return "", false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		fail(w, r, http.StatusBadRequest, fmt.Sprintf("pr must be a pull request number, got %q", v))
+		return "", false
+	}
+	return storage.PullRef(n), true
+}
+
+// prereleaseParam reads prerelease=, which lets ref=latest-release pick a
+// prerelease.
+func prereleaseParam(r *http.Request) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get("prerelease"))
+	return b
+}
+
+// rootParam parses the optional root= query parameter.
+func rootParam(w http.ResponseWriter, r *http.Request) (storage.RootMode, bool) {
+	v := strings.TrimSpace(r.URL.Query().Get("root"))
+	if v == "" {
+		return "", true
+	}
+	m, err := storage.ParseRootMode(v)
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return m, true
+}
+
+// normalizeParam reads normalize=, falling back to the server default.
+func (s *Server) normalizeParam(r *http.Request) bool {
+	if b, err := strconv.ParseBool(r.URL.Query().Get("normalize")); err == nil {
+		return b
+	}
+	return s.normalizeArchives
+}
+
+// prefixStore is implemented by stores that can repack archives under a
+// chosen top-level folder (see storage.Storage.PrefixedArchive).
+type prefixStore interface {
+	PrefixedArchive(zipPath, prefix string) (*storage.RepoArchive, error)
+}
+
+// prefixParam parses the optional prefix= query parameter, which asks for
+// the normalized repack under that folder. It excludes root= and
+// normalize=false.
+func (s *Server) prefixParam(w http.ResponseWriter, r *http.Request, root storage.RootMode) (string, bool) {
+	q := r.URL.Query()
+	if !q.Has("prefix") {
+		return "", true
+	}
+	if root != "" {
+		fail(w, r, http.StatusBadRequest, "prefix= and root= cannot be combined")
+		return "", false
+	}
+	if b, err := strconv.ParseBool(q.Get("normalize")); err == nil && !b {
+		fail(w, r, http.StatusBadRequest, "prefix= applies to normalized archives and cannot be combined with normalize=false")
+		return "", false
+	}
+	prefix, err := storage.ParseArchivePrefix(q.Get("prefix"))
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if _, ok := s.store.(prefixStore); !ok {
+		fail(w, r, http.StatusNotImplemented, "archive prefixes are not supported by this store")
+		return "", false
+	}
+	return prefix, true
+}
+
+// serveArchive ensures the cached archive exists and streams it.
+func (s *Server) serveArchive(ctx context.Context, w http.ResponseWriter, r *http.Request, req archiveRequest) {
+	// Ensure cached copy exists (download if missing), and then stream a zip.
+	// If branch is empty, EnsureRepo will use "main" (git mode) or fetch default from GitHub (legacy mode).
+	// If force is true, bypass cache validation and always download fresh.
+	// If legacy is true, use old GitHub zipball API instead of git archive.
+	if !refParam(w, r, req.branch) || !s.allowRepo(w, r, req.repo) {
+		return
+	}
+	if req.stale != "" {
+		ctx = storage.WithStalePolicy(ctx, req.stale)
+	}
+	strict := req.strict || s.strictVerification
+	if strict {
+		ctx = storage.WithStrict(ctx)
+	}
+	if req.maxAge > 0 {
+		ctx = storage.WithMaxAge(ctx, req.maxAge)
+	}
+	if req.prerelease {
+		ctx = storage.WithPrereleases(ctx, true)
+	}
+	if req.onlyIfCached {
+		if req.force || req.revalidate {
+			// RFC 9111: a request the cache cannot satisfy without
+			// going upstream gets 504.
+			writeError(w, http.StatusGatewayTimeout, CodeNotCached, "only-if-cached cannot be combined with force or no-cache")
+			return
+		}
+		ctx = storage.WithOnlyIfCached(ctx)
+	}
+	if req.noStore {
+		ctx = storage.WithNoStore(ctx)
+	}
+	var outcome storage.CacheOutcome
+	served, res, err := s.ensureWithFallback(storage.WithOutcome(ctx, &outcome), req.user, req.repo, req.branch, req.token, req.force, req.legacy, req.fallback)
+	setCacheLabel(r, outcome)
+	if err == nil {
+		setCacheHeader(w, res.Outcome)
+		defer res.Discard()
+		if len(req.fallback) > 0 {
+			w.Header().Set("X-GHH-Branch", served)
+			req.branch = served
+		}
+	}
+	if err == nil && outcome == storage.CacheStale {
+		s.logf("serving unverified archive user=%s repo=%s branch=%s\n", req.user, req.repo, req.branch)
+		setStale(w, "unverified")
+	}
+	var gone *storage.BranchGoneError
+	if s.serveStaleOnGone && !strict && errors.As(err, &gone) && gone.ZipPath != "" {
+		// Availability over freshness: hand out the last archive we had.
+		s.logf("serving stale archive user=%s repo=%s branch=%s: branch deleted upstream\n", req.user, req.repo, req.branch)
+		setStale(w, "branch-deleted")
+		res, err = gone.Archive(), nil
+		setCacheHeader(w, res.Outcome)
+	}
+	pull, isPull := storage.PullNumber(req.branch)
+	if err != nil {
+		err = redactToken(err, req.token)
+		s.logf("download error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, req.branch, err)
+		failErr(w, r, "ensure repo", err)
+		return
+	}
+	zipPath := res.Path
+	if res.Transient {
+		zipPath = res.CachePath
+	}
+	// Extract actual branch name from zipPath (e.g., "main.zip" -> "main")
+	actualBranch := strings.TrimSuffix(filepath.Base(zipPath), ".zip")
+	if isPull {
+		actualBranch = fmt.Sprintf("pr-%d", pull)
+	}
+	if req.normalize {
+		// X-GHH-SHA256 and the body are then the normalized artifact.
+		var norm *storage.RepoArchive
+		var err error
+		if req.prefix != "" {
+			norm, err = s.store.(prefixStore).PrefixedArchive(res.Path, req.prefix)
+			w.Header().Set("X-GHH-Prefix", req.prefix)
+		} else {
+			norm, err = s.store.NormalizedArchive(res.Path, req.root)
+		}
+		if err != nil {
+			w.Header().Del("X-GHH-Prefix")
+			s.logf("normalize error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, actualBranch, err)
+			failErr(w, r, "normalize archive", err)
+			return
+		}
+		norm.FromCache, norm.Transient, norm.CachePath = res.FromCache, false, res.CachePath
+		res = norm
+		w.Header().Set("X-GHH-Normalized", "true")
+	}
+	if res.Tag != "" {
+		w.Header().Set("X-GHH-Tag", res.Tag)
+	}
+	setCommitHeaders(w, res.CommitSHA, res.ShortSHA)
+	if res.SHA256 != "" {
+		w.Header().Set("X-GHH-SHA256", res.SHA256)
+	}
+	switch {
+	case req.noStore:
+		w.Header().Set("Cache-Control", "no-store")
+	case res.CommitSHA != "" && strings.EqualFold(req.branch, res.CommitSHA):
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	}
+	if req.format == formatInfo {
+		s.serveArchiveInfo(ctx, w, r, req)
+		return
+	}
+	if req.format == formatTarball {
+		s.serveTarball(w, r, req, res, zipPath, outcome, actualBranch)
+		return
+	}
+	if !req.normalize && !res.Transient && (req.root == "" || req.root == storage.RootKeep) {
+		// The signature covers the cached archive, not a repack of it.
+		s.setSignature(w, res.Path)
+	}
+	s.setFreshness(w, res.FetchedAt)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", safeName(req.repo, actualBranch)))
+	if !req.normalize && req.root != "" && req.root != storage.RootKeep {
+		s.serveRerooted(w, r, req, res, zipPath, outcome, actualBranch)
+		return
+	}
+	f, err := s.store.OpenArchive(res.Path)
+	if err != nil {
+		s.logf("zip open error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, actualBranch, err)
+		failErr(w, r, "open zip", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	n, err := serveArchiveFile(w, r, f, res.Size, res.FetchedAt, req.streamDelay)
+	s.stats.record(req.user, req.repo, actualBranch, zipPath, outcome, n)
+	if err != nil {
+		s.logf("zip stream error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, actualBranch, err)
+		return
+	}
+	s.logf("download ok user=%s repo=%s branch=%s zip=%s\n", req.user, req.repo, actualBranch, zipPath)
+}
+
+// setFreshness dates a served archive by when it was fetched from GitHub
+// (from its metadata, not the file mtime that every serve resets):
+// X-GHH-Fetched-At, Age in seconds and Last-Modified. Archives without a
+// recorded fetch time get none of them.
+func (s *Server) setFreshness(w http.ResponseWriter, fetchedAt time.Time) {
+	if fetchedAt.IsZero() {
+		return
+	}
+	age := max(s.now().Sub(fetchedAt), 0)
+	w.Header().Set("X-GHH-Fetched-At", fetchedAt.UTC().Format(time.RFC3339))
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	w.Header().Set("Last-Modified", fetchedAt.UTC().Format(http.TimeFormat))
+}
+
+// setStale flags an archive served without confirming it is current:
+// X-GHH-Stale says why, Warning 110 says so to generic HTTP caches.
+func setStale(w http.ResponseWriter, reason string) {
+	w.Header().Set("X-GHH-Stale", reason)
+	w.Header().Set("Warning", `110 ghh "Response is Stale"`)
+}
+
+// now is the storage clock, so ages agree with the fetched-at stamps.
+func (s *Server) now() time.Time {
+	if st, ok := s.store.(*storage.Storage); ok {
+		return st.Now()
+	}
+	return time.Now()
+}
+
+// serveRerooted streams the archive with its entries renamed for req.root.
+// The body is built on the fly, so it has no length, no range support and
+// no X-GHH-SHA256 (which describes the cached archive).
+func (s *Server) serveRerooted(w http.ResponseWriter, r *http.Request, req archiveRequest, res *storage.RepoArchive, zipPath string, outcome storage.CacheOutcome, branch string) {
+	w.Header().Del("X-GHH-SHA256")
+	w.Header().Set("X-GHH-Root", string(req.root))
+	// Collisions are found before the first byte, so they can still fail
+	// with a proper status; any later error can only cut the body short.
+	wrote := false
+	n, err := s.store.RerootArchive(writeFunc(func(p []byte) (int, error) {
+		wrote = true
+		return w.Write(p)
+	}), res.Path, req.root)
+	s.stats.record(req.user, req.repo, branch, zipPath, outcome, n)
+	if err != nil {
+		s.logf("reroot error user=%s repo=%s branch=%s root=%s err=%v\n", req.user, req.repo, branch, req.root, err)
+		if !wrote {
+			w.Header().Del("Content-Disposition")
+			failErr(w, r, "reroot archive", err)
+		}
+		return
+	}
+	s.logf("download ok user=%s repo=%s branch=%s zip=%s root=%s\n", req.user, req.repo, branch, zipPath, req.root)
+}
+
+// serveTarball streams the archive converted to a gzipped tar, with its
+// entries renamed for req.root unless the normalized repack already was.
+// Like serveRerooted the body has no length and no X-GHH-SHA256.
+func (s *Server) serveTarball(w http.ResponseWriter, r *http.Request, req archiveRequest, res *storage.RepoArchive, zipPath string, outcome storage.CacheOutcome, branch string) {
+	root := req.root
+	if req.normalize {
+		root = storage.RootKeep
+	}
+	w.Header().Del("X-GHH-SHA256")
+	s.setFreshness(w, res.FetchedAt)
+	w.Header().Set("Content-Type", req.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar.gz\"", safeName(req.repo, branch)))
+	wrote := false
+	n, err := s.store.(tarballStore).TarballArchive(writeFunc(func(p []byte) (int, error) {
+		wrote = true
+		return w.Write(p)
+	}), res.Path, root)
+	s.stats.record(req.user, req.repo, branch, zipPath, outcome, n)
+	if err != nil {
+		s.logf("tarball error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, branch, err)
+		if !wrote {
+			w.Header().Del("Content-Disposition")
+			failErr(w, r, "tarball", err)
+		}
+		return
+	}
+	s.logf("download ok user=%s repo=%s branch=%s zip=%s format=tar.gz\n", req.user, req.repo, branch, zipPath)
+}
+
+// serveArchiveInfo answers a download negotiated as JSON with the repo-info
+// document of the branch just ensured, for clients that want to know what
+// a download gives without the bytes.
+func (s *Server) serveArchiveInfo(ctx context.Context, w http.ResponseWriter, r *http.Request, req archiveRequest) {
+	st, err := s.store.BranchStatus(ctx, req.user, req.repo, req.branch, req.token, false)
+	if err != nil {
+		err = redactToken(err, req.token)
+		s.logf("download info error user=%s repo=%s branch=%s err=%v\n", req.user, req.repo, req.branch, err)
+		jsonError(w, "repo info", err)
+		return
+	}
+	w.Header().Del("X-GHH-SHA256")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// writeFunc adapts a function to io.Writer.
+type writeFunc func([]byte) (int, error)
+
+func (f writeFunc) Write(p []byte) (int, error) { return f(p) }
+
+// serveRetained streams the user's archive of repo@branch at commit, the
+// current one or one kept by keep_previous_archives. Nothing is downloaded:
+// an archive that is not held is a 404 in both API versions.
+func (s *Server) serveRetained(w http.ResponseWriter, r *http.Request, user, repo, branch, commit string) {
+	if !refParam(w, r, branch) {
+		return
+	}
+	zipPath, meta, err := s.store.ArchiveAt(user, repo, branch, commit)
+	if err != nil {
+		s.logf("download error user=%s repo=%s branch=%s commit=%s err=%v\n", user, repo, branch, commit, err)
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "archive at commit: "+err.Error())
+			return
+		}
+		failErr(w, r, "archive at commit", err)
+		return
+	}
+	s.serveHeld(w, r, user, repo, zipPath, meta)
+}
+
+// serveHeld streams a held archive described by meta, as of its commit:
+// it is immutable and always a cache hit.
+func (s *Server) serveHeld(w http.ResponseWriter, r *http.Request, user, repo, zipPath string, meta *storage.ArchiveMeta) {
+	f, err := s.store.OpenArchive(zipPath)
+	if err != nil {
+		failErr(w, r, "open zip", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	short := s.shortSHA(meta.CommitSHA)
+	setCommitHeaders(w, meta.CommitSHA, short)
+	if meta.SHA256 != "" {
+		w.Header().Set("X-GHH-SHA256", meta.SHA256)
+	}
+	s.setFreshness(w, meta.FetchedAt)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", safeName(repo, strings.ReplaceAll(meta.Branch, "/", "-")+"-"+short)))
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	setCacheLabel(r, storage.CacheHit)
+	setCacheHeader(w, storage.CacheHit)
+	n, err := serveArchiveFile(w, r, f, meta.Size, meta.FetchedAt, 0)
+	s.stats.record(user, repo, meta.Branch, zipPath, storage.CacheHit, n)
+	if err != nil {
+		s.logf("zip stream error user=%s repo=%s commit=%s err=%v\n", user, repo, short, err)
+		return
+	}
+	s.logf("download ok user=%s repo=%s branch=%s commit=%s zip=%s\n", user, repo, meta.Branch, short, zipPath)
+}
+
+// serveRef resolves ref without downloading and writes it as JSON or as the
+// legacy short-SHA text line.
+func (s *Server) serveRef(ctx context.Context, w http.ResponseWriter, r *http.Request, user, token, repo, ref string, asJSON bool) {
+	if !refParam(w, r, ref) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	info, err := s.store.ResolveRef(ctx, user, repo, ref, token)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("resolve ref error user=%s repo=%s ref=%s err=%v\n", user, repo, ref, err)
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "resolve ref: "+err.Error())
+			return
+		}
+		failErr(w, r, "resolve ref", err)
+		return
+	}
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(info)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(info.Short + "\n"))
+}
+
+// serveSparse exports paths of repo@branch from the bare cache as a zip.
+func (s *Server) serveSparse(w http.ResponseWriter, r *http.Request, token, repo, branch string, paths []string) {
+	if !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+
+	// Ensure bare repo is up-to-date
+	if _, err := s.store.EnsureBareRepo(ctx, repo, token); err != nil {
+		err = redactToken(err, token)
+		s.logf("sparse download error repo=%s err=%v\n", repo, err)
+		failErr(w, r, "ensure bare repo", err)
+		return
+	}
+
+	// If branch not specified, use "main" as default (could also fetch default branch)
+	if branch == "" {
+		branch = "main"
+	}
+
+	// Create temp zip file
+	tmpFile, err := os.CreateTemp("", "sparse-*.zip")
+	if err != nil {
+		failErr(w, r, "create temp file", err)
+		return
+	}
+	tmpPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	// Export sparse zip
+	commit, err := s.store.ExportSparseZip(ctx, repo, branch, paths, tmpPath)
+	if err != nil {
+		s.logf("sparse export error repo=%s branch=%s paths=%v err=%v\n", repo, branch, paths, err)
+		failErr(w, r, "export sparse", err)
+		return
+	}
+
+	// Set headers
+	setCommitHeaders(w, commit, s.shortSHA(commit))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-sparse.zip\"", safeName(repo, branch)))
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		failErr(w, r, "open zip", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := serveFile(w, r, f, 0); err != nil {
+		s.logf("sparse stream error repo=%s branch=%s err=%v\n", repo, branch, err)
+		return
+	}
+	s.logf("sparse download ok repo=%s branch=%s paths=%v commit=%s\n", repo, branch, paths, commit)
+}
+
+// serveDefaultBranch writes the repo's default branch and cached branches.
+// It is a JSON endpoint in both API versions.
+func (s *Server) serveDefaultBranch(w http.ResponseWriter, r *http.Request, user, token, repo string) {
+	if err := s.repoPolicy.Load().Check(repo); err != nil {
+		jsonError(w, "repo policy", err)
+		return
+	}
+	info, err := s.store.DefaultBranch(r.Context(), user, repo, token)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("default branch error user=%s repo=%s err=%v\n", user, repo, err)
+		jsonError(w, "default branch", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+const (
+	// defaultSignedURLTTL is how long a signed download URL is valid when
+	// the request names no ttl; maxSignedURLTTL caps the ttl asked for.
+	defaultSignedURLTTL = time.Hour
+	maxSignedURLTTL     = 24 * time.Hour
+	// signedDownloadPath serves signed download URLs.
+	signedDownloadPath = "/api/v1/download/signed"
+)
+
+// urlSigning holds the keys signed download URLs are signed with: new URLs
+// use the current key, and URLs signed with a previous one are accepted
+// until previousUntil.
+type urlSigning struct {
+	keys          storage.KeyProvider
+	previousUntil time.Time
+}
+
+// signedDownload is what a signed download URL grants, carried in its
+// token next to the HMAC-SHA256 of the encoded claims.
+type signedDownload struct {
+	Repo    string `json:"repo"`
+	Branch  string `json:"branch"`
+	User    string `json:"user"`
+	Legacy  bool   `json:"legacy,omitempty"`
+	Expires int64  `json:"exp"` // Unix seconds
+	KeyID   string `json:"kid"`
+}
+
+// signedPrincipalKey carries the principal a signed URL authenticates, for
+// authenticate to pick up.
+type signedPrincipalKey struct{}
+
+// SetURLSigning enables signed download URLs (POST /api/v1/download/sign),
+// signed with the current key of keys. URLs signed with a previous key
+// keep working for grace from now, so a rotation does not break URLs
+// already handed out; nil keys disables them.
+func (s *Server) SetURLSigning(keys storage.KeyProvider, grace time.Duration) {
+	if keys == nil {
+		s.urlSigning = nil
+		return
+	}
+	s.urlSigning = &urlSigning{keys: keys, previousUntil: s.now().Add(grace)}
+}
+
+// sign returns the token for claims, signed with the current key.
+func (u *urlSigning) sign(claims signedDownload) (string, error) {
+	id, key, err := u.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	claims.KeyID = id
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key, payload)), nil
+}
+
+// verify checks token and returns its claims, or the error code to answer
+// with: CodeSignatureInvalid for tokens that were altered, are not ours or
+// use a previous key past its grace, CodeURLExpired for valid ones past
+// their expiry.
+func (u *urlSigning) verify(token string, now time.Time) (*signedDownload, string) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, CodeSignatureInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, CodeSignatureInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, CodeSignatureInvalid
+	}
+	var claims signedDownload
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, CodeSignatureInvalid
+	}
+	key, err := u.keys.Key(claims.KeyID)
+	if err != nil || !hmac.Equal(mac, tokenMAC(key, payload)) {
+		return nil, CodeSignatureInvalid
+	}
+	if current, _, err := u.keys.CurrentKey(); err != nil || (claims.KeyID != current && now.After(u.previousUntil)) {
+		return nil, CodeSignatureInvalid
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, CodeURLExpired
+	}
+	return &claims, ""
+}
+
+func tokenMAC(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+// ttlArg parses the ttl of a sign request: seconds or a duration string.
+// Empty means defaultSignedURLTTL.
+func ttlArg(raw json.RawMessage) (time.Duration, bool) {
+	v := strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	if v == "" || v == "null" {
+		return defaultSignedURLTTL, true
+	}
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.ParseInt(v, 10, 64); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	return d, err == nil && d > 0 && d <= maxSignedURLTTL
+}
+
+// handleDownloadSign returns a URL that downloads a branch archive as the
+// caller, without other credentials, until its ttl passes.
+func (s *Server) handleDownloadSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if s.urlSigning == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "signed URLs are not enabled")
+		return
+	}
+	var req struct {
+		Repo   string          `json:"repo"`
+		Branch string          `json:"branch"`
+		TTL    json.RawMessage `json:"ttl"`
+		Legacy bool            `json:"legacy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid json")
+		return
+	}
+	req.Repo, req.Branch = repoArg(req.Repo), strings.TrimSpace(req.Branch)
+	if req.Repo == "" || req.Branch == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "missing repo/branch")
+		return
+	}
+	ttl, ok := ttlArg(req.TTL)
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "ttl must be seconds or a duration up to "+maxSignedURLTTL.String())
+		return
+	}
+	if !refParam(w, r, req.Branch) || !s.allowRepo(w, r, req.Repo) {
+		return
+	}
+	expires := s.now().Add(ttl).Truncate(time.Second)
+	token, err := s.urlSigning.sign(signedDownload{Repo: req.Repo, Branch: req.Branch, User: user, Legacy: req.Legacy, Expires: expires.Unix()})
+	if err != nil {
+		s.logf("download sign error user=%s repo=%s branch=%s err=%v\n", user, req.Repo, req.Branch, err)
+		jsonError(w, "sign url", err)
+		return
+	}
+	u := s.externalURL(r, signedDownloadPath)
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+	s.logf("download sign ok user=%s repo=%s branch=%s expires=%s\n", user, req.Repo, req.Branch, expires.UTC().Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"url":        u.String(),
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// handleSignedDownload serves a signed download URL: it checks the token
+// and answers as GET /api/v1/download would for the user, repo and branch
+// it names. Tampered tokens answer 403 signature_invalid, expired ones 403
+// url_expired.
+func (s *Server) handleSignedDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.urlSigning == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "signed URLs are not enabled")
+		return
+	}
+	claims, code := s.urlSigning.verify(r.URL.Query().Get("token"), s.now())
+	if claims == nil {
+		msg := "invalid signature"
+		if code == CodeURLExpired {
+			msg = "signed URL expired"
+		}
+		s.logf("signed download refused path=%s code=%s\n", r.URL.Path, code)
+		writeError(w, http.StatusForbidden, code, msg)
+		return
+	}
+	q := url.Values{"repo": {claims.Repo}, "branch": {claims.Branch}, "user": {claims.User}}
+	if claims.Legacy {
+		q.Set("legacy", "true")
+	}
+	p := Principal{User: claims.User, Authenticated: true}
+	r2 := r.Clone(context.WithValue(r.Context(), signedPrincipalKey{}, p))
+	r2.URL.RawQuery = q.Encode()
+	for _, h := range []string{"X-GHH-User", "X-GHH-Api-Key", "X-GHH-Token", "Authorization"} {
+		r2.Header.Del(h)
+	}
+	s.handleDownload(w, r2)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func TestURLSigningVerify(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	oldRing, _ := storage.NewKeyRing(testKey(1))
+	rotated, _ := storage.NewKeyRing(testKey(2), testKey(1))
+	claims := signedDownload{Repo: "own/repo", Branch: "main", User: "alice", Expires: now.Add(time.Hour).Unix()}
+	sign := func(keys storage.KeyProvider, c signedDownload) string {
+		tok, err := (&urlSigning{keys: keys}).sign(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := sign(rotated, claims)
+	payload, mac, _ := strings.Cut(valid, ".")
+	forged := claims
+	forged.Repo = "own/secret"
+	forgedPayload, _, _ := strings.Cut(sign(rotated, forged), ".")
+	expired := claims
+	expired.Expires = now.Unix()
+
+	tests := []struct {
+		name     string
+		token    string
+		grace    time.Duration // previous keys accepted for grace after now
+		wantCode string
+	}{
+		{"valid", valid, 0, ""},
+		{"previous key within grace", sign(oldRing, claims), time.Minute, ""},
+		{"previous key after grace", sign(oldRing, claims), -time.Minute, CodeSignatureInvalid},
+		{"swapped claims", forgedPayload + "." + mac, 0, CodeSignatureInvalid},
+		{"altered signature", payload + "." + flipFirst(mac), 0, CodeSignatureInvalid},
+		{"unknown key", sign(mustKeyRing(t, testKey(3)), claims), time.Minute, CodeSignatureInvalid},
+		{"garbage", "not-a-token", 0, CodeSignatureInvalid},
+		{"expired", sign(rotated, expired), 0, CodeURLExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &urlSigning{keys: rotated, previousUntil: now.Add(tt.grace)}
+			got, code := u.verify(tt.token, now)
+			if code != tt.wantCode {
+				t.Fatalf("code = %q, want %q", code, tt.wantCode)
+			}
+			if code == "" && (got.Repo != "own/repo" || got.User != "alice") {
+				t.Fatalf("claims = %+v", got)
+			}
+		})
+	}
+}
+
+// flipFirst changes the first character of s.
+func flipFirst(s string) string {
+	if s[0] == 'A' {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
+
+func mustKeyRing(t *testing.T, key []byte) *storage.KeyRing {
+	t.Helper()
+	k, err := storage.NewKeyRing(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSignedDownload(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "repo.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, ensureMeta: &storage.ArchiveMeta{SHA256: "cafe", Size: 3, CommitSHA: "abc123"}}
+	s := NewServerWithStore(fs, "", "default")
+	s.SetAuth([]APIKey{{Key: "k-alice", User: "alice"}})
+	s.SetURLSigning(mustKeyRing(t, testKey(1)), time.Hour)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	sign := func(apiKey, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/download/sign", strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("X-GHH-Api-Key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := sign("", `{"repo":"own/repo","branch":"main"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated sign: status=%d", resp.StatusCode)
+	}
+	if resp := sign("k-alice", `{"repo":"own/repo","branch":"main","ttl":"48h"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("ttl over the cap: status=%d", resp.StatusCode)
+	}
+	resp := sign("k-alice", `{"repo":"own/repo","branch":"main","ttl":600}`)
+	var signed struct {
+		URL       string `json:"url"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("sign: status=%d err=%v", resp.StatusCode, err)
+	}
+	_ = resp.Body.Close()
+	if exp, err := time.Parse(time.RFC3339, signed.ExpiresAt); err != nil || time.Until(exp) > 10*time.Minute || time.Until(exp) < 9*time.Minute {
+		t.Fatalf("expires_at = %q", signed.ExpiresAt)
+	}
+
+	resp, err := http.Get(signed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) == 0 || resp.Header.Get("X-GHH-SHA256") != "cafe" {
+		t.Fatalf("signed GET: status=%d headers=%v", resp.StatusCode, resp.Header)
+	}
+	if fs.lastUser != "alice" || fs.lastRepo != "own/repo" || fs.lastBranch != "main" {
+		t.Fatalf("store called with user=%s repo=%s branch=%s", fs.lastUser, fs.lastRepo, fs.lastBranch)
+	}
+
+	u, _ := url.Parse(signed.URL)
+	tok := u.Query().Get("token")
+	u.RawQuery = url.Values{"token": {flipFirst(tok)}}.Encode()
+	resp, err = http.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-GHH-Error-Code") != CodeSignatureInvalid {
+		t.Fatalf("tampered GET: status=%d code=%q", resp.StatusCode, resp.Header.Get("X-GHH-Error-Code"))
+	}
+}
+
+func TestSignedURLExternalBase(t *testing.T) {
+	tests := []struct {
+		name    string
+		public  string
+		trusted []string
+		tls     bool
+		hdr     map[string]string
+		want    string
+	}{
+		{name: "request", want: "http://example.com"},
+		{name: "tls", tls: true, want: "https://example.com"},
+		{name: "untrusted proxy", hdr: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"}, want: "http://example.com"},
+		{name: "trusted proxy", trusted: []string{"192.0.2.0/24"}, hdr: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "hub.example"}, want: "https://hub.example"},
+		{name: "trusted proxy chain", trusted: []string{"192.0.2.1"}, hdr: map[string]string{"X-Forwarded-Proto": "HTTPS, http"}, want: "https://example.com"},
+		{name: "trusted proxy bad proto", trusted: []string{"192.0.2.1"}, hdr: map[string]string{"X-Forwarded-Proto": "gopher"}, want: "http://example.com"},
+		{name: "public url", public: "https://pub.example/ghh/", trusted: []string{"192.0.2.1"}, hdr: map[string]string{"X-Forwarded-Host": "hub.example"}, want: "https://pub.example/ghh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithStore(&fakeStore{}, "", "default")
+			s.SetURLSigning(mustKeyRing(t, testKey(1)), time.Hour)
+			if err := s.SetPublicURL(tt.public); err != nil {
+				t.Fatal(err)
+			}
+			proxies, err := ParseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetTrustedProxies(proxies)
+			mux := http.NewServeMux()
+			s.RegisterRoutes(mux)
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/v1/download/sign", strings.NewReader(`{"repo":"own/repo","branch":"main"}`))
+			req.RemoteAddr = "192.0.2.1:4321"
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.hdr {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			var signed struct {
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&signed); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("sign: status=%d err=%v", rec.Code, err)
+			}
+			if want := tt.want + signedDownloadPath + "?token="; !strings.HasPrefix(signed.URL, want) {
+				t.Fatalf("url = %q, want prefix %q", signed.URL, want)
+			}
+		})
+	}
+
+	s := NewServerWithStore(&fakeStore{}, "", "default")
+	for _, bad := range []string{"hub.example", "ftp://hub.example", "https://", "https://hub.example/?x=1"} {
+		if err := s.SetPublicURL(bad); err == nil {
+			t.Fatalf("public url %q accepted", bad)
+		}
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1", "proxy.example"}); err == nil {
+		t.Fatal("hostname accepted as trusted proxy")
+	}
+}
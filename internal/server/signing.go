@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github-hub/internal/storage"
+)
+
+// SetSigning signs newly cached archives with keys and publishes their
+// public keys on /api/v1/public-key; nil stops signing. Downloads of cached
+// archives then carry X-GHH-Signature. The built-in storage signs with
+// keys; other stores answer ArchiveSignature as they see fit.
+func (s *Server) SetSigning(keys *storage.SigningKeys) {
+	s.signing = keys
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.Signer = keys
+	}
+}
+
+// setSignature adds the signature of the cached archive at zipPath, which
+// covers its X-GHH-SHA256: X-GHH-Signature (base64 Ed25519) and
+// X-GHH-Signature-Key (the key ID). Without one the headers are left out.
+func (s *Server) setSignature(w http.ResponseWriter, zipPath string) {
+	if s.signing == nil {
+		return
+	}
+	sig, err := s.store.ArchiveSignature(zipPath)
+	if err != nil {
+		s.logf("archive signature error zip=%s err=%v\n", zipPath, err)
+		return
+	}
+	w.Header().Set("X-GHH-Signature", sig.Signature)
+	w.Header().Set("X-GHH-Signature-Key", sig.KeyID)
+}
+
+// handleDownloadSignature returns the detached signature of the caller's
+// cached archive of a branch, downloading it first if needed.
+func (s *Server) handleDownloadSignature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if s.signing == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "archive signing is not enabled")
+		return
+	}
+	token := s.githubToken(r)
+	repo := repoArg(r.URL.Query().Get("repo"))
+	branch := strings.TrimSpace(r.URL.Query().Get("branch"))
+	legacy, _ := strconv.ParseBool(r.URL.Query().Get("legacy"))
+	if repo == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	if !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+
+	res, err := s.store.EnsureRepoResult(ctx, user, repo, branch, token, false, legacy)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("download signature error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "ensure repo", err)
+		return
+	}
+	sig, err := s.store.ArchiveSignature(res.Path)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			fail(w, r, http.StatusNotFound, "404 page not found")
+			return
+		}
+		s.logf("archive signature error user=%s repo=%s branch=%s err=%v\n", user, repo, branch, err)
+		failErr(w, r, "sign archive", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(sig)
+}
+
+// handlePublicKey publishes the keys archive signatures verify with, the
+// current one first and then those rotated out. format=pem answers the
+// current key alone as PEM. Public keys are not secret, so it needs no API
+// key.
+func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.signing == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "archive signing is not enabled")
+		return
+	}
+	keys := s.signing.PublicKeys()
+	if strings.EqualFold(strings.TrimSpace(r.URL.Query().Get("format")), "pem") {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write([]byte(keys[0].PEM))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// statsFile is where download statistics are persisted, under the cache root.
+const statsFile = "stats.json"
+
+const defaultStatsFlushInterval = time.Minute
+
+// RepoStat is the traffic recorded for one user/repo/branch archive.
+type RepoStat struct {
+	User        string    `json:"user"`
+	Repo        string    `json:"repo"`
+	Branch      string    `json:"branch"`
+	Downloads   int64     `json:"downloads"`
+	CacheHits   int64     `json:"cache_hits"`
+	CacheMisses int64     `json:"cache_misses"`
+	BytesServed int64     `json:"bytes_served"`
+	LastServed  time.Time `json:"last_served"`
+}
+
+// repoCounter holds the live counters; recording only touches atomics.
+type repoCounter struct {
+	user, repo, branch string
+	downloads          atomic.Int64
+	hits               atomic.Int64
+	misses             atomic.Int64
+	bytes              atomic.Int64
+	lastServed         atomic.Int64 // unix nanoseconds
+	zipPath            atomic.Value // string; used to prune entries whose archive is gone
+}
+
+func (c *repoCounter) snapshot() RepoStat {
+	st := RepoStat{
+		User:        c.user,
+		Repo:        c.repo,
+		Branch:      c.branch,
+		Downloads:   c.downloads.Load(),
+		CacheHits:   c.hits.Load(),
+		CacheMisses: c.misses.Load(),
+		BytesServed: c.bytes.Load(),
+	}
+	if ns := c.lastServed.Load(); ns > 0 {
+		st.LastServed = time.Unix(0, ns).UTC()
+	}
+	return st
+}
+
+// persistedStat is the on-disk form, which also remembers the archive path.
+type persistedStat struct {
+	RepoStat
+	Path string `json:"path,omitempty"`
+}
+
+// repoStats tracks per-archive download statistics. Counters are updated
+// with atomics on the request path and written to disk by a background
+// flusher; path is empty for in-memory-only stats (injected stores).
+type repoStats struct {
+	path    string
+	mu      sync.RWMutex
+	entries map[string]*repoCounter
+	dirty   atomic.Bool
+}
+
+func newRepoStats(path string, logf func(string, ...any)) *repoStats {
+	st := &repoStats{path: path, entries: make(map[string]*repoCounter)}
+	if path == "" {
+		return st
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logf("stats: read %s: %v\n", path, err)
+		}
+		return st
+	}
+	var saved []persistedStat
+	if err := json.Unmarshal(b, &saved); err != nil {
+		logf("stats: ignoring corrupt %s: %v\n", path, err)
+		return st
+	}
+	for _, p := range saved {
+		c := st.counter(p.User, p.Repo, p.Branch)
+		c.downloads.Store(p.Downloads)
+		c.hits.Store(p.CacheHits)
+		c.misses.Store(p.CacheMisses)
+		c.bytes.Store(p.BytesServed)
+		if !p.LastServed.IsZero() {
+			c.lastServed.Store(p.LastServed.UnixNano())
+		}
+		c.zipPath.Store(p.Path)
+	}
+	return st
+}
+
+func statsKey(user, repo, branch string) string {
+	return user + "|" + strings.ToLower(repo) + "|" + branch
+}
+
+func (st *repoStats) counter(user, repo, branch string) *repoCounter {
+	key := statsKey(user, repo, branch)
+	st.mu.RLock()
+	c, ok := st.entries[key]
+	st.mu.RUnlock()
+	if ok {
+		return c
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if c, ok = st.entries[key]; !ok {
+		c = &repoCounter{user: user, repo: repo, branch: branch}
+		c.zipPath.Store("")
+		st.entries[key] = c
+	}
+	return c
+}
+
+// record counts one served archive.
+func (st *repoStats) record(user, repo, branch, zipPath string, outcome storage.CacheOutcome, n int64) {
+	c := st.counter(user, repo, branch)
+	c.downloads.Add(1)
+	switch outcome {
+	case storage.CacheHit, storage.CacheRevalidated:
+		c.hits.Add(1)
+	case storage.CacheMiss:
+		c.misses.Add(1)
+	}
+	c.bytes.Add(n)
+	c.lastServed.Store(time.Now().UnixNano())
+	c.zipPath.Store(zipPath)
+	st.dirty.Store(true)
+}
+
+// top returns stats sorted by downloads, then bytes served; user filters to
+// one user when non-empty and limit <= 0 returns everything.
+func (st *repoStats) top(user string, limit int) []RepoStat {
+	st.mu.RLock()
+	out := make([]RepoStat, 0, len(st.entries))
+	for _, c := range st.entries {
+		if user == "" || c.user == user {
+			out = append(out, c.snapshot())
+		}
+	}
+	st.mu.RUnlock()
+	return rankRepoStats(out, limit)
+}
+
+// rankRepoStats sorts stats by downloads, then bytes served, and keeps the
+// first limit (all when limit <= 0).
+func rankRepoStats(out []RepoStat, limit int) []RepoStat {
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Downloads != out[j].Downloads {
+			return out[i].Downloads > out[j].Downloads
+		}
+		if out[i].BytesServed != out[j].BytesServed {
+			return out[i].BytesServed > out[j].BytesServed
+		}
+		return statsKey(out[i].User, out[i].Repo, out[i].Branch) < statsKey(out[j].User, out[j].Repo, out[j].Branch)
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// mergeRepoStats adds theirs, another instance's stats, to ours. Users are
+// sharded, so entries rarely overlap; those that do are summed.
+func mergeRepoStats(ours, theirs []RepoStat) []RepoStat {
+	index := make(map[string]int, len(ours))
+	for i, st := range ours {
+		index[statsKey(st.User, st.Repo, st.Branch)] = i
+	}
+	for _, st := range theirs {
+		i, ok := index[statsKey(st.User, st.Repo, st.Branch)]
+		if !ok {
+			index[statsKey(st.User, st.Repo, st.Branch)] = len(ours)
+			ours = append(ours, st)
+			continue
+		}
+		o := &ours[i]
+		o.Downloads += st.Downloads
+		o.CacheHits += st.CacheHits
+		o.CacheMisses += st.CacheMisses
+		o.BytesServed += st.BytesServed
+		if st.LastServed.After(o.LastServed) {
+			o.LastServed = st.LastServed
+		}
+	}
+	return ours
+}
+
+// prune drops entries whose archive no longer exists on disk.
+func (st *repoStats) prune() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for key, c := range st.entries {
+		p, _ := c.zipPath.Load().(string)
+		if p == "" {
+			continue
+		}
+		if !storage.ArchiveExists(p) {
+			delete(st.entries, key)
+			st.dirty.Store(true)
+		}
+	}
+}
+
+// flush writes the stats file if anything changed since the last flush.
+func (st *repoStats) flush() error {
+	if st.path == "" || !st.dirty.Swap(false) {
+		return nil
+	}
+	st.mu.RLock()
+	saved := make([]persistedStat, 0, len(st.entries))
+	for _, c := range st.entries {
+		p, _ := c.zipPath.Load().(string)
+		saved = append(saved, persistedStat{RepoStat: c.snapshot(), Path: p})
+	}
+	st.mu.RUnlock()
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		st.dirty.Store(true)
+		return err
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		st.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// flushStats persists stats and byte budgets periodically until the
+// janitor context ends, then writes a final snapshot.
+func (s *Server) flushStats() {
+	defer close(s.statsFlushed)
+	ticker := time.NewTicker(s.statsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.janitorCtx.Done():
+			s.flushStatsOnce()
+			return
+		case <-ticker.C:
+			s.flushStatsOnce()
+		}
+	}
+}
+
+func (s *Server) flushStatsOnce() {
+	if err := s.stats.flush(); err != nil {
+		s.logf("stats flush error: %v\n", err)
+	}
+	if err := s.budgets.flush(); err != nil {
+		s.logf("budgets flush error: %v\n", err)
+	}
+}
+
+// handleRepoStats lists per-archive traffic, busiest first. Admins see every
+// user (or the one named by user=); other callers see their own archives.
+// cluster=true adds the archives of the other instances of the cluster.
+func (s *Server) handleRepoStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	peer, ok := s.statsPeer(w, r)
+	if !ok {
+		return
+	}
+	filter := strings.TrimSpace(r.URL.Query().Get("user"))
+	if !peer {
+		p, user, ok := s.scope(w, r)
+		if !ok {
+			return
+		}
+		filter = user
+		if p.Admin && strings.TrimSpace(r.URL.Query().Get("user")) == "" && strings.TrimSpace(r.Header.Get("X-GHH-User")) == "" {
+			filter = ""
+		}
+	}
+	all, ok := s.clusterStats(w, r)
+	if !ok {
+		return
+	}
+	limit := 0
+	if v := strings.TrimSpace(r.URL.Query().Get("top")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fail(w, r, http.StatusBadRequest, "invalid top")
+			return
+		}
+		limit = n
+	}
+	out := s.stats.top(filter, limit)
+	if all && !peer {
+		out = s.stats.top(filter, 0)
+		q := url.Values{}
+		if filter != "" {
+			q.Set("user", filter)
+		}
+		s.fanOut(r.Context(), w, r.URL.Path, q, func(b []byte) error {
+			var theirs []RepoStat
+			if err := json.Unmarshal(b, &theirs); err != nil {
+				return err
+			}
+			out = mergeRepoStats(out, theirs)
+			return nil
+		})
+		out = rankRepoStats(out, limit)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+	"github-hub/internal/testutil"
+)
+
+func TestRepoStatsEndpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "main.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, outcome: storage.CacheHit}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, repo := range []string{"a/hot", "a/hot", "a/cold"} {
+		resp := get("/api/v1/download?repo=" + repo)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("download %s: status=%d", repo, resp.StatusCode)
+		}
+	}
+
+	resp := get("/api/v1/stats/repos?top=1")
+	defer func() { _ = resp.Body.Close() }()
+	var stats []RepoStat
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("top=1 returned %d entries", len(stats))
+	}
+	fi, _ := os.Stat(zipPath)
+	got := stats[0]
+	if got.Repo != "a/hot" || got.Branch != "main" || got.Downloads != 2 || got.CacheHits != 2 ||
+		got.BytesServed != 2*fi.Size() || got.LastServed.IsZero() {
+		t.Fatalf("unexpected stats %+v", got)
+	}
+
+	bad := get("/api/v1/stats/repos?top=x")
+	_ = bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Fatalf("top=x status=%d", bad.StatusCode)
+	}
+}
+
+func TestRepoStatsPersistAndPrune(t *testing.T) {
+	root := t.TempDir()
+	zipPath := filepath.Join(root, "main.zip")
+	createZip(t, zipPath)
+	path := filepath.Join(root, statsFile)
+
+	st := newRepoStats(path, t.Logf)
+	st.record("u", "o/r", "main", zipPath, storage.CacheMiss, 10)
+	st.record("u", "o/r", "gone", filepath.Join(root, "gone.zip"), storage.CacheHit, 5)
+	if err := st.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newRepoStats(path, t.Logf)
+	if all := loaded.top("", 0); len(all) != 2 || all[0].Branch != "main" || all[0].CacheMisses != 1 {
+		t.Fatalf("reloaded stats %+v", all)
+	}
+	loaded.prune()
+	if all := loaded.top("", 0); len(all) != 1 || all[0].Branch != "main" {
+		t.Fatalf("prune kept %+v", all)
+	}
+}
+
+func TestUsageWindowBoundaries(t *testing.T) {
+	start := time.Date(2026, 3, 1, 10, 0, 59, 0, time.UTC)
+	clock := testutil.NewFakeClock(start)
+	u := newUsage(clock.Now)
+	u.served(storage.CacheHit, 100)
+	u.served(storage.CacheMiss, 40)
+	u.downloaded(40)
+	u.evicted("expired", 2)
+
+	// Counted in the 10:00 minute: in the last hour until 11:00 and in
+	// the last day until 10:00 the next day.
+	cases := []struct {
+		at           string
+		hour, day    int64 // requests in each window
+		hourRatioPct int
+	}{
+		{"2026-03-01T10:00:59Z", 2, 2, 50},
+		{"2026-03-01T10:59:59Z", 2, 2, 50},
+		{"2026-03-01T11:00:00Z", 0, 2, 0},
+		{"2026-03-02T09:59:59Z", 0, 2, 0},
+		{"2026-03-02T10:00:00Z", 0, 0, 0},
+	}
+	for _, tc := range cases {
+		at, err := time.Parse(time.RFC3339, tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Set(at)
+		sum := u.summary()
+		if sum.LastHour.Requests != tc.hour || sum.LastDay.Requests != tc.day {
+			t.Fatalf("at %s: hour=%d day=%d, want %d %d", tc.at, sum.LastHour.Requests, sum.LastDay.Requests, tc.hour, tc.day)
+		}
+		if got := int(sum.LastHour.HitRatio * 100); got != tc.hourRatioPct {
+			t.Fatalf("at %s: hour hit ratio %d%%, want %d%%", tc.at, got, tc.hourRatioPct)
+		}
+		if tc.day > 0 && (sum.LastDay.BytesFromCache != 100 || sum.LastDay.BytesServed != 140 || sum.LastDay.BytesDownloaded != 40 || sum.LastDay.Evictions["expired"] != 2) {
+			t.Fatalf("at %s: day window %+v", tc.at, sum.LastDay.usageCounts)
+		}
+	}
+
+	// A slot is reused a day later without carrying its old counts.
+	u.served(storage.CacheRevalidated, 10)
+	if sum := u.summary(); sum.LastDay.Requests != 1 || sum.LastDay.Revalidations != 1 || sum.LastDay.Hits != 0 {
+		t.Fatalf("reused slot: %+v", sum.LastDay.usageCounts)
+	}
+}
+
+func TestStatsSummaryEndpoint(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "main.zip")
+	createZip(t, zipPath)
+	fs := &fakeStore{ensurePath: zipPath, outcome: storage.CacheHit}
+	s := NewServerWithStore(fs, "", "default")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	var served int64
+	for _, outcome := range []storage.CacheOutcome{storage.CacheHit, storage.CacheHit, storage.CacheMiss} {
+		fs.outcome = outcome
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/download?repo=own/repo&branch=main", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("download: status=%d", rr.Code)
+		}
+		served += int64(rr.Body.Len())
+	}
+	// Routes that never consult the cache are not counted.
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/version", nil))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/stats/summary", nil))
+	var sum usageSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &sum); err != nil {
+		t.Fatalf("status=%d body=%s: %v", rr.Code, rr.Body.String(), err)
+	}
+	h := sum.LastHour
+	if h.Requests != 3 || h.Hits != 2 || h.Misses != 1 || h.BytesServed != served || h.BytesFromCache != served*2/3 {
+		t.Fatalf("last hour: %+v (served %d)", h.usageCounts, served)
+	}
+	if h.HitRatio < 0.66 || h.HitRatio > 0.67 {
+		t.Fatalf("hit ratio %f", h.HitRatio)
+	}
+}
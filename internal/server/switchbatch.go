@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github-hub/internal/storage"
+)
+
+const (
+	// maxBranchSwitchItems caps the items of one branch/switch request.
+	maxBranchSwitchItems = 100
+	// branchSwitchConcurrency is how many items of one request are ensured
+	// at once.
+	branchSwitchConcurrency = 4
+)
+
+// branchSwitchItem is one entry of a branch/switch items array. Force and
+// Legacy of the request apply to every item as well.
+type branchSwitchItem struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	Force  bool   `json:"force"`
+	Legacy bool   `json:"legacy"`
+}
+
+// itemError is the error of one batch item, as in the error envelope.
+type itemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// branchSwitchItemResult is the outcome of one item, in request order.
+type branchSwitchItemResult struct {
+	Repo   string     `json:"repo"`
+	Branch string     `json:"branch"`
+	Status int        `json:"status"`
+	Commit string     `json:"commit,omitempty"`
+	Cache  string     `json:"cache,omitempty"`
+	Error  *itemError `json:"error,omitempty"`
+}
+
+// branchSwitchBatchResult is the JSON answer of an items request. OK is
+// set when every item was switched.
+type branchSwitchBatchResult struct {
+	Atomic bool                     `json:"atomic"`
+	OK     bool                     `json:"ok"`
+	Items  []branchSwitchItemResult `json:"items"`
+}
+
+func (res *branchSwitchItemResult) fail(status int, code, msg string) {
+	res.Status = status
+	res.Error = &itemError{Code: code, Message: msg}
+}
+
+// handleBranchSwitchItems ensures several branches in one request, at most
+// branchSwitchConcurrency at once, and reports each one. Without atomic the
+// answer is 207 whatever the items did. With atomic it is 200 only when all
+// of them were switched and 409 otherwise: once an item fails no further
+// ones are started (they are reported as skipped), and items that were
+// already switched are reported but must not be consumed.
+func (s *Server) handleBranchSwitchItems(w http.ResponseWriter, r *http.Request, user, token string, items []branchSwitchItem, atomic, force, legacy bool) {
+	if len(items) > maxBranchSwitchItems {
+		fail(w, r, http.StatusBadRequest, "too many items")
+		return
+	}
+	results := make([]branchSwitchItemResult, len(items))
+	policy := s.repoPolicy.Load()
+	invalid := false
+	for i := range items {
+		it := &items[i]
+		it.Repo, it.Branch = repoArg(it.Repo), strings.TrimSpace(it.Branch)
+		it.Force, it.Legacy = it.Force || force, it.Legacy || legacy
+		res := &results[i]
+		res.Repo, res.Branch = it.Repo, it.Branch
+		if it.Repo == "" || it.Branch == "" {
+			res.fail(http.StatusBadRequest, CodeBadRequest, "missing repo/branch")
+		} else if err := storage.ValidateRef(it.Branch); err != nil {
+			res.fail(http.StatusBadRequest, CodeBadRequest, err.Error())
+		} else if err := policy.Check(it.Repo); err != nil {
+			s.logf("repo policy denied path=%s repo=%s\n", r.URL.Path, it.Repo)
+			status, code := classify(err)
+			res.fail(status, code, "repo policy: "+err.Error())
+		}
+		invalid = invalid || res.Error != nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = atomic && invalid
+	)
+	sem := make(chan struct{}, branchSwitchConcurrency)
+	for i := range items {
+		if results[i].Error != nil {
+			continue
+		}
+		sem <- struct{}{}
+		mu.Lock()
+		stop := atomic && failed
+		mu.Unlock()
+		if stop {
+			<-sem
+			results[i].fail(http.StatusFailedDependency, CodeSkipped, "not attempted: another item failed")
+			continue
+		}
+		wg.Add(1)
+		go func(it branchSwitchItem, res *branchSwitchItemResult) {
+			defer func() { <-sem; wg.Done() }()
+			if !s.switchItem(r, user, token, it, res) {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(items[i], &results[i])
+	}
+	wg.Wait()
+
+	out := branchSwitchBatchResult{Atomic: atomic, OK: true, Items: results}
+	for _, res := range results {
+		if res.Error != nil {
+			out.OK = false
+		}
+	}
+	status := http.StatusMultiStatus
+	if atomic {
+		status = http.StatusOK
+		if !out.OK {
+			status = http.StatusConflict
+		}
+	}
+	s.logf("branch switch batch user=%s items=%d atomic=%t ok=%t\n", user, len(items), atomic, out.OK)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// switchItem ensures one batch item into res and reports whether it
+// succeeded.
+func (s *Server) switchItem(r *http.Request, user, token string, it branchSwitchItem, res *branchSwitchItemResult) bool {
+	ctx, cancel := s.populateContext(r.Context())
+	defer cancel()
+	got, err := s.store.EnsureRepoResult(ctx, user, it.Repo, it.Branch, token, it.Force, it.Legacy)
+	if err != nil {
+		err = redactToken(err, token)
+		s.logf("branch switch error user=%s repo=%s branch=%s err=%v\n", user, it.Repo, it.Branch, err)
+		status, code := classify(err)
+		res.fail(status, code, "ensure branch: "+err.Error())
+		return false
+	}
+	res.Status = http.StatusOK
+	res.Commit = got.ShortSHA
+	res.Cache = cacheHeader(got.Outcome)
+	s.logf("branch switch ok user=%s repo=%s branch=%s\n", user, it.Repo, it.Branch)
+	return true
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// defaultTierRebalanceInterval is how often archives move between cache
+// tiers unless SetTiers is given an interval.
+const defaultTierRebalanceInterval = time.Minute
+
+// tierSource is implemented by stores that report per-tier usage for GET
+// /api/v1/stats/summary.
+type tierSource interface {
+	TierUsage() []storage.TierUsage
+}
+
+// SetTiers adds slower cache roots behind the built-in storage's root (see
+// storage.Storage.Tiers) and rebalances them every interval (0: one
+// minute) until Shutdown. Without tiers it does nothing.
+func (s *Server) SetTiers(hotCapacity int64, tiers []storage.Tier, interval time.Duration) error {
+	if len(tiers) == 0 {
+		return nil
+	}
+	st, ok := s.store.(*storage.Storage)
+	if !ok {
+		return errors.New("cache tiers are not supported by this store")
+	}
+	if interval <= 0 {
+		interval = defaultTierRebalanceInterval
+	}
+	st.HotCapacity, st.Tiers = hotCapacity, tiers
+	go s.rebalanceTiers(st, interval)
+	return nil
+}
+
+func (s *Server) rebalanceTiers(st *storage.Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.janitorCtx.Done():
+			return
+		case <-ticker.C:
+			report, err := st.Rebalance()
+			if err != nil {
+				s.logf("tier rebalance: %v\n", err)
+			}
+			if n := len(report.Demoted) + len(report.Promoted) + len(report.Orphans); n > 0 {
+				s.logf("tier rebalance: demoted=%d promoted=%d orphans=%d\n", len(report.Demoted), len(report.Promoted), len(report.Orphans))
+			}
+		}
+	}
+}
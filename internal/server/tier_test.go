@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestConfigTiers(t *testing.T) {
+	abs, err := filepath.Abs("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		cfg      Config
+		want     []storage.Tier
+		interval time.Duration
+		wantErr  bool
+	}{
+		{name: "none", cfg: Config{}},
+		{name: "tiers", cfg: Config{CacheTiers: []string{"/ssd=100", "cold"}, TierRebalanceInterval: "5m"},
+			want: []storage.Tier{{Root: "/ssd", Capacity: 100}, {Root: abs}}, interval: 5 * time.Minute},
+		{name: "bad capacity", cfg: Config{CacheTiers: []string{"/ssd=lots"}}, wantErr: true},
+		{name: "no path", cfg: Config{CacheTiers: []string{"=100"}}, wantErr: true},
+		{name: "bad interval", cfg: Config{TierRebalanceInterval: "0s"}, wantErr: true},
+		{name: "negative hot capacity", cfg: Config{HotTierCapacityBytes: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		_, tiers, interval, err := tt.cfg.Tiers()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: err = %v", tt.name, err)
+		}
+		if err == nil && (len(tiers) != len(tt.want) || interval != tt.interval) {
+			t.Fatalf("%s: tiers = %+v interval = %s", tt.name, tiers, interval)
+		}
+		for i := range tt.want {
+			if tiers[i] != tt.want[i] {
+				t.Fatalf("%s: tier %d = %+v, want %+v", tt.name, i, tiers[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestStatsSummary_Tiers(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.SetAuth([]APIKey{
+		{Key: "alice-key", User: "alice"},
+		{Key: "root-key", User: "root", Admin: true},
+	})
+	if err := s.SetTiers(1<<20, []storage.Tier{{Root: t.TempDir()}}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	for _, tt := range []struct {
+		key   string
+		tiers int
+	}{{"alice-key", 0}, {"root-key", 2}} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stats/summary", nil)
+		req.Header.Set("X-GHH-Api-Key", tt.key)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var sum usageSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &sum); err != nil {
+			t.Fatalf("status=%d body=%s: %v", rec.Code, rec.Body.String(), err)
+		}
+		if len(sum.Tiers) != tt.tiers {
+			t.Fatalf("%s: tiers = %+v", tt.key, sum.Tiers)
+		}
+		if tt.tiers > 0 && sum.Tiers[0].Capacity != 1<<20 {
+			t.Fatalf("hot tier = %+v", sum.Tiers[0])
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// servedAtStore is implemented by stores that record when each held
+// archive was served (see storage.Storage.ArchiveServedAt).
+type servedAtStore interface {
+	ArchiveServedAt(user, ownerRepo, branch string, t time.Time) (string, *storage.ArchiveMeta, *storage.ServingWindow, error)
+}
+
+// notServedBody is the 404 of /api/v1/download/at: the error envelope with
+// the nearest windows that can still be served.
+type notServedBody struct {
+	errorBody
+	Before *storage.ServingWindow `json:"before,omitempty"`
+	After  *storage.ServingWindow `json:"after,omitempty"`
+}
+
+// handleDownloadAt streams the archive that was being served for a branch
+// at time=, when it is still held (the current archive or one kept by
+// keep_previous_archives). It never downloads. The window is in
+// X-GHH-Served-From and X-GHH-Served-Until, and the commit in X-GHH-Commit
+// matches the audit line logged when the archive was activated.
+func (s *Server) handleDownloadAt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	_, user, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	st, ok := s.store.(servedAtStore)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "time-travel downloads are not supported by this store")
+		return
+	}
+	q := r.URL.Query()
+	repo := repoArg(q.Get("repo"))
+	branch := strings.TrimSpace(q.Get("branch"))
+	if repo == "" {
+		fail(w, r, http.StatusBadRequest, "missing repo")
+		return
+	}
+	if !refParam(w, r, branch) || !s.allowRepo(w, r, repo) {
+		return
+	}
+	v := strings.TrimSpace(q.Get("time"))
+	at, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		fail(w, r, http.StatusBadRequest, "time must be an RFC 3339 timestamp, got "+v)
+		return
+	}
+	zipPath, meta, window, err := st.ArchiveServedAt(user, repo, branch, at)
+	if err != nil {
+		s.logf("download at error user=%s repo=%s branch=%s time=%s err=%v\n", user, repo, branch, v, err)
+		var ns *storage.NotServedError
+		if errors.As(err, &ns) {
+			body := notServedBody{Before: ns.Before, After: ns.After}
+			body.Error.Code = CodeNotFound
+			body.Error.Message = "download at: " + err.Error()
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("X-GHH-Error-Code", CodeNotFound)
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(body)
+			return
+		}
+		jsonError(w, "download at", err)
+		return
+	}
+	w.Header().Set("X-GHH-Served-From", window.From.UTC().Format(time.RFC3339))
+	if window.Until != nil {
+		w.Header().Set("X-GHH-Served-Until", window.Until.UTC().Format(time.RFC3339))
+	}
+	s.logf("audit: download at user=%s repo=%s branch=%s time=%s commit=%s sha256=%s\n", user, repo, branch, at.UTC().Format(time.RFC3339), meta.CommitSHA, meta.SHA256)
+	s.serveHeld(w, r, user, repo, zipPath, meta)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadAt(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(root, "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	oldSHA, newSHA := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	dir := filepath.Join(root, "users", "default", "repos", "own", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"main.zip": "new archive", "main.aaaaaaa.zip": "old archive"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := fmt.Sprintf(`{"repo":"own/repo","branch":"main","commit_sha":%q,"size":11,"fetched_at":"2024-05-03T10:00:00Z","activated_at":"2024-05-03T10:00:00Z",
+		"previous":[{"commit_sha":%q,"file":"main.aaaaaaa.zip","size":11,"fetched_at":"2024-05-01T08:00:00Z","activated_at":"2024-05-02T00:00:00Z","retired_at":"2024-05-03T10:00:00Z"}]}`, newSHA, oldSHA)
+	if err := os.WriteFile(filepath.Join(dir, "main.meta.json"), []byte(meta), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		time       string
+		want       int
+		wantCommit string
+		wantBody   string
+		wantUntil  string
+	}{
+		{"retained", "2024-05-03T09:59:59Z", http.StatusOK, oldSHA, "old archive", "2024-05-03T10:00:00Z"},
+		{"current", "2024-05-03T10:00:00Z", http.StatusOK, newSHA, "new archive", ""},
+		{"offset", "2024-05-03T11:00:00+02:00", http.StatusOK, oldSHA, "old archive", "2024-05-03T10:00:00Z"},
+		{"before history", "2024-05-01T00:00:00Z", http.StatusNotFound, "", "", ""},
+		{"bad time", "May 3rd", http.StatusBadRequest, "", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/download/at?repo=own/repo&branch=main&time="+url.QueryEscape(tc.time), nil))
+			if rec.Code != tc.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.want, rec.Body.String())
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("X-GHH-Commit"); got != tc.wantCommit {
+				t.Fatalf("X-GHH-Commit %q, want %q", got, tc.wantCommit)
+			}
+			if rec.Body.String() != tc.wantBody {
+				t.Fatalf("body %q", rec.Body.String())
+			}
+			if got := rec.Header().Get("X-GHH-Served-Until"); got != tc.wantUntil {
+				t.Fatalf("X-GHH-Served-Until %q, want %q", got, tc.wantUntil)
+			}
+		})
+	}
+
+	// A miss names the nearest window that is still held.
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/download/at?repo=own/repo&branch=main&time=2024-05-01T00:00:00Z", nil))
+	var body notServedBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeNotFound || body.Before != nil || body.After == nil || body.After.CommitSHA != oldSHA {
+		t.Fatalf("404 body %+v", body)
+	}
+}
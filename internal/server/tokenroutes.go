@@ -0,0 +1,23 @@
+package server
+
+import "github-hub/internal/storage"
+
+// SetTokenRoutes installs the credential routing table for requests that
+// carry no GitHub token; the server token is then only used where the table
+// routes to it. It may be called again while serving; nil restores the
+// server token as the fallback for every repo.
+func (s *Server) SetTokenRoutes(t *storage.TokenRoutes) {
+	s.tokenRoutes.Store(t)
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.SetTokenRoutes(t)
+	}
+}
+
+// fallbackToken is the token for requests without one: the server token,
+// or none when token routes choose it per repo in storage.
+func (s *Server) fallbackToken() string {
+	if s.tokenRoutes.Load() != nil {
+		return ""
+	}
+	return s.token
+}
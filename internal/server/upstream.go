@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// circuitSource is implemented by stores with an upstream circuit (see
+// storage.Storage.UpstreamCircuit).
+type circuitSource interface {
+	UpstreamCircuit() storage.CircuitStatus
+}
+
+// SetUpstreamCircuit tunes the built-in storage's upstream circuit: it
+// opens after threshold GitHub calls in a row failed (0 = 5, negative
+// disables it) and stays open for cooldown (0 = 30s) before probing.
+func (s *Server) SetUpstreamCircuit(threshold int, cooldown time.Duration) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.CircuitThreshold = threshold
+		st.CircuitCooldown = max(cooldown, 0)
+	}
+}
+
+// SetAPICallTimeout bounds each GitHub API call of the built-in storage,
+// reading the answer included (0 = default 30s, negative = none; see
+// storage.Storage.APICallTimeout).
+func (s *Server) SetAPICallTimeout(d time.Duration) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.APICallTimeout = d
+	}
+}
+
+// SetBranchLookup picks the GitHub API call the built-in storage resolves
+// branch heads with (see storage.Storage.BranchLookup).
+func (s *Server) SetBranchLookup(l storage.BranchLookup) {
+	if st, ok := s.store.(*storage.Storage); ok {
+		st.BranchLookup = l
+	}
+}
+
+// upstreamStatus is the answer of /api/v1/admin/upstream.
+type upstreamStatus struct {
+	Circuit storage.CircuitStatus `json:"circuit"`
+	// RateLimited is set while a GitHub secondary rate limit breaker is
+	// open or half-open.
+	RateLimited bool                    `json:"rate_limited"`
+	Downloads   *storage.UpstreamHealth `json:"downloads,omitempty"`
+}
+
+// handleUpstream reports what the hub knows about GitHub's availability:
+// the upstream circuit with its failure counts and last error, the rate
+// limit breaker and the slow-download alert. Admin only.
+func (s *Server) handleUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, _, ok := s.scope(w, r)
+	if !ok {
+		return
+	}
+	if !p.Admin {
+		fail(w, r, http.StatusForbidden, "upstream status requires an admin key")
+		return
+	}
+	src, ok := s.store.(circuitSource)
+	if !ok {
+		fail(w, r, http.StatusNotImplemented, "upstream status is not supported by this store")
+		return
+	}
+	out := upstreamStatus{Circuit: src.UpstreamCircuit()}
+	if b, ok := s.store.(breakerSource); ok {
+		out.RateLimited = b.BreakerOpen()
+	}
+	if d, ok := s.store.(downloadSource); ok {
+		h := d.UpstreamHealth()
+		out.Downloads = &h
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+)
+
+func TestUpstreamCircuitStatus(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "default", "", defaultDownloadTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	st := s.store.(*storage.Storage)
+	var calls int
+	st.HTTPClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("unavailable")), Header: make(http.Header)}, nil
+	})}
+	st.RetryMax = 0
+	reg := metrics.NewRegistry()
+	s.SetMetrics(reg)
+	s.SetUpstreamCircuit(1, time.Minute)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/api/v1/download?repo=owner/repo&branch=main&legacy=true"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("first download: %d %s", rec.Code, rec.Body.String())
+	}
+	before := calls
+	rec := get("/api/v1/download?repo=owner/repo&branch=main&legacy=true")
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("download with open circuit: %d Retry-After=%q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	if calls != before {
+		t.Fatalf("open circuit made %d upstream calls", calls-before)
+	}
+
+	rec = get("/api/v1/admin/upstream")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upstream status: %d %s", rec.Code, rec.Body.String())
+	}
+	var got upstreamStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	c := got.Circuit
+	if c.State != storage.BreakerOpen || c.Threshold != 1 || c.Cooldown != 60 || c.Trips != 1 || c.Failures == 0 || c.Rejected == 0 || !strings.Contains(c.LastError, "503") {
+		t.Fatalf("circuit = %+v", c)
+	}
+
+	var out strings.Builder
+	if err := reg.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "ghh_upstream_circuit_open 1") || !strings.Contains(out.String(), "ghh_upstream_circuit_trips_total 1") {
+		t.Fatalf("circuit metrics missing:\n%s", out.String())
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/storage"
+)
+
+// Cache usage is counted in one-minute buckets over the last day, so a
+// window covers its current partial minute plus the full minutes before it.
+const (
+	usageBucket  = time.Minute
+	usageBuckets = 24 * 60
+)
+
+// Eviction reasons in usageCounts.Evictions besides the storage ones
+// (expired, retention, gone and space).
+const evictManual = "manual"
+
+// usageCounts is what a bucket, or a window of buckets, counted.
+type usageCounts struct {
+	// Requests counts archive and package requests that consulted the
+	// cache, by the outcome storage reported.
+	Requests      int64 `json:"requests"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidations int64 `json:"revalidations"`
+	Stale         int64 `json:"stale"`
+	// BytesServed is what those requests wrote, BytesFromCache the part
+	// written without a download; BytesDownloaded is what storage fetched
+	// from GitHub and package hosts.
+	BytesServed     int64            `json:"bytes_served"`
+	BytesFromCache  int64            `json:"bytes_from_cache"`
+	BytesDownloaded int64            `json:"bytes_downloaded"`
+	Evictions       map[string]int64 `json:"evictions"`
+}
+
+func (c *usageCounts) add(o usageCounts) {
+	c.Requests += o.Requests
+	c.Hits += o.Hits
+	c.Misses += o.Misses
+	c.Revalidations += o.Revalidations
+	c.Stale += o.Stale
+	c.BytesServed += o.BytesServed
+	c.BytesFromCache += o.BytesFromCache
+	c.BytesDownloaded += o.BytesDownloaded
+	for reason, n := range o.Evictions {
+		if c.Evictions == nil {
+			c.Evictions = map[string]int64{}
+		}
+		c.Evictions[reason] += n
+	}
+}
+
+// usageWindow is one window of GET /api/v1/stats/summary.
+type usageWindow struct {
+	usageCounts
+	// Since is the start of the oldest minute the window covers.
+	Since time.Time `json:"since"`
+	// HitRatio is the share of Requests served without a download (hits,
+	// revalidations and stale serves); 0 without requests.
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// merge adds o, the same window on another instance, to w.
+func (w *usageWindow) merge(o usageWindow) {
+	w.add(o.usageCounts)
+	if !o.Since.IsZero() && o.Since.Before(w.Since) {
+		w.Since = o.Since
+	}
+	w.HitRatio = 0
+	if w.Requests > 0 {
+		w.HitRatio = float64(w.Requests-w.Misses) / float64(w.Requests)
+	}
+}
+
+// usageSummary is the answer of GET /api/v1/stats/summary.
+type usageSummary struct {
+	LastHour usageWindow `json:"last_hour"`
+	LastDay  usageWindow `json:"last_24h"`
+	// Tiers is what each cache tier holds, when the store has tiers; only
+	// admins see it.
+	Tiers []storage.TierUsage `json:"tiers,omitempty"`
+	// Protected is what the archives protected from cleanup hold; only
+	// admins see it.
+	Protected *storage.ProtectedUsage `json:"protected,omitempty"`
+}
+
+type usageSlot struct {
+	minute int64 // unix minute the slot counts; older ones are reset on use
+	counts usageCounts
+}
+
+// usage keeps the rolling cache usage counters. Handlers report the cache
+// outcome (setCacheLabel), the usage middleware the bytes written, storage
+// its downloads and evictions. It lives in memory: a restart starts the
+// windows empty.
+type usage struct {
+	now   func() time.Time
+	mu    sync.Mutex
+	slots [usageBuckets]usageSlot
+
+	// Cumulative series for /metrics, set by SetMetrics.
+	requests  *metrics.CounterVec
+	bytes     *metrics.CounterVec
+	evictions *metrics.CounterVec
+}
+
+func newUsage(now func() time.Time) *usage {
+	return &usage{now: now}
+}
+
+func usageMinute(t time.Time) int64 {
+	return t.Unix() / int64(usageBucket/time.Second)
+}
+
+// slot returns the counts of the current minute; u.mu must be held.
+func (u *usage) slot() *usageCounts {
+	m := usageMinute(u.now())
+	sl := &u.slots[m%usageBuckets]
+	if sl.minute != m {
+		*sl = usageSlot{minute: m}
+	}
+	return &sl.counts
+}
+
+// served counts one request that consulted the cache and wrote n bytes.
+func (u *usage) served(o storage.CacheOutcome, n int64) {
+	u.mu.Lock()
+	c := u.slot()
+	c.Requests++
+	c.BytesServed += n
+	switch o {
+	case storage.CacheHit:
+		c.Hits++
+	case storage.CacheRevalidated:
+		c.Revalidations++
+	case storage.CacheStale:
+		c.Stale++
+	case storage.CacheMiss:
+		c.Misses++
+	}
+	fromCache := o != storage.CacheMiss
+	if fromCache {
+		c.BytesFromCache += n
+	}
+	u.mu.Unlock()
+	if u.requests != nil {
+		u.requests.Inc(string(o))
+		if fromCache {
+			u.bytes.Add(float64(n), "cache")
+		}
+	}
+}
+
+// downloaded counts n bytes fetched from upstream.
+func (u *usage) downloaded(n int64) {
+	u.mu.Lock()
+	u.slot().BytesDownloaded += n
+	u.mu.Unlock()
+	if u.bytes != nil {
+		u.bytes.Add(float64(n), "upstream")
+	}
+}
+
+// evicted counts n cache entries removed for reason.
+func (u *usage) evicted(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	u.mu.Lock()
+	c := u.slot()
+	if c.Evictions == nil {
+		c.Evictions = map[string]int64{}
+	}
+	c.Evictions[reason] += int64(n)
+	u.mu.Unlock()
+	if u.evictions != nil {
+		u.evictions.Add(float64(n), reason)
+	}
+}
+
+// window sums the last minutes buckets, the current one included.
+func (u *usage) window(minutes int64) usageWindow {
+	now := usageMinute(u.now())
+	w := usageWindow{Since: time.Unix((now-minutes+1)*int64(usageBucket/time.Second), 0).UTC()}
+	w.Evictions = map[string]int64{}
+	u.mu.Lock()
+	for i := range u.slots {
+		if sl := &u.slots[i]; sl.minute > now-minutes && sl.minute <= now {
+			w.add(sl.counts)
+		}
+	}
+	u.mu.Unlock()
+	if w.Requests > 0 {
+		w.HitRatio = float64(w.Requests-w.Misses) / float64(w.Requests)
+	}
+	return w
+}
+
+func (u *usage) summary() usageSummary {
+	return usageSummary{LastHour: u.window(60), LastDay: u.window(usageBuckets)}
+}
+
+// observeUsage registers the usage series on reg.
+func (s *Server) observeUsage(reg *metrics.Registry) {
+	u := s.usage
+	u.requests = reg.Counter("ghh_cache_requests_total", "Archive and package requests that consulted the cache, by outcome.", "outcome")
+	u.bytes = reg.Counter("ghh_cache_bytes_total", "Bytes served from cache (source=cache) and downloaded from upstream (source=upstream).", "source")
+	u.evictions = reg.Counter("ghh_cache_evictions_total", "Cache entries removed, by reason.", "reason")
+	reg.GaugeFunc("ghh_cache_hit_ratio_1h", "Share of cache requests in the last hour served without a download.", func() float64 { return u.window(60).HitRatio })
+	reg.GaugeFunc("ghh_cache_hit_ratio_24h", "Share of cache requests in the last 24h served without a download.", func() float64 { return u.window(usageBuckets).HitRatio })
+}
+
+// tally reports the cache outcome a handler set and the bytes it wrote to
+// the usage counters. Requests that never consulted the cache are not
+// counted.
+func (s *Server) tally(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obs, ok := r.Context().Value(observationKey{}).(*observation)
+		if !ok {
+			obs = &observation{}
+			r = r.WithContext(context.WithValue(r.Context(), observationKey{}, obs))
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, r)
+		if obs.cache != "" {
+			s.usage.served(obs.cache, cw.n)
+		}
+	})
+}
+
+// eventTap receives the built-in storage's events: evictions feed the
+// usage counters, and every event goes on to the webhook, when set, and to
+// the sink the storage had before.
+type eventTap struct {
+	usage *usage
+	hook  atomic.Pointer[webhook]
+	next  storage.EventSink
+}
+
+func (t *eventTap) Publish(e storage.Event) {
+	if e.Type == storage.EventArchiveEvicted || e.Type == storage.EventPackageEvicted {
+		t.usage.evicted(e.Reason, 1)
+	}
+	if wh := t.hook.Load(); wh != nil {
+		wh.Publish(e)
+	}
+	if t.next != nil {
+		t.next.Publish(e)
+	}
+}
+
+// handleStatsSummary reports cache usage over the last hour and day: the
+// hit ratio, bytes served from cache against bytes downloaded, and
+// evictions by reason. The counters cover the whole server. Admins also
+// see what each cache tier holds.
+func (s *Server) handleStatsSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	peer, ok := s.statsPeer(w, r)
+	if !ok {
+		return
+	}
+	var p Principal
+	if !peer {
+		if p, _, ok = s.scope(w, r); !ok {
+			return
+		}
+	}
+	all, ok := s.clusterStats(w, r)
+	if !ok {
+		return
+	}
+	sum := s.usage.summary()
+	if all && !peer {
+		s.fanOut(r.Context(), w, r.URL.Path, url.Values{}, func(b []byte) error {
+			var theirs usageSummary
+			if err := json.Unmarshal(b, &theirs); err != nil {
+				return err
+			}
+			sum.LastHour.merge(theirs.LastHour)
+			sum.LastDay.merge(theirs.LastDay)
+			return nil
+		})
+	}
+	if src, ok := s.store.(tierSource); ok && p.Admin {
+		sum.Tiers = src.TierUsage()
+	}
+	if src, ok := s.store.(archivePinner); ok && p.Admin {
+		u := src.ProtectedUsage()
+		sum.Protected = &u
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(sum)
+}
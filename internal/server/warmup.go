@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+// Warm-up states reported in WarmupStatus.State.
+const (
+	warmupRunning   = "running"
+	warmupDone      = "done"
+	warmupStopped   = "stopped" // rate limited or breaker open
+	warmupCancelled = "cancelled"
+)
+
+// warmupProgressEvery is how many checks pass between progress logs.
+const warmupProgressEvery = 10
+
+// WarmupStatus reports the startup warm-up in GET /api/v1/revalidate/status.
+type WarmupStatus struct {
+	// State is running, done, stopped (GitHub rate limited it) or
+	// cancelled (shutdown).
+	State string `json:"state"`
+	// GatesReady is set when /readyz waits for the warm-up.
+	GatesReady bool       `json:"gates_ready"`
+	Total      int        `json:"total"`
+	Checked    int        `json:"checked"`
+	Updated    int        `json:"updated"`
+	Failed     int        `json:"failed"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+}
+
+// warmup revalidates the most recently used branches once at startup, so
+// the first requests after a restart find them checked.
+type warmup struct {
+	mu     sync.Mutex
+	status *WarmupStatus
+	// warming holds /readyz at 503 while a gating warm-up runs.
+	warming atomic.Bool
+}
+
+func (w *warmup) report() *WarmupStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == nil {
+		return nil
+	}
+	st := *w.status
+	return &st
+}
+
+func (w *warmup) update(f func(st *WarmupStatus)) {
+	w.mu.Lock()
+	f(w.status)
+	w.mu.Unlock()
+}
+
+// StartWarmup revalidates the n most recently used cached branches in the
+// background, at most concurrency (0: 2) at once, refreshing those that
+// moved. With gateReady, /readyz answers 503 until it finishes. It stops
+// early when GitHub rate limits it and is cancelled by Shutdown. n <= 0
+// skips it. It needs a store that implements RecentBranches and
+// Revalidate, such as the built-in storage.
+func (s *Server) StartWarmup(n, concurrency int, gateReady bool) error {
+	if n <= 0 {
+		return nil
+	}
+	src, ok := s.store.(revalidateSource)
+	if !ok {
+		return errors.New("warm-up is not supported by this store")
+	}
+	if concurrency <= 0 {
+		concurrency = defaultRevalidateConcurrency
+	}
+	s.warmup.mu.Lock()
+	if s.warmup.status != nil {
+		s.warmup.mu.Unlock()
+		return errors.New("warm-up already started")
+	}
+	s.warmup.status = &WarmupStatus{State: warmupRunning, GatesReady: gateReady, Started: s.now()}
+	s.warmup.mu.Unlock()
+	s.warmup.warming.Store(gateReady)
+	go s.runWarmup(s.janitorCtx, src, n, concurrency)
+	return nil
+}
+
+func (s *Server) runWarmup(ctx context.Context, src revalidateSource, n, concurrency int) {
+	w := s.warmup
+	defer w.warming.Store(false)
+	recent := src.RecentBranches(time.Time{})
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].LastAccess.After(recent[j].LastAccess) })
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+	w.update(func(st *WarmupStatus) { st.Total = len(recent) })
+	s.logf("warmup start branches=%d concurrency=%d\n", len(recent), concurrency)
+
+	var (
+		wg          sync.WaitGroup
+		rateLimited bool
+		limitMu     sync.Mutex
+		stopped     bool
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, b := range recent {
+		sem <- struct{}{}
+		if ctx.Err() != nil || s.revalidate.limited(&limitMu, &rateLimited) {
+			<-sem
+			stopped = ctx.Err() == nil
+			break
+		}
+		wg.Add(1)
+		go func(b storage.RecentBranch) {
+			defer func() { <-sem; wg.Done() }()
+			if s.warmupCheck(ctx, src, b) == revalidateRateLimited {
+				limitMu.Lock()
+				rateLimited = true
+				limitMu.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	state := warmupDone
+	switch {
+	case ctx.Err() != nil:
+		state = warmupCancelled
+	case stopped:
+		state = warmupStopped
+	}
+	var st WarmupStatus
+	w.update(func(ws *WarmupStatus) {
+		now := s.now()
+		ws.State, ws.Finished = state, &now
+		st = *ws
+	})
+	s.logf("warmup %s checked=%d/%d updated=%d failed=%d in %s\n", state, st.Checked, st.Total, st.Updated, st.Failed, st.Finished.Sub(st.Started).Round(time.Millisecond))
+}
+
+// warmupCheck revalidates one branch and records the result.
+func (s *Server) warmupCheck(ctx context.Context, src revalidateSource, b storage.RecentBranch) string {
+	ctx, cancel := s.downloadContext(ctx)
+	defer cancel()
+	res, err := src.Revalidate(ctx, b, s.fallbackToken())
+	result := revalidateResult(res, err)
+
+	var checked, total int
+	s.warmup.update(func(st *WarmupStatus) {
+		st.Checked++
+		switch result {
+		case revalidateUpdated:
+			st.Updated++
+		case revalidateError, revalidateRateLimited:
+			st.Failed++
+		}
+		checked, total = st.Checked, st.Total
+	})
+	switch result {
+	case revalidateUpdated:
+		s.logf("warmup updated user=%s repo=%s branch=%s sha=%s\n", b.User, b.Repo, b.Branch, res.ShortSHA)
+	case revalidateError, revalidateRateLimited:
+		s.logf("warmup error user=%s repo=%s branch=%s err=%v\n", b.User, b.Repo, b.Branch, redactToken(err, s.fallbackToken()))
+	}
+	if checked%warmupProgressEvery == 0 && checked < total {
+		s.logf("warmup progress checked=%d/%d\n", checked, total)
+	}
+	return result
+}
+
+// handleReadyz answers 200 once the server is ready for traffic and 503
+// while a gating warm-up runs.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if s.warmup.warming.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("warming up\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
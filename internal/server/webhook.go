@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+const (
+	// webhookQueueSize bounds the events waiting for delivery; past it new
+	// events go straight to the dead-letter log.
+	webhookQueueSize = 1024
+	webhookAttempts  = 5
+	webhookBackoff   = time.Second
+	webhookTimeout   = 10 * time.Second
+)
+
+// webhook posts storage events to an external URL, one JSON event per
+// request, from its own goroutine. Each body is signed with HMAC-SHA256 of
+// the secret in X-GHH-Signature-256 ("sha256=<hex>", as GitHub does).
+// Failed deliveries are retried with exponential backoff and then written
+// to the dead-letter log.
+type webhook struct {
+	url        string
+	secret     string
+	events     map[string]bool // empty: every type
+	deadLetter string          // JSON lines file; empty logs to stdout
+	client     *http.Client
+	queue      chan storage.Event
+	backoff    time.Duration
+	logf       func(string, ...any)
+	mu         sync.Mutex // serializes dead-letter writes
+}
+
+// SetWebhook sends the storage events named in events (all when empty; see
+// storage.EventTypes) to rawURL, signed with secret when it is set.
+// Deliveries that keep failing are appended to the deadLetter file, or
+// logged when it is empty. Delivery stops at Shutdown, which dead-letters
+// what is still queued. It needs the built-in storage.
+func (s *Server) SetWebhook(rawURL, secret string, events []string, deadLetter string) error {
+	if _, ok := s.store.(*storage.Storage); !ok || s.events == nil {
+		return errors.New("webhooks are not supported by this store")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url must be an http(s) URL, got %q", rawURL)
+	}
+	wh := &webhook{
+		url:        rawURL,
+		secret:     secret,
+		events:     map[string]bool{},
+		deadLetter: deadLetter,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan storage.Event, webhookQueueSize),
+		backoff:    webhookBackoff,
+		logf:       s.logf,
+	}
+	for _, e := range events {
+		if !slices.Contains(storage.EventTypes, e) {
+			return fmt.Errorf("unknown webhook event %q (want one of %v)", e, storage.EventTypes)
+		}
+		wh.events[e] = true
+	}
+	s.webhook = wh
+	s.events.hook.Store(wh)
+	go wh.run(s.janitorCtx)
+	return nil
+}
+
+// Publish queues e without blocking; a full queue dead-letters it.
+func (wh *webhook) Publish(e storage.Event) {
+	if len(wh.events) > 0 && !wh.events[e.Type] {
+		return
+	}
+	select {
+	case wh.queue <- e:
+	default:
+		wh.dead(e, 0, errors.New("delivery queue full"))
+	}
+}
+
+func (wh *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-wh.queue:
+					wh.dead(e, 0, errors.New("server shutting down"))
+				default:
+					return
+				}
+			}
+		case e := <-wh.queue:
+			wh.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver posts e until it is accepted, a permanent error, or the last
+// attempt, then dead-letters it if it never got through.
+func (wh *webhook) deliver(ctx context.Context, e storage.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		wh.dead(e, 0, err)
+		return
+	}
+	id := deliveryID()
+	delay := wh.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := wh.post(ctx, id, e.Type, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts || ctx.Err() != nil {
+			wh.dead(e, attempt, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post makes one delivery attempt; retry reports whether a later attempt
+// may succeed.
+func (wh *webhook) post(ctx context.Context, id, typ string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", storage.DefaultUserAgent())
+	req.Header.Set("X-GHH-Event", typ)
+	req.Header.Set("X-GHH-Delivery", id)
+	if wh.secret != "" {
+		req.Header.Set("X-GHH-Signature-256", "sha256="+signPayload(wh.secret, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status=%d", resp.StatusCode)
+}
+
+// signPayload is the hex HMAC-SHA256 of body under secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliveryID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deadLetterRecord is one line of the dead-letter log.
+type deadLetterRecord struct {
+	Event    storage.Event `json:"event"`
+	Error    string        `json:"error"`
+	Attempts int           `json:"attempts"`
+	Time     time.Time     `json:"time"`
+}
+
+func (wh *webhook) dead(e storage.Event, attempts int, cause error) {
+	line, err := json.Marshal(deadLetterRecord{Event: e, Error: cause.Error(), Attempts: attempts, Time: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	wh.logf("webhook undelivered type=%s attempts=%d err=%v\n", e.Type, attempts, cause)
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.deadLetter == "" {
+		wh.logf("webhook dead letter: %s\n", line)
+		return
+	}
+	f, err := os.OpenFile(wh.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		wh.logf("webhook dead letter %s: %v: %s\n", wh.deadLetter, err, line)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	_, _ = f.Write(append(line, '\n'))
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []storage.Event
+		calls    int
+	)
+	status := http.StatusOK
+	done := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { done <- struct{}{} }()
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get("X-GHH-Signature-256"), "sha256="+signPayload("s3cret", body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		var e storage.Event
+		if err := json.Unmarshal(body, &e); err != nil || r.Header.Get("X-GHH-Event") != e.Type || r.Header.Get("X-GHH-Delivery") == "" {
+			t.Errorf("bad delivery %s: %v", body, err)
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // retried
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		received = append(received, e)
+	}))
+	defer ts.Close()
+
+	s, err := NewServer(t.TempDir(), "default", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	if err := s.SetWebhook(ts.URL, "s3cret", []string{storage.EventArchiveRefreshed, storage.EventCleanupCompleted}, deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	s.webhook.backoff = time.Millisecond
+	wait := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("delivery timed out")
+			}
+		}
+	}
+
+	s.webhook.Publish(storage.Event{Type: storage.EventArchiveEvicted, Repo: "own/repo"}) // filtered out
+	s.webhook.Publish(storage.Event{Type: storage.EventArchiveRefreshed, Repo: "own/repo", Branch: "main", OldSHA: "a", NewSHA: "b"})
+	wait(2)
+	mu.Lock()
+	if len(received) != 1 || received[0].NewSHA != "b" || calls != 2 {
+		t.Fatalf("received %+v after %d calls", received, calls)
+	}
+	// A permanent failure is not retried and lands in the dead-letter log.
+	status = http.StatusBadRequest
+	mu.Unlock()
+	s.webhook.Publish(storage.Event{Type: storage.EventCleanupCompleted})
+	wait(1)
+
+	var rec deadLetterRecord
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		f, err := os.Open(deadLetter)
+		if err == nil {
+			sc := bufio.NewScanner(f)
+			ok := sc.Scan() && json.Unmarshal(sc.Bytes(), &rec) == nil
+			_ = f.Close()
+			if ok {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no dead letter written")
+		}
+	}
+	if rec.Event.Type != storage.EventCleanupCompleted || rec.Attempts != 1 || rec.Error != "status=400" {
+		t.Fatalf("dead letter %+v", rec)
+	}
+
+	if err := s.SetWebhook("ftp://example.com", "", nil, ""); err == nil {
+		t.Fatal("expected an error for a non-http url")
+	}
+	if err := s.SetWebhook(ts.URL, "", []string{"archive-exploded"}, ""); err == nil {
+		t.Fatal("expected an error for an unknown event")
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static/*
+var uiFS embed.FS
+
+// SetWebUI serves the embedded cache browser at / when enabled; otherwise /
+// is 404. Call it before RegisterRoutes. The UI keeps no state of its own:
+// it only calls the JSON API, as the caller, so it sees and may change
+// exactly what the caller's API key allows.
+func (s *Server) SetWebUI(enabled bool) {
+	s.webUI = enabled
+}
+
+// uiHandler serves the static assets. With auth enabled they need an API
+// key too; browsers are asked for it as the password of HTTP Basic auth,
+// which they then send along with the UI's own API calls.
+func (s *Server) uiHandler() http.Handler {
+	sub, _ := fs.Sub(uiFS, "static")
+	files := http.FileServer(http.FS(sub))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if _, err := s.authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="github-hub", charset="UTF-8"`)
+			fail(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxAPIBody bounds how much of a GitHub API answer is decoded. The largest
+// legitimate one, a page of 100 commits, is far below it; a proxy that
+// answers with an endless body is not.
+const maxAPIBody = 1 << 20
+
+// defaultAPICallTimeout bounds a GitHub API call when
+// Storage.APICallTimeout is zero.
+const defaultAPICallTimeout = 30 * time.Second
+
+// ErrAPIResponseTooLarge reports a GitHub API answer larger than any the
+// hub expects (1 MiB). It also matches ErrUpstreamUnavailable.
+var ErrAPIResponseTooLarge = errors.New("github api response too large")
+
+// APIResponseTooLargeError is the error of a GitHub API call whose answer
+// went past Limit bytes; Op is what was asked, like StatusError.Op.
+type APIResponseTooLargeError struct {
+	Op    string
+	Limit int64
+}
+
+func (e *APIResponseTooLargeError) Error() string {
+	return fmt.Sprintf("%s: %s: more than %d bytes", ErrAPIResponseTooLarge, e.Op, e.Limit)
+}
+
+func (e *APIResponseTooLargeError) Unwrap() []error {
+	return []error{ErrAPIResponseTooLarge, ErrUpstreamUnavailable}
+}
+
+func (s *Storage) apiCallTimeout() time.Duration {
+	if s.APICallTimeout < 0 {
+		return 0
+	}
+	if s.APICallTimeout == 0 {
+		return defaultAPICallTimeout
+	}
+	return s.APICallTimeout
+}
+
+// apiContext bounds one GitHub API call, reading its answer included, by
+// the API call timeout, whether or not ctx has a deadline of its own. A
+// call cut short by it fails with ErrUpstreamUnavailable (see apiTimedOut).
+func (s *Storage) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := s.apiCallTimeout()
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, d, fmt.Errorf("github api call took longer than %s: %w", d, ErrUpstreamUnavailable))
+}
+
+// apiTimedOut reports whether ctx ended because the API call timeout of
+// apiContext ran out rather than because the caller gave up.
+func apiTimedOut(ctx context.Context) bool {
+	return ctx.Err() != nil && errors.Is(context.Cause(ctx), ErrUpstreamUnavailable)
+}
+
+// decodeAPI decodes the JSON answer body of the GitHub API call op into
+// out, failing with an *APIResponseTooLargeError past maxAPIBody.
+func decodeAPI(op string, body io.Reader, out any) error {
+	return json.NewDecoder(&apiBodyReader{r: body, op: op, left: maxAPIBody}).Decode(out)
+}
+
+// apiBodyReader reads at most left bytes of r and then fails.
+type apiBodyReader struct {
+	r    io.Reader
+	op   string
+	left int64
+}
+
+func (r *apiBodyReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, &APIResponseTooLargeError{Op: r.op, Limit: maxAPIBody}
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// archiveLagRetries bounds how often an archive is asked for again while
+// codeload 404s a commit the API has just resolved.
+const archiveLagRetries = 3
+
+// defaultArchiveLagBackoff is the wait before the first of those retries
+// when Storage.ArchiveLagBackoff is zero; later ones wait longer.
+const defaultArchiveLagBackoff = 500 * time.Millisecond
+
+// ErrArchiveUnavailable reports that codeload kept answering 404 for a
+// commit the API had resolved the branch to, as it does for a while after
+// a branch is created. It also matches ErrUpstreamUnavailable.
+var ErrArchiveUnavailable = errors.New("archive not served for resolved commit")
+
+// ArchiveUnavailableError is the error of a download that got 404 for the
+// resolved commit through every retry and for the branch name after them.
+// URLs are the archive URLs tried, by commit first (owner/repo@ref for a
+// Storage.Fetcher other than GitHub); Err is the last failure.
+type ArchiveUnavailableError struct {
+	Repo   string
+	Branch string
+	SHA    string
+	URLs   []string
+	Err    error
+}
+
+func (e *ArchiveUnavailableError) Error() string {
+	return fmt.Sprintf("%s: %s@%s at %s: tried %s: %v", ErrArchiveUnavailable, e.Repo, e.Branch, shortCommit(e.SHA), strings.Join(e.URLs, ", "), e.Err)
+}
+
+// Unwrap leaves out a last 404: the branch exists, so it must not read as
+// ErrBranchNotFound.
+func (e *ArchiveUnavailableError) Unwrap() []error {
+	errs := []error{ErrArchiveUnavailable, ErrUpstreamUnavailable}
+	if e.Err != nil && !errors.Is(e.Err, ErrBranchNotFound) && !errors.Is(e.Err, ErrRepoNotFound) {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+func (s *Storage) archiveLagBackoff() time.Duration {
+	if s.ArchiveLagBackoff <= 0 {
+		return defaultArchiveLagBackoff
+	}
+	return s.ArchiveLagBackoff
+}
+
+// archiveURL is where FetchArchive asks for ownerRepo at ref.
+func (s *Storage) archiveURL(ownerRepo, ref string) string {
+	if s.Fetcher != nil {
+		return ownerRepo + "@" + ref
+	}
+	return fmt.Sprintf("https://codeload.github.com/%s/zip/%s", ownerRepo, url.PathEscape(ref))
+}
+
+// downloadLagging downloads ownerRepo at sha, which branch was just
+// resolved to but codeload answered 404 for: up to archiveLagRetries more
+// times with a growing backoff, then by branch name, which codeload often
+// serves before the commit. It returns the commit downloaded, read from
+// the archive comment when the branch name was used and the branch has
+// moved on since.
+func (s *Storage) downloadLagging(ctx context.Context, ownerRepo, branch, sha, token, dest string) (string, error) {
+	fmt.Printf("%s@%s: archive of %s not served yet, retrying\n", ownerRepo, branch, shortCommit(sha))
+	var err error
+	for attempt := 1; attempt <= archiveLagRetries; attempt++ {
+		if err := sleepWithBackoff(ctx, s.archiveLagBackoff(), attempt); err != nil {
+			return sha, err
+		}
+		err = s.downloadZip(ctx, ownerRepo, sha, token, dest)
+		if !errors.Is(err, ErrBranchNotFound) {
+			return sha, err
+		}
+	}
+	fmt.Printf("%s@%s: archive of %s still not served, downloading by branch name\n", ownerRepo, branch, shortCommit(sha))
+	if err = s.downloadZip(ctx, ownerRepo, branch, token, dest); err == nil {
+		if got := archiveCommit(dest); got != "" && got != sha {
+			sha = got
+		}
+		return sha, nil
+	}
+	return sha, &ArchiveUnavailableError{
+		Repo:   ownerRepo,
+		Branch: branch,
+		SHA:    sha,
+		URLs:   []string{s.archiveURL(ownerRepo, sha), s.archiveURL(ownerRepo, branch)},
+		Err:    err,
+	}
+}
+
+// archiveCommit returns the commit GitHub records as the comment of its
+// zipballs, or "" when path has none.
+func archiveCommit(path string) string {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = zr.Close() }()
+	if c := strings.TrimSpace(zr.Comment); fullSHA.MatchString(c) {
+		return c
+	}
+	return ""
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBranchInfo is the answer to "what is this repo's default branch and
+// which branches do I already have cached".
+type DefaultBranchInfo struct {
+	Repo           string   `json:"repo"`
+	DefaultBranch  string   `json:"default_branch"`
+	CachedBranches []string `json:"cached_branches"`
+}
+
+type defaultBranchEntry struct {
+	branch  string
+	expires time.Time
+}
+
+// DefaultBranch resolves ownerRepo's default branch (cached for
+// DefaultBranchTTL) and lists the branches user holds archives for.
+func (s *Storage) DefaultBranch(ctx context.Context, user, ownerRepo, token string) (*DefaultBranchInfo, error) {
+	user, ownerRepo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	branch, err := s.fetchDefaultBranch(ctx, ownerRepo, token)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := s.knownRepoName(ownerRepo); ok {
+		ownerRepo = name
+	}
+	return &DefaultBranchInfo{
+		Repo:           ownerRepo,
+		DefaultBranch:  branch,
+		CachedBranches: s.cachedBranches(user, ownerRepo),
+	}, nil
+}
+
+// cachedBranches scans the user's repo directory for git-mode (<branch>.zip)
+// and legacy (<branch>.legacy.zip) archives, skipping kept previous ones.
+func (s *Storage) cachedBranches(user, ownerRepo string) []string {
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	seen := map[string]bool{}
+	for _, path := range s.branchZips(dir) {
+		seen[branchFromPath(dir, path)] = true
+	}
+	out := make([]string, 0, len(seen))
+	for b := range seen {
+		out = append(out, b)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// branchZips lists the current branch archives under a repo directory:
+// every archive but those kept by KeepPrevious.
+func (s *Storage) branchZips(dir string) []string {
+	var zips []string
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if zipPath, ok := archivePath(path); ok {
+			zips = append(zips, zipPath)
+		}
+		return nil
+	})
+	retained := retainedArchives(zips)
+	out := zips[:0]
+	for _, path := range zips {
+		if retained[path] == nil {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+// branchFromPath is the branch an archive under dir is named after; legacy
+// archive names have / replaced, so prefer the recorded branch for those.
+func branchFromPath(dir, zipPath string) string {
+	rel, err := filepath.Rel(dir, zipPath)
+	if err != nil {
+		return filepath.Base(zipPath)
+	}
+	rel = filepath.ToSlash(rel)
+	return strings.TrimSuffix(strings.TrimSuffix(rel, ".zip"), ".legacy")
+}
+
+// cachedBranchChecks bounds the concurrent upstream lookups of
+// CachedBranches.
+const cachedBranchChecks = 4
+
+// CachedBranch is one branch archive a user holds for a repo.
+type CachedBranch struct {
+	Branch       string     `json:"branch"`
+	Legacy       bool       `json:"legacy,omitempty"`
+	CommitSHA    string     `json:"commit_sha,omitempty"`
+	ShortSHA     string     `json:"short_sha,omitempty"`
+	Size         int64      `json:"size"`
+	FetchedAt    *time.Time `json:"fetched_at,omitempty"`
+	LastAccessed time.Time  `json:"last_accessed"`
+	Protected    bool       `json:"protected,omitempty"`
+	// Stale is only set by a remote check: whether upstream moved on
+	// (or deleted the branch). CheckError says why it is missing.
+	Stale      *bool  `json:"stale,omitempty"`
+	CheckError string `json:"check_error,omitempty"`
+}
+
+// CachedBranches lists the branch archives user holds for ownerRepo,
+// sorted by branch, without downloading anything; nothing cached is an
+// empty list. With remote set each branch is resolved upstream, a few at a
+// time, to tell whether its archive is stale.
+func (s *Storage) CachedBranches(ctx context.Context, user, ownerRepo, token string, remote bool) ([]CachedBranch, error) {
+	user, ownerRepo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	if remote {
+		if err := s.checkRepo(ownerRepo); err != nil {
+			return nil, err
+		}
+	}
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	out := []CachedBranch{}
+	for _, zipPath := range s.branchZips(dir) {
+		fi, err := statArchive(zipPath)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		res := archiveResult(zipPath, s.ShortSHALen)
+		cb := CachedBranch{
+			Branch:       branchFromPath(dir, zipPath),
+			Legacy:       strings.HasSuffix(zipPath, ".legacy.zip"),
+			CommitSHA:    res.CommitSHA,
+			ShortSHA:     res.ShortSHA,
+			Size:         res.Size,
+			LastAccessed: fi.ModTime().UTC(),
+		}
+		if meta, err := readArchiveMetaFile(zipPath); err == nil {
+			if meta.Branch != "" {
+				cb.Branch = meta.Branch
+			}
+			cb.Protected = meta.Protected
+		}
+		if cb.Size == 0 {
+			cb.Size = fi.Size()
+		}
+		if !res.FetchedAt.IsZero() {
+			t := res.FetchedAt.UTC()
+			cb.FetchedAt = &t
+		}
+		out = append(out, cb)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Branch != out[j].Branch {
+			return out[i].Branch < out[j].Branch
+		}
+		return !out[i].Legacy
+	})
+	if remote {
+		s.checkCachedBranches(ctx, ownerRepo, token, out)
+	}
+	return out, nil
+}
+
+// checkCachedBranches fills Stale by resolving each branch upstream.
+func (s *Storage) checkCachedBranches(ctx context.Context, ownerRepo, token string, branches []CachedBranch) {
+	sem := make(chan struct{}, cachedBranchChecks)
+	var wg sync.WaitGroup
+	for i := range branches {
+		cb := &branches[i]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			sha, err := s.fetchBranchSHA(ctx, ownerRepo, cb.Branch, token)
+			var stale bool
+			switch {
+			case errors.Is(err, errBranchMissing):
+				stale = true
+				cb.CheckError = errBranchMissing.Error()
+			case err != nil:
+				cb.CheckError = err.Error()
+				return
+			default:
+				cached := cb.CommitSHA
+				if cached == "" {
+					cached = cb.ShortSHA
+				}
+				if cached == "" {
+					return
+				}
+				stale = !strings.HasPrefix(strings.ToLower(sha), strings.ToLower(cached))
+			}
+			cb.Stale = &stale
+		}()
+	}
+	wg.Wait()
+}
+
+// defaultBranchKey scopes cache entries by token so a private repo's answer
+// is never served to a caller that could not see it.
+func defaultBranchKey(ownerRepo, token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return strings.ToLower(ownerRepo) + "|" + hex.EncodeToString(sum[:8])
+}
+
+func (s *Storage) cachedDefaultBranch(key string) (string, bool) {
+	if s.DefaultBranchTTL <= 0 {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.defaultBranches[key]
+	if !ok || s.Now().After(e.expires) {
+		return "", false
+	}
+	return e.branch, true
+}
+
+func (s *Storage) rememberDefaultBranch(key, branch string) {
+	if s.DefaultBranchTTL <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaultBranches == nil {
+		s.defaultBranches = make(map[string]defaultBranchEntry)
+	}
+	s.defaultBranches[key] = defaultBranchEntry{branch: branch, expires: s.Now().Add(s.DefaultBranchTTL)}
+}
+
+// isRateLimited reports whether resp is GitHub's primary or secondary rate
+// limit response.
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	// Primary limits exhaust X-RateLimit-Remaining; secondary limits carry
+	// Retry-After (doGitHub adds it when only the message says so).
+	return resp.StatusCode == http.StatusForbidden && (resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "")
+}
+
+// normalizeUserRepo applies the same user/owner-repo validation as EnsureRepo.
+// The repo is normalized and takes GitHub's case when it is already known
+// (see CanonicalRepo); GitHub is not asked.
+func (s *Storage) normalizeUserRepo(user, ownerRepo string) (string, string, error) {
+	user = strings.Trim(user, "/ ")
+	if user == "" {
+		user = "default"
+	}
+	if strings.ContainsRune(user, '/') || strings.ContainsRune(user, '\\') {
+		return "", "", fmt.Errorf("invalid user: %w", ErrBadPath)
+	}
+	ownerRepo, err := s.localRepo(ownerRepo)
+	if err != nil {
+		return "", "", err
+	}
+	return sanitizeName(user), ownerRepo, nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BranchLookup picks the GitHub API call that resolves a branch to its
+// head commit (see Storage.BranchLookup).
+type BranchLookup string
+
+const (
+	// BranchLookupRef asks the Git Data API (git/ref/heads/<branch>), whose
+	// answer is a small ref object. A 404 is asked again of the branches
+	// API, which tells a missing repository from a missing branch.
+	BranchLookupRef BranchLookup = "ref"
+	// BranchLookupBranches asks the branches API, whose answer carries the
+	// whole head commit.
+	BranchLookupBranches BranchLookup = "branches"
+)
+
+// ParseBranchLookup parses "ref" or "branches"; "" is BranchLookupRef.
+func ParseBranchLookup(v string) (BranchLookup, error) {
+	switch l := BranchLookup(strings.ToLower(strings.TrimSpace(v))); l {
+	case "", BranchLookupRef:
+		return BranchLookupRef, nil
+	case BranchLookupBranches:
+		return l, nil
+	}
+	return "", fmt.Errorf("branch lookup must be %q or %q, got %q", BranchLookupRef, BranchLookupBranches, v)
+}
+
+// errRefNotFound reports a git ref lookup without an exact match, which
+// fetchBranchSHARemote asks the branches API about instead.
+var errRefNotFound = errors.New("git ref not found")
+
+// refETag is the validator of the last 200 for a branch lookup and the
+// commit it answered.
+type refETag struct {
+	etag string
+	sha  string
+}
+
+func refETagKey(apiURL, token string) string {
+	return apiURL + "|" + tokenKey(token)
+}
+
+// conditional adds the stored ETag of apiURL for token to req, so an
+// unchanged branch answers 304, which GitHub does not count against the
+// rate limit.
+func (s *Storage) conditional(req *http.Request, key string) (refETag, bool) {
+	s.mu.Lock()
+	e, ok := s.refETags[key]
+	s.mu.Unlock()
+	if ok {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	return e, ok
+}
+
+// rememberETag stores the ETag of a 200 that resolved to sha; an answer
+// without one forgets the previous.
+func (s *Storage) rememberETag(key string, resp *http.Response, sha string) {
+	etag := strings.TrimSpace(resp.Header.Get("ETag"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if etag == "" {
+		delete(s.refETags, key)
+		return
+	}
+	if s.refETags == nil {
+		s.refETags = make(map[string]refETag)
+	}
+	s.refETags[key] = refETag{etag: etag, sha: sha}
+}
+
+func (s *Storage) forgetETag(key string) {
+	s.mu.Lock()
+	delete(s.refETags, key)
+	s.mu.Unlock()
+}
+
+// gitRef is a ref object of the Git Data API.
+type gitRef struct {
+	Ref    string `json:"ref"`
+	Object struct {
+		SHA  string `json:"sha"`
+		Type string `json:"type"`
+	} `json:"object"`
+}
+
+// fetchRefSHA resolves branch through git/ref/heads/<branch>. Older API
+// versions and proxies answer a branch name that prefixes others with the
+// list of matching refs (300 or 200 with an array); only the exact ref
+// counts. Without one it fails with errRefNotFound.
+func (s *Storage) fetchRefSHA(ctx context.Context, ownerRepo, branch, token string) (string, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
+	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/git/ref/heads/%s", ownerRepo, escapeRef(branch))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if strings.TrimSpace(token) != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	key := refETagKey(apiURL, token)
+	cached, conditional := s.conditional(req, key)
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && conditional:
+		return cached.sha, nil
+	case resp.StatusCode == http.StatusNotFound:
+		s.forgetETag(key)
+		return "", errRefNotFound
+	case isRateLimited(resp):
+		se, _ := readStatusError("git ref", resp)
+		return "", rateLimitError(resp, se)
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultipleChoices:
+		se, b := readStatusError("git ref", resp)
+		if resp.StatusCode == http.StatusConflict && repoEmpty(b) {
+			return "", emptyRepoError(ownerRepo)
+		}
+		return "", se
+	}
+	var raw json.RawMessage
+	if err := decodeAPI("git ref", resp.Body, &raw); err != nil {
+		return "", err
+	}
+	var refs []gitRef
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &refs); err != nil {
+			return "", err
+		}
+	} else {
+		var ref gitRef
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return "", err
+		}
+		refs = append(refs, ref)
+	}
+	for _, ref := range refs {
+		if ref.Ref != "refs/heads/"+branch {
+			continue
+		}
+		if strings.TrimSpace(ref.Object.SHA) == "" {
+			return "", fmt.Errorf("empty sha")
+		}
+		if resp.StatusCode == http.StatusOK {
+			s.rememberETag(key, resp, ref.Object.SHA)
+		}
+		return ref.Object.SHA, nil
+	}
+	return "", errRefNotFound
+}
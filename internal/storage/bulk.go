@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BulkEntry is one archive matched by DeleteMatching.
+type BulkEntry struct {
+	Path string `json:"path"` // relative to Root, always the logical .zip path
+	Size int64  `json:"size"` // bytes on disk, compressed when stored as .zip.zst
+}
+
+// BulkDelete is the result of DeleteMatching.
+type BulkDelete struct {
+	Pattern    string      `json:"pattern"`
+	DryRun     bool        `json:"dry_run"`
+	Matched    []BulkEntry `json:"matched"`
+	TotalBytes int64       `json:"total_bytes"`
+	// Deleted counts the archives removed; always 0 for a dry run.
+	Deleted int `json:"deleted"`
+}
+
+// cleanPattern validates a DeleteMatching pattern: a relative glob under
+// users/<user>/ or shared/ without . or .. segments, so it cannot reach
+// outside the cache trees.
+func cleanPattern(pattern string) (string, error) {
+	p := strings.TrimSpace(filepath.ToSlash(pattern))
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, `\`) {
+		return "", fmt.Errorf("pattern %q: %w", pattern, ErrBadPath)
+	}
+	parts := strings.Split(p, "/")
+	if len(parts) < 3 || (parts[0] != "users" && parts[0] != SharedDir) {
+		return "", fmt.Errorf("pattern %q must match files under users/<user>/ or shared/: %w", pattern, ErrBadPath)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("pattern %q: %w", pattern, ErrBadPath)
+		}
+	}
+	if _, err := path.Match(p, ""); err != nil {
+		return "", fmt.Errorf("pattern %q: %v: %w", pattern, err, ErrBadPath)
+	}
+	return p, nil
+}
+
+// DeleteMatching removes every cached archive whose path relative to Root
+// matches the glob pattern (path.Match syntax, e.g.
+// users/*/repos/acme/app/feature-*.zip), together with its sidecars. A
+// compressed archive matches by its .zip path. Files that are not archives
+// are never matched. With dryRun nothing is removed and the result lists
+// what would be. Deletes are permanent even with TrashDeletes.
+func (s *Storage) DeleteMatching(pattern string, dryRun bool) (*BulkDelete, error) {
+	p, err := cleanPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Clean(s.Root)
+	glob := filepath.Join(root, filepath.FromSlash(p))
+	var found []string
+	for _, g := range []string{glob, glob + zstSuffix} {
+		m, err := filepath.Glob(g)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v: %w", pattern, err, ErrBadPath)
+		}
+		found = append(found, m...)
+	}
+
+	res := &BulkDelete{Pattern: p, DryRun: dryRun, Matched: []BulkEntry{}}
+	seen := map[string]bool{}
+	var archives []string
+	for _, f := range found {
+		zipPath, ok := archivePath(f)
+		if !ok || seen[zipPath] {
+			continue
+		}
+		rel, err := filepath.Rel(root, zipPath)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if ok, _ := path.Match(p, rel); !ok {
+			continue
+		}
+		fi, err := statArchive(zipPath)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		seen[zipPath] = true
+		archives = append(archives, zipPath)
+		res.Matched = append(res.Matched, BulkEntry{Path: rel, Size: fi.Size()})
+		res.TotalBytes += fi.Size()
+	}
+	sort.Slice(res.Matched, func(i, j int) bool { return res.Matched[i].Path < res.Matched[j].Path })
+	if dryRun {
+		return res, nil
+	}
+	for _, zipPath := range archives {
+		removeArchive(zipPath)
+		s.trimRepoDir(filepath.Dir(zipPath))
+		res.Deleted++
+	}
+	fmt.Printf("bulk delete pattern=%s archives=%d bytes=%d\n", p, res.Deleted, res.TotalBytes)
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNotCached reports that a request made WithOnlyIfCached had no usable
+// cached archive to be served.
+var ErrNotCached = errors.New("not in cache")
+
+type onlyIfCachedKey struct{}
+
+// WithOnlyIfCached makes EnsureRepo calls made with the returned context
+// serve the cached archive without contacting GitHub, or fail with
+// ErrNotCached, like a cache honouring Cache-Control: only-if-cached. A max
+// age set WithMaxAge still applies: older archives are not served. The
+// repository name and, for legacy archives of the default branch, the
+// default branch are taken from what the Storage remembers.
+func WithOnlyIfCached(ctx context.Context) context.Context {
+	return context.WithValue(ctx, onlyIfCachedKey{}, true)
+}
+
+func onlyIfCached(ctx context.Context) bool {
+	b, _ := ctx.Value(onlyIfCachedKey{}).(bool)
+	return b
+}
+
+// cachedOnly serves zipPath for an only-if-cached request that no pin or
+// max age already served.
+func (s *Storage) cachedOnly(ctx context.Context, zipPath, ownerRepo, branch string) (string, error) {
+	if !archiveExists(zipPath) {
+		return "", fmt.Errorf("%s@%s: %w", ownerRepo, branch, ErrNotCached)
+	}
+	if _, err := os.Stat(gonePath(zipPath)); err == nil {
+		return "", fmt.Errorf("%s@%s: branch deleted upstream: %w", ownerRepo, branch, ErrNotCached)
+	}
+	if d := maxAge(ctx); d > 0 {
+		// withinMaxAge turned it down.
+		return "", fmt.Errorf("%s@%s: cached archive is older than %s: %w", ownerRepo, branch, d, ErrNotCached)
+	}
+	fmt.Printf("serving %s without revalidation: only-if-cached\n", zipPath)
+	s.touchServed(ctx, zipPath)
+	s.noteHit(ctx)
+	return zipPath, nil
+}
+
+type noStoreKey struct{}
+
+// noStore receives the archive downloaded for a WithNoStore request.
+type noStore struct {
+	path      string
+	cachePath string
+	commitSHA string
+}
+
+// WithNoStore makes EnsureRepo calls made with the returned context leave
+// the cache as it is, like a cache honouring Cache-Control: no-store: a
+// cached archive that upstream confirms is still served, but an archive
+// that has to be downloaded is handed out as a transient copy (see
+// RepoArchive.Transient) instead of being installed in the cache.
+func WithNoStore(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noStoreKey{}, &noStore{})
+}
+
+func noStoreOf(ctx context.Context) *noStore {
+	ns, _ := ctx.Value(noStoreKey{}).(*noStore)
+	return ns
+}
+
+// keepTransient hands tmpPath, downloaded at commitSHA, to a no-store
+// caller instead of installing it as zipPath.
+func (ns *noStore) keepTransient(tmpPath, zipPath, commitSHA string) string {
+	fmt.Printf("no-store: serving %s without caching it\n", zipPath)
+	ns.path, ns.cachePath, ns.commitSHA = tmpPath, zipPath, commitSHA
+	return tmpPath
+}
+
+// transientResult describes the archive a no-store request downloaded.
+func (s *Storage) transientResult(ns *noStore) *RepoArchive {
+	res := &RepoArchive{
+		Path:      ns.path,
+		CachePath: ns.cachePath,
+		CommitSHA: ns.commitSHA,
+		ShortSHA:  abbrevSHA(ns.commitSHA, s.ShortSHALen),
+		FetchedAt: s.Now(),
+		Outcome:   CacheMiss,
+		Transient: true,
+	}
+	if info, err := os.Stat(ns.path); err == nil {
+		res.Size = info.Size()
+	}
+	return res
+}
+
+// Discard removes a transient archive and any repack made of it. It does
+// nothing for cached archives.
+func (r *RepoArchive) Discard() {
+	if r == nil || !r.Transient {
+		return
+	}
+	_ = os.Remove(r.Path)
+	removeNormalized(r.Path)
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCooldown  = 30 * time.Second
+)
+
+// CircuitOpenError is returned for a GitHub call refused without being sent
+// because the upstream circuit is open (see Storage.CircuitThreshold). It
+// is an ErrUpstreamUnavailable, so EnsureRepo applies the stale policy to
+// it like to any other unreachable upstream.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+	LastError  string
+}
+
+func (e *CircuitOpenError) Error() string {
+	msg := ErrUpstreamUnavailable.Error() + " (circuit open"
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf("; retry after %s", e.RetryAfter.Round(time.Second))
+	}
+	msg += ")"
+	if e.LastError != "" {
+		msg += ": " + e.LastError
+	}
+	return msg
+}
+
+func (e *CircuitOpenError) Unwrap() error { return ErrUpstreamUnavailable }
+
+// CircuitStatus is the state of the upstream circuit.
+type CircuitStatus struct {
+	State BreakerState `json:"state"`
+	// Threshold is the consecutive failures that open the circuit, 0 when
+	// it is disabled; Cooldown how long it stays open, in seconds.
+	Threshold           int     `json:"threshold"`
+	Cooldown            float64 `json:"cooldown_seconds"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	// Failures and Successes count GitHub calls since startup, Rejected the
+	// calls refused while the circuit was open, Trips how often it opened.
+	Failures      int64      `json:"failures"`
+	Successes     int64      `json:"successes"`
+	Rejected      int64      `json:"rejected"`
+	Trips         int64      `json:"trips"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+	// OpenedAt is when the circuit last opened; RetryAt, while it is open,
+	// when the next call is let through as a probe.
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+// upstreamCircuit counts consecutive GitHub failures (no answer, or a 5xx)
+// across every token and call site. Unlike the per-token rate limit
+// breaker it tracks whether GitHub is reachable at all.
+type upstreamCircuit struct {
+	mu          sync.Mutex
+	consecutive int
+	open        bool // tripped and not yet closed by a successful probe
+	openUntil   time.Time
+	probing     bool
+	failures    int64
+	successes   int64
+	rejected    int64
+	trips       int64
+	lastErr     string
+	lastFailure time.Time
+	openedAt    time.Time
+}
+
+func (c *upstreamCircuit) state(now time.Time) BreakerState {
+	switch {
+	case !c.open:
+		return BreakerClosed
+	case now.Before(c.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+func (s *Storage) circuitThreshold() int {
+	if s.CircuitThreshold < 0 {
+		return 0
+	}
+	if s.CircuitThreshold == 0 {
+		return defaultCircuitThreshold
+	}
+	return s.CircuitThreshold
+}
+
+func (s *Storage) circuitCooldown() time.Duration {
+	if s.CircuitCooldown <= 0 {
+		return defaultCircuitCooldown
+	}
+	return s.CircuitCooldown
+}
+
+// circuitAdmit applies the circuit before a GitHub call. probe reports
+// that the call is the half-open probe, whose outcome closes or reopens
+// the circuit; every admitted call must be settled with circuitSettle.
+func (s *Storage) circuitAdmit() (probe bool, err error) {
+	if s.circuitThreshold() == 0 {
+		return false, nil
+	}
+	c := &s.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := s.Now()
+	switch c.state(now) {
+	case BreakerOpen:
+		c.rejected++
+		return false, &CircuitOpenError{RetryAfter: c.openUntil.Sub(now), LastError: c.lastErr}
+	case BreakerHalfOpen:
+		if c.probing {
+			c.rejected++
+			return false, &CircuitOpenError{LastError: c.lastErr}
+		}
+		c.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// circuitSettle records the outcome of an admitted GitHub call: err is nil
+// when GitHub answered (any status below 500, rate limits included).
+// Calls the caller gave up on say nothing about GitHub and are not counted.
+func (s *Storage) circuitSettle(ctx context.Context, probe bool, err error) {
+	if s.circuitThreshold() == 0 {
+		return
+	}
+	c := &s.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if probe {
+		c.probing = false
+	}
+	if err != nil && ((ctx.Err() != nil && !apiTimedOut(ctx)) || errors.Is(err, context.Canceled)) {
+		return
+	}
+	now := s.Now()
+	if err == nil {
+		c.successes++
+		c.consecutive = 0
+		if c.open {
+			fmt.Printf("upstream circuit closed after %s\n", now.Sub(c.openedAt).Round(time.Second))
+		}
+		c.open = false
+		return
+	}
+	c.failures++
+	c.consecutive++
+	c.lastErr, c.lastFailure = err.Error(), now
+	if probe || (!c.open && c.consecutive >= s.circuitThreshold()) {
+		if !c.open {
+			c.trips++
+			c.openedAt = now
+		}
+		c.open = true
+		c.openUntil = now.Add(s.circuitCooldown())
+		fmt.Printf("upstream circuit open for %s after %d consecutive failures: %v\n", s.circuitCooldown(), c.consecutive, err)
+	}
+}
+
+// UpstreamCircuit reports the state of the upstream circuit, counters and
+// last failure included.
+func (s *Storage) UpstreamCircuit() CircuitStatus {
+	c := &s.circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := s.Now()
+	st := CircuitStatus{
+		State:               c.state(now),
+		Threshold:           s.circuitThreshold(),
+		Cooldown:            s.circuitCooldown().Seconds(),
+		ConsecutiveFailures: c.consecutive,
+		Failures:            c.failures,
+		Successes:           c.successes,
+		Rejected:            c.rejected,
+		Trips:               c.trips,
+		LastError:           c.lastErr,
+	}
+	if !c.lastFailure.IsZero() {
+		t := c.lastFailure.UTC()
+		st.LastFailureAt = &t
+	}
+	if !c.openedAt.IsZero() {
+		t := c.openedAt.UTC()
+		st.OpenedAt = &t
+	}
+	if st.State == BreakerOpen {
+		t := c.openUntil.UTC()
+		st.RetryAt = &t
+	}
+	return st
+}
+
+// CircuitOpen reports whether the upstream circuit is open or half-open.
+func (s *Storage) CircuitOpen() bool {
+	return s.UpstreamCircuit().State != BreakerClosed
+}
+
+// runGitRemote runs a git command that talks to GitHub under the upstream
+// circuit. Failures git reports as GitHub's answer (a missing repository,
+// refused credentials) count as GitHub having answered.
+func (s *Storage) runGitRemote(ctx context.Context, cmd *exec.Cmd, stderr *gitStderr) error {
+	probe, err := s.circuitAdmit()
+	if err != nil {
+		return err
+	}
+	err = cmd.Run()
+	var failure error
+	if err != nil && errors.Is(gitFailure("git", "", "", stderr.buf.Bytes(), err), ErrUpstreamUnavailable) {
+		failure = err
+	}
+	s.circuitSettle(ctx, probe, failure)
+	return err
+}
@@ -0,0 +1,22 @@
+package storage
+
+import "time"
+
+// Clock tells the time. Storage reads it for cache TTLs, cleanup cutoffs,
+// access times and fetched-at stamps, so tests can move time forward
+// instead of sleeping or rewriting mtimes.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Now is the current time by Clock; a nil Clock is the real one.
+func (s *Storage) Now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCommitsLimit caps how many commits ListCommits returns.
+const MaxCommitsLimit = 500
+
+const commitsPerPage = 100
+
+var shortSHA = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// CommitEntry is one line of a commit log.
+type CommitEntry struct {
+	SHA     string    `json:"sha"`
+	Short   string    `json:"short"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"` // first line only
+}
+
+type commitsEntry struct {
+	commits []CommitEntry
+	expires time.Time
+}
+
+// ListCommits returns up to limit commits reachable from ref, newest first,
+// via the paginated GitHub commits API. With sinceSHA it stops before that
+// commit, so the result is what changed since it. An empty ref lists the
+// default branch. Results are cached for CommitsTTL.
+func (s *Storage) ListCommits(ctx context.Context, ownerRepo, ref, sinceSHA string, limit int, token string) ([]CommitEntry, error) {
+	ownerRepo, err := s.localRepo(ownerRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	ref = strings.TrimSpace(ref)
+	if err := ValidateRef(ref); err != nil {
+		return nil, err
+	}
+	sinceSHA = strings.ToLower(strings.TrimSpace(sinceSHA))
+	if sinceSHA != "" && !shortSHA.MatchString(sinceSHA) {
+		return nil, fmt.Errorf("invalid since %q: %w", sinceSHA, ErrBadPath)
+	}
+	if limit <= 0 || limit > MaxCommitsLimit {
+		limit = MaxCommitsLimit
+	}
+	if ref == "" {
+		def, err := s.fetchDefaultBranch(ctx, ownerRepo, token)
+		if err != nil {
+			return nil, fmt.Errorf("fetch default branch: %w", err)
+		}
+		ref = def
+	}
+
+	key := fmt.Sprintf("%s|%s|%s|%d", defaultBranchKey(ownerRepo, token), ref, sinceSHA, limit)
+	if commits, ok := s.cachedCommits(key); ok {
+		return commits, nil
+	}
+	commits, err := s.fetchCommits(ctx, ownerRepo, ref, sinceSHA, limit, token)
+	if err != nil {
+		return nil, err
+	}
+	s.rememberCommits(key, commits)
+	return commits, nil
+}
+
+func (s *Storage) fetchCommits(ctx context.Context, ownerRepo, ref, sinceSHA string, limit int, token string) ([]CommitEntry, error) {
+	perPage := commitsPerPage
+	if limit < perPage {
+		perPage = limit
+	}
+	out := make([]CommitEntry, 0, perPage)
+	for page := 1; ; page++ {
+		q := url.Values{"sha": {ref}, "per_page": {strconv.Itoa(perPage)}, "page": {strconv.Itoa(page)}}
+		apiURL := fmt.Sprintf("https://api.github.com/repos/%s/commits?%s", ownerRepo, q.Encode())
+		batch, err := s.fetchCommitPage(ctx, apiURL, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range batch {
+			if sinceSHA != "" && strings.HasPrefix(strings.ToLower(c.SHA), sinceSHA) {
+				return out, nil
+			}
+			out = append(out, c)
+			if len(out) >= limit {
+				return out, nil
+			}
+		}
+		if len(batch) < perPage {
+			return out, nil
+		}
+	}
+}
+
+func (s *Storage) fetchCommitPage(ctx context.Context, apiURL, token string) ([]CommitEntry, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if strings.TrimSpace(token) != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case isRateLimited(resp):
+		return nil, rateLimitError(resp, fmt.Errorf("list commits: status=%d", resp.StatusCode))
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity:
+		return nil, fmt.Errorf("list commits: repo or ref %w", ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		se, _ := readStatusError("github api", resp)
+		return nil, se
+	}
+	var raw []struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Message string `json:"message"`
+			Author  struct {
+				Name string    `json:"name"`
+				Date time.Time `json:"date"`
+			} `json:"author"`
+		} `json:"commit"`
+		Author *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}
+	if err := decodeAPI("list commits", resp.Body, &raw); err != nil {
+		return nil, err
+	}
+	out := make([]CommitEntry, 0, len(raw))
+	for _, r := range raw {
+		author := r.Commit.Author.Name
+		if r.Author != nil && r.Author.Login != "" {
+			author = r.Author.Login
+		}
+		msg, _, _ := strings.Cut(r.Commit.Message, "\n")
+		short := r.SHA
+		if len(short) > 7 {
+			short = short[:7]
+		}
+		out = append(out, CommitEntry{SHA: r.SHA, Short: short, Author: author, Date: r.Commit.Author.Date, Message: strings.TrimSpace(msg)})
+	}
+	return out, nil
+}
+
+func (s *Storage) cachedCommits(key string) ([]CommitEntry, bool) {
+	if s.CommitsTTL <= 0 {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.commits[key]
+	if !ok || s.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.commits, true
+}
+
+func (s *Storage) rememberCommits(key string, commits []CommitEntry) {
+	if s.CommitsTTL <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commits == nil {
+		s.commits = make(map[string]commitsEntry)
+	}
+	now := s.Now()
+	for k, e := range s.commits {
+		if now.After(e.expires) {
+			delete(s.commits, k)
+		}
+	}
+	s.commits[key] = commitsEntry{commits: commits, expires: now.Add(s.CommitsTTL)}
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github-hub/internal/zstd"
+)
+
+// CompressionZstd is the ArchiveMeta.Compression of archives stored as
+// <branch>.zip.zst.
+const CompressionZstd = "zstd"
+
+// zstSuffix is appended to an archive's path when it is stored compressed.
+// The uncompressed path stays its identity: sidecars, EnsureRepo results,
+// stats and retained-archive names all use <branch>.zip.
+const zstSuffix = ".zst"
+
+// storedPath returns the file holding zipPath's bytes: the compressed
+// variant when there is one, otherwise zipPath itself.
+func storedPath(zipPath string) string {
+	if fi, err := os.Stat(zipPath + zstSuffix); err == nil && !fi.IsDir() {
+		return zipPath + zstSuffix
+	}
+	return zipPath
+}
+
+func statArchive(zipPath string) (os.FileInfo, error) {
+	return os.Stat(storedPath(zipPath))
+}
+
+// archivePath maps a file name found in a repo directory to the archive
+// path it stores, accepting both <name>.zip and <name>.zip.zst.
+func archivePath(path string) (string, bool) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	path = strings.TrimSuffix(path, zstSuffix)
+	return path, strings.HasSuffix(path, ".zip")
+}
+
+// installArchive moves a freshly written archive from tmpPath to zipPath,
+// compressing it on the way when CompressArchives is set and encrypting it
+// when Keys is set, and removes the other variant so exactly one copy is on
+// disk. The caller removes tmpPath on error.
+func (s *Storage) installArchive(tmpPath, zipPath string) error {
+	if !s.CompressArchives && s.Keys == nil {
+		_ = os.Remove(zipPath + zstSuffix)
+		return s.replaceFile(tmpPath, zipPath)
+	}
+	dst, other := zipPath, zipPath+zstSuffix
+	if s.CompressArchives {
+		dst, other = other, dst
+	}
+	stored, err := s.storeBeside(tmpPath, dst, s.CompressArchives)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(stored, dst); err != nil {
+		_ = os.Remove(stored)
+		return err
+	}
+	_ = os.Remove(tmpPath)
+	_ = os.Remove(other)
+	return nil
+}
+
+// storeBeside writes src the way it is stored, zstd-compressed when
+// compress is set and then encrypted when Keys is set, to a synced temp
+// file in dst's directory and returns its path.
+func (s *Storage) storeBeside(src, dst string, compress bool) (string, error) {
+	if !compress {
+		return s.sealBeside(src, dst)
+	}
+	zst, err := compressBeside(src, dst)
+	if err != nil || s.Keys == nil {
+		return zst, err
+	}
+	defer func() { _ = os.Remove(zst) }()
+	return s.sealBeside(zst, dst)
+}
+
+// compressBeside writes a zstd-compressed copy of src to a synced temp file
+// in dst's directory and returns its path.
+func compressBeside(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-compress-*.zst")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	zw := zstd.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("compress %s: %w", src, err)
+	}
+	return tmp, nil
+}
+
+// moveArchive renames the stored variant of src to dst, keeping its
+// compression.
+func (s *Storage) moveArchive(src, dst string) error {
+	from := storedPath(src)
+	to := dst + strings.TrimPrefix(from, src)
+	if err := s.replaceFile(from, to); err != nil {
+		return err
+	}
+	if to == dst {
+		_ = os.Remove(dst + zstSuffix)
+	} else {
+		_ = os.Remove(dst)
+	}
+	return nil
+}
+
+// removeStored deletes both variants of an archive.
+func removeStored(zipPath string) {
+	_ = os.Remove(zipPath)
+	_ = os.Remove(zipPath + zstSuffix)
+}
+
+// storedInfo fills meta's compression and encryption fields from the file
+// on disk.
+func storedInfo(zipPath string, meta *ArchiveMeta) {
+	meta.Compression, meta.Encryption, meta.KeyID, meta.StoredSize = "", "", "", 0
+	p := storedPath(zipPath)
+	if p != zipPath {
+		meta.Compression = CompressionZstd
+	}
+	if h := sealInfo(p); h != nil {
+		meta.Encryption, meta.KeyID = EncryptionAES256GCM, h.keyID
+	}
+	if meta.Compression == "" && meta.Encryption == "" {
+		return
+	}
+	if fi, err := os.Stat(p); err == nil {
+		meta.StoredSize = fi.Size()
+	}
+}
+
+// archiveReader is an open compressed or encrypted archive.
+type archiveReader struct {
+	io.Reader
+	f    *os.File
+	size int64
+}
+
+func (a *archiveReader) Close() error { return a.f.Close() }
+
+// Size is the number of bytes the reader returns, or -1 when that is only
+// known from the archive's metadata.
+func (a *archiveReader) Size() int64 { return a.size }
+
+// OpenArchive opens a cached archive for reading its plain bytes. A plain
+// archive is returned as its *os.File so callers can still hand it to
+// http.ServeContent; a compressed or encrypted one is decoded as it is read.
+// It opens cached packages the same way.
+func (s *Storage) OpenArchive(zipPath string) (io.ReadCloser, error) {
+	return s.openArchive(zipPath)
+}
+
+func (s *Storage) openArchive(zipPath string) (io.ReadCloser, error) {
+	p := storedPath(zipPath)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	r, size, err := s.unseal(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if p != zipPath {
+		return &archiveReader{Reader: zstd.NewReader(r), f: f, size: -1}, nil
+	}
+	if size >= 0 {
+		return &archiveReader{Reader: r, f: f, size: size}, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// RawArchive returns a path holding zipPath's plain bytes for callers that
+// need a plain file. For a compressed or encrypted archive (or package)
+// that is a decoded temp copy, which the returned func removes; otherwise
+// it is zipPath itself and the func does nothing. The copy goes where a
+// download into zipPath's directory would (see TempDir), never to the OS
+// temp directory, under the same free-space checks, and is named like
+// other temp files so cleanup removes it if the process dies first.
+func (s *Storage) RawArchive(zipPath string) (string, func(), error) {
+	p := storedPath(zipPath)
+	if p == zipPath && sealInfo(p) == nil {
+		if _, err := os.Stat(zipPath); err != nil {
+			return "", nil, err
+		}
+		return zipPath, func() {}, nil
+	}
+	in, err := s.openArchive(zipPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() { _ = in.Close() }()
+	dir, err := s.tempDirFor(filepath.Dir(zipPath))
+	if err != nil {
+		return "", nil, err
+	}
+	var size int64
+	if meta, err := readArchiveMetaFile(zipPath); err == nil {
+		size = meta.Size
+	}
+	if err := s.checkSpace(dir, size); err != nil {
+		return "", nil, fmt.Errorf("decode %s: %w", zipPath, err)
+	}
+	out, err := os.CreateTemp(dir, tempPrefix+"raw-*.zip")
+	if err != nil {
+		return "", nil, err
+	}
+	tmp := out.Name()
+	_, err = io.Copy(&spaceGuard{w: out, s: s, dir: dir}, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", nil, fmt.Errorf("decode %s: %w", zipPath, err)
+	}
+	return tmp, func() { _ = os.Remove(tmp) }, nil
+}
+
+// ArchiveExists reports whether zipPath is cached, compressed or not.
+func ArchiveExists(zipPath string) bool {
+	return archiveExists(zipPath)
+}
+
+// hashArchive returns the SHA-256 and size of an archive's plain bytes.
+func (s *Storage) hashArchive(zipPath string) (string, int64, error) {
+	f, err := s.openArchive(zipPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github-hub/internal/zstd"
+)
+
+// consistencyGrace is how old a file must be before the consistency pass
+// touches it: a download writes its archive and sidecars one after the
+// other, and a move to trash or history does the same.
+const consistencyGrace = 5 * time.Minute
+
+// ConsistencyReport lists what a consistency pass found under Root, as
+// paths relative to it. In a dry run nothing is changed and the lists are
+// what the pass would have done.
+type ConsistencyReport struct {
+	DryRun bool `json:"dry_run"`
+	// OrphanSidecars are sidecars whose archive is gone and package
+	// directories holding only their metadata; deleted.
+	OrphanSidecars []string `json:"orphan_sidecars"`
+	// Regenerated are archives without a .meta.json that got one recorded
+	// from the commit in their .meta.
+	Regenerated []string `json:"regenerated"`
+	// Unverified are archives without any record of their commit. They get
+	// a .meta.json without one, so the next download revalidates them.
+	Unverified []string `json:"unverified"`
+	// Broken are zero-byte or unreadable archives; deleted with their
+	// sidecars.
+	Broken []string `json:"broken"`
+	// Unexpected are files and directories that do not fit the cache
+	// layout; only reported.
+	Unexpected []string `json:"unexpected"`
+}
+
+// Repairs is how many problems the pass repaired, or would have.
+func (r *ConsistencyReport) Repairs() int {
+	return len(r.OrphanSidecars) + len(r.Regenerated) + len(r.Unverified) + len(r.Broken)
+}
+
+// CheckConsistency walks the repo and package trees of both layouts and
+// repairs what no download or cleanup rule would: sidecars left without
+// their archive are deleted, archives without metadata get it recorded
+// (unverified when their commit is unknown), zero-byte and unreadable
+// archives are deleted, and anything that does not fit the layout is
+// reported. Files changed in the last few minutes are skipped, as they may
+// belong to a download in progress. With dryRun nothing is changed.
+// Encrypted archives are only checked for being empty, since their key may
+// not be loaded.
+func (s *Storage) CheckConsistency(dryRun bool) (*ConsistencyReport, error) {
+	c := &consistencyPass{s: s, dryRun: dryRun, cutoff: s.Now().Add(-consistencyGrace), report: &ConsistencyReport{DryRun: dryRun}}
+	users, err := os.ReadDir(filepath.Join(s.Root, "users"))
+	if err != nil && !os.IsNotExist(err) {
+		return c.report, err
+	}
+	for _, u := range users {
+		dir := filepath.Join(s.Root, "users", u.Name())
+		if strings.HasPrefix(u.Name(), ".") {
+			continue
+		}
+		if !u.IsDir() {
+			c.unexpected(dir)
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return c.report, err
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			switch {
+			case strings.HasPrefix(e.Name(), "."):
+			case e.IsDir() && e.Name() == "repos":
+				c.reposTree(p)
+			case e.IsDir() && e.Name() == "packages":
+				c.packagesTree(p)
+			default:
+				c.unexpected(p)
+			}
+		}
+	}
+	c.reposTree(filepath.Join(s.Root, SharedDir, "repos"))
+	r := c.report
+	for _, l := range [][]string{r.OrphanSidecars, r.Regenerated, r.Unverified, r.Broken, r.Unexpected} {
+		sort.Strings(l)
+	}
+	return r, nil
+}
+
+type consistencyPass struct {
+	s      *Storage
+	dryRun bool
+	cutoff time.Time
+	report *ConsistencyReport
+}
+
+func (c *consistencyPass) rel(p string) string {
+	rel, err := filepath.Rel(c.s.Root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (c *consistencyPass) unexpected(p string) {
+	c.report.Unexpected = append(c.report.Unexpected, c.rel(p))
+}
+
+// settled reports whether p was last changed before the grace period.
+func (c *consistencyPass) settled(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.ModTime().Before(c.cutoff)
+}
+
+// reposTree checks repos/<owner>/<repo>/ directories.
+func (c *consistencyPass) reposTree(root string) {
+	owners, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, o := range owners {
+		ownerDir := filepath.Join(root, o.Name())
+		if strings.HasPrefix(o.Name(), ".") {
+			continue
+		}
+		if !o.IsDir() {
+			c.unexpected(ownerDir)
+			continue
+		}
+		repos, err := os.ReadDir(ownerDir)
+		if err != nil {
+			continue
+		}
+		for _, r := range repos {
+			repoDir := filepath.Join(ownerDir, r.Name())
+			switch {
+			case strings.HasPrefix(r.Name(), "."):
+			case !r.IsDir():
+				c.unexpected(repoDir)
+			default:
+				c.repoDir(repoDir)
+			}
+		}
+	}
+}
+
+// repoDir checks the archives of one repository, including those of
+// branches with slashes in subdirectories.
+func (c *consistencyPass) repoDir(dir string) {
+	var files []string
+	_ = filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	archives := make(map[string]bool)
+	retained := make(map[string]bool)
+	for _, p := range files {
+		if zipPath, ok := archivePath(p); ok {
+			archives[zipPath] = true
+		}
+	}
+	for zipPath := range archives {
+		if meta, err := readArchiveMetaFile(zipPath); err == nil {
+			for _, h := range meta.Previous {
+				retained[filepath.Join(filepath.Dir(zipPath), h.File)] = true
+			}
+		}
+	}
+	for _, p := range files {
+		if _, ok := archivePath(p); ok {
+			continue
+		}
+		zipPath, ok := sidecarArchive(p)
+		switch {
+		case !ok && filepath.Base(p) == releaseMapName && filepath.Dir(p) == dir:
+		case !ok:
+			c.unexpected(p)
+		case !archives[zipPath] && c.settled(p):
+			c.report.OrphanSidecars = append(c.report.OrphanSidecars, c.rel(p))
+			if !c.dryRun {
+				_ = os.Remove(p)
+				c.s.trimRepoDir(filepath.Dir(p))
+			}
+		}
+	}
+	ownerRepo := filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir)
+	for zipPath := range archives {
+		c.archive(dir, ownerRepo, zipPath, retained[zipPath])
+	}
+}
+
+// archive checks one archive of ownerRepo, cached in dir; retained ones
+// keep their metadata in the current archive's sidecar.
+func (c *consistencyPass) archive(dir, ownerRepo, zipPath string, retained bool) {
+	stored := storedPath(zipPath)
+	if !c.settled(stored) {
+		return
+	}
+	if !c.s.archiveReadable(zipPath) {
+		c.report.Broken = append(c.report.Broken, c.rel(stored))
+		if !c.dryRun {
+			meta, _ := readArchiveMetaFile(zipPath)
+			fmt.Printf("consistency: removing unreadable archive %s\n", stored)
+			removeArchive(zipPath)
+			c.s.trimRepoDir(filepath.Dir(zipPath))
+			c.s.emitEvicted(zipPath, meta, "broken")
+		}
+		return
+	}
+	if retained {
+		return
+	}
+	if _, err := readArchiveMetaFile(zipPath); !errors.Is(err, ErrNotFound) {
+		return
+	}
+	sha, _ := readSHA(zipPath + ".meta")
+	if sha != "" {
+		c.report.Regenerated = append(c.report.Regenerated, c.rel(zipPath))
+	} else {
+		c.report.Unverified = append(c.report.Unverified, c.rel(zipPath))
+	}
+	if c.dryRun {
+		return
+	}
+	fi, err := os.Stat(stored)
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(dir, zipPath)
+	if err != nil {
+		return
+	}
+	branch := strings.TrimSuffix(strings.TrimSuffix(filepath.ToSlash(rel), ".zip"), ".legacy")
+	if _, err := c.s.recordArchiveAt(zipPath, ownerRepo, branch, sha, fi.ModTime()); err != nil {
+		fmt.Printf("consistency: record metadata for %s: %v\n", zipPath, err)
+	}
+}
+
+// packagesTree checks packages/<hash>/ directories: one holding nothing
+// but its metadata lost its package.
+func (c *consistencyPass) packagesTree(root string) {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		dir := filepath.Join(root, d.Name())
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		if !d.IsDir() {
+			c.unexpected(dir)
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		hasMeta, hasFile := false, false
+		for _, e := range entries {
+			switch {
+			case e.Name() == packageMetaName:
+				hasMeta = true
+			case !strings.HasPrefix(e.Name(), "."):
+				hasFile = true
+			}
+		}
+		metaPath := filepath.Join(dir, packageMetaName)
+		if hasMeta && !hasFile && c.settled(metaPath) {
+			c.report.OrphanSidecars = append(c.report.OrphanSidecars, c.rel(metaPath))
+			if !c.dryRun {
+				_ = os.Remove(metaPath)
+				trimEmpty(dir, filepath.Join(c.s.Root, "users"))
+			}
+		}
+	}
+}
+
+// sidecarArchive maps a sidecar file to the archive it belongs to.
+func sidecarArchive(p string) (string, bool) {
+	if base, ok := strings.CutSuffix(p, ".zip.meta"); ok {
+		return base + ".zip", true
+	}
+	for _, suffix := range []string{".meta.json", ".info.json", ".manifest.json", ".segments.json", ".commit.txt", ".gone"} {
+		if base, ok := strings.CutSuffix(p, suffix); ok {
+			return base + ".zip", true
+		}
+	}
+	// Normalized repacks: <branch>.zip.normalized[-mode] and their
+	// <branch>.normalized[-mode].json.
+	if i := strings.LastIndex(p, ".zip.normalized"); i >= 0 {
+		return p[:i+len(".zip")], true
+	}
+	if i := strings.LastIndex(p, ".normalized"); i >= 0 && strings.HasSuffix(p, ".json") {
+		return p[:i] + ".zip", true
+	}
+	return "", false
+}
+
+// archiveReadable reports whether zipPath is a non-empty archive whose zip
+// directory can be read. Compressed archives are decoded far enough to
+// find the zip signature; encrypted ones are only checked for size.
+func (s *Storage) archiveReadable(zipPath string) bool {
+	stored := storedPath(zipPath)
+	fi, err := os.Stat(stored)
+	if err != nil || fi.Size() == 0 {
+		return false
+	}
+	switch {
+	case sealInfo(stored) != nil:
+		return true
+	case stored != zipPath:
+		f, err := os.Open(stored)
+		if err != nil {
+			return false
+		}
+		defer func() { _ = f.Close() }()
+		var sig [2]byte
+		_, err = io.ReadFull(zstd.NewReader(f), sig[:])
+		return err == nil && string(sig[:]) == "PK"
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return false
+	}
+	_ = zr.Close()
+	return true
+}
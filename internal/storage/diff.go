@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	// diffContext is how many unchanged lines surround each hunk.
+	diffContext = 3
+	// maxDiffEdits bounds the edit distance searched per file; files
+	// further apart are diffed as one hunk replacing every line.
+	maxDiffEdits = 1000
+	// maxDiffFileBytes is the largest file diffed line by line; bigger
+	// ones are reported like binary files.
+	maxDiffFileBytes = 16 << 20
+	// binarySniffBytes is how much of a file is searched for a NUL byte
+	// to tell binary files, as git does.
+	binarySniffBytes = 8000
+)
+
+// errDiffTooLarge is returned by capWriter once the diff outgrows it.
+var errDiffTooLarge = errors.New("diff too large")
+
+// capWriter buffers at most max bytes.
+type capWriter struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if c.max > 0 && int64(c.buf.Len()+len(p)) > c.max {
+		return 0, errDiffTooLarge
+	}
+	return c.buf.Write(p)
+}
+
+// zipTree maps the files of an archive to their entries, keyed by path
+// below the archive's root folder.
+func zipTree(zr *zip.Reader) map[string]*zip.File {
+	root := ""
+	for i, f := range zr.File {
+		top, _, ok := strings.Cut(f.Name, "/")
+		if !ok || (i > 0 && top+"/" != root) {
+			root = ""
+			break
+		}
+		root = top + "/"
+	}
+	out := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		out[strings.TrimPrefix(f.Name, root)] = f
+	}
+	return out
+}
+
+// diffArchives writes the git-style unified diff turning the files of zip
+// a into those of zip b to w. Paths are relative to each archive's root
+// folder, which differs between commits.
+func diffArchives(w io.Writer, a, b *zip.Reader) error {
+	ta, tb := zipTree(a), zipTree(b)
+	paths := make([]string, 0, len(ta)+len(tb))
+	for p := range ta {
+		paths = append(paths, p)
+	}
+	for p := range tb {
+		if _, ok := ta[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fa, fb := ta[p], tb[p]
+		if fa != nil && fb != nil && fa.CRC32 == fb.CRC32 && fa.UncompressedSize64 == fb.UncompressedSize64 && fileMode(fa) == fileMode(fb) {
+			continue
+		}
+		if err := diffFile(w, p, fa, fb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileMode(f *zip.File) string {
+	if f.Mode()&0o111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+// diffFile writes the diff of one path; a nil entry is a missing side.
+func diffFile(w io.Writer, path string, fa, fb *zip.File) error {
+	da, err := readEntry(fa)
+	if err != nil {
+		return err
+	}
+	db, err := readEntry(fb)
+	if err != nil {
+		return err
+	}
+	from, to := "a/"+path, "b/"+path
+	var hdr strings.Builder
+	fmt.Fprintf(&hdr, "diff --git a/%s b/%s\n", path, path)
+	switch {
+	case fa == nil:
+		fmt.Fprintf(&hdr, "new file mode %s\n", fileMode(fb))
+		from = "/dev/null"
+	case fb == nil:
+		fmt.Fprintf(&hdr, "deleted file mode %s\n", fileMode(fa))
+		to = "/dev/null"
+	case fileMode(fa) != fileMode(fb):
+		fmt.Fprintf(&hdr, "old mode %s\nnew mode %s\n", fileMode(fa), fileMode(fb))
+	}
+	// Same content: a mode change, or an empty file added or removed.
+	if bytes.Equal(da, db) {
+		_, err := io.WriteString(w, hdr.String())
+		return err
+	}
+	if isBinary(da) || isBinary(db) {
+		fmt.Fprintf(&hdr, "Binary files %s and %s differ\n", from, to)
+		_, err := io.WriteString(w, hdr.String())
+		return err
+	}
+	fmt.Fprintf(&hdr, "--- %s\n+++ %s\n", from, to)
+	if _, err := io.WriteString(w, hdr.String()); err != nil {
+		return err
+	}
+	return writeHunks(w, splitLines(da), splitLines(db))
+}
+
+// readEntry reads a file of at most maxDiffFileBytes; larger files read as
+// a NUL byte so they are reported like binary ones.
+func readEntry(f *zip.File) ([]byte, error) {
+	if f == nil {
+		return nil, nil
+	}
+	if f.UncompressedSize64 > maxDiffFileBytes {
+		return []byte{0}, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	return io.ReadAll(io.LimitReader(rc, maxDiffFileBytes))
+}
+
+func isBinary(b []byte) bool {
+	return bytes.IndexByte(b[:min(len(b), binarySniffBytes)], 0) >= 0
+}
+
+// splitLines splits b into lines that keep their "\n", so a last line
+// without one differs from the same line with it.
+func splitLines(b []byte) []string {
+	var out []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		out = append(out, string(b[:i]))
+		b = b[i:]
+	}
+	return out
+}
+
+// edit is one line of an edit script: ' ' kept, '-' removed from a, '+'
+// added from b.
+type edit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the edit script turning a into b, shortest by Myers'
+// algorithm unless the files are more than maxDiffEdits apart.
+func diffLines(a, b []string) []edit {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	out := make([]edit, 0, len(a)+len(b))
+	for _, l := range a[:pre] {
+		out = append(out, edit{' ', l})
+	}
+	out = append(out, myers(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		out = append(out, edit{' ', l})
+	}
+	return out
+}
+
+// myers finds a shortest edit script between a and b. It keeps the
+// frontier of every round for the backtrack, so the search stops after
+// maxDiffEdits rounds and replaces a with b wholesale instead.
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	replace := func() []edit {
+		out := make([]edit, 0, n+m)
+		for _, l := range a {
+			out = append(out, edit{'-', l})
+		}
+		for _, l := range b {
+			out = append(out, edit{'+', l})
+		}
+		return out
+	}
+	if n == 0 || m == 0 {
+		return replace()
+	}
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	// trace[d] holds v[k] for k in [-d-1, d+1] as it was before round d.
+	var trace [][]int
+	for d := 0; ; d++ {
+		if d > maxDiffEdits {
+			return replace()
+		}
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+}
+
+// backtrack walks the trace of myers back from the end of a and b.
+func backtrack(a, b []string, trace [][]int) []edit {
+	get := func(d, k int) int { return trace[d][k+d+1] }
+	var rev []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(d, k-1) < get(d, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(d, prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, edit{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = append(rev, edit{'+', b[y-1]})
+			} else {
+				rev = append(rev, edit{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+	return rev
+}
+
+// writeHunks writes the hunks of the diff of a and b with diffContext
+// lines of context, merging hunks whose context would overlap.
+func writeHunks(w io.Writer, a, b []string) error {
+	edits := diffLines(a, b)
+	var changed []int
+	for i, e := range edits {
+		if e.op != ' ' {
+			changed = append(changed, i)
+		}
+	}
+	// aLine and bLine are the 1-based line numbers before each edit.
+	aLine, bLine := make([]int, len(edits)+1), make([]int, len(edits)+1)
+	aLine[0], bLine[0] = 1, 1
+	for i, e := range edits {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if e.op != '+' {
+			aLine[i+1]++
+		}
+		if e.op != '-' {
+			bLine[i+1]++
+		}
+	}
+	for i := 0; i < len(changed); {
+		start := max(changed[i]-diffContext, 0)
+		j := i
+		for j+1 < len(changed) && changed[j+1]-changed[j] <= 2*diffContext {
+			j++
+		}
+		end := min(changed[j]+diffContext+1, len(edits))
+		var h strings.Builder
+		fmt.Fprintf(&h, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[end]-aLine[start]), hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for _, e := range edits[start:end] {
+			h.WriteByte(e.op)
+			h.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				h.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		if _, err := io.WriteString(w, h.String()); err != nil {
+			return err
+		}
+		i = j + 1
+	}
+	return nil
+}
+
+// hunkRange formats one side of a hunk header as git does: an empty side
+// starts at the line before it, and a count of one is left out.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,6 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+// freeBytes cannot tell on this platform.
+func freeBytes(dir string) (uint64, bool) { return 0, false }
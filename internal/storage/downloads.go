@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// recentDownloadsMax is how many downloads RecentDownloads remembers.
+	recentDownloadsMax = 100
+	// slowDownloadMinBytes is the smallest download judged against
+	// SlowDownloadThreshold; below it latency, not bandwidth, dominates.
+	slowDownloadMinBytes = 1 << 20
+	// defaultSlowDownloadRecovery is the SlowDownloadRecovery default.
+	defaultSlowDownloadRecovery = 3
+)
+
+// Download kinds in DownloadRecord.
+const (
+	DownloadRepo    = "repo"
+	DownloadPackage = "package"
+)
+
+// DownloadRecord describes one upstream download: a zipball or a package,
+// including its retries. Git fetches are not recorded.
+type DownloadRecord struct {
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	// Started and Duration are by the Storage's Clock; Duration and
+	// BytesPerSecond cover the attempt that succeeded.
+	Started         time.Time     `json:"started"`
+	Duration        time.Duration `json:"-"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Bytes           int64         `json:"bytes"`
+	BytesPerSecond  float64       `json:"bytes_per_second"`
+	Attempts        int           `json:"attempts"`
+	Error           string        `json:"error,omitempty"`
+	// Slow marks a download judged below SlowDownloadThreshold.
+	Slow bool `json:"slow,omitempty"`
+}
+
+// UpstreamHealth is the slow-download alert state (see
+// SlowDownloadThreshold).
+type UpstreamHealth struct {
+	Degraded bool `json:"degraded_upstream"`
+	// Since is when the current degradation began.
+	Since *time.Time `json:"since,omitempty"`
+	// LastSlow is the slow download that raised or last extended it.
+	LastSlow *DownloadRecord `json:"last_slow,omitempty"`
+	// Healthy counts healthy downloads since the last slow one, towards
+	// Recovery.
+	Healthy  int `json:"healthy"`
+	Recovery int `json:"recovery"`
+	// ThresholdBytesPerSecond is SlowDownloadThreshold; 0 when disabled.
+	ThresholdBytesPerSecond int64 `json:"threshold_bytes_per_second"`
+}
+
+// downloadLog keeps the recent downloads and the alert state.
+type downloadLog struct {
+	mu       sync.Mutex
+	recent   []DownloadRecord // ring, next is the oldest once full
+	next     int
+	degraded bool
+	since    time.Time
+	lastSlow *DownloadRecord
+	healthy  int
+}
+
+// DownloadObserver, when set on a Storage, is called after every upstream
+// download with its record, e.g. to feed metrics. It must not block.
+type DownloadObserver func(DownloadRecord)
+
+// recordDownload logs a finished download, judges its throughput and hands
+// it to the observer.
+func (s *Storage) recordDownload(rec DownloadRecord) {
+	rec.DurationSeconds = rec.Duration.Seconds()
+	if rec.Error == "" && rec.Duration > 0 {
+		rec.BytesPerSecond = float64(rec.Bytes) / rec.Duration.Seconds()
+	}
+	threshold := s.SlowDownloadThreshold
+	judged := threshold > 0 && rec.Error == "" && rec.Bytes >= slowDownloadMinBytes
+	rec.Slow = judged && rec.BytesPerSecond < float64(threshold)
+
+	l := &s.downloads
+	l.mu.Lock()
+	if len(l.recent) < recentDownloadsMax {
+		l.recent = append(l.recent, rec)
+	} else {
+		l.recent[l.next] = rec
+		l.next = (l.next + 1) % recentDownloadsMax
+	}
+	switch {
+	case rec.Slow:
+		s.stats.slowDownloads.Add(1)
+		if !l.degraded {
+			l.degraded, l.since = true, rec.Started
+			fmt.Printf("warning: upstream degraded: %s %s at %s/s, below %s/s\n", rec.Kind, rec.Label, formatBytes(int64(rec.BytesPerSecond)), formatBytes(threshold))
+		} else {
+			fmt.Printf("warning: slow upstream download: %s %s at %s/s\n", rec.Kind, rec.Label, formatBytes(int64(rec.BytesPerSecond)))
+		}
+		slow := rec
+		l.lastSlow, l.healthy = &slow, 0
+	case judged && l.degraded:
+		l.healthy++
+		if l.healthy >= s.slowDownloadRecovery() {
+			fmt.Printf("upstream recovered after %d healthy downloads (degraded since %s)\n", l.healthy, l.since.Format(time.RFC3339))
+			l.degraded, l.since, l.lastSlow, l.healthy = false, time.Time{}, nil, 0
+		}
+	}
+	l.mu.Unlock()
+
+	if s.DownloadObserver != nil {
+		s.DownloadObserver(rec)
+	}
+}
+
+func (s *Storage) slowDownloadRecovery() int {
+	if s.SlowDownloadRecovery <= 0 {
+		return defaultSlowDownloadRecovery
+	}
+	return s.SlowDownloadRecovery
+}
+
+// RecentDownloads returns the last upstream downloads, newest first.
+func (s *Storage) RecentDownloads() []DownloadRecord {
+	l := &s.downloads
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]DownloadRecord, 0, len(l.recent))
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		out = append(out, l.recent[(l.next+i)%len(l.recent)])
+	}
+	return out
+}
+
+// UpstreamHealth reports whether recent downloads were slow enough to
+// consider upstream degraded.
+func (s *Storage) UpstreamHealth() UpstreamHealth {
+	l := &s.downloads
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := UpstreamHealth{
+		Degraded:                l.degraded,
+		Healthy:                 l.healthy,
+		Recovery:                s.slowDownloadRecovery(),
+		ThresholdBytesPerSecond: max(s.SlowDownloadThreshold, 0),
+	}
+	if l.degraded {
+		since := l.since
+		h.Since = &since
+	}
+	if l.lastSlow != nil {
+		slow := *l.lastSlow
+		h.LastSlow = &slow
+	}
+	return h
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrEmptyRepo reports a repository that exists upstream but has no
+// commits yet, so there is nothing to archive.
+var ErrEmptyRepo = errors.New("empty repository")
+
+// defaultEmptyRepoTTL is the EmptyRepoTTL New sets: short, since the first
+// push may be seconds away.
+const defaultEmptyRepoTTL = 30 * time.Second
+
+func emptyRepoError(ownerRepo string) error {
+	return fmt.Errorf("%s has no commits yet: %w", ownerRepo, ErrEmptyRepo)
+}
+
+// repoEmpty reports GitHub's answer for git data of an empty repository:
+// 409 {"message": "Git Repository is empty."}.
+func repoEmpty(body []byte) bool {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	return json.Unmarshal(body, &msg) == nil && strings.Contains(strings.ToLower(msg.Message), "repository is empty")
+}
+
+func emptyKey(ownerRepo, token string) string {
+	return strings.ToLower(ownerRepo) + "|" + tokenKey(token)
+}
+
+// knownEmpty reports whether ownerRepo was found empty less than
+// EmptyRepoTTL ago, so GitHub need not be asked again.
+func (s *Storage) knownEmpty(ownerRepo, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.emptyRepos[emptyKey(ownerRepo, token)]
+	return ok && s.Now().Before(until)
+}
+
+func (s *Storage) rememberEmpty(ownerRepo, token string) {
+	if s.EmptyRepoTTL <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.emptyRepos == nil {
+		s.emptyRepos = make(map[string]time.Time)
+	}
+	now := s.Now()
+	for k, until := range s.emptyRepos {
+		if !now.Before(until) {
+			delete(s.emptyRepos, k)
+		}
+	}
+	s.emptyRepos[emptyKey(ownerRepo, token)] = now.Add(s.EmptyRepoTTL)
+}
+
+// gitRepoEmpty reports whether a fetched bare repo has no refs at all.
+func gitRepoEmpty(ctx context.Context, barePath string) bool {
+	out, err := exec.CommandContext(ctx, "git", "-C", barePath, "for-each-ref", "--count=1", "--format=%(refname)").Output()
+	return err == nil && strings.TrimSpace(string(out)) == ""
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptionAES256GCM is the ArchiveMeta.Encryption of files encrypted at
+// rest.
+const EncryptionAES256GCM = "aes-256-gcm"
+
+// ErrKeyUnavailable reports an encrypted file whose key the KeyProvider does
+// not have, or an encrypted file read without a KeyProvider.
+var ErrKeyUnavailable = errors.New("encryption key unavailable")
+
+// KeyProvider supplies the AES-256 keys for encryption at rest. Every key
+// has an ID, which is stored in the files it encrypts, so after a rotation
+// files written under an older key are still read with that key. KeyRing
+// reads keys from files; implement KeyProvider to fetch them from a KMS.
+type KeyProvider interface {
+	// CurrentKey returns the ID and 32-byte key new files are encrypted
+	// with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID; it should wrap
+	// ErrKeyUnavailable for IDs it does not know.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding a current key and any number of previous
+// ones. Key IDs are derived from the keys (see KeyID).
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// KeyID returns the ID of key: the first 8 bytes of its SHA-256, in hex.
+// It identifies the key without revealing it.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewKeyRing returns a KeyRing encrypting with current and still able to
+// decrypt files written under the previous keys. Keys are 32 bytes.
+func NewKeyRing(current []byte, previous ...[]byte) (*KeyRing, error) {
+	k := &KeyRing{current: KeyID(current), keys: make(map[string][]byte, 1+len(previous))}
+	for _, key := range append([][]byte{current}, previous...) {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+		}
+		k.keys[KeyID(key)] = key
+	}
+	return k, nil
+}
+
+// LoadKeyRing reads a KeyRing from key files holding 32 bytes, raw or as 64
+// hex digits or base64 (e.g. from "openssl rand -hex 32").
+func LoadKeyRing(currentFile string, previousFiles ...string) (*KeyRing, error) {
+	var keys [][]byte
+	for _, path := range append([]string{currentFile}, previousFiles...) {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyRing(keys[0], keys[1:]...)
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	text := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key file %s must hold 32 bytes, raw, hex or base64", path)
+}
+
+// CurrentKey implements KeyProvider.
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+// Key implements KeyProvider.
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %s: %w", id, ErrKeyUnavailable)
+	}
+	return key, nil
+}
+
+// An encrypted file is a header followed by the plaintext in sealChunk
+// sized chunks, each sealed with AES-256-GCM. The header holds the key ID,
+// a random nonce prefix and the plaintext size; it is authenticated with
+// every chunk, whose nonce ends in the chunk's index, so chunks cannot be
+// reordered, dropped or moved between files.
+//
+//	magic "GHHSEAL1" | id length (1) | key ID | nonce prefix (4) | size (8)
+const (
+	sealMagic  = "GHHSEAL1"
+	sealChunk  = 64 << 10
+	sealPrefix = 4
+)
+
+// sealHeader is the parsed header of an encrypted file.
+type sealHeader struct {
+	keyID  string
+	prefix []byte
+	size   int64 // plaintext bytes
+	raw    []byte
+}
+
+func (h *sealHeader) nonce(i uint64) []byte {
+	n := make([]byte, 12)
+	copy(n, h.prefix)
+	binary.BigEndian.PutUint64(n[sealPrefix:], i)
+	return n
+}
+
+func (h *sealHeader) chunks() uint64 {
+	if h.size == 0 {
+		return 1
+	}
+	return uint64((h.size + sealChunk - 1) / sealChunk)
+}
+
+// readSealHeader reads the header of an encrypted file from r. It returns
+// nil and no error when r does not start with one.
+func readSealHeader(r *bufio.Reader) (*sealHeader, error) {
+	magic, err := r.Peek(len(sealMagic))
+	if err != nil || string(magic) != sealMagic {
+		return nil, nil
+	}
+	raw := make([]byte, len(sealMagic)+1)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	rest := make([]byte, int(raw[len(sealMagic)])+sealPrefix+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("encrypted file header: %w", io.ErrUnexpectedEOF)
+	}
+	raw = append(raw, rest...)
+	idLen := int(raw[len(sealMagic)])
+	rest = rest[idLen:]
+	h := &sealHeader{
+		keyID:  string(raw[len(sealMagic)+1 : len(sealMagic)+1+idLen]),
+		prefix: rest[:sealPrefix],
+		size:   int64(binary.BigEndian.Uint64(rest[sealPrefix:])),
+		raw:    raw,
+	}
+	if h.size < 0 {
+		return nil, errors.New("encrypted file header: bad size")
+	}
+	return h, nil
+}
+
+// sealInfo returns the header of the encrypted file at path, or nil when
+// the file is not encrypted.
+func sealInfo(path string) *sealHeader {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	h, _ := readSealHeader(bufio.NewReaderSize(f, 512))
+	return h
+}
+
+func gcmFor(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal writes size bytes from r to w, encrypted under keys' current key.
+func seal(w io.Writer, r io.Reader, size int64, keys KeyProvider) error {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return fmt.Errorf("encryption key: %w", err)
+	}
+	if len(id) > 255 {
+		return fmt.Errorf("encryption key id longer than 255 bytes")
+	}
+	aead, err := gcmFor(key)
+	if err != nil {
+		return err
+	}
+	h := &sealHeader{keyID: id, prefix: make([]byte, sealPrefix), size: size}
+	if _, err := rand.Read(h.prefix); err != nil {
+		return err
+	}
+	var hdr bytes.Buffer
+	hdr.WriteString(sealMagic)
+	hdr.WriteByte(byte(len(id)))
+	hdr.WriteString(id)
+	hdr.Write(h.prefix)
+	_ = binary.Write(&hdr, binary.BigEndian, uint64(size))
+	h.raw = hdr.Bytes()
+	if _, err := w.Write(h.raw); err != nil {
+		return err
+	}
+	buf := make([]byte, sealChunk, sealChunk+aead.Overhead())
+	for i := uint64(0); i < h.chunks(); i++ {
+		n := sealChunk
+		if left := size - int64(i)*sealChunk; left < sealChunk {
+			n = int(left)
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+		if _, err := w.Write(aead.Seal(buf[:0], h.nonce(i), buf[:n], h.raw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealBeside writes an encrypted copy of src to a synced temp file in dst's
+// directory and returns its path.
+func (s *Storage) sealBeside(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = in.Close() }()
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-seal-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	err = seal(out, in, fi.Size(), s.Keys)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("encrypt %s: %w", src, err)
+	}
+	return tmp, nil
+}
+
+// unsealReader decrypts an encrypted file chunk by chunk.
+type unsealReader struct {
+	r    io.Reader
+	h    *sealHeader
+	aead cipher.AEAD
+	next uint64
+	buf  []byte
+	out  []byte
+}
+
+func (u *unsealReader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.next == u.h.chunks() {
+			if n, _ := u.r.Read(u.buf[:1]); n > 0 {
+				return 0, errors.New("decrypt: trailing data after the last chunk")
+			}
+			return 0, io.EOF
+		}
+		n := sealChunk
+		if left := u.h.size - int64(u.next)*sealChunk; left < sealChunk {
+			n = int(left)
+		}
+		ct := u.buf[:n+u.aead.Overhead()]
+		if _, err := io.ReadFull(u.r, ct); err != nil {
+			return 0, fmt.Errorf("decrypt: %w", io.ErrUnexpectedEOF)
+		}
+		out, err := u.aead.Open(ct[:0], u.h.nonce(u.next), ct, u.h.raw)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt chunk %d: %w", u.next, ErrChecksumMismatch)
+		}
+		u.out = out
+		u.next++
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	return n, nil
+}
+
+// unseal returns a reader of f's plaintext and the plaintext size. A file
+// that is not encrypted is read as it is, with a size of -1.
+func (s *Storage) unseal(f *os.File) (io.Reader, int64, error) {
+	br := bufio.NewReader(f)
+	h, err := readSealHeader(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	if h == nil {
+		return br, -1, nil
+	}
+	if s.Keys == nil {
+		return nil, 0, fmt.Errorf("%s is encrypted with key %s: %w", f.Name(), h.keyID, ErrKeyUnavailable)
+	}
+	key, err := s.Keys.Key(h.keyID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	aead, err := gcmFor(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &unsealReader{r: br, h: h, aead: aead, buf: make([]byte, sealChunk+aead.Overhead())}, h.size, nil
+}
+
+// plainSize is the size of the file at path once decrypted.
+func plainSize(path string) (int64, error) {
+	if h := sealInfo(path); h != nil {
+		return h.size, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// Event types published to Storage.Events.
+const (
+	// EventArchiveRefreshed: a branch archive was downloaded, replacing the
+	// cached one (OldSHA) when there was one.
+	EventArchiveRefreshed = "archive-refreshed"
+	// EventArchiveEvicted: cleanup removed a repo archive; Reason is
+	// expired, retention, gone or space (evicted for a download that would
+	// not fit).
+	EventArchiveEvicted = "archive-evicted"
+	// EventPackageEvicted: cleanup removed an expired package.
+	EventPackageEvicted = "package-evicted"
+	// EventCleanupCompleted: a cleanup pass finished; Report says what it
+	// removed.
+	EventCleanupCompleted = "cleanup-completed"
+)
+
+// EventTypes lists every event type, in the order documented above, then
+// EventPackageDenied (pkgpolicy.go).
+var EventTypes = []string{EventArchiveRefreshed, EventArchiveEvicted, EventPackageEvicted, EventCleanupCompleted, EventPackageDenied}
+
+// Event describes a change to the cache that other systems may want to
+// react to. Fields that do not apply to the type are empty.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	User string    `json:"user,omitempty"`
+	Repo string    `json:"repo,omitempty"`
+	// Branch is the branch or tag of an archive.
+	Branch string `json:"branch,omitempty"`
+	OldSHA string `json:"old_sha,omitempty"`
+	NewSHA string `json:"new_sha,omitempty"`
+	// URL is the source of a package.
+	URL string `json:"url,omitempty"`
+	// Path is relative to Root.
+	Path   string         `json:"path,omitempty"`
+	Reason string         `json:"reason,omitempty"`
+	Report *CleanupReport `json:"report,omitempty"`
+}
+
+// EventSink receives Events. Publish is called on the goroutine that made
+// the change, while it may still hold locks, so it must not block: queue
+// the event and deliver it elsewhere.
+type EventSink interface {
+	Publish(Event)
+}
+
+// emit stamps e and hands it to the configured sink.
+func (s *Storage) emit(e Event) {
+	if s.Events == nil {
+		return
+	}
+	e.Time = s.Now().UTC()
+	s.Events.Publish(e)
+}
+
+// emitRefreshed reports a newly published archive at zipPath.
+func (s *Storage) emitRefreshed(zipPath, ownerRepo, branch, oldSHA, newSHA string) {
+	if s.Events == nil {
+		return
+	}
+	s.emit(Event{Type: EventArchiveRefreshed, User: s.pathUser(zipPath), Repo: ownerRepo, Branch: branch, OldSHA: oldSHA, NewSHA: newSHA, Path: s.relPath(zipPath)})
+}
+
+// emitEvicted reports a repo archive removed by cleanup. meta is its
+// sidecar as read before the removal, nil when there was none.
+func (s *Storage) emitEvicted(zipPath string, meta *ArchiveMeta, reason string) {
+	if s.Events == nil {
+		return
+	}
+	e := Event{Type: EventArchiveEvicted, User: s.pathUser(zipPath), Path: s.relPath(zipPath), Reason: reason}
+	if meta != nil {
+		e.Repo, e.Branch, e.OldSHA = meta.Repo, meta.Branch, meta.CommitSHA
+	}
+	s.emit(e)
+}
+
+func (s *Storage) relPath(p string) string {
+	rel, err := filepath.Rel(s.Root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+// pathUser is the user owning p, empty for the shared tree.
+func (s *Storage) pathUser(p string) string {
+	parts := splitPath(s.relPath(p))
+	if len(parts) >= 2 && parts[0] == "users" {
+		return parts[1]
+	}
+	return ""
+}
+
+// emitPackageEvicted reports an expired package file removed by cleanup;
+// url is from its sidecar as read before the removal.
+func (s *Storage) emitPackageEvicted(path, url string) {
+	s.emit(Event{Type: EventPackageEvicted, User: s.pathUser(path), URL: url, Path: s.relPath(path), Reason: "expired"})
+}
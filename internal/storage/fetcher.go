@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// RemoteFetcher is where legacy-mode EnsureRepo gets branches and archives
+// from. Storage keeps the caching, locking, retries and metadata around it,
+// so a fetcher only talks to its provider. The default fetches from GitHub;
+// set Storage.Fetcher to mock GitHub in tests or to serve another host.
+//
+// Errors should wrap ErrRepoNotFound for a missing repository and
+// ErrBranchNotFound for a missing ref (a *NotFoundError does both), so
+// EnsureRepo can tell them from transient failures.
+type RemoteFetcher interface {
+	// ResolveDefaultBranch returns the repository's default branch.
+	ResolveDefaultBranch(ctx context.Context, ownerRepo, token string) (string, error)
+	// ResolveRefSHA returns the full commit SHA ref points at.
+	ResolveRefSHA(ctx context.Context, ownerRepo, ref, token string) (string, error)
+	// FetchArchive opens a zip archive of ownerRepo at ref, which is a
+	// commit SHA from ResolveRefSHA or, when that failed, the ref itself.
+	// The size is -1 when unknown.
+	FetchArchive(ctx context.Context, ownerRepo, ref, token string) (io.ReadCloser, int64, error)
+}
+
+// fetcher is Storage.Fetcher, or GitHub when unset.
+func (s *Storage) fetcher() RemoteFetcher {
+	if s.Fetcher != nil {
+		return s.Fetcher
+	}
+	return githubFetcher{s}
+}
+
+// githubFetcher is the default RemoteFetcher: the GitHub REST API for
+// lookups and codeload.github.com for archives, through doGitHub.
+type githubFetcher struct{ s *Storage }
+
+func (g githubFetcher) ResolveDefaultBranch(ctx context.Context, ownerRepo, token string) (string, error) {
+	return g.s.fetchDefaultBranchRemote(ctx, ownerRepo, token)
+}
+
+func (g githubFetcher) ResolveRefSHA(ctx context.Context, ownerRepo, ref, token string) (string, error) {
+	return g.s.fetchBranchSHARemote(ctx, ownerRepo, ref, token)
+}
+
+func (g githubFetcher) FetchArchive(ctx context.Context, ownerRepo, ref, token string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.s.archiveURL(ownerRepo, ref), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if strings.TrimSpace(token) != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/zip")
+	body, size, err := g.s.openHTTP(req)
+	var se *StatusError
+	if errors.As(err, &se) && se.Status == http.StatusNotFound {
+		return nil, 0, &NotFoundError{Repo: ownerRepo, Branch: ref, Token: strings.TrimSpace(token) != ""}
+	}
+	return body, size, err
+}
+
+// openHTTP sends req and returns the body of a 2xx response. Other
+// responses fail with a *StatusError, or a rate limit error from GitHub.
+func (s *Storage) openHTTP(req *http.Request) (io.ReadCloser, int64, error) {
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		se, _ := readStatusError("download", resp)
+		_ = resp.Body.Close()
+		var err error = se
+		if isGitHubHost(req.URL.Hostname()) && isRateLimited(resp) {
+			// doGitHub already waited out what it could; more retries
+			// would only extend the limit.
+			return nil, 0, rateLimitError(resp, err)
+		}
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// isRetryableFetch reports whether a failed open is worth another attempt.
+func isRetryableFetch(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return isRetryableStatus(se.Status)
+	}
+	if errors.Is(err, ErrRepoNotFound) || errors.Is(err, ErrBranchNotFound) || errors.Is(err, ErrEmptyRepo) {
+		return false
+	}
+	return isRetryableError(err)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// flightGroup collapses concurrent lookups with the same key into one: the
+// first caller runs fn, later callers wait for it and share its result. A
+// cold hub hit by many requests for one repo thus makes one API call per
+// lookup instead of one per request.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	dups int // callers waiting on this call, guarded by flightGroup.mu
+	val  string
+	err  error
+}
+
+// do runs fn once per key at a time. shared reports that the result came
+// from another caller's call. A waiter whose ctx ends stops waiting with
+// ctx's error; the call itself goes on for the others.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (string, error)) (val string, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err, true
+		case <-ctx.Done():
+			return "", ctx.Err(), true
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// lookup runs fn through the storage's flight group and counts collapsed
+// calls. fn runs with the first caller's context, so when that caller goes
+// away its cancellation is not handed to waiters that are still live: they
+// retry, and one of them becomes the new leader.
+func (s *Storage) lookup(ctx context.Context, key string, fn func() (string, error)) (string, error) {
+	for {
+		val, err, shared := s.flights.do(ctx, key, fn)
+		if !shared {
+			return val, err
+		}
+		if ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		s.stats.collapsedLookups.Add(1)
+		return val, err
+	}
+}
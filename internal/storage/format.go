@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CacheFormat is the on-disk cache format this binary writes, recorded in
+// every metadata sidecar and in FormatFile. Bump it, with a migration in
+// formatMigrations, when older caches need rewriting before they can be
+// served.
+//
+//   - 1: archives with .meta and .commit.txt, .meta.json only where written
+//     since checksums were recorded.
+//   - 2: every archive has a .meta.json carrying its format.
+const CacheFormat = 2
+
+// FormatFile records the cache format under Root, and the migrations that
+// brought the cache to it.
+const FormatFile = "cache-format.json"
+
+// ErrFormatTooNew is returned by MigrateFormat for caches written by a newer
+// binary, which this one must not touch.
+var ErrFormatTooNew = errors.New("cache format is newer than this binary")
+
+// FormatMigration is one migration recorded in FormatFile.
+type FormatMigration struct {
+	From     int       `json:"from"`
+	To       int       `json:"to"`
+	At       time.Time `json:"at"`
+	Archives int       `json:"archives"`
+}
+
+// formatRecord is the content of FormatFile.
+type formatRecord struct {
+	Format     int               `json:"format"`
+	Migrations []FormatMigration `json:"migrations,omitempty"`
+}
+
+// formatMigrations upgrades a cache from format i+1 to i+2, returning how
+// many archives it rewrote.
+var formatMigrations = []func(s *Storage) (int, error){
+	(*Storage).migrateMetaSidecars,
+}
+
+// MigrateFormat brings the cache under Root to CacheFormat, once: it reads
+// FormatFile (a cache without one is format 1, an empty root is new), runs
+// the migrations between and records each in FormatFile. It returns the
+// migrations it ran, and ErrFormatTooNew, touching nothing, when the cache
+// is newer than CacheFormat. Call it before serving.
+func (s *Storage) MigrateFormat() ([]FormatMigration, error) {
+	rec, err := s.readFormat()
+	if err != nil {
+		return nil, err
+	}
+	if rec.Format > CacheFormat {
+		return nil, fmt.Errorf("%s: format %d, this binary supports up to %d: %w", filepath.Join(s.Root, FormatFile), rec.Format, CacheFormat, ErrFormatTooNew)
+	}
+	var ran []FormatMigration
+	for rec.Format < CacheFormat {
+		n, err := formatMigrations[rec.Format-1](s)
+		if err != nil {
+			return ran, fmt.Errorf("migrate cache format %d to %d: %w", rec.Format, rec.Format+1, err)
+		}
+		m := FormatMigration{From: rec.Format, To: rec.Format + 1, At: s.Now().UTC(), Archives: n}
+		rec.Format = m.To
+		rec.Migrations = append(rec.Migrations, m)
+		if err := s.writeFormat(rec); err != nil {
+			return ran, err
+		}
+		ran = append(ran, m)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, FormatFile)); os.IsNotExist(err) {
+		return ran, s.writeFormat(rec)
+	}
+	return ran, nil
+}
+
+// readFormat reads FormatFile. Without it, a root holding cached repos is
+// format 1 and any other root is new, at CacheFormat.
+func (s *Storage) readFormat() (*formatRecord, error) {
+	b, err := os.ReadFile(filepath.Join(s.Root, FormatFile))
+	if os.IsNotExist(err) {
+		for _, top := range []string{"users", SharedDir} {
+			if _, err := os.Stat(filepath.Join(s.Root, top)); err == nil {
+				return &formatRecord{Format: 1}, nil
+			}
+		}
+		return &formatRecord{Format: CacheFormat}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec formatRecord
+	if err := json.Unmarshal(b, &rec); err != nil || rec.Format < 1 {
+		return nil, fmt.Errorf("%s: invalid cache format record", filepath.Join(s.Root, FormatFile))
+	}
+	return &rec, nil
+}
+
+func (s *Storage) writeFormat(rec *formatRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Root, FormatFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// migrateMetaSidecars (format 1 to 2) gives every cached archive a
+// .meta.json: archives known only by .meta get one recorded from the file,
+// fetched at its mtime, and existing sidecars are rewritten with their
+// format.
+func (s *Storage) migrateMetaSidecars() (int, error) {
+	n := 0
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".zip.meta") {
+			return nil
+		}
+		zipPath := strings.TrimSuffix(p, ".meta")
+		fi, err := statArchive(zipPath)
+		if err != nil {
+			return nil
+		}
+		meta, err := readArchiveMetaFile(zipPath)
+		switch {
+		case err == nil:
+			if meta.Format == CacheFormat {
+				return nil
+			}
+			err = writeArchiveMeta(zipPath, meta)
+		case errors.Is(err, ErrNotFound):
+			sha, _ := readSHA(p)
+			repo, branch := archiveIdentity(s.Root, zipPath)
+			_, err = s.recordArchiveAt(zipPath, repo, branch, sha, fi.ModTime())
+		}
+		if err != nil {
+			fmt.Printf("migrate %s: %v\n", zipPath, err)
+			return nil
+		}
+		n++
+		return nil
+	}
+	for _, top := range []string{"users", SharedDir} {
+		if err := filepath.WalkDir(filepath.Join(s.Root, top), walk); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// archiveIdentity guesses owner/repo and branch from an archive's path, for
+// archives cached before their sidecar recorded them. Branch names lose
+// their slashes, which were replaced by dashes in the file name.
+func archiveIdentity(root, zipPath string) (repo, branch string) {
+	rel, err := filepath.Rel(root, zipPath)
+	if err != nil {
+		return "", ""
+	}
+	parts := splitPath(rel)
+	for i, part := range parts {
+		if part == "repos" && i+3 == len(parts)-1 {
+			name := strings.TrimSuffix(parts[len(parts)-1], ".zip")
+			return parts[i+1] + "/" + parts[i+2], strings.TrimSuffix(name, ".legacy")
+		}
+	}
+	return "", ""
+}
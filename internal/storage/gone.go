@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrBranchGone reports that a branch we hold an archive for no longer exists
+// upstream. Errors wrapping it are *BranchGoneError values carrying the
+// stale archive.
+var ErrBranchGone = errors.New("branch deleted upstream")
+
+// errBranchMissing is returned by fetchBranchSHA for a 404, as opposed to a
+// transient failure that leaves the branch's existence unknown.
+var errBranchMissing = errors.New("branch not found upstream")
+
+// BranchGoneError describes a cached archive whose branch was deleted.
+type BranchGoneError struct {
+	Repo       string
+	Branch     string
+	LastCommit string    // full SHA of the cached archive, if known
+	ZipPath    string    // the stale archive, still on disk
+	Since      time.Time // first time the deletion was observed
+
+	shortLen int // Storage.ShortSHALen, for Archive
+}
+
+func (e *BranchGoneError) Error() string {
+	msg := fmt.Sprintf("%s: %s@%s", ErrBranchGone, e.Repo, e.Branch)
+	if e.LastCommit != "" {
+		msg += " (last cached commit " + e.LastCommit + ")"
+	}
+	return msg
+}
+
+func (e *BranchGoneError) Unwrap() error { return ErrBranchGone }
+
+func gonePath(zipPath string) string {
+	return strings.TrimSuffix(zipPath, ".zip") + ".gone"
+}
+
+// branchGone records (once) that zipPath's branch disappeared and returns
+// the error to hand back to the caller.
+func (s *Storage) branchGone(zipPath, ownerRepo, branch string) *BranchGoneError {
+	since := s.Now()
+	if b, err := os.ReadFile(gonePath(zipPath)); err == nil {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b))); err == nil {
+			since = t
+		}
+	} else {
+		_ = os.WriteFile(gonePath(zipPath), []byte(since.UTC().Format(time.RFC3339)), 0o644)
+	}
+	sha, _ := readSHA(zipPath + ".meta")
+	fmt.Printf("branch %s@%s deleted upstream; cached archive %s is stale\n", ownerRepo, branch, zipPath)
+	return &BranchGoneError{Repo: ownerRepo, Branch: branch, LastCommit: sha, ZipPath: zipPath, Since: since, shortLen: s.ShortSHALen}
+}
+
+// Archive describes the stale archive left behind by the deleted branch.
+func (e *BranchGoneError) Archive() *RepoArchive {
+	res := archiveResult(e.ZipPath, e.shortLen)
+	if res.CommitSHA == "" && e.LastCommit != "" {
+		res.CommitSHA, res.ShortSHA = e.LastCommit, abbrevSHA(e.LastCommit, e.shortLen)
+	}
+	res.FromCache, res.Outcome = true, CacheStale
+	return res
+}
+
+// clearGone drops the deletion marker once the branch resolves again.
+func clearGone(zipPath string) {
+	_ = os.Remove(gonePath(zipPath))
+}
+
+// goneBefore reports whether zipPath's branch was confirmed deleted before
+// cutoff.
+func goneBefore(zipPath string, cutoff time.Time) bool {
+	b, err := os.ReadFile(gonePath(zipPath))
+	if err != nil {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	return err == nil && t.Before(cutoff)
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+
+	"github-hub/internal/version"
+)
+
+// GitHubAPIVersion is sent as X-GitHub-Api-Version on api.github.com calls.
+// Bump it after checking the changes GitHub lists for the new version.
+const GitHubAPIVersion = "2022-11-28"
+
+// DefaultUserAgent is the User-Agent of outgoing requests unless
+// Storage.UserAgent overrides it.
+func DefaultUserAgent() string {
+	v := strings.TrimSpace(version.Version)
+	if v == "" {
+		v = "dev"
+	}
+	return "github-hub/" + v
+}
+
+func (s *Storage) userAgent() string {
+	if ua := strings.TrimSpace(s.UserAgent); ua != "" {
+		return ua
+	}
+	return DefaultUserAgent()
+}
+
+// setRequestHeaders identifies us on every outgoing request, as GitHub's
+// API guidelines require, and pins the API version on api.github.com.
+func (s *Storage) setRequestHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", s.userAgent())
+	if strings.EqualFold(req.URL.Hostname(), "api.github.com") {
+		req.Header.Set("X-GitHub-Api-Version", GitHubAPIVersion)
+	}
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RetainedArchive is an earlier archive of a branch kept next to the current
+// one as <branch>.<shortsha>.zip when KeepPrevious is set. The current
+// archive's metadata lists them newest first.
+type RetainedArchive struct {
+	CommitSHA string    `json:"commit_sha"`
+	File      string    `json:"file"` // base name, in the current archive's directory
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// ActivatedAt and RetiredAt bound when the archive was served for the
+	// branch (see ArchiveServedAt). Entries kept before they were recorded
+	// have neither.
+	ActivatedAt time.Time `json:"activated_at"`
+	RetiredAt   time.Time `json:"retired_at"`
+}
+
+// retire describes the archive of meta, moved aside to file at now.
+func retire(meta *ArchiveMeta, file string, now time.Time) RetainedArchive {
+	return RetainedArchive{CommitSHA: meta.CommitSHA, File: file, SHA256: meta.SHA256, Size: meta.Size, FetchedAt: meta.FetchedAt, ActivatedAt: meta.activatedAt(), RetiredAt: now.UTC()}
+}
+
+// retainedPath names the retained copy of zipPath at commit sha, keeping the
+// .legacy marker last so retained legacy archives still read as legacy.
+func retainedPath(zipPath, sha string) string {
+	short := shortCommit(sha)
+	if base, ok := strings.CutSuffix(zipPath, ".legacy.zip"); ok {
+		return base + "." + short + ".legacy.zip"
+	}
+	return strings.TrimSuffix(zipPath, ".zip") + "." + short + ".zip"
+}
+
+// DefaultShortSHALen is the length of the short SHA in .commit.txt and
+// RepoArchive.ShortSHA when Storage.ShortSHALen is 0.
+const DefaultShortSHALen = 12
+
+// abbrevSHA abbreviates sha to n hex digits (DefaultShortSHALen when n is
+// 0) for .commit.txt and RepoArchive.ShortSHA.
+func abbrevSHA(sha string, n int) string {
+	if n <= 0 {
+		n = DefaultShortSHALen
+	}
+	if len(sha) > n {
+		return sha[:n]
+	}
+	return sha
+}
+
+// shortCommit is the 7-digit form used in log lines and retained archive
+// names, which must not change with ShortSHALen.
+func shortCommit(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// retainCurrent moves the current archive aside before it is replaced by
+// newSHA and returns the updated history, trimmed to KeepPrevious. The
+// caller holds the branch lock and records the result on the new metadata.
+func (s *Storage) retainCurrent(zipPath, newSHA string) []RetainedArchive {
+	if s.KeepPrevious <= 0 {
+		return nil
+	}
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return nil
+	}
+	history := liveHistory(zipPath, meta.Previous)
+	if meta.CommitSHA == "" || meta.CommitSHA == newSHA || !archiveExists(zipPath) {
+		return s.trimHistory(zipPath, history)
+	}
+	dst := retainedPath(zipPath, meta.CommitSHA)
+	if err := s.moveArchive(zipPath, dst); err != nil {
+		fmt.Printf("warning: keep previous archive %s: %v\n", zipPath, err)
+		return s.trimHistory(zipPath, history)
+	}
+	kept := retire(meta, filepath.Base(dst), s.Now())
+	out := []RetainedArchive{kept}
+	for _, h := range history {
+		if h.File != kept.File {
+			out = append(out, h)
+		}
+	}
+	return s.trimHistory(zipPath, out)
+}
+
+// liveHistory drops entries whose file was removed (cleanup, retention).
+func liveHistory(zipPath string, history []RetainedArchive) []RetainedArchive {
+	dir := filepath.Dir(zipPath)
+	out := history[:0:0]
+	for _, h := range history {
+		if archiveExists(filepath.Join(dir, h.File)) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func (s *Storage) trimHistory(zipPath string, history []RetainedArchive) []RetainedArchive {
+	if len(history) <= s.KeepPrevious {
+		return history
+	}
+	for _, h := range history[s.KeepPrevious:] {
+		removeStored(filepath.Join(filepath.Dir(zipPath), h.File))
+	}
+	return history[:s.KeepPrevious]
+}
+
+// recordHistory attaches history to the metadata of a freshly recorded
+// archive.
+func recordHistory(zipPath string, meta *ArchiveMeta, history []RetainedArchive) {
+	if meta == nil || len(history) == 0 {
+		return
+	}
+	meta.Previous = history
+	if err := writeArchiveMeta(zipPath, meta); err != nil {
+		fmt.Printf("warning: record archive history for %s: %v\n", zipPath, err)
+	}
+}
+
+// pinnedArchive serves a rolled-back archive without consulting upstream;
+// a forced refresh replaces it and clears the pin.
+func (s *Storage) pinnedArchive(ctx context.Context, zipPath string) (string, bool) {
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil || !meta.Pinned || !archiveExists(zipPath) {
+		return "", false
+	}
+	s.touchServed(ctx, zipPath)
+	s.noteHit(ctx)
+	return zipPath, true
+}
+
+// retainedArchives maps the paths among zipPaths that are kept previous
+// archives to the metadata of the current archive that keeps them.
+func retainedArchives(zipPaths []string) map[string]*ArchiveMeta {
+	out := map[string]*ArchiveMeta{}
+	for _, zipPath := range zipPaths {
+		meta, err := readArchiveMetaFile(zipPath)
+		if err != nil {
+			continue
+		}
+		for _, h := range meta.Previous {
+			out[filepath.Join(filepath.Dir(zipPath), h.File)] = meta
+		}
+	}
+	return out
+}
+
+// branchArchives returns the git-mode and legacy archive paths of a branch.
+func (s *Storage) branchArchives(user, ownerRepo, branch string) []string {
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	return []string{
+		filepath.Join(dir, branch+".zip"),
+		filepath.Join(dir, sanitizeName(branch)+".legacy.zip"),
+	}
+}
+
+func (s *Storage) historyBranch(user, ownerRepo, branch string) (string, string, string, error) {
+	user, ownerRepo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return "", "", "", err
+	}
+	branch = strings.TrimSpace(branch)
+	if branch == "" {
+		branch = s.recordedDefaultBranch(ownerRepo)
+	}
+	if branch == "" {
+		branch = "main"
+	}
+	if err := ValidateRef(branch); err != nil {
+		return "", "", "", err
+	}
+	return user, ownerRepo, branch, nil
+}
+
+// ArchiveAt returns the user's cached archive of branch at commit (a full
+// or abbreviated SHA): the current archive or one kept by KeepPrevious. It
+// never downloads; ErrNotFound means no such archive is held.
+func (s *Storage) ArchiveAt(user, ownerRepo, branch, commit string) (string, *ArchiveMeta, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return "", nil, err
+	}
+	commit = strings.ToLower(strings.TrimSpace(commit))
+	if !shortSHA.MatchString(commit) {
+		return "", nil, fmt.Errorf("invalid commit %q: %w", commit, ErrBadPath)
+	}
+	for _, zipPath := range s.branchArchives(user, ownerRepo, branch) {
+		meta, err := readArchiveMeta(zipPath)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(meta.CommitSHA), commit) && archiveExists(zipPath) {
+			return zipPath, meta, nil
+		}
+		for _, h := range meta.Previous {
+			p := filepath.Join(filepath.Dir(zipPath), h.File)
+			if strings.HasPrefix(strings.ToLower(h.CommitSHA), commit) && archiveExists(p) {
+				return p, keptMeta(p, meta, h), nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("%s@%s at %s: %w", ownerRepo, branch, commit, ErrNotFound)
+}
+
+// keptMeta describes the retained archive h of the current archive meta,
+// stored at p.
+func keptMeta(p string, meta *ArchiveMeta, h RetainedArchive) *ArchiveMeta {
+	kept := &ArchiveMeta{Repo: meta.Repo, Branch: meta.Branch, CommitSHA: h.CommitSHA, SHA256: h.SHA256, Size: h.Size, FetchedAt: h.FetchedAt, ActivatedAt: h.ActivatedAt}
+	storedInfo(p, kept)
+	return kept
+}
+
+// ServingWindow is a span of time during which an archive was the one
+// served for its branch.
+type ServingWindow struct {
+	CommitSHA string    `json:"commit_sha"`
+	SHA256    string    `json:"sha256,omitempty"`
+	From      time.Time `json:"from"`
+	// Until is nil for the current archive.
+	Until  *time.Time `json:"until,omitempty"`
+	Legacy bool       `json:"legacy,omitempty"`
+}
+
+func (w ServingWindow) covers(t time.Time) bool {
+	return !t.Before(w.From) && (w.Until == nil || t.Before(*w.Until))
+}
+
+// NotServedError reports that no held archive of a branch was served at At.
+// Before and After are the nearest windows that are held, when any. It is
+// an ErrNotFound.
+type NotServedError struct {
+	Repo, Branch  string
+	At            time.Time
+	Before, After *ServingWindow
+}
+
+func (e *NotServedError) Error() string {
+	return fmt.Sprintf("no retained archive of %s@%s was served at %s", e.Repo, e.Branch, e.At.UTC().Format(time.RFC3339))
+}
+
+func (e *NotServedError) Unwrap() error { return ErrNotFound }
+
+// servedArchive is a held archive with its serving window.
+type servedArchive struct {
+	path   string
+	meta   *ArchiveMeta
+	window ServingWindow
+}
+
+// servedArchives lists the archive at zipPath and those it keeps, with the
+// windows they were served in. Entries kept before windows were recorded
+// are taken to have served from their fetch until the next one started.
+func servedArchives(zipPath string) []servedArchive {
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return nil
+	}
+	legacy := strings.HasSuffix(zipPath, ".legacy.zip")
+	var out []servedArchive
+	if archiveExists(zipPath) {
+		out = append(out, servedArchive{zipPath, meta, ServingWindow{CommitSHA: meta.CommitSHA, SHA256: meta.SHA256, From: meta.activatedAt(), Legacy: legacy}})
+	}
+	from := func(h RetainedArchive) time.Time {
+		if h.ActivatedAt.IsZero() {
+			return h.FetchedAt
+		}
+		return h.ActivatedAt
+	}
+	starts := []time.Time{meta.activatedAt()}
+	for _, h := range meta.Previous {
+		starts = append(starts, from(h))
+	}
+	for _, h := range liveHistory(zipPath, meta.Previous) {
+		p := filepath.Join(filepath.Dir(zipPath), h.File)
+		w := ServingWindow{CommitSHA: h.CommitSHA, SHA256: h.SHA256, From: from(h), Legacy: legacy}
+		until := h.RetiredAt
+		if until.IsZero() {
+			for _, t := range starts {
+				if t.After(w.From) && (until.IsZero() || t.Before(until)) {
+					until = t
+				}
+			}
+		}
+		if until.IsZero() {
+			continue // no way to tell when it stopped being served
+		}
+		until = until.UTC()
+		w.Until = &until
+		out = append(out, servedArchive{p, keptMeta(p, meta, h), w})
+	}
+	return out
+}
+
+// ArchiveServedAt returns the user's held archive of branch that was being
+// served at t: the current archive or one kept by KeepPrevious, whose
+// window (from activation to replacement) covers t. It never downloads.
+// When none does the error is a *NotServedError naming the nearest held
+// windows.
+func (s *Storage) ArchiveServedAt(user, ownerRepo, branch string, t time.Time) (string, *ArchiveMeta, *ServingWindow, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	nf := &NotServedError{Repo: ownerRepo, Branch: branch, At: t}
+	for _, zipPath := range s.branchArchives(user, ownerRepo, branch) {
+		for _, a := range servedArchives(zipPath) {
+			w := a.window
+			if w.covers(t) {
+				return a.path, a.meta, &w, nil
+			}
+			if w.Until != nil && !w.Until.After(t) && (nf.Before == nil || w.Until.After(*nf.Before.Until)) {
+				nf.Before = &w
+			}
+			if w.From.After(t) && (nf.After == nil || w.From.Before(nf.After.From)) {
+				nf.After = &w
+			}
+		}
+	}
+	return "", nil, nil, nf
+}
+
+// Rollback promotes the newest retained archive of branch to be the current
+// one and pins it, so downloads keep serving it instead of refreshing until
+// a forced refresh. The replaced archive joins the end of the history, so
+// repeated rollbacks walk further back. The git-mode archive is preferred
+// when both modes have history.
+func (s *Storage) Rollback(user, ownerRepo, branch string) (*ArchiveMeta, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return nil, err
+	}
+	for i, zipPath := range s.branchArchives(user, ownerRepo, branch) {
+		lockBranch := branch
+		if i == 1 {
+			lockBranch += "-legacy"
+		}
+		unlock := s.acquire(user, ownerRepo, lockBranch)
+		meta, err := s.rollback(zipPath)
+		unlock()
+		if err == nil {
+			fmt.Printf("rolled back %s@%s for %s to %s\n", ownerRepo, branch, user, shortCommit(meta.CommitSHA))
+			return meta, nil
+		}
+	}
+	return nil, fmt.Errorf("no previous archive of %s@%s: %w", ownerRepo, branch, ErrNotFound)
+}
+
+func (s *Storage) rollback(zipPath string) (*ArchiveMeta, error) {
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	history := liveHistory(zipPath, meta.Previous)
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	target := history[0]
+	rest := history[1:]
+	if archiveExists(zipPath) && meta.CommitSHA != "" {
+		dst := retainedPath(zipPath, meta.CommitSHA)
+		if err := s.moveArchive(zipPath, dst); err != nil {
+			return nil, err
+		}
+		rest = append(rest, retire(meta, filepath.Base(dst), s.Now()))
+	}
+	if err := s.moveArchive(filepath.Join(filepath.Dir(zipPath), target.File), zipPath); err != nil {
+		return nil, err
+	}
+	promoted := &ArchiveMeta{
+		Repo:        meta.Repo,
+		Branch:      meta.Branch,
+		CommitSHA:   target.CommitSHA,
+		SHA256:      target.SHA256,
+		Size:        target.Size,
+		FetchedAt:   target.FetchedAt,
+		ActivatedAt: s.Now().UTC(),
+		Previous:    rest,
+		Pinned:      true,
+	}
+	storedInfo(zipPath, promoted)
+	s.signMeta(promoted)
+	if err := writeArchiveMeta(zipPath, promoted); err != nil {
+		return nil, err
+	}
+	auditActivation(zipPath, promoted)
+	base := strings.TrimSuffix(zipPath, ".zip")
+	_ = writeSHA(zipPath+".meta", target.CommitSHA)
+	_ = writeSHA(base+".commit.txt", abbrevSHA(target.CommitSHA, s.ShortSHALen))
+	_ = writeInfoJSON(base+".info.json", &RepoInfo{Repo: meta.Repo, Branch: meta.Branch, CommitSHA: target.CommitSHA, ChangedFiles: []string{}})
+	_ = s.touch(zipPath)
+	return promoted, nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrBlockedHost reports a package URL, redirect hop or connection whose
+// host is, or resolves to, an address PublicHostCheck refuses.
+var ErrBlockedHost = errors.New("host is not public")
+
+// hostCheckTimeout bounds the DNS lookup of one PublicHostCheck.
+const hostCheckTimeout = 5 * time.Second
+
+// lookupHost resolves hosts for PublicHostCheck; tests replace it.
+var lookupHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
+// PublicHostCheck is a PackageHostCheck that keeps package downloads off
+// internal networks: it refuses hosts that are, or resolve to, a loopback,
+// private (RFC 1918, fc00::/7), link-local (e.g. 169.254.169.254),
+// unspecified or multicast address. Every address a name resolves to must
+// be public. Called again with each address a download connects to, it
+// also refuses a name that resolves differently by then (DNS rebinding).
+func PublicHostCheck(ctx context.Context, u *url.URL) error {
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("no host: %w", ErrBlockedHost)
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i] // IPv6 zone
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkPublicIP(host, ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, hostCheckTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, strings.TrimSuffix(host, "."))
+	if err != nil {
+		return fmt.Errorf("resolve %s: %v: %w", host, err, ErrBlockedHost)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%s has no addresses: %w", host, ErrBlockedHost)
+	}
+	for _, a := range addrs {
+		if err := checkPublicIP(host, a.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPublicIP(host string, ip net.IP) error {
+	var kind string
+	switch {
+	case ip.IsLoopback():
+		kind = "loopback"
+	case ip.IsPrivate():
+		kind = "private"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		kind = "link-local"
+	case ip.IsUnspecified():
+		kind = "unspecified"
+	case ip.IsMulticast():
+		kind = "multicast"
+	default:
+		return nil
+	}
+	if host == ip.String() {
+		return fmt.Errorf("%s is a %s address: %w", host, kind, ErrBlockedHost)
+	}
+	return fmt.Errorf("%s resolves to %s address %s: %w", host, kind, ip, ErrBlockedHost)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImportRepoArchive seeds the cache with an archive obtained out of band,
+// e.g. carried into an air-gapped network: the zip at src (a local path or
+// a file:// URL) becomes user's git-mode archive of ownerRepo@branch at
+// commitSHA, with the same sidecars a download writes. An empty branch
+// means the repo's recorded default branch, else "main"; give ownerRepo as
+// GitHub spells it, since that names the cache directory.
+//
+// The archive is then an ordinary cache entry with that commit. While
+// GitHub cannot be reached, EnsureRepo serves it under the stale policy
+// (PreferFresh and PreferCache serve it as stale, StaleFail refuses); once
+// it can, the branch is revalidated as usual, so the import is served as a
+// hit while the branch is still at commitSHA and replaced by a fresh export
+// when it has moved. Legacy (zipball) requests do not see it. The source
+// must open as a zip archive and commitSHA must be a full 40-digit SHA;
+// both fail with ErrBadPath otherwise.
+func (s *Storage) ImportRepoArchive(user, ownerRepo, branch, commitSHA, src string) (*ArchiveMeta, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	commitSHA = strings.ToLower(strings.TrimSpace(commitSHA))
+	if !fullSHA.MatchString(commitSHA) {
+		return nil, fmt.Errorf("import %s@%s: commit must be a full 40-digit SHA, got %.64q: %w", ownerRepo, branch, commitSHA, ErrBadPath)
+	}
+	src, err = importSource(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkZip(src); err != nil {
+		return nil, fmt.Errorf("import %s@%s: %s is not a zip archive (%v): %w", ownerRepo, branch, src, err, ErrBadPath)
+	}
+
+	zipPath := filepath.Join(s.reposDir(user), ownerRepo, branch+".zip")
+	parent := filepath.Dir(zipPath)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := s.tempDirFor(parent)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath, err := copyToTemp(src, tmpDir)
+	if err != nil {
+		return nil, fmt.Errorf("import %s@%s: %w", ownerRepo, branch, err)
+	}
+
+	unlock := s.acquire(user, ownerRepo, branch)
+	defer unlock()
+	metaPath := zipPath + ".meta"
+	oldSHA, _ := readSHA(metaPath)
+	history := s.retainCurrent(zipPath, commitSHA)
+	if err := s.installArchive(tmpPath, zipPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	base := strings.TrimSuffix(zipPath, ".zip")
+	_ = writeSHA(metaPath, commitSHA)
+	_ = writeSHA(base+".commit.txt", abbrevSHA(commitSHA, s.ShortSHALen))
+	_ = writeInfoJSON(base+".info.json", &RepoInfo{Repo: ownerRepo, Branch: branch, CommitSHA: commitSHA, ChangedFiles: []string{}})
+	clearGone(zipPath)
+	meta, err := s.recordArchive(zipPath, ownerRepo, branch, commitSHA)
+	if err != nil {
+		return nil, fmt.Errorf("record imported archive %s: %w", zipPath, err)
+	}
+	recordHistory(zipPath, meta, history)
+	s.emitRefreshed(zipPath, ownerRepo, branch, oldSHA, commitSHA)
+	fmt.Printf("imported %s@%s for %s at %s from %s\n", ownerRepo, branch, user, shortCommit(commitSHA), src)
+	return meta, nil
+}
+
+// importSource turns a file:// URL into a path; anything else with a
+// scheme is refused.
+func importSource(src string) (string, error) {
+	src = strings.TrimSpace(src)
+	if !strings.Contains(src, "://") {
+		if src == "" {
+			return "", fmt.Errorf("import: missing archive path: %w", ErrBadPath)
+		}
+		return src, nil
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") || u.Path == "" {
+		return "", fmt.Errorf("import: archive must be a local path or file:// URL, got %.64q: %w", src, ErrBadPath)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// checkZip opens path as a zip archive and reads its directory.
+func checkZip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+	if len(zr.File) == 0 {
+		return errors.New("archive is empty")
+	}
+	return nil
+}
+
+// copyToTemp copies src into a new temp file in dir and returns its path.
+func copyToTemp(src, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.CreateTemp(dir, tempPrefix+"import-*.zip")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CacheLayout decides where repo archives are cached.
+type CacheLayout string
+
+const (
+	// LayoutPerUser (the default) keeps archives per user under
+	// users/<user>/repos/<owner>/<repo>/.
+	LayoutPerUser CacheLayout = "per-user"
+	// LayoutShared keeps one copy of each archive for everyone under
+	// shared/repos/<owner>/<repo>/. Packages stay per user. Access is then
+	// only restricted by the repo policy.
+	LayoutShared CacheLayout = "shared"
+)
+
+// SharedDir is the top-level directory of LayoutShared archives.
+const SharedDir = "shared"
+
+// ParseCacheLayout parses a cache_layout value; empty means LayoutPerUser.
+func ParseCacheLayout(v string) (CacheLayout, error) {
+	switch l := CacheLayout(strings.ToLower(strings.TrimSpace(v))); l {
+	case "":
+		return LayoutPerUser, nil
+	case LayoutPerUser, LayoutShared:
+		return l, nil
+	}
+	return "", fmt.Errorf("cache layout must be %q or %q, got %q", LayoutPerUser, LayoutShared, v)
+}
+
+func (s *Storage) shared() bool { return s.Layout == LayoutShared }
+
+// reposDir is the directory holding user's <owner>/<repo> archive trees.
+func (s *Storage) reposDir(user string) string {
+	if s.shared() {
+		return filepath.Join(s.Root, SharedDir, "repos")
+	}
+	return filepath.Join(s.Root, "users", user, "repos")
+}
+
+// lockUser is the user part of branch lock keys: one namespace for all
+// users when archives are shared.
+func (s *Storage) lockUser(user string) string {
+	if s.shared() {
+		return SharedDir
+	}
+	return user
+}
+
+// repoTrees lists the directories holding <owner>/<repo> archive trees for
+// the current layout, keyed by the user they belong to ("" when shared).
+// Archives left by the other layout are not listed; cleanupExpired still
+// expires them.
+func (s *Storage) repoTrees() map[string]string {
+	if s.shared() {
+		return map[string]string{"": s.reposDir("")}
+	}
+	trees := map[string]string{}
+	users, err := os.ReadDir(filepath.Join(s.Root, "users"))
+	if err != nil {
+		return trees
+	}
+	for _, u := range users {
+		if u.IsDir() {
+			trees[u.Name()] = s.reposDir(u.Name())
+		}
+	}
+	return trees
+}
+
+// trimRepoDir removes dir and its empty parents up to the users/ or shared/
+// directory it is in.
+func (s *Storage) trimRepoDir(dir string) {
+	top := "users"
+	if rel, err := filepath.Rel(s.Root, dir); err == nil {
+		if parts := splitPath(rel); len(parts) > 0 && parts[0] == SharedDir {
+			top = SharedDir
+		}
+	}
+	trimEmpty(dir, filepath.Join(s.Root, top))
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrBadPageToken reports a continuation token that is not one ListPage or
+// ListPackagesPage returned.
+var ErrBadPageToken = errors.New("invalid page token")
+
+// ListOptions pages a listing. Pages are in lexicographic (byte-wise) name
+// order and a token resumes strictly after the last name of the page that
+// returned it, so walking every page sees each entry that existed
+// throughout exactly once. Paging is best effort otherwise: entries created
+// or removed between pages may or may not be seen, and nothing is held open
+// between calls.
+type ListOptions struct {
+	// Limit caps the entries returned; 0 or less returns the rest.
+	Limit int
+	// Token is the continuation token of the previous page, or empty for
+	// the first.
+	Token string
+}
+
+func pageToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// after decodes opts.Token into the name to resume after.
+func (o ListOptions) after() (string, error) {
+	if o.Token == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(o.Token)
+	if err != nil || len(b) == 0 {
+		return "", ErrBadPageToken
+	}
+	return string(b), nil
+}
+
+// eachPage calls add for the names that follow opts.Token, in sorted
+// order, until add has accepted opts.Limit of them; add reports whether it
+// kept the name. next is the token of the following page, empty when the
+// names ran out.
+func eachPage(names []string, opts ListOptions, add func(name string) bool) (next string, err error) {
+	after, err := opts.after()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	i := sort.SearchStrings(names, after)
+	if i < len(names) && names[i] == after {
+		i++
+	}
+	n := 0
+	for ; i < len(names); i++ {
+		if !add(names[i]) {
+			continue
+		}
+		if n++; opts.Limit > 0 && n == opts.Limit && i+1 < len(names) {
+			return pageToken(names[i]), nil
+		}
+	}
+	return "", nil
+}
+
+// listDir returns the names in the directory at abs. Only names are read;
+// entries are built one page at a time.
+func listDir(abs string) ([]string, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// listed reports whether List shows the name in the directory at abs:
+// sidecars and the trash are hidden.
+func (s *Storage) listed(abs, name string) bool {
+	if strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".info.json") || strings.HasSuffix(name, ".meta.json") || strings.HasSuffix(name, ".gone") || strings.HasSuffix(name, ".manifest.json") || strings.HasSuffix(name, ".segments.json") || name == packageMetaName || name == releaseMapName {
+		return false
+	}
+	return !s.inTrash(filepath.Join(abs, name))
+}
+
+// listAbs resolves rel for listing.
+func (s *Storage) listAbs(rel string) (string, error) {
+	abs, err := s.safeJoin(rel)
+	if err != nil {
+		return "", err
+	}
+	if s.inTrash(abs) {
+		return "", ErrNotFound
+	}
+	return abs, nil
+}
+
+// ListPage lists one page of the entries under rel, in name order; see
+// ListOptions. next is the token of the following page, empty on the last
+// one.
+func (s *Storage) ListPage(rel string, opts ListOptions) (entries []Entry, next string, err error) {
+	abs, err := s.listAbs(rel)
+	if err != nil {
+		return nil, "", err
+	}
+	names, err := listDir(abs)
+	if err != nil {
+		return nil, "", err
+	}
+	entries = make([]Entry, 0)
+	next, err = eachPage(names, opts, func(name string) bool {
+		if !s.listed(abs, name) {
+			return false
+		}
+		e, ok := s.listEntry(abs, rel, name)
+		if ok {
+			entries = append(entries, e)
+		}
+		return ok
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+// ListFunc calls fn for each entry under rel, in name order, building one
+// entry at a time so large directories are never held in memory as
+// entries. fn returning fs.SkipAll stops the listing without error; any
+// other error stops it and is returned.
+func (s *Storage) ListFunc(rel string, fn func(Entry) error) error {
+	abs, err := s.listAbs(rel)
+	if err != nil {
+		return err
+	}
+	names, err := listDir(abs)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !s.listed(abs, name) {
+			continue
+		}
+		e, ok := s.listEntry(abs, rel, name)
+		if !ok {
+			continue
+		}
+		if err := fn(e); err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// listEntry builds the entry for name in the directory at abs; ok is false
+// when it vanished since the directory was read.
+func (s *Storage) listEntry(abs, rel, name string) (Entry, bool) {
+	info, err := os.Lstat(filepath.Join(abs, name))
+	if err != nil {
+		return Entry{}, false
+	}
+	if target := s.tierLink(filepath.Join(abs, name)); target != "" {
+		// An archive demoted to a slower tier.
+		if info, err = os.Stat(target); err != nil {
+			return Entry{}, false
+		}
+	}
+	return newEntry(filepath.Join(abs, name), filepath.Join(rel, name), info.IsDir(), info), true
+}
+
+// ListPackagesPage lists one page of the user's cached packages in hash
+// order, with the paging semantics of ListPage. Use ListPackages for the
+// most recently used first.
+func (s *Storage) ListPackagesPage(user string, opts ListOptions) ([]PackageMeta, string, error) {
+	base, err := s.packagesBase(user)
+	if err != nil {
+		return nil, "", err
+	}
+	names, err := listDir(base)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, "", err
+	}
+	out := make([]PackageMeta, 0)
+	next, err := eachPage(names, opts, func(name string) bool {
+		meta, err := readPackageDir(filepath.Join(base, name))
+		if err != nil {
+			return false
+		}
+		out = append(out, *meta)
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return out, next, nil
+}
+
+// EachPackage calls fn for each of the user's cached packages in hash order,
+// reading one package directory at a time. fn returning fs.SkipAll stops
+// without error; any other error stops it and is returned.
+func (s *Storage) EachPackage(user string, fn func(PackageMeta) error) error {
+	base, err := s.packagesBase(user)
+	if err != nil {
+		return err
+	}
+	names, err := listDir(base)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		meta, err := readPackageDir(filepath.Join(base, name))
+		if err != nil {
+			continue
+		}
+		if err := fn(*meta); err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest lists the files of a cached archive with their sizes and
+// SHA-256 digests, for compliance tooling. It is built once per archive
+// (commit and archive checksum) and cached in <branch>.manifest.json.
+type Manifest struct {
+	Repo      string `json:"repo"`
+	Branch    string `json:"branch"`
+	CommitSHA string `json:"commit_sha,omitempty"`
+	// SHA256 and Size describe the archive as served.
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// FileCount and TotalSize count the files listed in Files, which are
+	// in archive order with their names as stored in the zip.
+	FileCount int             `json:"file_count"`
+	TotalSize int64           `json:"total_size"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is one file of a Manifest.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestLimits caps the archives ArchiveManifest builds a manifest for;
+// 0 or less leaves that dimension unlimited.
+type ManifestLimits struct {
+	MaxEntries int
+	MaxBytes   int64 // uncompressed bytes to hash
+}
+
+func manifestPath(zipPath string) string {
+	return strings.TrimSuffix(zipPath, ".zip") + ".manifest.json"
+}
+
+// ArchiveManifest writes the Manifest of a cached archive to w as JSON and
+// returns the bytes written. The first call for an archive hashes every
+// file, one at a time, and caches the document; later calls copy the cached
+// one until the archive is replaced. Archives with more entries or bytes
+// than limits allows fail with ErrTooLarge before anything is hashed.
+func (s *Storage) ArchiveManifest(w io.Writer, zipPath string, limits ManifestLimits) (int64, error) {
+	res := archiveResult(zipPath, s.ShortSHALen)
+	if res.SHA256 == "" {
+		sum, size, err := s.hashArchive(zipPath)
+		if err != nil {
+			return 0, err
+		}
+		res.SHA256, res.Size = sum, size
+	}
+	path := manifestPath(zipPath)
+	if head, err := readManifestHead(path); err != nil || head.SHA256 != res.SHA256 || head.CommitSHA != res.CommitSHA {
+		if err := s.buildManifest(zipPath, path, res, limits); err != nil {
+			return 0, fmt.Errorf("manifest of %s: %w", zipPath, err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	return io.Copy(w, f)
+}
+
+// buildManifest hashes the files of zipPath and writes their manifest to
+// dst. Entries are encoded as they are hashed, so memory stays bounded by
+// the zip's directory rather than the manifest.
+func (s *Storage) buildManifest(zipPath, dst string, res *RepoArchive, limits ManifestLimits) error {
+	raw, done, err := s.RawArchive(zipPath)
+	if err != nil {
+		return err
+	}
+	defer done()
+	zr, err := zip.OpenReader(raw)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+
+	m := Manifest{CommitSHA: res.CommitSHA, SHA256: res.SHA256, Size: res.Size}
+	if meta, err := readArchiveMeta(zipPath); err == nil {
+		m.Repo, m.Branch = meta.Repo, meta.Branch
+	}
+	var files []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, f)
+		m.TotalSize += int64(f.UncompressedSize64)
+	}
+	m.FileCount = len(files)
+	if limits.MaxEntries > 0 && m.FileCount > limits.MaxEntries {
+		return fmt.Errorf("%d files, limit is %d: %w", m.FileCount, limits.MaxEntries, ErrTooLarge)
+	}
+	if limits.MaxBytes > 0 && m.TotalSize > limits.MaxBytes {
+		return fmt.Errorf("%d bytes uncompressed, limit is %d: %w", m.TotalSize, limits.MaxBytes, ErrTooLarge)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-manifest-*.json")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	err = writeManifest(tmp, &m, files)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	fmt.Printf("manifest %s files=%d bytes=%d\n", zipPath, m.FileCount, m.TotalSize)
+	return nil
+}
+
+// writeManifest encodes m, with files hashed into m.Files as it goes. The
+// archive fields come first so readManifestHead can stop before Files.
+func writeManifest(out io.Writer, m *Manifest, files []*zip.File) error {
+	bw := bufio.NewWriter(out)
+	head, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// Splice the entries in place of the empty "files":null.
+	head = head[:len(head)-len(`null}`)]
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+	_ = bw.WriteByte('[')
+	for i, f := range files {
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		b, err := json.Marshal(ManifestEntry{Path: f.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			_ = bw.WriteByte(',')
+		}
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	if _, err := bw.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readManifestHead decodes a cached manifest up to its Files, which it
+// skips.
+func readManifestHead(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		if key == "files" {
+			break
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		fields[key] = v
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
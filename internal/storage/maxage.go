@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+type maxAgeKey struct{}
+
+// WithMaxAge lets EnsureRepo calls made with the returned context serve a
+// cached branch archive fetched less than d ago as is, without asking
+// upstream whether the branch moved. Older archives are revalidated as
+// usual; d <= 0 always revalidates, which is also the default.
+func WithMaxAge(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxAgeKey{}, d)
+}
+
+func maxAge(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(maxAgeKey{}).(time.Duration)
+	return d
+}
+
+// withinMaxAge serves zipPath when the context's max age covers it: the
+// archive exists, has a recorded fetch time inside the window and its
+// branch was not found deleted upstream.
+func (s *Storage) withinMaxAge(ctx context.Context, zipPath string) (string, bool) {
+	if s.strict(ctx) {
+		return "", false
+	}
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return "", false
+	}
+	age, ok := s.maxAgeCovers(ctx, zipPath, meta)
+	if !ok {
+		return "", false
+	}
+	fmt.Printf("serving %s without revalidation: age %s within max age %s\n", zipPath, age.Round(time.Second), maxAge(ctx))
+	s.touchServed(ctx, zipPath)
+	if !background(ctx) {
+		s.stats.skippedRevalidations.Add(1)
+	}
+	s.noteHit(ctx)
+	return zipPath, true
+}
+
+// maxAgeCovers is the check of withinMaxAge without serving anything: it
+// reports the age of zipPath, whose metadata is meta, and whether the
+// context's max age covers it.
+func (s *Storage) maxAgeCovers(ctx context.Context, zipPath string, meta *ArchiveMeta) (time.Duration, bool) {
+	d := maxAge(ctx)
+	if d <= 0 {
+		return 0, false
+	}
+	if meta.FetchedAt.IsZero() || !archiveExists(zipPath) {
+		return 0, false
+	}
+	if _, err := os.Stat(gonePath(zipPath)); err == nil {
+		return 0, false
+	}
+	age := s.Now().Sub(meta.FetchedAt)
+	return age, age < d
+}
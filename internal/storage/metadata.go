@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github-hub/internal/zstd"
+)
+
+// ErrChecksumMismatch reports that a cached archive no longer matches the
+// checksum recorded when it was downloaded.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ArchiveMeta is the JSON sidecar (<branch>.meta.json) written next to each
+// cached repo archive. The checksum is computed once at download time so it
+// can be served without rereading the archive. FetchedAt is when the content
+// was downloaded; the archive's mtime tracks last access for cleanup and is
+// reset on every serve. SHA256 and Size always describe the uncompressed
+// zip, also for archives stored compressed.
+type ArchiveMeta struct {
+	// Format is the CacheFormat of the binary that wrote the sidecar; 0
+	// for sidecars older than format 2.
+	Format    int       `json:"format,omitempty"`
+	Repo      string    `json:"repo"`
+	Branch    string    `json:"branch"`
+	CommitSHA string    `json:"commit_sha,omitempty"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// ActivatedAt is when the archive started being served for the branch:
+	// when it replaced another commit or was rolled back to. Refreshes that
+	// find the same commit keep it. Zero for archives cached before it was
+	// recorded, whose window starts at FetchedAt.
+	ActivatedAt time.Time `json:"activated_at"`
+	// Compression is CompressionZstd for archives stored as
+	// <branch>.zip.zst. Encryption is EncryptionAES256GCM for archives
+	// encrypted at rest, under the key with ID KeyID. StoredSize is the
+	// size on disk of compressed or encrypted archives.
+	Compression string `json:"compression,omitempty"`
+	Encryption  string `json:"encryption,omitempty"`
+	KeyID       string `json:"key_id,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
+	// Signature is the Ed25519 signature (base64) of SHA256 by the signing
+	// key SignatureKeyID, when archives are signed (see Storage.Signer).
+	Signature      string `json:"signature,omitempty"`
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+	// Previous lists archives kept by KeepPrevious, newest first.
+	Previous []RetainedArchive `json:"previous,omitempty"`
+	// Pinned is set by Rollback; a pinned archive is served without
+	// checking upstream until a forced refresh.
+	Pinned bool `json:"pinned,omitempty"`
+	// Protected is set by Pin: expiry, retention and low-space eviction
+	// never remove the archive. Unlike Pinned it does not change how the
+	// archive is served, and a refresh keeps it.
+	Protected bool `json:"protected,omitempty"`
+	// Tier is the Storage.Tiers tier holding the archive (1 is the first
+	// slower one); 0 when it is in Root.
+	Tier int `json:"tier,omitempty"`
+}
+
+// storedSize is the archive's expected size on disk.
+func (m *ArchiveMeta) storedSize() int64 {
+	if m.Compression != "" || m.Encryption != "" {
+		return m.StoredSize
+	}
+	return m.Size
+}
+
+func archiveMetaPath(zipPath string) string {
+	return strings.TrimSuffix(zipPath, ".zip") + ".meta.json"
+}
+
+func writeArchiveMeta(zipPath string, meta *ArchiveMeta) error {
+	meta.Format = CacheFormat
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(archiveMetaPath(zipPath), b, 0o644)
+}
+
+// readArchiveMeta reads the sidecar, backfilling FetchedAt for sidecars
+// written before it was recorded.
+func readArchiveMeta(zipPath string) (*ArchiveMeta, error) {
+	meta, err := readArchiveMetaFile(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if meta.FetchedAt.IsZero() {
+		backfillFetchedAt(zipPath, meta)
+	}
+	return meta, nil
+}
+
+func readArchiveMetaFile(zipPath string) (*ArchiveMeta, error) {
+	b, err := os.ReadFile(archiveMetaPath(zipPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var meta ArchiveMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// ReadArchiveMeta returns the metadata sidecar for a cached repo zip.
+func (s *Storage) ReadArchiveMeta(zipPath string) (*ArchiveMeta, error) {
+	return readArchiveMeta(zipPath)
+}
+
+// recordArchive hashes a freshly written archive and stores its metadata.
+func (s *Storage) recordArchive(zipPath, ownerRepo, branch, commitSHA string) (*ArchiveMeta, error) {
+	return s.recordArchiveAt(zipPath, ownerRepo, branch, commitSHA, s.Now())
+}
+
+func (s *Storage) recordArchiveAt(zipPath, ownerRepo, branch, commitSHA string, fetchedAt time.Time) (*ArchiveMeta, error) {
+	sum, size, err := s.hashArchive(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	meta := &ArchiveMeta{Repo: ownerRepo, Branch: branch, CommitSHA: commitSHA, SHA256: sum, Size: size, FetchedAt: fetchedAt.UTC()}
+	activated := true
+	if prev, err := readArchiveMetaFile(zipPath); err == nil {
+		meta.Protected = prev.Protected
+		if prev.CommitSHA == commitSHA && commitSHA != "" {
+			meta.ActivatedAt, activated = prev.activatedAt(), false
+		}
+	}
+	if activated {
+		meta.ActivatedAt = meta.FetchedAt
+	}
+	storedInfo(zipPath, meta)
+	s.signMeta(meta)
+	if err := writeArchiveMeta(zipPath, meta); err != nil {
+		return nil, err
+	}
+	if activated {
+		auditActivation(zipPath, meta)
+	}
+	return meta, nil
+}
+
+// activatedAt is when the archive started being served, FetchedAt for
+// sidecars that predate ActivatedAt.
+func (m *ArchiveMeta) activatedAt() time.Time {
+	if m.ActivatedAt.IsZero() {
+		return m.FetchedAt
+	}
+	return m.ActivatedAt
+}
+
+// auditActivation logs that meta's archive is now the one served, with the
+// commit and checksum that ArchiveServedAt answers can be checked against.
+func auditActivation(zipPath string, meta *ArchiveMeta) {
+	fmt.Printf("audit: archive activated repo=%s branch=%s commit=%s sha256=%s at=%s file=%s\n", meta.Repo, meta.Branch, meta.CommitSHA, meta.SHA256, meta.ActivatedAt.UTC().Format(time.RFC3339), filepath.Base(zipPath))
+}
+
+// backfillFetchedAt sets FetchedAt from the archive's mtime, the best record
+// there is for archives cached before fetched-at existed, and saves it.
+func backfillFetchedAt(zipPath string, meta *ArchiveMeta) bool {
+	fi, err := statArchive(zipPath)
+	if err != nil {
+		return false
+	}
+	meta.FetchedAt = fi.ModTime().UTC()
+	return writeArchiveMeta(zipPath, meta) == nil
+}
+
+// BackfillFetchedAt records fetched-at for every cached archive whose
+// sidecar predates it, using the archive's current mtime. Run it before
+// serving so the first download cannot reset the mtime it reads.
+func (s *Storage) BackfillFetchedAt() (int, error) {
+	n := 0
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".meta.json") {
+			return nil
+		}
+		zipPath := strings.TrimSuffix(p, ".meta.json") + ".zip"
+		meta, err := readArchiveMetaFile(zipPath)
+		if err != nil || !meta.FetchedAt.IsZero() {
+			return nil
+		}
+		if backfillFetchedAt(zipPath, meta) {
+			n++
+		}
+		return nil
+	}
+	for _, top := range []string{"users", SharedDir} {
+		if err := filepath.WalkDir(filepath.Join(s.Root, top), walk); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// archiveIntact is the cheap per-hit check: the recorded size must match the
+// file on disk, compressed or not. Archives cached before metadata existed get it backfilled.
+func (s *Storage) archiveIntact(zipPath, ownerRepo, branch, commitSHA string, size int64) bool {
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		fetchedAt := s.Now()
+		if fi, serr := statArchive(zipPath); serr == nil {
+			fetchedAt = fi.ModTime()
+		}
+		_, err = s.recordArchiveAt(zipPath, ownerRepo, branch, commitSHA, fetchedAt)
+		return err == nil
+	}
+	return meta.storedSize() == size
+}
+
+// VerifyArchive recomputes the archive checksum and compares it with the
+// recorded one, decoding compressed and encrypted archives. On mismatch, or
+// when a compressed or encrypted archive no longer decodes, the archive and its sidecars are removed so the
+// next EnsureRepo downloads a fresh copy, and ErrChecksumMismatch is returned.
+func (s *Storage) VerifyArchive(zipPath string) error {
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return err
+	}
+	sum, size, err := s.hashArchive(zipPath)
+	if errors.Is(err, zstd.ErrCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrChecksumMismatch) {
+		removeArchive(zipPath)
+		return fmt.Errorf("%s: %v: %w", zipPath, err, ErrChecksumMismatch)
+	}
+	if err != nil {
+		return err
+	}
+	if sum != meta.SHA256 || size != meta.Size {
+		removeArchive(zipPath)
+		return fmt.Errorf("%s: %w", zipPath, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// removeArchive deletes a cached archive together with all of its sidecars.
+// It is the recovery path for archives found to be corrupt.
+func removeArchive(zipPath string) {
+	base := strings.TrimSuffix(zipPath, ".zip")
+	removeStored(zipPath)
+	_ = os.Remove(zipPath + ".meta")
+	_ = os.Remove(base + ".commit.txt")
+	_ = os.Remove(base + ".info.json")
+	_ = os.Remove(base + ".meta.json")
+	_ = os.Remove(base + ".gone")
+	_ = os.Remove(manifestPath(zipPath))
+	_ = os.Remove(segmentsPath(zipPath))
+	removeNormalized(zipPath)
+}
+
+// RemoveArchive deletes a cached repo archive and its sidecars. zipPath must
+// be an archive under Root/users or Root/shared as returned by EnsureRepo.
+func (s *Storage) RemoveArchive(zipPath string) error {
+	rel, err := filepath.Rel(s.Root, zipPath)
+	if err != nil || !strings.HasSuffix(zipPath, ".zip") {
+		return fmt.Errorf("not a cached archive %q: %w", zipPath, ErrBadPath)
+	}
+	parts := splitPath(rel)
+	perUser := len(parts) >= 6 && parts[0] == "users" && parts[2] == "repos"
+	shared := len(parts) >= 5 && parts[0] == SharedDir && parts[1] == "repos"
+	if !(perUser || shared) || strings.Contains(filepath.ToSlash(rel), "..") {
+		return fmt.Errorf("not a cached archive %q: %w", zipPath, ErrBadPath)
+	}
+	if _, err := statArchive(zipPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	removeArchive(zipPath)
+	s.trimRepoDir(filepath.Dir(zipPath))
+	return nil
+}
@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// normalizedDOSDate is the MS-DOS date of every entry in a normalized
+// archive: 1980-01-01, the earliest a zip can express, at 00:00.
+const normalizedDOSDate = 1<<5 | 1
+
+// NormalizedMeta is the sidecar (<branch>.normalized.json) of a normalized
+// archive. SourceSHA256 is the checksum of the archive it was made from; a
+// different one means the branch moved and the repack is redone.
+type NormalizedMeta struct {
+	SourceSHA256 string `json:"source_sha256"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+	// Prefix is the top-level folder of a PrefixedArchive repack.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// RootMode selects the top-level folder of a repacked archive.
+type RootMode string
+
+const (
+	// RootRepo names the folder after the repository (<repo>/).
+	RootRepo RootMode = "repo"
+	// RootNone drops the folder so entries sit at the top of the zip.
+	RootNone RootMode = "none"
+	// RootKeep leaves the folder as fetched (<repo>-<sha>/ for zipballs).
+	RootKeep RootMode = "keep"
+)
+
+// rootModes lists every mode, for cleanup of the per-mode repacks.
+var rootModes = []RootMode{RootRepo, RootNone, RootKeep}
+
+// ParseRootMode parses a root= value; empty means RootRepo.
+func ParseRootMode(v string) (RootMode, error) {
+	switch m := RootMode(strings.ToLower(strings.TrimSpace(v))); m {
+	case "":
+		return RootRepo, nil
+	case RootRepo, RootNone, RootKeep:
+		return m, nil
+	}
+	return "", fmt.Errorf("root must be %q, %q or %q, got %q", RootRepo, RootNone, RootKeep, v)
+}
+
+// normalizedSuffix keeps the RootRepo repack at its original name and gives
+// each other mode its own file.
+func normalizedSuffix(root RootMode) string {
+	if root == RootRepo || root == "" {
+		return ".normalized"
+	}
+	return ".normalized-" + string(root)
+}
+
+func normalizedPath(zipPath string, root RootMode) string {
+	return zipPath + normalizedSuffix(root)
+}
+
+func normalizedMetaPath(zipPath string, root RootMode) string {
+	return strings.TrimSuffix(zipPath, ".zip") + normalizedSuffix(root) + ".json"
+}
+
+// prefixSuffix names the repack of one prefix by a digest of it, since a
+// prefix may hold slashes.
+func prefixSuffix(prefix string) string {
+	sum := sha256.Sum256([]byte(prefix))
+	return ".normalized-prefix-" + hex.EncodeToString(sum[:8])
+}
+
+// removeNormalized deletes the repacks of every root mode and prefix.
+func removeNormalized(zipPath string) {
+	for _, m := range rootModes {
+		_ = os.Remove(normalizedPath(zipPath, m))
+		_ = os.Remove(normalizedMetaPath(zipPath, m))
+	}
+	entries, err := os.ReadDir(filepath.Dir(zipPath))
+	if err != nil {
+		return
+	}
+	zipPrefix := filepath.Base(zipPath) + ".normalized-prefix-"
+	metaPrefix := strings.TrimSuffix(filepath.Base(zipPath), ".zip") + ".normalized-prefix-"
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, zipPrefix) || (strings.HasPrefix(name, metaPrefix) && strings.HasSuffix(name, ".json")) {
+			_ = os.Remove(filepath.Join(filepath.Dir(zipPath), name))
+		}
+	}
+}
+
+// maxPrefixLen bounds an archive prefix.
+const maxPrefixLen = 200
+
+// ParseArchivePrefix validates a prefix= value, the top-level folder of a
+// PrefixedArchive. It is one or more slash-separated segments of letters,
+// digits and "._+@-", none of them "." or ".."; a trailing slash is
+// dropped.
+func ParseArchivePrefix(v string) (string, error) {
+	p := strings.TrimSuffix(strings.TrimSpace(v), "/")
+	if p == "" {
+		return "", errors.New("prefix must not be empty")
+	}
+	if len(p) > maxPrefixLen {
+		return "", fmt.Errorf("prefix is longer than %d bytes", maxPrefixLen)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("prefix %q must not be absolute or contain empty, \".\" or \"..\" segments", v)
+		}
+		for _, c := range seg {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._+@-", c)) {
+				return "", fmt.Errorf("prefix %q contains %q; use letters, digits and ._+@-", v, c)
+			}
+		}
+	}
+	return p, nil
+}
+
+// repoFolder is the RootRepo folder name of an archive: the repository name
+// from its metadata, else the name of its repo directory.
+func repoFolder(zipPath string) string {
+	if meta, err := readArchiveMeta(zipPath); err == nil && strings.Contains(meta.Repo, "/") {
+		return meta.Repo[strings.LastIndex(meta.Repo, "/")+1:]
+	}
+	return filepath.Base(filepath.Dir(zipPath))
+}
+
+// rootNames maps each entry of files to its name under root, "" for the
+// dropped top-level folder itself. It fails with ErrExists when two entries
+// land on the same path or a file lands where another entry needs a
+// directory, which flattening can cause, so nothing is overwritten silently.
+func rootNames(files []*zip.File, root RootMode, folder string) ([]string, error) {
+	names := make([]string, len(files))
+	kinds := map[string]bool{} // path -> is a directory
+	for i, f := range files {
+		name := f.Name
+		if root != RootKeep {
+			rest := name
+			if _, after, ok := strings.Cut(name, "/"); ok {
+				rest = after
+			}
+			name = rest
+			if root == RootRepo {
+				name = folder + "/" + rest
+			}
+		}
+		names[i] = name
+		if name == "" {
+			continue
+		}
+		isDir := strings.HasSuffix(name, "/")
+		p := strings.TrimSuffix(name, "/")
+		if dir, ok := kinds[p]; ok && !(dir && isDir) {
+			return nil, fmt.Errorf("entry %q collides with another entry at %q with root=%s: %w", f.Name, p, root, ErrExists)
+		}
+		kinds[p] = isDir
+		for d := path.Dir(p); d != "." && d != "/"; d = path.Dir(d) {
+			if dir, ok := kinds[d]; ok {
+				if !dir {
+					return nil, fmt.Errorf("entry %q needs directory %q, which is a file with root=%s: %w", f.Name, d, root, ErrExists)
+				}
+				break
+			}
+			kinds[d] = true
+		}
+	}
+	return names, nil
+}
+
+// NormalizedArchive returns a deterministic repack of a cached archive: the
+// top-level folder (which GitHub names after the commit) becomes <repo>/,
+// is dropped or is kept as root says (empty means RootRepo), entries are sorted by name, every timestamp is 1980-01-01 00:00, modes are
+// 0644, 0755 for executables and directories, and the archive comment is
+// dropped. Identical trees therefore give identical bytes whichever way they
+// were fetched. The repack is cached next to the archive and redone only
+// when the archive changes. The result's SHA256 and Size describe the
+// normalized file.
+func (s *Storage) NormalizedArchive(zipPath string, root RootMode) (*RepoArchive, error) {
+	if root == "" {
+		root = RootRepo
+	}
+	return s.normalized(zipPath, root, repoFolder(zipPath), "", normalizedPath(zipPath, root), normalizedMetaPath(zipPath, root))
+}
+
+// PrefixedArchive is NormalizedArchive with the top-level folder renamed to
+// prefix, which must have passed ParseArchivePrefix, for vendoring tools
+// that expect a fixed folder (Bazel's strip_prefix). Each prefix is cached
+// as its own repack of the archive.
+func (s *Storage) PrefixedArchive(zipPath, prefix string) (*RepoArchive, error) {
+	if _, err := ParseArchivePrefix(prefix); err != nil {
+		return nil, err
+	}
+	suffix := prefixSuffix(prefix)
+	return s.normalized(zipPath, RootRepo, prefix, prefix, zipPath+suffix, strings.TrimSuffix(zipPath, ".zip")+suffix+".json")
+}
+
+// normalized returns the repack of zipPath with root and folder, cached at
+// dst with its sidecar at metaPath.
+func (s *Storage) normalized(zipPath string, root RootMode, folder, prefix, dst, metaPath string) (*RepoArchive, error) {
+	res := archiveResult(zipPath, s.ShortSHALen)
+	if res.SHA256 == "" {
+		sum, _, err := s.hashArchive(zipPath)
+		if err != nil {
+			return nil, err
+		}
+		res.SHA256 = sum
+	}
+	out := *res
+	out.Path, out.Compressed, out.Encrypted = dst, false, false
+	if nm, err := readNormalizedMeta(metaPath); err == nil && nm.SourceSHA256 == res.SHA256 && nm.Prefix == prefix {
+		if size, err := plainSize(out.Path); err == nil && size == nm.Size {
+			out.SHA256, out.Size = nm.SHA256, nm.Size
+			out.Encrypted = sealInfo(out.Path) != nil
+			return &out, nil
+		}
+	}
+
+	sum, size, err := s.repack(zipPath, out.Path, root, folder)
+	if err != nil {
+		return nil, fmt.Errorf("normalize %s: %w", zipPath, err)
+	}
+	nm := &NormalizedMeta{SourceSHA256: res.SHA256, SHA256: sum, Size: size, Prefix: prefix}
+	if b, err := json.MarshalIndent(nm, "", "  "); err == nil {
+		_ = os.WriteFile(metaPath, b, 0o644)
+	}
+	if prefix != "" {
+		fmt.Printf("normalized %s prefix=%s (%d bytes)\n", zipPath, prefix, size)
+	} else {
+		fmt.Printf("normalized %s root=%s (%d bytes)\n", zipPath, root, size)
+	}
+	out.SHA256, out.Size = sum, size
+	out.Encrypted = s.Keys != nil
+	return &out, nil
+}
+
+func readNormalizedMeta(metaPath string) (*NormalizedMeta, error) {
+	b, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var nm NormalizedMeta
+	if err := json.Unmarshal(b, &nm); err != nil {
+		return nil, err
+	}
+	return &nm, nil
+}
+
+// repack writes the normalized form of zipPath to dst, with folder as the
+// RootRepo folder, and returns its checksum and size.
+func (s *Storage) repack(zipPath, dst string, root RootMode, folder string) (string, int64, error) {
+	raw, done, err := s.RawArchive(zipPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer done()
+	zr, err := zip.OpenReader(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = zr.Close() }()
+
+	type entry struct {
+		name string
+		f    *zip.File
+	}
+	names, err := rootNames(zr.File, root, folder)
+	if err != nil {
+		return "", 0, err
+	}
+	var entries []entry
+	for i, f := range zr.File {
+		if names[i] != "" {
+			entries = append(entries, entry{names[i], f})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-normalize-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) (string, int64, error) {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return "", 0, err
+	}
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(tmp, h)}
+	zw := zip.NewWriter(cw)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, ModifiedDate: normalizedDOSDate}
+		mode := e.f.Mode()
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Method = zip.Store
+			hdr.SetMode(fs.ModeDir | 0o755)
+		case mode&fs.ModeSymlink != 0:
+			hdr.SetMode(fs.ModeSymlink | 0o777)
+		case mode&0o111 != 0:
+			hdr.SetMode(0o755)
+		default:
+			hdr.SetMode(0o644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return fail(err)
+		}
+		if hdr.Method == zip.Store {
+			continue
+		}
+		rc, err := e.f.Open()
+		if err != nil {
+			return fail(err)
+		}
+		_, err = io.Copy(w, rc)
+		_ = rc.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", 0, err
+	}
+	if s.Keys != nil {
+		sealed, err := s.sealBeside(tmpPath, dst)
+		_ = os.Remove(tmpPath)
+		if err != nil {
+			return "", 0, err
+		}
+		tmpPath = sealed
+	}
+	if err := s.replaceFile(tmpPath, dst); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), cw.n, nil
+}
+
+// RerootArchive streams the cached archive to w with its entries renamed for
+// root, copying the compressed data as is, and returns the bytes written.
+// Unlike NormalizedArchive nothing else changes and nothing is cached.
+// Collisions are reported before anything is written.
+func (s *Storage) RerootArchive(w io.Writer, zipPath string, root RootMode) (int64, error) {
+	raw, done, err := s.RawArchive(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	zr, err := zip.OpenReader(raw)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = zr.Close() }()
+	names, err := rootNames(zr.File, root, repoFolder(zipPath))
+	if err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	zw := zip.NewWriter(cw)
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return cw.n, err
+	}
+	for i, f := range zr.File {
+		if names[i] == "" {
+			continue
+		}
+		hdr := f.FileHeader
+		hdr.Name = names[i]
+		dst, err := zw.CreateRaw(&hdr)
+		if err != nil {
+			return cw.n, err
+		}
+		src, err := f.OpenRaw()
+		if err != nil {
+			return cw.n, err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			return cw.n, err
+		}
+	}
+	err = zw.Close()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
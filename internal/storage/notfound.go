@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// NotFoundError is an upstream 404 for a repository or one of its
+// branches. It wraps ErrRepoNotFound when Branch is empty and
+// ErrBranchNotFound otherwise.
+type NotFoundError struct {
+	Repo   string
+	Branch string
+	// Token reports whether the request carried a token. GitHub answers
+	// 404, not 403, for private repositories the caller cannot see, so a
+	// missing repository may only be a missing or insufficient token.
+	Token bool
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Branch != "" {
+		return fmt.Sprintf("%s: %s@%s", ErrBranchNotFound, e.Repo, e.Branch)
+	}
+	if e.Token {
+		return fmt.Sprintf("%s or token lacks access: %s", ErrRepoNotFound, e.Repo)
+	}
+	return fmt.Sprintf("%s: %s (no token sent; private repositories need one)", ErrRepoNotFound, e.Repo)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	if e.Branch != "" {
+		return ErrBranchNotFound
+	}
+	return ErrRepoNotFound
+}
+
+// repoMissing reports whether a 404 body from a repository endpoint means
+// the repository itself is missing (GitHub's bare "Not Found") rather than
+// the object asked for within it, e.g. "Branch not found".
+func repoMissing(body []byte) bool {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	return json.Unmarshal(body, &msg) == nil && strings.EqualFold(strings.TrimSpace(msg.Message), "Not Found")
+}
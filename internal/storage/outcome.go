@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// CacheOutcome describes how a request for a cached artifact was satisfied.
+type CacheOutcome string
+
+const (
+	// CacheHit is a cached artifact served without asking upstream
+	// (packages, pinned archives, archives requested by commit).
+	CacheHit CacheOutcome = "hit"
+	// CacheRevalidated is a cached archive served after upstream confirmed
+	// it is still current.
+	CacheRevalidated CacheOutcome = "revalidated"
+	// CacheMiss is an artifact that had to be fetched.
+	CacheMiss CacheOutcome = "miss"
+)
+
+type outcomeKey struct{}
+
+// WithOutcome returns a context in which EnsureRepo/EnsurePackage record
+// their cache outcome into dst.
+func WithOutcome(ctx context.Context, dst *CacheOutcome) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, dst)
+}
+
+// ReportOutcome records o for a caller that prepared ctx with WithOutcome.
+// Alternative Store implementations can use it to report their own outcomes.
+func ReportOutcome(ctx context.Context, o CacheOutcome) {
+	if dst, ok := ctx.Value(outcomeKey{}).(*CacheOutcome); ok && dst != nil {
+		*dst = o
+	}
+}
+
+type downloadedKey struct{}
+
+// WithDownloadedBytes returns a context in which upstream downloads made
+// for it add their size to dst, e.g. to charge them to the user who asked.
+// A download shared by several callers is charged to the one that started
+// it.
+func WithDownloadedBytes(ctx context.Context, dst *atomic.Int64) context.Context {
+	return context.WithValue(ctx, downloadedKey{}, dst)
+}
+
+func reportDownloaded(ctx context.Context, n int64) {
+	if dst, ok := ctx.Value(downloadedKey{}).(*atomic.Int64); ok && dst != nil {
+		dst.Add(n)
+	}
+}
+
+type backgroundKey struct{}
+
+// withBackground marks ctx as a background revalidation: the cache counters
+// are left alone and served archives keep their last access time, so cleanup
+// and the hit rate only see real requests.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func background(ctx context.Context) bool {
+	b, _ := ctx.Value(backgroundKey{}).(bool)
+	return b
+}
+
+// Counters is a snapshot of storage-level activity since start.
+type Counters struct {
+	// CacheHits counts revalidated archives as well as plain hits.
+	CacheHits        int64
+	CacheMisses      int64
+	Downloads        int64
+	DownloadFailures int64
+	DownloadedBytes  int64
+	// CollapsedLookups counts default-branch and branch-SHA lookups that
+	// shared another caller's in-flight GitHub request.
+	CollapsedLookups int64
+	// SkippedRevalidations counts archives served within a request's max
+	// age (WithMaxAge) without asking upstream for the branch's commit.
+	SkippedRevalidations int64
+	// UpstreamDials counts connections the default transport opened;
+	// UpstreamReusedConns counts upstream requests it served on a pooled
+	// connection instead. Both stay zero with a caller's HTTPClient.
+	UpstreamDials       int64
+	UpstreamReusedConns int64
+	// SlowDownloads counts downloads below SlowDownloadThreshold.
+	SlowDownloads int64
+}
+
+type counters struct {
+	cacheHits        atomic.Int64
+	cacheMisses      atomic.Int64
+	downloads        atomic.Int64
+	downloadFailures atomic.Int64
+	downloadedBytes  atomic.Int64
+	collapsedLookups atomic.Int64
+
+	skippedRevalidations atomic.Int64
+	dials                atomic.Int64
+	reusedConns          atomic.Int64
+	slowDownloads        atomic.Int64
+}
+
+// Counters returns a snapshot of the storage counters.
+func (s *Storage) Counters() Counters {
+	return Counters{
+		CacheHits:        s.stats.cacheHits.Load(),
+		CacheMisses:      s.stats.cacheMisses.Load(),
+		Downloads:        s.stats.downloads.Load(),
+		DownloadFailures: s.stats.downloadFailures.Load(),
+		DownloadedBytes:  s.stats.downloadedBytes.Load(),
+		CollapsedLookups: s.stats.collapsedLookups.Load(),
+
+		SkippedRevalidations: s.stats.skippedRevalidations.Load(),
+		UpstreamDials:        s.stats.dials.Load(),
+		UpstreamReusedConns:  s.stats.reusedConns.Load(),
+		SlowDownloads:        s.stats.slowDownloads.Load(),
+	}
+}
+
+func (s *Storage) noteHit(ctx context.Context) {
+	if !background(ctx) {
+		s.stats.cacheHits.Add(1)
+	}
+	ReportOutcome(ctx, CacheHit)
+}
+
+func (s *Storage) noteRevalidated(ctx context.Context) {
+	if !background(ctx) {
+		s.stats.cacheHits.Add(1)
+	}
+	ReportOutcome(ctx, CacheRevalidated)
+}
+
+func (s *Storage) noteMiss(ctx context.Context) {
+	if !background(ctx) {
+		s.stats.cacheMisses.Add(1)
+	}
+	ReportOutcome(ctx, CacheMiss)
+}
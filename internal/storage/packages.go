@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadScheme prefixes the synthetic URLs under which uploaded packages are
+// cached; they can be fetched like any other package URL but never
+// downloaded from upstream.
+const UploadScheme = "upload://"
+
+var (
+	// ErrTooLarge reports an upload over the configured size limit.
+	ErrTooLarge = errors.New("upload too large")
+	// ErrExists reports an upload to a key that is already cached, or a
+	// trash restore onto a path that exists again.
+	ErrExists = errors.New("already exists")
+)
+
+// packageMetaName is the sidecar written into each package's hash
+// directory; it records the URL the hash was derived from.
+const packageMetaName = ".package.json"
+
+// PackageMeta describes a cached package. LastAccess is the package file's
+// mtime, which EnsurePackage bumps on every hit.
+type PackageMeta struct {
+	// Format is as in ArchiveMeta.
+	Format int    `json:"format,omitempty"`
+	URL    string `json:"url"`
+	// FinalURL is where the package was served from when that was not URL:
+	// a mirror (see PackageMirrors) or a redirect. Source is SourceMirror
+	// or SourceOrigin.
+	FinalURL string `json:"final_url,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Filename string `json:"filename"`
+	Hash     string `json:"hash"`
+	// Size is the size on disk; SHA256 is the digest of the plain bytes.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Encryption and KeyID are set for packages encrypted at rest, as in
+	// ArchiveMeta.
+	Encryption string    `json:"encryption,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// packageFilename derives the cached file name from a package URL.
+func packageFilename(pkgURL string) string {
+	u, _ := url.Parse(pkgURL)
+	filename := ""
+	if u != nil {
+		filename = filepath.Base(u.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = filepath.Base(pkgURL)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "package.bin"
+	}
+	return filename
+}
+
+func packageUser(user string) (string, error) {
+	user = sanitizeName(strings.Trim(user, "/ "))
+	if user == "" {
+		user = "default"
+	}
+	if user == "." || strings.Contains(user, "..") {
+		return "", fmt.Errorf("invalid user: %w", ErrBadPath)
+	}
+	return user, nil
+}
+
+// recordPackage hashes a freshly installed package and writes its sidecar.
+func (s *Storage) recordPackage(pkgPath, pkgURL, finalURL, source string) error {
+	sum, _, err := s.hashArchive(pkgPath)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(pkgPath)
+	if err != nil {
+		return err
+	}
+	meta := PackageMeta{Format: CacheFormat, URL: pkgURL, Filename: filepath.Base(pkgPath), Hash: filepath.Base(filepath.Dir(pkgPath)), Size: fi.Size(), SHA256: sum, Source: source}
+	if finalURL != pkgURL {
+		meta.FinalURL = finalURL
+	}
+	sealedInfo(pkgPath, &meta)
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(filepath.Dir(pkgPath), packageMetaName), b, 0o644)
+}
+
+// sealPackage encrypts a downloaded package at tmpPath into a temp file
+// beside pkgPath when Keys is set, removes tmpPath and returns the file to
+// install. Without Keys it returns tmpPath.
+func (s *Storage) sealPackage(tmpPath, pkgPath string) (string, error) {
+	if s.Keys == nil {
+		return tmpPath, nil
+	}
+	sealed, err := s.sealBeside(tmpPath, pkgPath)
+	_ = os.Remove(tmpPath)
+	return sealed, err
+}
+
+// sealedInfo fills meta's encryption fields from the package on disk.
+func sealedInfo(pkgPath string, meta *PackageMeta) {
+	meta.Encryption, meta.KeyID = "", ""
+	if h := sealInfo(pkgPath); h != nil {
+		meta.Encryption, meta.KeyID = EncryptionAES256GCM, h.keyID
+	}
+}
+
+// readPackageDir describes the package cached in dir. Packages cached before
+// sidecars existed are reported without URL and digest.
+func readPackageDir(dir string) (*PackageMeta, error) {
+	meta := &PackageMeta{Hash: filepath.Base(dir)}
+	if b, err := os.ReadFile(filepath.Join(dir, packageMetaName)); err == nil {
+		if err := json.Unmarshal(b, meta); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if meta.Filename != "" && name != meta.Filename {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		meta.Filename = name
+		meta.Size = info.Size()
+		meta.LastAccess = info.ModTime().UTC()
+		sealedInfo(filepath.Join(dir, name), meta)
+		return meta, nil
+	}
+	return nil, ErrNotFound
+}
+
+// packagesBase is the directory holding the user's cached packages.
+func (s *Storage) packagesBase(user string) (string, error) {
+	user, err := packageUser(user)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "users", user, "packages"), nil
+}
+
+// ListPackages returns the user's cached packages, most recently used first.
+func (s *Storage) ListPackages(user string) ([]PackageMeta, error) {
+	out := make([]PackageMeta, 0)
+	err := s.EachPackage(user, func(meta PackageMeta) error {
+		out = append(out, meta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastAccess.After(out[j].LastAccess) })
+	return out, nil
+}
+
+// LookupPackage reports whether pkgURL is cached for user without fetching
+// it; it returns ErrNotFound when it is not.
+func (s *Storage) LookupPackage(user, pkgURL string) (*PackageMeta, error) {
+	user, err := packageUser(user)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.Root, "users", user, "packages", PackageHash(pkgURL))
+	meta, err := readPackageDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if meta.URL == "" {
+		meta.URL = pkgURL
+	}
+	return meta, nil
+}
+
+// DeletePackage removes the cached copy of pkgURL and its hash directory.
+func (s *Storage) DeletePackage(user, pkgURL string) error {
+	user, err := packageUser(user)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.Root, "users", user, "packages", PackageHash(pkgURL))
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("package %s: %w", pkgURL, ErrNotFound)
+		}
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	trimEmpty(filepath.Dir(dir), filepath.Join(s.Root, "users"))
+	return nil
+}
+
+// UploadURL returns the synthetic package URL for an upload key such as
+// "ci/build-42/tool.tgz". The key's last segment is the cached file name.
+func UploadURL(key string) (string, error) {
+	key = strings.Trim(strings.TrimSpace(filepath.ToSlash(key)), "/")
+	if key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, "\\?#") {
+		return "", fmt.Errorf("invalid upload key %q: %w", key, ErrBadPath)
+	}
+	return UploadScheme + key, nil
+}
+
+// StorePackage caches body as the package for key (see UploadURL), reading
+// at most maxBytes (0 = unlimited). The body is streamed to a temp file and
+// hashed on the way; an existing package is only replaced with overwrite.
+func (s *Storage) StorePackage(user, key string, body io.Reader, maxBytes int64, overwrite bool) (*PackageMeta, error) {
+	user, err := packageUser(user)
+	if err != nil {
+		return nil, err
+	}
+	pkgURL, err := UploadURL(key)
+	if err != nil {
+		return nil, err
+	}
+	hashStr := PackageHash(pkgURL)
+	pkgDir := filepath.Join(s.Root, "users", user, "packages", hashStr)
+	pkgPath := filepath.Join(pkgDir, packageFilename(pkgURL))
+	if _, err := os.Stat(pkgPath); err == nil && !overwrite {
+		return nil, fmt.Errorf("%s: %w", pkgURL, ErrExists)
+	}
+	if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(pkgDir, ".tmp-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	h := sha256.New()
+	src := body
+	if maxBytes > 0 {
+		src = io.LimitReader(body, maxBytes+1)
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if err == nil && maxBytes > 0 && n > maxBytes {
+		err = fmt.Errorf("limit is %d bytes: %w", maxBytes, ErrTooLarge)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		trimEmpty(pkgDir, filepath.Join(s.Root, "users"))
+		return nil, err
+	}
+	if tmpPath, err = s.sealPackage(tmpPath, pkgPath); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(pkgPath)
+	if err := s.replaceFile(tmpPath, pkgPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	meta := &PackageMeta{Format: CacheFormat, URL: pkgURL, Filename: filepath.Base(pkgPath), Hash: hashStr, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	if fi, err := os.Stat(pkgPath); err == nil {
+		meta.Size = fi.Size()
+	}
+	sealedInfo(pkgPath, meta)
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, packageMetaName), b, 0o644); err != nil {
+		return nil, err
+	}
+	meta.LastAccess = s.Now().UTC()
+	fmt.Printf("package upload ok user=%s url=%s size=%d\n", user, pkgURL, n)
+	return meta, nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultPatchMaxBytes caps a Patch when its caller sets no limit.
+const DefaultPatchMaxBytes = 10 << 20
+
+// Where the diff of a Patch came from.
+const (
+	// PatchFromCache: both commits were retained archives, diffed locally.
+	PatchFromCache = "cache"
+	// PatchFromGitHub: the GitHub compare API rendered the diff.
+	PatchFromGitHub = "github"
+)
+
+// Patch is the unified diff of a repository between two commits.
+type Patch struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	// From and To are the commits as given, To resolved to the cached head
+	// when it was not.
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Source string `json:"source"`
+	Body   []byte `json:"-"`
+}
+
+// Patch returns the unified diff of ownerRepo from commit from to commit to
+// (full or abbreviated SHAs). An empty to, or "head", is the commit of the
+// user's cached archive of branch. When both commits are held in the cache
+// (the current archive or one kept by KeepPrevious) the archives are
+// diffed locally; otherwise GitHub's compare API renders the diff. Diffs
+// over maxBytes (0 means DefaultPatchMaxBytes) fail with ErrTooLarge,
+// commits GitHub does not know with ErrNotFound.
+func (s *Storage) Patch(ctx context.Context, user, ownerRepo, branch, from, to, token string, maxBytes int64) (*Patch, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultPatchMaxBytes
+	}
+	from = strings.ToLower(strings.TrimSpace(from))
+	if !shortSHA.MatchString(from) {
+		return nil, fmt.Errorf("invalid from %q: %w", from, ErrBadPath)
+	}
+	to = strings.ToLower(strings.TrimSpace(to))
+	if to == "" || to == "head" {
+		head, err := s.cachedHead(user, ownerRepo, branch)
+		if err != nil {
+			return nil, err
+		}
+		to = head
+	} else if !shortSHA.MatchString(to) {
+		return nil, fmt.Errorf("invalid to %q: %w", to, ErrBadPath)
+	}
+	p := &Patch{Repo: ownerRepo, Branch: branch, From: from, To: to}
+	out := &capWriter{max: maxBytes}
+	fromZip, _, errFrom := s.ArchiveAt(user, ownerRepo, branch, from)
+	toZip, _, errTo := s.ArchiveAt(user, ownerRepo, branch, to)
+	if errFrom == nil && errTo == nil {
+		p.Source = PatchFromCache
+		err = s.diffCached(out, fromZip, toZip)
+	} else {
+		p.Source = PatchFromGitHub
+		err = s.fetchCompareDiff(ctx, out, ownerRepo, from, to, s.tokenFor(ownerRepo, token))
+	}
+	if errors.Is(err, errDiffTooLarge) {
+		return nil, fmt.Errorf("patch %s %s..%s is over %d bytes; download the full archive instead: %w", ownerRepo, shortCommit(from), shortCommit(to), maxBytes, ErrTooLarge)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Body = out.buf.Bytes()
+	return p, nil
+}
+
+// cachedHead is the commit of the user's current archive of branch,
+// preferring the git-mode archive.
+func (s *Storage) cachedHead(user, ownerRepo, branch string) (string, error) {
+	for _, zipPath := range s.branchArchives(user, ownerRepo, branch) {
+		if meta, err := readArchiveMeta(zipPath); err == nil && meta.CommitSHA != "" && archiveExists(zipPath) {
+			return strings.ToLower(meta.CommitSHA), nil
+		}
+	}
+	return "", fmt.Errorf("no cached archive of %s@%s to diff against; pass to: %w", ownerRepo, branch, ErrNotFound)
+}
+
+// diffCached diffs two cached archives, decoded from however they are
+// stored.
+func (s *Storage) diffCached(w io.Writer, fromZip, toZip string) error {
+	var readers [2]*zip.Reader
+	for i, zipPath := range []string{fromZip, toZip} {
+		raw, done, err := s.RawArchive(zipPath)
+		if err != nil {
+			return err
+		}
+		defer done()
+		zr, err := zip.OpenReader(raw)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = zr.Close() }()
+		readers[i] = &zr.Reader
+	}
+	return diffArchives(w, readers[0], readers[1])
+}
+
+// fetchCompareDiff copies GitHub's diff of from...to into w.
+func (s *Storage) fetchCompareDiff(ctx context.Context, w io.Writer, ownerRepo, from, to, token string) error {
+	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/compare/%s...%s", ownerRepo, from, to)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.diff")
+	if strings.TrimSpace(token) != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case isRateLimited(resp):
+		return rateLimitError(resp, fmt.Errorf("compare: status=%d", resp.StatusCode))
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("compare %s %s...%s: repo or commit %w", ownerRepo, shortCommit(from), shortCommit(to), ErrNotFound)
+	case resp.StatusCode == http.StatusNotAcceptable:
+		// GitHub declines to render diffs that are too large.
+		return errDiffTooLarge
+	case resp.StatusCode != http.StatusOK:
+		se, _ := readStatusError("github api", resp)
+		return se
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Package sources recorded in PackageMeta.Source.
+const (
+	SourceOrigin = "origin"
+	SourceMirror = "mirror"
+)
+
+// PackageMirrors rewrites package URLs to internal mirrors before they are
+// downloaded. Packages stay cached under their original URL, so adding,
+// moving or dropping a mirror keeps the cache.
+type PackageMirrors struct {
+	rules []mirrorRule
+}
+
+type mirrorRule struct {
+	host     string
+	path     string // path prefix, "" or starting with "/"
+	base     string // replacement base URL, no trailing slash
+	fallback bool
+}
+
+// NewPackageMirrors builds the rewrite rules. Each rule is
+// "match=base[ fallback]": match is a host or host/path prefix (a scheme is
+// ignored) compared on path segments, and base replaces it, the rest of the
+// path and the query kept. With "fallback" a mirror answering 404 or 5xx
+// is skipped for the original URL. The first matching rule wins.
+func NewPackageMirrors(rules []string) (*PackageMirrors, error) {
+	m := &PackageMirrors{}
+	for _, r := range rules {
+		match, rest, ok := strings.Cut(r, "=")
+		fields := strings.Fields(rest)
+		match = strings.TrimRight(stripScheme(strings.TrimSpace(match)), "/")
+		if !ok || match == "" || len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("package mirror %q must be \"match=base[ fallback]\"", r)
+		}
+		host, path, _ := strings.Cut(match, "/")
+		rule := mirrorRule{host: host, base: strings.TrimRight(fields[0], "/")}
+		if path != "" {
+			rule.path = "/" + path
+		}
+		if len(fields) == 2 {
+			if fields[1] != "fallback" {
+				return nil, fmt.Errorf("package mirror %q: unknown option %q", r, fields[1])
+			}
+			rule.fallback = true
+		}
+		u, err := url.Parse(rule.base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("package mirror %q: base must be an http(s) URL", r)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+func stripScheme(s string) string {
+	if _, rest, ok := strings.Cut(s, "://"); ok {
+		return rest
+	}
+	return s
+}
+
+// Rewrite returns the mirror URL for pkgURL and whether to fall back to
+// pkgURL when the mirror fails; ok is false when no rule matches.
+func (m *PackageMirrors) Rewrite(pkgURL string) (mirrorURL string, fallback, ok bool) {
+	u, err := url.Parse(pkgURL)
+	if err != nil || u.Host == "" {
+		return "", false, false
+	}
+	for _, r := range m.rules {
+		if !strings.EqualFold(u.Host, r.host) {
+			continue
+		}
+		rest, found := strings.CutPrefix(u.EscapedPath(), r.path)
+		if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+		mirrorURL = r.base + rest
+		if u.RawQuery != "" {
+			mirrorURL += "?" + u.RawQuery
+		}
+		return mirrorURL, r.fallback, true
+	}
+	return "", false, false
+}
+
+// Len is the number of rules.
+func (m *PackageMirrors) Len() int {
+	return len(m.rules)
+}
+
+// SetPackageMirrors replaces the package mirror rules; safe to call while
+// serving. nil downloads every package from its own URL.
+func (s *Storage) SetPackageMirrors(m *PackageMirrors) {
+	s.packageMirrors.Store(m)
+}
+
+// downloadPackage downloads pkgURL for user to dest, from its mirror when a
+// rule matches, and returns the URL the bytes came from and their source.
+// PackageHostCheck applies to pkgURL and its connections, not to the
+// mirror's, which is the operator's own host; both checks and the package
+// policy apply to every redirect hop.
+func (s *Storage) downloadPackage(ctx context.Context, user, pkgURL, dest string) (finalURL, source string, err error) {
+	if err := s.checkPackageURL(ctx, pkgURL); err != nil {
+		return "", "", err
+	}
+	if m := s.packageMirrors.Load(); m != nil {
+		if mirrorURL, fallback, ok := m.Rewrite(pkgURL); ok {
+			var mirrorHost string
+			if u, err := url.Parse(mirrorURL); err == nil {
+				mirrorHost = u.Hostname()
+			}
+			finalURL, err := s.downloadFile(s.withDialCheck(ctx, mirrorHost), user, mirrorURL, dest)
+			if err == nil {
+				return finalURL, SourceMirror, nil
+			}
+			if !fallback || !mirrorFailed(err) {
+				return "", "", fmt.Errorf("package mirror: %w", err)
+			}
+			fmt.Printf("package mirror failed, downloading from origin url=%s err=%v\n", pkgURL, err)
+		}
+	}
+	finalURL, err = s.downloadFile(s.withDialCheck(ctx, ""), user, pkgURL, dest)
+	return finalURL, SourceOrigin, err
+}
+
+// mirrorFailed reports whether a mirror download failure warrants trying
+// the original URL: the mirror answered 404 or a server error.
+func mirrorFailed(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.Status == http.StatusNotFound || se.Status >= 500
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// EventPackageDenied is published, with the user and URL, when the package
+// policy refuses a package download; Reason names the rule.
+const EventPackageDenied = "package-denied"
+
+// PackagePolicy decides which package URLs EnsurePackage may download.
+// Rules match "host/path" of the URL (host without port, lowercased, and
+// the decoded path cleaned of "." and ".."):
+// globs where "*" matches within a path segment and "**" across segments,
+// a rule without "/" matching every path on its host ("*.example.com"),
+// or regular expressions when prefixed with "re:". Deny rules win over
+// allow rules; a URL matching neither gets the default action.
+type PackagePolicy struct {
+	allow        []pkgPattern
+	deny         []pkgPattern
+	defaultAllow bool
+}
+
+type pkgPattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// NewPackagePolicy compiles allow and deny rules; defaultAllow is the
+// action for URLs that match neither.
+func NewPackagePolicy(allow, deny []string, defaultAllow bool) (*PackagePolicy, error) {
+	p := &PackagePolicy{defaultAllow: defaultAllow}
+	var err error
+	if p.allow, err = compilePackagePatterns(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = compilePackagePatterns(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func compilePackagePatterns(raw []string) ([]pkgPattern, error) {
+	out := make([]pkgPattern, 0, len(raw))
+	for _, r := range raw {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		expr, ok := strings.CutPrefix(r, "re:")
+		if !ok {
+			expr = globExpr(strings.ToLower(r))
+		}
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("package pattern %q: %w", r, err)
+		}
+		out = append(out, pkgPattern{raw: r, re: re})
+	}
+	return out, nil
+}
+
+// globExpr translates a package glob into a regular expression.
+func globExpr(glob string) string {
+	if !strings.Contains(glob, "/") {
+		glob += "/**"
+	}
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Check returns an error wrapping ErrPolicyDenied when pkgURL may not be
+// downloaded, and the rule that decided. A nil policy allows everything.
+func (p *PackagePolicy) Check(pkgURL string) (rule string, err error) {
+	if p == nil {
+		return "", nil
+	}
+	u, err := url.Parse(pkgURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("package url %.128q: not an absolute URL: %w", pkgURL, ErrBadPath)
+	}
+	// Match the decoded, cleaned path, so "a/../b" and "%62" cannot step
+	// around a rule for b.
+	target := strings.ToLower(u.Hostname()) + path.Clean("/"+u.Path)
+	for _, d := range p.deny {
+		if d.re.MatchString(target) {
+			return d.raw, fmt.Errorf("package url %s matches deny rule %q: %w", redactURL(u), d.raw, ErrPolicyDenied)
+		}
+	}
+	for _, a := range p.allow {
+		if a.re.MatchString(target) {
+			return a.raw, nil
+		}
+	}
+	if !p.defaultAllow {
+		return "default", fmt.Errorf("package url %s is not in the allow list: %w", redactURL(u), ErrPolicyDenied)
+	}
+	return "default", nil
+}
+
+// SetPackagePolicy replaces the package policy; safe to call while serving.
+// nil allows every package URL. The policy is applied to the package URL
+// before anything is requested, cached or not, and to every redirect hop,
+// each time before PackageHostCheck, which still vets the URLs it allows.
+// A denied hop fails with ErrPolicyDenied and ErrRedirectPolicy.
+func (s *Storage) SetPackagePolicy(p *PackagePolicy) {
+	s.packagePolicy.Store(p)
+}
+
+// checkPackagePolicy applies the package policy to a download user asked
+// for. Denials are logged and published as EventPackageDenied, for the
+// audit trail.
+func (s *Storage) checkPackagePolicy(user, pkgURL string) error {
+	rule, err := s.packagePolicy.Load().Check(pkgURL)
+	if err == nil || !errors.Is(err, ErrPolicyDenied) {
+		return err
+	}
+	u, _ := url.Parse(pkgURL)
+	fmt.Printf("audit: package denied user=%s url=%s rule=%q\n", user, redactURL(u), rule)
+	s.emit(Event{Type: EventPackageDenied, User: user, URL: redactURL(u), Reason: rule})
+	return err
+}
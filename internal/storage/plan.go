@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PlanAction is what EnsureRepo would do for a branch.
+type PlanAction string
+
+const (
+	// PlanHit serves the cached archive without asking upstream: it is
+	// pinned by a rollback or within the context's max age.
+	PlanHit PlanAction = "hit"
+	// PlanRevalidate asks upstream for the branch's commit and serves the
+	// cached archive when it still matches.
+	PlanRevalidate PlanAction = "revalidate"
+	// PlanDownload fetches a new archive.
+	PlanDownload PlanAction = "download"
+)
+
+// RepoPlan is what PlanRepo found out about a branch.
+type RepoPlan struct {
+	Repo      string     `json:"repo"`
+	Branch    string     `json:"branch"`
+	Cached    bool       `json:"cached"`
+	CachedSHA string     `json:"cached_sha,omitempty"`
+	RemoteSHA string     `json:"remote_sha,omitempty"`
+	Would     PlanAction `json:"would"`
+	// EstimatedBytes is the size of the cached archive, which a download
+	// replaces with one of about the same size; 0 when nothing is cached.
+	EstimatedBytes int64  `json:"estimated_bytes"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// PlanRepo reports what EnsureRepo with the same arguments (and no force)
+// would do, looking only at the cache: the archive, its metadata and the
+// context's max age. With checkRemote it also asks GitHub for the branch's
+// commit, the one call a revalidation makes, and tells a revalidation
+// that serves the cache from one that downloads. It never downloads,
+// touches or records anything, so an archive planned for is not kept
+// alive by the plan. A missing branch fails with ErrBranchNotFound, and
+// without checkRemote an empty legacy branch needs the default branch to
+// be known locally.
+func (s *Storage) PlanRepo(ctx context.Context, user, ownerRepo, branch, token string, legacy, checkRemote bool) (*RepoPlan, error) {
+	if err := ValidateRef(branch); err != nil {
+		return nil, err
+	}
+	var err error
+	if checkRemote {
+		ownerRepo, err = s.canonicalChecked(ctx, ownerRepo, token)
+	} else {
+		ownerRepo, err = s.localChecked(ownerRepo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, ownerRepo, err = s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	plan := &RepoPlan{Repo: ownerRepo, Branch: branch}
+	if branch == LatestRelease {
+		tag, err := s.planReleaseTag(ctx, user, ownerRepo, token, checkRemote)
+		if err != nil {
+			return nil, err
+		}
+		if tag == "" {
+			plan.Would, plan.Reason = PlanRevalidate, "latest release not known"
+			return plan, nil
+		}
+		branch = tag
+	}
+
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	var zipPath string
+	_, pull := PullNumber(branch)
+	switch {
+	case pull:
+		zipPath = filepath.Join(dir, branch+".zip")
+	case legacy:
+		if branch == "" {
+			branch = s.recordedDefaultBranch(ownerRepo)
+		}
+		if branch == "" && checkRemote {
+			if branch, err = s.fetchDefaultBranch(ctx, ownerRepo, token); err != nil {
+				return nil, fmt.Errorf("fetch default branch: %w", err)
+			}
+		}
+		if branch == "" {
+			return nil, fmt.Errorf("%s: default branch not known: %w", ownerRepo, ErrNotCached)
+		}
+		zipPath = filepath.Join(dir, sanitizeName(branch)+".legacy.zip")
+	default:
+		if branch == "" {
+			branch = "main"
+		}
+		zipPath = filepath.Join(dir, branch+".zip")
+	}
+	plan.Branch = branch
+
+	meta, _ := readArchiveMetaFile(zipPath)
+	if info, err := statArchive(zipPath); err == nil && !info.IsDir() {
+		plan.Cached = true
+		plan.EstimatedBytes = info.Size()
+		if meta != nil && meta.Size > 0 {
+			plan.EstimatedBytes = meta.Size
+		}
+		if meta != nil && meta.FetchedAt.IsZero() {
+			// What readArchiveMeta would backfill, without writing it.
+			m := *meta
+			m.FetchedAt = info.ModTime().UTC()
+			meta = &m
+		}
+		plan.CachedSHA, _ = readSHA(zipPath + ".meta")
+		if plan.CachedSHA == "" && meta != nil {
+			plan.CachedSHA = meta.CommitSHA
+		}
+	}
+	_, gone := os.Stat(gonePath(zipPath))
+	switch {
+	case !plan.Cached:
+		plan.Would, plan.Reason = PlanDownload, "not cached"
+	case meta != nil && meta.Pinned:
+		plan.Would, plan.Reason = PlanHit, "pinned by a rollback"
+		return plan, nil
+	case gone == nil:
+		plan.Would, plan.Reason = PlanRevalidate, "branch was deleted upstream"
+	case meta != nil:
+		if age, ok := s.maxAgeCovers(ctx, zipPath, meta); ok {
+			plan.Would, plan.Reason = PlanHit, fmt.Sprintf("fetched %s ago, within max age", age.Round(time.Second))
+			return plan, nil
+		}
+		plan.Would = PlanRevalidate
+	default:
+		plan.Would = PlanRevalidate
+	}
+	if !checkRemote {
+		return plan, nil
+	}
+
+	remote, err := s.planRemoteSHA(ctx, ownerRepo, branch, token)
+	if err != nil {
+		return nil, err
+	}
+	plan.RemoteSHA = remote
+	switch {
+	case !plan.Cached:
+	case plan.CachedSHA != "" && strings.EqualFold(plan.CachedSHA, remote):
+		plan.Would, plan.Reason = PlanRevalidate, "cached archive is current"
+	default:
+		plan.Would, plan.Reason = PlanDownload, "branch moved upstream"
+	}
+	return plan, nil
+}
+
+// planReleaseTag is the tag LatestRelease would resolve to: asked of
+// GitHub with checkRemote, else the recorded mapping, "" when there is
+// none. Unlike latestReleaseTag it records nothing.
+func (s *Storage) planReleaseTag(ctx context.Context, user, ownerRepo, token string, checkRemote bool) (string, error) {
+	pre := prereleases(ctx)
+	if checkRemote {
+		return s.fetchLatestRelease(ctx, ownerRepo, token, pre)
+	}
+	var all releaseMappings
+	if b, err := os.ReadFile(filepath.Join(s.reposDir(user), ownerRepo, releaseMapName)); err == nil {
+		_ = json.Unmarshal(b, &all)
+	}
+	if recorded := *all.slot(pre); recorded != nil {
+		return recorded.Tag, nil
+	}
+	return "", nil
+}
+
+// planRemoteSHA is the commit a revalidation of branch would compare the
+// cached archive with: the head of a pull request, else what the branch,
+// tag or commit points at.
+func (s *Storage) planRemoteSHA(ctx context.Context, ownerRepo, branch, token string) (string, error) {
+	if n, ok := PullNumber(branch); ok {
+		pr, err := s.fetchPullHead(ctx, ownerRepo, n, token)
+		if err != nil {
+			return "", err
+		}
+		return pr.SHA, nil
+	}
+	sha, err := s.fetchBranchSHA(ctx, ownerRepo, branch, token)
+	if errors.Is(err, errBranchMissing) && s.Fetcher == nil {
+		var info *RefInfo
+		if info, err = s.resolveTagOrCommit(ctx, ownerRepo, branch, token); err == nil {
+			sha = info.SHA
+		}
+	}
+	if errors.Is(err, errBranchMissing) || (errors.Is(err, ErrNotFound) && !errors.Is(err, ErrRepoNotFound)) {
+		return "", fmt.Errorf("%w (%w)", &NotFoundError{Repo: ownerRepo, Branch: branch, Token: strings.TrimSpace(token) != ""}, err)
+	}
+	return sha, err
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pullRefPrefix starts the ref EnsureRepo reads as a pull request: "pr/123"
+// is the head of pull request #123 of the repository. A branch literally
+// named so cannot be downloaded by name.
+const pullRefPrefix = "pr/"
+
+// PullRef returns the ref of pull request number.
+func PullRef(number int) string {
+	return pullRefPrefix + strconv.Itoa(number)
+}
+
+// PullNumber reports whether ref names a pull request ("pr/123") and which.
+func PullNumber(ref string) (int, bool) {
+	v, ok := strings.CutPrefix(ref, pullRefPrefix)
+	if !ok || v == "" || v[0] == '0' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n > 0
+}
+
+// pullHead is what the pulls API says about a pull request's head.
+type pullHead struct {
+	Number int
+	State  string
+	// Repo is the repository the head lives in, a fork for pull requests
+	// from forks; empty when that repository was deleted.
+	Repo string
+	Ref  string
+	SHA  string
+}
+
+// fetchPullHead asks the pulls API for pull request number of ownerRepo.
+func (s *Storage) fetchPullHead(ctx context.Context, ownerRepo string, number int, token string) (*pullHead, error) {
+	if s.Fetcher != nil {
+		return nil, fmt.Errorf("pull request refs need the GitHub pulls API, which a custom fetcher does not provide")
+	}
+	var pr struct {
+		State string `json:"state"`
+		Head  struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo *struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+	}
+	found, err := s.getGitHubJSON(ctx, fmt.Sprintf("https://api.github.com/repos/%s/pulls/%d", ownerRepo, number), token, &pr)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !fullSHA.MatchString(pr.Head.SHA) {
+		return nil, fmt.Errorf("pull request #%d of %s: %w", number, ownerRepo, ErrBranchNotFound)
+	}
+	head := &pullHead{Number: number, State: pr.State, Ref: pr.Head.Ref, SHA: strings.ToLower(pr.Head.SHA)}
+	if pr.Head.Repo != nil {
+		head.Repo = pr.Head.Repo.FullName
+	}
+	return head, nil
+}
+
+// headDeleted reports whether a closed pull request's head is gone: its
+// repository (the fork) was deleted, or its branch was. Open pull requests
+// always have a head to fetch.
+func (s *Storage) headDeleted(ctx context.Context, pr *pullHead, token string) (bool, error) {
+	if pr.State != "closed" {
+		return false, nil
+	}
+	if pr.Repo == "" {
+		return true, nil
+	}
+	_, err := s.fetchBranchSHA(ctx, pr.Repo, pr.Ref, token)
+	if errors.Is(err, errBranchMissing) || errors.Is(err, ErrRepoNotFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+// ensurePullArchive is EnsureRepo for a "pr/<number>" ref: the archive of
+// the pull request's head commit, fetched from the head repository (the
+// fork, for pull requests from forks) and cached under the base repository
+// as pr/<number>.zip, keyed by the head SHA so a push to the pull request
+// replaces it. A closed pull request whose head was deleted fails with a
+// *BranchGoneError.
+func (s *Storage) ensurePullArchive(ctx context.Context, user, ownerRepo string, number int, token string, force bool) (string, error) {
+	user, ownerRepo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	ref := PullRef(number)
+	zipPath := filepath.Join(s.reposDir(user), ownerRepo, ref+".zip")
+	metaPath := zipPath + ".meta"
+	unlock := s.acquire(user, ownerRepo, ref)
+	defer unlock()
+
+	if !force {
+		if err := s.strictCheck(ctx, zipPath, ownerRepo, ref); err != nil {
+			return "", err
+		}
+		if p, ok := s.pinnedArchive(ctx, zipPath); ok {
+			return p, nil
+		}
+		if p, ok := s.withinMaxAge(ctx, zipPath); ok {
+			return p, nil
+		}
+		if onlyIfCached(ctx) {
+			return s.cachedOnly(ctx, zipPath, ownerRepo, ref)
+		}
+	}
+
+	pr, err := s.fetchPullHead(ctx, ownerRepo, number, token)
+	var gone bool
+	if err == nil {
+		gone, err = s.headDeleted(ctx, pr, token)
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		return "", cerr
+	}
+	if err != nil {
+		if force || errors.Is(err, ErrRepoNotFound) || errors.Is(err, ErrBranchNotFound) {
+			return "", err
+		}
+		if p, serr := s.onUnverified(ctx, zipPath, ownerRepo, ref, err); p != "" || serr != nil {
+			return p, serr
+		}
+		// Without the head SHA there is nothing to download.
+		if p, ok := s.fallBackToStale(ctx, zipPath, ownerRepo, ref, err); ok {
+			return p, nil
+		}
+		return "", err
+	}
+	if gone {
+		if archiveExists(zipPath) {
+			return "", s.branchGone(zipPath, ownerRepo, ref)
+		}
+		return "", &BranchGoneError{Repo: ownerRepo, Branch: ref, LastCommit: pr.SHA, Since: s.Now(), shortLen: s.ShortSHALen}
+	}
+
+	parent := filepath.Dir(zipPath)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+	if !force {
+		if info, err := statArchive(zipPath); err == nil && !info.IsDir() {
+			if cachedSHA, err := readSHA(metaPath); err == nil && cachedSHA == pr.SHA {
+				if s.archiveIntact(zipPath, ownerRepo, ref, pr.SHA, info.Size()) {
+					clearGone(zipPath)
+					s.touchServed(ctx, zipPath)
+					s.noteRevalidated(ctx)
+					return zipPath, nil
+				}
+				fmt.Printf("cached archive %s is corrupt, re-downloading\n", zipPath)
+				removeArchive(zipPath)
+			}
+		}
+	}
+
+	// A deleted fork of an open pull request: the base repository still
+	// holds the head commit.
+	headRepo := pr.Repo
+	if headRepo == "" {
+		headRepo = ownerRepo
+	}
+	s.noteMiss(ctx)
+	tmpDir, err := s.tempDirFor(parent)
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, ".tmp-download-*.zip")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	fmt.Printf("downloading %s#%d at %s from %s...\n", ownerRepo, number, shortCommit(pr.SHA), headRepo)
+	if err := s.downloadZip(ctx, headRepo, pr.SHA, token, tmpPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	if ns := noStoreOf(ctx); ns != nil {
+		return ns.keepTransient(tmpPath, zipPath, pr.SHA), nil
+	}
+	oldSHA, _ := readSHA(metaPath)
+	history := s.retainCurrent(zipPath, pr.SHA)
+	if err := s.installArchive(tmpPath, zipPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	base := strings.TrimSuffix(zipPath, ".zip")
+	_ = writeSHA(metaPath, pr.SHA)
+	_ = writeSHA(base+".commit.txt", abbrevSHA(pr.SHA, s.ShortSHALen))
+	_ = writeInfoJSON(base+".info.json", &RepoInfo{Repo: ownerRepo, Branch: ref, CommitSHA: pr.SHA, ChangedFiles: []string{}})
+	clearGone(zipPath)
+	if meta, err := s.recordArchive(zipPath, ownerRepo, ref, pr.SHA); err != nil {
+		fmt.Printf("warning: record archive metadata for %s: %v\n", zipPath, err)
+	} else {
+		recordHistory(zipPath, meta, history)
+	}
+	s.emitRefreshed(zipPath, ownerRepo, ref, oldSHA, pr.SHA)
+	s.touchServed(ctx, zipPath)
+	return zipPath, nil
+}
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BreakerState is the state of the GitHub circuit breaker for one token.
+type BreakerState string
+
+const (
+	// BreakerClosed lets calls through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails calls fast until the advised retry time.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe through after the cool-down;
+	// its outcome closes or reopens the breaker.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+const (
+	defaultSecondaryRetries = 2
+	defaultSecondaryWaitMax = 2 * time.Minute
+	// GitHub asks clients to wait at least a minute when a secondary
+	// limit response carries no Retry-After.
+	defaultSecondaryWait = time.Minute
+)
+
+// RateLimitError is returned when GitHub rate limited a call, or when the
+// breaker refused to send it. RetryAfter is GitHub's advice, zero if none.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Breaker    bool // refused locally while the breaker was open
+}
+
+func (e *RateLimitError) Error() string {
+	msg := ErrRateLimited.Error()
+	if e.Breaker {
+		msg += " (cooling down)"
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf("; retry after %s", e.RetryAfter.Round(time.Second))
+	}
+	return msg
+}
+
+func (e *RateLimitError) Unwrap() error { return ErrRateLimited }
+
+// breaker tracks secondary rate limiting for one token.
+type breaker struct {
+	openUntil time.Time
+	tripped   bool // set until a call succeeds after a trip
+	probing   bool // the half-open probe is in flight
+}
+
+func (b *breaker) state(now time.Time) BreakerState {
+	switch {
+	case !b.tripped:
+		return BreakerClosed
+	case now.Before(b.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// GitHubBreaker reports the circuit breaker for token and, while it is
+// open, when calls will be let through again.
+func (s *Storage) GitHubBreaker(token string) (BreakerState, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.breakers[tokenKey(token)]
+	if b == nil {
+		return BreakerClosed, time.Time{}
+	}
+	st := b.state(s.Now())
+	if st == BreakerOpen {
+		return st, b.openUntil
+	}
+	return st, time.Time{}
+}
+
+// BreakerOpen reports whether any token's breaker is open or half-open.
+func (s *Storage) BreakerOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	for _, b := range s.breakers {
+		if b.state(now) != BreakerClosed {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func requestToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+func isGitHubHost(host string) bool {
+	return host == "github.com" || strings.HasSuffix(host, ".github.com")
+}
+
+// admit applies the breaker before a GitHub call. probe reports that the
+// call is the half-open probe and must be settled with settle.
+func (s *Storage) admit(key string) (probe bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.breakers[key]
+	if b == nil {
+		return false, nil
+	}
+	now := s.Now()
+	switch b.state(now) {
+	case BreakerOpen:
+		return false, &RateLimitError{RetryAfter: b.openUntil.Sub(now), Breaker: true}
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, &RateLimitError{Breaker: true}
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// settle records the outcome of a GitHub call: limited > 0 (re)opens the
+// breaker for that long, otherwise a response closes it.
+func (s *Storage) settle(key string, probe bool, answered bool, limited time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.breakers == nil {
+		s.breakers = make(map[string]*breaker)
+	}
+	b := s.breakers[key]
+	switch {
+	case limited > 0:
+		if b == nil {
+			b = &breaker{}
+			s.breakers[key] = b
+		}
+		b.tripped = true
+		if until := s.Now().Add(limited); until.After(b.openUntil) {
+			b.openUntil = until
+		}
+		b.probing = false
+	case answered:
+		delete(s.breakers, key)
+	case probe && b != nil:
+		b.probing = false
+	}
+}
+
+// doGitHub sends req, honouring GitHub's secondary rate limits: a 403/429
+// with Retry-After (or the secondary-limit message) opens the token's
+// breaker, and the call sleeps the advised time, bounded by its context and
+// SecondaryWaitMax, before retrying up to SecondaryRetries times. Other
+// hosts (package downloads) go straight through. Every request gets our
+// User-Agent (see setRequestHeaders); failures to get an answer, or to read
+// it, are ErrUpstreamUnavailable. Those and 5xx answers feed the upstream
+// circuit, which refuses GitHub calls while it is open (see circuit.go).
+func (s *Storage) doGitHub(req *http.Request) (*http.Response, error) {
+	s.setRequestHeaders(req)
+	if !isGitHubHost(req.URL.Hostname()) {
+		resp, err := s.clientFor(req).Do(req)
+		return upstreamResponse(req, resp, err)
+	}
+	key := tokenKey(requestToken(req))
+	probe, err := s.admit(key)
+	if err != nil {
+		return nil, err
+	}
+	circuitProbe, err := s.circuitAdmit()
+	if err != nil {
+		s.settle(key, probe, false, 0)
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := s.clientFor(req).Do(req.Clone(req.Context()))
+		if err != nil {
+			s.settle(key, probe, false, 0)
+			s.circuitSettle(req.Context(), circuitProbe, err)
+			return nil, upstreamFailure(req.Context(), err)
+		}
+		var serverErr error
+		if resp.StatusCode >= http.StatusInternalServerError {
+			serverErr = fmt.Errorf("%s answered %d", req.URL.Host, resp.StatusCode)
+		}
+		s.circuitSettle(req.Context(), circuitProbe, serverErr)
+		circuitProbe = false
+		wait, limited := secondaryLimit(resp)
+		if !limited {
+			s.settle(key, probe, true, 0)
+			return upstreamResponse(req, resp, nil)
+		}
+		s.settle(key, probe, true, wait)
+		fmt.Printf("github secondary rate limit on %s; retry after %s (attempt %d)\n", req.URL.Path, wait, attempt+1)
+		if attempt >= s.secondaryRetries() || wait > s.secondaryWaitMax() {
+			return upstreamResponse(req, resp, nil)
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			// The retry could not finish in time; fail now.
+			return upstreamResponse(req, resp, nil)
+		}
+		_ = resp.Body.Close()
+		if err := sleepFor(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		// The sleeping call is the one allowed to probe after the cool-down.
+		probe = true
+	}
+}
+
+func (s *Storage) secondaryRetries() int {
+	if s.SecondaryRetries < 0 {
+		return 0
+	}
+	if s.SecondaryRetries == 0 {
+		return defaultSecondaryRetries
+	}
+	return s.SecondaryRetries
+}
+
+func (s *Storage) secondaryWaitMax() time.Duration {
+	if s.SecondaryWaitMax <= 0 {
+		return defaultSecondaryWaitMax
+	}
+	return s.SecondaryWaitMax
+}
+
+// secondaryLimit reports whether resp is a secondary rate limit response
+// and how long GitHub asks to wait. The body is buffered so callers can
+// still read it.
+func secondaryLimit(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	wait, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if hasRetryAfter {
+		return wait, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return 0, false // primary limit; reported as ErrRateLimited
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if strings.Contains(strings.ToLower(string(b)), "secondary rate limit") {
+		// Let isRateLimited and rateLimitError see it like a Retry-After.
+		resp.Header.Set("Retry-After", strconv.Itoa(int(defaultSecondaryWait/time.Second)))
+		return defaultSecondaryWait, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		if n == 0 {
+			n = 1
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return time.Second, true
+	}
+	return 0, false
+}
+
+// rateLimitError builds the error for a rate limited response.
+func rateLimitError(resp *http.Response, detail error) error {
+	wait, _ := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if wait == 0 && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if d := time.Until(time.Unix(reset, 0)); d > 0 {
+				wait = d
+			}
+		}
+	}
+	return fmt.Errorf("%w: %w", &RateLimitError{RetryAfter: wait}, detail)
+}
+
+func sleepFor(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrRedirectPolicy reports that a package download was redirected in a
+// way the Storage's RedirectPolicy or PackageHostCheck refuses.
+var ErrRedirectPolicy = errors.New("redirect refused by policy")
+
+// DefaultRedirectHops is how many redirects a package download follows
+// when RedirectPolicy.MaxHops is 0, as net/http does.
+const DefaultRedirectHops = 10
+
+// RedirectPolicy controls the redirects package downloads follow. Each hop
+// is compared with the package URL, not the hop before it.
+type RedirectPolicy struct {
+	// MaxHops is how many redirects are followed; 0 means
+	// DefaultRedirectHops, negative follows none.
+	MaxHops int
+	// RequireSameScheme refuses a hop to another scheme, e.g. from an
+	// https package URL to plain http.
+	RequireSameScheme bool
+	// RequireSameHost refuses a hop to another host. GitHub release assets
+	// redirect to a separate download host, so it is off by default.
+	RequireSameHost bool
+}
+
+// DefaultRedirectPolicy returns the policy New installs: up to
+// DefaultRedirectHops redirects, all keeping the package URL's scheme.
+func DefaultRedirectPolicy() RedirectPolicy {
+	return RedirectPolicy{MaxHops: DefaultRedirectHops, RequireSameScheme: true}
+}
+
+func (p RedirectPolicy) maxHops() int {
+	switch {
+	case p.MaxHops < 0:
+		return 0
+	case p.MaxHops == 0:
+		return DefaultRedirectHops
+	}
+	return p.MaxHops
+}
+
+// checkPackageURL applies PackageHostCheck to the URL a package download
+// starts from.
+func (s *Storage) checkPackageURL(ctx context.Context, pkgURL string) error {
+	if s.PackageHostCheck == nil {
+		return nil
+	}
+	u, err := url.Parse(pkgURL)
+	if err != nil {
+		return fmt.Errorf("package url %.128q: %v: %w", pkgURL, err, ErrBadPath)
+	}
+	if err := s.PackageHostCheck(ctx, u); err != nil {
+		return fmt.Errorf("package url %s refused: %w: %w", redactURL(u), err, ErrBadPath)
+	}
+	return nil
+}
+
+// redirectChecker returns the http.Client CheckRedirect enforcing the
+// Redirects policy, the package policy (audited as user's) and
+// PackageHostCheck on every hop; final is updated to each hop followed, so
+// it ends as the URL the body came from.
+func (s *Storage) redirectChecker(user string, final *string) func(req *http.Request, via []*http.Request) error {
+	p := s.Redirects
+	return func(req *http.Request, via []*http.Request) error {
+		orig := via[0].URL
+		refuse := func(why string) error {
+			return fmt.Errorf("%s redirected to %s: %s: %w", redactURL(orig), redactURL(req.URL), why, ErrRedirectPolicy)
+		}
+		if len(via) > p.maxHops() {
+			return refuse(fmt.Sprintf("more than %d redirects", p.maxHops()))
+		}
+		if p.RequireSameScheme && !strings.EqualFold(req.URL.Scheme, orig.Scheme) {
+			return refuse("scheme changed from " + orig.Scheme)
+		}
+		if p.RequireSameHost && !strings.EqualFold(req.URL.Host, orig.Host) {
+			return refuse("host changed from " + orig.Host)
+		}
+		if err := s.checkPackagePolicy(user, req.URL.String()); err != nil {
+			return fmt.Errorf("%s redirected to %s: %w: %w", redactURL(orig), redactURL(req.URL), err, ErrRedirectPolicy)
+		}
+		if s.PackageHostCheck != nil {
+			if err := s.PackageHostCheck(req.Context(), req.URL); err != nil {
+				return fmt.Errorf("%s redirected to %s: %w: %w", redactURL(orig), redactURL(req.URL), err, ErrRedirectPolicy)
+			}
+		}
+		*final = req.URL.String()
+		return nil
+	}
+}
+
+// redirectCheckKey carries a CheckRedirect for the requests of one call.
+type redirectCheckKey struct{}
+
+func withRedirectCheck(ctx context.Context, check func(*http.Request, []*http.Request) error) context.Context {
+	return context.WithValue(ctx, redirectCheckKey{}, check)
+}
+
+// clientFor is the HTTP client to send req with: httpClient, with the
+// CheckRedirect req's context carries, if any.
+func (s *Storage) clientFor(req *http.Request) *http.Client {
+	c := s.httpClient()
+	check, ok := req.Context().Value(redirectCheckKey{}).(func(*http.Request, []*http.Request) error)
+	if !ok {
+		return c
+	}
+	cc := *c
+	cc.CheckRedirect = check
+	return &cc
+}
+
+// redactURL drops credentials and the query, which may hold signed tokens,
+// from u for messages.
+func redactURL(u *url.URL) string {
+	r := *u
+	r.User, r.RawQuery, r.Fragment = nil, "", ""
+	return r.String()
+}
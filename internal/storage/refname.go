@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxRefLength caps branch, tag and ref names. Git sets no limit, but the
+// name becomes a cache file name and part of an upstream URL.
+const MaxRefLength = 255
+
+// ValidateRef checks a branch, tag or commit name before it becomes part of
+// a cache path, a git argument or an upstream URL, following git's
+// check-ref-format rules: no "..", "@{", control characters, space, "~",
+// "^", ":", "?", "*", "[" or "\", no leading "-", no empty, "."-prefixed or
+// ".lock"-suffixed slash-separated component, no trailing "." and at most
+// MaxRefLength bytes. Slashes between components ("feature/x") are fine.
+// The empty name, which stands for the default branch, is valid too.
+// Invalid names fail with ErrBadPath.
+func ValidateRef(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	if problem := refProblem(ref); problem != "" {
+		return fmt.Errorf("invalid ref %.64q: %s: %w", ref, problem, ErrBadPath)
+	}
+	return nil
+}
+
+// refProblem says what is wrong with ref, or "" when it is a valid name.
+func refProblem(ref string) string {
+	if len(ref) > MaxRefLength {
+		return fmt.Sprintf("longer than %d bytes", MaxRefLength)
+	}
+	if !utf8.ValidString(ref) {
+		return "not valid UTF-8"
+	}
+	for _, r := range ref {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return "contains a control character"
+		case strings.ContainsRune(" ~^:?*[\\", r):
+			return fmt.Sprintf("contains %q", r)
+		}
+	}
+	switch {
+	case ref == "@":
+		return `is "@"`
+	case strings.HasPrefix(ref, "-"):
+		return `starts with "-"`
+	case strings.Contains(ref, ".."):
+		return `contains ".."`
+	case strings.Contains(ref, "@{"):
+		return `contains "@{"`
+	case strings.HasSuffix(ref, "."):
+		return `ends with "."`
+	}
+	for _, part := range strings.Split(ref, "/") {
+		switch {
+		case part == "":
+			return "has an empty path component"
+		case strings.HasPrefix(part, "."):
+			return `has a component starting with "."`
+		case strings.HasSuffix(part, ".lock"):
+			return `has a component ending with ".lock"`
+		}
+	}
+	return ""
+}
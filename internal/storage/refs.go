@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Ref types reported by ResolveRef.
+const (
+	RefBranch = "branch"
+	RefTag    = "tag"
+	RefCommit = "commit"
+)
+
+var fullSHA = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// RefInfo describes a resolved git ref.
+type RefInfo struct {
+	Ref    string `json:"ref"`
+	SHA    string `json:"sha"`
+	Short  string `json:"short"`
+	Type   string `json:"type"`
+	Cached bool   `json:"cached"`
+	// repo is the owner/name GitHub answered for, which differs from the
+	// requested one after a rename. Only branch lookups fill it.
+	repo string
+}
+
+// ResolveRef resolves a branch, tag or commit SHA to a full commit SHA using
+// the GitHub refs/commits API, without downloading any archive. An empty ref
+// resolves the repository's default branch and LatestRelease the tag of its
+// latest release. Cached reports whether the user
+// already holds an archive of ref at that commit. A ref that is none of
+// them fails with an error matching both ErrBranchNotFound and ErrNotFound,
+// which makes ResolveRef the cheap way to ask whether a branch exists.
+func (s *Storage) ResolveRef(ctx context.Context, user, ownerRepo, ref, token string) (*RefInfo, error) {
+	user, ownerRepo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		def, err := s.fetchDefaultBranch(ctx, ownerRepo, token)
+		if err != nil {
+			return nil, fmt.Errorf("fetch default branch: %w", err)
+		}
+		ref = def
+	}
+	if ref == LatestRelease {
+		if ref, err = s.latestReleaseTag(ctx, user, ownerRepo, token, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateRef(ref); err != nil {
+		return nil, err
+	}
+
+	info, err := s.resolveRemoteRef(ctx, ownerRepo, ref, token)
+	if errors.Is(err, ErrNotFound) {
+		// Neither a branch, a tag nor a commit.
+		return nil, fmt.Errorf("%w (%w)", &NotFoundError{Repo: ownerRepo, Branch: ref, Token: strings.TrimSpace(token) != ""}, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Short = info.SHA
+	if len(info.Short) > 7 {
+		info.Short = info.Short[:7]
+	}
+	info.Cached = s.cachedAt(user, ownerRepo, ref, info.SHA)
+	return info, nil
+}
+
+func (s *Storage) resolveRemoteRef(ctx context.Context, ownerRepo, ref, token string) (*RefInfo, error) {
+	if fullSHA.MatchString(ref) {
+		sha, err := s.fetchCommitSHA(ctx, ownerRepo, ref, token)
+		if err != nil {
+			return nil, err
+		}
+		return &RefInfo{Ref: ref, SHA: sha, Type: RefCommit}, nil
+	}
+	var obj struct {
+		URL    string `json:"url"`
+		Object struct {
+			SHA  string `json:"sha"`
+			Type string `json:"type"`
+		} `json:"object"`
+	}
+	base := fmt.Sprintf("https://api.github.com/repos/%s/git/ref/", ownerRepo)
+	found, err := s.getGitHubJSON(ctx, base+"heads/"+escapeRef(ref), token, &obj)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return &RefInfo{Ref: ref, SHA: obj.Object.SHA, Type: RefBranch, repo: apiRepo(obj.URL)}, nil
+	}
+	return s.resolveTagOrCommit(ctx, ownerRepo, ref, token)
+}
+
+// resolveTagOrCommit resolves ref as a tag, peeling annotated tags, or else
+// as a full or abbreviated commit SHA. It returns ErrNotFound when ref is
+// neither.
+func (s *Storage) resolveTagOrCommit(ctx context.Context, ownerRepo, ref, token string) (*RefInfo, error) {
+	var obj struct {
+		Object struct {
+			SHA  string `json:"sha"`
+			Type string `json:"type"`
+		} `json:"object"`
+	}
+	tagRef := fmt.Sprintf("https://api.github.com/repos/%s/git/ref/tags/%s", ownerRepo, escapeRef(ref))
+	found, err := s.getGitHubJSON(ctx, tagRef, token, &obj)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		sha := obj.Object.SHA
+		// Annotated tags point at a tag object; peel it to the commit.
+		if obj.Object.Type == "tag" {
+			var tag struct {
+				Object struct {
+					SHA string `json:"sha"`
+				} `json:"object"`
+			}
+			tagURL := fmt.Sprintf("https://api.github.com/repos/%s/git/tags/%s", ownerRepo, sha)
+			if ok, err := s.getGitHubJSON(ctx, tagURL, token, &tag); err != nil {
+				return nil, err
+			} else if ok && tag.Object.SHA != "" {
+				sha = tag.Object.SHA
+			}
+		}
+		return &RefInfo{Ref: ref, SHA: sha, Type: RefTag}, nil
+	}
+	// Fall back to the commits API, which also accepts abbreviated SHAs.
+	sha, err := s.fetchCommitSHA(ctx, ownerRepo, ref, token)
+	if err != nil {
+		return nil, err
+	}
+	return &RefInfo{Ref: ref, SHA: sha, Type: RefCommit}, nil
+}
+
+func (s *Storage) fetchCommitSHA(ctx context.Context, ownerRepo, ref, token string) (string, error) {
+	var data struct {
+		SHA string `json:"sha"`
+	}
+	found, err := s.getGitHubJSON(ctx, fmt.Sprintf("https://api.github.com/repos/%s/commits/%s", ownerRepo, url.PathEscape(ref)), token, &data)
+	if err != nil {
+		return "", err
+	}
+	if !found || strings.TrimSpace(data.SHA) == "" {
+		return "", fmt.Errorf("ref %q: %w", ref, ErrNotFound)
+	}
+	return data.SHA, nil
+}
+
+// getGitHubJSON decodes a GitHub API response into out. It reports false
+// without error for 404 and 422 (the commits API answers 422 for unknown SHAs)
+// and fails with ErrEmptyRepo for the 409 of a repository without commits.
+func (s *Storage) getGitHubJSON(ctx context.Context, apiURL, token string, out any) (bool, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if strings.TrimSpace(token) != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity:
+		return false, nil
+	case isRateLimited(resp):
+		return false, rateLimitError(resp, fmt.Errorf("github api: status=%d", resp.StatusCode))
+	case resp.StatusCode != http.StatusOK:
+		se, b := readStatusError("github api", resp)
+		if resp.StatusCode == http.StatusConflict && repoEmpty(b) {
+			return false, emptyRepoError(apiRepo(apiURL))
+		}
+		return false, se
+	}
+	if err := decodeAPI("github api", resp.Body, out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// apiRepo extracts owner/name from a GitHub API URL such as
+// https://api.github.com/repos/<owner>/<name>/git/refs/heads/main.
+func apiRepo(apiURL string) string {
+	_, rest, ok := strings.Cut(apiURL, "/repos/")
+	if !ok {
+		return ""
+	}
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// escapeRef escapes each path segment of a ref so refs containing "/" keep
+// their hierarchy in the URL.
+func escapeRef(ref string) string {
+	parts := strings.Split(ref, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// cachedAt reports whether user holds a git-mode or legacy archive of ref
+// whose recorded commit equals sha.
+func (s *Storage) cachedAt(user, ownerRepo, ref, sha string) bool {
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	candidates := []string{
+		filepath.Join(dir, ref+".zip"),
+		filepath.Join(dir, sanitizeName(ref)+".legacy.zip"),
+	}
+	for _, zipPath := range candidates {
+		if !archiveExists(zipPath) {
+			continue
+		}
+		if cached, err := readSHA(zipPath + ".meta"); err == nil && strings.EqualFold(cached, sha) {
+			return true
+		}
+	}
+	return false
+}
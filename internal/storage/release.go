@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LatestRelease is the ref EnsureRepo and ResolveRef resolve to the tag of
+// the repository's latest release. The archive is cached under the tag, so
+// it stays put when a newer release moves the mapping on.
+const LatestRelease = "latest-release"
+
+// releaseMapName is the file, beside the user's archives of a repository,
+// recording which tag LatestRelease mapped to when last checked.
+const releaseMapName = "latest-release.json"
+
+type releaseMapping struct {
+	Tag       string    `json:"tag"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// releaseMappings keeps the latest release with and without prereleases
+// apart, as they usually differ.
+type releaseMappings struct {
+	Release    *releaseMapping `json:"release,omitempty"`
+	Prerelease *releaseMapping `json:"prerelease,omitempty"`
+}
+
+func (m *releaseMappings) slot(pre bool) **releaseMapping {
+	if pre {
+		return &m.Prerelease
+	}
+	return &m.Release
+}
+
+type prereleaseKey struct{}
+
+// WithPrereleases makes LatestRelease in EnsureRepo and ResolveRef calls made
+// with the returned context consider prereleases too. Drafts never count.
+func WithPrereleases(ctx context.Context, include bool) context.Context {
+	return context.WithValue(ctx, prereleaseKey{}, include)
+}
+
+func prereleases(ctx context.Context) bool {
+	b, _ := ctx.Value(prereleaseKey{}).(bool)
+	return b
+}
+
+// latestReleaseTag resolves LatestRelease for user's copy of ownerRepo
+// (already canonical) with the freshness rules of branches: a mapping
+// checked within the context's max age is used without asking GitHub, and
+// when GitHub cannot answer the stale policy decides whether the recorded
+// mapping stands in. force always asks. Under strict verification
+// neither the max age nor the recorded mapping stands in for GitHub.
+func (s *Storage) latestReleaseTag(ctx context.Context, user, ownerRepo, token string, force bool) (string, error) {
+	user, repo, err := s.normalizeUserRepo(user, ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	unlock := s.acquire(user, repo, LatestRelease)
+	defer unlock()
+
+	path := filepath.Join(s.reposDir(user), repo, releaseMapName)
+	pre := prereleases(ctx)
+	var all releaseMappings
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &all)
+	}
+	recorded := *all.slot(pre)
+	if onlyIfCached(ctx) && !force {
+		if recorded == nil {
+			return "", fmt.Errorf("%s: latest release not known: %w", repo, ErrNotCached)
+		}
+		if d := maxAge(ctx); d <= 0 || s.Now().Sub(recorded.CheckedAt) < d {
+			return recorded.Tag, nil
+		}
+		return "", fmt.Errorf("%s: latest release checked more than %s ago: %w", repo, maxAge(ctx), ErrNotCached)
+	}
+	if !force && recorded != nil {
+		if d := maxAge(ctx); d > 0 && s.Now().Sub(recorded.CheckedAt) < d && !s.strict(ctx) {
+			return recorded.Tag, nil
+		}
+	}
+
+	tag, err := s.fetchLatestRelease(ctx, repo, token, pre)
+	if err != nil {
+		if recorded == nil || force || ctx.Err() != nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrRepoNotFound) {
+			return "", err
+		}
+		if s.strict(ctx) {
+			return "", &UnverifiableError{Repo: repo, Branch: LatestRelease, Reason: "latest release lookup failed", Err: err}
+		}
+		if s.stalePolicy(ctx) == StaleFail {
+			return "", &StaleError{Repo: repo, Branch: LatestRelease, Err: err}
+		}
+		fmt.Printf("cannot check latest release of %s (%v); using recorded tag %s\n", repo, err, recorded.Tag)
+		return recorded.Tag, nil
+	}
+	if recorded == nil || recorded.Tag != tag {
+		fmt.Printf("latest release of %s is %s\n", repo, tag)
+	}
+	*all.slot(pre) = &releaseMapping{Tag: tag, CheckedAt: s.Now()}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		if b, err := json.MarshalIndent(&all, "", "  "); err == nil {
+			_ = os.WriteFile(path, b, 0o644)
+		}
+	}
+	return tag, nil
+}
+
+// fetchLatestRelease asks the releases API for the tag of the latest
+// release: GitHub's own pick of the newest non-prerelease, or with pre the
+// newest release that is not a draft.
+func (s *Storage) fetchLatestRelease(ctx context.Context, ownerRepo, token string, pre bool) (string, error) {
+	if s.Fetcher != nil {
+		return "", fmt.Errorf("%s needs the GitHub releases API, which a custom fetcher does not provide", LatestRelease)
+	}
+	type release struct {
+		TagName    string `json:"tag_name"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	}
+	base := fmt.Sprintf("https://api.github.com/repos/%s/releases", ownerRepo)
+	if !pre {
+		var rel release
+		found, err := s.getGitHubJSON(ctx, base+"/latest", token, &rel)
+		if err != nil {
+			return "", err
+		}
+		if !found || rel.TagName == "" {
+			return "", fmt.Errorf("%s has no published release: %w", ownerRepo, ErrNotFound)
+		}
+		return rel.TagName, nil
+	}
+	var rels []release
+	found, err := s.getGitHubJSON(ctx, base+"?per_page=30", token, &rels)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		for _, rel := range rels {
+			if !rel.Draft && rel.TagName != "" {
+				return rel.TagName, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s has no published release: %w", ownerRepo, ErrNotFound)
+}
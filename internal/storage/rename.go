@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// replaceFile moves src to dst. When the rename fails with EXDEV (src and
+// dst on different mounts, e.g. an overlay bind mount) it copies src into a
+// temp file beside dst, fsyncs it and renames that into place, so dst is
+// never visible half-written. src is removed either way on success.
+func (s *Storage) replaceFile(src, dst string) error {
+	rename := s.rename
+	if rename == nil {
+		rename = os.Rename
+	}
+	err := rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	fmt.Printf("rename %s -> %s crosses devices, copying\n", src, dst)
+	tmp, err := copyBeside(src, dst)
+	if err != nil {
+		return err
+	}
+	if err := rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = os.Remove(src)
+	return nil
+}
+
+// copyBeside copies src into a synced temp file in dst's directory and
+// returns its path.
+func copyBeside(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-xdev-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("copy %s: %w", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
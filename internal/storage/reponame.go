@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// githubPrefixes are the URL forms NormalizeRepo strips, compared without
+// regard to case.
+var githubPrefixes = []string{"https://github.com/", "http://github.com/", "https://www.github.com/", "http://www.github.com/", "github.com/"}
+
+// NormalizeRepo turns the spellings clients send for a repository into
+// owner/repo: surrounding space and slashes, a github.com URL prefix and a
+// .git suffix are dropped, so "https://github.com/own/repo.git/" and
+// "/own/repo" are both "own/repo". Case is kept; CanonicalRepo settles it.
+// Anything that is not then exactly owner/repo of letters, digits, '-',
+// '_' and '.' fails with ErrBadPath.
+func NormalizeRepo(repo string) (string, error) {
+	s := strings.TrimSpace(repo)
+	for _, p := range githubPrefixes {
+		if len(s) >= len(p) && strings.EqualFold(s[:len(p)], p) {
+			s = s[len(p):]
+			break
+		}
+	}
+	s = strings.Trim(s, "/")
+	s = strings.Trim(strings.TrimSuffix(s, ".git"), "/")
+	owner, name, ok := strings.Cut(s, "/")
+	if !ok || !validRepoPart(owner) || !validRepoPart(name) {
+		return "", fmt.Errorf("owner/repo expected, got %q: %w", repo, ErrBadPath)
+	}
+	return s, nil
+}
+
+func validRepoPart(p string) bool {
+	if p == "" || p == "." || p == ".." {
+		return false
+	}
+	for _, r := range p {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// CanonicalRepo is NormalizeRepo with the case GitHub uses for the
+// repository (its full_name), so "OWN/REPO" and "own/repo" share one cache
+// entry. The name comes from the repository API call that also reports the
+// default branch and is remembered for the life of the Storage. When GitHub
+// cannot tell (unknown repository, rate limited, offline, a custom Fetcher)
+// the normalized spelling is used as is, and the call that follows reports
+// what went wrong.
+func (s *Storage) CanonicalRepo(ctx context.Context, ownerRepo, token string) (string, error) {
+	repo, err := NormalizeRepo(ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	if name, ok := s.knownRepoName(repo); ok {
+		return name, nil
+	}
+	if s.Fetcher != nil {
+		return repo, nil
+	}
+	if _, err := s.fetchDefaultBranch(ctx, repo, s.tokenFor(repo, token)); err != nil {
+		return repo, nil
+	}
+	if name, ok := s.knownRepoName(repo); ok {
+		return name, nil
+	}
+	return repo, nil
+}
+
+// canonicalChecked is CanonicalRepo with the repo policy applied before
+// GitHub is asked and again to the name GitHub answered with.
+func (s *Storage) canonicalChecked(ctx context.Context, ownerRepo, token string) (string, error) {
+	repo, err := NormalizeRepo(ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkRepo(repo); err != nil {
+		return "", err
+	}
+	name, err := s.CanonicalRepo(ctx, repo, token)
+	if err != nil {
+		return "", err
+	}
+	if name != repo {
+		if err := s.checkRepo(name); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// localChecked is localRepo with the repo policy applied.
+func (s *Storage) localChecked(ownerRepo string) (string, error) {
+	repo, err := s.localRepo(ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkRepo(repo); err != nil {
+		return "", err
+	}
+	return repo, nil
+}
+
+// localRepo is CanonicalRepo for calls that must not reach GitHub: the
+// remembered spelling when there is one, else the normalized one.
+func (s *Storage) localRepo(ownerRepo string) (string, error) {
+	repo, err := NormalizeRepo(ownerRepo)
+	if err != nil {
+		return "", err
+	}
+	if name, ok := s.knownRepoName(repo); ok {
+		return name, nil
+	}
+	return repo, nil
+}
+
+func (s *Storage) knownRepoName(repo string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.repoNames[strings.ToLower(repo)]
+	return name, ok
+}
+
+// noteRepoName remembers GitHub's spelling of the repository asked for as
+// repo. A renamed repository is reached under its old name too, and both
+// map to the new one.
+func (s *Storage) noteRepoName(repo, fullName string) {
+	if _, err := NormalizeRepo(fullName); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repoNames == nil {
+		s.repoNames = make(map[string]string)
+	}
+	s.repoNames[strings.ToLower(repo)] = fullName
+	s.repoNames[strings.ToLower(fullName)] = fullName
+}
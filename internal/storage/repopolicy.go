@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrPolicyDenied reports that the repo policy forbids a repository, or the
+// package policy a package URL.
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// RepoPolicy decides which owner/repo names may be fetched. Patterns are
+// globs matched case-insensitively against "owner/repo" ("myorg/*"), or
+// regular expressions when prefixed with "re:". Deny rules win over allow
+// rules; an empty allow list allows everything not denied.
+type RepoPolicy struct {
+	allow []repoPattern
+	deny  []repoPattern
+}
+
+type repoPattern struct {
+	raw  string
+	glob string
+	re   *regexp.Regexp
+}
+
+// NewRepoPolicy compiles allow and deny patterns.
+func NewRepoPolicy(allow, deny []string) (*RepoPolicy, error) {
+	p := &RepoPolicy{}
+	var err error
+	if p.allow, err = compilePatterns(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = compilePatterns(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func compilePatterns(raw []string) ([]repoPattern, error) {
+	out := make([]repoPattern, 0, len(raw))
+	for _, r := range raw {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if expr, ok := strings.CutPrefix(r, "re:"); ok {
+			re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("repo pattern %q: %w", r, err)
+			}
+			out = append(out, repoPattern{raw: r, re: re})
+			continue
+		}
+		glob := strings.ToLower(r)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("repo pattern %q: %w", r, err)
+		}
+		out = append(out, repoPattern{raw: r, glob: glob})
+	}
+	return out, nil
+}
+
+func (rp repoPattern) match(ownerRepo string) bool {
+	if rp.re != nil {
+		return rp.re.MatchString(ownerRepo)
+	}
+	ok, _ := path.Match(rp.glob, strings.ToLower(ownerRepo))
+	return ok
+}
+
+// Check returns an error wrapping ErrPolicyDenied when ownerRepo may not be
+// fetched. A nil policy allows everything.
+func (p *RepoPolicy) Check(ownerRepo string) error {
+	if p == nil {
+		return nil
+	}
+	ownerRepo = strings.Trim(strings.TrimSpace(ownerRepo), "/")
+	for _, d := range p.deny {
+		if d.match(ownerRepo) {
+			return fmt.Errorf("%s matches deny rule %q: %w", ownerRepo, d.raw, ErrPolicyDenied)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, a := range p.allow {
+		if a.match(ownerRepo) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the allow list: %w", ownerRepo, ErrPolicyDenied)
+}
+
+// SetRepoPolicy replaces the repo policy; safe to call while serving.
+func (s *Storage) SetRepoPolicy(p *RepoPolicy) {
+	s.repoPolicy.Store(p)
+}
+
+// checkRepo applies the repo policy before any GitHub call.
+func (s *Storage) checkRepo(ownerRepo string) error {
+	return s.repoPolicy.Load().Check(ownerRepo)
+}
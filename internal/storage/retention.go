@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy caps how many branch archives each user keeps per repo.
+// The least recently accessed archives beyond the cap are removed together
+// with their sidecars; the repo's default branch is never removed.
+type RetentionPolicy struct {
+	// MaxArchives is the global cap per user and owner/repo; 0 means no cap.
+	MaxArchives int
+	// PerRepo overrides MaxArchives for specific owner/repo keys.
+	PerRepo map[string]int
+}
+
+// Limit returns the cap that applies to ownerRepo (0 = unlimited).
+func (p RetentionPolicy) Limit(ownerRepo string) int {
+	for k, v := range p.PerRepo {
+		if strings.EqualFold(k, ownerRepo) {
+			return v
+		}
+	}
+	return p.MaxArchives
+}
+
+// CleanupReport lists what a cleanup pass removed, as paths relative to Root.
+type CleanupReport struct {
+	Expired   []string `json:"expired"`
+	Retention []string `json:"retention"`
+	Gone      []string `json:"gone"`  // branch deleted upstream past the grace period
+	Trash     []string `json:"trash"` // soft-deleted items past TrashRetention
+	// Temp lists orphaned temp files; those in TempDir are absolute paths.
+	Temp []string `json:"temp"`
+	// Protected and ProtectedBytes count the archives protected by Pin and
+	// the bytes they hold, which no cleanup removes.
+	Protected      int   `json:"protected"`
+	ProtectedBytes int64 `json:"protected_bytes"`
+}
+
+// Cleanup removes orphaned temp files and items idle longer than ttl, then
+// applies the retention policy to every user's repos.
+func (s *Storage) Cleanup(ttl time.Duration) (*CleanupReport, error) {
+	report := &CleanupReport{}
+	// Expiry and retention go by mtime, so coalesced accesses count.
+	s.SyncTouches()
+	s.removeOrphanTemps(report)
+	if err := s.cleanupExpired(ttl, report); err != nil {
+		return report, err
+	}
+	s.applyRetentionAll(report)
+	s.purgeTrash(report)
+	s.emit(Event{Type: EventCleanupCompleted, Report: report})
+	return report, nil
+}
+
+type cachedArchive struct {
+	path      string
+	branch    string
+	mtime     time.Time
+	legacy    bool
+	retained  bool // a previous archive kept by KeepPrevious
+	protected bool // by Pin
+}
+
+// applyRetentionAll walks the <owner>/<repo> directories of every user, or
+// of the shared tree under LayoutShared.
+func (s *Storage) applyRetentionAll(report *CleanupReport) {
+	if s.Retention.MaxArchives <= 0 && len(s.Retention.PerRepo) == 0 {
+		return
+	}
+	for user, reposDir := range s.repoTrees() {
+		owners, err := os.ReadDir(reposDir)
+		if err != nil {
+			continue
+		}
+		for _, o := range owners {
+			if !o.IsDir() {
+				continue
+			}
+			repos, err := os.ReadDir(filepath.Join(reposDir, o.Name()))
+			if err != nil {
+				continue
+			}
+			for _, r := range repos {
+				if r.IsDir() {
+					s.applyRetention(user, o.Name()+"/"+r.Name(), "", report)
+				}
+			}
+		}
+	}
+}
+
+// applyRetention enforces the policy for one user's repo. keep is an archive
+// path that must survive (the one just served); protected archives survive
+// too and, like the default branch, count against the cap. Archives that
+// are busy are skipped rather than waited for.
+func (s *Storage) applyRetention(user, ownerRepo, keep string, report *CleanupReport) {
+	limit := s.Retention.Limit(ownerRepo)
+	if limit <= 0 {
+		return
+	}
+	s.SyncTouches()
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	archives := listArchives(dir)
+	if len(archives) <= limit {
+		return
+	}
+	def := s.recordedDefaultBranch(ownerRepo)
+	var candidates []cachedArchive
+	kept := 0
+	for _, a := range archives {
+		if a.path == keep || a.protected || (def != "" && a.branch == def && !a.retained) {
+			kept++
+			continue
+		}
+		candidates = append(candidates, a)
+	}
+	// Newest first; everything past the remaining allowance goes.
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].mtime.After(candidates[j].mtime) })
+	allowance := limit - kept
+	if allowance < 0 {
+		allowance = 0
+	}
+	if allowance >= len(candidates) {
+		return
+	}
+	for _, a := range candidates[allowance:] {
+		lockBranch := a.branch
+		if a.legacy {
+			lockBranch += "-legacy"
+		}
+		unlock, ok := s.tryAcquire(user, ownerRepo, lockBranch)
+		if !ok {
+			continue
+		}
+		meta, _ := readArchiveMetaFile(a.path)
+		removeArchive(a.path)
+		unlock()
+		s.trimRepoDir(filepath.Dir(a.path))
+		if rel, err := filepath.Rel(s.Root, a.path); err == nil && report != nil {
+			report.Retention = append(report.Retention, filepath.ToSlash(rel))
+		}
+		s.emitEvicted(a.path, meta, "retention")
+		fmt.Printf("retention: removed %s (limit %d for %s)\n", a.path, limit, ownerRepo)
+	}
+}
+
+// listArchives returns the branch archives (git-mode <branch>.zip and
+// <branch>.legacy.zip) under a user's repo directory. Kept previous
+// archives are listed too, under their branch, so they count against the
+// cap and are removed under that branch's lock.
+func listArchives(dir string) []cachedArchive {
+	var out []cachedArchive
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		zipPath, ok := archivePath(path)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, zipPath)
+		if err != nil {
+			return nil
+		}
+		path = zipPath
+		a := cachedArchive{path: path, mtime: info.ModTime()}
+		branch := strings.TrimSuffix(filepath.ToSlash(rel), ".zip")
+		if strings.HasSuffix(branch, ".legacy") {
+			a.legacy = true
+			branch = strings.TrimSuffix(branch, ".legacy")
+		}
+		// The metadata sidecar has the real branch name; legacy file names
+		// are sanitized.
+		if meta, err := readArchiveMeta(path); err == nil {
+			if meta.Branch != "" {
+				branch = meta.Branch
+			}
+			a.protected = meta.Protected
+		}
+		a.branch = branch
+		out = append(out, a)
+		return nil
+	})
+	paths := make([]string, len(out))
+	for i, a := range out {
+		paths[i] = a.path
+	}
+	retained := retainedArchives(paths)
+	for i := range out {
+		if meta := retained[out[i].path]; meta != nil {
+			out[i].retained = true
+			out[i].branch = meta.Branch
+		}
+	}
+	return out
+}
+
+// recordedDefaultBranch returns the default branch learned from the GitHub
+// API, falling back to the bare repo's HEAD (set by git clone --bare).
+func (s *Storage) recordedDefaultBranch(ownerRepo string) string {
+	s.mu.Lock()
+	def := s.knownDefaults[strings.ToLower(ownerRepo)]
+	s.mu.Unlock()
+	if def != "" {
+		return def
+	}
+	b, err := os.ReadFile(filepath.Join(s.gitCachePath(ownerRepo), "HEAD"))
+	if err != nil {
+		return ""
+	}
+	head := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(head, "ref: refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(head, "ref: refs/heads/")
+}
+
+func (s *Storage) noteDefaultBranch(ownerRepo, branch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.knownDefaults == nil {
+		s.knownDefaults = make(map[string]string)
+	}
+	s.knownDefaults[strings.ToLower(ownerRepo)] = branch
+}
+
+// tryAcquire is acquire without waiting.
+func (s *Storage) tryAcquire(user, repo, branch string) (func(), bool) {
+	key := fmt.Sprintf("%s|%s|%s", s.lockUser(user), repo, branch)
+	s.mu.Lock()
+	if s.lock == nil {
+		s.lock = make(map[string]*sync.Mutex)
+	}
+	m, ok := s.lock[key]
+	if !ok {
+		m = &sync.Mutex{}
+		s.lock[key] = m
+	}
+	s.mu.Unlock()
+	if !m.TryLock() {
+		return nil, false
+	}
+	return m.Unlock, true
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBusy is returned by Revalidate when a request holds the branch lock.
+var ErrBusy = errors.New("branch is busy")
+
+// RecentBranch is a cached branch archive and when it was last served.
+type RecentBranch struct {
+	User       string    `json:"user,omitempty"` // empty in LayoutShared
+	Repo       string    `json:"repo"`
+	Branch     string    `json:"branch"`
+	Legacy     bool      `json:"legacy,omitempty"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// branchArchive is the path EnsureRepo keeps user's archive of branch at.
+func (s *Storage) branchArchive(user, ownerRepo, branch string, legacy bool) string {
+	dir := filepath.Join(s.reposDir(user), ownerRepo)
+	if legacy {
+		safe := strings.ReplaceAll(strings.ReplaceAll(branch, "/", "-"), "\\", "-")
+		return filepath.Join(dir, safe+".legacy.zip")
+	}
+	return filepath.Join(dir, branch+".zip")
+}
+
+// RecentBranches lists the branch archives of the current layout served
+// since the given time, most recently used first. Archives kept by
+// KeepPrevious, pinned archives and archives without metadata are skipped.
+func (s *Storage) RecentBranches(since time.Time) []RecentBranch {
+	var out []RecentBranch
+	for user, dir := range s.repoTrees() {
+		_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			zipPath, ok := archivePath(p)
+			if !ok {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().Before(since) {
+				return nil
+			}
+			meta, err := readArchiveMetaFile(zipPath)
+			if err != nil || meta.Pinned || meta.Repo == "" || meta.Branch == "" {
+				return nil
+			}
+			legacy := strings.HasSuffix(zipPath, ".legacy.zip")
+			if zipPath != s.branchArchive(user, meta.Repo, meta.Branch, legacy) {
+				return nil
+			}
+			out = append(out, RecentBranch{User: user, Repo: meta.Repo, Branch: meta.Branch, Legacy: legacy, LastAccess: info.ModTime()})
+			return nil
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastAccess.After(out[j].LastAccess) })
+	return out
+}
+
+// busy reports whether a request holds the lock EnsureRepo takes for
+// branch.
+func (s *Storage) busy(user, ownerRepo, branch string, legacy bool) bool {
+	if legacy {
+		branch += "-legacy"
+	}
+	key := fmt.Sprintf("%s|%s|%s", s.lockUser(user), ownerRepo, branch)
+	s.mu.Lock()
+	m, ok := s.lock[key]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if !m.TryLock() {
+		return true
+	}
+	m.Unlock()
+	return false
+}
+
+// Revalidate checks b against upstream ahead of demand, downloading the
+// branch again when it moved. It returns ErrBusy instead of waiting when a
+// request is working on the branch. The check is not counted as a cache
+// hit or miss and leaves the archive's last access time as it was, so
+// cleanup still expires branches nobody asks for.
+func (s *Storage) Revalidate(ctx context.Context, b RecentBranch, token string) (*RepoArchive, error) {
+	if s.busy(b.User, b.Repo, b.Branch, b.Legacy) {
+		return nil, ErrBusy
+	}
+	res, err := s.EnsureRepoResult(withBackground(ctx), b.User, b.Repo, b.Branch, token, false, b.Legacy)
+	if err != nil {
+		return nil, err
+	}
+	if res.Outcome == CacheMiss && !b.LastAccess.IsZero() {
+		_ = os.Chtimes(storedPath(res.Path), b.LastAccess, b.LastAccess)
+	}
+	return res, nil
+}
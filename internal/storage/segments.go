@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSegmentSize is the chunk size of segment manifests when the caller
+// sets none.
+const DefaultSegmentSize = 32 << 20
+
+// ErrNotSegmentable reports an archive stored compressed or encrypted,
+// which has no byte offsets to serve chunks from; download it whole.
+var ErrNotSegmentable = errors.New("archive is stored compressed or encrypted and cannot be segmented")
+
+// SegmentManifest splits a cached archive, as served, into chunks that can
+// be fetched and verified one at a time. It is built once per archive
+// (commit, archive checksum and chunk size) and cached in
+// <branch>.segments.json.
+type SegmentManifest struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit,omitempty"`
+	// SHA256 is the digest of the whole archive, which the reassembled
+	// chunks must match.
+	SHA256    string    `json:"sha256"`
+	TotalSize int64     `json:"total_size"`
+	ChunkSize int64     `json:"chunk_size"`
+	Chunks    []Segment `json:"chunks"`
+}
+
+// Segment is one chunk of a SegmentManifest.
+type Segment struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+func segmentsPath(zipPath string) string {
+	return strings.TrimSuffix(zipPath, ".zip") + ".segments.json"
+}
+
+// ArchiveSegments returns the SegmentManifest of a cached archive with
+// chunks of chunkSize bytes (DefaultSegmentSize when 0 or less). The first
+// call for an archive hashes it chunk by chunk and caches the manifest;
+// later calls read the cached one until the archive is replaced. Archives
+// stored compressed or encrypted fail with ErrNotSegmentable: a chunk of
+// them could only be reached by decoding everything before it.
+func (s *Storage) ArchiveSegments(zipPath string, chunkSize int64) (*SegmentManifest, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultSegmentSize
+	}
+	if storedPath(zipPath) != zipPath || sealInfo(zipPath) != nil {
+		return nil, fmt.Errorf("segments of %s: %w", zipPath, ErrNotSegmentable)
+	}
+	res := archiveResult(zipPath, s.ShortSHALen)
+	path := segmentsPath(zipPath)
+	if b, err := os.ReadFile(path); err == nil {
+		var m SegmentManifest
+		if json.Unmarshal(b, &m) == nil && res.SHA256 != "" && m.SHA256 == res.SHA256 && m.Commit == res.CommitSHA && m.ChunkSize == chunkSize {
+			return &m, nil
+		}
+	}
+	m, err := s.buildSegments(zipPath, res, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("segments of %s: %w", zipPath, err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-segments-*.json")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	fmt.Printf("segments %s chunks=%d bytes=%d\n", zipPath, len(m.Chunks), m.TotalSize)
+	return m, nil
+}
+
+// buildSegments reads zipPath once, hashing each chunk and the whole.
+func (s *Storage) buildSegments(zipPath string, res *RepoArchive, chunkSize int64) (*SegmentManifest, error) {
+	f, err := s.openArchive(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	m := &SegmentManifest{Commit: res.CommitSHA, ChunkSize: chunkSize, Chunks: []Segment{}}
+	if meta, err := readArchiveMeta(zipPath); err == nil {
+		m.Repo, m.Branch = meta.Repo, meta.Branch
+	}
+	whole := sha256.New()
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(h, whole), f, chunkSize)
+		if n > 0 {
+			m.Chunks = append(m.Chunks, Segment{Index: len(m.Chunks), Offset: m.TotalSize, Length: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+			m.TotalSize += n
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	if res.SHA256 != "" && m.SHA256 != res.SHA256 {
+		return nil, fmt.Errorf("archive digest %s does not match its metadata: %w", m.SHA256, ErrChecksumMismatch)
+	}
+	return m, nil
+}
+
+// OpenSegment opens chunk index of a cached archive's SegmentManifest with
+// chunks of chunkSize bytes, seeking straight to it. The caller closes the
+// reader; the chunk's digest is in the returned Segment, and a chunk read
+// while the archive was being replaced will not match it.
+func (s *Storage) OpenSegment(zipPath string, chunkSize int64, index int) (*Segment, io.ReadCloser, error) {
+	m, err := s.ArchiveSegments(zipPath, chunkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index < 0 || index >= len(m.Chunks) {
+		return nil, nil, fmt.Errorf("segment %d of %d: %w", index, len(m.Chunks), ErrNotFound)
+	}
+	seg := m.Chunks[index]
+	f, err := s.openArchive(zipPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, ok := f.(io.Seeker)
+	if !ok {
+		// Compressed or encrypted since the manifest was read.
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("segment %d of %s: %w", index, zipPath, ErrNotSegmentable)
+	}
+	if _, err := sk.Seek(seg.Offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return &seg, &segmentReader{Reader: io.LimitReader(f, seg.Length), c: f}, nil
+}
+
+type segmentReader struct {
+	io.Reader
+	c io.Closer
+}
+
+func (r *segmentReader) Close() error { return r.c.Close() }
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SignatureEd25519 is the algorithm of archive signatures: Ed25519 over the
+// 32-byte SHA-256 digest of the archive (the bytes ArchiveMeta.SHA256
+// spells in hex).
+const SignatureEd25519 = "ed25519"
+
+// ErrSigningDisabled reports a signature asked of a Storage without a
+// Signer.
+var ErrSigningDisabled = errors.New("archive signing disabled")
+
+// SigningKeys signs archives with a current Ed25519 key and holds the
+// public keys of earlier ones, so consumers can still verify what was
+// signed before a rotation. Key IDs are derived from the public keys (see
+// KeyID).
+type SigningKeys struct {
+	current string
+	priv    ed25519.PrivateKey
+	public  map[string]ed25519.PublicKey
+	ids     []string // current first
+}
+
+// SigningPublicKey is a verification key as published to consumers.
+type SigningPublicKey struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is the raw 32-byte key in base64; PEM is the same key as a
+	// PKIX "PUBLIC KEY" block, as openssl and cosign read it.
+	PublicKey string `json:"public_key"`
+	PEM       string `json:"pem"`
+	Current   bool   `json:"current"`
+}
+
+// NewSigningKeys returns SigningKeys signing with current and publishing
+// the previous public keys as well.
+func NewSigningKeys(current ed25519.PrivateKey, previous ...ed25519.PublicKey) (*SigningKeys, error) {
+	if len(current) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("signing key must be an Ed25519 private key, got %d bytes", len(current))
+	}
+	pub := current.Public().(ed25519.PublicKey)
+	k := &SigningKeys{current: KeyID(pub), priv: current, public: make(map[string]ed25519.PublicKey, 1+len(previous))}
+	for _, key := range append([]ed25519.PublicKey{pub}, previous...) {
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("signing public key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+		}
+		id := KeyID(key)
+		if _, dup := k.public[id]; dup {
+			continue
+		}
+		k.public[id] = key
+		k.ids = append(k.ids, id)
+	}
+	return k, nil
+}
+
+// LoadSigningKeys reads SigningKeys from files. The current key file holds
+// an Ed25519 private key as PKCS#8 PEM (e.g. from "openssl genpkey
+// -algorithm ed25519") or its 32-byte seed, raw, hex or base64. Previous
+// key files may hold either a private key or just its PKIX PEM public key.
+func LoadSigningKeys(currentFile string, previousFiles ...string) (*SigningKeys, error) {
+	priv, pub, err := readSigningKeyFile(currentFile)
+	if err != nil {
+		return nil, err
+	}
+	if priv == nil {
+		return nil, fmt.Errorf("signing key file %s holds no private key", currentFile)
+	}
+	var previous []ed25519.PublicKey
+	for _, path := range previousFiles {
+		_, pub, err = readSigningKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, pub)
+	}
+	return NewSigningKeys(priv, previous...)
+}
+
+func readSigningKeyFile(path string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read signing key file: %w", err)
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		switch block.Type {
+		case "PRIVATE KEY":
+			if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+				if priv, ok := key.(ed25519.PrivateKey); ok {
+					return priv, priv.Public().(ed25519.PublicKey), nil
+				}
+			}
+		case "PUBLIC KEY":
+			if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+				if pub, ok := key.(ed25519.PublicKey); ok {
+					return nil, pub, nil
+				}
+			}
+		}
+		return nil, nil, fmt.Errorf("signing key file %s: not an Ed25519 %s", path, block.Type)
+	}
+	seed, err := readKeyFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing key file %s must hold an Ed25519 PEM key or a 32-byte seed", path)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return priv, priv.Public().(ed25519.PublicKey), nil
+}
+
+// KeyID returns the ID of the key new signatures are made with.
+func (k *SigningKeys) KeyID() string { return k.current }
+
+// Sign signs the archive digest sha256Hex (as in ArchiveMeta.SHA256) with
+// the current key and returns the signature in base64.
+func (k *SigningKeys) Sign(sha256Hex string) (string, error) {
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(digest) != 32 {
+		return "", fmt.Errorf("sign: invalid sha256 %q", sha256Hex)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(k.priv, digest)), nil
+}
+
+// Verify reports whether signature (base64) is a signature of sha256Hex by
+// the key with ID keyID.
+func (k *SigningKeys) Verify(keyID, sha256Hex, signature string) bool {
+	pub, ok := k.public[keyID]
+	digest, err := hex.DecodeString(sha256Hex)
+	sig, serr := base64.StdEncoding.DecodeString(signature)
+	return ok && err == nil && serr == nil && ed25519.Verify(pub, digest, sig)
+}
+
+// PublicKeys lists the verification keys, the current one first.
+func (k *SigningKeys) PublicKeys() []SigningPublicKey {
+	out := make([]SigningPublicKey, 0, len(k.ids))
+	for _, id := range k.ids {
+		pub := k.public[id]
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		out = append(out, SigningPublicKey{
+			KeyID:     id,
+			Algorithm: SignatureEd25519,
+			PublicKey: base64.StdEncoding.EncodeToString(pub),
+			PEM:       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			Current:   id == k.current,
+		})
+	}
+	return out
+}
+
+// ArchiveSignature is the detached signature of a cached archive.
+type ArchiveSignature struct {
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+}
+
+// signMeta signs meta's digest with the current key; without a Signer it
+// clears any signature, which would otherwise outlive its digest.
+func (s *Storage) signMeta(meta *ArchiveMeta) {
+	meta.Signature, meta.SignatureKeyID = "", ""
+	if s.Signer == nil || meta.SHA256 == "" {
+		return
+	}
+	sig, err := s.Signer.Sign(meta.SHA256)
+	if err != nil {
+		fmt.Printf("warning: sign %s/%s: %v\n", meta.Repo, meta.Branch, err)
+		return
+	}
+	meta.Signature, meta.SignatureKeyID = sig, s.Signer.KeyID()
+}
+
+// ArchiveSignature returns the signature of the cached archive at zipPath.
+// Archives are signed when they are cached; one signed under a key that has
+// since been rotated out, or cached before signing was enabled, is signed
+// afresh with the current key (and stored so at its next refresh). It fails
+// with ErrSigningDisabled without a Signer and ErrNotFound for archives
+// without metadata.
+func (s *Storage) ArchiveSignature(zipPath string) (*ArchiveSignature, error) {
+	if s.Signer == nil {
+		return nil, ErrSigningDisabled
+	}
+	meta, err := readArchiveMeta(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if meta.SHA256 == "" {
+		return nil, fmt.Errorf("archive %s has no checksum: %w", zipPath, ErrNotFound)
+	}
+	if meta.SignatureKeyID != s.Signer.KeyID() || meta.Signature == "" {
+		s.signMeta(meta)
+		if meta.Signature == "" {
+			return nil, fmt.Errorf("sign archive %s: invalid checksum", zipPath)
+		}
+	}
+	return &ArchiveSignature{SHA256: meta.SHA256, Signature: meta.Signature, KeyID: meta.SignatureKeyID, Algorithm: SignatureEd25519}, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrInsufficientSpace reports that a download would not fit on disk.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// DefaultSpaceReserve is the free space downloads leave on the cache and
+// temp filesystems when Storage.SpaceReserve is zero.
+const DefaultSpaceReserve = 64 << 20
+
+// spaceCheckEvery is how many bytes a download of unknown size writes
+// between free-space checks.
+const spaceCheckEvery = 8 << 20
+
+// SpaceError is returned when a download would leave less than the reserve
+// free in Dir. It wraps ErrInsufficientSpace.
+type SpaceError struct {
+	Dir  string
+	Need uint64 // bytes still to write plus the reserve
+	Free uint64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space in %s: need %d bytes, %d free", e.Dir, e.Need, e.Free)
+}
+
+func (e *SpaceError) Unwrap() error { return ErrInsufficientSpace }
+
+func (s *Storage) spaceReserve() (int64, bool) {
+	switch {
+	case s.SpaceReserve < 0:
+		return 0, false
+	case s.SpaceReserve == 0:
+		return DefaultSpaceReserve, true
+	}
+	return s.SpaceReserve, true
+}
+
+// checkSpace fails with a SpaceError when writing need more bytes into dir
+// would leave less than the reserve free there or, with TempDir set, in the
+// cache root, which receives a copy of the temp file. With
+// SpaceEmergencyCleanup it first evicts least recently used archives and
+// checks once more. Filesystems that cannot tell are not checked.
+func (s *Storage) checkSpace(dir string, need int64) error {
+	reserve, ok := s.spaceReserve()
+	if !ok {
+		return nil
+	}
+	if need < 0 {
+		need = 0
+	}
+	dirs := []string{dir}
+	if s.TempDir != "" {
+		dirs = append(dirs, s.Root)
+	}
+	want := uint64(need + reserve)
+	for _, d := range dirs {
+		free, ok := s.freeBytes(d)
+		if !ok || free >= want {
+			continue
+		}
+		if s.SpaceEmergencyCleanup && s.inCache(d) {
+			s.evictForSpace(d, want)
+			if free, ok = s.freeBytes(d); !ok || free >= want {
+				continue
+			}
+		}
+		return &SpaceError{Dir: d, Need: want, Free: free}
+	}
+	return nil
+}
+
+func (s *Storage) freeBytes(dir string) (uint64, bool) {
+	if s.diskFree != nil {
+		return s.diskFree(dir)
+	}
+	return freeBytes(dir)
+}
+
+// inCache reports whether dir is Root or below it, where evicting archives
+// frees space.
+func (s *Storage) inCache(dir string) bool {
+	rel, err := filepath.Rel(s.Root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evictForSpace removes cached archives, least recently used first, until
+// dir's filesystem has want bytes free or none but protected ones are left.
+func (s *Storage) evictForSpace(dir string, want uint64) {
+	s.SyncTouches()
+	type lru struct {
+		path string
+		fi   fs.FileInfo
+	}
+	var archives []lru
+	for _, tree := range s.repoTrees() {
+		_ = filepath.WalkDir(tree, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			zipPath, ok := archivePath(path)
+			if !ok {
+				return nil
+			}
+			if fi, err := d.Info(); err == nil {
+				archives = append(archives, lru{zipPath, fi})
+			}
+			return nil
+		})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].fi.ModTime().Before(archives[j].fi.ModTime()) })
+	var removed int
+	var bytes int64
+	for _, a := range archives {
+		if free, ok := s.freeBytes(dir); !ok || free >= want {
+			break
+		}
+		meta, _ := readArchiveMetaFile(a.path)
+		if meta != nil && meta.Protected {
+			continue
+		}
+		removeArchive(a.path)
+		s.trimRepoDir(filepath.Dir(a.path))
+		s.emitEvicted(a.path, meta, "space")
+		removed++
+		bytes += a.fi.Size()
+	}
+	if removed > 0 {
+		fmt.Printf("low disk space in %s: evicted %d archives (%d bytes)\n", dir, removed, bytes)
+	}
+}
+
+// spaceGuard re-checks free space while a download of unknown size is
+// written, so it fails before filling the disk.
+type spaceGuard struct {
+	w       io.Writer
+	s       *Storage
+	dir     string
+	pending int64
+}
+
+func (g *spaceGuard) Write(p []byte) (int, error) {
+	if g.pending += int64(len(p)); g.pending >= spaceCheckEvery {
+		g.pending = 0
+		if err := g.s.checkSpace(g.dir, spaceCheckEvery); err != nil {
+			return 0, err
+		}
+	}
+	return g.w.Write(p)
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StalePolicy decides what EnsureRepo does when it cannot learn the
+// upstream commit of a branch (GitHub API or git fetch failure) and so
+// cannot tell whether a cached archive is current.
+type StalePolicy string
+
+const (
+	// PreferFresh (the default) tries a fresh download and serves the
+	// cached archive as stale only if that also fails.
+	PreferFresh StalePolicy = "prefer-fresh"
+	// PreferCache serves the cached archive as stale without downloading.
+	PreferCache StalePolicy = "prefer-cache"
+	// StaleFail returns a *StaleError instead of guessing.
+	StaleFail StalePolicy = "fail"
+)
+
+// CacheStale is reported (see WithOutcome) when EnsureRepo returned a cached
+// archive it could not verify against upstream.
+const CacheStale CacheOutcome = "stale"
+
+// ErrUnverified reports that the upstream commit of a branch could not be
+// fetched and the stale policy refused to guess.
+var ErrUnverified = errors.New("cannot verify branch against upstream")
+
+// StaleError is returned under StaleFail. ZipPath is the unverified cached
+// archive, empty when there is none; Err is the failed upstream lookup.
+type StaleError struct {
+	Repo    string
+	Branch  string
+	ZipPath string
+	Err     error
+}
+
+func (e *StaleError) Error() string {
+	msg := fmt.Sprintf("%s: %s@%s: %v", ErrUnverified, e.Repo, e.Branch, e.Err)
+	if e.ZipPath != "" {
+		msg += " (cached archive not served)"
+	}
+	return msg
+}
+
+func (e *StaleError) Unwrap() []error { return []error{ErrUnverified, e.Err} }
+
+// ParseStalePolicy parses a policy name; empty means PreferFresh.
+func ParseStalePolicy(v string) (StalePolicy, error) {
+	switch p := StalePolicy(strings.ToLower(strings.TrimSpace(v))); p {
+	case "":
+		return PreferFresh, nil
+	case PreferFresh, PreferCache, StaleFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("stale policy must be %q, %q or %q, got %q", PreferFresh, PreferCache, StaleFail, v)
+}
+
+type stalePolicyKey struct{}
+
+// WithStalePolicy overrides Storage.StalePolicy for EnsureRepo calls made
+// with the returned context.
+func WithStalePolicy(ctx context.Context, p StalePolicy) context.Context {
+	return context.WithValue(ctx, stalePolicyKey{}, p)
+}
+
+func (s *Storage) stalePolicy(ctx context.Context) StalePolicy {
+	if p, ok := ctx.Value(stalePolicyKey{}).(StalePolicy); ok && p != "" {
+		return p
+	}
+	if s.StalePolicy != "" {
+		return s.StalePolicy
+	}
+	return PreferFresh
+}
+
+// staleAction is what EnsureRepo does about an unverifiable branch.
+type staleAction int
+
+const (
+	staleDownload staleAction = iota
+	staleServe
+	staleFail
+)
+
+func (a staleAction) String() string {
+	switch a {
+	case staleServe:
+		return "serve cached archive as stale"
+	case staleFail:
+		return "fail"
+	}
+	return "download"
+}
+
+// decide is the whole decision table. Without a cache PreferFresh and
+// PreferCache still try a download, which may succeed where the API did not.
+func (p StalePolicy) decide(cached bool) staleAction {
+	switch {
+	case p == StaleFail:
+		return staleFail
+	case p == PreferCache && cached:
+		return staleServe
+	}
+	return staleDownload
+}
+
+// onUnverified applies the stale policy after the upstream commit lookup
+// failed with cause. It returns the archive to serve, or the error to
+// return, or neither when the caller should go on and download.
+func (s *Storage) onUnverified(ctx context.Context, zipPath, ownerRepo, branch string, cause error) (string, error) {
+	if ctx.Err() != nil {
+		return "", cause
+	}
+	cached := archiveExists(zipPath)
+	if s.strict(ctx) {
+		fmt.Printf("cannot verify %s@%s (%v); strict verification: fail\n", ownerRepo, branch, cause)
+		return "", &UnverifiableError{Repo: ownerRepo, Branch: branch, Reason: "upstream commit lookup failed", Err: cause}
+	}
+	policy := s.stalePolicy(ctx)
+	action := policy.decide(cached)
+	fmt.Printf("cannot verify %s@%s (%v); policy=%s cached=%t: %s\n", ownerRepo, branch, cause, policy, cached, action)
+	switch action {
+	case staleServe:
+		return s.serveStale(ctx, zipPath), nil
+	case staleFail:
+		e := &StaleError{Repo: ownerRepo, Branch: branch, Err: cause}
+		if cached {
+			e.ZipPath = zipPath
+		}
+		return "", e
+	}
+	return "", nil
+}
+
+// fallBackToStale serves the cached archive after a fresh download failed
+// under PreferFresh; it reports false when there is nothing to fall back to.
+func (s *Storage) fallBackToStale(ctx context.Context, zipPath, ownerRepo, branch string, cause error) (string, bool) {
+	if ctx.Err() != nil || s.strict(ctx) || s.stalePolicy(ctx) != PreferFresh || !archiveExists(zipPath) {
+		return "", false
+	}
+	fmt.Printf("refresh of %s@%s failed (%v); serving cached archive as stale\n", ownerRepo, branch, cause)
+	return s.serveStale(ctx, zipPath), true
+}
+
+func (s *Storage) serveStale(ctx context.Context, zipPath string) string {
+	s.touchServed(ctx, zipPath)
+	if !background(ctx) {
+		s.stats.cacheHits.Add(1)
+	}
+	ReportOutcome(ctx, CacheStale)
+	return zipPath
+}
+
+func archiveExists(zipPath string) bool {
+	fi, err := statArchive(zipPath)
+	return err == nil && !fi.IsDir()
+}
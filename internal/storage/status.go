@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProviderGitHub is the only upstream archives are fetched from.
+const ProviderGitHub = "github"
+
+// BranchStatus is everything known about a user's cached branch, as served
+// by /api/v1/repos/info. Unknown fields are left empty and omitted from the
+// JSON rather than reported as zero values.
+type BranchStatus struct {
+	Repo     string `json:"repo"`
+	Branch   string `json:"branch"`
+	Provider string `json:"provider"`
+	Cached   bool   `json:"cached"`
+	Legacy   bool   `json:"legacy,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Compression and StoredSize are set for archives kept compressed.
+	Compression  string     `json:"compression,omitempty"`
+	StoredSize   int64      `json:"stored_size,omitempty"`
+	CommitSHA    string     `json:"commit_sha,omitempty"`
+	ShortSHA     string     `json:"short_sha,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	FetchedAt    *time.Time `json:"fetched_at,omitempty"`
+	LastAccessed *time.Time `json:"last_accessed,omitempty"`
+	Pinned       bool       `json:"pinned,omitempty"`
+	Protected    bool       `json:"protected,omitempty"`
+	// The fields below are only filled by a remote check.
+	RemoteSHA string `json:"remote_sha,omitempty"`
+	// Stale reports whether the cached commit differs from RemoteSHA; it is
+	// omitted when either is unknown.
+	Stale *bool `json:"stale,omitempty"`
+	// CanonicalRepo is the name GitHub answers to when the repository was
+	// renamed or transferred since it was requested as Repo.
+	CanonicalRepo string `json:"canonical_repo,omitempty"`
+}
+
+// BranchStatus describes the user's archive of branch (the recorded default
+// branch, else main, when empty) from the files on disk, preferring the
+// git-mode archive over the legacy one. It never downloads. With remote set
+// it also resolves the branch on GitHub, one API call, to tell whether the
+// cache is behind and whether the repository was renamed.
+func (s *Storage) BranchStatus(ctx context.Context, user, ownerRepo, branch, token string, remote bool) (*BranchStatus, error) {
+	user, ownerRepo, branch, err := s.historyBranch(user, ownerRepo, branch)
+	if err != nil {
+		return nil, err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	st := &BranchStatus{Repo: ownerRepo, Branch: branch, Provider: ProviderGitHub}
+	for i, zipPath := range s.branchArchives(user, ownerRepo, branch) {
+		fi, err := statArchive(zipPath)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		res := archiveResult(zipPath, s.ShortSHALen)
+		st.Cached, st.Legacy = true, i == 1
+		st.Size, st.CommitSHA, st.ShortSHA, st.SHA256 = res.Size, res.CommitSHA, res.ShortSHA, res.SHA256
+		if !res.FetchedAt.IsZero() {
+			t := res.FetchedAt.UTC()
+			st.FetchedAt = &t
+		}
+		accessed := fi.ModTime().UTC()
+		st.LastAccessed = &accessed
+		if meta, err := readArchiveMeta(zipPath); err == nil {
+			storedInfo(zipPath, meta)
+			st.Compression, st.StoredSize, st.Pinned, st.Protected = meta.Compression, meta.StoredSize, meta.Pinned, meta.Protected
+		}
+		break
+	}
+	if !remote {
+		return st, nil
+	}
+	if err := s.checkRepo(ownerRepo); err != nil {
+		return nil, err
+	}
+	info, err := s.resolveRemoteRef(ctx, ownerRepo, branch, token)
+	if err != nil {
+		return nil, fmt.Errorf("check %s@%s: %w", ownerRepo, branch, err)
+	}
+	st.RemoteSHA = info.SHA
+	if info.repo != "" && !strings.EqualFold(info.repo, ownerRepo) {
+		st.CanonicalRepo = info.repo
+	}
+	cached := st.CommitSHA
+	if cached == "" {
+		cached = st.ShortSHA
+	}
+	if cached != "" {
+		stale := !strings.HasPrefix(strings.ToLower(info.SHA), strings.ToLower(cached))
+		st.Stale = &stale
+	}
+	return st, nil
+}
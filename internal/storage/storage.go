@@ -2,6 +2,7 @@ package storage
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
@@ -24,6 +26,14 @@ import (
 var (
 	ErrBadPath  = errors.New("bad path")
 	ErrNotFound = errors.New("not found")
+	// ErrRepoNotFound reports that GitHub answered 404 for the repository
+	// (it does not exist, or the token cannot see it).
+	ErrRepoNotFound = errors.New("repository not found")
+	// ErrBranchNotFound reports that the repository exists but has no such
+	// branch, tag or commit.
+	ErrBranchNotFound = errors.New("branch not found")
+	// ErrRateLimited reports that GitHub refused the call due to rate limiting.
+	ErrRateLimited = errors.New("github rate limit exceeded")
 )
 
 // RepoInfo holds metadata written to info.json after download.
@@ -42,10 +52,173 @@ type Storage struct {
 	DebugSlowReader time.Duration // DEBUG: delay per read chunk to simulate slow network
 	RetryMax        int
 	RetryBackoff    time.Duration
+	// DefaultBranchTTL controls how long a repository's default branch is
+	// remembered per repo; zero disables the cache.
+	DefaultBranchTTL time.Duration
+	// CommitsTTL controls how long ListCommits results are reused; zero
+	// disables the cache.
+	CommitsTTL time.Duration
+	// StalePolicy applies when a branch's upstream commit cannot be fetched
+	// (see StalePolicy); empty means PreferFresh. WithStalePolicy overrides
+	// it per call.
+	StalePolicy StalePolicy
+	// StrictVerification makes EnsureRepo refuse, with an
+	// *UnverifiableError, any archive it cannot verify against the branch
+	// head instead of serving it (see WithStrict). Forced refreshes still
+	// download.
+	StrictVerification bool
+	// SecondaryRetries is how often a call hit by a GitHub secondary rate
+	// limit sleeps and retries (0 = default 2, negative = never);
+	// SecondaryWaitMax caps the advised wait it will sleep (default 2m).
+	// Longer waits fail at once and the breaker stays open meanwhile.
+	SecondaryRetries int
+	SecondaryWaitMax time.Duration
+	// APICallTimeout bounds each GitHub API call, reading the answer
+	// included, even when the caller's context has no deadline (0 =
+	// default 30s, negative = none). Answers over 1 MiB fail with an
+	// *APIResponseTooLargeError.
+	APICallTimeout time.Duration
+	// CircuitThreshold is how many GitHub calls in a row must fail (no
+	// answer, or a 5xx) to open the upstream circuit (0 = default 5,
+	// negative = never). While it is open, for CircuitCooldown (default
+	// 30s), GitHub calls fail at once with a *CircuitOpenError and
+	// EnsureRepo applies the stale policy; then one probe call decides
+	// whether it closes or stays open for another cool-down.
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
+	// Retention caps archives per user and repo; applied by CleanupExpired
+	// and, with RetainOnEnsure, after every successful EnsureRepo.
+	Retention      RetentionPolicy
+	RetainOnEnsure bool
+	// GonePurgeAfter removes archives whose branch has been confirmed
+	// deleted upstream for longer than this; zero keeps them until the TTL.
+	GonePurgeAfter time.Duration
+	// KeepPrevious is how many replaced archives to keep per branch as
+	// <branch>.<shortsha>.zip for ArchiveAt and Rollback; zero keeps none.
+	// Kept archives count against Retention like any other archive.
+	KeepPrevious int
+	// TouchInterval coalesces access-time writes: an entry's mtime is
+	// written at most once per interval, newer accesses being kept in
+	// memory until FlushTouches or SyncTouches (cleanup syncs first). New
+	// sets DefaultTouchInterval; zero writes every access.
+	TouchInterval time.Duration
+	// ShortSHALen is the length of the short SHA written to .commit.txt and
+	// reported as RepoArchive.ShortSHA; 0 means DefaultShortSHALen. The full
+	// SHA is always in the .meta.json sidecar.
+	ShortSHALen int
+	// TrashDeletes makes Delete move items to trash/ instead of removing
+	// them, for Restore; cleanup purges them after TrashRetention (zero
+	// keeps them).
+	TrashDeletes   bool
+	TrashRetention time.Duration
+	// CompressArchives stores newly cached repo archives zstd-compressed
+	// as <branch>.zip.zst; they are decompressed as they are served.
+	// Archives already on disk are read either way.
+	CompressArchives bool
+	// Keys encrypts newly cached archives, normalized archives and packages
+	// at rest (after compression); they are decrypted as they are served.
+	// Files on disk are read whether encrypted or not, so a cache can be
+	// migrated gradually, and encrypted files need the key they were
+	// written with. Bare git caches are not encrypted.
+	Keys KeyProvider
+	// Signer signs the SHA-256 of newly cached archives (see
+	// ArchiveSignature).
+	Signer *SigningKeys
+	// UserAgent is sent on every request to GitHub and package hosts and
+	// by git fetches; empty means DefaultUserAgent.
+	UserAgent string
+	// Redirects limits the redirects package downloads follow; New sets
+	// DefaultRedirectPolicy. A refused hop fails with ErrRedirectPolicy.
+	Redirects RedirectPolicy
+	// PackageHostCheck, when set, vets a package URL and every redirect
+	// hop before it is requested, and, with the transport New builds
+	// (see SetTransport), the address each of their connections goes to,
+	// as a URL whose host is that IP and port; PublicHostCheck keeps
+	// downloads off internal hosts. A refused package URL fails with
+	// ErrBadPath, a refused hop with ErrRedirectPolicy, both also matching
+	// the check's error; a refused connection fails with the check's error.
+	// New leaves it nil.
+	PackageHostCheck func(ctx context.Context, u *url.URL) error
+	// Layout is where repo archives are cached; empty means LayoutPerUser.
+	Layout CacheLayout
+	// EmptyRepoTTL is how long a repository found to have no commits fails
+	// with ErrEmptyRepo without asking GitHub again (force bypasses it);
+	// zero disables the negative cache.
+	EmptyRepoTTL time.Duration
+	// TempDir receives downloads while they stream; they are then moved
+	// into the cache, by copy when it is another filesystem. Empty writes
+	// them beside their destination and renames them into place.
+	TempDir string
+	// SpaceReserve is the free space downloads must leave on the cache and
+	// TempDir filesystems (0 = DefaultSpaceReserve, negative = no checks).
+	// With SpaceEmergencyCleanup a download that would not fit first evicts
+	// least recently used archives.
+	SpaceReserve          int64
+	SpaceEmergencyCleanup bool
+	// Clock is read wherever storage needs the time: TTLs, cleanup,
+	// access times and fetched-at stamps (the server ages archives by it
+	// too). New sets the real clock; nil also means the real clock.
+	Clock Clock
+	// Fetcher resolves branches and fetches archives for legacy mode and
+	// default-branch lookups; nil means GitHub. Git mode still clones
+	// from GitHub.
+	Fetcher RemoteFetcher
+	// BranchLookup picks the GitHub API call that resolves a branch head
+	// ("" = BranchLookupRef, the Git Data API).
+	BranchLookup BranchLookup
+	// ArchiveLagBackoff is the first wait (0 = 500ms) before asking again
+	// for the archive of a commit the API resolved but codeload 404s.
+	ArchiveLagBackoff time.Duration
+	// Events receives archive refreshes, evictions and finished cleanups
+	// as they happen; nil publishes nothing.
+	Events EventSink
+	// SlowDownloadThreshold, in bytes per second, flags downloads of at
+	// least 1 MiB that were slower as slow: each is logged and the first
+	// marks upstream degraded (see UpstreamHealth) until
+	// SlowDownloadRecovery (0 = 3) judged downloads in a row were not.
+	// Zero disables the alert; downloads are recorded either way.
+	SlowDownloadThreshold int64
+	SlowDownloadRecovery  int
+	// DownloadObserver is called after every upstream download.
+	DownloadObserver DownloadObserver
+	// Tiers are slower cache roots, fastest first, that Rebalance moves
+	// least recently used archives to once Root holds more than
+	// HotCapacity bytes of them (0 = unlimited). Downloads always land in
+	// Root and moved archives stay reachable through it.
+	Tiers       []Tier
+	HotCapacity int64
 
 	mu     sync.Mutex
 	lock   map[string]*sync.Mutex
 	rwLock map[string]*sync.RWMutex // for git cache read/write locks
+	stats  counters
+	// downloads keeps RecentDownloads and the UpstreamHealth state.
+	downloads downloadLog
+	// defaultClient is the client New built, which SetTransport may retune.
+	defaultClient *http.Client
+
+	defaultBranches map[string]defaultBranchEntry
+	knownDefaults   map[string]string // owner/repo -> default branch, for retention
+	repoNames       map[string]string // lower-case owner/repo -> GitHub's full_name
+	commits         map[string]commitsEntry
+	emptyRepos      map[string]time.Time // owner/repo|token -> negative cache expiry
+	refETags        map[string]refETag   // branch lookup URL|token -> last ETag
+	breakers        map[string]*breaker  // token hash -> secondary rate limit state
+	circuit         upstreamCircuit
+	flights         flightGroup // collapses concurrent branch/SHA lookups
+	repoPolicy      atomic.Pointer[RepoPolicy]
+	packagePolicy   atomic.Pointer[PackagePolicy]
+	tokenRoutes     atomic.Pointer[TokenRoutes]
+	packageMirrors  atomic.Pointer[PackageMirrors]
+	touches         touchLog
+
+	// rename is os.Rename unless a test injects a failure.
+	rename func(oldpath, newpath string) error
+	// diskFree is freeBytes unless a test fakes a full disk.
+	diskFree func(dir string) (uint64, bool)
+	// lockWait, when a test sets it, is called with the lock key before a
+	// branch or git cache write lock is taken.
+	lockWait func(key string)
 }
 
 func sanitizeName(v string) string {
@@ -64,26 +237,18 @@ func PackageHash(pkgURL string) string {
 
 // EnsurePackage caches a package archive downloaded from pkgURL under:
 // <root>/users/<user>/packages/<url-hash>/<filename>
+// URLs the package policy denies fail with ErrPolicyDenied, cached or not.
 func (s *Storage) EnsurePackage(ctx context.Context, user, pkgURL string) (string, error) {
-	user = sanitizeName(strings.Trim(user, "/ "))
-	if user == "" {
-		user = "default"
-	}
-	if user == "." || strings.Contains(user, "..") {
-		return "", fmt.Errorf("invalid user: %w", ErrBadPath)
-	}
-
-	u, _ := url.Parse(pkgURL)
-	filename := ""
-	if u != nil {
-		filename = filepath.Base(u.Path)
-	}
-	if filename == "" || filename == "." || filename == "/" {
-		filename = filepath.Base(pkgURL)
+	user, err := packageUser(user)
+	if err != nil {
+		return "", err
 	}
-	if filename == "" || filename == "." || filename == "/" {
-		filename = "package.bin"
+	if !strings.HasPrefix(pkgURL, UploadScheme) {
+		if err := s.checkPackagePolicy(user, pkgURL); err != nil {
+			return "", err
+		}
 	}
+	filename := packageFilename(pkgURL)
 	hashStr := PackageHash(pkgURL)
 
 	pkgDir := filepath.Join(s.Root, "users", user, "packages", hashStr)
@@ -92,28 +257,45 @@ func (s *Storage) EnsurePackage(ctx context.Context, user, pkgURL string) (strin
 	// If exists, reuse
 	if info, err := os.Stat(pkgPath); err == nil && !info.IsDir() {
 		_ = s.touch(pkgPath)
+		s.noteHit(ctx)
 		return pkgPath, nil
 	}
+	s.noteMiss(ctx)
+	if strings.HasPrefix(pkgURL, UploadScheme) {
+		// Uploaded packages have no upstream to fall back to.
+		return "", fmt.Errorf("uploaded package %s: %w", pkgURL, ErrNotFound)
+	}
 
 	if err := os.MkdirAll(pkgDir, 0o755); err != nil {
 		return "", err
 	}
-	tmpFile, err := os.CreateTemp(pkgDir, ".tmp-package-*.bin")
+	tmpDir, err := s.tempDirFor(pkgDir)
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, ".tmp-package-*.bin")
 	if err != nil {
 		return "", err
 	}
 	tmpPath := tmpFile.Name()
 	_ = tmpFile.Close()
 
-	if err := s.downloadFile(ctx, pkgURL, tmpPath); err != nil {
+	finalURL, source, err := s.downloadPackage(ctx, user, pkgURL, tmpPath)
+	if err != nil {
 		_ = os.Remove(tmpPath)
 		return "", err
 	}
+	if tmpPath, err = s.sealPackage(tmpPath, pkgPath); err != nil {
+		return "", err
+	}
 	_ = os.Remove(pkgPath)
-	if err := os.Rename(tmpPath, pkgPath); err != nil {
+	if err := s.replaceFile(tmpPath, pkgPath); err != nil {
 		_ = os.Remove(tmpPath)
 		return "", err
 	}
+	if err := s.recordPackage(pkgPath, pkgURL, finalURL, source); err != nil {
+		fmt.Printf("package metadata error url=%s err=%v\n", pkgURL, err)
+	}
 	_ = s.touch(pkgPath)
 	return pkgPath, nil
 }
@@ -126,27 +308,22 @@ func New(root string) *Storage {
 // NewWithTimeout creates a Storage with an HTTP client configured with the given timeout.
 // If timeout <= 0, no client-level timeout is set (relies on context timeout).
 func NewWithTimeout(root string, timeout time.Duration) *Storage {
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	client := &http.Client{Transport: transport}
-	if timeout > 0 {
-		client.Timeout = timeout
-	}
-	return &Storage{
-		Root:         root,
-		HTTPClient:   client,
-		RetryMax:     5,
-		RetryBackoff: 2 * time.Second,
-	}
+	st := &Storage{
+		Root:             root,
+		RetryMax:         5,
+		RetryBackoff:     2 * time.Second,
+		DefaultBranchTTL: 10 * time.Minute,
+		CommitsTTL:       time.Minute,
+		EmptyRepoTTL:     defaultEmptyRepoTTL,
+		Clock:            realClock{},
+		Redirects:        DefaultRedirectPolicy(),
+		TouchInterval:    DefaultTouchInterval,
+	}
+	// One transport serves API calls, archive downloads and package fetches,
+	// so they share its connection pool.
+	st.defaultClient = &http.Client{Transport: newTransport(DefaultTransportOptions(), &st.stats), Timeout: max(timeout, 0)}
+	st.HTTPClient = st.defaultClient
+	return st
 }
 
 func (s *Storage) httpClient() *http.Client {
@@ -163,12 +340,147 @@ func (s *Storage) httpClient() *http.Client {
 // Returns the path to the zip file and the commit SHA.
 //
 // If branch is empty, fetches the default branch from GitHub API.
+// A branch of PullRef(n) ("pr/123") is the head of pull request n instead,
+// fetched from the head repository; legacy is ignored for it.
 // If force is true, bypasses cache validation and always downloads fresh.
 func (s *Storage) EnsureRepo(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (string, error) {
-	if legacy {
-		return s.ensureRepoLegacy(ctx, user, ownerRepo, branch, token, force)
+	if err := ValidateRef(branch); err != nil {
+		return "", err
 	}
-	return s.ensureRepoViaGit(ctx, user, ownerRepo, branch, token, force)
+	var err error
+	if onlyIfCached(ctx) {
+		ownerRepo, err = s.localChecked(ownerRepo)
+	} else {
+		ownerRepo, err = s.canonicalChecked(ctx, ownerRepo, token)
+	}
+	if err != nil {
+		return "", err
+	}
+	token = s.tokenFor(ownerRepo, token)
+	if branch == LatestRelease {
+		if branch, err = s.latestReleaseTag(ctx, user, ownerRepo, token, force); err != nil {
+			return "", err
+		}
+		if err := ValidateRef(branch); err != nil {
+			return "", fmt.Errorf("latest release: %w", err)
+		}
+	}
+	var zipPath string
+	if n, ok := PullNumber(branch); ok {
+		zipPath, err = s.ensurePullArchive(ctx, user, ownerRepo, n, token, force)
+	} else if legacy {
+		zipPath, err = s.ensureRepoLegacy(ctx, user, ownerRepo, branch, token, force)
+	} else {
+		zipPath, err = s.ensureRepoViaGit(ctx, user, ownerRepo, branch, token, force)
+	}
+	if ns := noStoreOf(ctx); ns != nil && ns.path != "" && ns.path == zipPath {
+		return zipPath, err
+	}
+	if err == nil && s.RetainOnEnsure {
+		// Runs after the branch lock is released so two requests pruning
+		// each other's branches cannot deadlock.
+		if u, repo, nerr := s.normalizeUserRepo(user, ownerRepo); nerr == nil {
+			s.applyRetention(u, repo, zipPath, nil)
+		}
+	}
+	return zipPath, err
+}
+
+// RepoArchive describes the archive EnsureRepoResult ensured, so callers
+// can serve it without reading its sidecar files.
+type RepoArchive struct {
+	Path      string
+	CommitSHA string // empty when the upstream commit was never known
+	ShortSHA  string // CommitSHA abbreviated to Storage.ShortSHALen
+	SHA256    string
+	Size      int64 // uncompressed, also when Compressed
+	FetchedAt time.Time
+	FromCache bool // served from cache (hit, pinned or stale) rather than downloaded
+	// Tag is the release tag a LatestRelease request resolved to.
+	Tag string
+	// Outcome is how the archive was obtained: CacheHit, CacheRevalidated,
+	// CacheMiss or CacheStale.
+	Outcome CacheOutcome
+	// Compressed archives are stored as Path+".zst" and Encrypted ones are
+	// encrypted at rest; read them through OpenArchive or RawArchive.
+	Compressed bool
+	Encrypted  bool
+	// Transient archives were downloaded for a WithNoStore request and
+	// never entered the cache; Path is a temporary file the caller removes
+	// with Discard once it has been served.
+	Transient bool
+	// CachePath is where a Transient archive would have been cached.
+	CachePath string
+}
+
+// EnsureRepoResult is EnsureRepo returning what is known about the archive.
+// The cache outcome is still reported to a context prepared with WithOutcome.
+func (s *Storage) EnsureRepoResult(ctx context.Context, user, ownerRepo, branch, token string, force, legacy bool) (*RepoArchive, error) {
+	var outcome CacheOutcome
+	zipPath, err := s.EnsureRepo(WithOutcome(ctx, &outcome), user, ownerRepo, branch, token, force, legacy)
+	if outcome != "" {
+		ReportOutcome(ctx, outcome)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ns := noStoreOf(ctx); ns != nil && ns.path != "" && ns.path == zipPath {
+		return s.transientResult(ns), nil
+	}
+	res := archiveResult(zipPath, s.ShortSHALen)
+	res.FromCache = outcome != CacheMiss
+	res.Outcome = outcome
+	if branch == LatestRelease {
+		if meta, err := readArchiveMeta(zipPath); err == nil {
+			res.Tag = meta.Branch
+		}
+	}
+	return res, nil
+}
+
+// archiveResult describes zipPath from its metadata sidecar, with short
+// SHAs of shortLen digits. A legacy download whose commit could not be
+// fetched keeps the previous .commit.txt, which is the best short SHA there
+// is.
+func archiveResult(zipPath string, shortLen int) *RepoArchive {
+	res := &RepoArchive{Path: zipPath}
+	if meta, err := readArchiveMeta(zipPath); err == nil {
+		res.CommitSHA = meta.CommitSHA
+		res.ShortSHA = abbrevSHA(meta.CommitSHA, shortLen)
+		res.SHA256 = meta.SHA256
+		res.Size = meta.Size
+		res.FetchedAt = meta.FetchedAt
+	}
+	res.Compressed = storedPath(zipPath) != zipPath
+	res.Encrypted = sealInfo(storedPath(zipPath)) != nil
+	if res.ShortSHA == "" {
+		res.ShortSHA, _ = readSHA(strings.TrimSuffix(zipPath, ".zip") + ".commit.txt")
+	}
+	return res
+}
+
+// gitCachedArchive makes the cache decisions git mode takes before
+// consulting the bare repo, under the branch lock: done reports that the
+// request is answered, with p or err.
+func (s *Storage) gitCachedArchive(ctx context.Context, zipPath, ownerRepo, branch, token string) (p string, done bool, err error) {
+	if err := s.strictCheck(ctx, zipPath, ownerRepo, branch); err != nil {
+		return "", true, err
+	}
+	// A rolled-back archive stays pinned until a forced refresh.
+	if p, ok := s.pinnedArchive(ctx, zipPath); ok {
+		return p, true, nil
+	}
+	if p, ok := s.withinMaxAge(ctx, zipPath); ok {
+		return p, true, nil
+	}
+	if onlyIfCached(ctx) {
+		p, err := s.cachedOnly(ctx, zipPath, ownerRepo, branch)
+		return p, true, err
+	}
+	if !archiveExists(zipPath) && s.knownEmpty(ownerRepo, token) {
+		return "", true, emptyRepoError(ownerRepo)
+	}
+	return "", false, nil
 }
 
 // ensureRepoViaGit uses bare repo cache + git archive for downloading.
@@ -187,28 +499,76 @@ func (s *Storage) ensureRepoViaGit(ctx context.Context, user, ownerRepo, branch,
 		return "", fmt.Errorf("owner/repo expected: %w", ErrBadPath)
 	}
 
-	// Ensure bare repo is up-to-date
-	if _, err := s.EnsureBareRepo(ctx, ownerRepo, token); err != nil {
-		return "", err
-	}
-
 	// If branch not specified, use "main" as default
 	if branch == "" {
 		branch = "main"
 	}
-
-	zipPath := filepath.Join(s.Root, "users", user, "repos", ownerRepo, branch+".zip")
+	zipPath := filepath.Join(s.reposDir(user), ownerRepo, branch+".zip")
 	metaPath := zipPath + ".meta"
+	// The branch lock covers the cache decision, so a concurrent refresh
+	// cannot replace the archive and its sidecars between the check and
+	// the serve, and then the install, but not the bare repo fetch in
+	// between: requests the cache answers do not wait for a fetch.
+	if !force {
+		unlock := s.acquire(user, ownerRepo, branch)
+		p, done, err := s.gitCachedArchive(ctx, zipPath, ownerRepo, branch, token)
+		unlock()
+		if done {
+			return p, err
+		}
+	}
+
+	// Ensure bare repo is up-to-date. If the fetch fails the cached archive
+	// cannot be verified; the stale policy decides whether to serve it.
+	_, ferr := s.EnsureBareRepo(ctx, ownerRepo, token)
 	unlock := s.acquire(user, ownerRepo, branch)
 	defer unlock()
+	if !force && ferr == nil {
+		// The archive may have been rolled back or refreshed during the
+		// fetch.
+		if p, done, err := s.gitCachedArchive(ctx, zipPath, ownerRepo, branch, token); done {
+			return p, err
+		}
+	}
+	if err := ferr; err != nil {
+		if force || errors.Is(err, ErrPolicyDenied) || errors.Is(err, ErrBadPath) {
+			return "", err
+		}
+		if p, serr := s.onUnverified(ctx, zipPath, ownerRepo, branch, err); p != "" || serr != nil {
+			return p, serr
+		}
+		// git mode has no other way to download.
+		if p, ok := s.fallBackToStale(ctx, zipPath, ownerRepo, branch, err); ok {
+			return p, nil
+		}
+		return "", err
+	}
 
 	// Get current commit SHA from bare repo
 	barePath := s.gitCachePath(ownerRepo)
 	refName := "origin/" + branch
 	remoteSHA, err := s.gitRevParse(ctx, barePath, refName)
 	if err != nil {
+		// The bare repo was just fetched with --prune, so a branch we hold
+		// an archive for but cannot resolve was deleted upstream.
+		if archiveExists(zipPath) {
+			return "", s.branchGone(zipPath, ownerRepo, branch)
+		}
+		if gitRepoEmpty(ctx, barePath) {
+			s.rememberEmpty(ownerRepo, token)
+			return "", emptyRepoError(ownerRepo)
+		}
+		if ctx.Err() == nil {
+			// Fetched with --prune just now: the branch does not exist.
+			return "", fmt.Errorf("resolve branch %q: %v: %w", branch, err, &NotFoundError{Repo: ownerRepo, Branch: branch, Token: strings.TrimSpace(token) != ""})
+		}
 		return "", fmt.Errorf("resolve branch %q: %w", branch, err)
 	}
+	// A caller that gave up while the bare repo was fetched gets nothing,
+	// not even a touched cache entry.
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
 	parent := filepath.Dir(zipPath)
 	if err := os.MkdirAll(parent, 0o755); err != nil {
@@ -217,17 +577,28 @@ func (s *Storage) ensureRepoViaGit(ctx context.Context, user, ownerRepo, branch,
 
 	// If we have cache and sha matches, reuse (unless force refresh requested).
 	if !force {
-		if info, err := os.Stat(zipPath); err == nil && !info.IsDir() {
+		if info, err := statArchive(zipPath); err == nil && !info.IsDir() {
 			if cachedSHA, err := readSHA(metaPath); err == nil && cachedSHA == remoteSHA {
-				_ = s.touch(zipPath)
-				return zipPath, nil
+				if s.archiveIntact(zipPath, ownerRepo, branch, remoteSHA, info.Size()) {
+					clearGone(zipPath)
+					s.touchServed(ctx, zipPath)
+					s.noteRevalidated(ctx)
+					return zipPath, nil
+				}
+				fmt.Printf("cached archive %s is corrupt, re-exporting\n", zipPath)
+				removeArchive(zipPath)
 			}
 		}
 	}
 
 	// Export via git archive
+	s.noteMiss(ctx)
 	fmt.Printf("exporting %s@%s via git archive...\n", ownerRepo, branch)
-	tmpFile, err := os.CreateTemp(parent, ".tmp-download-*.zip")
+	tmpDir, err := s.tempDirFor(parent)
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, ".tmp-download-*.zip")
 	if err != nil {
 		return "", err
 	}
@@ -259,9 +630,18 @@ func (s *Storage) ensureRepoViaGit(ctx context.Context, user, ownerRepo, branch,
 		_ = os.Remove(tmpPath)
 		return "", fmt.Errorf("git archive failed: %w", err)
 	}
+	// Last point to back out: past here the archive is published.
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	if ns := noStoreOf(ctx); ns != nil {
+		return ns.keepTransient(tmpPath, zipPath, remoteSHA), nil
+	}
 
-	_ = os.Remove(zipPath)
-	if err := os.Rename(tmpPath, zipPath); err != nil {
+	oldSHA, _ := readSHA(metaPath)
+	history := s.retainCurrent(zipPath, remoteSHA)
+	if err := s.installArchive(tmpPath, zipPath); err != nil {
 		_ = os.Remove(tmpPath)
 		return "", err
 	}
@@ -269,11 +649,7 @@ func (s *Storage) ensureRepoViaGit(ctx context.Context, user, ownerRepo, branch,
 	// Write metadata
 	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
 	_ = writeSHA(metaPath, remoteSHA)
-	short := remoteSHA
-	if len(short) > 7 {
-		short = short[:7]
-	}
-	_ = writeSHA(commitPath, short)
+	_ = writeSHA(commitPath, abbrevSHA(remoteSHA, s.ShortSHALen))
 
 	// Write info.json (repo, branch, commit_sha, commit_message, changed_files)
 	infoPath := strings.TrimSuffix(zipPath, ".zip") + ".info.json"
@@ -288,8 +664,14 @@ func (s *Storage) ensureRepoViaGit(ctx context.Context, user, ownerRepo, branch,
 		info.ChangedFiles = []string{}
 	}
 	_ = writeInfoJSON(infoPath, info)
+	if meta, err := s.recordArchive(zipPath, ownerRepo, branch, remoteSHA); err != nil {
+		fmt.Printf("warning: record archive metadata for %s: %v\n", zipPath, err)
+	} else {
+		recordHistory(zipPath, meta, history)
+	}
+	s.emitRefreshed(zipPath, ownerRepo, branch, oldSHA, remoteSHA)
 
-	_ = s.touch(zipPath)
+	s.touchServed(ctx, zipPath)
 	return zipPath, nil
 }
 
@@ -308,6 +690,11 @@ func (s *Storage) ensureRepoLegacy(ctx context.Context, user, ownerRepo, branch,
 		return "", fmt.Errorf("owner/repo expected: %w", ErrBadPath)
 	}
 	// If branch not specified, fetch the default branch from GitHub
+	if branch == "" && onlyIfCached(ctx) {
+		if branch = s.recordedDefaultBranch(ownerRepo); branch == "" {
+			return "", fmt.Errorf("%s: default branch not known: %w", ownerRepo, ErrNotCached)
+		}
+	}
 	if branch == "" {
 		defaultBranch, err := s.fetchDefaultBranch(ctx, ownerRepo, token)
 		if err != nil {
@@ -320,12 +707,66 @@ func (s *Storage) ensureRepoLegacy(ctx context.Context, user, ownerRepo, branch,
 	safeBranch := strings.ReplaceAll(branch, "/", "-")
 	safeBranch = strings.ReplaceAll(safeBranch, "\\", "-")
 	// Use .legacy.zip suffix to separate from git mode cache
-	zipPath := filepath.Join(s.Root, "users", user, "repos", ownerRepo, safeBranch+".legacy.zip")
+	zipPath := filepath.Join(s.reposDir(user), ownerRepo, safeBranch+".legacy.zip")
 	metaPath := zipPath + ".meta"
 	unlock := s.acquire(user, ownerRepo, branch+"-legacy")
 	defer unlock()
 
+	if !force {
+		if err := s.strictCheck(ctx, zipPath, ownerRepo, branch); err != nil {
+			return "", err
+		}
+		if p, ok := s.pinnedArchive(ctx, zipPath); ok {
+			return p, nil
+		}
+		if p, ok := s.withinMaxAge(ctx, zipPath); ok {
+			return p, nil
+		}
+		if onlyIfCached(ctx) {
+			return s.cachedOnly(ctx, zipPath, ownerRepo, branch)
+		}
+		if !archiveExists(zipPath) && s.knownEmpty(ownerRepo, token) {
+			return "", emptyRepoError(ownerRepo)
+		}
+	}
+
 	remoteSHA, fetchErr := s.fetchBranchSHA(ctx, ownerRepo, branch, token)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if errors.Is(fetchErr, errBranchMissing) && s.Fetcher == nil {
+		// Not a branch; codeload serves tags and commits too, so resolve
+		// those to a SHA and cache them like branches. Other fetchers
+		// resolve them in ResolveRefSHA.
+		if info, err := s.resolveTagOrCommit(ctx, ownerRepo, branch, token); err == nil {
+			remoteSHA, fetchErr = info.SHA, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			fetchErr = err
+		}
+	}
+	if errors.Is(fetchErr, ErrEmptyRepo) {
+		// The branch lookup 404s and the tag lookup 409s until the first
+		// push; codeload would 404 as well.
+		s.rememberEmpty(ownerRepo, token)
+	}
+	if errors.Is(fetchErr, errBranchMissing) || errors.Is(fetchErr, ErrRepoNotFound) || errors.Is(fetchErr, ErrEmptyRepo) {
+		if archiveExists(zipPath) {
+			return "", s.branchGone(zipPath, ownerRepo, branch)
+		}
+		// Nothing to download: codeload would answer 404 as well.
+		if errors.Is(fetchErr, ErrRepoNotFound) || errors.Is(fetchErr, ErrEmptyRepo) {
+			return "", fetchErr
+		}
+		return "", &NotFoundError{Repo: ownerRepo, Branch: branch, Token: strings.TrimSpace(token) != ""}
+	}
+	// Without the upstream SHA the cache cannot be verified; the stale
+	// policy decides between serving it, failing and downloading.
+	unverified := fetchErr != nil && !errors.Is(fetchErr, errBranchMissing) && !force
+	if unverified {
+		if p, err := s.onUnverified(ctx, zipPath, ownerRepo, branch, fetchErr); p != "" || err != nil {
+			return p, err
+		}
+	}
 
 	parent := filepath.Dir(zipPath)
 	if err := os.MkdirAll(parent, 0o755); err != nil {
@@ -334,31 +775,56 @@ func (s *Storage) ensureRepoLegacy(ctx context.Context, user, ownerRepo, branch,
 
 	// If we have cache and sha matches, reuse (unless force refresh requested).
 	if !force {
-		if info, err := os.Stat(zipPath); err == nil && !info.IsDir() {
+		if info, err := statArchive(zipPath); err == nil && !info.IsDir() {
 			if fetchErr == nil && remoteSHA != "" {
 				if cachedSHA, err := readSHA(metaPath); err == nil && cachedSHA == remoteSHA {
-					_ = s.touch(zipPath)
-					return zipPath, nil
+					if s.archiveIntact(zipPath, ownerRepo, branch, remoteSHA, info.Size()) {
+						clearGone(zipPath)
+						s.touchServed(ctx, zipPath)
+						s.noteRevalidated(ctx)
+						return zipPath, nil
+					}
+					fmt.Printf("cached archive %s is corrupt, re-downloading\n", zipPath)
+					removeArchive(zipPath)
 				}
 			}
-			// If fetchErr != nil, we cannot verify, so we fall through to force refresh
 		}
 	}
 
 	// Download fresh zip (to temp then replace).
-	tmpFile, err := os.CreateTemp(parent, ".tmp-download-*.zip")
+	s.noteMiss(ctx)
+	tmpDir, err := s.tempDirFor(parent)
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, ".tmp-download-*.zip")
 	if err != nil {
 		return "", err
 	}
 	tmpPath := tmpFile.Name()
 	_ = tmpFile.Close()
 
-	if err := s.downloadZip(ctx, ownerRepo, branch, token, tmpPath); err != nil {
+	remoteSHA, err = s.downloadAtSHA(ctx, ownerRepo, branch, remoteSHA, token, tmpPath)
+	if err != nil {
 		_ = os.Remove(tmpPath)
+		if unverified {
+			if p, ok := s.fallBackToStale(ctx, zipPath, ownerRepo, branch, err); ok {
+				return p, nil
+			}
+		}
 		return "", err
 	}
-	_ = os.Remove(zipPath)
-	if err := os.Rename(tmpPath, zipPath); err != nil {
+	// Last point to back out: past here the archive is published.
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	if ns := noStoreOf(ctx); ns != nil {
+		return ns.keepTransient(tmpPath, zipPath, remoteSHA), nil
+	}
+	oldSHA, _ := readSHA(metaPath)
+	history := s.retainCurrent(zipPath, remoteSHA)
+	if err := s.installArchive(tmpPath, zipPath); err != nil {
 		_ = os.Remove(tmpPath)
 		return "", err
 	}
@@ -366,11 +832,7 @@ func (s *Storage) ensureRepoLegacy(ctx context.Context, user, ownerRepo, branch,
 	commitPath := strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"
 	if remoteSHA != "" {
 		_ = writeSHA(metaPath, remoteSHA)
-		short := remoteSHA
-		if len(short) > 7 {
-			short = short[:7]
-		}
-		_ = writeSHA(commitPath, short)
+		_ = writeSHA(commitPath, abbrevSHA(remoteSHA, s.ShortSHALen))
 
 		// Write info.json (legacy mode: no bare repo, so commit_message/changed_files empty)
 		infoPath := strings.TrimSuffix(zipPath, ".zip") + ".info.json"
@@ -386,50 +848,82 @@ func (s *Storage) ensureRepoLegacy(ctx context.Context, user, ownerRepo, branch,
 		_ = os.Remove(metaPath)
 		// 若无法获取远端 SHA，则保持已有 commit 文件（如果存在），不强删
 	}
-	_ = s.touch(zipPath)
+	if meta, err := s.recordArchive(zipPath, ownerRepo, branch, remoteSHA); err != nil {
+		fmt.Printf("warning: record archive metadata for %s: %v\n", zipPath, err)
+	} else {
+		recordHistory(zipPath, meta, history)
+	}
+	s.emitRefreshed(zipPath, ownerRepo, branch, oldSHA, remoteSHA)
+	s.touchServed(ctx, zipPath)
 	return zipPath, nil
 }
 
-// List lists entries under the given relative path.
+// List lists entries under the given relative path, in name order. Use
+// ListPage or ListFunc for very large directories.
 func (s *Storage) List(rel string) ([]Entry, error) {
+	result := make([]Entry, 0)
+	err := s.ListFunc(rel, func(e Entry) error {
+		result = append(result, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stat describes a single relative path like List does for its entries.
+func (s *Storage) Stat(rel string) (*Entry, error) {
 	abs, err := s.safeJoin(rel)
 	if err != nil {
 		return nil, err
 	}
-	entries, err := os.ReadDir(abs)
+	if s.inTrash(abs) {
+		return nil, ErrNotFound
+	}
+	info, err := os.Stat(abs)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	result := make([]Entry, 0, len(entries))
-	for _, e := range entries {
-		if strings.HasSuffix(e.Name(), ".meta") || strings.HasSuffix(e.Name(), ".info.json") {
-			continue
-		}
-		info, _ := e.Info()
-		size := int64(0)
-		if info != nil {
-			size = info.Size()
+	e := newEntry(abs, rel, info.IsDir(), info)
+	return &e, nil
+}
+
+func newEntry(abs, rel string, isDir bool, info fs.FileInfo) Entry {
+	e := Entry{Name: filepath.Base(abs), Path: filepath.ToSlash(rel), IsDir: isDir}
+	if info != nil {
+		e.Size = info.Size()
+		e.LastAccess = info.ModTime().UTC()
+	}
+	if zipPath, ok := archivePath(abs); ok && !isDir {
+		if meta, err := readArchiveMeta(zipPath); err == nil {
+			e.FetchedAt = &meta.FetchedAt
+			e.Protected = meta.Protected
 		}
-		p := filepath.ToSlash(filepath.Join(rel, e.Name()))
-		result = append(result, Entry{
-			Name:  e.Name(),
-			Path:  p,
-			IsDir: e.IsDir(),
-			Size:  size,
-		})
 	}
-	return result, nil
+	return e
 }
 
 // Delete removes the relative path. If recursive is false and path is a directory, it must be empty.
+// With TrashDeletes files and recursive deletes go to the trash instead
+// (see Restore); the trash itself cannot be deleted through here.
 func (s *Storage) Delete(rel string, recursive bool) error {
 	abs, err := s.safeJoin(rel)
 	if err != nil {
 		return err
 	}
+	if s.inTrash(abs) {
+		return ErrNotFound
+	}
+	if s.TrashDeletes && abs != filepath.Clean(s.Root) {
+		if info, serr := os.Stat(abs); serr == nil && (recursive || !info.IsDir()) {
+			_, err := s.moveToTrash(abs, rel)
+			return err
+		}
+	}
 	if recursive {
 		return os.RemoveAll(abs)
 	}
@@ -453,7 +947,7 @@ func (s *Storage) safeJoin(rel string) (string, error) {
 
 // acquire returns an unlock func for a per-repo/branch key.
 func (s *Storage) acquire(user, repo, branch string) func() {
-	key := fmt.Sprintf("%s|%s|%s", user, repo, branch)
+	key := fmt.Sprintf("%s|%s|%s", s.lockUser(user), repo, branch)
 	s.mu.Lock()
 	if s.lock == nil {
 		s.lock = make(map[string]*sync.Mutex)
@@ -464,51 +958,103 @@ func (s *Storage) acquire(user, repo, branch string) func() {
 		s.lock[key] = m
 	}
 	s.mu.Unlock()
+	if s.lockWait != nil {
+		s.lockWait(key)
+	}
 	m.Lock()
 	return m.Unlock
 }
 
 // downloadZip downloads archive into the given path.
 func (s *Storage) downloadZip(ctx context.Context, ownerRepo, branch, token, dest string) error {
-	downloadURL := fmt.Sprintf("https://codeload.github.com/%s/zip/%s", ownerRepo, url.PathEscape(branch))
-	reqBuilder := func(ctx context.Context) (*http.Request, error) {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
-		if err != nil {
-			return nil, err
+	open := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		body, size, err := s.fetcher().FetchArchive(ctx, ownerRepo, branch, token)
+		if err != nil || s.DebugSlowReader <= 0 {
+			return body, size, err
 		}
-		if strings.TrimSpace(token) != "" {
-			req.Header.Set("Authorization", "Bearer "+token)
+		fmt.Printf("DEBUG: simulating slow network, target download time %s for repo=%s (size=%d bytes)\n",
+			s.DebugSlowReader, ownerRepo, size)
+		return struct {
+			io.Reader
+			io.Closer
+		}{newSlowReader(body, ctx, s.DebugSlowReader, size), body}, size, nil
+	}
+	return s.downloadWithRetry(ctx, dest, DownloadRepo, ownerRepo+"@"+branch, open)
+}
+
+// downloadAtSHA downloads ownerRepo at sha rather than at branch, so the
+// archive holds exactly the commit its metadata will record even when the
+// branch moves meanwhile. If the commit is gone (force-pushed away), branch
+// is resolved again and the new commit downloaded once. If the branch
+// still points at a commit codeload 404s, codeload is lagging behind and
+// downloadLagging takes over. It returns the commit downloaded; an unknown
+// sha ("") downloads branch as it is.
+func (s *Storage) downloadAtSHA(ctx context.Context, ownerRepo, branch, sha, token, dest string) (string, error) {
+	if sha == "" {
+		return "", s.downloadZip(ctx, ownerRepo, branch, token, dest)
+	}
+	err := s.downloadZip(ctx, ownerRepo, sha, token, dest)
+	if errors.Is(err, ErrBranchNotFound) {
+		fresh, ferr := s.fetchBranchSHA(ctx, ownerRepo, branch, token)
+		if ferr == nil && fresh != sha {
+			fmt.Printf("%s@%s moved from %s to %s during download, retrying\n", ownerRepo, branch, shortCommit(sha), shortCommit(fresh))
+			sha = fresh
+			err = s.downloadZip(ctx, ownerRepo, sha, token, dest)
 		}
-		req.Header.Set("Accept", "application/zip")
-		return req, nil
-	}
-	readerFn := func(resp *http.Response) io.Reader {
-		if s.DebugSlowReader > 0 {
-			fmt.Printf("DEBUG: simulating slow network, target download time %s for repo=%s (size=%d bytes)\n",
-				s.DebugSlowReader, ownerRepo, resp.ContentLength)
-			return newSlowReader(resp.Body, ctx, s.DebugSlowReader, resp.ContentLength)
+		if ferr == nil && errors.Is(err, ErrBranchNotFound) && branch != sha {
+			sha, err = s.downloadLagging(ctx, ownerRepo, branch, sha, token, dest)
 		}
-		return resp.Body
 	}
-	label := fmt.Sprintf("repo %s@%s", ownerRepo, branch)
-	return s.downloadWithRetry(ctx, dest, label, reqBuilder, readerFn)
+	var nf *NotFoundError
+	if errors.As(err, &nf) {
+		nf.Branch = branch
+	}
+	return sha, err
 }
 
-func (s *Storage) downloadFile(ctx context.Context, fileURL, dest string) error {
-	reqBuilder := func(ctx context.Context) (*http.Request, error) {
+// downloadFile downloads a package for user to dest under the Redirects
+// and package policies and returns the URL it was finally served from.
+func (s *Storage) downloadFile(ctx context.Context, user, fileURL, dest string) (string, error) {
+	var final string
+	ctx = withRedirectCheck(ctx, s.redirectChecker(user, &final))
+	open := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		final = fileURL
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return req, nil
+		return s.openHTTP(req)
 	}
-	label := fmt.Sprintf("package %s", filepath.Base(fileURL))
-	return s.downloadWithRetry(ctx, dest, label, reqBuilder, func(resp *http.Response) io.Reader {
-		return resp.Body
-	})
+	if err := s.downloadWithRetry(ctx, dest, DownloadPackage, filepath.Base(fileURL), open); err != nil {
+		return "", err
+	}
+	return final, nil
+}
+
+// openFunc opens one download attempt: the body and its size (-1 when
+// unknown).
+type openFunc func(ctx context.Context) (io.ReadCloser, int64, error)
+
+// downloadWithRetry downloads to dest, recording the download (see
+// RecentDownloads) under kind and label.
+func (s *Storage) downloadWithRetry(ctx context.Context, dest, kind, label string, open openFunc) error {
+	s.stats.downloads.Add(1)
+	rec := DownloadRecord{Kind: kind, Label: label, Started: s.Now()}
+	err := s.downloadAttempts(ctx, dest, kind+" "+label, open, &rec)
+	if err != nil {
+		s.stats.downloadFailures.Add(1)
+		rec.Error = err.Error()
+		rec.Duration = s.Now().Sub(rec.Started)
+	} else {
+		reportDownloaded(ctx, rec.Bytes)
+	}
+	s.recordDownload(rec)
+	return err
 }
 
-func (s *Storage) downloadWithRetry(ctx context.Context, dest string, label string, reqBuilder func(context.Context) (*http.Request, error), readerFn func(*http.Response) io.Reader) error {
+// downloadAttempts fills in rec's attempts and, on success, the bytes and
+// duration of the attempt that succeeded.
+func (s *Storage) downloadAttempts(ctx context.Context, dest string, label string, open openFunc, rec *DownloadRecord) error {
 	attempts := s.retryAttempts()
 	var lastErr error
 	for attempt := 0; attempt < attempts; attempt++ {
@@ -517,41 +1063,32 @@ func (s *Storage) downloadWithRetry(ctx context.Context, dest string, label stri
 				return err
 			}
 		}
-		req, err := reqBuilder(ctx)
-		if err != nil {
-			return err
-		}
-		resp, err := s.httpClient().Do(req)
+		rec.Attempts = attempt + 1
+		attemptStart := s.Now()
+		body, size, err := open(ctx)
 		if err != nil {
 			lastErr = err
-			if attempt == attempts-1 || !isRetryableError(err) {
+			if attempt == attempts-1 || !isRetryableFetch(err) {
 				return err
 			}
 			continue
 		}
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-			_ = resp.Body.Close()
-			err := fmt.Errorf("download failed: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
-			lastErr = err
-			if attempt == attempts-1 || !isRetryableStatus(resp.StatusCode) {
-				return err
-			}
-			continue
+		if err := s.checkSpace(filepath.Dir(dest), size); err != nil {
+			_ = body.Close()
+			return err
 		}
 
 		tmpFile, err := os.CreateTemp(filepath.Dir(dest), ".tmp-download-*")
 		if err != nil {
-			_ = resp.Body.Close()
+			_ = body.Close()
 			return err
 		}
 		tmpPath := tmpFile.Name()
 		_ = tmpFile.Close()
 
-		reader := readerFn(resp)
 		out, err := os.Create(tmpPath)
 		if err != nil {
-			_ = resp.Body.Close()
+			_ = body.Close()
 			_ = os.Remove(tmpPath)
 			return err
 		}
@@ -573,14 +1110,22 @@ func (s *Storage) downloadWithRetry(ctx context.Context, dest string, label stri
 					return
 				}
 			}
-		}(resp.ContentLength)
+		}(size)
 
-		cr := &countingReader{r: reader, ctx: ctx, written: &written}
-		_, err = io.Copy(out, cr)
+		cr := &countingReader{r: body, ctx: ctx, written: &written}
+		var w io.Writer = out
+		if size < 0 {
+			w = &spaceGuard{w: out, s: s, dir: filepath.Dir(tmpPath)}
+		}
+		_, err = io.Copy(w, cr)
 		_ = out.Close()
-		_ = resp.Body.Close()
+		_ = body.Close()
 		close(done)
 		wg.Wait()
+		if err == nil {
+			// The body may have ended just as the caller gave up.
+			err = ctx.Err()
+		}
 		if err != nil {
 			_ = os.Remove(tmpPath)
 			lastErr = err
@@ -590,10 +1135,13 @@ func (s *Storage) downloadWithRetry(ctx context.Context, dest string, label stri
 			continue
 		}
 		_ = os.Remove(dest)
-		if err := os.Rename(tmpPath, dest); err != nil {
+		if err := s.replaceFile(tmpPath, dest); err != nil {
 			_ = os.Remove(tmpPath)
 			return err
 		}
+		rec.Bytes = atomic.LoadInt64(&written)
+		rec.Duration = s.Now().Sub(attemptStart)
+		s.stats.downloadedBytes.Add(rec.Bytes)
 		return nil
 	}
 	return lastErr
@@ -638,7 +1186,7 @@ func isRetryableError(err error) bool {
 	if err == nil {
 		return false
 	}
-	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrInsufficientSpace) || errors.Is(err, ErrRedirectPolicy) || errors.Is(err, ErrBlockedHost) {
 		return false
 	}
 	var nerr net.Error
@@ -727,23 +1275,50 @@ func (s *Storage) Touch(rel string) error {
 	return nil
 }
 
-func (s *Storage) touch(abs string) error {
-	now := time.Now()
-	return os.Chtimes(abs, now, now)
+// touchServed records that zipPath was served, except to background
+// revalidation.
+func (s *Storage) touchServed(ctx context.Context, zipPath string) {
+	if !background(ctx) {
+		_ = s.touch(zipPath)
+	}
 }
 
 // CleanupExpired removes cached items unused beyond ttl.
 // - Repos: users/<user>/repos/<owner>/<repo>/<branch>.zip (+.meta, commit)
+// - Shared repos: shared/repos/<owner>/<repo>/<branch>.zip, in either Layout
 // - Packages: users/<user>/packages/** (any file)
+// Archives protected by Pin are kept. The retention policy is applied
+// afterwards; see Cleanup for the report.
 func (s *Storage) CleanupExpired(ttl time.Duration) error {
-	cutoff := time.Now().Add(-ttl)
-	root := filepath.Join(s.Root, "users")
-	if _, err := os.Stat(root); err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	report, err := s.Cleanup(ttl)
+	if n := len(report.Expired) + len(report.Retention) + len(report.Gone) + len(report.Trash) + len(report.Temp); n > 0 {
+		fmt.Printf("cleanup: removed %d expired, %d over retention, %d deleted upstream, %d from trash, %d orphaned temp files\n", len(report.Expired), len(report.Retention), len(report.Gone), len(report.Trash), len(report.Temp))
+	}
+	if report.Protected > 0 {
+		fmt.Printf("cleanup: kept %d protected archives (%d bytes)\n", report.Protected, report.ProtectedBytes)
+	}
+	return err
+}
+
+func (s *Storage) cleanupExpired(ttl time.Duration, report *CleanupReport) error {
+	cutoff := s.Now().Add(-ttl)
+	// Both layouts are walked so archives left by the other one still expire.
+	for _, top := range []string{"users", SharedDir} {
+		root := filepath.Join(s.Root, top)
+		if _, err := os.Stat(root); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := s.cleanupTree(root, cutoff, report); err != nil {
+			return err
 		}
-		return err
 	}
+	return nil
+}
+
+func (s *Storage) cleanupTree(root string, cutoff time.Time, report *CleanupReport) error {
 	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return nil // ignore inaccessible
@@ -753,29 +1328,63 @@ func (s *Storage) CleanupExpired(ttl time.Duration) error {
 		}
 		rel, _ := filepath.Rel(s.Root, path)
 		parts := splitPath(rel)
-		if len(parts) < 3 || parts[0] != "users" {
+		// users/<user>/<kind>/... or shared/<kind>/...
+		var kind string
+		minParts := 6
+		switch {
+		case len(parts) >= 3 && parts[0] == "users":
+			kind = parts[2]
+		case len(parts) >= 2 && parts[0] == SharedDir:
+			kind, minParts = parts[1], 5
+		default:
 			return nil
 		}
 
-		switch parts[2] {
+		switch kind {
 		case "repos":
-			// expect users/<user>/repos/<owner>/<repo>/<branch>.zip
-			if filepath.Ext(path) != ".zip" || len(parts) < 6 {
+			// expect users/<user>/repos/<owner>/<repo>/<branch>.zip[.zst]
+			// or shared/repos/<owner>/<repo>/<branch>.zip[.zst]
+			zipPath, ok := archivePath(path)
+			if !ok || len(parts) < minParts {
+				return nil
+			}
+			rel = strings.TrimSuffix(rel, zstSuffix)
+			if protectedArchive(zipPath) {
+				report.Protected++
+				if fi, err := os.Stat(path); err == nil {
+					report.ProtectedBytes += fi.Size()
+				}
 				return nil
 			}
 			if expired(path, cutoff) {
-				base := strings.TrimSuffix(path, ".zip")
-				_ = os.Remove(path)
-				_ = os.Remove(path + ".meta")
-				_ = os.Remove(base + ".commit.txt")
-				_ = os.Remove(base + ".info.json")
-				trimEmpty(filepath.Dir(path), filepath.Join(s.Root, "users"))
+				meta, _ := readArchiveMetaFile(zipPath)
+				removeArchive(zipPath)
+				s.trimRepoDir(filepath.Dir(path))
+				report.Expired = append(report.Expired, filepath.ToSlash(rel))
+				s.emitEvicted(zipPath, meta, "expired")
+			} else if s.GonePurgeAfter > 0 && goneBefore(zipPath, s.Now().Add(-s.GonePurgeAfter)) {
+				meta, _ := readArchiveMetaFile(zipPath)
+				removeArchive(zipPath)
+				s.trimRepoDir(filepath.Dir(path))
+				report.Gone = append(report.Gone, filepath.ToSlash(rel))
+				s.emitEvicted(zipPath, meta, "gone")
 			}
 		case "packages":
-			// any package file under users/<user>/packages/**
+			// any package file under users/<user>/packages/**; the sidecar
+			// goes with its package
+			if parts[0] != "users" || d.Name() == packageMetaName {
+				return nil
+			}
 			if expired(path, cutoff) {
+				var url string
+				if meta, err := readPackageDir(filepath.Dir(path)); err == nil {
+					url = meta.URL
+				}
 				_ = os.Remove(path)
-				trimEmpty(filepath.Dir(path), filepath.Join(s.Root, "users"))
+				_ = os.Remove(filepath.Join(filepath.Dir(path), packageMetaName))
+				s.trimRepoDir(filepath.Dir(path))
+				report.Expired = append(report.Expired, filepath.ToSlash(rel))
+				s.emitPackageEvicted(path, url)
 			}
 		default:
 			return nil
@@ -817,8 +1426,27 @@ func splitPath(p string) []string {
 	return out
 }
 
-// fetchDefaultBranch retrieves the default branch name from GitHub API.
+// fetchDefaultBranch retrieves the default branch name from the fetcher,
+// consulting the per-repo cache first. Concurrent misses share one call.
 func (s *Storage) fetchDefaultBranch(ctx context.Context, ownerRepo, token string) (string, error) {
+	key := defaultBranchKey(ownerRepo, token)
+	if branch, ok := s.cachedDefaultBranch(key); ok {
+		return branch, nil
+	}
+	return s.lookup(ctx, "default-branch|"+key, func() (string, error) {
+		branch, err := s.fetcher().ResolveDefaultBranch(ctx, ownerRepo, token)
+		if err != nil {
+			return "", err
+		}
+		s.rememberDefaultBranch(key, branch)
+		s.noteDefaultBranch(ownerRepo, branch)
+		return branch, nil
+	})
+}
+
+func (s *Storage) fetchDefaultBranchRemote(ctx context.Context, ownerRepo, token string) (string, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
 	url := fmt.Sprintf("https://api.github.com/repos/%s", ownerRepo)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -828,28 +1456,55 @@ func (s *Storage) fetchDefaultBranch(ctx context.Context, ownerRepo, token strin
 	if strings.TrimSpace(token) != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
-	resp, err := s.httpClient().Do(req)
+	resp, err := s.doGitHub(req)
 	if err != nil {
 		return "", err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-		return "", fmt.Errorf("fetch repo info failed: %d: %s", resp.StatusCode, string(b))
+		se, _ := readStatusError("fetch repo info", resp)
+		var err error = se
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return "", &NotFoundError{Repo: ownerRepo, Token: strings.TrimSpace(token) != ""}
+		case isRateLimited(resp):
+			return "", rateLimitError(resp, err)
+		}
+		return "", err
 	}
 	var data struct {
 		DefaultBranch string `json:"default_branch"`
+		FullName      string `json:"full_name"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+	if err := decodeAPI("fetch repo info", resp.Body, &data); err != nil {
 		return "", err
 	}
+	if data.FullName != "" {
+		s.noteRepoName(ownerRepo, data.FullName)
+	}
 	if strings.TrimSpace(data.DefaultBranch) == "" {
 		return "", fmt.Errorf("empty default branch")
 	}
 	return data.DefaultBranch, nil
 }
 
+// fetchBranchSHA returns the commit branch points at upstream. Concurrent
+// callers asking for the same branch with the same token share one call.
 func (s *Storage) fetchBranchSHA(ctx context.Context, ownerRepo, branch, token string) (string, error) {
+	key := "branch-sha|" + strings.ToLower(ownerRepo) + "|" + branch + "|" + tokenKey(token)
+	return s.lookup(ctx, key, func() (string, error) {
+		sha, err := s.fetcher().ResolveRefSHA(ctx, ownerRepo, branch, token)
+		if errors.Is(err, ErrBranchNotFound) && !errors.Is(err, errBranchMissing) {
+			err = fmt.Errorf("%w: %w", errBranchMissing, err)
+		}
+		return sha, err
+	})
+}
+
+// fetchBranchSHARemote resolves branch with the API BranchLookup picks.
+// Both calls send the ETag of the last answer, so an unchanged branch
+// costs no rate limit.
+func (s *Storage) fetchBranchSHARemote(ctx context.Context, ownerRepo, branch, token string) (string, error) {
 	if branch == "" {
 		return "", fmt.Errorf("branch unspecified")
 	}
@@ -857,8 +1512,21 @@ func (s *Storage) fetchBranchSHA(ctx context.Context, ownerRepo, branch, token s
 	if len(parts) != 2 {
 		return "", fmt.Errorf("invalid owner/repo")
 	}
-	url := fmt.Sprintf("https://api.github.com/repos/%s/branches/%s", ownerRepo, url.PathEscape(branch))
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if s.BranchLookup != BranchLookupBranches {
+		sha, err := s.fetchRefSHA(ctx, ownerRepo, branch, token)
+		if !errors.Is(err, errRefNotFound) {
+			return sha, err
+		}
+	}
+	return s.fetchBranchesSHA(ctx, ownerRepo, branch, token)
+}
+
+// fetchBranchesSHA resolves branch through the branches API.
+func (s *Storage) fetchBranchesSHA(ctx context.Context, ownerRepo, branch, token string) (string, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
+	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/branches/%s", ownerRepo, url.PathEscape(branch))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
 	if err != nil {
 		return "", err
 	}
@@ -866,26 +1534,42 @@ func (s *Storage) fetchBranchSHA(ctx context.Context, ownerRepo, branch, token s
 	if strings.TrimSpace(token) != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
-	resp, err := s.httpClient().Do(req)
+	key := refETagKey(apiURL, token)
+	cached, conditional := s.conditional(req, key)
+	resp, err := s.doGitHub(req)
 	if err != nil {
 		return "", err
 	}
 	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		return cached.sha, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-		return "", fmt.Errorf("branch sha failed: status=%d body=%s", resp.StatusCode, string(b))
+		se, b := readStatusError("branch sha", resp)
+		if resp.StatusCode == http.StatusNotFound {
+			s.forgetETag(key)
+			if repoMissing(b) {
+				return "", &NotFoundError{Repo: ownerRepo, Token: strings.TrimSpace(token) != ""}
+			}
+			return "", fmt.Errorf("%w: %w", errBranchMissing, se)
+		}
+		if isRateLimited(resp) {
+			return "", rateLimitError(resp, se)
+		}
+		return "", se
 	}
 	var data struct {
 		Commit struct {
 			Sha string `json:"sha"`
 		} `json:"commit"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+	if err := decodeAPI("branch sha", resp.Body, &data); err != nil {
 		return "", err
 	}
 	if strings.TrimSpace(data.Commit.Sha) == "" {
 		return "", fmt.Errorf("empty sha")
 	}
+	s.rememberETag(key, resp, data.Commit.Sha)
 	return data.Commit.Sha, nil
 }
 
@@ -906,6 +1590,14 @@ type Entry struct {
 	Path  string `json:"path"`
 	IsDir bool   `json:"is_dir"`
 	Size  int64  `json:"size"`
+	// LastAccess is the mtime, reset whenever the entry is served; cleanup
+	// expires entries by it.
+	LastAccess time.Time `json:"last_access"`
+	// FetchedAt is when a cached repo archive was downloaded (nil for
+	// anything else).
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	// Protected reports an archive protected from cleanup by Pin.
+	Protected bool `json:"protected,omitempty"`
 }
 
 // slowReader wraps an io.Reader to simulate slow network by stretching download to target duration.
@@ -994,6 +1686,9 @@ func (s *Storage) acquireGitCacheWrite(ownerRepo string) func() {
 		s.rwLock[key] = m
 	}
 	s.mu.Unlock()
+	if s.lockWait != nil {
+		s.lockWait(key)
+	}
 	m.Lock()
 	return m.Unlock
 }
@@ -1031,10 +1726,11 @@ func (s *Storage) gitCachePath(ownerRepo string) string {
 // If missing, clones from GitHub. Otherwise, fetches updates.
 // Returns the path to the bare repo.
 func (s *Storage) EnsureBareRepo(ctx context.Context, ownerRepo, token string) (string, error) {
-	ownerRepo = strings.Trim(ownerRepo, "/")
-	if ownerRepo == "" || strings.Count(ownerRepo, "/") != 1 {
-		return "", fmt.Errorf("owner/repo expected: %w", ErrBadPath)
+	ownerRepo, err := s.canonicalChecked(ctx, ownerRepo, token)
+	if err != nil {
+		return "", err
 	}
+	token = s.tokenFor(ownerRepo, token)
 
 	unlock := s.acquireGitCacheWrite(ownerRepo)
 	defer unlock()
@@ -1056,11 +1752,15 @@ func (s *Storage) EnsureBareRepo(ctx context.Context, ownerRepo, token string) (
 
 		// Fetch updates
 		fmt.Printf("fetching updates for %s...\n", ownerRepo)
-		cmd = exec.CommandContext(ctx, "git", "-C", barePath, "fetch", "--prune", "origin")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return "", fmt.Errorf("git fetch failed: %w", err)
+		cmd = exec.CommandContext(ctx, "git", "-C", barePath, "-c", "http.userAgent="+s.userAgent(), "fetch", "--prune", "origin")
+		stderr := &gitStderr{w: redactWriter(os.Stderr, token)}
+		cmd.Stdout = redactWriter(os.Stdout, token)
+		cmd.Stderr = stderr
+		if err := s.runGitRemote(ctx, cmd, stderr); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", gitFailure("git fetch", ownerRepo, token, stderr.buf.Bytes(), err)
 		}
 	} else {
 		// Clone bare repo
@@ -1068,11 +1768,15 @@ func (s *Storage) EnsureBareRepo(ctx context.Context, ownerRepo, token string) (
 		if err := os.MkdirAll(filepath.Dir(barePath), 0o755); err != nil {
 			return "", err
 		}
-		cmd := exec.CommandContext(ctx, "git", "clone", "--bare", remoteURL, barePath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return "", fmt.Errorf("git clone --bare failed: %w", err)
+		cmd := exec.CommandContext(ctx, "git", "-c", "http.userAgent="+s.userAgent(), "clone", "--bare", remoteURL, barePath)
+		stderr := &gitStderr{w: redactWriter(os.Stderr, token)}
+		cmd.Stdout = redactWriter(os.Stdout, token)
+		cmd.Stderr = stderr
+		if err := s.runGitRemote(ctx, cmd, stderr); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", gitFailure("git clone --bare", ownerRepo, token, stderr.buf.Bytes(), err)
 		}
 
 		// Set fetch refspec for bare repo (git clone --bare doesn't set this by default)
@@ -1086,10 +1790,34 @@ func (s *Storage) EnsureBareRepo(ctx context.Context, ownerRepo, token string) (
 	return barePath, nil
 }
 
+// redactWriter masks token in anything git prints, since the clone URL embeds
+// it and git may echo the URL in progress or error output.
+func redactWriter(w io.Writer, token string) io.Writer {
+	if strings.TrimSpace(token) == "" {
+		return w
+	}
+	return &redactingWriter{w: w, secret: []byte(token)}
+}
+
+type redactingWriter struct {
+	w      io.Writer
+	secret []byte
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(bytes.ReplaceAll(p, r.secret, []byte("[REDACTED]"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // ExportSparseZip exports selected paths from a branch to a zip file using git archive.
 // paths: list of directory/file prefixes to include. If empty, exports entire repository.
-// Returns the commit SHA.
+// Returns the full commit SHA.
 func (s *Storage) ExportSparseZip(ctx context.Context, ownerRepo, branch string, paths []string, destZip string) (string, error) {
+	if err := ValidateRef(branch); err != nil {
+		return "", err
+	}
 	for _, p := range paths {
 		if strings.Contains(p, "..") || filepath.IsAbs(p) {
 			return "", fmt.Errorf("invalid path %q: %w", p, ErrBadPath)
@@ -1139,18 +1867,16 @@ func (s *Storage) ExportSparseZip(ctx context.Context, ownerRepo, branch string,
 		return "", fmt.Errorf("git archive failed: %w", err)
 	}
 
-	// Return short commit SHA
-	shortSHA := commitSHA
-	if len(shortSHA) > 7 {
-		shortSHA = shortSHA[:7]
-	}
-	return shortSHA, nil
+	return commitSHA, nil
 }
 
 // ExportSparseDir exports selected paths from a branch to a directory using git archive.
 // paths: list of directory/file prefixes to include. If empty, exports entire repository.
-// Returns the commit SHA.
+// Returns the full commit SHA.
 func (s *Storage) ExportSparseDir(ctx context.Context, ownerRepo, branch string, paths []string, destDir string) (string, error) {
+	if err := ValidateRef(branch); err != nil {
+		return "", err
+	}
 	for _, p := range paths {
 		if strings.Contains(p, "..") || filepath.IsAbs(p) {
 			return "", fmt.Errorf("invalid path %q: %w", p, ErrBadPath)
@@ -1211,11 +1937,7 @@ func (s *Storage) ExportSparseDir(ctx context.Context, ownerRepo, branch string,
 		return "", fmt.Errorf("git archive failed: %w", err)
 	}
 
-	shortSHA := commitSHA
-	if len(shortSHA) > 7 {
-		shortSHA = shortSHA[:7]
-	}
-	return shortSHA, nil
+	return commitSHA, nil
 }
 
 // gitRevParse runs git rev-parse to resolve a ref to a commit SHA.
@@ -1358,4 +2080,4 @@ func extractTar(r io.Reader, destDir string) error {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
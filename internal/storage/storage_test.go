@@ -1,17 +1,41 @@
 package storage
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github-hub/internal/testutil"
+	"github-hub/internal/version"
 )
 
 func TestListAndDelete(t *testing.T) {
@@ -107,6 +131,7 @@ func TestDownloadZip_EscapesSlashBranch(t *testing.T) {
 func TestFetchBranchSHA_EscapesSlashBranch(t *testing.T) {
 	root := t.TempDir()
 	s := New(root)
+	s.BranchLookup = BranchLookupBranches
 	ctx := context.Background()
 
 	branch := "feature/sub"
@@ -131,6 +156,90 @@ func TestFetchBranchSHA_EscapesSlashBranch(t *testing.T) {
 	}
 }
 
+func TestFetchBranchSHA_Lookups(t *testing.T) {
+	for _, lookup := range []BranchLookup{BranchLookupRef, BranchLookupBranches} {
+		t.Run(string(lookup), func(t *testing.T) {
+			gh := testutil.NewFakeGitHub(t)
+			first := gh.Push("own/repo", "main", map[string]string{"a": "1"})
+			nested := gh.Push("own/repo", "feature/x", map[string]string{"a": "2"})
+			s := New(t.TempDir())
+			s.HTTPClient = gh.Client()
+			s.BranchLookup = lookup
+			ctx := context.Background()
+			path := "/api/repos/own/repo/git/ref/heads/"
+			if lookup == BranchLookupBranches {
+				path = "/api/repos/own/repo/branches/"
+			}
+
+			for i, want := range []string{first, first} {
+				if sha, err := s.fetchBranchSHA(ctx, "own/repo", "main", ""); err != nil || sha != want {
+					t.Fatalf("lookup %d: %q, %v", i, sha, err)
+				}
+			}
+			if n := gh.Requests(path); n != 2 || gh.NotModified() != 1 {
+				t.Fatalf("%d requests to %s and %d 304s, want 2 and 1", n, path, gh.NotModified())
+			}
+			if n := gh.Requests("/api/"); n != 2 {
+				t.Fatalf("%d API requests, want 2", n)
+			}
+			second := gh.Push("own/repo", "main", map[string]string{"a": "3"})
+			if sha, err := s.fetchBranchSHA(ctx, "own/repo", "main", ""); err != nil || sha != second {
+				t.Fatalf("after push: %q, %v", sha, err)
+			}
+			if sha, err := s.fetchBranchSHA(ctx, "own/repo", "feature/x", ""); err != nil || sha != nested {
+				t.Fatalf("nested branch: %q, %v", sha, err)
+			}
+			if _, err := s.fetchBranchSHA(ctx, "own/repo", "nope", ""); !errors.Is(err, errBranchMissing) || errors.Is(err, ErrRepoNotFound) {
+				t.Fatalf("missing branch: %v", err)
+			}
+			if _, err := s.fetchBranchSHA(ctx, "own/gone", "main", ""); !errors.Is(err, ErrRepoNotFound) {
+				t.Fatalf("missing repo: %v", err)
+			}
+		})
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		gh := testutil.NewFakeGitHub(t)
+		want := gh.Push("own/repo", "main", nil)
+		gh.Fail("/api/repos/own/repo/git/", http.StatusNotFound)
+		s := New(t.TempDir())
+		s.HTTPClient = gh.Client()
+		if sha, err := s.fetchBranchSHA(context.Background(), "own/repo", "main", ""); err != nil || sha != want {
+			t.Fatalf("%q, %v", sha, err)
+		}
+		if gh.Requests("/api/repos/own/repo/git/") != 1 || gh.Requests("/api/repos/own/repo/branches/main") != 1 {
+			t.Fatalf("requests %d git, %d branches", gh.Requests("/api/repos/own/repo/git/"), gh.Requests("/api/repos/own/repo/branches/main"))
+		}
+	})
+
+	// A branch name that prefixes others may be answered with every match.
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"multiple choices", http.StatusMultipleChoices, `[{"ref":"refs/heads/main-old","object":{"sha":"old"}},{"ref":"refs/heads/main","object":{"sha":"abc"}}]`, "abc"},
+		{"list", http.StatusOK, `[{"ref":"refs/heads/main","object":{"sha":"abc"}}]`, "abc"},
+		{"no exact match", http.StatusMultipleChoices, `[{"ref":"refs/heads/main-old","object":{"sha":"old"}}]`, "fromBranches"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				status, body := tc.status, tc.body
+				if strings.Contains(req.URL.Path, "/branches/") {
+					status, body = http.StatusOK, `{"commit":{"sha":"fromBranches"}}`
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+			})}
+			if sha, err := s.fetchBranchSHA(context.Background(), "own/repo", "main", ""); err != nil || sha != tc.want {
+				t.Fatalf("%q, %v, want %q", sha, err, tc.want)
+			}
+		})
+	}
+}
+
 func TestDownloadZip_RetryOnServerError(t *testing.T) {
 	root := t.TempDir()
 	s := New(root)
@@ -196,7 +305,7 @@ func TestDownloadFile_RetryOnServerError(t *testing.T) {
 		}, nil
 	})}
 
-	if err := s.downloadFile(ctx, "https://example.com/package", dest); err != nil {
+	if _, err := s.downloadFile(ctx, "u", "https://example.com/package", dest); err != nil {
 		t.Fatalf("downloadFile: %v", err)
 	}
 	if attempts != 2 {
@@ -291,6 +400,150 @@ func TestEnsureBareRepo_InvalidRepo(t *testing.T) {
 	}
 }
 
+func TestNormalizeRepo(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string // empty: ErrBadPath
+	}{
+		{"own/repo", "own/repo"},
+		{"Own/Repo/", "Own/Repo"},
+		{"own/repo.git", "own/repo"},
+		{"https://github.com/own/repo", "own/repo"},
+		{"HTTPS://GitHub.com/own/repo.git/", "own/repo"},
+		{"http://github.com/own/repo.git/", "own/repo"},
+		{"github.com/own/repo", "own/repo"},
+		{" /own/repo ", "own/repo"},
+		{"own/my.repo_v-2", "own/my.repo_v-2"},
+		{"", ""},
+		{"own", ""},
+		{"own/", ""},
+		{"own/repo/extra", ""},
+		{"https://github.com/own", ""},
+		{"https://gitlab.com/own/repo", ""},
+		{"../x", ""},
+		{"own/..", ""},
+		{"own/re po", ""},
+		{"own/repo?x=1", ""},
+	}
+	for _, tc := range cases {
+		got, err := NormalizeRepo(tc.in)
+		if tc.want == "" {
+			if !errors.Is(err, ErrBadPath) {
+				t.Errorf("NormalizeRepo(%q) = %q, %v; want ErrBadPath", tc.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("NormalizeRepo(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestValidateRef(t *testing.T) {
+	cases := []struct {
+		ref string
+		ok  bool
+	}{
+		{"", true},
+		{"main", true},
+		{"feature/x", true},
+		{"release/v1.2.3", true},
+		{"v1.0", true},
+		{"0123456789abcdef0123456789abcdef01234567", true},
+		{"user@host", true},
+		{"dépôt", true},
+		{LatestRelease, true},
+		{strings.Repeat("a", MaxRefLength), true},
+		{strings.Repeat("a", MaxRefLength+1), false},
+		{"..", false},
+		{"a..b", false},
+		{"../../etc/passwd", false},
+		{"..%2F..", false},
+		{"a~1", false},
+		{"a^", false},
+		{"a:b", false},
+		{"a\\b", false},
+		{"a b", false},
+		{"a?", false},
+		{"a*", false},
+		{"a[b", false},
+		{"-rf", false},
+		{"a\x00b", false},
+		{"a\nb", false},
+		{"a\x7f", false},
+		{"@", false},
+		{"a@{1}", false},
+		{"a.", false},
+		{"/main", false},
+		{"main/", false},
+		{"a//b", false},
+		{".hidden", false},
+		{"a/.b", false},
+		{"a.lock", false},
+		{"a.lock/b", false},
+		{"\xff", false},
+	}
+	for _, tc := range cases {
+		err := ValidateRef(tc.ref)
+		if tc.ok && err != nil {
+			t.Errorf("ValidateRef(%.40q) = %v, want nil", tc.ref, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrBadPath) {
+			t.Errorf("ValidateRef(%.40q) = %v, want ErrBadPath", tc.ref, err)
+		}
+	}
+
+	// EnsureRepo rejects bad names before anything reaches GitHub or disk.
+	s := New(t.TempDir())
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request %s", req.URL)
+		return nil, errors.New("offline")
+	})}
+	if _, err := s.EnsureRepo(context.Background(), "u", "own/repo", "../../x", "", false, true); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("EnsureRepo = %v, want ErrBadPath", err)
+	}
+}
+
+func TestEnsureRepo_CanonicalRepoName(t *testing.T) {
+	var repoCalls int
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := "zip"
+		switch {
+		case req.URL.Host == "codeload.github.com":
+		case strings.EqualFold(req.URL.Path, "/repos/own/repo"):
+			repoCalls++
+			body = `{"full_name":"Own/Repo","default_branch":"main"}`
+		case strings.Contains(req.URL.Path, "/branches/"):
+			body = `{"commit":{"sha":"abc123"}}`
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	want := filepath.Join(root, "users", "u", "repos", "Own", "Repo", "main.legacy.zip")
+	for _, spelling := range []string{"OWN/REPO", "own/repo.git", "https://github.com/own/repo", "Own/Repo"} {
+		got, err := s.EnsureRepo(ctx, "u", spelling, "main", "", false, true)
+		if err != nil {
+			t.Fatalf("%s: %v", spelling, err)
+		}
+		if got != want {
+			t.Fatalf("%s: cached at %s, want %s", spelling, got, want)
+		}
+	}
+	if repoCalls != 1 {
+		t.Fatalf("expected the name to be looked up once, got %d", repoCalls)
+	}
+	if _, err := s.EnsureRepo(ctx, "u", "own/re po", "main", "", false, true); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("expected ErrBadPath, got %v", err)
+	}
+}
+
 func TestGitCachePath(t *testing.T) {
 	root := t.TempDir()
 	s := New(root)
@@ -376,9 +629,92 @@ func TestList_FiltersInfoJSON(t *testing.T) {
 	}
 }
 
+func TestListPage(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	names := []string{"d", "b.zip", "a", "c.txt", "e"}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(root, n), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// sidecars are skipped without counting against the limit
+	if err := os.WriteFile(filepath.Join(root, "b.meta.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b.zip", "c.txt", "d", "e"}
+
+	for _, limit := range []int{0, 1, 2, 5, 10} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			var got []string
+			opts := ListOptions{Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(want) {
+					t.Fatalf("too many pages: %v", got)
+				}
+				entries, next, err := s.ListPage(".", opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if limit > 0 && len(entries) > limit {
+					t.Fatalf("page of %d entries, limit %d", len(entries), limit)
+				}
+				for _, e := range entries {
+					got = append(got, e.Name)
+				}
+				if next == "" {
+					break
+				}
+				opts.Token = next
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("pages = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// entries created or removed between pages do not disturb the rest
+	entries, next, err := s.ListPage(".", ListOptions{Limit: 2})
+	if err != nil || len(entries) != 2 || next == "" {
+		t.Fatalf("first page = %v, %q, %v", entries, next, err)
+	}
+	if err := os.Remove(filepath.Join(root, "b.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "aa"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err = s.ListPage(".", ListOptions{Token: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Name != "c.txt" {
+		t.Fatalf("resumed page = %v", entries)
+	}
+
+	if _, _, err := s.ListPage(".", ListOptions{Token: "!!"}); !errors.Is(err, ErrBadPageToken) {
+		t.Fatalf("bad token err = %v", err)
+	}
+
+	// ListFunc streams in the same order and stops on fs.SkipAll
+	var streamed []string
+	err = s.ListFunc(".", func(e Entry) error {
+		streamed = append(streamed, e.Name)
+		if len(streamed) == 2 {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil || strings.Join(streamed, ",") != "a,aa" {
+		t.Fatalf("ListFunc = %v, %v", streamed, err)
+	}
+}
+
 func TestCleanupExpired_RemovesInfoJSON(t *testing.T) {
 	root := t.TempDir()
 	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
 	repoDir := filepath.Join(root, "users", "default", "repos", "owner", "repo")
 	if err := os.MkdirAll(repoDir, 0o755); err != nil {
 		t.Fatal(err)
@@ -391,12 +727,14 @@ func TestCleanupExpired_RemovesInfoJSON(t *testing.T) {
 	if err := os.WriteFile(infoPath, []byte("{}"), 0o644); err != nil {
 		t.Fatal(err)
 	}
-	// Set mtime to the past so it's expired
-	past := time.Now().Add(-48 * time.Hour)
-	if err := os.Chtimes(zipPath, past, past); err != nil {
+	if err := s.CleanupExpired(24 * time.Hour); err != nil {
 		t.Fatal(err)
 	}
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Fatalf("fresh zip removed: %v", err)
+	}
 
+	clock.Advance(48 * time.Hour)
 	if err := s.CleanupExpired(24 * time.Hour); err != nil {
 		t.Fatal(err)
 	}
@@ -407,3 +745,5346 @@ func TestCleanupExpired_RemovesInfoJSON(t *testing.T) {
 		t.Fatal("info.json should be removed")
 	}
 }
+
+func TestTouch_Coalesces(t *testing.T) {
+	const interval = time.Minute
+	cases := []struct {
+		name     string
+		interval time.Duration
+		steps    func(s *Storage, clock *testutil.FakeClock, path string)
+		wantAge  time.Duration // how far the mtime lags the clock
+	}{
+		{"first access written", interval, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+		}, 0},
+		{"repeat within interval pending", interval, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+			c.Advance(10 * time.Second)
+			_ = s.touch(p)
+		}, 10 * time.Second},
+		{"flush before interval waits", interval, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+			c.Advance(10 * time.Second)
+			_ = s.touch(p)
+			c.Advance(20 * time.Second)
+			s.FlushTouches()
+		}, 30 * time.Second},
+		{"flush after interval writes", interval, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+			c.Advance(10 * time.Second)
+			_ = s.touch(p)
+			c.Advance(interval)
+			s.FlushTouches()
+		}, interval},
+		{"sync writes all", interval, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+			c.Advance(10 * time.Second)
+			_ = s.touch(p)
+			s.SyncTouches()
+		}, 0},
+		{"zero interval writes every access", 0, func(s *Storage, c *testutil.FakeClock, p string) {
+			_ = s.touch(p)
+			c.Advance(10 * time.Second)
+			_ = s.touch(p)
+		}, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			clock := testutil.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			s.Clock = clock
+			s.TouchInterval = tc.interval
+			path := filepath.Join(s.Root, "main.zip")
+			if err := os.WriteFile(path, []byte("zip"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			tc.steps(s, clock, path)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := clock.Now().Sub(info.ModTime()); got != tc.wantAge {
+				t.Fatalf("mtime lags clock by %v, want %v", got, tc.wantAge)
+			}
+		})
+	}
+}
+
+func TestCleanupExpired_SeesPendingTouches(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	repoDir := filepath.Join(root, "users", "default", "repos", "owner", "repo")
+	if err := os.MkdirAll(repoDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(repoDir, "main.zip")
+	if err := os.WriteFile(zipPath, []byte("zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.touch(zipPath)
+	clock.Advance(30 * time.Second)
+	_ = s.touch(zipPath) // pending: within TouchInterval of the first
+	clock.Advance(24*time.Hour - 10*time.Second)
+	if err := s.CleanupExpired(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Fatalf("recently used zip removed: %v", err)
+	}
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Publish(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestEvents_RefreshEvictAndCleanup(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	sha, body, downloads := "abc123", "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	rec := &eventRecorder{}
+	s.Events = rec
+	ctx := context.Background()
+
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	sha, body = "def456", "zip-v2"
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EnsurePackage(ctx, "u", "https://example.com/pkg.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(48 * time.Hour)
+	if _, err := s.Cleanup(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Type: EventArchiveRefreshed, User: "u", Repo: "owner/repo", Branch: "main", NewSHA: "abc123", Path: "users/u/repos/owner/repo/main.legacy.zip"},
+		{Type: EventArchiveRefreshed, User: "u", Repo: "owner/repo", Branch: "main", OldSHA: "abc123", NewSHA: "def456", Path: "users/u/repos/owner/repo/main.legacy.zip"},
+		{Type: EventPackageEvicted, User: "u", URL: "https://example.com/pkg.tgz", Reason: "expired"},
+		{Type: EventArchiveEvicted, User: "u", Repo: "owner/repo", Branch: "main", OldSHA: "def456", Path: "users/u/repos/owner/repo/main.legacy.zip", Reason: "expired"},
+		{Type: EventCleanupCompleted},
+	}
+	got := rec.events
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		if e.Time.IsZero() {
+			t.Fatalf("event %d has no time", i)
+		}
+		e.Time = time.Time{}
+		if e.Type == EventPackageEvicted {
+			e.Path = ""
+		}
+		if e.Type == EventCleanupCompleted {
+			if e.Report == nil || len(e.Report.Expired) != 2 {
+				t.Fatalf("cleanup report %+v", e.Report)
+			}
+			e.Report = nil
+		}
+		if e != want[i] {
+			t.Fatalf("event %d:\n got %+v\nwant %+v", i, e, want[i])
+		}
+	}
+}
+
+// fakeGitHub serves the branches API and codeload zipballs for legacy mode.
+func fakeGitHub(sha *string, body *string, downloads *int) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Host {
+		case "api.github.com":
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"commit":{"sha":"` + *sha + `"}}`)),
+				Header:     make(http.Header),
+			}, nil
+		default:
+			*downloads++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(*body)),
+				Header:     make(http.Header),
+			}, nil
+		}
+	})
+}
+
+func TestEnsureRepoLegacy_RecordsChecksum(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	sha, body, downloads := "abc123", "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.ReadArchiveMeta(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, _ := hashFile(zipPath)
+	if meta.SHA256 != want || meta.Size != int64(len(body)) || meta.CommitSHA != sha {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+
+	// Force refresh with new content updates the checksum.
+	body = "zip-v2-longer"
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", true, true); err != nil {
+		t.Fatal(err)
+	}
+	meta2, _ := s.ReadArchiveMeta(zipPath)
+	if meta2.SHA256 == meta.SHA256 || meta2.Size != int64(len(body)) {
+		t.Fatalf("checksum not updated: %+v", meta2)
+	}
+
+	// Truncating the archive is detected on the next hit and triggers a re-download.
+	if err := os.WriteFile(zipPath, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := downloads
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != before+1 {
+		t.Fatalf("expected corrupt archive to be re-downloaded")
+	}
+}
+
+func TestEnsureRepoLegacy_StalePolicyMatrix(t *testing.T) {
+	const cachedSHA = "abc123"
+	tests := []struct {
+		name       string
+		cached     bool
+		shaStatus  int // branches API answer
+		downloadOK bool
+		policy     StalePolicy // per call; empty uses the storage default
+		storage    StalePolicy
+		want       CacheOutcome // "" when an error is expected
+		wantErr    error
+		downloads  int
+	}{
+		{name: "verified hit", cached: true, shaStatus: 200, downloadOK: true, policy: StaleFail, want: CacheRevalidated},
+		{name: "verified miss", shaStatus: 200, downloadOK: true, policy: StaleFail, want: CacheMiss, downloads: 1},
+		{name: "fresh cached download ok", cached: true, shaStatus: 500, downloadOK: true, policy: PreferFresh, want: CacheMiss, downloads: 1},
+		{name: "fresh cached download fails", cached: true, shaStatus: 500, policy: PreferFresh, want: CacheStale, downloads: 1},
+		{name: "fresh uncached download ok", shaStatus: 500, downloadOK: true, policy: PreferFresh, want: CacheMiss, downloads: 1},
+		{name: "fresh uncached download fails", shaStatus: 500, policy: PreferFresh, wantErr: errDownload, downloads: 1},
+		{name: "default is prefer-fresh", cached: true, shaStatus: 500, want: CacheStale, downloads: 1},
+		{name: "cache cached", cached: true, shaStatus: 500, downloadOK: true, policy: PreferCache, want: CacheStale},
+		{name: "cache from storage default", cached: true, shaStatus: 500, downloadOK: true, storage: PreferCache, want: CacheStale},
+		{name: "cache uncached download ok", shaStatus: 500, downloadOK: true, policy: PreferCache, want: CacheMiss, downloads: 1},
+		{name: "cache uncached download fails", shaStatus: 500, policy: PreferCache, wantErr: errDownload, downloads: 1},
+		{name: "fail cached", cached: true, shaStatus: 500, downloadOK: true, policy: StaleFail, wantErr: ErrUnverified},
+		{name: "fail uncached", shaStatus: 500, downloadOK: true, policy: StaleFail, wantErr: ErrUnverified},
+		{name: "call overrides storage", cached: true, shaStatus: 500, downloadOK: true, storage: PreferCache, policy: StaleFail, wantErr: ErrUnverified},
+		{name: "branch deleted cached", cached: true, shaStatus: 404, downloadOK: true, policy: PreferCache, wantErr: ErrBranchGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = 0
+			s.StalePolicy = tt.storage
+			ctx := context.Background()
+			if tt.cached {
+				sha, body, n := cachedSHA, "zip-v1", 0
+				s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &n)}
+				if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			downloads := 0
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				status, body := tt.shaStatus, `{"commit":{"sha":"`+cachedSHA+`"}}`
+				if req.URL.Host != "api.github.com" {
+					downloads++
+					status, body = http.StatusOK, "zip-v2"
+					if !tt.downloadOK {
+						status = http.StatusInternalServerError
+					}
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+			})}
+			if tt.policy != "" {
+				ctx = WithStalePolicy(ctx, tt.policy)
+			}
+			var outcome CacheOutcome
+			zipPath, err := s.EnsureRepo(WithOutcome(ctx, &outcome), "u", "owner/repo", "main", "", false, true)
+			if downloads != tt.downloads {
+				t.Fatalf("downloads=%d, want %d", downloads, tt.downloads)
+			}
+			switch {
+			case tt.wantErr == errDownload:
+				if err == nil || errors.Is(err, ErrUnverified) {
+					t.Fatalf("expected the download error, got %v", err)
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				var stale *StaleError
+				if errors.As(err, &stale) && (stale.ZipPath != "") != tt.cached {
+					t.Fatalf("StaleError.ZipPath=%q with cached=%t", stale.ZipPath, tt.cached)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome != tt.want {
+				t.Fatalf("outcome=%q, want %q", outcome, tt.want)
+			}
+			if b, _ := os.ReadFile(zipPath); tt.want == CacheStale && string(b) != "zip-v1" {
+				t.Fatalf("stale serve returned %q", b)
+			}
+		})
+	}
+}
+
+// errDownload marks matrix rows that expect the download's own error.
+var errDownload = errors.New("download error")
+
+func TestEnsureRepoLegacy_StrictVerification(t *testing.T) {
+	const cachedSHA = "abc123"
+	tests := []struct {
+		name         string
+		storage      bool // Storage.StrictVerification; otherwise WithStrict
+		shaStatus    int
+		pinned       bool
+		maxAge       time.Duration
+		onlyIfCached bool
+		force        bool
+		want         CacheOutcome // "" when ErrUnverifiable is expected
+		wantUpstream bool         // the error wraps the failed lookup
+		downloads    int
+	}{
+		{name: "verified hit", storage: true, shaStatus: 200, want: CacheRevalidated},
+		{name: "lookup fails", storage: true, shaStatus: 500, wantUpstream: true},
+		{name: "per call", shaStatus: 500, wantUpstream: true},
+		{name: "max age ignored", shaStatus: 500, maxAge: time.Hour, wantUpstream: true},
+		{name: "pinned", shaStatus: 200, pinned: true},
+		{name: "only if cached", shaStatus: 200, onlyIfCached: true},
+		{name: "force downloads", storage: true, shaStatus: 500, pinned: true, force: true, want: CacheMiss, downloads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = 0
+			// The strict check comes before any stale policy.
+			s.StalePolicy = PreferCache
+			ctx := context.Background()
+			sha, body, n := cachedSHA, "zip-v1", 0
+			s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &n)}
+			zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.pinned {
+				meta, _ := readArchiveMeta(zipPath)
+				meta.Pinned = true
+				if err := writeArchiveMeta(zipPath, meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.StrictVerification = tt.storage
+			if !tt.storage {
+				ctx = WithStrict(ctx)
+			}
+			if tt.maxAge > 0 {
+				ctx = WithMaxAge(ctx, tt.maxAge)
+			}
+			if tt.onlyIfCached {
+				ctx = WithOnlyIfCached(ctx)
+			}
+			downloads := 0
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				status, body := tt.shaStatus, `{"commit":{"sha":"`+cachedSHA+`"}}`
+				if req.URL.Host != "api.github.com" {
+					downloads++
+					status, body = http.StatusOK, "zip-v2"
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+			})}
+			var outcome CacheOutcome
+			_, err = s.EnsureRepo(WithOutcome(ctx, &outcome), "u", "owner/repo", "main", "", tt.force, true)
+			if downloads != tt.downloads {
+				t.Fatalf("downloads=%d, want %d", downloads, tt.downloads)
+			}
+			if tt.want != "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if outcome != tt.want {
+					t.Fatalf("outcome=%q, want %q", outcome, tt.want)
+				}
+				return
+			}
+			var ue *UnverifiableError
+			if !errors.Is(err, ErrUnverifiable) || !errors.As(err, &ue) {
+				t.Fatalf("expected ErrUnverifiable, got %v", err)
+			}
+			if (ue.Err != nil) != tt.wantUpstream || ue.Repo != "owner/repo" || ue.Branch != "main" {
+				t.Fatalf("unexpected error %+v", ue)
+			}
+		})
+	}
+}
+
+func TestFetchedAt_SurvivesTouchAndBackfills(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	sha, body, downloads := "abc123", "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := s.ReadArchiveMeta(zipPath)
+	fetched := meta.FetchedAt
+	if fetched.IsZero() {
+		t.Fatal("fetched_at not recorded")
+	}
+
+	// Serving touches the archive; the fetch time must not move.
+	clock.Advance(time.Minute)
+	rel := "users/u/repos/owner/repo/main.legacy.zip"
+	if err := s.Touch(rel); err != nil {
+		t.Fatal(err)
+	}
+	e, err := s.Stat(rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.FetchedAt == nil || !e.FetchedAt.Equal(fetched) || !e.LastAccess.After(fetched) {
+		t.Fatalf("unexpected entry %+v (fetched %v)", e, fetched)
+	}
+	entries, _ := s.List("users/u/repos/owner/repo")
+	if len(entries) != 2 || entries[0].FetchedAt != nil || entries[1].FetchedAt == nil {
+		t.Fatalf("unexpected list %+v", entries)
+	}
+
+	// A sidecar written before fetched_at existed is backfilled from mtime.
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	meta.FetchedAt = time.Time{}
+	if err := writeArchiveMeta(zipPath, meta); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(zipPath, old, old)
+	if n, err := s.BackfillFetchedAt(); err != nil || n != 1 {
+		t.Fatalf("backfill n=%d err=%v", n, err)
+	}
+	raw, _ := readArchiveMetaFile(zipPath)
+	if !raw.FetchedAt.Equal(old) {
+		t.Fatalf("fetched_at=%v, want %v", raw.FetchedAt, old)
+	}
+	if n, _ := s.BackfillFetchedAt(); n != 0 {
+		t.Fatalf("second backfill touched %d archives", n)
+	}
+}
+
+func TestEnsureRepo_MaxAgeSkipsRevalidation(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	sha, branchCalls, downloads := "abc123", 0, 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := "zip-" + sha
+		switch {
+		case req.URL.Host != "api.github.com":
+			downloads++
+		case strings.Contains(req.URL.Path, "/branches/"):
+			branchCalls++
+			body = `{"commit":{"sha":"` + sha + `"}}`
+		default:
+			body = `{"full_name":"owner/repo","default_branch":"main"}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	ensure := func(maxAge time.Duration) CacheOutcome {
+		t.Helper()
+		var outcome CacheOutcome
+		ctx := WithOutcome(context.Background(), &outcome)
+		if maxAge >= 0 {
+			ctx = WithMaxAge(ctx, maxAge)
+		}
+		if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+			t.Fatal(err)
+		}
+		return outcome
+	}
+
+	if got := ensure(time.Hour); got != CacheMiss || branchCalls != 1 {
+		t.Fatalf("first download: outcome=%s branch calls=%d", got, branchCalls)
+	}
+	sha = "def456" // upstream moves; within the window nobody asks
+	clock.Advance(30 * time.Minute)
+	if got := ensure(time.Hour); got != CacheHit || branchCalls != 1 || downloads != 1 {
+		t.Fatalf("within max age: outcome=%s branch calls=%d downloads=%d", got, branchCalls, downloads)
+	}
+	if n := s.Counters().SkippedRevalidations; n != 1 {
+		t.Fatalf("skipped revalidations = %d, want 1", n)
+	}
+	for _, tc := range []struct {
+		name   string
+		maxAge time.Duration // -1: no max age
+	}{
+		{"absent", -1},
+		{"zero", 0},
+		{"expired", 10 * time.Minute},
+	} {
+		clock.Advance(20 * time.Minute)
+		before := branchCalls
+		ensure(tc.maxAge)
+		if branchCalls != before+1 {
+			t.Fatalf("%s: expected a revalidation, branch calls %d -> %d", tc.name, before, branchCalls)
+		}
+	}
+	if downloads != 2 || s.Counters().SkippedRevalidations != 1 {
+		t.Fatalf("downloads=%d skipped=%d", downloads, s.Counters().SkippedRevalidations)
+	}
+}
+
+func TestEnsureRepo_OnlyIfCached(t *testing.T) {
+	s := New(t.TempDir())
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	upstream := 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		upstream++
+		body := "zip-abc123"
+		switch {
+		case strings.Contains(req.URL.Path, "/branches/"):
+			body = `{"commit":{"sha":"abc123"}}`
+		case req.URL.Host == "api.github.com":
+			body = `{"full_name":"owner/repo","default_branch":"main"}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	ensure := func(ctx context.Context, branch string) (string, CacheOutcome, error) {
+		t.Helper()
+		var outcome CacheOutcome
+		p, err := s.EnsureRepo(WithOutcome(WithOnlyIfCached(ctx), &outcome), "u", "owner/repo", branch, "", false, true)
+		return p, outcome, err
+	}
+
+	if _, _, err := ensure(context.Background(), "main"); !errors.Is(err, ErrNotCached) || upstream != 0 {
+		t.Fatalf("uncached: err=%v upstream=%d", err, upstream)
+	}
+	if _, _, err := ensure(context.Background(), ""); !errors.Is(err, ErrNotCached) || upstream != 0 {
+		t.Fatalf("unknown default branch: err=%v upstream=%d", err, upstream)
+	}
+	zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := upstream
+	clock.Advance(time.Hour)
+	for _, branch := range []string{"main", ""} {
+		p, outcome, err := ensure(context.Background(), branch)
+		if err != nil || p != zipPath || outcome != CacheHit || upstream != before {
+			t.Fatalf("branch %q: path=%q outcome=%s err=%v upstream %d -> %d", branch, p, outcome, err, before, upstream)
+		}
+	}
+	if _, _, err := ensure(WithMaxAge(context.Background(), time.Minute), "main"); !errors.Is(err, ErrNotCached) || upstream != before {
+		t.Fatalf("older than max age: err=%v upstream %d -> %d", err, before, upstream)
+	}
+	if p, _, err := ensure(WithMaxAge(context.Background(), 2*time.Hour), "main"); err != nil || p != zipPath {
+		t.Fatalf("within max age: path=%q err=%v", p, err)
+	}
+}
+
+// TestEnsureRepoViaGit_ChecksUnderLock checks that git mode decides to serve
+// a cached archive only under the branch lock a refresh holds.
+func TestEnsureRepoViaGit_ChecksUnderLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		meta    ArchiveMeta
+		wantErr error
+	}{
+		{name: "pinned", ctx: context.Background(), meta: ArchiveMeta{CommitSHA: "abc123", Pinned: true}},
+		{name: "strict pinned", ctx: WithStrict(context.Background()), meta: ArchiveMeta{CommitSHA: "abc123", Pinned: true}, wantErr: ErrUnverifiable},
+		{name: "within max age", ctx: WithMaxAge(context.Background(), time.Hour), meta: ArchiveMeta{CommitSHA: "abc123"}},
+		{name: "only if cached", ctx: WithOnlyIfCached(context.Background()), meta: ArchiveMeta{CommitSHA: "abc123"}},
+		{name: "strict only if cached", ctx: WithStrict(WithOnlyIfCached(context.Background())), meta: ArchiveMeta{CommitSHA: "abc123"}, wantErr: ErrUnverifiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			zipPath := filepath.Join(s.reposDir("u"), "owner", "repo", "main.zip")
+			if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(zipPath, []byte("zip-abc123"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			meta := tt.meta
+			meta.FetchedAt = time.Now()
+			if err := writeArchiveMeta(zipPath, &meta); err != nil {
+				t.Fatal(err)
+			}
+			waiting := make(chan string, 1)
+			s.lockWait = func(key string) { waiting <- key }
+			unlock := s.acquire("u", "owner/repo", "main")
+			<-waiting
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.EnsureRepo(tt.ctx, "u", "owner/repo", "main", "", false, false)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				unlock()
+				t.Fatalf("answered (err=%v) without taking the branch lock", err)
+			case key := <-waiting:
+				if !strings.HasSuffix(key, "|owner/repo|main") {
+					unlock()
+					t.Fatalf("waited on %q, want the branch lock", key)
+				}
+			}
+			unlock()
+			if err := <-done; !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestEnsureRepoViaGit_FetchOutsideBranchLock checks that a bare repo fetch
+// does not hold the branch lock, so requests the cache answers do not wait
+// for it.
+func TestEnsureRepoViaGit_FetchOutsideBranchLock(t *testing.T) {
+	s := New(t.TempDir())
+	zipPath := filepath.Join(s.reposDir("u"), "owner", "repo", "main.zip")
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipPath, []byte("zip-abc123"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchiveMeta(zipPath, &ArchiveMeta{CommitSHA: "abc123", FetchedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan string, 4)
+	s.lockWait = func(key string) { waiting <- key }
+
+	// A forced refresh blocks in the fetch, where another one holds the
+	// git cache.
+	unlockCache := s.acquireGitCacheWrite("owner/repo")
+	<-waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	forced := make(chan error, 1)
+	go func() {
+		_, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", true, false)
+		forced <- err
+	}()
+	if key := <-waiting; key != "git-cache|owner/repo" {
+		t.Fatalf("forced refresh waited on %q, want the git cache", key)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		_, err := s.EnsureRepo(WithMaxAge(context.Background(), time.Hour), "u", "owner/repo", "main", "", false, false)
+		served <- err
+	}()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("cached request: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached request waited for the fetch")
+	}
+
+	cancel()
+	unlockCache()
+	if err := <-forced; err == nil {
+		t.Fatal("cancelled forced refresh succeeded")
+	}
+}
+
+func TestEnsureRepoResult_NoStore(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	sha := "abc123"
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := "zip-" + sha
+		switch {
+		case strings.Contains(req.URL.Path, "/branches/"):
+			body = `{"commit":{"sha":"` + sha + `"}}`
+		case req.URL.Host == "api.github.com":
+			body = `{"full_name":"owner/repo","default_branch":"main"}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	zipPath := filepath.Join(root, "users", "u", "repos", "owner", "repo", "main.legacy.zip")
+
+	// Uncached: served from a temporary file, nothing cached.
+	res, err := s.EnsureRepoResult(WithNoStore(context.Background()), "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Transient || res.Outcome != CacheMiss || res.CachePath != zipPath || res.Path == zipPath || res.CommitSHA != sha {
+		t.Fatalf("result = %+v", res)
+	}
+	if b, err := os.ReadFile(res.Path); err != nil || string(b) != "zip-abc123" {
+		t.Fatalf("transient archive %q err=%v", b, err)
+	}
+	if archiveExists(zipPath) {
+		t.Fatal("no-store download was cached")
+	}
+	res.Discard()
+	if _, err := os.Stat(res.Path); !os.IsNotExist(err) {
+		t.Fatalf("transient archive left behind: %v", err)
+	}
+
+	// Cached and current: the cache serves it as usual.
+	if _, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.EnsureRepoResult(WithNoStore(context.Background()), "u", "owner/repo", "main", "", false, true)
+	if err != nil || res.Transient || res.Path != zipPath || res.Outcome != CacheRevalidated {
+		t.Fatalf("cached: res=%+v err=%v", res, err)
+	}
+	res.Discard()
+	if !archiveExists(zipPath) {
+		t.Fatal("Discard removed a cached archive")
+	}
+
+	// Upstream moved: the new commit is served but the cache keeps the old.
+	sha = "def456"
+	res, err = s.EnsureRepoResult(WithNoStore(context.Background()), "u", "owner/repo", "main", "", false, true)
+	if err != nil || !res.Transient || res.CommitSHA != "def456" {
+		t.Fatalf("moved: res=%+v err=%v", res, err)
+	}
+	defer res.Discard()
+	if meta, err := readArchiveMeta(zipPath); err != nil || meta.CommitSHA != "abc123" {
+		t.Fatalf("cached archive updated: meta=%+v err=%v", meta, err)
+	}
+}
+
+func TestEnsureRepo_LatestRelease(t *testing.T) {
+	latest, releaseCalls, releasesDown := "v1.0", 0, false
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, ""
+		p := req.URL.Path
+		switch {
+		case req.URL.Host != "api.github.com":
+			body = "zip-" + path.Base(p)
+		case p == "/repos/owner/repo":
+			body = `{"full_name":"owner/repo","default_branch":"main"}`
+		case p == "/repos/owner/repo/releases/latest":
+			releaseCalls++
+			body = `{"tag_name":"` + latest + `"}`
+			if releasesDown {
+				status, body = http.StatusBadGateway, "{}"
+			}
+		case p == "/repos/owner/repo/releases":
+			releaseCalls++
+			body = `[{"tag_name":"v3.0","draft":true},{"tag_name":"v2.0-rc1","prerelease":true},{"tag_name":"` + latest + `"}]`
+		case strings.Contains(p, "/branches/"):
+			status, body = http.StatusNotFound, `{"message":"Branch not found"}`
+		case strings.Contains(p, "/git/ref/tags/"):
+			body = `{"object":{"sha":"sha-` + path.Base(p) + `","type":"commit"}}`
+		default:
+			status, body = http.StatusNotFound, `{"message":"Not Found"}`
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+
+	ensure := func(ctx context.Context) (*RepoArchive, error) {
+		return s.EnsureRepoResult(ctx, "u", "owner/repo", LatestRelease, "", false, true)
+	}
+	res, err := ensure(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Tag != "v1.0" || res.Path != filepath.Join(dir, "v1.0.legacy.zip") || res.CommitSHA != "sha-v1.0" {
+		t.Fatalf("unexpected archive %+v", res)
+	}
+
+	// A new release moves the mapping; the old tag's archive stays.
+	latest = "v1.1"
+	if res, err = ensure(ctx); err != nil || res.Tag != "v1.1" || !archiveExists(filepath.Join(dir, "v1.0.legacy.zip")) {
+		t.Fatalf("after release: %+v %v", res, err)
+	}
+	if pre, err := ensure(WithPrereleases(ctx, true)); err != nil || pre.Tag != "v2.0-rc1" {
+		t.Fatalf("with prereleases: %+v %v", pre, err)
+	}
+
+	// Within max age the mapping is used without asking GitHub.
+	calls := releaseCalls
+	if res, err = ensure(WithMaxAge(ctx, time.Hour)); err != nil || res.Tag != "v1.1" || releaseCalls != calls {
+		t.Fatalf("within max age: %+v %v calls=%d->%d", res, err, calls, releaseCalls)
+	}
+
+	// When GitHub cannot answer the stale policy decides.
+	releasesDown = true
+	if res, err = ensure(ctx); err != nil || res.Tag != "v1.1" {
+		t.Fatalf("prefer-fresh fallback: %+v %v", res, err)
+	}
+	if _, err = ensure(WithStalePolicy(ctx, StaleFail)); !errors.Is(err, ErrUnverified) {
+		t.Fatalf("expected ErrUnverified, got %v", err)
+	}
+	entries, err := s.List("users/u/repos/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name == releaseMapName {
+			t.Fatalf("mapping should not be listed: %+v", e)
+		}
+	}
+}
+
+func TestVerifyArchive_Mismatch(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	zipPath := filepath.Join(root, "main.zip")
+	if err := os.WriteFile(zipPath, []byte("good"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.recordArchive(zipPath, "owner/repo", "main", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyArchive(zipPath); err != nil {
+		t.Fatalf("verify intact: %v", err)
+	}
+	if err := os.WriteFile(zipPath, []byte("evil"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyArchive(zipPath); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, err := os.Stat(zipPath); !os.IsNotExist(err) {
+		t.Fatalf("corrupt archive should be removed")
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	const (
+		branchSHA = "1111111111111111111111111111111111111111"
+		tagObj    = "2222222222222222222222222222222222222222"
+		tagSHA    = "3333333333333333333333333333333333333333"
+		commitSHA = "4444444444444444444444444444444444444444"
+	)
+	var downloads int
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, status := "", http.StatusNotFound
+		switch {
+		case req.URL.Host != "api.github.com":
+			downloads++
+		case req.URL.Path == "/repos/owner/repo":
+			body, status = `{"default_branch":"main"}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/git/ref/heads/main":
+			body, status = `{"object":{"sha":"`+branchSHA+`","type":"commit"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/git/ref/tags/v1":
+			body, status = `{"object":{"sha":"`+tagObj+`","type":"tag"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/git/tags/"+tagObj:
+			body, status = `{"object":{"sha":"`+tagSHA+`","type":"commit"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/commits/4444444":
+			body, status = `{"sha":"`+commitSHA+`"}`, http.StatusOK
+		case strings.HasPrefix(req.URL.Path, "/repos/owner/repo/commits/"):
+			status = http.StatusUnprocessableEntity
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	// A cached git-mode archive of main at branchSHA.
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "main.zip"), []byte("zip"), 0o644)
+	_ = writeSHA(filepath.Join(dir, "main.zip.meta"), branchSHA)
+
+	tests := []struct {
+		ref      string
+		wantRef  string
+		wantSHA  string
+		wantType string
+		cached   bool
+	}{
+		{ref: "", wantRef: "main", wantSHA: branchSHA, wantType: RefBranch, cached: true},
+		{ref: "main", wantRef: "main", wantSHA: branchSHA, wantType: RefBranch, cached: true},
+		{ref: "v1", wantRef: "v1", wantSHA: tagSHA, wantType: RefTag},
+		{ref: "4444444", wantRef: "4444444", wantSHA: commitSHA, wantType: RefCommit},
+	}
+	for _, tt := range tests {
+		got, err := s.ResolveRef(ctx, "u", "owner/repo", tt.ref, "")
+		if err != nil {
+			t.Fatalf("ResolveRef(%q): %v", tt.ref, err)
+		}
+		if got.Ref != tt.wantRef || got.SHA != tt.wantSHA || got.Short != tt.wantSHA[:7] || got.Type != tt.wantType || got.Cached != tt.cached {
+			t.Fatalf("ResolveRef(%q) = %+v", tt.ref, got)
+		}
+	}
+	if _, err := s.ResolveRef(ctx, "u", "owner/repo", "missing", ""); !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("expected ErrNotFound and ErrBranchNotFound, got %v", err)
+	}
+	if downloads != 0 {
+		t.Fatalf("ResolveRef downloaded %d archives", downloads)
+	}
+}
+
+func TestEnsureRepoLegacy_TagsAndCommitsResolveToSHA(t *testing.T) {
+	const tagSHA = "5555555555555555555555555555555555555555"
+	downloads := 0
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, status := "", http.StatusNotFound
+		switch {
+		case req.URL.Host != "api.github.com":
+			downloads++
+			if path.Base(req.URL.Path) != "nope" {
+				body, status = "zip-"+path.Base(req.URL.Path), http.StatusOK
+			}
+		case req.URL.Path == "/repos/owner/repo/git/ref/tags/v1":
+			body, status = `{"object":{"sha":"`+tagSHA+`","type":"commit"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/commits/5555555":
+			body, status = `{"sha":"`+tagSHA+`"}`, http.StatusOK
+		case strings.HasPrefix(req.URL.Path, "/repos/owner/repo/commits/"):
+			status = http.StatusUnprocessableEntity
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	s := New(t.TempDir())
+	s.HTTPClient = &http.Client{Transport: rt}
+	s.RetryMax = 0
+	ctx := context.Background()
+
+	for _, ref := range []string{"v1", "5555555"} {
+		for i, want := range []CacheOutcome{CacheMiss, CacheRevalidated} {
+			var outcome CacheOutcome
+			zipPath, err := s.EnsureRepo(WithOutcome(ctx, &outcome), "u", "owner/repo", ref, "", false, true)
+			if err != nil {
+				t.Fatalf("%s #%d: %v", ref, i, err)
+			}
+			if outcome != want {
+				t.Fatalf("%s #%d: outcome=%q, want %q", ref, i, outcome, want)
+			}
+			if meta, _ := s.ReadArchiveMeta(zipPath); meta == nil || meta.CommitSHA != tagSHA {
+				t.Fatalf("%s: meta %+v", ref, meta)
+			}
+		}
+	}
+	if downloads != 2 {
+		t.Fatalf("downloads=%d, want 2", downloads)
+	}
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "nope", "", false, true); err == nil || errors.Is(err, ErrBranchGone) {
+		t.Fatal("expected unknown ref to fail")
+	}
+}
+
+func TestDefaultBranch_CachesAndListsArchives(t *testing.T) {
+	calls := 0
+	status := http.StatusOK
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		h := make(http.Header)
+		body := `{"default_branch":"trunk"}`
+		if status == http.StatusForbidden {
+			h.Set("X-RateLimit-Remaining", "0")
+			body = `{"message":"API rate limit exceeded"}`
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: h}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	for _, name := range []string{"trunk.zip", "trunk.zip.meta", "feature/x.zip", "dev.legacy.zip", ".tmp-download-1.zip"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(p), 0o755)
+		_ = os.WriteFile(p, []byte("x"), 0o644)
+	}
+
+	info, err := s.DefaultBranch(ctx, "u", "owner/repo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DefaultBranch != "trunk" || strings.Join(info.CachedBranches, ",") != "dev,feature/x,trunk" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if _, err := s.DefaultBranch(ctx, "u", "owner/repo", ""); err != nil || calls != 1 {
+		t.Fatalf("expected cached answer, calls=%d err=%v", calls, err)
+	}
+
+	// A different token is a different cache entry; errors are classified.
+	status = http.StatusForbidden
+	if _, err := s.DefaultBranch(ctx, "u", "owner/repo", "other"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	status = http.StatusNotFound
+	s.DefaultBranchTTL = 0
+	if _, err := s.DefaultBranch(ctx, "u", "owner/repo", ""); !errors.Is(err, ErrRepoNotFound) {
+		t.Fatalf("expected ErrRepoNotFound, got %v", err)
+	}
+}
+
+func TestListCommits_PaginatesAndStopsAtSince(t *testing.T) {
+	var pages []string
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/repos/owner/repo/commits" {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}, nil
+		}
+		q := req.URL.Query()
+		pages = append(pages, q.Get("sha")+"@"+q.Get("page"))
+		page, _ := strconv.Atoi(q.Get("page"))
+		per, _ := strconv.Atoi(q.Get("per_page"))
+		var items []string
+		for i := 0; i < per; i++ {
+			n := (page-1)*per + i
+			items = append(items, fmt.Sprintf(`{"sha":"%07x%033x","commit":{"message":"change %d\n\nbody","author":{"name":"Dev","date":"2024-01-02T03:04:05Z"}},"author":{"login":"dev%d"}}`, n+1, 0, n, n))
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("[" + strings.Join(items, ",") + "]")), Header: make(http.Header)}, nil
+	})
+	s := New(t.TempDir())
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	got, err := s.ListCommits(ctx, "owner/repo", "main", "", 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Short != fmt.Sprintf("%07x", 1) || got[0].Message != "change 0" || got[0].Author != "dev0" || got[0].Date.IsZero() {
+		t.Fatalf("unexpected commits %+v", got)
+	}
+
+	// since is on the second page: everything before it, exclusive.
+	since := fmt.Sprintf("%07x%033x", 150, 0)[:12]
+	got, err = s.ListCommits(ctx, "owner/repo", "main", since, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 149 || got[148].Message != "change 148" {
+		t.Fatalf("expected 149 commits before since, got %d", len(got))
+	}
+	if strings.Join(pages, ",") != "main@1,main@1,main@2" {
+		t.Fatalf("unexpected page requests %v", pages)
+	}
+	if _, err := s.ListCommits(ctx, "owner/repo", "main", since, 0, ""); err != nil || len(pages) != 3 {
+		t.Fatalf("expected cached answer, pages=%v err=%v", pages, err)
+	}
+
+	if _, err := s.ListCommits(ctx, "owner/other", "main", "", 0, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.ListCommits(ctx, "owner/repo", "main", "not-a-sha", 0, ""); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("expected ErrBadPath, got %v", err)
+	}
+}
+
+func TestSecondaryRateLimit_RetriesAndBreaker(t *testing.T) {
+	var calls int
+	var respond func(n int) (int, http.Header, string)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		status, h, body := respond(calls)
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: h}, nil
+	})
+	limited := func(retryAfter string) (int, http.Header, string) {
+		h := make(http.Header)
+		if retryAfter != "" {
+			h.Set("Retry-After", retryAfter)
+		}
+		return http.StatusForbidden, h, `{"message":"You have exceeded a secondary rate limit."}`
+	}
+	ok := func() (int, http.Header, string) {
+		return http.StatusOK, make(http.Header), `{"default_branch":"main","commit":{"sha":"abc"}}`
+	}
+	newStorage := func() *Storage {
+		calls = 0
+		s := New(t.TempDir())
+		s.HTTPClient = &http.Client{Transport: rt}
+		s.DefaultBranchTTL = 0
+		return s
+	}
+	ctx := context.Background()
+
+	// A short advised wait is slept and retried; success closes the breaker.
+	s := newStorage()
+	respond = func(n int) (int, http.Header, string) {
+		if n == 1 {
+			return limited("1")
+		}
+		return ok()
+	}
+	start := time.Now()
+	if _, err := s.fetchDefaultBranch(ctx, "owner/repo", "tok"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || time.Since(start) < time.Second {
+		t.Fatalf("expected one retry after ~1s, calls=%d elapsed=%s", calls, time.Since(start))
+	}
+	if st, _ := s.GitHubBreaker("tok"); st != BreakerClosed {
+		t.Fatalf("breaker %s after success", st)
+	}
+
+	// A wait beyond SecondaryWaitMax fails at once and opens the breaker
+	// for that token only; later calls do not reach GitHub.
+	s = newStorage()
+	s.SecondaryWaitMax = time.Second
+	respond = func(int) (int, http.Header, string) { return limited("120") }
+	_, err := s.fetchDefaultBranch(ctx, "owner/repo", "tok")
+	var rle *RateLimitError
+	if !errors.As(err, &rle) || rle.RetryAfter != 120*time.Second || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected RateLimitError with 120s, got %v", err)
+	}
+	if st, until := s.GitHubBreaker("tok"); st != BreakerOpen || time.Until(until) < 100*time.Second {
+		t.Fatalf("breaker %s until %v", st, until)
+	}
+	if _, err := s.fetchBranchSHA(ctx, "owner/repo", "main", "tok"); !errors.As(err, &rle) || !rle.Breaker || calls != 1 {
+		t.Fatalf("expected breaker to refuse without a call, calls=%d err=%v", calls, err)
+	}
+	respond = func(int) (int, http.Header, string) { return ok() }
+	if _, err := s.fetchDefaultBranch(ctx, "owner/repo", "other"); err != nil || calls != 2 {
+		t.Fatalf("other token should pass, calls=%d err=%v", calls, err)
+	}
+
+	// After the cool-down a single probe goes through and closes it.
+	s.mu.Lock()
+	s.breakers[tokenKey("tok")].openUntil = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	if st, _ := s.GitHubBreaker("tok"); st != BreakerHalfOpen {
+		t.Fatalf("breaker %s, want half-open", st)
+	}
+	if _, err := s.fetchDefaultBranch(ctx, "owner/repo", "tok"); err != nil || calls != 3 {
+		t.Fatalf("probe: calls=%d err=%v", calls, err)
+	}
+	if st, _ := s.GitHubBreaker("tok"); st != BreakerClosed || s.BreakerOpen() {
+		t.Fatalf("breaker %s after probe", st)
+	}
+
+	// The message alone identifies a secondary limit; codeload downloads
+	// stop instead of retrying into it.
+	s = newStorage()
+	s.SecondaryRetries = -1
+	s.RetryBackoff = time.Millisecond
+	respond = func(int) (int, http.Header, string) { return limited("") }
+	err = s.downloadZip(ctx, "owner/repo", "main", "", filepath.Join(t.TempDir(), "x.zip"))
+	if !errors.As(err, &rle) || rle.RetryAfter != time.Minute || calls != 1 {
+		t.Fatalf("expected one call and a 1m RateLimitError, calls=%d err=%v", calls, err)
+	}
+}
+
+func TestCleanup_RetentionKeepsNewestAndDefault(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	s.Retention = RetentionPolicy{MaxArchives: 2, PerRepo: map[string]int{"owner/big": 0}}
+	s.noteDefaultBranch("owner/repo", "main")
+	now := time.Now()
+	clock := testutil.NewFakeClock(now)
+	s.Clock = clock
+
+	// Each archive was last served age ago.
+	write := func(repo, name string, age time.Duration) string {
+		p := filepath.Join(root, "users", "u", "repos", filepath.FromSlash(repo), filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(p), 0o755)
+		_ = os.WriteFile(p, []byte("zip"), 0o644)
+		_ = os.WriteFile(p+".meta", []byte("sha"), 0o644)
+		clock.Set(now.Add(-age))
+		_ = s.touch(p)
+		clock.Set(now)
+		return p
+	}
+	mainZip := write("owner/repo", "main.zip", 5*time.Hour) // oldest, but default
+	newest := write("owner/repo", "feature/new.zip", time.Hour)
+	older := write("owner/repo", "old.zip", 2*time.Hour)
+	oldest := write("owner/repo", "stale.legacy.zip", 3*time.Hour)
+	for i := 0; i < 4; i++ {
+		write("owner/big", fmt.Sprintf("b%d.zip", i), time.Hour)
+	}
+
+	report, err := s.Cleanup(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{mainZip, newest} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s should be kept: %v", p, err)
+		}
+	}
+	for _, p := range []string{older, oldest, older + ".meta"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed", p)
+		}
+	}
+	if len(report.Retention) != 2 || len(report.Expired) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got := len(listArchives(filepath.Join(root, "users", "u", "repos", "owner", "big"))); got != 4 {
+		t.Fatalf("per-repo override ignored, %d archives left", got)
+	}
+
+	// The archive just served survives even when it is not the newest.
+	write("owner/repo", "old.zip", 10*time.Hour)
+	s.applyRetention("u", "owner/repo", older, nil)
+	if _, err := os.Stat(older); err != nil {
+		t.Fatalf("kept archive removed: %v", err)
+	}
+	if _, err := os.Stat(newest); !os.IsNotExist(err) {
+		t.Fatalf("newest non-kept archive should make room")
+	}
+}
+
+func TestEnsureRepoLegacy_BranchGone(t *testing.T) {
+	const sha = "abcdef0123456789abcdef0123456789abcdef01"
+	apiStatus := http.StatusOK
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "api.github.com" {
+			body := `{"commit":{"sha":"` + sha + `"}}`
+			if apiStatus != http.StatusOK {
+				body = `{"message":"Branch not found"}`
+			}
+			return &http.Response{StatusCode: apiStatus, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("zip")), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.HTTPClient = &http.Client{Transport: rt}
+	s.RetryMax = 1
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "feature", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiStatus = http.StatusNotFound
+	_, err = s.EnsureRepo(ctx, "u", "owner/repo", "feature", "", false, true)
+	var gone *BranchGoneError
+	if !errors.Is(err, ErrBranchGone) || !errors.As(err, &gone) {
+		t.Fatalf("expected ErrBranchGone, got %v", err)
+	}
+	if gone.ZipPath != zipPath || gone.LastCommit != sha {
+		t.Fatalf("unexpected gone error %+v", gone)
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Fatalf("stale archive should be kept: %v", err)
+	}
+
+	// Within the grace period cleanup keeps it; past it the archive goes.
+	s.GonePurgeAfter = time.Hour
+	if report, _ := s.Cleanup(24 * time.Hour); len(report.Gone) != 0 {
+		t.Fatalf("purged too early: %+v", report)
+	}
+	past := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	_ = os.WriteFile(gonePath(zipPath), []byte(past), 0o644)
+	report, _ := s.Cleanup(24 * time.Hour)
+	if len(report.Gone) != 1 {
+		t.Fatalf("expected purge, got %+v", report)
+	}
+	if _, err := os.Stat(zipPath); !os.IsNotExist(err) {
+		t.Fatalf("archive not purged")
+	}
+	if _, err := os.Stat(gonePath(zipPath)); !os.IsNotExist(err) {
+		t.Fatalf("marker not removed")
+	}
+}
+
+func TestRepoPolicy_Precedence(t *testing.T) {
+	cases := []struct {
+		name  string
+		allow []string
+		deny  []string
+		repo  string
+		want  bool
+	}{
+		{"no rules", nil, nil, "any/repo", true},
+		{"allow glob", []string{"myorg/*"}, nil, "myorg/tool", true},
+		{"allow is case-insensitive", []string{"myorg/*"}, nil, "MyOrg/Tool", true},
+		{"not in allow list", []string{"myorg/*"}, nil, "other/tool", false},
+		{"deny only", nil, []string{"evil/*"}, "evil/x", false},
+		{"deny only, other repo", nil, []string{"evil/*"}, "good/x", true},
+		{"deny beats allow", []string{"myorg/*"}, []string{"myorg/secret"}, "myorg/secret", false},
+		{"deny beats exact allow", []string{"myorg/secret"}, []string{"myorg/*"}, "myorg/secret", false},
+		{"regex allow", []string{"re:(myorg|partner)/.+"}, nil, "partner/lib", true},
+		{"regex is anchored", []string{"re:myorg/lib"}, nil, "myorg/library", false},
+		{"regex deny", []string{"*/*"}, []string{"re:.*/internal-.*"}, "a/internal-x", false},
+	}
+	for _, tc := range cases {
+		p, err := NewRepoPolicy(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err = p.Check(tc.repo)
+		if got := err == nil; got != tc.want {
+			t.Errorf("%s: Check(%q) = %v, want allowed=%v", tc.name, tc.repo, err, tc.want)
+		}
+		if err != nil && !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s: error %v does not wrap ErrPolicyDenied", tc.name, err)
+		}
+	}
+
+	if _, err := NewRepoPolicy([]string{"re:("}, nil); err == nil {
+		t.Fatal("expected error for invalid regex")
+	}
+}
+
+func TestRepoPolicy_DeniedBeforeGitHub(t *testing.T) {
+	s := New(t.TempDir())
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", req.URL)
+		return nil, errors.New("no network")
+	})}
+	p, err := NewRepoPolicy([]string{"myorg/*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRepoPolicy(p)
+	ctx := context.Background()
+
+	if _, err := s.EnsureRepo(ctx, "u", "other/repo", "main", "", false, true); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("EnsureRepo: expected ErrPolicyDenied, got %v", err)
+	}
+	if _, err := s.EnsureBareRepo(ctx, "other/repo", ""); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("EnsureBareRepo: expected ErrPolicyDenied, got %v", err)
+	}
+	if _, err := s.ResolveRef(ctx, "u", "other/repo", "main", ""); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("ResolveRef: expected ErrPolicyDenied, got %v", err)
+	}
+	if _, err := s.DefaultBranch(ctx, "u", "other/repo", ""); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("DefaultBranch: expected ErrPolicyDenied, got %v", err)
+	}
+}
+
+// crossDevice simulates a destination on another mount: renames of the
+// download temp files fail with EXDEV, renames within the destination work.
+func crossDevice(fail error) func(string, string) error {
+	return func(oldpath, newpath string) error {
+		if strings.HasPrefix(filepath.Base(oldpath), ".tmp-xdev-") {
+			if fail != nil {
+				return fail
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+}
+
+func TestEnsurePackage_CrossDeviceRename(t *testing.T) {
+	s := New(t.TempDir())
+	s.rename = crossDevice(nil)
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("package")), Header: make(http.Header)}, nil
+	})}
+
+	pkgPath, err := s.EnsurePackage(context.Background(), "u", "https://example.com/pkg.tgz")
+	if err != nil {
+		t.Fatalf("EnsurePackage: %v", err)
+	}
+	if data, err := os.ReadFile(pkgPath); err != nil || string(data) != "package" {
+		t.Fatalf("content %q, err %v", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(pkgPath))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			t.Fatalf("temp file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestReplaceFile_CrossDeviceFailureHidesPartialCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst.zip")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := New(dir)
+	s.rename = crossDevice(errors.New("rename failed"))
+
+	if err := s.replaceFile(src, dst); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("destination should not exist: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "src" {
+		t.Fatalf("unexpected files %v", entries)
+	}
+}
+
+func TestPackages_SidecarLookupAndCleanup(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	downloads := 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		downloads++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("package")), Header: make(http.Header)}, nil
+	})}
+	const pkgURL = "https://example.com/pkg.tgz"
+
+	if _, err := s.LookupPackage("u", pkgURL); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before download, got %v", err)
+	}
+	pkgPath, err := s.EnsurePackage(context.Background(), "u", pkgURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.LookupPackage("u", pkgURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.URL != pkgURL || meta.Filename != "pkg.tgz" || meta.Size != 7 || meta.SHA256 == "" {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+	if downloads != 1 {
+		t.Fatalf("lookup must not fetch, downloads=%d", downloads)
+	}
+	entries, err := s.List("users/u/packages/" + PackageHash(pkgURL))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("sidecar should be hidden from List: %v %v", entries, err)
+	}
+
+	clock.Advance(48 * time.Hour)
+	if _, err := s.Cleanup(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(pkgPath)); !os.IsNotExist(err) {
+		t.Fatalf("expired package dir should be removed with its sidecar: %v", err)
+	}
+}
+
+func TestKeepPrevious_ArchiveAtAndRollback(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	s.KeepPrevious = 2
+	sha, body, downloads := "", "", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	shas := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40), strings.Repeat("d", 40)}
+	var zipPath string
+	for i, v := range shas {
+		sha, body = v, fmt.Sprintf("zip-v%d", i+1)
+		var err error
+		if zipPath, err = s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, err := s.ReadArchiveMeta(zipPath)
+	if err != nil || len(meta.Previous) != 2 || meta.Previous[0].CommitSHA != shas[2] || meta.Previous[1].CommitSHA != shas[1] {
+		t.Fatalf("history %+v err=%v", meta, err)
+	}
+	if _, err := os.Stat(retainedPath(zipPath, shas[0])); !os.IsNotExist(err) {
+		t.Fatalf("trimmed archive still on disk: %v", err)
+	}
+
+	p, at, err := s.ArchiveAt("u", "owner/repo", "main", "ccccccc")
+	if err != nil || at.CommitSHA != shas[2] {
+		t.Fatalf("ArchiveAt: %v %+v", err, at)
+	}
+	if b, _ := os.ReadFile(p); string(b) != "zip-v3" {
+		t.Fatalf("ArchiveAt content %q", b)
+	}
+	if _, _, err := s.ArchiveAt("u", "owner/repo", "main", "aaaaaaa"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("trimmed commit: %v", err)
+	}
+	if _, _, err := s.ArchiveAt("u", "owner/repo", "main", "zz"); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("bad commit: %v", err)
+	}
+	if got := s.cachedBranches("u", "owner/repo"); len(got) != 1 || got[0] != "main" {
+		t.Fatalf("cached branches %v", got)
+	}
+	if got := listArchives(filepath.Dir(zipPath)); len(got) != 3 {
+		t.Fatalf("retained archives not counted: %+v", got)
+	}
+
+	// Rollback pins v3 while upstream still says d; no refresh until forced.
+	rolled, err := s.Rollback("u", "owner/repo", "main")
+	if err != nil || rolled.CommitSHA != shas[2] || !rolled.Pinned {
+		t.Fatalf("Rollback: %v %+v", err, rolled)
+	}
+	before := downloads
+	if zipPath, err = s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(zipPath); string(b) != "zip-v3" || downloads != before {
+		t.Fatalf("pinned archive not served: %q downloads=%d", b, downloads-before)
+	}
+	if _, _, err := s.ArchiveAt("u", "owner/repo", "main", "ddddddd"); err != nil {
+		t.Fatalf("rolled-back head not kept: %v", err)
+	}
+	if _, err = s.EnsureRepo(ctx, "u", "owner/repo", "main", "", true, true); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.ReadArchiveMeta(zipPath); meta.Pinned || meta.CommitSHA != shas[3] {
+		t.Fatalf("forced refresh kept pin: %+v", meta)
+	}
+}
+
+func TestArchiveServedAt(t *testing.T) {
+	s := New(t.TempDir())
+	s.KeepPrevious = 2
+	t0 := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	clock := testutil.NewFakeClock(t0)
+	s.Clock = clock
+	sha, body, downloads := "", "", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+	shas := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40), strings.Repeat("d", 40)}
+	ensure := func(at time.Duration, i int) {
+		t.Helper()
+		clock.Set(t0.Add(at))
+		sha, body = shas[i], fmt.Sprintf("zip-v%d", i+1)
+		if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a from 12:00 (revalidated at 13:00), b from 14:00, c from 16:00.
+	ensure(0, 0)
+	ensure(time.Hour, 0)
+	ensure(2*time.Hour, 1)
+	ensure(4*time.Hour, 2)
+
+	servedAt := func(at time.Duration) (string, *ServingWindow, error) {
+		t.Helper()
+		p, meta, w, err := s.ArchiveServedAt("u", "owner/repo", "main", t0.Add(at))
+		if err != nil {
+			return "", nil, err
+		}
+		if b, _ := os.ReadFile(p); meta.CommitSHA != w.CommitSHA || string(b) != fmt.Sprintf("zip-v%d", strings.Index("abcd", w.CommitSHA[:1])+1) {
+			t.Fatalf("%s: %s holds %q for commit %s", at, p, b, meta.CommitSHA)
+		}
+		return w.CommitSHA, w, nil
+	}
+	cases := []struct {
+		at     time.Duration
+		commit string
+		until  time.Duration // 0: still served
+	}{
+		{0, shas[0], 2 * time.Hour},
+		{90 * time.Minute, shas[0], 2 * time.Hour},
+		{2 * time.Hour, shas[1], 4 * time.Hour},
+		{3 * time.Hour, shas[1], 4 * time.Hour},
+		{5 * time.Hour, shas[2], 0},
+	}
+	for _, tc := range cases {
+		commit, w, err := servedAt(tc.at)
+		if err != nil || commit != tc.commit {
+			t.Fatalf("%s: commit %s err=%v, want %s", tc.at, commit, err, tc.commit)
+		}
+		if (tc.until == 0) != (w.Until == nil) || (w.Until != nil && !w.Until.Equal(t0.Add(tc.until))) {
+			t.Fatalf("%s: window %+v", tc.at, w)
+		}
+	}
+	_, _, err := servedAt(-time.Hour)
+	var ns *NotServedError
+	if !errors.As(err, &ns) || !errors.Is(err, ErrNotFound) || ns.Before != nil || ns.After == nil || ns.After.CommitSHA != shas[0] {
+		t.Fatalf("before the first archive: %v %+v", err, ns)
+	}
+
+	// d trims a; its window is then gone, and the nearest held one is b's.
+	ensure(6*time.Hour, 3)
+	if _, _, err := servedAt(time.Hour); !errors.As(err, &ns) || ns.After == nil || ns.After.CommitSHA != shas[1] {
+		t.Fatalf("trimmed window: %v", err)
+	}
+	// A rollback to c at 19:00 ends d's window and starts a new one for c.
+	clock.Set(t0.Add(7 * time.Hour))
+	if _, err := s.Rollback("u", "owner/repo", "main"); err != nil {
+		t.Fatal(err)
+	}
+	for at, want := range map[time.Duration]string{6*time.Hour + 30*time.Minute: shas[3], 8 * time.Hour: shas[2]} {
+		commit, _, err := servedAt(at)
+		if commit != want || err != nil {
+			t.Fatalf("after rollback, %s: commit %s err=%v, want %s", at, commit, err, want)
+		}
+	}
+}
+
+func TestEnsureRepoResult_DescribesArchive(t *testing.T) {
+	s := New(t.TempDir())
+	sha, body, downloads := strings.Repeat("e", 40), "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	for i, wantCache := range []bool{false, true} {
+		var outcome CacheOutcome
+		res, err := s.EnsureRepoResult(WithOutcome(ctx, &outcome), "u", "owner/repo", "main", "", false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, size, _ := hashFile(res.Path)
+		if res.CommitSHA != sha || res.ShortSHA != sha[:DefaultShortSHALen] || res.SHA256 != sum || res.Size != size || res.FetchedAt.IsZero() {
+			t.Fatalf("#%d: unexpected result %+v", i, res)
+		}
+		if res.FromCache != wantCache || (outcome == CacheRevalidated) != wantCache || res.Outcome != outcome {
+			t.Fatalf("#%d: from cache=%v outcome=%q", i, res.FromCache, outcome)
+		}
+	}
+
+	// ShortSHALen abbreviates the result and the refreshed .commit.txt.
+	s.ShortSHALen = 7
+	res, err := s.EnsureRepoResult(ctx, "u", "owner/repo", "main", "", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, _ := readSHA(strings.TrimSuffix(res.Path, ".zip") + ".commit.txt")
+	if res.ShortSHA != sha[:7] || short != sha[:7] {
+		t.Fatalf("short sha %q, .commit.txt %q", res.ShortSHA, short)
+	}
+}
+
+func TestTrash_RestoreConflictAndPurge(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	s.TrashDeletes = true
+	file := filepath.Join(root, "users", "u", "packages", "p", "a.tgz")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("users/u/packages/p/a.tgz", false); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := s.ListTrash()
+	if err != nil || len(trash) != 1 || trash[0].Size != 2 {
+		t.Fatalf("trash %+v err=%v", trash, err)
+	}
+	if _, err := s.List(trashDir); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("trash listable: %v", err)
+	}
+	if err := s.Delete(trashDir, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("trash deletable: %v", err)
+	}
+
+	// Something new at the original path blocks the restore.
+	if err := os.WriteFile(file, []byte("v2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Restore(trash[0].ID); !errors.Is(err, ErrExists) {
+		t.Fatalf("restore over existing: %v", err)
+	}
+	if _, err := s.Restore("../users"); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("bad id: %v", err)
+	}
+
+	s.TrashRetention = time.Hour
+	if report, err := s.Cleanup(24 * time.Hour); err != nil || len(report.Trash) != 0 {
+		t.Fatalf("purged early: %+v err=%v", report, err)
+	}
+	clock.Advance(2 * time.Hour)
+	report, err := s.Cleanup(24 * time.Hour)
+	if err != nil || len(report.Trash) != 1 || report.Trash[0] != "users/u/packages/p/a.tgz" {
+		t.Fatalf("purge report %+v err=%v", report, err)
+	}
+	if trash, _ := s.ListTrash(); len(trash) != 0 {
+		t.Fatalf("trash after purge %+v", trash)
+	}
+}
+
+func TestCompressArchives_StoresZstAndServesOriginalBytes(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	s.CompressArchives = true
+	s.KeepPrevious = 1
+	sha, body, downloads := strings.Repeat("a", 40), strings.Repeat("zip-v1 ", 2000), 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	res, err := s.EnsureRepoResult(ctx, "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(res.Path); !os.IsNotExist(err) {
+		t.Fatalf("uncompressed archive left on disk: %v", err)
+	}
+	fi, err := os.Stat(res.Path + ".zst")
+	if err != nil || fi.Size() >= int64(len(body)) {
+		t.Fatalf("compressed archive: %v", err)
+	}
+	sum := sha256.Sum256([]byte(body))
+	meta, _ := s.ReadArchiveMeta(res.Path)
+	if !res.Compressed || res.Size != int64(len(body)) || res.SHA256 != hex.EncodeToString(sum[:]) ||
+		meta.Compression != CompressionZstd || meta.StoredSize != fi.Size() {
+		t.Fatalf("result %+v meta %+v", res, meta)
+	}
+	rc, err := s.OpenArchive(res.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil || string(got) != body {
+		t.Fatalf("OpenArchive read %d bytes, err=%v", len(got), err)
+	}
+	raw, done, err := s.RawArchive(res.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(raw); string(b) != body {
+		t.Fatalf("RawArchive content mismatch")
+	}
+	// The decoded copy stays beside the archive, named as a temp file.
+	if filepath.Dir(raw) != filepath.Dir(res.Path) || !strings.HasPrefix(filepath.Base(raw), tempPrefix) {
+		t.Fatalf("RawArchive copy at %s, want a temp file beside %s", raw, res.Path)
+	}
+	done()
+	if _, err := os.Stat(raw); !os.IsNotExist(err) {
+		t.Fatalf("RawArchive temp copy not removed: %v", err)
+	}
+	tempDir := filepath.Join(t.TempDir(), "tmp")
+	s.TempDir = tempDir
+	s.diskFree = func(string) (uint64, bool) { return 1 << 20, true }
+	if _, _, err := s.RawArchive(res.Path); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("RawArchive without space: err = %v", err)
+	}
+	s.diskFree = nil
+	if raw, done, err = s.RawArchive(res.Path); err != nil || filepath.Dir(raw) != tempDir {
+		t.Fatalf("RawArchive with TempDir: %s, %v", raw, err)
+	}
+	done()
+	s.TempDir = ""
+
+	// Hits, verification and listings see the compressed archive.
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil || downloads != 1 {
+		t.Fatalf("expected a cache hit, downloads=%d err=%v", downloads, err)
+	}
+	if err := s.VerifyArchive(res.Path); err != nil {
+		t.Fatalf("VerifyArchive: %v", err)
+	}
+	if got := s.cachedBranches("u", "owner/repo"); len(got) != 1 || got[0] != "main" {
+		t.Fatalf("cached branches %v", got)
+	}
+
+	// A replaced archive is kept compressed and still served by commit.
+	sha, body = strings.Repeat("b", 40), "zip-v2"
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	p, at, err := s.ArchiveAt("u", "owner/repo", "main", "aaaaaaa")
+	if err != nil || at.Compression != CompressionZstd {
+		t.Fatalf("ArchiveAt: %v %+v", err, at)
+	}
+	if rc, err = s.OpenArchive(p); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(rc)
+	_ = rc.Close()
+	if string(got) != strings.Repeat("zip-v1 ", 2000) {
+		t.Fatalf("kept archive content mismatch")
+	}
+
+	// Corruption of the compressed bytes is caught by verification.
+	if err := os.WriteFile(res.Path+".zst", []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyArchive(res.Path); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("VerifyArchive on corrupt archive: %v", err)
+	}
+	if ArchiveExists(res.Path) {
+		t.Fatalf("corrupt archive not removed")
+	}
+}
+
+func writeTestZip(t *testing.T, path, top string, mod time.Time, names []string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range names {
+		hdr := &zip.FileHeader{Name: top + name, Method: zip.Deflate, Modified: mod}
+		hdr.SetMode(0o600)
+		if strings.HasSuffix(name, ".sh") {
+			hdr.SetMode(0o700)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			_, _ = w.Write([]byte("content of " + name))
+		}
+	}
+	_ = zw.SetComment(top)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+}
+
+func TestNormalizedArchive_Deterministic(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "main.zip"), filepath.Join(dir, "dev.zip")
+	writeTestZip(t, a, "repo-aaaaaaa/", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), []string{"", "sub/", "sub/run.sh", "b.txt"})
+	writeTestZip(t, b, "repo-bbbbbbb/", time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC), []string{"b.txt", "", "sub/run.sh", "sub/"})
+
+	na, err := s.NormalizedArchive(a, RootRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := s.NormalizedArchive(b, RootRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if na.SHA256 != nb.SHA256 || na.SHA256 == "" {
+		t.Fatalf("normalized archives differ: %s vs %s", na.SHA256, nb.SHA256)
+	}
+	if sum, size, _ := hashFile(na.Path); sum != na.SHA256 || size != na.Size {
+		t.Fatalf("result does not describe %s", na.Path)
+	}
+
+	zr, err := zip.OpenReader(na.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.ModifiedDate != normalizedDOSDate || f.ModifiedTime != 0 {
+			t.Fatalf("%s keeps its timestamp", f.Name)
+		}
+		want := os.FileMode(0o644)
+		switch f.Name {
+		case "repo/", "repo/sub/":
+			want = os.ModeDir | 0o755
+		case "repo/sub/run.sh":
+			want = 0o755
+		}
+		if f.Mode() != want {
+			t.Fatalf("%s mode %v, want %v", f.Name, f.Mode(), want)
+		}
+	}
+	_ = zr.Close()
+	if got := strings.Join(names, ","); got != "repo/,repo/b.txt,repo/sub/,repo/sub/run.sh" {
+		t.Fatalf("entries %s", got)
+	}
+
+	// Served again, the cached repack is reused; a new archive redoes it.
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(na.Path, past, past)
+	if again, err := s.NormalizedArchive(a, RootRepo); err != nil || again.SHA256 != na.SHA256 {
+		t.Fatalf("second normalize: %v", err)
+	}
+	if fi, _ := os.Stat(na.Path); !fi.ModTime().Equal(past) {
+		t.Fatalf("repack redone for an unchanged archive")
+	}
+	writeTestZip(t, a, "repo-ccccccc/", time.Now(), []string{"", "c.txt"})
+	if changed, err := s.NormalizedArchive(a, RootRepo); err != nil || changed.SHA256 == na.SHA256 {
+		t.Fatalf("repack not redone after the archive changed: %v", err)
+	}
+	removeArchive(a)
+	if _, err := os.Stat(na.Path); !os.IsNotExist(err) {
+		t.Fatalf("normalized variant outlived its archive")
+	}
+}
+
+func TestArchiveManifest(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(dir, "main.zip")
+	writeTestZip(t, zipPath, "repo-aaaaaaa/", time.Now(), []string{"", "sub/", "sub/run.sh", "b.txt"})
+	if _, err := s.recordArchive(zipPath, "owner/repo", "main", strings.Repeat("a", 40)); err != nil {
+		t.Fatal(err)
+	}
+	manifest := func(limits ManifestLimits) (*Manifest, error) {
+		var buf bytes.Buffer
+		n, err := s.ArchiveManifest(&buf, zipPath, limits)
+		if err != nil {
+			return nil, err
+		}
+		if n != int64(buf.Len()) {
+			t.Fatalf("reported %d bytes, wrote %d", n, buf.Len())
+		}
+		var m Manifest
+		if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+			t.Fatalf("decode %q: %v", buf.String(), err)
+		}
+		return &m, nil
+	}
+
+	m, err := manifest(ManifestLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, size, _ := hashFile(zipPath)
+	if m.Repo != "owner/repo" || m.Branch != "main" || m.CommitSHA != strings.Repeat("a", 40) || m.SHA256 != sum || m.Size != size {
+		t.Fatalf("manifest head = %+v", m)
+	}
+	digest := sha256.Sum256([]byte("content of b.txt"))
+	if m.FileCount != 2 || len(m.Files) != 2 || m.Files[1].Path != "repo-aaaaaaa/b.txt" || m.Files[1].SHA256 != hex.EncodeToString(digest[:]) || m.Files[1].Size != int64(len("content of b.txt")) {
+		t.Fatalf("manifest files = %+v", m.Files)
+	}
+	if m.TotalSize != m.Files[0].Size+m.Files[1].Size {
+		t.Fatalf("total size %d", m.TotalSize)
+	}
+
+	// served from the sidecar until the archive changes
+	sidecar := manifestPath(zipPath)
+	before, _ := os.Stat(sidecar)
+	if _, err := manifest(ManifestLimits{MaxEntries: 1}); err != nil {
+		t.Fatalf("cached manifest was rebuilt against the limits: %v", err)
+	}
+	if after, _ := os.Stat(sidecar); !after.ModTime().Equal(before.ModTime()) {
+		t.Fatal("cached manifest was rewritten")
+	}
+	writeTestZip(t, zipPath, "repo-bbbbbbb/", time.Now(), []string{"", "c.txt"})
+	if _, err := s.recordArchive(zipPath, "owner/repo", "main", strings.Repeat("b", 40)); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = manifest(ManifestLimits{}); err != nil || m.CommitSHA != strings.Repeat("b", 40) || m.FileCount != 1 || m.Files[0].Path != "repo-bbbbbbb/c.txt" {
+		t.Fatalf("manifest after update = %+v, %v", m, err)
+	}
+
+	tests := []struct {
+		name   string
+		limits ManifestLimits
+	}{
+		{"entries", ManifestLimits{MaxEntries: 1}},
+		{"bytes", ManifestLimits{MaxBytes: 4}},
+	}
+	writeTestZip(t, zipPath, "repo-ccccccc/", time.Now(), []string{"", "c.txt", "d.txt"})
+	if _, err := s.recordArchive(zipPath, "owner/repo", "main", strings.Repeat("c", 40)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := manifest(tt.limits); !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("err = %v, want ErrTooLarge", err)
+			}
+		})
+	}
+
+	if err := s.RemoveArchive(zipPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+		t.Fatalf("sidecar left behind: %v", err)
+	}
+}
+
+func TestRootModes(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ok := filepath.Join(dir, "main.zip")
+	writeTestZip(t, ok, "repo-aaaaaaa/", mod, []string{"", "a.txt", "sub/"})
+	// A stray top-level file named like a directory inside the folder.
+	clash := filepath.Join(dir, "dev.zip")
+	writeTestZip(t, clash, "", mod, []string{"repo-aaaaaaa/", "repo-aaaaaaa/sub/", "repo-aaaaaaa/sub/x.txt", "sub"})
+
+	cases := []struct {
+		name    string
+		zipPath string
+		root    RootMode
+		want    string
+		wantErr bool
+	}{
+		{"repo", ok, RootRepo, "repo/,repo/a.txt,repo/sub/", false},
+		{"none", ok, RootNone, "a.txt,sub/", false},
+		{"keep", ok, RootKeep, "repo-aaaaaaa/,repo-aaaaaaa/a.txt,repo-aaaaaaa/sub/", false},
+		{"none collides", clash, RootNone, "", true},
+		{"repo collides", clash, RootRepo, "", true},
+		{"keep is untouched", clash, RootKeep, "repo-aaaaaaa/,repo-aaaaaaa/sub/,repo-aaaaaaa/sub/x.txt,sub", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := s.RerootArchive(&buf, tc.zipPath, tc.root)
+			norm, nerr := s.NormalizedArchive(tc.zipPath, tc.root)
+			if tc.wantErr {
+				if !errors.Is(err, ErrExists) || !errors.Is(nerr, ErrExists) || buf.Len() != 0 {
+					t.Fatalf("reroot err=%v (%d bytes), normalize err=%v", err, buf.Len(), nerr)
+				}
+				return
+			}
+			if err != nil || nerr != nil || n != int64(buf.Len()) {
+				t.Fatalf("reroot err=%v n=%d, normalize err=%v", err, n, nerr)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+				if !f.Modified.Equal(mod) {
+					t.Fatalf("%s lost its timestamp", f.Name)
+				}
+			}
+			if got := strings.Join(names, ","); got != tc.want {
+				t.Fatalf("rerooted entries %s, want %s", got, tc.want)
+			}
+			if filepath.Base(norm.Path) != filepath.Base(normalizedPath(tc.zipPath, tc.root)) {
+				t.Fatalf("normalized path %s", norm.Path)
+			}
+		})
+	}
+	removeArchive(ok)
+	for _, m := range rootModes {
+		if _, err := os.Stat(normalizedPath(ok, m)); !os.IsNotExist(err) {
+			t.Fatalf("root=%s repack outlived its archive", m)
+		}
+	}
+}
+
+func TestPrefixedArchive(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(dir, "main.zip")
+	writeTestZip(t, zipPath, "repo-aaaaaaa/", time.Now(), []string{"", "a.txt", "sub/"})
+
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"repo-1.2.0", "repo-1.2.0", false},
+		{" third_party/repo/ ", "third_party/repo", false},
+		{"", "", true},
+		{"/", "", true},
+		{"/abs", "", true},
+		{"../up", "", true},
+		{"a/./b", "", true},
+		{"a//b", "", true},
+		{`a\b`, "", true},
+		{"sp ace", "", true},
+		{strings.Repeat("x", 201), "", true},
+	} {
+		got, err := ParseArchivePrefix(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Fatalf("ParseArchivePrefix(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+	if _, err := s.PrefixedArchive(zipPath, "../x"); err == nil {
+		t.Fatal("PrefixedArchive accepted a traversing prefix")
+	}
+
+	entries := func(path string) string {
+		t.Helper()
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = zr.Close() }()
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	a, err := s.PrefixedArchive(zipPath, "vendor/repo-1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(a.Path); got != "vendor/repo-1.0/,vendor/repo-1.0/a.txt,vendor/repo-1.0/sub/" {
+		t.Fatalf("entries %s", got)
+	}
+	b, err := s.PrefixedArchive(zipPath, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Path == a.Path || entries(b.Path) != "other/,other/a.txt,other/sub/" {
+		t.Fatalf("second prefix served %s", b.Path)
+	}
+	norm, err := s.NormalizedArchive(zipPath, RootRepo)
+	if err != nil || norm.Path == a.Path || entries(norm.Path) != "repo/,repo/a.txt,repo/sub/" {
+		t.Fatalf("plain repack disturbed: %v", err)
+	}
+
+	// Each prefix is cached once per archive.
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(a.Path, past, past)
+	if again, err := s.PrefixedArchive(zipPath, "vendor/repo-1.0"); err != nil || again.SHA256 != a.SHA256 {
+		t.Fatalf("second prefixed repack: %v", err)
+	}
+	if fi, _ := os.Stat(a.Path); !fi.ModTime().Equal(past) {
+		t.Fatal("prefixed repack redone for an unchanged archive")
+	}
+
+	removeArchive(zipPath)
+	left, _ := filepath.Glob(filepath.Join(dir, "main*"))
+	if len(left) != 0 {
+		t.Fatalf("repacks outlived their archive: %v", left)
+	}
+}
+
+func TestTarballArchive(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	zipPath := filepath.Join(dir, "main.zip")
+	writeTestZip(t, zipPath, "repo-aaaaaaa/", mod, []string{"", "a.txt", "run.sh", "sub/"})
+
+	cases := []struct {
+		root RootMode
+		want string
+	}{
+		{"", "repo-aaaaaaa/,repo-aaaaaaa/a.txt,repo-aaaaaaa/run.sh,repo-aaaaaaa/sub/"},
+		{RootRepo, "repo/,repo/a.txt,repo/run.sh,repo/sub/"},
+		{RootNone, "a.txt,run.sh,sub/"},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.root), func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := s.TarballArchive(&buf, zipPath, tc.root)
+			if err != nil || n != int64(buf.Len()) {
+				t.Fatalf("err=%v n=%d len=%d", err, n, buf.Len())
+			}
+			gz, err := gzip.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(gz)
+			var names []string
+			var comment string
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeXGlobalHeader {
+					comment = hdr.PAXRecords["comment"]
+					continue
+				}
+				names = append(names, hdr.Name)
+				if !hdr.ModTime.Equal(mod) {
+					t.Fatalf("%s lost its timestamp", hdr.Name)
+				}
+				switch base := path.Base(hdr.Name); {
+				case strings.HasSuffix(hdr.Name, "/"):
+					if hdr.Typeflag != tar.TypeDir {
+						t.Fatalf("%s: type %c", hdr.Name, hdr.Typeflag)
+					}
+				case base == "run.sh" && hdr.Mode != 0o700, base == "a.txt" && hdr.Mode != 0o600:
+					t.Fatalf("%s: mode %o", hdr.Name, hdr.Mode)
+				default:
+					b, _ := io.ReadAll(tr)
+					if string(b) != "content of "+strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "repo/"), "repo-aaaaaaa/") {
+						t.Fatalf("%s: content %q", hdr.Name, b)
+					}
+				}
+			}
+			if got := strings.Join(names, ","); got != tc.want {
+				t.Fatalf("tar entries %s, want %s", got, tc.want)
+			}
+			if comment != "repo-aaaaaaa/" {
+				t.Fatalf("comment %q", comment)
+			}
+		})
+	}
+}
+
+func TestBranchStatus(t *testing.T) {
+	const (
+		cachedSHA = "1111111111111111111111111111111111111111"
+		newSHA    = "2222222222222222222222222222222222222222"
+	)
+	var apiCalls int
+	remoteSHA, remoteRepo := cachedSHA, "owner/repo"
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		apiCalls++
+		body := `{"url":"https://api.github.com/repos/` + remoteRepo + `/git/refs/heads/main","object":{"sha":"` + remoteSHA + `","type":"commit"}}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	// Nothing cached: only the identity is known.
+	st, err := s.BranchStatus(ctx, "u", "owner/repo", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(st)
+	if got := string(b); got != `{"repo":"owner/repo","branch":"main","provider":"github","cached":false}` {
+		t.Fatalf("uncached status %s", got)
+	}
+
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(dir, "main.zip")
+	_ = os.WriteFile(zipPath, []byte("zip"), 0o644)
+	fetched := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := writeArchiveMeta(zipPath, &ArchiveMeta{Repo: "owner/repo", Branch: "main", CommitSHA: cachedSHA, SHA256: "sum", Size: 3, FetchedAt: fetched}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		remote    bool
+		remoteSHA string
+		repo      string
+		wantStale string // "" when omitted
+		wantCanon string
+	}{
+		{"local", false, newSHA, "owner/repo", "", ""},
+		{"up to date", true, cachedSHA, "owner/repo", "false", ""},
+		{"behind and renamed", true, newSHA, "neworg/repo2", "true", "neworg/repo2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			apiCalls, remoteSHA, remoteRepo = 0, tc.remoteSHA, tc.repo
+			st, err := s.BranchStatus(ctx, "u", "owner/repo", "main", "", tc.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.Cached || st.CommitSHA != cachedSHA || st.ShortSHA != cachedSHA[:DefaultShortSHALen] || st.SHA256 != "sum" || st.Size != 3 {
+				t.Fatalf("status %+v", st)
+			}
+			if st.FetchedAt == nil || !st.FetchedAt.Equal(fetched) || st.LastAccessed == nil {
+				t.Fatalf("times fetched=%v accessed=%v", st.FetchedAt, st.LastAccessed)
+			}
+			stale := ""
+			if st.Stale != nil {
+				stale = fmt.Sprint(*st.Stale)
+			}
+			if stale != tc.wantStale {
+				t.Fatalf("stale=%q, want %q", stale, tc.wantStale)
+			}
+			if st.CanonicalRepo != tc.wantCanon {
+				t.Fatalf("canonical_repo=%q, want %q", st.CanonicalRepo, tc.wantCanon)
+			}
+			if wantCalls := map[bool]int{false: 0, true: 1}[tc.remote]; apiCalls != wantCalls {
+				t.Fatalf("%d GitHub calls, want %d", apiCalls, wantCalls)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		h := make(http.Header)
+		body, status := "{}", http.StatusNotFound
+		switch {
+		case token == "bad":
+			status = http.StatusUnauthorized
+		case req.URL.Path == "/user":
+			body, status = `{"login":"octo"}`, http.StatusOK
+			if token == "ghp_classic" {
+				h.Set("X-OAuth-Scopes", "repo, read:org")
+			} else {
+				h.Set("GitHub-Authentication-Token-Expiration", "2099-01-02 03:04:05 UTC")
+			}
+		case req.URL.Path == "/installation/repositories":
+			body, status = `{"total_count":1}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo":
+			body, status = `{"permissions":{"pull":true,"push":false}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/commits" && token != "github_pat_metaonly":
+			body, status = `[]`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/commits":
+			status = http.StatusForbidden
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: h}, nil
+	})
+	s := New(t.TempDir())
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		token    string
+		repo     string
+		want     bool
+		kind     string
+		login    string
+		scopes   string
+		expires  bool
+		contents string // "" when not checked
+	}{
+		{"classic", "ghp_classic", "owner/repo", true, TokenClassic, "octo", "read:org,repo", false, "true"},
+		{"fine-grained", "github_pat_ok", "", true, TokenFineGrained, "octo", "", true, ""},
+		{"no contents permission", "github_pat_metaonly", "owner/repo", false, TokenFineGrained, "octo", "", true, "false"},
+		{"repo not visible", "ghp_classic", "owner/other", false, TokenClassic, "octo", "read:org,repo", false, ""},
+		{"app", "ghs_app", "owner/repo", true, TokenApp, "", "", false, "true"},
+		{"rejected", "bad", "owner/repo", false, TokenUnknown, "", "", false, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := s.ValidateToken(ctx, tc.token, tc.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := ""
+			if v.ContentsRead != nil {
+				contents = fmt.Sprint(*v.ContentsRead)
+			}
+			if v.Valid != tc.want || v.Kind != tc.kind || v.Login != tc.login || strings.Join(v.Scopes, ",") != tc.scopes || (v.ExpiresAt != nil) != tc.expires || contents != tc.contents {
+				t.Fatalf("validation %+v", v)
+			}
+			if v.Valid == (v.Problem != "") {
+				t.Fatalf("valid=%v with problem %q", v.Valid, v.Problem)
+			}
+		})
+	}
+	if _, err := s.ValidateToken(ctx, "", "owner/repo"); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("empty token: %v", err)
+	}
+}
+
+func TestOutgoingRequestHeaders(t *testing.T) {
+	type seen struct{ ua, apiVersion string }
+	var mu sync.Mutex
+	got := map[string]seen{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Header.Get("X-Test-Host")
+		if host == "" {
+			host = "package"
+		}
+		mu.Lock()
+		got[host] = seen{r.Header.Get("User-Agent"), r.Header.Get("X-GitHub-Api-Version")}
+		mu.Unlock()
+		if host == "api.github.com" {
+			_, _ = io.WriteString(w, `{"commit":{"sha":"abc123"}}`)
+			return
+		}
+		_, _ = io.WriteString(w, "payload")
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	// Send GitHub hosts to the test server, remembering where they were going.
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		if req.URL.Host != target.Host {
+			req.Header.Set("X-Test-Host", req.URL.Host)
+			req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	for _, ua := range []string{"", "acme-mirror/1.0"} {
+		s := New(t.TempDir())
+		s.HTTPClient = &http.Client{Transport: rt}
+		s.UserAgent = ua
+		ctx := context.Background()
+		got = map[string]seen{}
+		if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.EnsurePackage(ctx, "u", ts.URL+"/pkg.tgz"); err != nil {
+			t.Fatal(err)
+		}
+		wantUA := ua
+		if wantUA == "" {
+			wantUA = "github-hub/" + version.Version
+		}
+		want := map[string]seen{
+			"api.github.com":      {wantUA, GitHubAPIVersion},
+			"codeload.github.com": {wantUA, ""},
+			"package":             {wantUA, ""},
+		}
+		for host, w := range want {
+			if got[host] != w {
+				t.Fatalf("UserAgent=%q: %s saw %+v, want %+v", ua, host, got[host], w)
+			}
+		}
+	}
+}
+
+func TestLookupsCollapseConcurrentCalls(t *testing.T) {
+	const callers = 50
+	var calls atomic.Int32
+	release := make(chan struct{})
+	status := http.StatusOK
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		<-release
+		body := `{"ref":"refs/heads/main","object":{"sha":"abc123","type":"commit"}}`
+		if req.URL.Path == "/repos/owner/repo" {
+			body = `{"default_branch":"trunk"}`
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+
+	cases := []struct {
+		name    string
+		status  int
+		lookup  func(s *Storage) (string, error)
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{"branch sha", http.StatusOK, func(s *Storage) (string, error) {
+			return s.fetchBranchSHA(context.Background(), "owner/repo", "main", "")
+		}, "branch-sha|owner/repo|main|" + tokenKey(""), "abc123", false},
+		{"default branch", http.StatusOK, func(s *Storage) (string, error) {
+			return s.fetchDefaultBranch(context.Background(), "owner/repo", "")
+		}, "default-branch|" + defaultBranchKey("owner/repo", ""), "trunk", false},
+		{"error reaches every caller", http.StatusInternalServerError, func(s *Storage) (string, error) {
+			return s.fetchBranchSHA(context.Background(), "owner/repo", "main", "")
+		}, "branch-sha|owner/repo|main|" + tokenKey(""), "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.HTTPClient = &http.Client{Transport: rt}
+			calls.Store(0)
+			status = tc.status
+			release = make(chan struct{})
+
+			type result struct {
+				val string
+				err error
+			}
+			results := make(chan result, callers)
+			for i := 0; i < callers; i++ {
+				go func() {
+					v, err := tc.lookup(s)
+					results <- result{v, err}
+				}()
+			}
+			// Let the call go once every other caller is waiting on it.
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				s.flights.mu.Lock()
+				c := s.flights.calls[tc.key]
+				waiting := c != nil && c.dups == callers-1
+				s.flights.mu.Unlock()
+				if waiting {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("callers never joined one in-flight call")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			for i := 0; i < callers; i++ {
+				r := <-results
+				if r.val != tc.want || (r.err != nil) != tc.wantErr {
+					t.Fatalf("caller got %q, %v", r.val, r.err)
+				}
+			}
+			if n := calls.Load(); n != 1 {
+				t.Fatalf("%d GitHub calls, want 1", n)
+			}
+			if got := s.Counters().CollapsedLookups; got != callers-1 {
+				t.Fatalf("collapsed lookups = %d, want %d", got, callers-1)
+			}
+		})
+	}
+}
+
+// cancelingBody serves data and cancels the request's context once it has
+// handed out after bytes (or at EOF when after is negative).
+type cancelingBody struct {
+	r      io.Reader
+	after  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Read(p []byte) (int, error) {
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	n, err := b.r.Read(p)
+	b.read += n
+	if (b.after >= 0 && b.read >= b.after) || (b.after < 0 && err == io.EOF) {
+		b.cancel()
+	}
+	return n, err
+}
+
+func (b *cancelingBody) Close() error { return nil }
+
+func TestEnsureRepoLegacy_CancelledDownloadLeavesCache(t *testing.T) {
+	cases := []struct {
+		name  string
+		after int
+	}{
+		{"mid download", 4096},
+		{"after the last byte", -1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := New(root)
+			s.RetryMax = 0
+			sha, body, downloads := "aaaaaaa1", "zip-v1", 0
+			s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+			zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Dir(zipPath)
+			readDir := func() map[string]string {
+				files := map[string]string{}
+				entries, _ := os.ReadDir(dir)
+				for _, e := range entries {
+					b, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+					files[e.Name()] = string(b)
+				}
+				return files
+			}
+			before := readDir()
+
+			// The branch moves; its new archive arrives slowly and the caller
+			// gives up.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			large := strings.Repeat("x", 64<<10)
+			s.DebugSlowReader = 200 * time.Millisecond
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host == "api.github.com" {
+					return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"commit":{"sha":"bbbbbbb2"}}`)), Header: make(http.Header)}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, ContentLength: int64(len(large)), Body: &cancelingBody{r: strings.NewReader(large), after: tc.after, cancel: cancel}, Header: make(http.Header)}, nil
+			})}
+			if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want context.Canceled", err)
+			}
+			after := readDir()
+			if len(after) != len(before) {
+				t.Fatalf("files changed: before %d, after %d", len(before), len(after))
+			}
+			for name, content := range before {
+				if after[name] != content {
+					t.Fatalf("%s changed after a cancelled download", name)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		dryRun  bool
+		want    []string
+		wantErr error
+	}{
+		{"dry run", "users/*/repos/acme/app/feature-*.zip", true, []string{"users/alice/repos/acme/app/feature-a.zip", "users/bob/repos/acme/app/feature-b.zip"}, nil},
+		{"delete", "users/*/repos/acme/app/feature-*.zip", false, []string{"users/alice/repos/acme/app/feature-a.zip", "users/bob/repos/acme/app/feature-b.zip"}, nil},
+		{"sidecars are not matched", "users/alice/repos/acme/app/*.txt", false, []string{}, nil},
+		{"outside users", "git-cache/*", true, nil, ErrBadPath},
+		{"dot dot", "users/alice/../../*", true, nil, ErrBadPath},
+		{"absolute", "/users/*", true, nil, ErrBadPath},
+		{"malformed", "users/alice/[", true, nil, ErrBadPath},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := New(root)
+			s.CompressArchives = true
+			files := map[string]string{
+				"users/alice/repos/acme/app/feature-a.zip":        "a",
+				"users/alice/repos/acme/app/feature-a.commit.txt": "sha",
+				"users/alice/repos/acme/app/feature-a.zip.meta":   "{}",
+				"users/alice/repos/acme/app/main.zip":             "main",
+				"users/bob/repos/acme/app/feature-b.zip":          "b",
+			}
+			for rel, body := range files {
+				p := filepath.Join(root, filepath.FromSlash(rel))
+				if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// bob's archive is stored compressed and still matches by .zip.
+			bob := filepath.Join(root, "users/bob/repos/acme/app/feature-b.zip")
+			if err := s.installArchive(bob, bob); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := s.DeleteMatching(tc.pattern, tc.dryRun)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for _, e := range res.Matched {
+				got = append(got, e.Path)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("matched %v, want %v", got, tc.want)
+			}
+			if tc.dryRun != (res.Deleted == 0) && len(tc.want) > 0 {
+				t.Fatalf("deleted = %d with dryRun=%t", res.Deleted, tc.dryRun)
+			}
+			_, aErr := os.Stat(filepath.Join(root, "users/alice/repos/acme/app/feature-a.commit.txt"))
+			if deleted := !tc.dryRun && len(tc.want) > 0; os.IsNotExist(aErr) != deleted || ArchiveExists(bob) == deleted {
+				t.Fatalf("after delete: sidecar err=%v, bob cached=%t", aErr, ArchiveExists(bob))
+			}
+			if _, err := os.Stat(filepath.Join(root, "users/alice/repos/acme/app/main.zip")); err != nil {
+				t.Fatalf("main.zip: %v", err)
+			}
+			if !tc.dryRun && len(tc.want) > 0 {
+				if _, err := os.Stat(filepath.Dir(bob)); !os.IsNotExist(err) {
+					t.Fatalf("empty repo dir left behind: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSharedLayout(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	sha, body, downloads := "aaaaaaa1", "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	// An archive cached before the switch is left alone.
+	old, err := s.EnsureRepo(ctx, "alice", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Layout = LayoutShared
+	var paths []string
+	for _, user := range []string{"alice", "bob"} {
+		p, err := s.EnsureRepo(ctx, user, "owner/repo", "main", "", false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	if paths[0] != paths[1] || downloads != 2 {
+		t.Fatalf("paths %v after %d downloads, want one shared archive", paths, downloads)
+	}
+	if want := filepath.Join(root, "shared", "repos", "owner", "repo", "main.legacy.zip"); paths[0] != want {
+		t.Fatalf("path = %s, want %s", paths[0], want)
+	}
+	if meta, err := readArchiveMeta(old); err != nil || !ArchiveExists(old) {
+		t.Fatalf("per-user archive damaged: %v %v", meta, err)
+	}
+
+	// Retention counts the shared tree once, not per user.
+	s.Retention = RetentionPolicy{MaxArchives: 1}
+	if _, err := s.EnsureRepo(ctx, "bob", "owner/repo", "dev", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Cleanup(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Retention) != 1 || !strings.HasPrefix(report.Retention[0], "shared/repos/owner/repo/") {
+		t.Fatalf("retention report = %+v", report)
+	}
+
+	// Expiry covers both layouts and trims the shared tree.
+	if _, err := s.Cleanup(-time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ArchiveExists(old) {
+		t.Fatal("per-user archive not expired")
+	}
+	if _, err := os.Stat(filepath.Join(root, "shared", "repos")); !os.IsNotExist(err) {
+		t.Fatalf("shared tree not trimmed: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("root removed: %v", err)
+	}
+}
+
+func TestEnsureRepoLegacy_UpstreamNotFound(t *testing.T) {
+	var mu sync.Mutex
+	codeload := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test-Host") == "codeload.github.com" {
+			mu.Lock()
+			codeload++
+			mu.Unlock()
+			http.Error(w, "404: Not Found", http.StatusNotFound)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/owner/repo":
+			_, _ = io.WriteString(w, `{"default_branch":"main"}`)
+		case "/repos/owner/repo/branches/racy":
+			_, _ = io.WriteString(w, `{"commit":{"sha":"abc123"}}`)
+		case "/repos/owner/repo/branches/nope":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"Branch not found"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"Not Found"}`)
+		}
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Test-Host", req.URL.Host)
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	cases := []struct {
+		name         string
+		repo, branch string
+		token        string
+		want         error
+		wantMsg      string
+		wantCodeload int
+	}{
+		{"default branch of missing repo", "owner/missing", "", "", ErrRepoNotFound, "no token sent", 0},
+		{"default branch with token", "owner/missing", "", "ghp_x", ErrRepoNotFound, "or token lacks access", 0},
+		{"branch of missing repo", "owner/missing", "main", "", ErrRepoNotFound, "owner/missing", 0},
+		{"missing branch", "owner/repo", "nope", "", ErrBranchNotFound, "owner/repo@nope", 0},
+		// The branch resolves but codeload never serves it: retried, then
+		// asked by name, and reported as upstream trouble, not a 404.
+		{"archive never served by codeload", "owner/repo", "racy", "", ErrArchiveUnavailable, "owner/repo@racy", 1 + archiveLagRetries + 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := New(root)
+			s.HTTPClient = &http.Client{Transport: rt}
+			s.RetryMax = 2
+			s.ArchiveLagBackoff = time.Millisecond
+			codeload = 0
+			_, err := s.EnsureRepo(context.Background(), "u", tc.repo, tc.branch, tc.token, false, true)
+			var nf *NotFoundError
+			if !errors.Is(err, tc.want) || (errors.As(err, &nf) == errors.Is(err, ErrArchiveUnavailable)) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.wantMsg) {
+				t.Fatalf("err = %q, want it to mention %q", err, tc.wantMsg)
+			}
+			if codeload != tc.wantCodeload {
+				t.Fatalf("codeload called %d times, want %d", codeload, tc.wantCodeload)
+			}
+			if _, err := os.Stat(filepath.Join(root, "users", "u", "repos", tc.repo)); err == nil {
+				if entries, _ := os.ReadDir(filepath.Join(root, "users", "u", "repos", tc.repo)); len(entries) != 0 {
+					t.Fatalf("left files behind: %v", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestTempDir_DownloadsMoveAcrossFilesystems(t *testing.T) {
+	root, tmp := t.TempDir(), t.TempDir()
+	s := New(root)
+	s.TempDir = tmp
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	// Renames between TempDir and the cache cross "devices".
+	s.rename = func(oldpath, newpath string) error {
+		if strings.HasPrefix(oldpath, tmp) != strings.HasPrefix(newpath, tmp) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	sha, body, downloads := "abc123", "zip-v1", 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+
+	zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(zipPath); err != nil || string(data) != body {
+		t.Fatalf("archive %q, err %v", data, err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Fatalf("temp dir not empty: %v", entries)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(zipPath))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tempPrefix) {
+			t.Fatalf("temp file left in cache: %s", e.Name())
+		}
+	}
+
+	// Cleanup removes old temp files in both places and nothing else.
+	for _, p := range []string{
+		filepath.Join(filepath.Dir(zipPath), ".tmp-download-1.zip"),
+		filepath.Join(tmp, ".tmp-download-2"),
+		filepath.Join(tmp, "other.txt"),
+	} {
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(2 * orphanTempAge)
+	fresh := filepath.Join(tmp, ".tmp-download-3")
+	if err := os.WriteFile(fresh, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.touch(fresh)
+	report, err := s.Cleanup(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"users/u/repos/owner/repo/.tmp-download-1.zip", filepath.Join(tmp, ".tmp-download-2")}
+	if fmt.Sprint(report.Temp) != fmt.Sprint(want) {
+		t.Fatalf("removed %v, want %v", report.Temp, want)
+	}
+	for _, p := range []string{zipPath, fresh, filepath.Join(tmp, "other.txt")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s should remain: %v", p, err)
+		}
+	}
+
+	if _, ok := freeBytes(tmp); ok {
+		if err := s.checkSpace(tmp, 1<<62); !errors.Is(err, ErrInsufficientSpace) {
+			t.Fatalf("checkSpace = %v, want ErrInsufficientSpace", err)
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestEnsureRepoLegacy_InsufficientSpace(t *testing.T) {
+	const free = 1 << 20
+	big := strings.Repeat("x", 2*spaceCheckEvery)
+	cases := []struct {
+		name    string
+		length  int64 // Content-Length of the download; -1 = unknown
+		body    string
+		cleanup bool
+		wantErr bool
+	}{
+		{"known length too large", 2 * free, "zip-v2", false, true},
+		{"known length fits", 100, "zip-v2", false, false},
+		{"unknown length outgrows reserve", -1, big, false, true},
+		{"emergency cleanup makes room", 2 * free, "zip-v2", true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := New(root)
+			s.RetryMax = 2
+			s.SpaceReserve = 1024
+			s.SpaceEmergencyCleanup = tc.cleanup
+			old := filepath.Join(root, "users", "u", "repos", "owner", "other", "dev.zip")
+			if err := os.MkdirAll(filepath.Dir(old), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(old, []byte("old"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// The disk is full until the old archive is gone; while it is
+			// there, free space shrinks as the download is written.
+			var written int64
+			s.diskFree = func(string) (uint64, bool) {
+				if _, err := os.Stat(old); err != nil {
+					return 1 << 40, true
+				}
+				return uint64(max(free-atomic.LoadInt64(&written), 0)), true
+			}
+			downloads := 0
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host == "api.github.com" {
+					return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"commit":{"sha":"abc123"}}`)), Header: make(http.Header)}, nil
+				}
+				downloads++
+				body := io.TeeReader(strings.NewReader(tc.body), writerFunc(func(p []byte) (int, error) {
+					atomic.AddInt64(&written, int64(len(p)))
+					return len(p), nil
+				}))
+				return &http.Response{StatusCode: http.StatusOK, ContentLength: tc.length, Body: io.NopCloser(body), Header: make(http.Header)}, nil
+			})}
+
+			zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+			if tc.wantErr {
+				var se *SpaceError
+				if !errors.Is(err, ErrInsufficientSpace) || !errors.As(err, &se) {
+					t.Fatalf("err = %v, want ErrInsufficientSpace", err)
+				}
+				if downloads != 1 {
+					t.Fatalf("downloads = %d, want 1 (no retries)", downloads)
+				}
+				entries, _ := os.ReadDir(filepath.Join(root, "users", "u", "repos", "owner", "repo"))
+				for _, e := range entries {
+					if strings.HasPrefix(e.Name(), tempPrefix) {
+						t.Fatalf("temp file left: %s", e.Name())
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(zipPath); string(data) != tc.body {
+				t.Fatalf("archive %q", data)
+			}
+			if _, err := os.Stat(old); tc.cleanup != os.IsNotExist(err) {
+				t.Fatalf("old archive evicted = %v, want %v", os.IsNotExist(err), tc.cleanup)
+			}
+		})
+	}
+}
+
+func TestEnsureRepoLegacy_EmptyRepo(t *testing.T) {
+	var calls, codeload atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test-Host") == "codeload.github.com" {
+			codeload.Add(1)
+			http.Error(w, "404: Not Found", http.StatusNotFound)
+			return
+		}
+		calls.Add(1)
+		switch {
+		case r.URL.Path == "/repos/owner/new":
+			_, _ = io.WriteString(w, `{"default_branch":"main","size":0}`)
+		case strings.HasPrefix(r.URL.Path, "/repos/owner/new/branches/"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"Branch not found"}`)
+		default:
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, `{"message":"Git Repository is empty."}`)
+		}
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	s := New(t.TempDir())
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Test-Host", req.URL.Host)
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	ctx := context.Background()
+
+	cases := []struct {
+		name      string
+		advance   time.Duration
+		force     bool
+		wantCalls bool // GitHub asked again
+	}{
+		{"first request asks GitHub", 0, false, true},
+		{"negative cache answers", time.Second, false, false},
+		{"force bypasses the cache", 0, true, true},
+		{"cache expires", 2 * s.EmptyRepoTTL, false, true},
+	}
+	for _, tc := range cases {
+		clock.Advance(tc.advance)
+		before := calls.Load()
+		_, err := s.EnsureRepo(ctx, "u", "owner/new", "", "", tc.force, true)
+		if !errors.Is(err, ErrEmptyRepo) || !strings.Contains(err.Error(), "owner/new") {
+			t.Fatalf("%s: err = %v, want ErrEmptyRepo", tc.name, err)
+		}
+		if asked := calls.Load() > before; asked != tc.wantCalls {
+			t.Fatalf("%s: asked GitHub = %v, want %v", tc.name, asked, tc.wantCalls)
+		}
+	}
+	if n := codeload.Load(); n != 0 {
+		t.Fatalf("codeload called %d times for an empty repo", n)
+	}
+}
+
+func TestEnsureRepoLegacy_DownloadsResolvedSHA(t *testing.T) {
+	cases := []struct {
+		name     string
+		gone     string // commit codeload no longer serves
+		wantSHA  string
+		wantBody string
+		wantZips []string
+	}{
+		// The branch moves right after it is resolved; the archive still
+		// matches the commit that was recorded.
+		{"branch advances mid download", "", "aaa111", "zip-aaa111", []string{"aaa111"}},
+		// The resolved commit was force-pushed away: resolve again once.
+		{"commit force-pushed away", "aaa111", "bbb222", "zip-bbb222", []string{"aaa111", "bbb222"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			head := "aaa111"
+			var zips []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Header.Get("X-Test-Host") == "codeload.github.com" {
+					ref := path.Base(r.URL.Path)
+					zips = append(zips, ref)
+					if ref == "main" {
+						ref = head
+					}
+					if ref == tc.gone {
+						http.Error(w, "404: Not Found", http.StatusNotFound)
+						return
+					}
+					_, _ = io.WriteString(w, "zip-"+ref)
+					return
+				}
+				if r.URL.Path == "/repos/owner/repo" {
+					_, _ = io.WriteString(w, `{"full_name":"owner/repo","default_branch":"main"}`)
+					return
+				}
+				// Every lookup sees the current head, then a push lands.
+				_, _ = io.WriteString(w, `{"ref":"refs/heads/main","object":{"sha":"`+head+`"}}`)
+				head = "bbb222"
+			}))
+			defer ts.Close()
+			target, _ := url.Parse(ts.URL)
+			s := New(t.TempDir())
+			s.RetryMax = 0
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req = req.Clone(req.Context())
+				req.Header.Set("X-Test-Host", req.URL.Host)
+				req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+				return http.DefaultTransport.RoundTrip(req)
+			})}
+
+			zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := os.ReadFile(zipPath)
+			meta, err := s.ReadArchiveMeta(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.wantBody || meta.CommitSHA != tc.wantSHA {
+				t.Fatalf("archive %q recorded as %s, want %q as %s", data, meta.CommitSHA, tc.wantBody, tc.wantSHA)
+			}
+			if fmt.Sprint(zips) != fmt.Sprint(tc.wantZips) {
+				t.Fatalf("codeload fetched %v, want %v", zips, tc.wantZips)
+			}
+		})
+	}
+}
+
+func TestEnsureRepoLegacy_ArchiveLag(t *testing.T) {
+	head := strings.Repeat("a", 40)
+	moved := strings.Repeat("b", 40)
+	var byName bytes.Buffer
+	zw := zip.NewWriter(&byName)
+	_ = zw.SetComment(moved)
+	_ = zw.Close()
+
+	cases := []struct {
+		name      string
+		shaMisses int  // 404s for the commit URL before it is served
+		nameOK    bool // codeload serves the branch name
+		wantSHA   string
+		wantURLs  []string
+		wantErr   bool
+	}{
+		{"branch url 404s, commit url served", 0, false, head, []string{head}, false},
+		{"commit served after a retry", 2, false, head, []string{head, head, head}, false},
+		{"commit never served, branch name is", 100, true, moved, []string{head, head, head, head, "new-branch"}, false},
+		{"nothing served", 100, false, "", []string{head, head, head, head, "new-branch"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var zips []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Header.Get("X-Test-Host") != "codeload.github.com" {
+					_, _ = io.WriteString(w, `{"ref":"refs/heads/new-branch","object":{"sha":"`+head+`"}}`)
+					return
+				}
+				ref := path.Base(r.URL.Path)
+				zips = append(zips, ref)
+				switch {
+				case ref == head && len(zips) > tc.shaMisses:
+					_, _ = io.WriteString(w, "zip-"+ref)
+				case ref == "new-branch" && tc.nameOK:
+					_, _ = w.Write(byName.Bytes())
+				default:
+					http.Error(w, "404: Not Found", http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+			target, _ := url.Parse(ts.URL)
+			s := New(t.TempDir())
+			s.RetryMax = 0
+			s.ArchiveLagBackoff = time.Millisecond
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req = req.Clone(req.Context())
+				req.Header.Set("X-Test-Host", req.URL.Host)
+				req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+				return http.DefaultTransport.RoundTrip(req)
+			})}
+
+			zipPath, err := s.EnsureRepo(context.Background(), "u", "owner/repo", "new-branch", "", false, true)
+			if fmt.Sprint(zips) != fmt.Sprint(tc.wantURLs) {
+				t.Fatalf("codeload asked for %v, want %v", zips, tc.wantURLs)
+			}
+			if tc.wantErr {
+				var ae *ArchiveUnavailableError
+				if !errors.As(err, &ae) || !errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrBranchNotFound) {
+					t.Fatalf("err = %v, want *ArchiveUnavailableError", err)
+				}
+				want := []string{"https://codeload.github.com/owner/repo/zip/" + head, "https://codeload.github.com/owner/repo/zip/new-branch"}
+				if fmt.Sprint(ae.URLs) != fmt.Sprint(want) || ae.SHA != head {
+					t.Fatalf("error %+v, want URLs %v", ae, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := s.ReadArchiveMeta(zipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.CommitSHA != tc.wantSHA {
+				t.Fatalf("recorded %s, want %s", meta.CommitSHA, tc.wantSHA)
+			}
+		})
+	}
+}
+
+func TestRevalidate_RecentBranches(t *testing.T) {
+	var mu sync.Mutex
+	head := "aaa111"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-Test-Host") == "codeload.github.com" {
+			_, _ = io.WriteString(w, "zip-"+path.Base(r.URL.Path))
+			return
+		}
+		_, _ = io.WriteString(w, `{"commit":{"sha":"`+head+`"}}`)
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	clock := testutil.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := New(t.TempDir())
+	s.Clock = clock
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Test-Host", req.URL.Host)
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "feature/x", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "old", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := clock.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldPath, idle, idle); err != nil {
+		t.Fatal(err)
+	}
+	served := clock.Now()
+
+	clock.Advance(time.Hour)
+	recent := s.RecentBranches(clock.Now().Add(-24 * time.Hour))
+	if len(recent) != 1 {
+		t.Fatalf("recent = %+v, want only the branch served within 24h", recent)
+	}
+	b := recent[0]
+	if b.User != "u" || b.Repo != "owner/repo" || b.Branch != "feature/x" || !b.Legacy || !b.LastAccess.Equal(served) {
+		t.Fatalf("recent branch = %+v", b)
+	}
+
+	// A request holding the branch lock is not waited for.
+	unlock := s.acquire("u", "owner/repo", "feature/x-legacy")
+	if _, err := s.Revalidate(ctx, b, ""); !errors.Is(err, ErrBusy) {
+		t.Fatalf("Revalidate on a locked branch: %v, want ErrBusy", err)
+	}
+	unlock()
+
+	before := s.Counters()
+	mu.Lock()
+	head = "bbb222"
+	mu.Unlock()
+	res, err := s.Revalidate(ctx, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Outcome != CacheMiss || res.CommitSHA != "bbb222" || res.Path != zipPath {
+		t.Fatalf("revalidate = %+v, want a fresh download of bbb222", res)
+	}
+	if fi, err := os.Stat(zipPath); err != nil || !fi.ModTime().Equal(served) {
+		t.Fatalf("archive access time moved to %v, want %v", fi.ModTime(), served)
+	}
+	res, err = s.Revalidate(ctx, b, "")
+	if err != nil || res.Outcome != CacheRevalidated {
+		t.Fatalf("second revalidate = %+v, %v", res, err)
+	}
+	if fi, _ := os.Stat(zipPath); !fi.ModTime().Equal(served) {
+		t.Fatalf("archive access time moved to %v, want %v", fi.ModTime(), served)
+	}
+	after := s.Counters()
+	if after.CacheHits != before.CacheHits || after.CacheMisses != before.CacheMisses {
+		t.Fatalf("background checks counted: before %+v after %+v", before, after)
+	}
+}
+
+// mapFetcher is a RemoteFetcher serving branches and archives from maps.
+type mapFetcher struct {
+	mu       sync.Mutex
+	def      string
+	branches map[string]string // ref -> sha
+	archives map[string]string // sha -> zip body
+	fetched  []string
+}
+
+func (f *mapFetcher) ResolveDefaultBranch(ctx context.Context, ownerRepo, token string) (string, error) {
+	return f.def, nil
+}
+
+func (f *mapFetcher) ResolveRefSHA(ctx context.Context, ownerRepo, ref, token string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sha, ok := f.branches[ref]; ok {
+		return sha, nil
+	}
+	return "", &NotFoundError{Repo: ownerRepo, Branch: ref}
+}
+
+func (f *mapFetcher) FetchArchive(ctx context.Context, ownerRepo, ref, token string) (io.ReadCloser, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetched = append(f.fetched, ref)
+	body, ok := f.archives[ref]
+	if !ok {
+		return nil, 0, &NotFoundError{Repo: ownerRepo, Branch: ref}
+	}
+	return io.NopCloser(strings.NewReader(body)), int64(len(body)), nil
+}
+
+func TestEnsureRepoLegacy_CustomFetcher(t *testing.T) {
+	f := &mapFetcher{
+		def:      "trunk",
+		branches: map[string]string{"trunk": "aaa111"},
+		archives: map[string]string{"aaa111": "zip-aaa111", "bbb222": "zip-bbb222"},
+	}
+	s := New(t.TempDir())
+	s.RetryMax = 0
+	s.Fetcher = f
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected HTTP request to %s", req.URL)
+		return nil, errors.New("no network")
+	})}
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(zipPath) != "trunk.legacy.zip" {
+		t.Fatalf("zip path = %s, want the default branch", zipPath)
+	}
+	if b, _ := os.ReadFile(zipPath); string(b) != "zip-aaa111" {
+		t.Fatalf("archive = %q", b)
+	}
+
+	// Unchanged: served from cache without fetching again.
+	res, err := s.EnsureRepoResult(ctx, "u", "owner/repo", "trunk", "", false, true)
+	if err != nil || res.Outcome != CacheRevalidated {
+		t.Fatalf("second ensure = %+v, %v", res, err)
+	}
+
+	f.mu.Lock()
+	f.branches["trunk"] = "bbb222"
+	f.mu.Unlock()
+	res, err = s.EnsureRepoResult(ctx, "u", "owner/repo", "trunk", "", false, true)
+	if err != nil || res.Outcome != CacheMiss || res.CommitSHA != "bbb222" {
+		t.Fatalf("after push = %+v, %v", res, err)
+	}
+	if fmt.Sprint(f.fetched) != "[aaa111 bbb222]" {
+		t.Fatalf("fetched %v, want one archive per commit", f.fetched)
+	}
+
+	// A ref the fetcher does not know is a missing branch, not a retry.
+	_, err = s.EnsureRepo(ctx, "u", "owner/repo", "nope", "", false, true)
+	var nf *NotFoundError
+	if !errors.As(err, &nf) || nf.Branch != "nope" || !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("missing ref: %v", err)
+	}
+}
+
+func TestCachedBranches(t *testing.T) {
+	f := &mapFetcher{
+		branches: map[string]string{"main": "aaa111", "feature/x": "ccc333", "old": "ddd444"},
+		archives: map[string]string{"aaa111": "zip-aaa111", "bbb222": "zip-bbb222", "ccc333": "zip-ccc333", "ddd444": "zip-ddd444"},
+	}
+	s := New(t.TempDir())
+	s.RetryMax = 0
+	s.Fetcher = f
+	s.KeepPrevious = 1
+	ctx := context.Background()
+
+	got, err := s.CachedBranches(ctx, "u", "owner/repo", "", true)
+	if err != nil || got == nil || len(got) != 0 {
+		t.Fatalf("nothing cached: %v, %v; want an empty list", got, err)
+	}
+	for _, b := range []string{"main", "feature/x", "old"} {
+		if _, err := s.EnsureRepo(ctx, "u", "owner/repo", b, "", false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// main moves twice: the first archive is kept as a previous one and
+	// must not be listed; then upstream moves on once more and old is
+	// deleted.
+	f.branches["main"] = "bbb222"
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	f.branches["main"] = "eee555"
+	delete(f.branches, "old")
+	fetched := len(f.fetched)
+
+	local, err := s.CachedBranches(ctx, "u", "owner/repo", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cb := range local {
+		names = append(names, cb.Branch)
+		if cb.Stale != nil || !cb.Legacy || cb.FetchedAt == nil || cb.Size == 0 {
+			t.Fatalf("local entry %+v", cb)
+		}
+	}
+	if fmt.Sprint(names) != "[feature/x main old]" {
+		t.Fatalf("branches %v", names)
+	}
+
+	remote, err := s.CachedBranches(ctx, "u", "owner/repo", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"feature/x": false, "main": true, "old": true}
+	for _, cb := range remote {
+		if cb.Stale == nil || *cb.Stale != want[cb.Branch] {
+			t.Fatalf("%s stale=%v, want %v (%+v)", cb.Branch, cb.Stale, want[cb.Branch], cb)
+		}
+	}
+	if remote[1].ShortSHA != "bbb222" || remote[2].CheckError == "" {
+		t.Fatalf("remote entries %+v", remote)
+	}
+	if len(f.fetched) != fetched {
+		t.Fatalf("listing downloaded %v", f.fetched[fetched:])
+	}
+}
+
+func TestTokenRoutes(t *testing.T) {
+	creds := map[string]string{"server": "srv", "acme": "acme-token", "public": ""}
+	routes, err := NewTokenRoutes(creds, []string{"acme=acme", "partner/tools=acme", "re:oss-.*/.*=public"}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		repo, name, token string
+	}{
+		{"acme/widget", "acme", "acme-token"},
+		{"ACME/Widget", "acme", "acme-token"},
+		{"partner/tools", "acme", "acme-token"},
+		{"partner/other", "server", "srv"},
+		{"oss-lab/lib", "public", ""},
+		{"someone/else", "server", "srv"},
+	}
+	for _, tc := range cases {
+		if name, token := routes.Resolve(tc.repo); name != tc.name || token != tc.token {
+			t.Errorf("Resolve(%q) = %q, %q; want %q, %q", tc.repo, name, token, tc.name, tc.token)
+		}
+	}
+
+	for _, bad := range [][]string{{"acme"}, {"acme=missing"}, {"=acme"}, {"re:(=acme"}} {
+		if _, err := NewTokenRoutes(creds, bad, "server"); err == nil {
+			t.Errorf("NewTokenRoutes(%q): expected an error", bad)
+		}
+	}
+	if _, err := NewTokenRoutes(creds, nil, "missing"); err == nil {
+		t.Error("expected an error for an undefined default credential")
+	}
+}
+
+func TestTokenRoutes_UsedWithoutToken(t *testing.T) {
+	var mu sync.Mutex
+	var auth []string
+	s := New(t.TempDir())
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		auth = append(auth, req.Header.Get("Authorization"))
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"default_branch":"main"}`)),
+			Request:    req,
+		}, nil
+	})}
+	routes, err := NewTokenRoutes(map[string]string{"acme": "acme-token", "anon": ""}, []string{"acme=acme"}, "anon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTokenRoutes(routes)
+	ctx := context.Background()
+
+	for _, call := range []struct{ repo, token string }{{"acme/a", ""}, {"other/b", ""}, {"acme/c", "own"}} {
+		if _, err := s.DefaultBranch(ctx, "u", call.repo, call.token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"Bearer acme-token", "", "Bearer own"}
+	if strings.Join(auth, ",") != strings.Join(want, ",") {
+		t.Fatalf("Authorization headers = %q, want %q", auth, want)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	keys, err := NewKeyRing(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(t.TempDir())
+	s.Keys = keys
+	for _, size := range []int{0, 1, sealChunk - 1, sealChunk, sealChunk + 1, 3*sealChunk + 17} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+		var buf bytes.Buffer
+		if err := seal(&buf, bytes.NewReader(plain), int64(size), keys); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(s.Root, "f")
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := s.OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: read %d bytes, err=%v", size, len(got), err)
+		}
+		if n, _ := plainSize(path); n != int64(size) {
+			t.Fatalf("size %d: plainSize = %d", size, n)
+		}
+
+		// Truncation, tampering and trailing data are all caught.
+		sealed := buf.Bytes()
+		for name, bad := range map[string][]byte{
+			"truncated": sealed[:len(sealed)-1],
+			"flipped":   append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1),
+			"trailing":  append(append([]byte{}, sealed...), 0),
+		} {
+			_ = os.WriteFile(path, bad, 0o644)
+			rc, err := s.OpenArchive(path)
+			if err == nil {
+				_, err = io.ReadAll(rc)
+				_ = rc.Close()
+			}
+			if err == nil {
+				t.Fatalf("size %d: %s file read without error", size, name)
+			}
+		}
+	}
+}
+
+func TestEncryptArchives_MigrationAndRotation(t *testing.T) {
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	s := New(t.TempDir())
+	s.KeepPrevious = 1
+	v1 := strings.Repeat("zip-v1 ", 20000)
+	sha, body, downloads := strings.Repeat("a", 40), v1, 0
+	s.HTTPClient = &http.Client{Transport: fakeGitHub(&sha, &body, &downloads)}
+	ctx := context.Background()
+
+	// A plain archive cached before encryption was turned on.
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	ring1, _ := NewKeyRing(key1)
+	s.Keys, s.CompressArchives = ring1, true
+	sha, body = strings.Repeat("b", 40), strings.Repeat("zip-v2 ", 20000)
+	res, err := s.EnsureRepoResult(ctx, "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := os.ReadFile(res.Path + zstSuffix)
+	if err != nil || bytes.Contains(onDisk, []byte("zip-v2")) {
+		t.Fatalf("archive not encrypted at rest: %v", err)
+	}
+	meta, _ := s.ReadArchiveMeta(res.Path)
+	if !res.Encrypted || !res.Compressed || meta.Encryption != EncryptionAES256GCM || meta.KeyID != KeyID(key1) ||
+		meta.StoredSize != int64(len(onDisk)) || res.Size != int64(len(body)) {
+		t.Fatalf("result %+v meta %+v", res, meta)
+	}
+	if err := s.VerifyArchive(res.Path); err != nil {
+		t.Fatalf("VerifyArchive: %v", err)
+	}
+	read := func(p string) (string, error) {
+		rc, err := s.OpenArchive(p)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = rc.Close() }()
+		b, err := io.ReadAll(rc)
+		return string(b), err
+	}
+	if got, err := read(res.Path); err != nil || got != body {
+		t.Fatalf("encrypted archive read %d bytes, err=%v", len(got), err)
+	}
+	// The plain archive it replaced is kept and still served.
+	kept, at, err := s.ArchiveAt("u", "owner/repo", "main", "aaaaaaa")
+	if err != nil || at.Encryption != "" {
+		t.Fatalf("ArchiveAt: %v %+v", err, at)
+	}
+	if got, err := read(kept); err != nil || got != v1 {
+		t.Fatalf("plain kept archive read err=%v", err)
+	}
+
+	// After a rotation the old key still decrypts; once dropped it cannot.
+	s.Keys, _ = NewKeyRing(key2, key1)
+	if got, err := read(res.Path); err != nil || got != body {
+		t.Fatalf("read after rotation: %v", err)
+	}
+	s.Keys, _ = NewKeyRing(key2)
+	if _, err := read(res.Path); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("read without the key: %v", err)
+	}
+
+	// Packages are encrypted too and read back through OpenArchive.
+	pkg, err := s.StorePackage("u", "ci/tool.bin", strings.NewReader("package body"), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgPath := filepath.Join(s.Root, "users", "u", "packages", pkg.Hash, pkg.Filename)
+	if b, _ := os.ReadFile(pkgPath); bytes.Contains(b, []byte("package body")) {
+		t.Fatal("package not encrypted at rest")
+	}
+	if got, err := read(pkgPath); err != nil || got != "package body" {
+		t.Fatalf("package read %q, err=%v", got, err)
+	}
+	looked, err := s.LookupPackage("u", pkg.URL)
+	if err != nil || looked.Encryption != EncryptionAES256GCM || looked.KeyID != KeyID(key2) || looked.Size != int64(len(mustRead(t, pkgPath))) {
+		t.Fatalf("LookupPackage: %+v, %v", looked, err)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type failingBody struct{ sent bool }
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if !b.sent {
+		b.sent = true
+		return copy(p, "PK"), nil
+	}
+	return 0, errors.New("connection reset by peer")
+}
+
+func (b *failingBody) Close() error { return nil }
+
+func TestUpstreamErrorTaxonomy(t *testing.T) {
+	status := func(code int, header ...string) func(*http.Request) (*http.Response, error) {
+		return func(*http.Request) (*http.Response, error) {
+			h := make(http.Header)
+			for i := 0; i+1 < len(header); i += 2 {
+				h.Set(header[i], header[i+1])
+			}
+			return &http.Response{StatusCode: code, Header: h, Body: io.NopCloser(strings.NewReader(`{"message":"Not Found"}`))}, nil
+		}
+	}
+	unreachable := func(*http.Request) (*http.Response, error) { return nil, errors.New("dial tcp: connection refused") }
+	truncated := func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), ContentLength: -1, Body: &failingBody{}}, nil
+	}
+	cases := []struct {
+		name string
+		rt   func(*http.Request) (*http.Response, error)
+		pkg  bool // EnsurePackage rather than a legacy EnsureRepo
+		want error
+	}{
+		{"github down", status(http.StatusServiceUnavailable), false, ErrUpstreamUnavailable},
+		{"github unreachable", unreachable, false, ErrUpstreamUnavailable},
+		{"bad credentials", status(http.StatusUnauthorized), false, ErrUnauthorizedUpstream},
+		{"forbidden", status(http.StatusForbidden), false, ErrUnauthorizedUpstream},
+		{"rate limited", status(http.StatusForbidden, "X-RateLimit-Remaining", "0"), false, ErrRateLimited},
+		{"repo missing", status(http.StatusNotFound), false, ErrRepoNotFound},
+		{"package missing", status(http.StatusNotFound), true, ErrNotFound},
+		{"package host down", status(http.StatusBadGateway), true, ErrUpstreamUnavailable},
+		{"package refused", status(http.StatusUnauthorized), true, ErrUnauthorizedUpstream},
+		{"package cut off", truncated, true, ErrUpstreamUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(tc.rt)}
+			s.RetryMax = -1
+			var err error
+			if tc.pkg {
+				_, err = s.EnsurePackage(context.Background(), "u", "https://example.com/pkg.tgz")
+			} else {
+				_, err = s.EnsureRepo(context.Background(), "u", "owner/repo", "main", "", false, true)
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+			var rle *RateLimitError
+			if errors.Is(err, ErrRateLimited) != errors.As(err, &rle) {
+				t.Fatalf("rate limit without a RateLimitError: %v", err)
+			}
+		})
+	}
+
+	// git has only its stderr to say why a fetch failed.
+	gitCases := []struct {
+		stderr string
+		want   error
+	}{
+		{"remote: Repository not found.\nfatal: repository 'https://github.com/o/r.git/' not found", ErrRepoNotFound},
+		{"fatal: Authentication failed for 'https://github.com/o/r.git/'", ErrUnauthorizedUpstream},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", ErrUnauthorizedUpstream},
+		{"fatal: unable to access 'https://github.com/o/r.git/': Could not resolve host: github.com", ErrUpstreamUnavailable},
+	}
+	for _, tc := range gitCases {
+		if err := gitFailure("git fetch", "o/r", "", []byte(tc.stderr), errors.New("exit status 128")); !errors.Is(err, tc.want) {
+			t.Errorf("%q: err = %v, want %v", tc.stderr, err, tc.want)
+		}
+	}
+}
+
+// countingBody is an endless error page that counts what was read of it.
+type countingBody struct{ n int }
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = "<html> oops\n"[(b.n+i)%12]
+	}
+	b.n += len(p)
+	return len(p), nil
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestUpstreamStatusError(t *testing.T) {
+	const ghJSON = `{"message":"Server Error","documentation_url":"https://docs.github.com/rest"}`
+	calls := []struct {
+		name string
+		call func(s *Storage, dir string) error
+	}{
+		{"downloadZip", func(s *Storage, dir string) error {
+			return s.downloadZip(context.Background(), "owner/repo", "main", "", filepath.Join(dir, "main.zip"))
+		}},
+		{"downloadFile", func(s *Storage, dir string) error {
+			_, err := s.downloadFile(context.Background(), "u", "https://example.com/pkg.tgz", filepath.Join(dir, "pkg.tgz"))
+			return err
+		}},
+		{"fetchDefaultBranch", func(s *Storage, dir string) error {
+			_, err := s.fetchDefaultBranchRemote(context.Background(), "owner/repo", "")
+			return err
+		}},
+		{"fetchBranchSHA", func(s *Storage, dir string) error {
+			_, err := s.fetchBranchSHARemote(context.Background(), "owner/repo", "main", "")
+			return err
+		}},
+	}
+	for _, c := range calls {
+		t.Run(c.name+"/json", func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = -1
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusInternalServerError, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(ghJSON))}, nil
+			})}
+			err := c.call(s, t.TempDir())
+			var se *StatusError
+			if !errors.As(err, &se) || !errors.Is(err, ErrUpstreamUnavailable) {
+				t.Fatalf("err = %v, want a StatusError", err)
+			}
+			if se.Status != 500 || se.Message != "Server Error" || se.DocumentationURL != "https://docs.github.com/rest" || se.Snippet != "" {
+				t.Fatalf("fields %+v", se)
+			}
+			if !strings.Contains(err.Error(), `message="Server Error" documentation_url=https://docs.github.com/rest`) {
+				t.Fatalf("message %q", err)
+			}
+		})
+		t.Run(c.name+"/truncated", func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = -1
+			body := &countingBody{}
+			s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusBadGateway, Header: make(http.Header), Body: body}, nil
+			})}
+			err := c.call(s, t.TempDir())
+			var se *StatusError
+			if !errors.As(err, &se) {
+				t.Fatalf("err = %v, want a StatusError", err)
+			}
+			if body.n > 2*maxErrorBody {
+				t.Fatalf("read %d bytes of the error body", body.n)
+			}
+			if !strings.HasSuffix(se.Snippet, truncatedMarker) || len(se.Snippet) > maxErrorBody+len(truncatedMarker) || strings.Contains(se.Snippet, "\n") {
+				t.Fatalf("snippet of %d bytes: %.80q", len(se.Snippet), se.Snippet)
+			}
+			if !strings.HasPrefix(se.Snippet, "<html> oops <html>") || se.Message != "" {
+				t.Fatalf("fields %+v", se)
+			}
+		})
+	}
+}
+
+func TestAPICallGuards(t *testing.T) {
+	stop := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"default_branch":"`)
+		w.(http.Flusher).Flush()
+		if r.Header.Get("X-Test-Mode") == "stalled" {
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+			return
+		}
+		chunk := strings.Repeat("a", 32<<10)
+		for {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+	defer close(stop)
+	target, _ := url.Parse(ts.URL)
+
+	calls := []struct {
+		name string
+		call func(s *Storage) error
+	}{
+		{"fetchDefaultBranch", func(s *Storage) error {
+			_, err := s.fetchDefaultBranchRemote(context.Background(), "owner/repo", "")
+			return err
+		}},
+		{"fetchBranchSHA", func(s *Storage) error {
+			_, err := s.fetchBranchSHARemote(context.Background(), "owner/repo", "main", "")
+			return err
+		}},
+		{"getGitHubJSON", func(s *Storage) error {
+			var out map[string]any
+			_, err := s.getGitHubJSON(context.Background(), "https://api.github.com/repos/owner/repo/pulls/1", "", &out)
+			return err
+		}},
+	}
+	for _, mode := range []string{"endless", "stalled"} {
+		for _, c := range calls {
+			t.Run(mode+"/"+c.name, func(t *testing.T) {
+				s := New(t.TempDir())
+				s.RetryMax = -1
+				s.APICallTimeout = 200 * time.Millisecond
+				if mode == "endless" {
+					// The size cap alone must end the call.
+					s.APICallTimeout = -1
+				}
+				s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					req = req.Clone(req.Context())
+					req.Header.Set("X-Test-Mode", mode)
+					req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+					return http.DefaultTransport.RoundTrip(req)
+				})}
+				start := time.Now()
+				err := c.call(s)
+				if took := time.Since(start); took > 5*time.Second {
+					t.Fatalf("call took %s", took)
+				}
+				if !errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("err = %v, want ErrUpstreamUnavailable", err)
+				}
+				var tooLarge *APIResponseTooLargeError
+				if errors.As(err, &tooLarge) != (mode == "endless") {
+					t.Fatalf("err = %v (mode %s)", err, mode)
+				}
+				if mode == "endless" && (tooLarge.Limit != maxAPIBody || !errors.Is(err, ErrAPIResponseTooLarge)) {
+					t.Fatalf("too large error %+v", tooLarge)
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveSigning(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	zipPath := filepath.Join(root, "main.zip")
+	if err := os.WriteFile(zipPath, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.recordArchive(zipPath, "owner/repo", "main", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ArchiveSignature(zipPath); !errors.Is(err, ErrSigningDisabled) {
+		t.Fatalf("unsigned: %v, want ErrSigningDisabled", err)
+	}
+
+	_, oldKey, _ := ed25519.GenerateKey(nil)
+	_, newKey, _ := ed25519.GenerateKey(nil)
+	dir := t.TempDir()
+	der, _ := x509.MarshalPKCS8PrivateKey(oldKey)
+	oldFile := filepath.Join(dir, "old.pem")
+	if err := os.WriteFile(oldFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadSigningKeys(oldFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Signer = keys
+	meta, err := s.recordArchive(zipPath, "owner/repo", "main", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := s.Signer.KeyID()
+	if meta.SignatureKeyID != oldID || !s.Signer.Verify(oldID, meta.SHA256, meta.Signature) {
+		t.Fatalf("recorded meta %+v", meta)
+	}
+	digest, _ := hex.DecodeString(meta.SHA256)
+	sig, _ := base64.StdEncoding.DecodeString(meta.Signature)
+	if !ed25519.Verify(oldKey.Public().(ed25519.PublicKey), digest, sig) {
+		t.Fatal("signature does not verify against the raw digest")
+	}
+
+	// Rotation: the new key is a hex seed and the old one is only
+	// published, as a PEM public key.
+	pubDER, _ := x509.MarshalPKIXPublicKey(oldKey.Public())
+	pubFile := filepath.Join(dir, "old.pub.pem")
+	newFile := filepath.Join(dir, "new.key")
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newFile, []byte(hex.EncodeToString(newKey.Seed())+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if s.Signer, err = LoadSigningKeys(newFile, pubFile); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ArchiveSignature(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyID == oldID || got.KeyID != s.Signer.KeyID() || !s.Signer.Verify(got.KeyID, got.SHA256, got.Signature) {
+		t.Fatalf("after rotation %+v", got)
+	}
+	if !s.Signer.Verify(oldID, meta.SHA256, meta.Signature) {
+		t.Fatal("old signature no longer verifies")
+	}
+	pubs := s.Signer.PublicKeys()
+	if len(pubs) != 2 || !pubs[0].Current || pubs[0].KeyID != got.KeyID || pubs[1].KeyID != oldID || pubs[1].Current {
+		t.Fatalf("public keys %+v", pubs)
+	}
+	if _, err := LoadSigningKeys(pubFile); err == nil {
+		t.Fatal("a public key cannot be the signing key")
+	}
+}
+
+func TestTransportConnectionReuse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+
+	s := New(t.TempDir())
+	s.SetTransport(TransportOptions{MaxIdleConnsPerHost: 4, MaxConnsPerHost: 2, IdleConnTimeout: time.Minute})
+	tr := s.HTTPClient.Transport.(*connCounter).base
+	if tr.MaxIdleConnsPerHost != 4 || tr.MaxConnsPerHost != 2 || tr.IdleConnTimeout != time.Minute || !tr.ForceAttemptHTTP2 || tr.MaxIdleConns != 100 {
+		t.Fatalf("transport not tuned: idle/host=%d conns/host=%d idle=%v h2=%v idle=%d", tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.IdleConnTimeout, tr.ForceAttemptHTTP2, tr.MaxIdleConns)
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := s.httpClient().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if c := s.Counters(); c.UpstreamDials != 1 || c.UpstreamReusedConns != 2 {
+		t.Fatalf("dials=%d reused=%d, want 1 and 2", c.UpstreamDials, c.UpstreamReusedConns)
+	}
+
+	// A caller's client is left alone.
+	custom := &http.Client{}
+	s.HTTPClient = custom
+	s.SetTransport(TransportOptions{DisableHTTP2: true})
+	if s.HTTPClient != custom || custom.Transport != nil {
+		t.Fatal("SetTransport replaced a caller's client")
+	}
+}
+
+func TestImportRepoArchive(t *testing.T) {
+	const (
+		sha1 = "1111111111111111111111111111111111111111"
+		sha2 = "2222222222222222222222222222222222222222"
+	)
+	src := t.TempDir()
+	good := filepath.Join(src, "repo.zip")
+	writeTestZip(t, good, "repo-main/", time.Now(), []string{"README.md"})
+	notZip := filepath.Join(src, "bad.zip")
+	_ = os.WriteFile(notZip, []byte("not a zip"), 0o644)
+
+	root := t.TempDir()
+	s := New(root)
+	s.KeepPrevious = 1
+	// Air-gapped: every upstream call fails.
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("dial tcp: no route to host")
+	})}
+
+	for _, tt := range []struct {
+		name, sha, src string
+	}{
+		{"short sha", "1111111", good},
+		{"not a zip", sha1, notZip},
+		{"missing file", sha1, filepath.Join(src, "none.zip")},
+		{"http url", sha1, "https://example.com/repo.zip"},
+	} {
+		if _, err := s.ImportRepoArchive("u", "owner/repo", "main", tt.sha, tt.src); err == nil {
+			t.Fatalf("%s: import succeeded", tt.name)
+		} else if tt.name != "missing file" && !errors.Is(err, ErrBadPath) {
+			t.Fatalf("%s: err = %v, want ErrBadPath", tt.name, err)
+		}
+	}
+	if _, err := s.ImportRepoArchive("u", "owner/repo", "bad..ref", sha1, good); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("bad ref: err = %v", err)
+	}
+
+	meta, err := s.ImportRepoArchive("u", "owner/repo", "main", sha1, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(root, "users", "u", "repos", "owner", "repo", "main.zip")
+	if meta.CommitSHA != sha1 || meta.Repo != "owner/repo" || meta.Branch != "main" || meta.SHA256 == "" {
+		t.Fatalf("meta = %+v", meta)
+	}
+	if got, _ := readSHA(zipPath + ".meta"); got != sha1 {
+		t.Fatalf(".meta = %q", got)
+	}
+	if got, _ := readSHA(strings.TrimSuffix(zipPath, ".zip") + ".commit.txt"); got != sha1[:DefaultShortSHALen] {
+		t.Fatalf(".commit.txt = %q", got)
+	}
+	if info, err := s.ReadRepoInfo(zipPath); err != nil || info.CommitSHA != sha1 {
+		t.Fatalf("info = %+v, %v", info, err)
+	}
+	if err := s.VerifyArchive(zipPath); err != nil {
+		t.Fatalf("VerifyArchive: %v", err)
+	}
+
+	// Served from cache without reaching GitHub.
+	res, err := s.EnsureRepoResult(WithMaxAge(context.Background(), time.Hour), "u", "owner/repo", "main", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Path != zipPath || res.CommitSHA != sha1 || !res.FromCache {
+		t.Fatalf("EnsureRepoResult = %+v", res)
+	}
+
+	// A newer import from a file:// URL keeps the previous one.
+	if _, err := s.ImportRepoArchive("u", "owner/repo", "main", sha2, "file://"+filepath.ToSlash(good)); err != nil {
+		t.Fatal(err)
+	}
+	if p, _, err := s.ArchiveAt("u", "owner/repo", "main", sha1); err != nil || p == zipPath {
+		t.Fatalf("ArchiveAt(previous) = %q, %v", p, err)
+	}
+	if meta, err := s.ReadArchiveMeta(zipPath); err != nil || meta.CommitSHA != sha2 {
+		t.Fatalf("meta after re-import = %+v, %v", meta, err)
+	}
+}
+
+func TestSlowDownloadAlert(t *testing.T) {
+	const mib = 1 << 20
+	clock := testutil.NewFakeClock(time.Now())
+	var delay time.Duration
+	s := New(t.TempDir())
+	s.Clock = clock
+	s.RetryMax = 0
+	s.SlowDownloadThreshold = mib
+	s.SlowDownloadRecovery = 2
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clock.Advance(delay)
+		size := 2 * mib
+		if strings.Contains(req.URL.Path, "small") {
+			size = 1024
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(make([]byte, size))), ContentLength: int64(size), Header: make(http.Header)}, nil
+	})}
+	var observed atomic.Int32
+	s.DownloadObserver = func(DownloadRecord) { observed.Add(1) }
+
+	steps := []struct {
+		name     string
+		delay    time.Duration
+		degraded bool
+		slow     bool
+	}{
+		{"big.tgz", time.Second, false, false},    // 2 MiB/s
+		{"small.tgz", time.Minute, false, false},  // too small to judge
+		{"slow.tgz", 4 * time.Second, true, true}, // 0.5 MiB/s
+		{"ok1.tgz", time.Second, true, false},     // 1 of 2 healthy
+		{"small2.tgz", time.Second, true, false},  // not judged, not healthy either
+		{"ok2.tgz", 500 * time.Millisecond, false, false},
+	}
+	for i, st := range steps {
+		delay = st.delay
+		if _, err := s.EnsurePackage(context.Background(), "u", "https://example.com/"+st.name); err != nil {
+			t.Fatal(err)
+		}
+		rec := s.RecentDownloads()[0]
+		if rec.Kind != DownloadPackage || rec.Label != st.name || rec.Slow != st.slow || rec.Attempts != 1 || rec.Duration != st.delay {
+			t.Fatalf("step %d: record = %+v", i, rec)
+		}
+		if h := s.UpstreamHealth(); h.Degraded != st.degraded {
+			t.Fatalf("step %d (%s): health = %+v", i, st.name, h)
+		}
+	}
+	recent := s.RecentDownloads()
+	if len(recent) != len(steps) || recent[0].Label != "ok2.tgz" || recent[len(recent)-1].Label != "big.tgz" {
+		t.Fatalf("recent = %+v", recent)
+	}
+	if recent[0].BytesPerSecond != 4*mib {
+		t.Fatalf("throughput = %v", recent[0].BytesPerSecond)
+	}
+	if c := s.Counters(); c.SlowDownloads != 1 || observed.Load() != int32(len(steps)) {
+		t.Fatalf("slow=%d observed=%d", c.SlowDownloads, observed.Load())
+	}
+
+	// The ring keeps the newest recentDownloadsMax records.
+	delay = time.Second
+	for i := 0; i < recentDownloadsMax; i++ {
+		if _, err := s.EnsurePackage(context.Background(), "u", fmt.Sprintf("https://example.com/small-%d.tgz", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent = s.RecentDownloads()
+	if len(recent) != recentDownloadsMax || recent[0].Label != fmt.Sprintf("small-%d.tgz", recentDownloadsMax-1) || recent[len(recent)-1].Label != "small-0.tgz" {
+		t.Fatalf("ring: %d records, newest %q, oldest %q", len(recent), recent[0].Label, recent[len(recent)-1].Label)
+	}
+}
+
+func TestEnsureRepoPullRequest(t *testing.T) {
+	sha1, sha2 := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	head, state, branchExists := sha1, "open", true
+	var downloads []string
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, "zip-"+req.URL.Path
+		switch {
+		case req.URL.Host == "codeload.github.com":
+			downloads = append(downloads, req.URL.Path)
+		case req.URL.Path == "/repos/owner/repo/pulls/7":
+			body = `{"state":"` + state + `","head":{"ref":"feature","sha":"` + head + `","repo":{"full_name":"fork/repo"}}}`
+		case req.URL.Path == "/repos/fork/repo/branches/feature" && branchExists:
+			body = `{"commit":{"sha":"` + head + `"}}`
+		case strings.Contains(req.URL.Path, "/branches/"):
+			status, body = http.StatusNotFound, `{"message":"Branch not found"}`
+		default:
+			status, body = http.StatusNotFound, `{"message":"Not Found"}`
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: rt}
+	ctx := context.Background()
+
+	want := filepath.Join(root, "users", "u", "repos", "owner", "repo", "pr", "7.zip")
+	check := func(step, wantSHA string, wantDownloads ...string) {
+		t.Helper()
+		res, err := s.EnsureRepoResult(ctx, "u", "owner/repo", PullRef(7), "", false, false)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if res.Path != want || res.CommitSHA != wantSHA {
+			t.Fatalf("%s: got %s at %s, want %s at %s", step, res.Path, res.CommitSHA, want, wantSHA)
+		}
+		if !slices.Equal(downloads, wantDownloads) {
+			t.Fatalf("%s: downloads %v, want %v", step, downloads, wantDownloads)
+		}
+	}
+	// The head lives in the fork, so the archive comes from its codeload.
+	check("first", sha1, "/fork/repo/zip/"+sha1)
+	check("unchanged head", sha1, "/fork/repo/zip/"+sha1)
+	head = sha2
+	check("new head", sha2, "/fork/repo/zip/"+sha1, "/fork/repo/zip/"+sha2)
+
+	state, branchExists = "closed", false
+	_, err := s.EnsureRepo(ctx, "u", "owner/repo", PullRef(7), "", false, false)
+	var gone *BranchGoneError
+	if !errors.As(err, &gone) || gone.Branch != "pr/7" || gone.LastCommit != sha2 {
+		t.Fatalf("closed pull request with deleted head: err = %v, want BranchGoneError for pr/7", err)
+	}
+
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", PullRef(8), "", false, false); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("unknown pull request: err = %v, want ErrBranchNotFound", err)
+	}
+
+	for ref, wantN := range map[string]int{"pr/7": 7, "pr/0": 0, "pr/07": 0, "pr/x": 0, "pr/": 0, "feature/pr/1": 0} {
+		if n, ok := PullNumber(ref); n != wantN || ok != (wantN > 0) {
+			t.Errorf("PullNumber(%q) = %d, %v", ref, n, ok)
+		}
+	}
+}
+
+func TestEnsurePackageRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "pkg from other host")
+	}))
+	defer other.Close()
+	var hits atomic.Int32
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/hop1/pkg.zip":
+			http.Redirect(w, r, "/hop2/pkg.zip", http.StatusFound)
+		case "/hop2/pkg.zip":
+			http.Redirect(w, r, "/files/pkg.zip", http.StatusFound)
+		case "/files/pkg.zip":
+			_, _ = io.WriteString(w, "pkg")
+		case "/insecure/pkg.zip":
+			http.Redirect(w, r, other.URL+"/pkg.zip", http.StatusFound)
+		case "/metadata/pkg.zip":
+			http.Redirect(w, r, "https://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/private/pkg.zip":
+			http.Redirect(w, r, "https://10.0.0.1/pkg.zip", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+	// The test servers listen on loopback, which PublicHostCheck refuses.
+	publicButOrigin := func(ctx context.Context, u *url.URL) error {
+		if u.Host == strings.TrimPrefix(origin.URL, "https://") {
+			return nil
+		}
+		return PublicHostCheck(ctx, u)
+	}
+
+	cases := []struct {
+		name      string
+		path      string
+		policy    RedirectPolicy
+		hostCheck func(context.Context, *url.URL) error
+		wantErr   error
+		wantFinal string
+	}{
+		{"no redirect", "/files/pkg.zip", DefaultRedirectPolicy(), nil, nil, ""},
+		{"same host chain", "/hop1/pkg.zip", DefaultRedirectPolicy(), nil, nil, origin.URL + "/files/pkg.zip"},
+		{"too many hops", "/hop1/pkg.zip", RedirectPolicy{MaxHops: 1}, nil, ErrRedirectPolicy, ""},
+		{"no redirects", "/hop1/pkg.zip", RedirectPolicy{MaxHops: -1}, nil, ErrRedirectPolicy, ""},
+		{"https to http", "/insecure/pkg.zip", DefaultRedirectPolicy(), nil, ErrRedirectPolicy, ""},
+		{"scheme change allowed", "/insecure/pkg.zip", RedirectPolicy{}, nil, nil, other.URL + "/pkg.zip"},
+		{"other host", "/insecure/pkg.zip", RedirectPolicy{RequireSameHost: true}, nil, ErrRedirectPolicy, ""},
+		{"host check on hop", "/insecure/pkg.zip", RedirectPolicy{}, func(_ context.Context, u *url.URL) error {
+			if u.Host == otherHost {
+				return errors.New("internal host")
+			}
+			return nil
+		}, ErrRedirectPolicy, ""},
+		{"host check on package url", "/files/pkg.zip", DefaultRedirectPolicy(), func(context.Context, *url.URL) error {
+			return errors.New("internal host")
+		}, ErrBadPath, ""},
+		{"redirect to metadata address", "/metadata/pkg.zip", DefaultRedirectPolicy(), publicButOrigin, ErrBlockedHost, ""},
+		{"redirect to private address", "/private/pkg.zip", DefaultRedirectPolicy(), publicButOrigin, ErrBlockedHost, ""},
+		{"loopback package url", "/files/pkg.zip", DefaultRedirectPolicy(), PublicHostCheck, ErrBlockedHost, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = 3
+			s.RetryBackoff = time.Millisecond
+			s.HTTPClient = origin.Client()
+			s.Redirects = tc.policy
+			s.PackageHostCheck = tc.hostCheck
+			hits.Store(0)
+			pkgURL := origin.URL + tc.path
+			_, err := s.EnsurePackage(context.Background(), "u", pkgURL)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tc.wantErr)
+				}
+				if n := hits.Load(); n > 3 {
+					t.Fatalf("origin hit %d times; refused redirects must not be retried", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := s.LookupPackage("u", pkgURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.URL != pkgURL || meta.FinalURL != tc.wantFinal {
+				t.Fatalf("meta url=%q final=%q, want final %q", meta.URL, meta.FinalURL, tc.wantFinal)
+			}
+		})
+	}
+}
+
+func TestPublicHostCheck(t *testing.T) {
+	orig := lookupHost
+	defer func() { lookupHost = orig }()
+	lookupHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		switch host {
+		case "public.example":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.215.14")}, {IP: net.ParseIP("2606:2800:21f:cb07:6820:80da:af6b:8b2c")}}, nil
+		case "mixed.example":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.215.14")}, {IP: net.ParseIP("192.168.1.10")}}, nil
+		case "localhost":
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	cases := []struct {
+		url  string
+		want bool // allowed
+	}{
+		{"https://public.example/pkg.zip", true},
+		{"https://93.184.215.14/pkg.zip", true},
+		{"https://[2606:4700::1]/pkg.zip", true},
+		{"https://mixed.example/pkg.zip", false},
+		{"https://localhost:8080/pkg.zip", false},
+		{"https://missing.example/pkg.zip", false},
+		{"http://127.0.0.1/pkg.zip", false},
+		{"http://10.1.2.3/pkg.zip", false},
+		{"http://172.16.0.1/pkg.zip", false},
+		{"http://192.168.0.1/pkg.zip", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://0.0.0.0/pkg.zip", false},
+		{"http://224.0.0.1/pkg.zip", false},
+		{"http://[::1]/pkg.zip", false},
+		{"http://[fe80::1]/pkg.zip", false},
+		{"http://[fd00::1]/pkg.zip", false},
+		{"http://[::ffff:127.0.0.1]/pkg.zip", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tc := range cases {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = PublicHostCheck(context.Background(), u)
+		if tc.want != (err == nil) || (err != nil && !errors.Is(err, ErrBlockedHost)) {
+			t.Fatalf("%s: err = %v, want allowed=%v", tc.url, err, tc.want)
+		}
+	}
+	// The lookup runs under the caller's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := PublicHostCheck(ctx, &url.URL{Scheme: "https", Host: "public.example"}); !errors.Is(err, ErrBlockedHost) || !strings.Contains(err.Error(), "context canceled") {
+		t.Fatalf("cancelled check: err = %v", err)
+	}
+}
+
+func TestPackageHostCheckOnConnect(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "pkg")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	// The names pass when their URL is checked, as a rebinding name would,
+	// but connect to loopback.
+	check := func(ctx context.Context, u *url.URL) error {
+		if h := u.Hostname(); h == "localhost" || h == "pkgs.example" {
+			return nil
+		}
+		return PublicHostCheck(ctx, u)
+	}
+
+	s := New(t.TempDir())
+	s.RetryMax = 3
+	s.RetryBackoff = time.Millisecond
+	s.PackageHostCheck = check
+	_, err := s.EnsurePackage(context.Background(), "u", "http://localhost:"+port+"/pkg.zip")
+	if !errors.Is(err, ErrBlockedHost) || errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("err = %v, want ErrBlockedHost", err)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("blocked host served %d requests", n)
+	}
+
+	// A mirror is the operator's own host and may be internal.
+	m, err := NewPackageMirrors([]string{"pkgs.example=" + srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPackageMirrors(m)
+	if _, err := s.EnsurePackage(context.Background(), "u", "https://pkgs.example/pkg.zip"); err != nil {
+		t.Fatalf("mirror download: %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("mirror served %d requests, want 1", n)
+	}
+}
+
+func TestPackageMirrorsRewrite(t *testing.T) {
+	m, err := NewPackageMirrors([]string{
+		"releases.hashicorp.com=https://mirror.internal/hashicorp/ fallback",
+		"https://dl.google.com/go=https://mirror.internal/golang",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		url, want    string
+		fallback, ok bool
+	}{
+		{"https://releases.hashicorp.com/terraform/1.9.0/tf.zip", "https://mirror.internal/hashicorp/terraform/1.9.0/tf.zip", true, true},
+		{"https://Releases.Hashicorp.com/a.zip?x=1", "https://mirror.internal/hashicorp/a.zip?x=1", true, true},
+		{"http://dl.google.com/go/go1.22.linux-amd64.tar.gz", "https://mirror.internal/golang/go1.22.linux-amd64.tar.gz", false, true},
+		{"https://dl.google.com/go", "https://mirror.internal/golang", false, true},
+		{"https://dl.google.com/golang/x.tgz", "", false, false},
+		{"https://dl.google.com/android/x.zip", "", false, false},
+		{"https://example.com/pkg.zip", "", false, false},
+	}
+	for _, tc := range cases {
+		got, fallback, ok := m.Rewrite(tc.url)
+		if got != tc.want || fallback != tc.fallback || ok != tc.ok {
+			t.Errorf("Rewrite(%q) = %q, %v, %v; want %q, %v, %v", tc.url, got, fallback, ok, tc.want, tc.fallback, tc.ok)
+		}
+	}
+	for _, bad := range []string{"example.com", "=https://m", "example.com=", "example.com=ftp://m", "example.com=https://m always"} {
+		if _, err := NewPackageMirrors([]string{bad}); err == nil {
+			t.Errorf("NewPackageMirrors(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestEnsurePackageMirror(t *testing.T) {
+	var mirrorHits, originHits atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHits.Add(1)
+		switch r.URL.Path {
+		case "/m/ok/pkg.zip":
+			_, _ = io.WriteString(w, "from mirror")
+		case "/m/broken/pkg.zip":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHits.Add(1)
+		_, _ = io.WriteString(w, "from origin")
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	cases := []struct {
+		name       string
+		rule       string
+		path       string
+		wantErr    bool
+		wantBody   string
+		wantSource string
+		wantFinal  string
+	}{
+		{"served by mirror", host + "/ok=" + mirror.URL + "/m/ok", "/ok/pkg.zip", false, "from mirror", SourceMirror, mirror.URL + "/m/ok/pkg.zip"},
+		{"not mirrored", host + "/ok=" + mirror.URL + "/m/ok", "/other/pkg.zip", false, "from origin", SourceOrigin, ""},
+		{"mirror 404 falls back", host + "=" + mirror.URL + "/m fallback", "/missing/pkg.zip", false, "from origin", SourceOrigin, ""},
+		{"mirror 5xx falls back", host + "=" + mirror.URL + "/m fallback", "/broken/pkg.zip", false, "from origin", SourceOrigin, ""},
+		{"mirror 404 without fallback", host + "=" + mirror.URL + "/m", "/missing/pkg.zip", true, "", "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			s.RetryMax = 2
+			s.RetryBackoff = time.Millisecond
+			m, err := NewPackageMirrors([]string{tc.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetPackageMirrors(m)
+			pkgURL := origin.URL + tc.path
+			path, err := s.EnsurePackage(context.Background(), "u", pkgURL)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, _ := os.ReadFile(path); string(b) != tc.wantBody {
+				t.Fatalf("body = %q, want %q", b, tc.wantBody)
+			}
+			if want := filepath.Join(PackageHash(pkgURL), filepath.Base(path)); !strings.HasSuffix(path, want) {
+				t.Fatalf("path %s not keyed by the original URL", path)
+			}
+			meta, err := s.LookupPackage("u", pkgURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Source != tc.wantSource || meta.FinalURL != tc.wantFinal {
+				t.Fatalf("source=%q final=%q, want %q %q", meta.Source, meta.FinalURL, tc.wantSource, tc.wantFinal)
+			}
+
+			// Dropping the mirror keeps the cached package.
+			s.SetPackageMirrors(nil)
+			before := originHits.Load() + mirrorHits.Load()
+			if _, err := s.EnsurePackage(context.Background(), "u", pkgURL); err != nil {
+				t.Fatal(err)
+			}
+			if after := originHits.Load() + mirrorHits.Load(); after != before {
+				t.Fatalf("cached package downloaded again after the mirror changed")
+			}
+		})
+	}
+}
+
+func TestMigrateFormat(t *testing.T) {
+	archive := filepath.Join("users", "u", "repos", "acme", "app", "main.zip")
+	cases := []struct {
+		name       string
+		setup      func(t *testing.T, root string)
+		wantRan    int
+		wantErr    error
+		wantFormat int // in FormatFile afterwards, 0: not written
+	}{
+		{"new root", func(t *testing.T, root string) {}, 0, nil, CacheFormat},
+		{"format 1 archive without sidecar", func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, archive), "zip")
+			writeFile(t, filepath.Join(root, archive+".meta"), "abc123")
+		}, 1, nil, CacheFormat},
+		{"format 1 sidecar without format", func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, archive), "zip")
+			writeFile(t, filepath.Join(root, archive+".meta"), "abc123")
+			writeFile(t, filepath.Join(root, strings.TrimSuffix(archive, ".zip")+".meta.json"), `{"repo":"acme/app","branch":"main","sha256":"x","size":3}`)
+		}, 1, nil, CacheFormat},
+		{"current", func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, FormatFile), fmt.Sprintf(`{"format":%d}`, CacheFormat))
+		}, 0, nil, CacheFormat},
+		{"newer binary's cache", func(t *testing.T, root string) {
+			writeFile(t, filepath.Join(root, archive), "zip")
+			writeFile(t, filepath.Join(root, FormatFile), `{"format":99}`)
+		}, 0, ErrFormatTooNew, 99},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			tc.setup(t, root)
+			s := New(root)
+			ran, err := s.MigrateFormat()
+			if !errors.Is(err, tc.wantErr) || len(ran) != tc.wantRan {
+				t.Fatalf("MigrateFormat = %v, %v; want %d migrations, err %v", ran, err, tc.wantRan, tc.wantErr)
+			}
+			rec, err := s.readFormat()
+			if err != nil || rec.Format != tc.wantFormat || len(rec.Migrations) != tc.wantRan {
+				t.Fatalf("format record = %+v, %v; want format %d", rec, err, tc.wantFormat)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(root, archive)); err == nil {
+				meta, err := readArchiveMetaFile(filepath.Join(root, archive))
+				if err != nil || meta.Format != CacheFormat || meta.Repo != "acme/app" || meta.Branch != "main" {
+					t.Fatalf("sidecar = %+v, %v", meta, err)
+				}
+			}
+			if ran, err := s.MigrateFormat(); err != nil || len(ran) != 0 {
+				t.Fatalf("second MigrateFormat = %v, %v; want nothing to do", ran, err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithDownloadedBytes(t *testing.T) {
+	s := New(t.TempDir())
+	s.RetryMax = 0
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(make([]byte, 1000))), ContentLength: 1000, Header: make(http.Header)}, nil
+	})}
+	var fetched atomic.Int64
+	ctx := WithDownloadedBytes(context.Background(), &fetched)
+	for i := 0; i < 2; i++ {
+		if _, err := s.EnsurePackage(ctx, "u", "https://example.com/pkg.tgz"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fetched.Load(); got != 1000 {
+		t.Fatalf("fetched = %d, want 1000 (the cache hit downloads nothing)", got)
+	}
+}
+
+func TestPackagePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		allow, deny  []string
+		defaultAllow bool
+		url          string
+		wantDenied   bool
+		wantRule     string
+	}{
+		{name: "no rules, default allow", defaultAllow: true, url: "https://example.com/a.tgz", wantRule: "default"},
+		{name: "no rules, default deny", url: "https://example.com/a.tgz", wantDenied: true, wantRule: "default"},
+		{name: "allowed host", allow: []string{"registry.npmjs.org"}, url: "https://registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz", wantRule: "registry.npmjs.org"},
+		{name: "host glob ignores port and case", allow: []string{"*.example.com"}, url: "https://Files.Example.com:8443/x.zip", wantRule: "*.example.com"},
+		{name: "single star stays in a segment", allow: []string{"github.com/*/releases"}, url: "https://github.com/o/r/releases/download/v1/x.tgz", wantDenied: true, wantRule: "default"},
+		{name: "double star crosses segments", allow: []string{"github.com/*/*/releases/**"}, url: "https://github.com/o/r/releases/download/v1/x.tgz", wantRule: "github.com/*/*/releases/**"},
+		{name: "deny wins over allow", allow: []string{"*.example.com"}, deny: []string{"internal.example.com"}, defaultAllow: true, url: "https://internal.example.com/x.zip", wantDenied: true, wantRule: "internal.example.com"},
+		{name: "deny by path", allow: []string{"example.com"}, deny: []string{"example.com/private/**"}, url: "https://example.com/private/a/x.zip", wantDenied: true, wantRule: "example.com/private/**"},
+		{name: "allow beats default deny", allow: []string{"example.com"}, url: "https://example.com/x.zip", wantRule: "example.com"},
+		{name: "regex rule", deny: []string{`re:.*\.exe`}, defaultAllow: true, url: "https://example.com/setup.EXE", wantDenied: true, wantRule: `re:.*\.exe`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPackagePolicy(tt.allow, tt.deny, tt.defaultAllow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, err := p.Check(tt.url)
+			if denied := errors.Is(err, ErrPolicyDenied); denied != tt.wantDenied || (err != nil && !denied) {
+				t.Fatalf("err = %v, want denied=%v", err, tt.wantDenied)
+			}
+			if rule != tt.wantRule {
+				t.Fatalf("rule = %q, want %q", rule, tt.wantRule)
+			}
+		})
+	}
+	if _, err := NewPackagePolicy([]string{"re:("}, nil, true); err == nil {
+		t.Fatal("invalid regex accepted")
+	}
+}
+
+func TestEnsurePackage_Policy(t *testing.T) {
+	s := New(t.TempDir())
+	s.RetryMax = 0
+	var requests atomic.Int32
+	redirects := map[string]string{
+		"/to-denied.tgz":  "https://example.com/blocked/pkg.tgz",
+		"/to-other.tgz":   "https://other.example/pkg.tgz",
+		"/to-private.tgz": "https://10.0.0.1/pkg.tgz",
+	}
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		if to, ok := redirects[req.URL.Path]; ok {
+			return &http.Response{StatusCode: http.StatusFound, Body: http.NoBody, Header: http.Header{"Location": {to}}, Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("pkg")), ContentLength: 3, Header: make(http.Header)}, nil
+	})}
+	s.PackageHostCheck = func(_ context.Context, u *url.URL) error {
+		if u.Hostname() == "10.0.0.1" {
+			return errors.New("private address")
+		}
+		return nil
+	}
+	rec := &eventRecorder{}
+	s.Events = rec
+	p, err := NewPackagePolicy([]string{"example.com", "10.0.0.1"}, []string{"example.com/blocked/**"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := s.EnsurePackage(ctx, "alice", "https://example.com/ok.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetPackagePolicy(p)
+
+	tests := []struct {
+		url      string
+		wantErr  error
+		requests int32
+	}{
+		{"https://example.com/pkg.tgz", nil, 1},
+		{"https://example.com/blocked/pkg.tgz", ErrPolicyDenied, 0},
+		{"https://other.example/pkg.tgz", ErrPolicyDenied, 0},
+		{"https://example.com/ok.tgz", nil, 0},     // cached before the policy, still allowed
+		{"http://10.0.0.1/pkg.tgz", ErrBadPath, 0}, // allowed by the policy, refused by the host check
+		{"https://example.com/ok/../blocked/x.tgz", ErrPolicyDenied, 0},
+		{"https://example.com/%62locked/x.tgz", ErrPolicyDenied, 0},
+		// Every redirect hop is checked too, the policy before the host check.
+		{"https://example.com/to-denied.tgz", ErrPolicyDenied, 1},
+		{"https://example.com/to-other.tgz", ErrPolicyDenied, 1},
+		{"https://example.com/to-private.tgz", ErrRedirectPolicy, 1},
+	}
+	for _, tt := range tests {
+		requests.Store(0)
+		_, err := s.EnsurePackage(ctx, "alice", tt.url)
+		if (tt.wantErr == nil) != (err == nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+			t.Fatalf("%s: err = %v, want %v", tt.url, err, tt.wantErr)
+		}
+		if got := requests.Load(); got != tt.requests {
+			t.Fatalf("%s: %d requests, want %d", tt.url, got, tt.requests)
+		}
+	}
+
+	var denied []Event
+	for _, e := range rec.events {
+		if e.Type == EventPackageDenied {
+			denied = append(denied, e)
+		}
+	}
+	if len(denied) != 6 || denied[0].User != "alice" || denied[0].URL != "https://example.com/blocked/pkg.tgz" || denied[0].Reason != "example.com/blocked/**" || denied[1].Reason != "default" ||
+		denied[4].URL != "https://example.com/blocked/pkg.tgz" || denied[5].URL != "https://other.example/pkg.tgz" || denied[5].User != "alice" {
+		t.Fatalf("denied events = %+v", denied)
+	}
+}
+
+func TestWriteHunks(t *testing.T) {
+	lines := func(n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&b, "l%d\n", i)
+		}
+		return b.String()
+	}
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"unchanged", "x\ny\n", "x\ny\n", ""},
+		{"one line changed", "a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"added file", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed file", "a\n", "", "@@ -1 +0,0 @@\n-a\n"},
+		{"no newline at end", "a\nb", "a\nb\nc", "@@ -1,2 +1,3 @@\n a\n-b\n\\ No newline at end of file\n+b\n+c\n\\ No newline at end of file\n"},
+		{"context trimmed", lines(10), strings.Replace(lines(10), "l5\n", "L5\n", 1), "@@ -2,7 +2,7 @@\n l2\n l3\n l4\n-l5\n+L5\n l6\n l7\n l8\n"},
+		{
+			"distant changes split",
+			lines(20),
+			strings.Replace(strings.Replace(lines(20), "l2\n", "L2\n", 1), "l18\n", "", 1),
+			"@@ -1,5 +1,5 @@\n l1\n-l2\n+L2\n l3\n l4\n l5\n@@ -15,6 +15,5 @@\n l15\n l16\n l17\n-l18\n l19\n l20\n",
+		},
+		{"insert between", "a\nc\n", "a\nb\nc\n", "@@ -1,2 +1,3 @@\n a\n+b\n c\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeHunks(&b, splitLines([]byte(tt.a)), splitLines([]byte(tt.b))); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Fatalf("hunks:\n%s\nwant:\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLines_Shortest(t *testing.T) {
+	a := splitLines([]byte("a\nb\nc\na\nb\nb\na\n"))
+	b := splitLines([]byte("c\nb\na\nb\na\nc\n"))
+	edits := diffLines(a, b)
+	var got, want []string
+	changes := 0
+	for _, e := range edits {
+		if e.op != '+' {
+			got = append(got, e.line)
+		}
+		if e.op != ' ' {
+			changes++
+		}
+	}
+	for _, e := range edits {
+		if e.op != '-' {
+			want = append(want, e.line)
+		}
+	}
+	if strings.Join(got, "") != strings.Join(a, "") || strings.Join(want, "") != strings.Join(b, "") {
+		t.Fatalf("edit script does not turn a into b: %+v", edits)
+	}
+	if changes != 5 {
+		t.Fatalf("%d changes, want the shortest script of 5", changes)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	zipOf := func(top string, files map[string]string) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, body := range files {
+			w, _ := zw.Create(top + name)
+			_, _ = w.Write([]byte(body))
+		}
+		_ = zw.Close()
+		return buf.String()
+	}
+	shaA, shaB := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	s := New(t.TempDir())
+	s.KeepPrevious = 1
+	sha, body, downloads := "", "", 0
+	compares := 0
+	gh := fakeGitHub(&sha, &body, &downloads)
+	s.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/compare/") {
+			compares++
+			if req.Header.Get("Accept") != "application/vnd.github.diff" {
+				t.Errorf("compare Accept = %q", req.Header.Get("Accept"))
+			}
+			if strings.Contains(req.URL.Path, "/compare/0000000...") {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader(`{}`)), Header: make(http.Header)}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("diff --git a/x b/x\n")), Header: make(http.Header)}, nil
+		}
+		return gh.RoundTrip(req)
+	})}
+	ctx := context.Background()
+	sha, body = shaA, zipOf("owner-repo-aaaaaaa/", map[string]string{"README": "v1\n", "old.txt": "gone\n", "same": "x\n"})
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	sha, body = shaB, zipOf("owner-repo-bbbbbbb/", map[string]string{"README": "v2\n", "new.txt": "hello\n", "same": "x\n"})
+	if _, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	local := "diff --git a/README b/README\n--- a/README\n+++ b/README\n@@ -1 +1 @@\n-v1\n+v2\n" +
+		"diff --git a/new.txt b/new.txt\nnew file mode 100644\n--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+hello\n" +
+		"diff --git a/old.txt b/old.txt\ndeleted file mode 100644\n--- a/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-gone\n"
+	tests := []struct {
+		name       string
+		from, to   string
+		max        int64
+		wantErr    error
+		wantSource string
+		wantTo     string
+		wantBody   string
+	}{
+		{name: "cached head", from: "aaaaaaa", wantSource: PatchFromCache, wantTo: shaB, wantBody: local},
+		{name: "explicit head", from: "aaaaaaa", to: "HEAD", wantSource: PatchFromCache, wantTo: shaB, wantBody: local},
+		{name: "reverse", from: "bbbbbbb", to: "aaaaaaa", wantSource: PatchFromCache, wantTo: "aaaaaaa"},
+		{name: "from not cached", from: "1234567", wantSource: PatchFromGitHub, wantTo: shaB, wantBody: "diff --git a/x b/x\n"},
+		{name: "from unknown to github", from: "0000000", wantErr: ErrNotFound},
+		{name: "over the cap", from: "aaaaaaa", max: 64, wantErr: ErrTooLarge},
+		{name: "bad from", from: "nope", wantErr: ErrBadPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := s.Patch(ctx, "u", "owner/repo", "main", tt.from, tt.to, "", tt.max)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Source != tt.wantSource || p.To != tt.wantTo {
+				t.Fatalf("source=%s to=%s", p.Source, p.To)
+			}
+			if tt.wantBody != "" && string(p.Body) != tt.wantBody {
+				t.Fatalf("body:\n%s\nwant:\n%s", p.Body, tt.wantBody)
+			}
+		})
+	}
+	if compares != 2 {
+		t.Fatalf("%d compare calls, want 2 (cached commits are diffed locally)", compares)
+	}
+	if _, err := s.Patch(ctx, "u", "owner/repo", "dev", "aaaaaaa", "", "", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("uncached branch without to: %v", err)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	const sha = "abcdefabcdefabcdefabcdefabcdefabcdefabcd"
+	root := t.TempDir()
+	s := New(root)
+	now := time.Now().Add(time.Hour)
+	s.Clock = testutil.NewFakeClock(now)
+	repo := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "feature"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestZip(t, filepath.Join(repo, "main.zip"), "repo-main/", time.Now(), []string{"README.md"})
+	writeFile(t, filepath.Join(repo, "main.zip.meta"), sha)
+	writeTestZip(t, filepath.Join(repo, "feature", "x.zip"), "repo-x/", time.Now(), []string{"README.md"})
+	writeFile(t, filepath.Join(repo, "old.meta.json"), "{}")
+	writeFile(t, filepath.Join(repo, "old.commit.txt"), "abcdefa")
+	writeFile(t, filepath.Join(repo, "old.zip.normalized"), "PK")
+	writeFile(t, filepath.Join(repo, "empty.zip"), "")
+	writeFile(t, filepath.Join(repo, "empty.meta.json"), "{}")
+	writeFile(t, filepath.Join(repo, "bad.zip"), "not a zip")
+	writeFile(t, filepath.Join(repo, "notes.txt"), "hi")
+	writeFile(t, filepath.Join(repo, releaseMapName), "{}")
+	writeFile(t, filepath.Join(repo, "fresh.gone"), "")
+	if err := os.Chtimes(filepath.Join(repo, "fresh.gone"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "users", "u", "stray"), "")
+	writeFile(t, filepath.Join(root, "users", "u", "packages", "abc", packageMetaName), "{}")
+	writeFile(t, filepath.Join(root, "users", "u", "packages", "def", packageMetaName), "{}")
+	writeFile(t, filepath.Join(root, "users", "u", "packages", "def", "pkg.tgz"), "data")
+
+	want := &ConsistencyReport{
+		OrphanSidecars: []string{
+			"users/u/packages/abc/.package.json",
+			"users/u/repos/owner/repo/old.commit.txt",
+			"users/u/repos/owner/repo/old.meta.json",
+			"users/u/repos/owner/repo/old.zip.normalized",
+		},
+		Regenerated: []string{"users/u/repos/owner/repo/main.zip"},
+		Unverified:  []string{"users/u/repos/owner/repo/feature/x.zip"},
+		Broken:      []string{"users/u/repos/owner/repo/bad.zip", "users/u/repos/owner/repo/empty.zip"},
+		Unexpected:  []string{"users/u/repos/owner/repo/notes.txt", "users/u/stray"},
+	}
+	for _, dryRun := range []bool{true, false} {
+		got, err := s.CheckConsistency(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.DryRun = dryRun
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("dry_run=%v report:\n%+v\nwant:\n%+v", dryRun, got, want)
+		}
+		_, err = os.Stat(filepath.Join(repo, "old.meta.json"))
+		if dryRun != (err == nil) {
+			t.Fatalf("dry_run=%v: orphan sidecar stat err = %v", dryRun, err)
+		}
+	}
+
+	for _, p := range []string{"bad.zip", "empty.zip", "empty.meta.json", "old.commit.txt"} {
+		if _, err := os.Stat(filepath.Join(repo, p)); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", p, err)
+		}
+	}
+	for _, p := range []string{"fresh.gone", "notes.txt", releaseMapName} {
+		if _, err := os.Stat(filepath.Join(repo, p)); err != nil {
+			t.Fatalf("%s removed: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "users", "u", "packages", "abc")); !os.IsNotExist(err) {
+		t.Fatalf("orphaned package dir kept: %v", err)
+	}
+	if meta, err := readArchiveMetaFile(filepath.Join(repo, "main.zip")); err != nil || meta.CommitSHA != sha || meta.Branch != "main" || meta.Repo != "owner/repo" {
+		t.Fatalf("regenerated meta = %+v, %v", meta, err)
+	}
+	if meta, err := readArchiveMetaFile(filepath.Join(repo, "feature", "x.zip")); err != nil || meta.CommitSHA != "" || meta.Branch != "feature/x" {
+		t.Fatalf("unverified meta = %+v, %v", meta, err)
+	}
+
+	again, err := s.CheckConsistency(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Repairs() != 0 || len(again.Unexpected) != 2 {
+		t.Fatalf("second pass = %+v", again)
+	}
+}
+
+func TestRebalanceTiers(t *testing.T) {
+	root, cold := t.TempDir(), t.TempDir()
+	s := New(root)
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	repo := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(repo, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	hot, old := filepath.Join(repo, "main.zip"), filepath.Join(repo, "dev.zip")
+	for _, p := range []string{hot, old} {
+		writeTestZip(t, p, "repo/", time.Now(), []string{"README.md"})
+		branch := strings.TrimSuffix(filepath.Base(p), ".zip")
+		if _, err := s.recordArchive(p, "owner/repo", branch, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(hot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+	at := func(p string, ago time.Duration) {
+		t.Helper()
+		when := clock.Now().Add(-ago)
+		if err := os.Chtimes(p, when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at(hot, time.Minute)
+	at(old, time.Hour)
+
+	if r, err := s.Rebalance(); err != nil || len(r.Demoted)+len(r.Promoted) != 0 {
+		t.Fatalf("without tiers: %+v, %v", r, err)
+	}
+	s.Tiers = []Tier{{Root: cold}}
+	s.HotCapacity = size + size/2
+
+	tierOf := func(p string) int {
+		t.Helper()
+		meta, err := readArchiveMetaFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.Tier
+	}
+	r, err := s.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Demoted, []string{"users/u/repos/owner/repo/dev.zip"}) || len(r.Promoted) != 0 {
+		t.Fatalf("first pass = %+v", r)
+	}
+	coldCopy := filepath.Join(cold, "users", "u", "repos", "owner", "repo", "dev.zip")
+	if target, err := os.Readlink(old); err != nil || target != coldCopy {
+		t.Fatalf("dev.zip links to %q, %v", target, err)
+	}
+	if tierOf(old) != 1 || tierOf(hot) != 0 {
+		t.Fatalf("tiers dev=%d main=%d", tierOf(old), tierOf(hot))
+	}
+	if _, err := zip.OpenReader(old); err != nil {
+		t.Fatalf("demoted archive unreadable through Root: %v", err)
+	}
+	entries, err := s.List("users/u/repos/owner/repo")
+	if err != nil || len(entries) != 2 || entries[0].Name != "dev.zip" || entries[0].Size != size {
+		t.Fatalf("list = %+v, %v", entries, err)
+	}
+	usage := s.TierUsage()
+	if len(usage) != 2 || usage[0].Archives != 1 || usage[1].Archives != 1 || usage[1].Bytes != size {
+		t.Fatalf("usage = %+v", usage)
+	}
+
+	// Serving dev touches its cold copy through the link; the next pass
+	// swaps the two.
+	at(old, 0)
+	if r, err = s.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Promoted, []string{"users/u/repos/owner/repo/dev.zip"}) || !reflect.DeepEqual(r.Demoted, []string{"users/u/repos/owner/repo/main.zip"}) {
+		t.Fatalf("second pass = %+v", r)
+	}
+	if fi, err := os.Lstat(old); err != nil || !fi.Mode().IsRegular() || tierOf(old) != 0 {
+		t.Fatalf("dev.zip not promoted: %v", err)
+	}
+	if _, err := os.Stat(coldCopy); !os.IsNotExist(err) {
+		t.Fatalf("cold copy of a promoted archive kept: %v", err)
+	}
+
+	// Deleting a demoted archive leaves its cold copy to the next pass,
+	// once it is past the grace period.
+	if err := s.Delete("users/u/repos/owner/repo/main.zip", false); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if r, err = s.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Orphans, []string{"users/u/repos/owner/repo/main.zip"}) {
+		t.Fatalf("third pass = %+v", r)
+	}
+	if _, err := os.Stat(filepath.Join(cold, "users")); !os.IsNotExist(err) {
+		t.Fatalf("cold tier not trimmed: %v", err)
+	}
+}
+
+func TestPlanRepo(t *testing.T) {
+	const (
+		cachedSHA = "1111111111111111111111111111111111111111"
+		movedSHA  = "2222222222222222222222222222222222222222"
+	)
+	var downloads, calls int
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, status := "", http.StatusNotFound
+		switch {
+		case req.URL.Host != "api.github.com":
+			downloads++
+		case req.URL.Path == "/repos/owner/repo":
+			body, status = `{"full_name":"owner/repo","default_branch":"main"}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/branches/main":
+			calls++
+			body, status = `{"commit":{"sha":"`+cachedSHA+`"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/branches/dev":
+			calls++
+			body, status = `{"commit":{"sha":"`+movedSHA+`"}}`, http.StatusOK
+		case req.URL.Path == "/repos/owner/repo/branches/new":
+			calls++
+			body, status = `{"commit":{"sha":"`+movedSHA+`"}}`, http.StatusOK
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	root := t.TempDir()
+	s := New(root)
+	s.HTTPClient = &http.Client{Transport: rt}
+	clock := testutil.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.Clock = clock
+
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := clock.Now().Add(-time.Hour)
+	for _, branch := range []string{"main", "dev"} {
+		zipPath := filepath.Join(dir, branch+".zip")
+		_ = os.WriteFile(zipPath, []byte("zip-"+branch), 0o644)
+		_ = writeSHA(zipPath+".meta", cachedSHA)
+		if _, err := s.recordArchiveAt(zipPath, "owner/repo", branch, cachedSHA, clock.Now().Add(-10*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(zipPath, old, old)
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		branch string
+		remote bool
+		cached bool
+		would  PlanAction
+		sha    string
+		asks   bool // GitHub is asked for the branch's commit
+	}{
+		{name: "cached", ctx: context.Background(), branch: "main", cached: true, would: PlanRevalidate},
+		{name: "default branch", ctx: context.Background(), branch: "", cached: true, would: PlanRevalidate},
+		{name: "not cached", ctx: context.Background(), branch: "new", would: PlanDownload},
+		{name: "within max age", ctx: WithMaxAge(context.Background(), time.Hour), branch: "dev", cached: true, would: PlanHit},
+		{name: "max age passed", ctx: WithMaxAge(context.Background(), 5*time.Minute), branch: "dev", cached: true, would: PlanRevalidate},
+		{name: "current", ctx: context.Background(), branch: "main", remote: true, cached: true, would: PlanRevalidate, sha: cachedSHA, asks: true},
+		{name: "moved", ctx: context.Background(), branch: "dev", remote: true, cached: true, would: PlanDownload, sha: movedSHA, asks: true},
+		{name: "new remote", ctx: context.Background(), branch: "new", remote: true, would: PlanDownload, sha: movedSHA, asks: true},
+		{name: "hit skips remote", ctx: WithMaxAge(context.Background(), time.Hour), branch: "dev", remote: true, cached: true, would: PlanHit},
+	}
+	for _, tt := range tests {
+		before := calls
+		plan, err := s.PlanRepo(tt.ctx, "u", "owner/repo", tt.branch, "", false, tt.remote)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if plan.Cached != tt.cached || plan.Would != tt.would || plan.RemoteSHA != tt.sha {
+			t.Fatalf("%s: got %+v", tt.name, plan)
+		}
+		if tt.cached && (plan.CachedSHA != cachedSHA || plan.EstimatedBytes == 0) {
+			t.Fatalf("%s: cached archive not described: %+v", tt.name, plan)
+		}
+		if asked := calls > before; asked != tt.asks {
+			t.Fatalf("%s: remote asked = %v", tt.name, asked)
+		}
+	}
+	if downloads != 0 {
+		t.Fatalf("PlanRepo downloaded %d archives", downloads)
+	}
+	for _, branch := range []string{"main", "dev"} {
+		fi, err := os.Stat(filepath.Join(dir, branch+".zip"))
+		if err != nil || !fi.ModTime().Equal(old) {
+			t.Fatalf("%s.zip was touched: %v", branch, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.zip")); !os.IsNotExist(err) {
+		t.Fatalf("plan created an archive: %v", err)
+	}
+
+	if _, err := s.PlanRepo(context.Background(), "u", "owner/repo", "missing", "", false, true); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("missing branch: %v", err)
+	}
+	if _, err := s.PlanRepo(context.Background(), "u", "owner/other", "", "", true, false); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("legacy default branch without a remote check: %v", err)
+	}
+}
+
+func TestPinProtectsArchive(t *testing.T) {
+	root := t.TempDir()
+	s := New(root)
+	s.Retention = RetentionPolicy{MaxArchives: 1}
+	dir := filepath.Join(root, "users", "u", "repos", "owner", "repo")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, branch := range []string{"golden", "feature", "main"} {
+		zipPath := filepath.Join(dir, branch+".zip")
+		if err := os.WriteFile(zipPath, []byte("zip-"+branch), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.recordArchive(zipPath, "owner/repo", branch, ""); err != nil {
+			t.Fatal(err)
+		}
+		if branch != "main" {
+			_ = os.Chtimes(zipPath, old, old)
+		}
+	}
+
+	tests := []struct {
+		rel  string
+		want error
+	}{
+		{"users/u/repos/owner/repo/golden.zip", nil},
+		{"users/u/repos/owner/repo/missing.zip", ErrNotFound},
+		{"users/u/repos/owner/repo/golden.zip.meta", ErrBadPath},
+		{"../outside.zip", ErrBadPath},
+	}
+	for _, tt := range tests {
+		meta, err := s.Pin(tt.rel)
+		if !errors.Is(err, tt.want) {
+			t.Fatalf("Pin(%q) = %v, want %v", tt.rel, err, tt.want)
+		}
+		if err == nil && !meta.Protected {
+			t.Fatalf("Pin(%q) did not protect: %+v", tt.rel, meta)
+		}
+	}
+	if e, err := s.Stat("users/u/repos/owner/repo/golden.zip"); err != nil || !e.Protected {
+		t.Fatalf("Stat = %+v, %v", e, err)
+	}
+	golden := filepath.Join(dir, "golden.zip")
+	// A refresh keeps the protection.
+	if meta, err := s.recordArchive(golden, "owner/repo", "golden", ""); err != nil || !meta.Protected {
+		t.Fatalf("refreshed meta = %+v, %v", meta, err)
+	}
+	_ = os.Chtimes(golden, old, old)
+
+	report, err := s.Cleanup(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"users/u/repos/owner/repo/feature.zip"}; !reflect.DeepEqual(report.Expired, want) {
+		t.Fatalf("expired = %v, want %v", report.Expired, want)
+	}
+	// The protected archive fills the retention cap of one by itself.
+	if want := []string{"users/u/repos/owner/repo/main.zip"}; !reflect.DeepEqual(report.Retention, want) {
+		t.Fatalf("retention = %v, want %v", report.Retention, want)
+	}
+	if report.Protected != 1 || report.ProtectedBytes != int64(len("zip-golden")) {
+		t.Fatalf("report = %+v", report)
+	}
+	if !archiveExists(golden) {
+		t.Fatal("protected archive was removed")
+	}
+	if u := s.ProtectedUsage(); u.Archives != 1 || u.Bytes != int64(len("zip-golden")) {
+		t.Fatalf("protected usage = %+v", u)
+	}
+
+	if meta, err := s.Unpin("users/u/repos/owner/repo/golden.zip"); err != nil || meta.Protected {
+		t.Fatalf("Unpin = %+v, %v", meta, err)
+	}
+	if report, err = s.Cleanup(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if archiveExists(golden) || report.Protected != 0 {
+		t.Fatalf("unpinned archive survived cleanup: %+v", report)
+	}
+}
+
+func TestArchiveSegments(t *testing.T) {
+	const sha = "1111111111111111111111111111111111111111"
+	data := bytes.Repeat([]byte("0123456789"), 25) // 250 bytes
+	ring, _ := NewKeyRing(bytes.Repeat([]byte{1}, 32))
+	for _, mode := range []string{"plain", "compressed", "encrypted"} {
+		root := t.TempDir()
+		s := New(root)
+		s.CompressArchives = mode == "compressed"
+		if mode == "encrypted" {
+			s.Keys = ring
+		}
+		zipPath := filepath.Join(root, "users", "u", "repos", "owner", "repo", "main.zip")
+		if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(root, "download.tmp")
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.installArchive(tmp, zipPath); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.recordArchive(zipPath, "owner/repo", "main", sha); err != nil {
+			t.Fatal(err)
+		}
+
+		if mode != "plain" {
+			// Reaching a chunk would mean decoding everything before it.
+			if _, err := s.ArchiveSegments(zipPath, 100); !errors.Is(err, ErrNotSegmentable) {
+				t.Fatalf("%s: ArchiveSegments err = %v, want ErrNotSegmentable", mode, err)
+			}
+			if _, _, err := s.OpenSegment(zipPath, 100, 0); !errors.Is(err, ErrNotSegmentable) {
+				t.Fatalf("%s: OpenSegment err = %v, want ErrNotSegmentable", mode, err)
+			}
+			if _, err := os.Stat(segmentsPath(zipPath)); !os.IsNotExist(err) {
+				t.Fatalf("%s: manifest cached: %v", mode, err)
+			}
+			continue
+		}
+		m, err := s.ArchiveSegments(zipPath, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if m.Commit != sha || m.TotalSize != 250 || m.ChunkSize != 100 || m.SHA256 != hex.EncodeToString(sum[:]) || len(m.Chunks) != 3 || m.Chunks[2].Offset != 200 || m.Chunks[2].Length != 50 {
+			t.Fatalf("manifest = %+v", m)
+		}
+		if _, err := os.Stat(segmentsPath(zipPath)); err != nil {
+			t.Fatalf("manifest not cached: %v", err)
+		}
+		var joined []byte
+		for i := range m.Chunks {
+			seg, rc, err := s.OpenSegment(zipPath, 100, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sha256.Sum256(b)
+			if hex.EncodeToString(got[:]) != seg.SHA256 || int64(len(b)) != seg.Length {
+				t.Fatalf("segment %d does not match its digest", i)
+			}
+			joined = append(joined, b...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("reassembled archive differs")
+		}
+		if _, _, err := s.OpenSegment(zipPath, 100, 3); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("segment past the end: %v", err)
+		}
+		// Another chunk size is another manifest.
+		if m, err := s.ArchiveSegments(zipPath, 0); err != nil || len(m.Chunks) != 1 || m.ChunkSize != DefaultSegmentSize {
+			t.Fatalf("default chunk size: %+v, %v", m, err)
+		}
+		removeArchive(zipPath)
+		if _, err := os.Stat(segmentsPath(zipPath)); !os.IsNotExist(err) {
+			t.Fatalf("segments sidecar survived removal: %v", err)
+		}
+	}
+}
+
+func TestUpstreamCircuit(t *testing.T) {
+	sha, body, downloads := "abc123", "zip-v1", 0
+	down := false
+	var calls int
+	fake := fakeGitHub(&sha, &body, &downloads)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if down {
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader("bad gateway")), Header: make(http.Header)}, nil
+		}
+		return fake.RoundTrip(req)
+	})
+	s := New(t.TempDir())
+	clock := testutil.NewFakeClock(time.Now())
+	s.Clock = clock
+	s.HTTPClient = &http.Client{Transport: rt}
+	s.RetryMax = 0
+	s.CircuitThreshold = 2
+	s.CircuitCooldown = 30 * time.Second
+	ctx := context.Background()
+
+	zipPath, err := s.EnsureRepo(ctx, "u", "owner/repo", "main", "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures in a row open the circuit.
+	down = true
+	for i := 0; i < 2; i++ {
+		if _, err := s.fetchBranchSHARemote(ctx, "owner/repo", "main", ""); !errors.Is(err, ErrUpstreamUnavailable) {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	st := s.UpstreamCircuit()
+	if st.State != BreakerOpen || st.Trips != 1 || st.ConsecutiveFailures != 2 || st.LastError == "" || st.RetryAt == nil {
+		t.Fatalf("circuit after failures: %+v", st)
+	}
+
+	// While open, GitHub is not called and EnsureRepo serves the cache as
+	// stale under the default policy.
+	before := calls
+	var outcome CacheOutcome
+	got, err := s.EnsureRepo(WithOutcome(ctx, &outcome), "u", "owner/repo", "main", "", false, true)
+	if err != nil || got != zipPath || outcome != CacheStale {
+		t.Fatalf("open circuit: path=%q outcome=%q err=%v", got, outcome, err)
+	}
+	if calls != before {
+		t.Fatalf("open circuit made %d upstream calls", calls-before)
+	}
+	var coe *CircuitOpenError
+	if _, err := s.fetchBranchSHARemote(ctx, "owner/repo", "main", ""); !errors.As(err, &coe) || coe.RetryAfter <= 0 {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+
+	// After the cool-down a failed probe reopens it, a good one closes it.
+	clock.Advance(31 * time.Second)
+	if _, err := s.fetchBranchSHARemote(ctx, "owner/repo", "main", ""); errors.As(err, &coe) {
+		t.Fatalf("half-open circuit refused the probe: %v", err)
+	}
+	if st := s.UpstreamCircuit(); st.State != BreakerOpen || st.Trips != 1 {
+		t.Fatalf("circuit after failed probe: %+v", st)
+	}
+	clock.Advance(31 * time.Second)
+	down = false
+	if _, err := s.fetchBranchSHARemote(ctx, "owner/repo", "main", ""); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.UpstreamCircuit(); st.State != BreakerClosed || st.ConsecutiveFailures != 0 || st.Rejected == 0 {
+		t.Fatalf("circuit after probe: %+v", st)
+	}
+}
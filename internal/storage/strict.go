@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnverifiable reports that strict verification refused to serve an
+// archive it could not prove to be the current head of its branch.
+var ErrUnverifiable = errors.New("archive cannot be verified against the branch head")
+
+// UnverifiableError is returned by EnsureRepo under strict verification
+// (see Storage.StrictVerification and WithStrict) instead of an archive
+// that could not be verified. Err is the failed upstream lookup; it is nil
+// when the upstream was not asked, as for pinned archives and only-if-cached
+// requests.
+type UnverifiableError struct {
+	Repo   string
+	Branch string
+	Reason string
+	Err    error
+}
+
+func (e *UnverifiableError) Error() string {
+	msg := fmt.Sprintf("%s: %s@%s: %s", ErrUnverifiable, e.Repo, e.Branch, e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg + " (strict verification; force a refresh to download the branch head)"
+}
+
+func (e *UnverifiableError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{ErrUnverifiable}
+	}
+	return []error{ErrUnverifiable, e.Err}
+}
+
+type strictKey struct{}
+
+// WithStrict turns strict verification on for EnsureRepo calls made with
+// the returned context, as Storage.StrictVerification does for all of
+// them. It cannot turn it off.
+func WithStrict(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+func (s *Storage) strict(ctx context.Context) bool {
+	b, _ := ctx.Value(strictKey{}).(bool)
+	return b || s.StrictVerification
+}
+
+// strictCheck refuses, under strict verification, the archives EnsureRepo
+// would serve without asking upstream: one pinned by a rollback, or any for
+// an only-if-cached request. Max ages are ignored instead (see
+// withinMaxAge), as upstream can still be asked.
+func (s *Storage) strictCheck(ctx context.Context, zipPath, ownerRepo, branch string) error {
+	if !s.strict(ctx) {
+		return nil
+	}
+	if meta, err := readArchiveMeta(zipPath); err == nil && meta.Pinned && archiveExists(zipPath) {
+		return &UnverifiableError{Repo: ownerRepo, Branch: branch, Reason: "archive is pinned by a rollback"}
+	}
+	if onlyIfCached(ctx) {
+		return &UnverifiableError{Repo: ownerRepo, Branch: branch, Reason: "only-if-cached requests are not checked upstream"}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// TarballArchive streams the cached archive to w as a gzipped tar with its
+// entries renamed for root (empty keeps them as they are), and returns the
+// bytes written. Entries keep their order, modes and times; the zip
+// comment, which for GitHub zipballs is the commit, becomes the tar's pax
+// "comment" record as git archive writes it. Like RerootArchive nothing is
+// cached, and collisions are reported before anything is written.
+func (s *Storage) TarballArchive(w io.Writer, zipPath string, root RootMode) (int64, error) {
+	if root == "" {
+		root = RootKeep
+	}
+	raw, done, err := s.RawArchive(zipPath)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	zr, err := zip.OpenReader(raw)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = zr.Close() }()
+	names, err := rootNames(zr.File, root, repoFolder(zipPath))
+	if err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	gz := gzip.NewWriter(cw)
+	tw := tar.NewWriter(gz)
+	if zr.Comment != "" {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": zr.Comment}}); err != nil {
+			return cw.n, err
+		}
+	}
+	for i, f := range zr.File {
+		if names[i] == "" {
+			continue
+		}
+		if err := writeTarEntry(tw, f, names[i]); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return cw.n, err
+	}
+	err = gz.Close()
+	return cw.n, err
+}
+
+// writeTarEntry writes zip entry f to tw as name.
+func writeTarEntry(tw *tar.Writer, f *zip.File, name string) error {
+	mode := f.Mode()
+	hdr := &tar.Header{Name: name, Mode: int64(mode.Perm()), ModTime: f.Modified, Format: tar.FormatPAX}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = f.ModTime()
+	}
+	var rc io.ReadCloser
+	switch {
+	case mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+	case mode&os.ModeSymlink != 0:
+		// Zip stores a symlink's target as its content.
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		target, err := io.ReadAll(io.LimitReader(src, 4096))
+		_ = src.Close()
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, string(target)
+	default:
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		rc = src
+		hdr.Typeflag, hdr.Size = tar.TypeReg, int64(f.UncompressedSize64)
+	}
+	if rc != nil {
+		defer func() { _ = rc.Close() }()
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if rc == nil {
+		return nil
+	}
+	_, err := io.Copy(tw, rc)
+	return err
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempPrefix starts the name of every temp file the storage writes.
+const tempPrefix = ".tmp-"
+
+// orphanTempAge is how long a temp file may go unmodified before cleanup
+// treats it as left behind by a crash. Live downloads write continuously.
+const orphanTempAge = time.Hour
+
+// tempDirFor returns the directory for the temp file of a download that
+// will end up in dir: TempDir when set, else dir itself so the final rename
+// stays atomic.
+func (s *Storage) tempDirFor(dir string) (string, error) {
+	if s.TempDir == "" {
+		return dir, nil
+	}
+	if err := os.MkdirAll(s.TempDir, 0o755); err != nil {
+		return "", err
+	}
+	return s.TempDir, nil
+}
+
+// removeOrphanTemps deletes temp files older than orphanTempAge from the
+// cache trees and from the top of TempDir.
+func (s *Storage) removeOrphanTemps(report *CleanupReport) {
+	cutoff := s.Now().Add(-orphanTempAge)
+	remove := func(path string, d fs.DirEntry) {
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tempPrefix) || !expired(path, cutoff) {
+			return
+		}
+		if os.Remove(path) != nil {
+			return
+		}
+		if rel, err := filepath.Rel(s.Root, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = filepath.ToSlash(rel)
+		}
+		report.Temp = append(report.Temp, path)
+	}
+	for _, top := range []string{"users", SharedDir} {
+		_ = filepath.WalkDir(filepath.Join(s.Root, top), func(path string, d fs.DirEntry, err error) error {
+			if err == nil {
+				remove(path, d)
+			}
+			return nil
+		})
+	}
+	if s.TempDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(s.TempDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		remove(filepath.Join(s.TempDir, e.Name()), e)
+	}
+}
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tier is a slower cache root archives are demoted to (see Storage.Tiers).
+type Tier struct {
+	Root string
+	// Capacity is how many bytes of archives the tier should hold; 0 is
+	// unlimited. The last tier takes whatever the others cannot.
+	Capacity int64
+}
+
+// TierUsage is what one tier holds. Tier 0 is Root.
+type TierUsage struct {
+	Tier     int    `json:"tier"`
+	Root     string `json:"root"`
+	Capacity int64  `json:"capacity_bytes"`
+	Bytes    int64  `json:"bytes"`
+	Archives int    `json:"archives"`
+}
+
+// TierReport lists what a Rebalance pass moved or removed, as paths
+// relative to Root.
+type TierReport struct {
+	Demoted  []string `json:"demoted"`
+	Promoted []string `json:"promoted"`
+	// Orphans are archives in slower tiers nothing in Root links to any
+	// more, left by deletes and refreshes; removed.
+	Orphans []string `json:"orphans"`
+}
+
+// errTierChanged reports an archive replaced while it was being moved.
+var errTierChanged = errors.New("archive changed while moving it between tiers")
+
+// tieredArchive is an archive file in Root: the file itself in tier 0, a
+// symlink to its copy in a slower tier otherwise.
+type tieredArchive struct {
+	path   string // under Root
+	stored string // the file holding the bytes
+	tier   int
+	size   int64
+	mtime  time.Time
+}
+
+// tiers is the number of tiers including Root.
+func (s *Storage) tiers() int { return len(s.Tiers) + 1 }
+
+// tierRoot is tier i's root; slower tiers' are absolute, as symlinks in
+// Root point there.
+func (s *Storage) tierRoot(i int) string {
+	if i == 0 {
+		return s.Root
+	}
+	root, err := filepath.Abs(s.Tiers[i-1].Root)
+	if err != nil {
+		return filepath.Clean(s.Tiers[i-1].Root)
+	}
+	return root
+}
+
+func (s *Storage) tierCapacity(i int) int64 {
+	if i == 0 {
+		return s.HotCapacity
+	}
+	return s.Tiers[i-1].Capacity
+}
+
+// tierOf returns the slower tier abs is in, or 0 when it is in none.
+func (s *Storage) tierOf(abs string) int {
+	for i := 1; i < s.tiers(); i++ {
+		if strings.HasPrefix(abs, s.tierRoot(i)+string(os.PathSeparator)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// tierLink returns the slower-tier file the symlink at path points to, or
+// "" when path is not such a link.
+func (s *Storage) tierLink(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	target = filepath.Clean(target)
+	if s.tierOf(target) == 0 {
+		return ""
+	}
+	return target
+}
+
+// scanTiers lists the archives of both layouts with the tier holding each,
+// and the slower-tier files linked from anywhere in Root, the trash
+// included.
+func (s *Storage) scanTiers() ([]tieredArchive, map[string]bool) {
+	var archives []tieredArchive
+	linked := make(map[string]bool)
+	for _, top := range []string{"users", SharedDir, trashDir} {
+		_ = filepath.WalkDir(filepath.Join(s.Root, top), func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			a := tieredArchive{path: p, stored: p}
+			if d.Type()&fs.ModeSymlink != 0 {
+				if a.stored = s.tierLink(p); a.stored == "" {
+					return nil
+				}
+				linked[a.stored] = true
+				a.tier = s.tierOf(a.stored)
+			}
+			if _, ok := archivePath(p); !ok || top == trashDir {
+				return nil
+			}
+			fi, err := os.Stat(a.stored)
+			if err != nil || !fi.Mode().IsRegular() {
+				return nil
+			}
+			a.size, a.mtime = fi.Size(), fi.ModTime()
+			archives = append(archives, a)
+			return nil
+		})
+	}
+	return archives, linked
+}
+
+// TierUsage reports what each tier holds, Root first. Without Tiers it
+// returns nil.
+func (s *Storage) TierUsage() []TierUsage {
+	if len(s.Tiers) == 0 {
+		return nil
+	}
+	out := make([]TierUsage, s.tiers())
+	for i := range out {
+		out[i] = TierUsage{Tier: i, Root: s.tierRoot(i), Capacity: s.tierCapacity(i)}
+	}
+	archives, _ := s.scanTiers()
+	for _, a := range archives {
+		out[a.tier].Bytes += a.size
+		out[a.tier].Archives++
+	}
+	return out
+}
+
+// Rebalance moves archives between tiers so that, most recently used
+// first, each tier holds archives up to its capacity and the rest go to
+// the next one: archives that went unused are demoted, archives served
+// from a slower tier since the last pass are promoted back. A demoted
+// archive's copy in Root is replaced by a symlink to its new place, so
+// lookups, listings, deletes and cleanup see every tier through Root; its
+// sidecars stay in Root and its ArchiveMeta.Tier records where it is.
+// Copies in slower tiers nothing links to any more are removed. Without
+// Tiers it does nothing.
+func (s *Storage) Rebalance() (*TierReport, error) {
+	report := &TierReport{}
+	if len(s.Tiers) == 0 {
+		return report, nil
+	}
+	archives, linked := s.scanTiers()
+	sort.Slice(archives, func(i, j int) bool {
+		if !archives[i].mtime.Equal(archives[j].mtime) {
+			return archives[i].mtime.After(archives[j].mtime)
+		}
+		return archives[i].path < archives[j].path
+	})
+	used := make([]int64, s.tiers())
+	want := 0
+	var errs []error
+	for _, a := range archives {
+		for want < len(s.Tiers) && s.tierCapacity(want) > 0 && used[want]+a.size > s.tierCapacity(want) {
+			want++
+		}
+		used[want] += a.size
+		if a.tier == want {
+			continue
+		}
+		dst, err := s.moveTier(a, want)
+		if err != nil {
+			if !errors.Is(err, errTierChanged) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		linked[dst] = true
+		rel, _ := filepath.Rel(s.Root, a.path)
+		if want > a.tier {
+			report.Demoted = append(report.Demoted, filepath.ToSlash(rel))
+		} else {
+			report.Promoted = append(report.Promoted, filepath.ToSlash(rel))
+		}
+	}
+	cutoff := s.Now().Add(-consistencyGrace)
+	for i := 1; i < s.tiers(); i++ {
+		root := s.tierRoot(i)
+		_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || linked[p] {
+				return nil
+			}
+			if _, ok := archivePath(p); !ok || !expired(p, cutoff) {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, p)
+			report.Orphans = append(report.Orphans, filepath.ToSlash(rel))
+			_ = os.Remove(p)
+			trimEmpty(filepath.Dir(p), root)
+			return nil
+		})
+	}
+	return report, errors.Join(errs...)
+}
+
+// moveTier copies a to tier to and points Root at the copy, under the
+// archive's branch lock. It returns the file now holding the archive.
+func (s *Storage) moveTier(a tieredArchive, to int) (string, error) {
+	defer s.lockArchive(a.path)()
+	before, err := os.Lstat(a.path)
+	if err != nil {
+		return "", errTierChanged
+	}
+	dst := a.path
+	if to > 0 {
+		rel, err := filepath.Rel(s.Root, a.path)
+		if err != nil {
+			return "", err
+		}
+		dst = filepath.Join(s.tierRoot(to), rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return "", err
+		}
+	}
+	tmp, err := copyBeside(a.stored, dst)
+	if err != nil {
+		return "", fmt.Errorf("move %s to tier %d: %w", a.path, to, err)
+	}
+	// The mtime is the last access, which orders the next pass.
+	_ = os.Chtimes(tmp, a.mtime, a.mtime)
+	if to > 0 {
+		if err := os.Rename(tmp, dst); err != nil {
+			_ = os.Remove(tmp)
+			return "", err
+		}
+		link, err := os.CreateTemp(filepath.Dir(a.path), tempPrefix+"tier-*")
+		if err != nil {
+			return "", err
+		}
+		tmp = link.Name()
+		_ = link.Close()
+		_ = os.Remove(tmp)
+		if err := os.Symlink(dst, tmp); err != nil {
+			return "", err
+		}
+	}
+	if after, err := os.Lstat(a.path); err != nil || !os.SameFile(before, after) {
+		_ = os.Remove(tmp)
+		return "", errTierChanged
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if a.tier > 0 && a.stored != dst {
+		_ = os.Remove(a.stored)
+		trimEmpty(filepath.Dir(a.stored), s.tierRoot(a.tier))
+	}
+	zipPath := strings.TrimSuffix(a.path, zstSuffix)
+	if meta, err := readArchiveMetaFile(zipPath); err == nil && meta.Tier != to {
+		meta.Tier = to
+		_ = writeArchiveMeta(zipPath, meta)
+	}
+	return dst, nil
+}
+
+// lockArchive takes the branch lock EnsureRepo holds while it replaces the
+// archive at path. Legacy archives of branches with slashes are locked
+// under another key; moveTier's SameFile check covers them.
+func (s *Storage) lockArchive(path string) func() {
+	rel, _ := filepath.Rel(s.Root, strings.TrimSuffix(path, zstSuffix))
+	parts := splitPath(rel)
+	user, rest := SharedDir, parts
+	switch {
+	case len(parts) >= 6 && parts[0] == "users":
+		user, rest = parts[1], parts[3:]
+	case len(parts) >= 5 && parts[0] == SharedDir:
+		rest = parts[2:]
+	default:
+		return func() {}
+	}
+	branch := strings.TrimSuffix(strings.Join(rest[2:], "/"), ".zip")
+	if b, ok := strings.CutSuffix(branch, ".legacy"); ok {
+		branch = b + "-legacy"
+	}
+	return s.acquire(user, rest[0]+"/"+rest[1], branch)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Token kinds reported by ValidateToken, from GitHub's token prefixes.
+const (
+	TokenClassic     = "classic"      // ghp_
+	TokenFineGrained = "fine-grained" // github_pat_
+	TokenApp         = "app"          // ghs_ installation token
+	TokenOAuth       = "oauth"        // gho_, ghu_
+	TokenUnknown     = "unknown"
+	TokenNone        = "none" // a routed credential without a token
+)
+
+// TokenValidation is the result of ValidateToken. Valid is true when GitHub
+// accepted the token and, if a repository was given, the token can read its
+// contents, which is what archive downloads need.
+type TokenValidation struct {
+	Valid bool   `json:"valid"`
+	Kind  string `json:"kind"`
+	Login string `json:"login,omitempty"`
+	// Scopes are a classic token's OAuth scopes (X-OAuth-Scopes).
+	Scopes []string `json:"scopes,omitempty"`
+	// ExpiresAt is GitHub-Authentication-Token-Expiration, sent for
+	// fine-grained and expiring classic tokens.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Repo      string     `json:"repo,omitempty"`
+	// Permissions are the token's permissions on Repo as GitHub reports
+	// them (admin, maintain, push, triage, pull).
+	Permissions map[string]bool `json:"permissions,omitempty"`
+	// ContentsRead reports whether the token could list Repo's commits,
+	// which needs the same Contents read access as the archive download.
+	ContentsRead *bool `json:"contents_read,omitempty"`
+	// Problem explains why Valid is false.
+	Problem string `json:"problem,omitempty"`
+	// Credential names the routed credential that was checked when the
+	// request carried no token (see TokenRoutes).
+	Credential string `json:"credential,omitempty"`
+}
+
+// tokenExpiryLayouts are the formats of GitHub-Authentication-Token-Expiration.
+var tokenExpiryLayouts = []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700"}
+
+func tokenKind(token string) string {
+	switch {
+	case strings.HasPrefix(token, "github_pat_"):
+		return TokenFineGrained
+	case strings.HasPrefix(token, "ghp_"):
+		return TokenClassic
+	case strings.HasPrefix(token, "ghs_"):
+		return TokenApp
+	case strings.HasPrefix(token, "gho_"), strings.HasPrefix(token, "ghu_"):
+		return TokenOAuth
+	}
+	return TokenUnknown
+}
+
+// ValidateToken checks token against GitHub and, when ownerRepo is set,
+// whether it can read that repository. User tokens are checked with /user;
+// app installation tokens, which /user rejects, with
+// /installation/repositories. A rejected token or missing access is
+// reported in the result, not as an error; errors mean GitHub could not be
+// asked (rate limits, network). Nothing is cached, so a failed validation
+// never marks a repository as missing for later downloads.
+func (s *Storage) ValidateToken(ctx context.Context, token, ownerRepo string) (*TokenValidation, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, fmt.Errorf("token required: %w", ErrBadPath)
+	}
+	ownerRepo = strings.Trim(strings.TrimSpace(ownerRepo), "/")
+	if ownerRepo != "" && strings.Count(ownerRepo, "/") != 1 {
+		return nil, fmt.Errorf("owner/repo expected: %w", ErrBadPath)
+	}
+	v := &TokenValidation{Kind: tokenKind(token), Repo: ownerRepo}
+
+	identity := "https://api.github.com/user"
+	if v.Kind == TokenApp {
+		identity = "https://api.github.com/installation/repositories?per_page=1"
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	resp, err := s.githubAPI(ctx, identity, token, &user)
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind != TokenApp {
+		v.Login = user.Login
+	}
+	for _, sc := range strings.Split(resp.Header.Get("X-OAuth-Scopes"), ",") {
+		if sc = strings.TrimSpace(sc); sc != "" {
+			v.Scopes = append(v.Scopes, sc)
+		}
+	}
+	sort.Strings(v.Scopes)
+	if exp := strings.TrimSpace(resp.Header.Get("GitHub-Authentication-Token-Expiration")); exp != "" {
+		for _, layout := range tokenExpiryLayouts {
+			if t, err := time.Parse(layout, exp); err == nil {
+				t = t.UTC()
+				v.ExpiresAt = &t
+				break
+			}
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		v.Problem = "GitHub rejected the token (bad credentials, revoked or expired)"
+		return v, nil
+	case resp.StatusCode != http.StatusOK:
+		v.Problem = fmt.Sprintf("GitHub answered %d to %s", resp.StatusCode, identity)
+		return v, nil
+	}
+	if v.ExpiresAt != nil && v.ExpiresAt.Before(s.Now()) {
+		v.Problem = "token expired"
+		return v, nil
+	}
+	if ownerRepo == "" {
+		v.Valid = true
+		return v, nil
+	}
+
+	var repo struct {
+		Permissions map[string]bool `json:"permissions"`
+	}
+	resp, err = s.githubAPI(ctx, "https://api.github.com/repos/"+ownerRepo, token, &repo)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		v.Problem = fmt.Sprintf("repository %s is not visible to this token (GitHub answered %d)", ownerRepo, resp.StatusCode)
+		return v, nil
+	}
+	v.Permissions = repo.Permissions
+	resp, err = s.githubAPI(ctx, "https://api.github.com/repos/"+ownerRepo+"/commits?per_page=1", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	read := resp.StatusCode == http.StatusOK
+	v.ContentsRead = &read
+	if !read {
+		v.Problem = fmt.Sprintf("token cannot read the contents of %s (GitHub answered %d); grant Contents: read", ownerRepo, resp.StatusCode)
+		return v, nil
+	}
+	v.Valid = true
+	return v, nil
+}
+
+// githubAPI GETs apiURL with token and decodes a 200 body into out when it
+// is non-nil. Other statuses are returned for the caller to judge, except
+// rate limits, which are errors. The body is closed.
+func (s *Storage) githubAPI(ctx context.Context, apiURL, token string, out any) (*http.Response, error) {
+	ctx, cancel := s.apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.doGitHub(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if isRateLimited(resp) {
+		return nil, rateLimitError(resp, fmt.Errorf("github api: status=%d", resp.StatusCode))
+	}
+	if resp.StatusCode == http.StatusOK && out != nil {
+		if err := decodeAPI("github api", resp.Body, out); err != nil {
+			return nil, err
+		}
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	return resp, nil
+}
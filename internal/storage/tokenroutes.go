@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenRoutes picks the GitHub credential for calls made without a token,
+// so different owners can use different tokens. Routes are tried in order;
+// the first whose pattern matches owner/repo names the credential, and the
+// default credential covers everything else. A credential may be empty to
+// call GitHub anonymously.
+type TokenRoutes struct {
+	// Debug logs which credential each tokenless call was routed to, by
+	// name; tokens are never logged.
+	Debug bool
+
+	creds  map[string]string
+	routes []tokenRoute
+	def    string
+}
+
+type tokenRoute struct {
+	pattern repoPattern
+	cred    string
+}
+
+// NewTokenRoutes builds a routing table. routes are "pattern=credential"
+// entries; a pattern is a repo pattern as in RepoPolicy, and a bare owner
+// ("myorg") means all of its repos. defaultCred names the credential for
+// unmatched repos. Every named credential must exist in creds.
+func NewTokenRoutes(creds map[string]string, routes []string, defaultCred string) (*TokenRoutes, error) {
+	t := &TokenRoutes{creds: make(map[string]string, len(creds)), def: strings.TrimSpace(defaultCred)}
+	for name, token := range creds {
+		t.creds[strings.TrimSpace(name)] = strings.TrimSpace(token)
+	}
+	if _, ok := t.creds[t.def]; !ok {
+		return nil, fmt.Errorf("token routes: default credential %q is not defined", t.def)
+	}
+	for _, r := range routes {
+		pat, cred, ok := strings.Cut(r, "=")
+		pat, cred = strings.TrimSpace(pat), strings.TrimSpace(cred)
+		if !ok || pat == "" || cred == "" {
+			return nil, fmt.Errorf("token route %q must be \"pattern=credential\"", r)
+		}
+		if _, ok := t.creds[cred]; !ok {
+			return nil, fmt.Errorf("token route %q: credential %q is not defined", r, cred)
+		}
+		if !strings.Contains(pat, "/") && !strings.HasPrefix(pat, "re:") {
+			pat += "/*"
+		}
+		compiled, err := compilePatterns([]string{pat})
+		if err != nil {
+			return nil, fmt.Errorf("token route %q: %w", r, err)
+		}
+		t.routes = append(t.routes, tokenRoute{pattern: compiled[0], cred: cred})
+	}
+	return t, nil
+}
+
+// Resolve returns the name and token of the credential for ownerRepo.
+func (t *TokenRoutes) Resolve(ownerRepo string) (name, token string) {
+	ownerRepo = strings.Trim(strings.TrimSpace(ownerRepo), "/")
+	name = t.def
+	for _, r := range t.routes {
+		if r.pattern.match(ownerRepo) {
+			name = r.cred
+			break
+		}
+	}
+	return name, t.creds[name]
+}
+
+// SetTokenRoutes replaces the token routing table; safe to call while
+// serving. nil leaves tokenless calls anonymous.
+func (s *Storage) SetTokenRoutes(t *TokenRoutes) {
+	s.tokenRoutes.Store(t)
+}
+
+// tokenFor is token, or the routed credential for ownerRepo when token is
+// empty.
+func (s *Storage) tokenFor(ownerRepo, token string) string {
+	if strings.TrimSpace(token) != "" {
+		return token
+	}
+	routes := s.tokenRoutes.Load()
+	if routes == nil {
+		return token
+	}
+	name, routed := routes.Resolve(ownerRepo)
+	if routes.Debug {
+		fmt.Printf("debug: token route repo=%s credential=%s\n", ownerRepo, name)
+	}
+	return routed
+}
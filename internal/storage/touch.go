@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTouchInterval is how often New lets the access time of one cache
+// entry be written to disk (see Storage.TouchInterval).
+const DefaultTouchInterval = time.Minute
+
+// touchLog coalesces access-time writes: an entry written less than
+// TouchInterval ago only has its newest access remembered until
+// FlushTouches or SyncTouches writes it.
+type touchLog struct {
+	mu      sync.Mutex
+	written map[string]time.Time // stored path -> last access written
+	pending map[string]time.Time // stored path -> newer access not yet written
+}
+
+func (s *Storage) touch(abs string) error {
+	now := s.Now()
+	path := storedPath(abs)
+	if !s.touches.due(path, now, s.TouchInterval) {
+		return nil
+	}
+	return os.Chtimes(path, now, now)
+}
+
+// due reports whether the access at now must be written to path; when not,
+// it is kept as pending.
+func (t *touchLog) due(path string, now time.Time, interval time.Duration) bool {
+	if interval <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.written[path]; ok && now.Sub(last) < interval {
+		if t.pending == nil {
+			t.pending = map[string]time.Time{}
+		}
+		t.pending[path] = now
+		return false
+	}
+	if t.written == nil {
+		t.written = map[string]time.Time{}
+	}
+	t.written[path] = now
+	delete(t.pending, path)
+	return true
+}
+
+// take removes and returns the pending accesses; all takes every one,
+// otherwise only those whose entry was written at least interval before
+// now. Written entries older than interval are forgotten.
+func (t *touchLog) take(now time.Time, interval time.Duration, all bool) map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]time.Time{}
+	for path, at := range t.pending {
+		if all || now.Sub(t.written[path]) >= interval {
+			out[path] = at
+			t.written[path] = now
+			delete(t.pending, path)
+		}
+	}
+	for path, last := range t.written {
+		if _, ok := t.pending[path]; !ok && now.Sub(last) >= interval {
+			delete(t.written, path)
+		}
+	}
+	return out
+}
+
+// FlushTouches writes the coalesced access times that are due: those of
+// entries last written at least TouchInterval ago. Servers call it
+// periodically; it returns how many were written.
+func (s *Storage) FlushTouches() int {
+	return s.writeTouches(s.touches.take(s.Now(), s.TouchInterval, false))
+}
+
+// SyncTouches writes every coalesced access time now, as cleanup does before
+// reading mtimes and servers do on shutdown.
+func (s *Storage) SyncTouches() int {
+	return s.writeTouches(s.touches.take(s.Now(), s.TouchInterval, true))
+}
+
+func (s *Storage) writeTouches(pending map[string]time.Time) int {
+	n := 0
+	for path, at := range pending {
+		if err := os.Chtimes(path, at, at); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("touch %s: %v\n", path, err)
+			}
+			continue
+		}
+		n++
+	}
+	return n
+}
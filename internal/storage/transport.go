@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TransportOptions tunes the connection pool of the upstream transport,
+// which GitHub API calls, archive downloads and package fetches share.
+// Zero fields take the defaults of DefaultTransportOptions.
+type TransportOptions struct {
+	// MaxIdleConns caps idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps idle connections kept per host. Go's default
+	// of 2 is far below a warm-up's concurrency, so most connections to
+	// codeload would be closed after one request and left in TIME_WAIT.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps connections per host, dialing or in use;
+	// negative means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes connections idle for longer.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 stops the transport attempting HTTP/2, which it otherwise
+	// does even with the custom dialer.
+	DisableHTTP2 bool
+}
+
+// DefaultTransportOptions returns the pool settings New uses.
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+func (o TransportOptions) withDefaults() TransportOptions {
+	d := DefaultTransportOptions()
+	if o.MaxIdleConns <= 0 {
+		o.MaxIdleConns = d.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost < 0 {
+		o.MaxConnsPerHost = 0
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = d.IdleConnTimeout
+	}
+	return o
+}
+
+// newTransport builds the upstream transport; dials and connection reuse
+// are counted in c.
+func newTransport(o TransportOptions, c *counters) http.RoundTripper {
+	o = o.withDefaults()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := http.ProxyFromEnvironment(req)
+			if dc, ok := req.Context().Value(dialCheckKey{}).(*dialCheck); ok && u != nil {
+				dc.proxies.Store(proxyAddr(u), true)
+			}
+			return u, err
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c.dials.Add(1)
+			if dc, ok := ctx.Value(dialCheckKey{}).(*dialCheck); ok && dc.applies(addr) {
+				d := *dialer
+				d.ControlContext = dc.control
+				return d.DialContext(ctx, network, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     !o.DisableHTTP2,
+		MaxIdleConns:          o.MaxIdleConns,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       o.MaxConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &connCounter{base: t, stats: c}
+}
+
+// dialCheckKey carries the dialCheck of a package download.
+type dialCheckKey struct{}
+
+// dialCheck applies PackageHostCheck to the address each connection of a
+// package download goes to, once the dialer has resolved it, so a host
+// that resolves to another address than it did when its URL was checked
+// is still refused.
+type dialCheck struct {
+	check func(context.Context, *url.URL) error
+	// exempt is a host whose connections are not checked: a package
+	// mirror, which is the operator's own.
+	exempt string
+	// proxies holds the proxies the download's requests went through.
+	// The proxy connects to the host itself, so only the URL checks
+	// apply then.
+	proxies sync.Map
+}
+
+// withDialCheck makes the connections of the package download ctx is for
+// pass PackageHostCheck, except those to exempt.
+func (s *Storage) withDialCheck(ctx context.Context, exempt string) context.Context {
+	if s.PackageHostCheck == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, dialCheckKey{}, &dialCheck{check: s.PackageHostCheck, exempt: exempt})
+}
+
+func (dc *dialCheck) applies(addr string) bool {
+	if _, ok := dc.proxies.Load(addr); ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err != nil || dc.exempt == "" || !strings.EqualFold(host, dc.exempt)
+}
+
+// control is the dialer's ControlContext: address is the IP and port about
+// to be connected to.
+func (dc *dialCheck) control(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	if err := dc.check(ctx, &url.URL{Host: address}); err != nil {
+		return fmt.Errorf("connect to %s refused: %w", address, err)
+	}
+	return nil
+}
+
+// proxyAddr is the address the transport dials for proxy u.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// connCounter counts, per upstream request, whether the transport reused a
+// pooled connection.
+type connCounter struct {
+	base  *http.Transport
+	stats *counters
+}
+
+func (t *connCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.stats.reusedConns.Add(1)
+			}
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// CloseIdleConnections closes the pooled connections, as http.Client does
+// for transports that support it.
+func (t *connCounter) CloseIdleConnections() { t.base.CloseIdleConnections() }
+
+// SetTransport replaces the default client's transport with one tuned by o,
+// keeping its timeout. Connections of the previous transport are closed
+// once idle. It has no effect on a client set through HTTPClient (other
+// than the default one), whose transport is the caller's to tune; call it
+// before the Storage is in use.
+func (s *Storage) SetTransport(o TransportOptions) {
+	if s.HTTPClient == nil || s.HTTPClient != s.defaultClient {
+		return
+	}
+	old := s.HTTPClient.Transport
+	client := &http.Client{Transport: newTransport(o, &s.stats), Timeout: s.HTTPClient.Timeout}
+	s.HTTPClient, s.defaultClient = client, client
+	if t, ok := old.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
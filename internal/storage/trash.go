@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashDir holds soft-deleted items under the root, one directory per
+// delete: trash/<id>/ with the item under its base name and trashMetaName
+// recording where it came from.
+const (
+	trashDir      = "trash"
+	trashMetaName = ".trash.json"
+)
+
+// TrashEntry describes one soft-deleted item.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"` // original path relative to the root
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// inTrash reports whether abs is the trash directory or inside it.
+func (s *Storage) inTrash(abs string) bool {
+	trash := filepath.Join(filepath.Clean(s.Root), trashDir)
+	return abs == trash || strings.HasPrefix(abs, trash+string(os.PathSeparator))
+}
+
+// moveToTrash moves abs (rel to the root) to trash/<timestamp>-<path>/.
+func (s *Storage) moveToTrash(abs, rel string) (*TrashEntry, error) {
+	info, err := os.Stat(abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	now := s.Now().UTC()
+	id := now.Format("20060102T150405.000000000Z") + "-" + sanitizeName(rel)
+	dir := filepath.Join(s.Root, trashDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entry := &TrashEntry{ID: id, Path: rel, IsDir: info.IsDir(), Size: treeSize(abs), DeletedAt: now}
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, trashMetaName), b, 0o644); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := os.Rename(abs, filepath.Join(dir, filepath.Base(abs))); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	fmt.Printf("trash: moved %s to %s\n", rel, filepath.ToSlash(filepath.Join(trashDir, id)))
+	return entry, nil
+}
+
+func treeSize(abs string) int64 {
+	var n int64
+	_ = filepath.Walk(abs, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// ListTrash returns the soft-deleted items, most recently deleted first.
+func (s *Storage) ListTrash() ([]TrashEntry, error) {
+	dirs, err := os.ReadDir(filepath.Join(s.Root, trashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashEntry{}, nil
+		}
+		return nil, err
+	}
+	out := make([]TrashEntry, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if e, err := s.readTrashEntry(d.Name()); err == nil {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeletedAt.After(out[j].DeletedAt) })
+	return out, nil
+}
+
+func (s *Storage) readTrashEntry(id string) (*TrashEntry, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid trash id %q: %w", id, ErrBadPath)
+	}
+	b, err := os.ReadFile(filepath.Join(s.Root, trashDir, id, trashMetaName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("trash %s: %w", id, ErrNotFound)
+		}
+		return nil, err
+	}
+	var e TrashEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	e.ID = id
+	return &e, nil
+}
+
+// Restore moves a soft-deleted item back to its original path. It fails
+// with ErrExists when something has been created there since.
+func (s *Storage) Restore(id string) (*TrashEntry, error) {
+	e, err := s.readTrashEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := s.safeJoin(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	if s.inTrash(dst) || dst == filepath.Clean(s.Root) {
+		return nil, fmt.Errorf("restore %s: %w", e.Path, ErrBadPath)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil, fmt.Errorf("restore %s: %w", e.Path, ErrExists)
+	}
+	dir := filepath.Join(s.Root, trashDir, id)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(dir, filepath.Base(dst)), dst); err != nil {
+		return nil, err
+	}
+	_ = os.RemoveAll(dir)
+	fmt.Printf("trash: restored %s from %s\n", e.Path, id)
+	return e, nil
+}
+
+// purgeTrash permanently removes items deleted longer than TrashRetention ago.
+func (s *Storage) purgeTrash(report *CleanupReport) {
+	if s.TrashRetention <= 0 {
+		return
+	}
+	entries, err := s.ListTrash()
+	if err != nil {
+		return
+	}
+	cutoff := s.Now().Add(-s.TrashRetention)
+	for _, e := range entries {
+		if e.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.Root, trashDir, e.ID)); err != nil {
+			fmt.Printf("trash: purge %s: %v\n", e.ID, err)
+			continue
+		}
+		report.Trash = append(report.Trash, e.Path)
+	}
+}
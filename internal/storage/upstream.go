@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors from talking to GitHub or a package host. Together with
+// ErrRepoNotFound, ErrBranchNotFound, ErrEmptyRepo and ErrRateLimited (see
+// RateLimitError for the advised wait) they classify every upstream failure
+// of EnsureRepo, EnsurePackage and the downloads behind them; what is left
+// unclassified failed locally.
+var (
+	// ErrUpstreamUnavailable reports that upstream could not be reached,
+	// broke off a download or answered with an error status.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrUnauthorizedUpstream reports that upstream refused the request's
+	// credentials (401, or 403 without a rate limit).
+	ErrUnauthorizedUpstream = errors.New("upstream refused credentials")
+)
+
+// maxErrorBody bounds how much of an upstream error response is read: error
+// pages can be large and a burst of them should not hold megabytes or end
+// up in full in the logs.
+const maxErrorBody = 4 << 10
+
+// truncatedMarker ends a StatusError snippet cut at maxErrorBody.
+const truncatedMarker = " ...[truncated]"
+
+// StatusError is an upstream answer with an unexpected status. Message and
+// DocumentationURL are the fields of GitHub's JSON error body when it has
+// them; otherwise Snippet holds the start of the body, whitespace
+// collapsed, ending in " ...[truncated]" when it was cut. It wraps the
+// status's kind (see upstreamStatus).
+type StatusError struct {
+	Op               string // what failed, e.g. "download" or "branch sha"
+	Status           int
+	Message          string
+	DocumentationURL string
+	Snippet          string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s failed: status=%d", e.Op, e.Status)
+	switch {
+	case e.Message != "":
+		msg += " message=" + strconv.Quote(e.Message)
+		if e.DocumentationURL != "" {
+			msg += " documentation_url=" + e.DocumentationURL
+		}
+	case e.Snippet != "":
+		msg += " body=" + e.Snippet
+	}
+	return msg
+}
+
+func (e *StatusError) Unwrap() error { return upstreamStatus(e.Status) }
+
+// readStatusError reads at most maxErrorBody of resp's body into a
+// StatusError for op, and returns what it read for callers that look
+// further into it.
+func readStatusError(op string, resp *http.Response) (*StatusError, []byte) {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+	truncated := len(b) > maxErrorBody
+	if truncated {
+		b = b[:maxErrorBody]
+	}
+	e := &StatusError{Op: op, Status: resp.StatusCode}
+	var gh struct {
+		Message          string `json:"message"`
+		DocumentationURL string `json:"documentation_url"`
+	}
+	if !truncated && json.Unmarshal(b, &gh) == nil && strings.TrimSpace(gh.Message) != "" {
+		e.Message, e.DocumentationURL = strings.TrimSpace(gh.Message), strings.TrimSpace(gh.DocumentationURL)
+		return e, b
+	}
+	e.Snippet = strings.Join(strings.Fields(strings.ToValidUTF8(string(b), "")), " ")
+	if truncated {
+		e.Snippet += truncatedMarker
+	}
+	return e, b
+}
+
+// upstreamStatus is the error kind of an upstream answer with a non-2xx
+// status that is not a rate limit.
+func upstreamStatus(status int) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorizedUpstream
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return ErrUpstreamUnavailable
+}
+
+// upstreamFailure classifies an error from sending a request upstream or
+// reading its body. Errors that are the caller giving up stay what they
+// are, and so do errors that are already classified; a GitHub API call
+// that ran out of time (see apiContext) fails with ErrUpstreamUnavailable.
+func upstreamFailure(ctx context.Context, err error) error {
+	if err != nil && apiTimedOut(ctx) {
+		return fmt.Errorf("%w (%v)", context.Cause(ctx), err)
+	}
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrRedirectPolicy) || errors.Is(err, ErrBlockedHost) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+}
+
+// upstreamResponse classifies the outcome of sending req: the error, or
+// later the read errors of the body.
+func upstreamResponse(req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, upstreamFailure(req.Context(), err)
+	}
+	resp.Body = &upstreamReader{ReadCloser: resp.Body, ctx: req.Context()}
+	return resp, nil
+}
+
+// upstreamReader classifies the read errors of a response body.
+type upstreamReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *upstreamReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = upstreamFailure(r.ctx, err)
+	}
+	return n, err
+}
+
+// gitFailure classifies a failed git fetch or clone of ownerRepo from what
+// git printed to stderr, git having no better way to say why.
+func gitFailure(op, ownerRepo, token string, stderr []byte, err error) error {
+	msg := strings.ToLower(string(stderr))
+	var kind error = ErrUpstreamUnavailable
+	switch {
+	case strings.Contains(msg, "repository not found"), strings.Contains(msg, "not found") && strings.Contains(msg, "remote:"):
+		return fmt.Errorf("%s: %w", op, &NotFoundError{Repo: ownerRepo, Token: strings.TrimSpace(token) != ""})
+	case strings.Contains(msg, "authentication failed"), strings.Contains(msg, "could not read username"),
+		strings.Contains(msg, "could not read password"), strings.Contains(msg, "403"):
+		kind = ErrUnauthorizedUpstream
+	}
+	return fmt.Errorf("%s failed: %w: %w", op, kind, err)
+}
+
+// gitStderr tees what git prints to w and keeps the tail for gitFailure.
+type gitStderr struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (g *gitStderr) Write(p []byte) (int, error) {
+	g.buf.Write(p)
+	if over := g.buf.Len() - 4096; over > 0 {
+		g.buf.Next(over)
+	}
+	return g.w.Write(p)
+}
@@ -0,0 +1,326 @@
+package testutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeGitHub serves the parts of api.github.com and codeload.github.com
+// that zipball (legacy) downloads use, from repos pushed with Push. Point a
+// client at it with Transport: requests for those hosts reach the fake
+// with their path prefixed by /api or /codeload, which is also how Fail
+// and Requests name them. Branch and git ref answers carry an ETag and
+// answer 304 to a matching If-None-Match. Git-mode clones are not served.
+type FakeGitHub struct {
+	Server *httptest.Server
+
+	mu       sync.Mutex
+	repos    map[string]*fakeRepo // by lower-case owner/repo
+	failures map[string]int       // path prefix -> status
+	requests []string             // prefixed paths, in order
+	pushes   int
+	notMod   int // 304 answers
+}
+
+type fakeRepo struct {
+	name          string // owner/repo as pushed
+	defaultBranch string
+	branches      map[string]string            // branch -> commit
+	commits       map[string]map[string]string // commit -> files
+}
+
+// NewFakeGitHub starts a fake GitHub that is closed when t ends.
+func NewFakeGitHub(t testing.TB) *FakeGitHub {
+	g := &FakeGitHub{repos: map[string]*fakeRepo{}, failures: map[string]int{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/repos/{owner}/{repo}", g.handleRepo)
+	mux.HandleFunc("GET /api/repos/{owner}/{repo}/branches/{branch...}", g.handleBranch)
+	mux.HandleFunc("GET /api/repos/{owner}/{repo}/git/ref/heads/{branch...}", g.handleRef)
+	mux.HandleFunc("GET /api/repos/{owner}/{repo}/commits/{ref...}", g.handleCommit)
+	mux.HandleFunc("GET /codeload/{owner}/{repo}/zip/{ref...}", g.handleZip)
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.EscapedPath()
+		g.mu.Lock()
+		g.requests = append(g.requests, p)
+		status := 0
+		for prefix, st := range g.failures {
+			if strings.HasPrefix(p, prefix) {
+				status = st
+			}
+		}
+		g.mu.Unlock()
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(g.Server.Close)
+	return g
+}
+
+// Push commits files to branch of repo ("owner/repo"), creating both as
+// needed, and returns the new commit's SHA. The first branch pushed to a
+// repo is its default branch.
+func (g *FakeGitHub) Push(repo, branch string, files map[string]string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r := g.repos[strings.ToLower(repo)]
+	if r == nil {
+		r = &fakeRepo{name: repo, defaultBranch: branch, branches: map[string]string{}, commits: map[string]map[string]string{}}
+		g.repos[strings.ToLower(repo)] = r
+	}
+	g.pushes++
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", repo, branch, g.pushes)
+	sha := hex.EncodeToString(h.Sum(nil))
+	copied := make(map[string]string, len(files))
+	for name, body := range files {
+		copied[name] = body
+	}
+	r.commits[sha] = copied
+	r.branches[branch] = sha
+	return sha
+}
+
+// DeleteBranch removes branch from repo; its commits stay downloadable.
+func (g *FakeGitHub) DeleteBranch(repo, branch string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r := g.repos[strings.ToLower(repo)]; r != nil {
+		delete(r.branches, branch)
+	}
+}
+
+// Fail answers every request whose prefixed path starts with prefix with
+// status, e.g. Fail("/codeload/acme/app", 500); status 0 clears it.
+func (g *FakeGitHub) Fail(prefix string, status int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if status == 0 {
+		delete(g.failures, prefix)
+		return
+	}
+	g.failures[prefix] = status
+}
+
+// Requests counts the requests whose prefixed path starts with prefix.
+func (g *FakeGitHub) Requests(prefix string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, p := range g.requests {
+		if strings.HasPrefix(p, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// NotModified counts the 304 answers to conditional requests.
+func (g *FakeGitHub) NotModified() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.notMod
+}
+
+// Transport sends api.github.com and codeload.github.com requests to the
+// fake and refuses every other host.
+func (g *FakeGitHub) Transport() http.RoundTripper {
+	base, _ := url.Parse(g.Server.URL)
+	next := g.Server.Client().Transport
+	return roundTrip(func(req *http.Request) (*http.Response, error) {
+		var prefix string
+		switch strings.ToLower(req.URL.Hostname()) {
+		case "api.github.com":
+			prefix = "/api"
+		case "codeload.github.com":
+			prefix = "/codeload"
+		default:
+			return nil, fmt.Errorf("fake github: unexpected host %s", req.URL.Host)
+		}
+		out := req.Clone(req.Context())
+		u := *req.URL
+		u.Scheme, u.Host = base.Scheme, base.Host
+		u.Path = prefix + req.URL.Path
+		if req.URL.RawPath != "" {
+			u.RawPath = prefix + req.URL.RawPath
+		}
+		out.URL, out.Host = &u, ""
+		return next.RoundTrip(out)
+	})
+}
+
+// Client is an http.Client using Transport.
+func (g *FakeGitHub) Client() *http.Client {
+	return &http.Client{Transport: g.Transport()}
+}
+
+type roundTrip func(*http.Request) (*http.Response, error)
+
+func (f roundTrip) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func (g *FakeGitHub) repo(r *http.Request) *fakeRepo {
+	return g.repos[strings.ToLower(r.PathValue("owner")+"/"+r.PathValue("repo"))]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": msg})
+}
+
+func (g *FakeGitHub) handleRepo(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	repo := g.repo(r)
+	if repo == nil {
+		notFound(w, "Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"full_name": repo.name, "default_branch": repo.defaultBranch})
+}
+
+func (g *FakeGitHub) handleBranch(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	repo := g.repo(r)
+	if repo == nil {
+		notFound(w, "Not Found")
+		return
+	}
+	branch := r.PathValue("branch")
+	sha, ok := repo.branches[branch]
+	if !ok {
+		notFound(w, "Branch not found")
+		return
+	}
+	if g.notModified(w, r, "branch", sha) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"name": branch, "commit": map[string]string{"sha": sha}})
+}
+
+func (g *FakeGitHub) handleRef(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	repo := g.repo(r)
+	if repo == nil {
+		notFound(w, "Not Found")
+		return
+	}
+	branch := r.PathValue("branch")
+	sha, ok := repo.branches[branch]
+	if !ok {
+		notFound(w, "Not Found")
+		return
+	}
+	if g.notModified(w, r, "ref", sha) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ref": "refs/heads/" + branch, "object": map[string]string{"sha": sha, "type": "commit"}})
+}
+
+// notModified sets the ETag of an answer about sha and answers 304 when
+// the request already has it; g.mu must be held.
+func (g *FakeGitHub) notModified(w http.ResponseWriter, r *http.Request, kind, sha string) bool {
+	etag := `"` + kind + "-" + sha + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") != etag {
+		return false
+	}
+	g.notMod++
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func (g *FakeGitHub) handleCommit(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	repo := g.repo(r)
+	if repo == nil {
+		notFound(w, "Not Found")
+		return
+	}
+	sha, ok := repo.resolve(r.PathValue("ref"))
+	if !ok {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "No commit found for SHA: " + r.PathValue("ref")})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"sha": sha})
+}
+
+func (g *FakeGitHub) handleZip(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	repo := g.repo(r)
+	var files map[string]string
+	var sha string
+	if repo != nil {
+		var ok bool
+		if sha, ok = repo.resolve(r.PathValue("ref")); ok {
+			files = repo.commits[sha]
+		}
+	}
+	g.mu.Unlock()
+	if files == nil {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := zipFiles(path.Base(repo.name)+"-"+sha+"/", files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	_, _ = w.Write(b)
+}
+
+// resolve maps a branch name or a full commit SHA to a commit.
+func (r *fakeRepo) resolve(ref string) (string, bool) {
+	if sha, ok := r.branches[ref]; ok {
+		return sha, true
+	}
+	_, ok := r.commits[ref]
+	return ref, ok
+}
+
+// zipFiles builds a zipball with files under prefix, in name order so the
+// same commit always yields the same bytes.
+func zipFiles(prefix string, files map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: prefix + name, Method: zip.Deflate})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(files[name])); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
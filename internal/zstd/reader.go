@@ -0,0 +1,421 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// maxWindow bounds the history a frame may ask the Reader to keep.
+const maxWindow = 8 << 20
+
+// Reader decompresses a stream of zstd frames.
+type Reader struct {
+	r        io.Reader
+	buf      []byte // history window followed by decoded, unread output
+	pos      int    // next unread byte of buf
+	window   int
+	inFrame  bool
+	checksum bool
+	rep      [3]uint32
+	scratch  []byte
+	err      error
+}
+
+// NewReader returns a Reader decompressing r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read implements io.Reader.
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.pos == len(z.buf) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.buf[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+// next decodes one more block, reading a frame header first when needed.
+func (z *Reader) next() error {
+	if !z.inFrame {
+		if err := z.frameHeader(); err != nil {
+			return err
+		}
+	}
+	// Drop history the window no longer needs.
+	if z.pos > 2*z.window {
+		drop := z.pos - z.window
+		z.buf = append(z.buf[:0], z.buf[drop:]...)
+		z.pos -= drop
+	}
+	var hdr [3]byte
+	if err := z.readFull(hdr[:]); err != nil {
+		return err
+	}
+	bh := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+	size := int(bh >> 3)
+	if size > maxBlockSize {
+		return ErrCorrupt
+	}
+	switch (bh >> 1) & 3 {
+	case blockRaw:
+		start := len(z.buf)
+		z.buf = append(z.buf, make([]byte, size)...)
+		if err := z.readFull(z.buf[start:]); err != nil {
+			return err
+		}
+	case blockRLE:
+		var b [1]byte
+		if err := z.readFull(b[:]); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			z.buf = append(z.buf, b[0])
+		}
+	case blockCompressed:
+		if cap(z.scratch) < size {
+			z.scratch = make([]byte, size)
+		}
+		data := z.scratch[:size]
+		if err := z.readFull(data); err != nil {
+			return err
+		}
+		if err := z.compressedBlock(data); err != nil {
+			return err
+		}
+	default:
+		return ErrCorrupt
+	}
+	if bh&1 == 1 {
+		z.inFrame = false
+		// The optional content checksum is skipped, not verified.
+		if z.checksum {
+			var sum [4]byte
+			if err := z.readFull(sum[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readFull reads len(b) bytes, reporting a short read as truncation.
+func (z *Reader) readFull(b []byte) error {
+	_, err := io.ReadFull(z.r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// frameHeader reads the next frame header, skipping skippable frames. It
+// returns io.EOF when the input ends cleanly between frames.
+func (z *Reader) frameHeader() error {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(z.r, b[:4]); err != nil {
+			if err == io.EOF {
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+		magic := binary.LittleEndian.Uint32(b[:4])
+		if magic == frameMagic {
+			break
+		}
+		if magic&0xFFFFFFF0 != skippableMagic {
+			return fmt.Errorf("%w: bad magic %#x", ErrCorrupt, magic)
+		}
+		if err := z.readFull(b[:4]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, z.r, int64(binary.LittleEndian.Uint32(b[:4]))); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	if err := z.readFull(b[:1]); err != nil {
+		return err
+	}
+	d := b[0]
+	if d&0x08 != 0 {
+		return fmt.Errorf("%w: reserved header bit set", ErrCorrupt)
+	}
+	single := d&0x20 != 0
+	z.checksum = d&0x04 != 0
+	if !single {
+		if err := z.readFull(b[:1]); err != nil {
+			return err
+		}
+		wlog := 10 + int(b[0]>>3)
+		if wlog > 23 {
+			return fmt.Errorf("%w: window log %d", ErrUnsupported, wlog)
+		}
+		z.window = 1<<wlog + 1<<wlog/8*int(b[0]&7)
+	}
+	if n := [4]int{0, 1, 2, 4}[d&3]; n > 0 {
+		if err := z.readFull(b[:n]); err != nil {
+			return err
+		}
+		var id uint64
+		for i := 0; i < n; i++ {
+			id |= uint64(b[i]) << (8 * i)
+		}
+		if id != 0 {
+			return fmt.Errorf("%w: dictionary %d", ErrUnsupported, id)
+		}
+	}
+	fcsSize := [4]int{0, 2, 4, 8}[d>>6]
+	if single && fcsSize == 0 {
+		fcsSize = 1
+	}
+	if fcsSize > 0 {
+		if err := z.readFull(b[:fcsSize]); err != nil {
+			return err
+		}
+		var fcs uint64
+		for i := 0; i < fcsSize; i++ {
+			fcs |= uint64(b[i]) << (8 * i)
+		}
+		if fcsSize == 2 {
+			fcs += 256
+		}
+		if single {
+			// Single-segment frames use the content size as the window.
+			if fcs > maxWindow {
+				return fmt.Errorf("%w: window %d", ErrUnsupported, fcs)
+			}
+			z.window = int(fcs)
+		}
+	}
+	if z.window < maxBlockSize {
+		z.window = maxBlockSize
+	}
+	z.inFrame = true
+	z.rep = [3]uint32{1, 4, 8}
+	return nil
+}
+
+// compressedBlock decodes a compressed block onto z.buf.
+func (z *Reader) compressedBlock(data []byte) error {
+	lits, rest, err := literals(data)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return ErrCorrupt
+	}
+	var nseq int
+	switch b0 := int(rest[0]); {
+	case b0 < 128:
+		nseq, rest = b0, rest[1:]
+	case b0 < 255:
+		if len(rest) < 2 {
+			return ErrCorrupt
+		}
+		nseq, rest = (b0-128)<<8+int(rest[1]), rest[2:]
+	default:
+		if len(rest) < 3 {
+			return ErrCorrupt
+		}
+		nseq, rest = int(rest[1])+int(rest[2])<<8+0x7F00, rest[3:]
+	}
+	if nseq == 0 {
+		z.buf = append(z.buf, lits...)
+		return nil
+	}
+	if len(rest) == 0 {
+		return ErrCorrupt
+	}
+	modes := rest[0]
+	rest = rest[1:]
+	if modes&3 != 0 {
+		return fmt.Errorf("%w: reserved sequence modes", ErrCorrupt)
+	}
+	var tables [3]*fseTable
+	for i, def := range []*fseTable{llTable, ofTable, mlTable} {
+		switch (modes >> (6 - 2*i)) & 3 {
+		case 0:
+			tables[i] = def
+		case 1:
+			if len(rest) == 0 {
+				return ErrCorrupt
+			}
+			if int(rest[0]) >= len(def.enc) {
+				return ErrCorrupt
+			}
+			tables[i] = &fseTable{states: []fseState{{sym: rest[0]}}}
+			rest = rest[1:]
+		default:
+			return fmt.Errorf("%w: FSE-compressed sequence tables", ErrUnsupported)
+		}
+	}
+	llT, ofT, mlT := tables[0], tables[1], tables[2]
+
+	br, err := newBitReader(rest)
+	if err != nil {
+		return err
+	}
+	llState := br.read(llT.accLog)
+	ofState := br.read(ofT.accLog)
+	mlState := br.read(mlT.accLog)
+	start := len(z.buf)
+	for i := 0; i < nseq; i++ {
+		ofc := ofT.states[ofState].sym
+		mlc := mlT.states[mlState].sym
+		llc := llT.states[llState].sym
+		if ofc > 31 {
+			return ErrCorrupt
+		}
+		ov := uint32(1)<<ofc + uint32(br.read(ofc))
+		ml := mlBase[mlc] + uint32(br.read(mlBits[mlc]))
+		ll := llBase[llc] + uint32(br.read(llBits[llc]))
+		if i != nseq-1 {
+			llState = next(llT, llState, br)
+			mlState = next(mlT, mlState, br)
+			ofState = next(ofT, ofState, br)
+		}
+		if br.overflow() {
+			return ErrCorrupt
+		}
+
+		off := z.offset(ov, ll)
+		if off == 0 || int(ll) > len(lits) {
+			return ErrCorrupt
+		}
+		z.buf = append(z.buf, lits[:ll]...)
+		lits = lits[ll:]
+		if int(off) > len(z.buf) || int(off) > z.window {
+			return ErrCorrupt
+		}
+		if len(z.buf)-start+int(ml) > maxBlockSize {
+			return ErrCorrupt
+		}
+		from := len(z.buf) - int(off)
+		for j := 0; j < int(ml); j++ {
+			z.buf = append(z.buf, z.buf[from+j])
+		}
+	}
+	if !br.done() {
+		return ErrCorrupt
+	}
+	z.buf = append(z.buf, lits...)
+	if len(z.buf)-start > maxBlockSize {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// offset resolves an offset value against the repeat offsets and updates
+// them (RFC 8878 3.1.1.5).
+func (z *Reader) offset(ov, ll uint32) uint32 {
+	if ov > 3 {
+		off := ov - 3
+		z.rep = [3]uint32{off, z.rep[0], z.rep[1]}
+		return off
+	}
+	idx := ov - 1
+	if ll == 0 {
+		idx++
+	}
+	switch idx {
+	case 0:
+		return z.rep[0]
+	case 1:
+		z.rep = [3]uint32{z.rep[1], z.rep[0], z.rep[2]}
+	case 2:
+		z.rep = [3]uint32{z.rep[2], z.rep[0], z.rep[1]}
+	default:
+		off := z.rep[0] - 1
+		z.rep = [3]uint32{off, z.rep[0], z.rep[1]}
+	}
+	return z.rep[0]
+}
+
+func next(t *fseTable, state uint64, br *bitReader) uint64 {
+	st := t.states[state]
+	return uint64(st.baseline) + br.read(st.nbBits)
+}
+
+// literals parses a raw or RLE literals section and returns the literals
+// and the remaining block data.
+func literals(data []byte) ([]byte, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, ErrCorrupt
+	}
+	typ := data[0] & 3
+	if typ > 1 {
+		return nil, nil, fmt.Errorf("%w: Huffman-compressed literals", ErrUnsupported)
+	}
+	var size, hdr int
+	switch (data[0] >> 2) & 3 {
+	case 0, 2:
+		size, hdr = int(data[0]>>3), 1
+	case 1:
+		if len(data) < 2 {
+			return nil, nil, ErrCorrupt
+		}
+		size, hdr = int(data[0]>>4)+int(data[1])<<4, 2
+	default:
+		if len(data) < 3 {
+			return nil, nil, ErrCorrupt
+		}
+		size, hdr = int(data[0]>>4)+int(data[1])<<4+int(data[2])<<12, 3
+	}
+	if size > maxBlockSize {
+		return nil, nil, ErrCorrupt
+	}
+	if typ == 1 {
+		if len(data) < hdr+1 {
+			return nil, nil, ErrCorrupt
+		}
+		lits := make([]byte, size)
+		for i := range lits {
+			lits[i] = data[hdr]
+		}
+		return lits, data[hdr+1:], nil
+	}
+	if len(data) < hdr+size {
+		return nil, nil, ErrCorrupt
+	}
+	return data[hdr : hdr+size], data[hdr+size:], nil
+}
+
+// bitReader reads a backward bitstream from its end towards its start.
+type bitReader struct {
+	data []byte
+	pos  int // bits left to read
+}
+
+func newBitReader(data []byte) (*bitReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, ErrCorrupt
+	}
+	last := data[len(data)-1]
+	return &bitReader{data: data, pos: (len(data)-1)*8 + bits.Len8(last) - 1}, nil
+}
+
+func (b *bitReader) read(n uint8) uint64 {
+	if n == 0 {
+		return 0
+	}
+	b.pos -= int(n)
+	if b.pos < 0 {
+		return 0
+	}
+	var v uint64
+	first := b.pos >> 3
+	for i := 0; i < 8 && first+i < len(b.data); i++ {
+		v |= uint64(b.data[first+i]) << (8 * i)
+	}
+	return (v >> (b.pos & 7)) & (1<<n - 1)
+}
+
+func (b *bitReader) overflow() bool { return b.pos < 0 }
+
+func (b *bitReader) done() bool { return b.pos == 0 }
@@ -0,0 +1,236 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	hashLog  = 16
+	minMatch = 4
+)
+
+// Writer compresses everything written to it into a single zstd frame.
+// Close must be called to flush the last block; it does not close the
+// underlying writer.
+type Writer struct {
+	w       io.Writer
+	hist    []byte // window of already encoded input followed by pending input
+	done    int    // bytes of hist already encoded
+	base    int64  // absolute input offset of hist[0]
+	table   []int64
+	out     []byte
+	lits    []byte
+	seqs    []sequence
+	started bool
+	closed  bool
+	err     error
+}
+
+type sequence struct {
+	ll, ml, off uint32
+}
+
+// NewWriter returns a Writer compressing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, table: make([]int64, 1<<hashLog)}
+}
+
+// Write buffers p and emits every full block.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errors.New("zstd: write after close")
+	}
+	z.hist = append(z.hist, p...)
+	// Keep at least one byte back so Close always has a last block to mark.
+	for len(z.hist)-z.done > maxBlockSize {
+		if err := z.block(maxBlockSize, false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close emits the remaining input as the frame's last block.
+func (z *Writer) Close() error {
+	if z.closed || z.err != nil {
+		return z.err
+	}
+	z.closed = true
+	return z.block(len(z.hist)-z.done, true)
+}
+
+func (z *Writer) block(n int, last bool) error {
+	z.out = z.out[:0]
+	if !z.started {
+		z.started = true
+		// Magic, descriptor (no content size, checksum or dictionary) and
+		// a 1 MiB window.
+		z.out = binary.LittleEndian.AppendUint32(z.out, frameMagic)
+		z.out = append(z.out, 0x00, byte(windowLog-10)<<3)
+	}
+	src := z.hist[z.done : z.done+n]
+	hdr := len(z.out)
+	z.out = append(z.out, 0, 0, 0)
+	typ := blockRaw
+	if n > 0 {
+		z.compress(z.done, z.done+n)
+		if len(z.out)-hdr-3 < n {
+			typ = blockCompressed
+		} else {
+			z.out = append(z.out[:hdr+3], src...)
+		}
+	}
+	size := len(z.out) - hdr - 3
+	bh := uint32(size)<<3 | uint32(typ)<<1
+	if last {
+		bh |= 1
+	}
+	z.out[hdr], z.out[hdr+1], z.out[hdr+2] = byte(bh), byte(bh>>8), byte(bh>>16)
+	if _, err := z.w.Write(z.out); err != nil {
+		z.err = err
+		return err
+	}
+	z.done += n
+	if z.done > 2*windowSize {
+		drop := z.done - windowSize
+		z.hist = append(z.hist[:0], z.hist[drop:]...)
+		z.done -= drop
+		z.base += int64(drop)
+	}
+	return nil
+}
+
+// compress appends a compressed block body for hist[start:end] to z.out.
+func (z *Writer) compress(start, end int) {
+	h := z.hist
+	z.lits, z.seqs = z.lits[:0], z.seqs[:0]
+	anchor := start
+	for i := start; i+minMatch <= end; {
+		v := binary.LittleEndian.Uint32(h[i:])
+		key := hash4(v)
+		cand := int(z.table[key] - 1 - z.base)
+		z.table[key] = z.base + int64(i) + 1
+		if cand < 0 || i-cand > windowSize || binary.LittleEndian.Uint32(h[cand:]) != v {
+			i++
+			continue
+		}
+		ml := minMatch
+		for i+ml < end && h[cand+ml] == h[i+ml] {
+			ml++
+		}
+		z.lits = append(z.lits, h[anchor:i]...)
+		z.seqs = append(z.seqs, sequence{ll: uint32(i - anchor), ml: uint32(ml), off: uint32(i - cand)})
+		for j := i + 1; j < i+ml && j+minMatch <= end; j++ {
+			z.table[hash4(binary.LittleEndian.Uint32(h[j:]))] = z.base + int64(j) + 1
+		}
+		i += ml
+		anchor = i
+	}
+	z.lits = append(z.lits, h[anchor:end]...)
+
+	// Raw literals section.
+	switch n := len(z.lits); {
+	case n < 32:
+		z.out = append(z.out, byte(n<<3))
+	case n < 4096:
+		z.out = append(z.out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		z.out = append(z.out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	z.out = append(z.out, z.lits...)
+
+	// Sequences section header.
+	switch n := len(z.seqs); {
+	case n == 0:
+		z.out = append(z.out, 0)
+		return
+	case n < 128:
+		z.out = append(z.out, byte(n))
+	case n < 0x7F00:
+		z.out = append(z.out, byte(n>>8)+0x80, byte(n))
+	default:
+		n -= 0x7F00
+		z.out = append(z.out, 0xFF, byte(n), byte(n>>8))
+	}
+	z.out = append(z.out, 0x00) // predefined tables for all three codes
+	z.out = z.encodeSequences(z.out)
+}
+
+// encodeSequences writes the backward FSE bitstream: the decoder reads the
+// first sequence's fields last-written-first, so sequences are emitted in
+// reverse.
+func (z *Writer) encodeSequences(out []byte) []byte {
+	bw := bitWriter{out: out}
+	n := len(z.seqs)
+	codes := func(s sequence) (llc, mlc, ofc uint8, ov uint32) {
+		ov = s.off + 3
+		return llCode(s.ll), mlCode(s.ml), uint8(bits.Len32(ov) - 1), ov
+	}
+	extra := func(s sequence, llc, mlc, ofc uint8, ov uint32) {
+		bw.add(uint64(s.ll-llBase[llc]), uint(llBits[llc]))
+		bw.add(uint64(s.ml-mlBase[mlc]), uint(mlBits[mlc]))
+		bw.add(uint64(ov-1<<ofc), uint(ofc))
+	}
+
+	llc, mlc, ofc, ov := codes(z.seqs[n-1])
+	llState, mlState, ofState := llTable.enc[llc][0], mlTable.enc[mlc][0], ofTable.enc[ofc][0]
+	extra(z.seqs[n-1], llc, mlc, ofc, ov)
+	for i := n - 2; i >= 0; i-- {
+		s := z.seqs[i]
+		llc, mlc, ofc, ov = codes(s)
+		// The decoder updates LL, ML, then OF after reading each sequence.
+		ofState = transition(&bw, ofTable, ofc, ofState)
+		mlState = transition(&bw, mlTable, mlc, mlState)
+		llState = transition(&bw, llTable, llc, llState)
+		extra(s, llc, mlc, ofc, ov)
+	}
+	bw.add(uint64(mlState), uint(mlTable.accLog))
+	bw.add(uint64(ofState), uint(ofTable.accLog))
+	bw.add(uint64(llState), uint(llTable.accLog))
+	return bw.close()
+}
+
+// transition picks the state decoding sym from which the decoder moves to
+// next, writes the bits that move it there and returns the picked state.
+func transition(bw *bitWriter, t *fseTable, sym uint8, next uint16) uint16 {
+	u := t.enc[sym][next]
+	st := t.states[u]
+	bw.add(uint64(next-st.baseline), uint(st.nbBits))
+	return u
+}
+
+func hash4(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - hashLog)
+}
+
+// bitWriter packs bits little-endian; the decoder reads them back from the
+// end, after the closing marker bit.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (b *bitWriter) add(v uint64, n uint) {
+	b.acc |= (v & (1<<n - 1)) << b.n
+	b.n += n
+	for b.n >= 8 {
+		b.out = append(b.out, byte(b.acc))
+		b.acc >>= 8
+		b.n -= 8
+	}
+}
+
+func (b *bitWriter) close() []byte {
+	b.add(1, 1)
+	if b.n > 0 {
+		b.out = append(b.out, byte(b.acc))
+	}
+	return b.out
+}
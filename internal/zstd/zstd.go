@@ -0,0 +1,173 @@
+// Package zstd reads and writes Zstandard frames (RFC 8878) without
+// external dependencies, for storing cached archives compressed at rest.
+//
+// The Writer emits standard frames that any zstd decoder accepts: blocks of
+// LZ77 sequences coded with the predefined FSE tables and raw literals, or
+// raw blocks where that does not pay off. The Reader decodes what the
+// Writer produces plus raw and RLE literals and RLE sequence tables; frames
+// using Huffman literals or custom FSE tables, as produced by the reference
+// encoder, are rejected with ErrUnsupported.
+package zstd
+
+import (
+	"errors"
+	"math/bits"
+)
+
+const (
+	frameMagic     = 0xFD2FB528
+	skippableMagic = 0x184D2A50 // low nibble is free
+
+	windowLog    = 20
+	windowSize   = 1 << windowLog
+	maxBlockSize = 128 << 10
+)
+
+// Block types.
+const (
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+var (
+	// ErrCorrupt reports malformed compressed data.
+	ErrCorrupt = errors.New("zstd: corrupt input")
+	// ErrUnsupported reports a valid frame using features this package
+	// does not decode.
+	ErrUnsupported = errors.New("zstd: unsupported feature")
+)
+
+// Literal length codes: baseline and extra bits (RFC 8878 3.1.1.3.2.1.1).
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+)
+
+// Match length codes.
+var (
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Predefined FSE distributions (RFC 8878 3.1.1.3.2.2); -1 marks a
+// "less than one" probability.
+var (
+	llDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	llTable = newFSETable(llDefault, 6)
+	mlTable = newFSETable(mlDefault, 6)
+	ofTable = newFSETable(ofDefault, 5)
+)
+
+// fseState is one decoding table entry.
+type fseState struct {
+	sym      uint8
+	nbBits   uint8
+	baseline uint16
+}
+
+// fseTable is a decoding table plus, for the encoder, the inverse mapping:
+// enc[sym][next] is the state that decodes sym and moves to next.
+type fseTable struct {
+	accLog uint8
+	states []fseState
+	enc    [][]uint16
+}
+
+// newFSETable builds the decoding table for a normalized distribution as
+// specified in RFC 8878 4.1.1.
+func newFSETable(norm []int16, accLog uint8) *fseTable {
+	size := 1 << accLog
+	t := &fseTable{accLog: accLog, states: make([]fseState, size)}
+	next := make([]int, len(norm))
+	high := size - 1
+	for s, p := range norm {
+		if p == -1 {
+			t.states[high].sym = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(p)
+		}
+	}
+	pos, step, mask := 0, (size>>1)+(size>>3)+3, size-1
+	for s, p := range norm {
+		for i := 0; i < int(p); i++ {
+			t.states[pos].sym = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	t.enc = make([][]uint16, len(norm))
+	for s := range t.enc {
+		t.enc[s] = make([]uint16, size)
+	}
+	for u := range t.states {
+		st := &t.states[u]
+		n := next[st.sym]
+		next[st.sym]++
+		st.nbBits = accLog - uint8(bits.Len(uint(n))-1)
+		st.baseline = uint16(n<<st.nbBits - size)
+		for v := int(st.baseline); v < int(st.baseline)+1<<st.nbBits; v++ {
+			t.enc[st.sym][v] = uint16(u)
+		}
+	}
+	return t
+}
+
+func llCode(ll uint32) uint8 {
+	if ll < 16 {
+		return uint8(ll)
+	}
+	c := uint8(len(llBase) - 1)
+	for llBase[c] > ll {
+		c--
+	}
+	return c
+}
+
+func mlCode(ml uint32) uint8 {
+	if ml < 35 {
+		return uint8(ml - 3)
+	}
+	c := uint8(len(mlBase) - 1)
+	for mlBase[c] > ml {
+		c--
+	}
+	return c
+}
@@ -0,0 +1,99 @@
+package zstd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func compress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for p := data; len(p) > 0; {
+		n := min(len(p), 10000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	rng.Read(random)
+	var mixed []byte
+	for len(mixed) < 3<<20 {
+		if rng.Intn(2) == 0 {
+			mixed = append(mixed, random[rng.Intn(1000):][:rng.Intn(300)]...)
+		} else {
+			mixed = append(mixed, byte(rng.Intn(256)))
+		}
+	}
+	cases := []struct {
+		name   string
+		data   []byte
+		shrink bool
+	}{
+		{"empty", nil, false},
+		{"short", []byte("hello"), false},
+		{"repetitive", bytes.Repeat([]byte("github-hub "), 50000), true},
+		{"random", random, false},
+		{"mixed", mixed, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			z := compress(t, tc.data)
+			if tc.shrink && len(z) >= len(tc.data)/2 {
+				t.Fatalf("compressed %d bytes to %d", len(tc.data), len(z))
+			}
+			got, err := io.ReadAll(NewReader(bytes.NewReader(z)))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(tc.data))
+			}
+		})
+	}
+}
+
+func TestReader_ConcatenatedAndSkippableFrames(t *testing.T) {
+	var in []byte
+	in = append(in, compress(t, []byte("first "))...)
+	in = append(in, 0x5A, 0x2A, 0x4D, 0x18, 3, 0, 0, 0, 'x', 'y', 'z')
+	in = append(in, compress(t, []byte("second"))...)
+	got, err := io.ReadAll(NewReader(bytes.NewReader(in)))
+	if err != nil || string(got) != "first second" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestReader_Errors(t *testing.T) {
+	z := compress(t, bytes.Repeat([]byte("abc"), 1000))
+	cases := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"bad magic", []byte("PK\x03\x04"), ErrCorrupt},
+		{"truncated", z[:len(z)-2], io.ErrUnexpectedEOF},
+		// Single-segment frame, one compressed block with Huffman literals.
+		{"huffman", []byte{0x28, 0xB5, 0x2F, 0xFD, 0x20, 0x10, 0x0D, 0x00, 0x00, 0x02}, ErrUnsupported},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := io.ReadAll(NewReader(bytes.NewReader(tc.in)))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package ghhub_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github-hub/pkg/ghhub"
+)
+
+func ExampleNewStorage() {
+	root, err := os.MkdirTemp("", "ghhub")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	st := ghhub.NewStorage(root,
+		ghhub.WithLayout(ghhub.LayoutShared),
+		ghhub.WithDownloadTimeout(10*time.Minute),
+	)
+	st.KeepPrevious = 2
+	fmt.Println(st.Layout, st.HTTPClient.Timeout)
+	// Output: shared 10m0s
+}
+
+func ExampleStorage_EnsureRepo() {
+	st := ghhub.NewStorage("/var/cache/ghh")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Downloads owner/repo@main unless the cached archive is still current.
+	zipPath, err := st.EnsureRepo(ctx, "ci", "owner/repo", "main", os.Getenv("GITHUB_TOKEN"), false, false)
+	switch {
+	case errors.Is(err, ghhub.ErrRepoNotFound), errors.Is(err, ghhub.ErrBranchNotFound):
+		fmt.Println("no such branch")
+	case err != nil:
+		log.Fatal(err)
+	default:
+		fmt.Println("archive at", zipPath)
+	}
+}
+
+func ExampleNewServerWithOptions() {
+	st := ghhub.NewStorage("/var/cache/ghh", ghhub.WithUserAgent("my-service/1.0"))
+	srv := ghhub.NewServerWithOptions(st,
+		ghhub.WithToken(os.Getenv("GITHUB_TOKEN")),
+		ghhub.WithAuth([]ghhub.APIKey{{Key: "secret", User: "ci"}}),
+		ghhub.WithLimits(ghhub.Limits{DownloadTimeout: 10 * time.Minute}),
+	)
+	defer srv.Shutdown()
+	srv.SetMetrics(ghhub.NewMetricsRegistry())
+
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
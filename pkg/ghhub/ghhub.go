@@ -0,0 +1,251 @@
+// Package ghhub is the public API of github-hub for programs that embed the
+// archive cache or the HTTP server instead of running ghh-server.
+//
+// The implementation stays in internal/storage and internal/server, which
+// the ghh and ghh-server binaries keep using directly; ghhub re-exports the
+// supported part of it. The types below are aliases, so values move freely
+// between ghhub and the binaries' packages, and the errors are the same
+// values, so errors.Is works whichever package an error came from.
+//
+// # Compatibility
+//
+// What is declared in this package follows semantic versioning: the names,
+// signatures and error values declared here only change in a new major
+// version. Through the aliases, Storage and Server also expose methods and
+// fields that are not declared here; of those, the exported methods listed
+// in this file's type docs and the Storage fields documented as
+// configuration are covered as well. Everything else reachable through the
+// aliases may change in any release.
+//
+// Storage is configured by setting its fields after NewStorage, or by
+// passing Options. The HTTP client and its transport are options
+// (WithHTTPClient, WithTransport) because they are chosen once, before the
+// first download. DebugSlowReader is a test
+// hook for simulating slow networks and is not part of the API.
+package ghhub
+
+import (
+	"crypto/ed25519"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/server"
+	"github-hub/internal/storage"
+)
+
+// Storage caches GitHub repository archives and package downloads under
+// a root directory. Its supported methods are EnsureRepo,
+// EnsureRepoResult, EnsurePackage, List, ListPage, ListFunc, Delete, Touch,
+// CleanupExpired, ReadArchiveMeta, OpenArchive, RemoveArchive,
+// ArchiveSignature, ImportRepoArchive, RecentDownloads, UpstreamHealth,
+// UpstreamCircuit and Counters.
+// Its supported configuration fields are Root, RetryMax, RetryBackoff,
+// DefaultBranchTTL, CommitsTTL, StalePolicy, StrictVerification, Retention,
+// KeepPrevious, CompressArchives, UserAgent, Layout, TempDir, SpaceReserve,
+// Clock, Fetcher, Keys, Signer, SlowDownloadThreshold, SlowDownloadRecovery,
+// DownloadObserver, Redirects, PackageHostCheck, CircuitThreshold,
+// CircuitCooldown, APICallTimeout, BranchLookup and ArchiveLagBackoff.
+type Storage = storage.Storage
+
+// Entry is one file or directory returned by Storage.List.
+type Entry = storage.Entry
+
+// ListOptions pages Storage.ListPage: a limit and the continuation token
+// of the previous page, in name order.
+type ListOptions = storage.ListOptions
+
+// NormalizeRepo turns a repository spelling such as a github.com URL or a
+// name with a .git suffix into owner/repo, or fails with ErrBadPath.
+func NormalizeRepo(repo string) (string, error) {
+	return storage.NormalizeRepo(repo)
+}
+
+// RepoArchive describes an archive ensured by Storage.EnsureRepoResult.
+type RepoArchive = storage.RepoArchive
+
+// ArchiveMeta is the metadata sidecar of a cached archive.
+type ArchiveMeta = storage.ArchiveMeta
+
+// CacheLayout decides where repo archives are cached.
+type CacheLayout = storage.CacheLayout
+
+// CacheOutcome describes how a request for a cached archive was satisfied.
+type CacheOutcome = storage.CacheOutcome
+
+// Counters is a snapshot of storage-level activity.
+type Counters = storage.Counters
+
+// Clock is the time source of a Storage.
+type Clock = storage.Clock
+
+// RemoteFetcher is where a Storage resolves branches and fetches archives
+// in legacy mode; the default is GitHub.
+type RemoteFetcher = storage.RemoteFetcher
+
+// KeyProvider supplies the keys a Storage encrypts archives and packages
+// with at rest.
+type KeyProvider = storage.KeyProvider
+
+// KeyRing is a KeyProvider holding a current key and previous ones.
+type KeyRing = storage.KeyRing
+
+// NewKeyRing returns a KeyRing encrypting with the 32-byte key current and
+// still decrypting files written under the previous keys.
+func NewKeyRing(current []byte, previous ...[]byte) (*KeyRing, error) {
+	return storage.NewKeyRing(current, previous...)
+}
+
+// LoadKeyRing is NewKeyRing with the keys read from files.
+func LoadKeyRing(currentFile string, previousFiles ...string) (*KeyRing, error) {
+	return storage.LoadKeyRing(currentFile, previousFiles...)
+}
+
+// SigningKeys signs archives with a current Ed25519 key and publishes the
+// public keys of it and of rotated-out ones.
+type SigningKeys = storage.SigningKeys
+
+// SigningPublicKey is a verification key as published to consumers.
+type SigningPublicKey = storage.SigningPublicKey
+
+// ArchiveSignature is the detached signature of a cached archive: Ed25519
+// over the archive's SHA-256 digest.
+type ArchiveSignature = storage.ArchiveSignature
+
+// NewSigningKeys returns SigningKeys signing with current and still
+// publishing the previous public keys.
+func NewSigningKeys(current ed25519.PrivateKey, previous ...ed25519.PublicKey) (*SigningKeys, error) {
+	return storage.NewSigningKeys(current, previous...)
+}
+
+// LoadSigningKeys is NewSigningKeys with the keys read from PEM or seed
+// files.
+func LoadSigningKeys(currentFile string, previousFiles ...string) (*SigningKeys, error) {
+	return storage.LoadSigningKeys(currentFile, previousFiles...)
+}
+
+// StalePolicy chooses what happens when a branch's upstream commit cannot
+// be fetched.
+type StalePolicy = storage.StalePolicy
+
+// BranchLookup picks the GitHub API call that resolves a branch head.
+type BranchLookup = storage.BranchLookup
+
+// RetentionPolicy caps the archives kept per user and repo.
+type RetentionPolicy = storage.RetentionPolicy
+
+// DownloadRecord describes one upstream download (see
+// Storage.RecentDownloads).
+type DownloadRecord = storage.DownloadRecord
+
+// UpstreamHealth is the slow-download alert state.
+type UpstreamHealth = storage.UpstreamHealth
+
+// CircuitStatus is the state of the upstream circuit (see
+// Storage.UpstreamCircuit).
+type CircuitStatus = storage.CircuitStatus
+
+// TransportOptions tunes the connection pool of the default upstream
+// client (see WithTransport).
+type TransportOptions = storage.TransportOptions
+
+// DefaultTransportOptions returns the pool settings of the default client.
+func DefaultTransportOptions() TransportOptions { return storage.DefaultTransportOptions() }
+
+// RedirectPolicy limits the redirects package downloads follow.
+type RedirectPolicy = storage.RedirectPolicy
+
+// DefaultRedirectPolicy returns the redirect policy NewStorage installs.
+func DefaultRedirectPolicy() RedirectPolicy { return storage.DefaultRedirectPolicy() }
+
+// PackageMirrors rewrites package URLs to internal mirrors.
+type PackageMirrors = storage.PackageMirrors
+
+// NewPackageMirrors parses "match=base[ fallback]" mirror rules.
+func NewPackageMirrors(rules []string) (*PackageMirrors, error) {
+	return storage.NewPackageMirrors(rules)
+}
+
+// PackagePolicy decides which package URLs may be downloaded.
+type PackagePolicy = storage.PackagePolicy
+
+// NewPackagePolicy compiles package URL allow and deny rules.
+func NewPackagePolicy(allow, deny []string, defaultAllow bool) (*PackagePolicy, error) {
+	return storage.NewPackagePolicy(allow, deny, defaultAllow)
+}
+
+// CacheFormat is the on-disk cache format this version writes; run
+// Storage.MigrateFormat on a cache root before serving from it.
+const CacheFormat = storage.CacheFormat
+
+// FormatMigration is a cache format migration Storage.MigrateFormat ran.
+type FormatMigration = storage.FormatMigration
+
+const (
+	LayoutPerUser = storage.LayoutPerUser
+	LayoutShared  = storage.LayoutShared
+
+	CacheHit         = storage.CacheHit
+	CacheRevalidated = storage.CacheRevalidated
+	CacheMiss        = storage.CacheMiss
+	CacheStale       = storage.CacheStale
+
+	PreferFresh = storage.PreferFresh
+	PreferCache = storage.PreferCache
+	StaleFail   = storage.StaleFail
+)
+
+// Errors returned by Storage, usually wrapped; test for them with
+// errors.Is.
+var (
+	ErrBadPath              = storage.ErrBadPath
+	ErrNotFound             = storage.ErrNotFound
+	ErrRepoNotFound         = storage.ErrRepoNotFound
+	ErrBranchNotFound       = storage.ErrBranchNotFound
+	ErrBranchGone           = storage.ErrBranchGone
+	ErrEmptyRepo            = storage.ErrEmptyRepo
+	ErrRateLimited          = storage.ErrRateLimited
+	ErrUnverified           = storage.ErrUnverified
+	ErrUnverifiable         = storage.ErrUnverifiable
+	ErrPolicyDenied         = storage.ErrPolicyDenied
+	ErrChecksumMismatch     = storage.ErrChecksumMismatch
+	ErrInsufficientSpace    = storage.ErrInsufficientSpace
+	ErrTooLarge             = storage.ErrTooLarge
+	ErrExists               = storage.ErrExists
+	ErrKeyUnavailable       = storage.ErrKeyUnavailable
+	ErrSigningDisabled      = storage.ErrSigningDisabled
+	ErrBadPageToken         = storage.ErrBadPageToken
+	ErrUpstreamUnavailable  = storage.ErrUpstreamUnavailable
+	ErrUnauthorizedUpstream = storage.ErrUnauthorizedUpstream
+	ErrRedirectPolicy       = storage.ErrRedirectPolicy
+	ErrFormatTooNew         = storage.ErrFormatTooNew
+	ErrAPIResponseTooLarge  = storage.ErrAPIResponseTooLarge
+	ErrArchiveUnavailable   = storage.ErrArchiveUnavailable
+)
+
+// Error types carrying details; use errors.As.
+type (
+	NotFoundError            = storage.NotFoundError
+	RateLimitError           = storage.RateLimitError
+	BranchGoneError          = storage.BranchGoneError
+	StaleError               = storage.StaleError
+	UnverifiableError        = storage.UnverifiableError
+	SpaceError               = storage.SpaceError
+	CircuitOpenError         = storage.CircuitOpenError
+	StatusError              = storage.StatusError
+	APIResponseTooLargeError = storage.APIResponseTooLargeError
+	ArchiveUnavailableError  = storage.ArchiveUnavailableError
+)
+
+// Server is the ghh-server HTTP API. Its supported methods are
+// RegisterRoutes, SetAuth, SetMetrics, SetSigning and Shutdown.
+type Server = server.Server
+
+// MetricsRegistry collects the metrics a Server exposes on /metrics.
+type MetricsRegistry = metrics.Registry
+
+// Store is what a Server serves archives from; *Storage implements it.
+// Methods may be added to Store in minor releases, so implementations
+// outside this module should embed a *Storage or expect to be updated.
+type Store = server.Store
+
+// APIKey maps an API key to the user it authenticates.
+type APIKey = server.APIKey
@@ -0,0 +1,86 @@
+package ghhub
+
+import (
+	"net/http"
+	"time"
+
+	"github-hub/internal/storage"
+)
+
+type options struct {
+	client    *http.Client
+	timeout   time.Duration
+	layout    CacheLayout
+	clock     Clock
+	userAgent string
+	fetcher   RemoteFetcher
+	transport *TransportOptions
+}
+
+// Option configures a Storage created by NewStorage.
+type Option func(*options)
+
+// WithHTTPClient makes the Storage send GitHub and package requests through
+// c instead of its default client.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) { o.client = c }
+}
+
+// WithDownloadTimeout limits each upstream request of the default client to
+// d. It is ignored together with WithHTTPClient.
+func WithDownloadTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithTransport tunes the connection pool of the default client, which
+// GitHub API calls, archive downloads and package fetches share. It is
+// ignored together with WithHTTPClient.
+func WithTransport(t TransportOptions) Option {
+	return func(o *options) { o.transport = &t }
+}
+
+// WithLayout chooses where repo archives are cached.
+func WithLayout(l CacheLayout) Option {
+	return func(o *options) { o.layout = l }
+}
+
+// WithClock replaces the real clock, mostly for tests.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithUserAgent sets the User-Agent sent upstream.
+func WithUserAgent(ua string) Option {
+	return func(o *options) { o.userAgent = ua }
+}
+
+// WithFetcher replaces GitHub as the source of branches and archives, for
+// tests or other hosts.
+func WithFetcher(f RemoteFetcher) Option {
+	return func(o *options) { o.fetcher = f }
+}
+
+// NewStorage creates a Storage caching under root. The documented
+// configuration fields may also be set directly before first use.
+func NewStorage(root string, opts ...Option) *Storage {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := storage.NewWithTimeout(root, o.timeout)
+	if o.transport != nil {
+		s.SetTransport(*o.transport)
+	}
+	if o.client != nil {
+		s.HTTPClient = o.client
+	}
+	if o.layout != "" {
+		s.Layout = o.layout
+	}
+	if o.clock != nil {
+		s.Clock = o.clock
+	}
+	s.UserAgent = o.userAgent
+	s.Fetcher = o.fetcher
+	return s
+}
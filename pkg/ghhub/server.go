@@ -0,0 +1,71 @@
+package ghhub
+
+import (
+	"log"
+	"time"
+
+	"github-hub/internal/metrics"
+	"github-hub/internal/server"
+)
+
+// NewServer creates a Server caching under root with the built-in Storage,
+// as ghh-server does. Requests without an API key act as defaultUser, and
+// token authenticates upstream GitHub requests. Call Shutdown to stop its
+// background work.
+func NewServer(root, defaultUser, token string, downloadTimeout time.Duration) (*Server, error) {
+	return server.NewServer(root, defaultUser, token, downloadTimeout)
+}
+
+// ServerOption configures a Server created by NewServerWithOptions.
+type ServerOption = server.Option
+
+// Limits bounds what requests to a Server may cost; see WithLimits.
+type Limits = server.Limits
+
+// NewServerWithOptions creates a Server that serves from store, for example
+// a Storage configured with NewStorage. Server settings that configure the
+// built-in storage only apply when store is a *Storage. Call Shutdown to
+// stop its background work.
+func NewServerWithOptions(store Store, opts ...ServerOption) *Server {
+	return server.New(store, opts...)
+}
+
+// WithDefaultUser names the user of requests without an API key while auth
+// is disabled (default "default").
+func WithDefaultUser(user string) ServerOption {
+	return server.WithDefaultUser(user)
+}
+
+// WithToken authenticates upstream GitHub requests that bring no token.
+func WithToken(token string) ServerOption {
+	return server.WithToken(token)
+}
+
+// WithLogger sends the Server's log lines to l instead of stdout.
+func WithLogger(l *log.Logger) ServerOption {
+	return server.WithLogger(l)
+}
+
+// WithAuth requires one of keys on every request, as Server.SetAuth.
+func WithAuth(keys []APIKey) ServerOption {
+	return server.WithAuth(keys)
+}
+
+// WithLimits overrides the request timeouts and size caps set in l; zero
+// fields keep the defaults.
+func WithLimits(l Limits) ServerOption {
+	return server.WithLimits(l)
+}
+
+// NewServerWithStore creates a Server that serves from store.
+//
+// Deprecated: use NewServerWithOptions(store, WithToken(token),
+// WithDefaultUser(defaultUser)).
+func NewServerWithStore(store Store, token, defaultUser string) *Server {
+	return server.NewServerWithStore(store, token, defaultUser)
+}
+
+// NewMetricsRegistry returns an empty registry for Server.SetMetrics.
+func NewMetricsRegistry() *MetricsRegistry {
+	return metrics.NewRegistry()
+}